@@ -3,34 +3,91 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 
+	"github.com/sbox-project/sbox/internal/api"
+	"github.com/sbox-project/sbox/internal/archive"
+	"github.com/sbox-project/sbox/internal/audit"
+	"github.com/sbox-project/sbox/internal/bench"
 	"github.com/sbox-project/sbox/internal/builder"
 	"github.com/sbox-project/sbox/internal/cache"
+	"github.com/sbox-project/sbox/internal/compat"
+	"github.com/sbox-project/sbox/internal/compose"
 	"github.com/sbox-project/sbox/internal/config"
 	"github.com/sbox-project/sbox/internal/console"
+	"github.com/sbox-project/sbox/internal/dockerfile"
+	"github.com/sbox-project/sbox/internal/doctor"
+	"github.com/sbox-project/sbox/internal/githooks"
+	"github.com/sbox-project/sbox/internal/gpu"
+	"github.com/sbox-project/sbox/internal/healthcheck"
+	"github.com/sbox-project/sbox/internal/ide"
+	"github.com/sbox-project/sbox/internal/inspect"
+	"github.com/sbox-project/sbox/internal/leakcheck"
+	"github.com/sbox-project/sbox/internal/licenses"
+	"github.com/sbox-project/sbox/internal/lockfile"
+	"github.com/sbox-project/sbox/internal/modulefile"
+	"github.com/sbox-project/sbox/internal/nesting"
+	"github.com/sbox-project/sbox/internal/pack"
 	"github.com/sbox-project/sbox/internal/process"
+	"github.com/sbox-project/sbox/internal/profile"
+	"github.com/sbox-project/sbox/internal/registry"
+	"github.com/sbox-project/sbox/internal/relocate"
+	"github.com/sbox-project/sbox/internal/remote"
+	"github.com/sbox-project/sbox/internal/repro"
+	"github.com/sbox-project/sbox/internal/runbook"
 	"github.com/sbox-project/sbox/internal/runner"
+	sboxruntime "github.com/sbox-project/sbox/internal/runtime"
+	"github.com/sbox-project/sbox/internal/secrets"
+	"github.com/sbox-project/sbox/internal/shim"
+	"github.com/sbox-project/sbox/internal/slurm"
+	"github.com/sbox-project/sbox/internal/sysproc"
+	"github.com/sbox-project/sbox/internal/templates"
+	"github.com/sbox-project/sbox/internal/trash"
 	"github.com/sbox-project/sbox/internal/validate"
+	"github.com/sbox-project/sbox/internal/vcs"
+	"github.com/sbox-project/sbox/internal/watch"
 )
 
-const version = "0.4.0"
+const version = config.Version
 
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "sbox",
 		Short: "A rootless, user-space sandbox runtime",
 		Long:  "sbox - Docker-like workflow without sudo.\nA rootless, user-space sandbox runtime for Python and Node.js applications.",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			applyOutputFormat(cmd)
+			applyProfile(cmd)
+			applySharedUmask()
+			checkNested(cmd)
+		},
 	}
+	rootCmd.PersistentFlags().String("output", "", "Output format: text or json (default $"+console.OutputEnv+" or text)")
+	rootCmd.PersistentFlags().String("log-format", "", "Same as --output, for commands with an --output file flag")
+	rootCmd.PersistentFlags().String("profile", "", "Config profile to use, e.g. prod (default $"+config.ProfileEnv+")")
+	rootCmd.PersistentFlags().String("daemon-socket", "", "Send build, run and stop to the sbox daemon on this socket (default $"+api.SocketEnv+")")
+	rootCmd.PersistentFlags().Bool("allow-nested", false, "Allow entering another project's sandbox from inside a sandbox (default $"+nesting.AllowEnv+")")
 
 	// Version command
 	rootCmd.AddCommand(&cobra.Command{
@@ -45,21 +102,60 @@ func main() {
 	initCmd := &cobra.Command{
 		Use:   "init <project_name>",
 		Short: "Initialize a new sbox project",
-		Args:  cobra.ExactArgs(1),
-		Run:   runInit,
-	}
-	initCmd.Flags().StringP("runtime", "r", "python:3.10", "Runtime to use (python:X.Y or node:X)")
-	initCmd.Flags().BoolP("force", "f", false, "Overwrite existing project")
+		Long: `Initialize a new sbox project in ./<project_name> with sample app files.
+
+Use --template to start from a project template (fastapi, express,
+ml-notebook, or your own in ~/.sbox/templates) with its runtime, install
+commands and starter files; --list-templates shows them all.
+
+Use --bare to add sbox to an existing directory (default: the current one):
+only .sbox/config.yaml is created; no app/, samples or .gitignore changes.
+Its requirements.txt, pyproject.toml, environment.yml, package.json or
+pnpm-lock.yaml pick the install commands, cmd and, without --runtime,
+the runtime.
+
+Use --from-dockerfile to migrate a project built with Docker: the
+Dockerfile's FROM picks the runtime, COPY and ADD become copy specs, RUN
+install commands, and ENV, ARG, EXPOSE, WORKDIR, CMD and ENTRYPOINT carry
+over. The directory (default: the current one) is the build context.
+Instructions that have no sandbox equivalent, such as apt-get installs or
+USER, are reported and skipped.
+
+sbox's local state is added to the project's .gitignore, or to the
+.hgignore of a Mercurial repository it is created in, and later builds
+offer to add new state. --no-vcs skips both and sets vcs: none.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runInit,
+	}
+	initCmd.Flags().StringP("runtime", "r", "python:3.10", "Runtime to use (python:X.Y, node:X, go:X.Y, java:X, ruby:X.Y or rust:X.Y)")
+	initCmd.Flags().BoolP("force", "f", false, "Overwrite existing project (moved to the trash)")
+	initCmd.Flags().BoolP("yes", "y", false, "Do not ask before overwriting with --force")
+	initCmd.Flags().Bool("bare", false, "Only create .sbox/config.yaml in an existing directory")
+	initCmd.Flags().StringP("template", "t", "", "Start from a project template (see --list-templates)")
+	initCmd.Flags().Bool("list-templates", false, "List the available project templates")
+	initCmd.Flags().Bool("no-vcs", false, "Do not create or change .gitignore or .hgignore, now or later")
+	initCmd.Flags().String("from-dockerfile", "", "Create the config from this Dockerfile, in an existing directory")
 	rootCmd.AddCommand(initCmd)
 
 	// Build command
 	buildCmd := &cobra.Command{
 		Use:   "build",
 		Short: "Build the sandbox environment",
-		Run:   runBuild,
+		Long: `Build the sandbox environment.
+
+--build-arg overrides an arg declared under args: in config.yaml, which
+install commands and copy specs reference as ${NAME}. The values are
+recorded in sbox.lock and kept by later builds until overridden again.`,
+		Example: `  sbox build
+  sbox build --build-arg TORCH_VERSION=2.3.0 --build-arg EXTRAS=dev`,
+		Run: runBuild,
 	}
 	buildCmd.Flags().BoolP("force", "f", false, "Force rebuild even if up to date")
 	buildCmd.Flags().BoolP("verbose", "v", false, "Show detailed build output")
+	buildCmd.Flags().Bool("frozen", false, "Install exactly the package versions recorded in sbox.lock")
+	buildCmd.Flags().Bool("offline", false, "Build from cached runtimes and vendored packages only, failing if the network is needed")
+	buildCmd.Flags().Bool("no-network", false, "Same as --offline")
+	buildCmd.Flags().StringArray("build-arg", nil, "Override a build arg declared in config.yaml (NAME=VALUE, repeatable)")
 	rootCmd.AddCommand(buildCmd)
 
 	// Run command
@@ -69,27 +165,174 @@ func main() {
 		Long: `Run the application in the sandbox environment.
 
 If no command is provided, uses the default command from config.yaml.
-Use --detach to run as a background daemon with logging.`,
+Use --detach to run as a background daemon with logging.
+
+With --remote the sandbox runs on a host added with 'sbox remote add':
+it is packed, uploaded over SSH (rsync when both hosts have it, so an
+interrupted upload resumes, scp otherwise), extracted and relocated with
+'sbox unpack' under ~/sbox-remote/<project> there, and run with its
+output streamed back. sbox exits with the command's exit code. The host
+needs sbox and the same platform; each run replaces the remote tree, so
+results belong in mounts or paths outside it.
+
+  sbox remote add lab alice@gpu01.lab.example.org
+  sbox run --remote lab -- python train.py --epochs 10
+
+--metrics prints the wall time, CPU time, peak memory (max RSS) and exit
+code of a foreground run once it exits; --metrics-json writes them as
+JSON for batch scripts. CPU time and peak memory come from the kernel's
+accounting of the command and the processes it waited for.
+
+  sbox run --metrics-json metrics.json -- python train.py`,
 		Run: runRun,
 	}
 	runCmd.Flags().BoolP("detach", "d", false, "Run in background as daemon")
 	runCmd.Flags().StringP("name", "n", "", "Name for the daemon process (default: project name)")
+	runCmd.Flags().Duration("idle-timeout", 0, "Stop the daemon after this long without log output or TCP connections (overrides idle_timeout)")
+	runCmd.Flags().String("restart", process.RestartNo, "Restart policy for daemons: no, always or on-failure[:max-retries]")
+	runCmd.Flags().StringArray("env-file", nil, "Load variables from a .env file (repeatable; env in config.yaml takes precedence)")
+	runCmd.Flags().BoolP("tty", "t", false, "Run the command on a new pseudo-terminal (for interactive programs)")
+	runCmd.Flags().String("remote", "", "Run on a remote host added with 'sbox remote add'")
+	runCmd.Flags().Bool("metrics", false, "Print wall time, CPU time, peak memory and exit code when the command exits")
+	runCmd.Flags().String("metrics-json", "", "Write the metrics of the run as JSON to a file (- for stdout)")
+	addLogRotationFlags(runCmd)
 	rootCmd.AddCommand(runCmd)
 
+	// Remote command group
+	remoteCmd := &cobra.Command{
+		Use:   "remote",
+		Short: "Manage hosts for 'sbox run --remote'",
+		Long: `Manage the hosts sandboxes can run on with 'sbox run --remote'.
+
+Remotes are reached with the system ssh, so ~/.ssh/config, agents and
+jump hosts apply; a password or second factor is asked for once per run.
+They are kept in ~/.sbox/remotes.yaml.`,
+	}
+	remoteAddCmd := &cobra.Command{
+		Use:   "add <name> <user@host>",
+		Short: "Add a remote host (or replace one)",
+		Args:  cobra.ExactArgs(2),
+		Run:   runRemoteAdd,
+	}
+	remoteAddCmd.Flags().IntP("port", "p", 0, "SSH port")
+	remoteAddCmd.Flags().StringP("identity", "i", "", "SSH private key")
+	remoteAddCmd.Flags().String("dir", "", "Directory the sandboxes are unpacked in (default: ~/"+remote.DefaultDir+")")
+	remoteAddCmd.Flags().String("sbox", "", "sbox binary on the host (default: sbox from PATH)")
+	remoteCmd.AddCommand(remoteAddCmd)
+	remoteListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List remote hosts",
+		Run:   runRemoteList,
+	}
+	remoteListCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+	remoteCmd.AddCommand(remoteListCmd)
+	remoteCmd.AddCommand(&cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove a remote host",
+		Args:  cobra.ExactArgs(1),
+		Run:   runRemoteRemove,
+	})
+	rootCmd.AddCommand(remoteCmd)
+
 	// Shell command
-	rootCmd.AddCommand(&cobra.Command{
+	shellCmd := &cobra.Command{
 		Use:   "shell",
 		Short: "Start an interactive shell in the sandbox",
-		Run:   runShell,
-	})
+		Long: `Start an interactive shell in the sandbox.
+
+With --pure the shell gets only the environment sbox constructs: PATH is
+the environment's bin directory without /usr/bin and /bin, and host
+variables such as DISPLAY, SSH_AUTH_SOCK and USER are not passed. A
+command that fails there depends on something the host provides, which
+a packed archive will not carry.
+
+The shell (--shell, or $SHELL when it is bash, zsh or fish) starts with an
+rc file sbox writes to .sbox/shell instead of the user's ~/.bashrc,
+~/.zshrc or fish config, so nothing there changes PATH or activates conda
+environments. The prompt shows (sbox:<project>) and history is kept in the
+sandbox home, .sbox/rootfs/home. On Windows the shell is PowerShell (or
+--shell pwsh or cmd), started with -NoProfile and a profile of sbox.`,
+		Run: runShell,
+	}
+	shellCmd.Flags().StringArray("env-file", nil, "Load variables from a .env file (repeatable; env in config.yaml takes precedence)")
+	shellCmd.Flags().Bool("pure", false, "Start with only the sandbox environment (no system PATH entries or host variables)")
+	shellCmd.Flags().String("shell", "", "Shell to start: bash, zsh or fish (default: $SHELL if one of them, else bash); on Windows powershell, pwsh or cmd")
+	rootCmd.AddCommand(shellCmd)
+
+	// Which command - binary resolution diagnostics
+	whichCmd := &cobra.Command{
+		Use:   "which [name...]",
+		Short: "Show which binary a command resolves to in the sandbox and on the host",
+		Long: `Show where each name resolves on the PATH of the sandbox, which
+'sbox run', 'exec' and 'shell' use, and on the host PATH, with every
+shadowed match. Without names, the runtime's binary (e.g. python).
+
+Warnings point out a binary that resolves outside the environment (e.g. the
+system python from a host directory of path_mode), a symlink or script
+interpreter leading out of it, and names only the host has. The exit status
+is 1 when a name does not resolve in the sandbox.`,
+		Example: `  sbox which
+  sbox which python pip pytest
+  sbox which --pure node`,
+		Run: runWhich,
+	}
+	whichCmd.Flags().Bool("pure", false, "Resolve on the PATH of 'sbox shell --pure'")
+	whichCmd.Flags().Bool("json", false, "Output as JSON")
+	rootCmd.AddCommand(whichCmd)
 
 	// Exec command
-	rootCmd.AddCommand(&cobra.Command{
+	execCmd := &cobra.Command{
 		Use:   "exec <command> [args...]",
 		Short: "Execute a command in the sandbox",
-		Args:  cobra.MinimumNArgs(1),
-		Run:   runExec,
-	})
+		Long: `Execute a command with arguments in the sandbox, without a shell.
+
+As with docker exec, -i passes stdin to the command and -t runs it on a
+pseudo-terminal. At a terminal stdin is passed unless --interactive=false;
+from scripts and pipes the command gets no input without -i, so it cannot
+consume input meant for the script.
+
+  echo 'print(1 + 1)' | sbox exec -i python
+  sbox exec -it ipython
+
+Use --detach to run a one-shot job in the background. It is tracked like a
+daemon under --name: 'sbox ps' lists it, 'sbox logs <name>' shows its
+output and 'sbox stop <name>' stops it.
+
+  sbox exec -d --name train python train.py --epochs 10
+
+Use --all to run the command in every service of compose.yaml, one after
+another in dependency order, or all at once with --parallel. --label keeps
+the services with a label (key=value, or key for any value). Output lines
+are prefixed with the service name, and the exit status is that of the
+first service that failed.
+
+  sbox exec --all -- python --version
+  sbox exec --label tier=db -- python manage.py migrate
+
+--project runs the command in another project's sandbox, and --cwd in the
+current directory instead of the workdir, as the wrappers of 'sbox shim'
+do so sandboxed CLIs work on the files they are pointed at.
+
+  sbox exec --project ~/tools/lint --cwd -- ruff check .
+
+Flags must come before the command; everything after it is passed on.`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  runExec,
+	}
+	execCmd.Flags().BoolP("detach", "d", false, "Run in background with output captured to a log")
+	execCmd.Flags().StringP("name", "n", "", "Name for the background job (default: command name)")
+	execCmd.Flags().StringArray("env-file", nil, "Load variables from a .env file (repeatable; env in config.yaml takes precedence)")
+	execCmd.Flags().BoolP("tty", "t", false, "Run the command on a new pseudo-terminal, e.g. for ipython")
+	execCmd.Flags().BoolP("interactive", "i", false, "Pass stdin to the command (default: only when stdin is a terminal)")
+	execCmd.Flags().Bool("all", false, "Run the command in every compose service")
+	execCmd.Flags().StringArray("label", nil, "Run the command in compose services with a label, key=value or key (repeatable; implies --all)")
+	execCmd.Flags().Bool("parallel", false, "With --all, run in all services at once")
+	execCmd.Flags().String("file", compose.DefaultFile, "Compose file for --all and --label")
+	execCmd.Flags().String("project", "", "Use the sandbox of this project instead of the current one")
+	execCmd.Flags().Bool("cwd", false, "Run in the current directory instead of the workdir")
+	// sbox exec python -c '...' passes -c to python
+	execCmd.Flags().SetInterspersed(false)
+	rootCmd.AddCommand(execCmd)
 
 	// Status command (enhanced)
 	statusCmd := &cobra.Command{
@@ -102,26 +345,148 @@ Displays:
 - Build status and metadata
 - Environment details
 - Running processes
-- Available logs`,
+- Available logs
+- Overall health
+
+Health rolls the project up into one level: unhealthy when it is not
+built, was built for another platform or a service crashed; degraded when
+the config changed since the build, a mount source is missing or a
+service is being restarted; healthy otherwise.
+
+With --check only the health is printed, and the exit code tells it for
+cron jobs and monitoring: 0 healthy, 1 degraded, 2 unhealthy, 3 when the
+project cannot be read.`,
+		Example: `  sbox status
+  sbox status --check || mail -s "sandbox degraded" ops@example.com`,
 		Run: runStatus,
 	}
 	statusCmd.Flags().BoolP("json", "j", false, "Output status as JSON")
+	statusCmd.Flags().Bool("check", false, "Only print the health and exit non-zero unless healthy")
 	rootCmd.AddCommand(statusCmd)
 
+	// Healthcheck command - probe one daemon for monitoring agents
+	healthcheckCmd := &cobra.Command{
+		Use:   "healthcheck [name]",
+		Short: "Probe a daemon once, with monitoring plugin exit codes",
+		Long: `Run the healthcheck configured for a daemon once and exit with the
+monitoring plugin convention: 0 OK, 1 WARNING, 2 CRITICAL, 3 UNKNOWN.
+Probes are declared under healthchecks: in config.yaml, keyed by daemon
+name (default: the project name), as a command run in the sandbox
+environment or an HTTP URL that must answer 2xx. A daemon that is not
+running is critical; a paused or restarting one is a warning.
+
+The output is one plugin line with the probe's duration as performance
+data, so the command plugs into Nagios, Icinga, Sensu or check_mk as is.`,
+		Example: `  sbox healthcheck web
+  # Nagios: command_line cd /srv/app && sbox healthcheck web`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runHealthcheck,
+	}
+	rootCmd.AddCommand(healthcheckCmd)
+
 	// PS command - show running processes
 	psCmd := &cobra.Command{
 		Use:   "ps",
 		Short: "List running sandbox processes",
 		Long: `List all running sandbox processes for this project.
 
-Shows process ID, name, command, uptime, and status.
-Use --all to show stopped processes as well.`,
+Shows process ID, name, command, uptime, status and listening ports.
+Use --all to show stopped processes as well. Daemons the kernel killed for
+running out of memory show as oom-killed.
+
+Use --global to list the daemons of every project on this machine, from
+anywhere. Daemons still running after their project was deleted or moved
+show as orphaned; stop them with 'sbox stop -g'.`,
 		Run: runPs,
 	}
 	psCmd.Flags().BoolP("all", "a", false, "Show all processes (including stopped)")
 	psCmd.Flags().BoolP("quiet", "q", false, "Only show process IDs")
+	psCmd.Flags().BoolP("global", "g", false, "List the daemons of every project on this machine")
 	rootCmd.AddCommand(psCmd)
 
+	// Inspect command
+	inspectCmd := &cobra.Command{
+		Use:   "inspect [name]",
+		Short: "Print the full state of the project or a process as JSON",
+		Long: `Print a JSON document describing the project, or the tracked process
+name, like 'docker inspect'.
+
+The project document holds the resolved configuration, the lock file, the
+environment commands get after expansion, the resolved mounts, the state,
+usage and log files of every tracked process, and the cached runtime the
+environment was provisioned from. A process document holds its state,
+usage, log files and environment, read from the running process on Linux.
+
+Env values that look like secrets are masked unless --show-secrets is given.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runInspect,
+	}
+	inspectCmd.Flags().Bool("show-secrets", false, "Show the values of env vars that look like secrets")
+	rootCmd.AddCommand(inspectCmd)
+
+	// Top command
+	topCmd := &cobra.Command{
+		Use:   "top",
+		Short: "Show live resource usage of sandbox processes",
+		Long: `Show the CPU, memory, open files and disk IO of every running process
+of this project, refreshing like top. Each process is counted with the
+children of its process group. Press Ctrl-C to quit.
+
+CPU% and IO rates are measured over --interval, so --once waits one
+interval before printing. --json prints one JSON document per refresh.
+
+Usage is read from /proc, so it is only available on Linux.`,
+		Args: cobra.NoArgs,
+		Run:  runTop,
+	}
+	topCmd.Flags().Duration("interval", 2*time.Second, "Time between refreshes")
+	topCmd.Flags().Bool("once", false, "Print one sample and exit")
+	topCmd.Flags().Bool("json", false, "Output as JSON")
+	rootCmd.AddCommand(topCmd)
+
+	// Stats command
+	statsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show the resource usage of sandbox processes, now or over time",
+		Long: `Show how much CPU time, disk IO and memory the processes of this
+project have used. Without --historical, the running daemons are listed
+with their usage since they started.
+
+With --historical, the usage sbox metered over time is summed per daemon:
+daemons are sampled every 30 seconds by a background 'sbox meter', and
+foreground 'sbox run', 'exec' and 'shell' commands are recorded when they
+exit. --all-projects sums it per project over every project you ran, to
+see which sandboxes consume a shared machine.
+
+Usage of daemons is read from /proc, so it is only metered on Linux.`,
+		Args: cobra.NoArgs,
+		Run:  runStats,
+	}
+	statsCmd.Flags().Bool("historical", false, "Sum the usage recorded over time")
+	statsCmd.Flags().String("since", "7d", "With --historical, only count usage after this time or duration ago")
+	statsCmd.Flags().Bool("all-projects", false, "With --historical, sum the usage of every project per project")
+	statsCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+	rootCmd.AddCommand(statsCmd)
+
+	// Port command
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "port [name]",
+		Short: "Show the ports of running processes",
+		Long: `Show which TCP ports running processes listen on, next to the ports
+declared in config.yaml:
+
+  ports:
+    http: 8000
+    metrics: 9100
+
+Declared ports are exported to the sandbox as SBOX_PORT_<NAME>
+(SBOX_PORT_HTTP=8000), so the application can read them instead of
+hard-coding numbers. Listening ports are found through /proc and are also
+shown by 'sbox ps'.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runPort,
+	})
+
 	// Logs command
 	logsCmd := &cobra.Command{
 		Use:   "logs [name]",
@@ -129,12 +494,33 @@ Use --all to show stopped processes as well.`,
 		Long: `View logs for a sandbox process.
 
 If no name is provided, shows logs for the default process.
-Use --follow to stream new log entries in real-time.`,
+Use --follow to stream new log entries in real-time.
+
+--all shows the logs of every running process together, each line
+prefixed with the process name in its own color, like docker-compose
+logs; with --follow their new lines are interleaved as they are written.
+
+--since and --until select lines by time across rotated log files. They
+take a duration before now (30m, 2h) or a time (2006-01-02 15:04, or
+RFC 3339).
+
+With logging.structured (or 'sbox run -d --log-structured') each line is
+stored with the time it was captured and its stream: --timestamps shows
+the times, --stderr-only and --stdout-only pick a stream, and --since
+seeks through an index instead of reading the whole log. Other logs carry
+no times of their own, so --timestamps with --follow starts each new line
+with the time sbox read it.`,
 		Run: runLogs,
 	}
 	logsCmd.Flags().BoolP("follow", "f", false, "Follow log output (like tail -f)")
 	logsCmd.Flags().IntP("lines", "n", 50, "Number of lines to show")
+	logsCmd.Flags().String("since", "", "Show lines written after this time or duration ago")
+	logsCmd.Flags().String("until", "", "Show lines written before this time or duration ago")
 	logsCmd.Flags().Bool("list", false, "List available log files")
+	logsCmd.Flags().BoolP("all", "a", false, "Show the logs of all running processes, prefixed with their names")
+	logsCmd.Flags().BoolP("timestamps", "t", false, "Start lines with their capture time (followed lines: the time they were read, unless structured)")
+	logsCmd.Flags().Bool("stderr-only", false, "Only show stderr (structured logs)")
+	logsCmd.Flags().Bool("stdout-only", false, "Only show stdout (structured logs)")
 	rootCmd.AddCommand(logsCmd)
 
 	// Stop command
@@ -144,10 +530,16 @@ Use --follow to stream new log entries in real-time.`,
 		Long: `Stop a running daemon process.
 
 If no name is provided, stops the default process.
-Use --all to stop all running processes.`,
+Use --all to stop all running processes.
+
+With --global, stops a daemon of any project on this machine, as listed
+by 'sbox ps -g': name it <project>/<name> when several projects have one
+of that name.`,
 		Run: runStop,
 	}
 	stopCmd.Flags().BoolP("all", "a", false, "Stop all running processes")
+	stopCmd.Flags().BoolP("global", "g", false, "Stop a daemon of any project on this machine")
+	stopCmd.Flags().BoolP("yes", "y", false, "Do not ask before stopping with --all")
 	rootCmd.AddCommand(stopCmd)
 
 	// Restart command
@@ -158,28 +550,358 @@ Use --all to stop all running processes.`,
 	}
 	rootCmd.AddCommand(restartCmd)
 
+	// Pause command
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "pause [name]",
+		Short: "Suspend a running daemon process",
+		Long: `Suspend a running daemon and its process group with SIGSTOP.
+
+The process keeps its memory and state but stops consuming CPU until it
+is resumed with 'sbox resume'. If no name is provided, pauses the default process.`,
+		Run: runPause,
+	})
+
+	// Resume command
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "resume [name]",
+		Short: "Resume a paused daemon process",
+		Long: `Resume a daemon previously suspended with 'sbox pause' (SIGCONT).
+
+If no name is provided, resumes the default process.`,
+		Run: runResume,
+	})
+
+	// Events command
+	eventsCmd := &cobra.Command{
+		Use:   "events [name]",
+		Short: "Show recorded daemon lifecycle events",
+		Long: `Show lifecycle events recorded for sandbox daemons, such as
+idle auto-stops. If a name is provided, only events for that process are shown.`,
+		Run: runEvents,
+	}
+	eventsCmd.Flags().IntP("lines", "n", 50, "Number of most recent events to show")
+	eventsCmd.Flags().BoolP("json", "j", false, "Output events as JSON")
+	rootCmd.AddCommand(eventsCmd)
+
+	// Crashes command group
+	crashesCmd := &cobra.Command{
+		Use:   "crashes",
+		Short: "Inspect recorded daemon crashes",
+		Long: `Inspect the crashes recorded for postmortem debugging.
+
+When a daemon started with 'sbox run -d' exits with a non-zero code or
+is killed by a signal, its supervisor saves the exit details, the last
+log lines and, for signals that dump core, where the core dump goes
+under .sbox/crashes/<name>-<timestamp>/. Jobs from 'sbox exec --detach'
+and compose services have no supervisor; their crashes are only recorded
+while the command that started them is still running.`,
+	}
+	crashesListCmd := &cobra.Command{
+		Use:   "list [name]",
+		Short: "List recorded crashes, newest first",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runCrashesList,
+	}
+	crashesListCmd.Flags().BoolP("json", "j", false, "Output crashes as JSON")
+	crashesCmd.AddCommand(crashesListCmd)
+	crashesShowCmd := &cobra.Command{
+		Use:   "show <id>",
+		Short: "Show a crash and the log lines saved with it",
+		Args:  cobra.ExactArgs(1),
+		Run:   runCrashesShow,
+	}
+	crashesShowCmd.Flags().IntP("lines", "n", 50, "Number of saved log lines to show (0 for all)")
+	crashesCmd.AddCommand(crashesShowCmd)
+	rootCmd.AddCommand(crashesCmd)
+
+	// Debug command group
+	debugCmd := &cobra.Command{
+		Use:   "debug",
+		Short: "Attach debugging tools to a running daemon",
+		Long: `Attach debugging tools to the interpreter a running daemon started.
+
+'dump' and 'top' use py-spy, which is installed into the sandbox
+environment the first time it is needed; the next 'sbox build' removes
+it unless config.yaml installs it. 'inspect' opens the Node.js inspector
+of a running process. If no name is provided, the default process is used.`,
+	}
+	debugDumpCmd := &cobra.Command{
+		Use:   "dump [name]",
+		Short: "Print the Python stack of every thread (py-spy dump)",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runDebugDump,
+	}
+	debugDumpCmd.Flags().Bool("locals", false, "Show the local variables of each frame")
+	debugDumpCmd.Flags().Bool("native", false, "Include native (C/C++) frames")
+	debugCmd.AddCommand(debugDumpCmd)
+	debugCmd.AddCommand(&cobra.Command{
+		Use:   "top [name]",
+		Short: "Show the Python functions using the most time (py-spy top)",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runDebugTop,
+	})
+	debugInspectCmd := &cobra.Command{
+		Use:   "inspect [name]",
+		Short: "Open the Node.js inspector of a running process",
+		Long: `Open the inspector of a running Node.js process by sending it
+SIGUSR1, as 'kill -USR1' does, without restarting it. The inspector listens
+on 127.0.0.1:9229, or the port of --inspect-port; attach from
+chrome://inspect or an editor, through an SSH tunnel for remote hosts.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runDebugInspect,
+	}
+	debugInspectCmd.Flags().Duration("timeout", 5*time.Second, "How long to wait for the inspector to listen")
+	debugCmd.AddCommand(debugInspectCmd)
+	rootCmd.AddCommand(debugCmd)
+
+	// Profile command group
+	profileCmd := &cobra.Command{
+		Use:   "profile",
+		Short: "Profile a command and keep the results",
+		Long: `Run a command under the profiler of the project's runtime and keep the
+results in .sbox/profiles/<id>/, without changing the command.
+
+Python commands run under cProfile. Node.js commands use the V8 CPU
+profiler (cpu-prof) by default, or 0x or clinic flame, fetched with npx.`,
+	}
+	profileRunCmd := &cobra.Command{
+		Use:   "run [command]",
+		Short: "Run a command under the profiler and print a summary",
+		Long: `Run a command (default: cmd in config.yaml) in the sandbox under the
+profiler of its runtime, then print the functions that took the most time.
+
+A Python command is 'python ...' or a Python script installed in the
+sandbox, such as uvicorn or gunicorn. 0x and clinic profile 'node ...'
+commands; cpu-prof also profiles other commands such as 'npm start' on
+Node.js 22 and later, with a profile per Node.js process.`,
+		Run: runProfileRun,
+	}
+	profileRunCmd.Flags().StringP("tool", "t", "", "Profiler: cprofile (Python), cpu-prof, 0x or clinic (Node.js)")
+	profileRunCmd.Flags().IntP("top", "n", 20, "Number of functions in the summary")
+	profileRunCmd.Flags().String("sort", "cumulative", "Sort key of the cProfile summary, e.g. cumulative or tottime")
+	profileRunCmd.Flags().StringArray("env-file", nil, "Load variables from a .env file (repeatable; env in config.yaml takes precedence)")
+	profileCmd.AddCommand(profileRunCmd)
+	profileCmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List recorded profiles, newest first",
+		Args:  cobra.NoArgs,
+		Run:   runProfileList,
+	})
+	profileShowCmd := &cobra.Command{
+		Use:   "show <id>",
+		Short: "Print the summary of a recorded profile",
+		Args:  cobra.ExactArgs(1),
+		Run:   runProfileShow,
+	}
+	profileShowCmd.Flags().IntP("top", "n", 20, "Number of functions in the summary")
+	profileShowCmd.Flags().String("sort", "cumulative", "Sort key of the cProfile summary, e.g. cumulative or tottime")
+	profileCmd.AddCommand(profileShowCmd)
+	rootCmd.AddCommand(profileCmd)
+
+	// Secret commands
+	secretCmd := &cobra.Command{
+		Use:   "secret",
+		Short: "Manage encrypted secrets given to commands as env vars",
+		Long: `Keep values such as API tokens out of config.yaml. Secrets are stored in
+.sbox/secrets encrypted with AES-256-GCM, using a key created in
+~/.sbox/secrets.key on first use ($SBOX_SECRETS_KEY overrides it, e.g. in
+CI). Secrets listed under secrets: in config.yaml are decrypted when run,
+exec, shell or a daemon starts and set as env vars of the same name; they
+are never written to env.sh or packed archives.
+
+  sbox secret set API_TOKEN          # Reads the value from stdin
+  sbox config set secrets API_TOKEN  # Pass it to commands`,
+	}
+	secretSetCmd := &cobra.Command{
+		Use:   "set <name> [value]",
+		Short: "Encrypt and store a secret (value from stdin when omitted)",
+		Args:  cobra.RangeArgs(1, 2),
+		Run:   runSecretSet,
+	}
+	secretGetCmd := &cobra.Command{
+		Use:   "get <name>",
+		Short: "Print the value of a secret",
+		Args:  cobra.ExactArgs(1),
+		Run:   runSecretGet,
+	}
+	secretListCmd := &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List secrets and whether commands get them",
+		Run:     runSecretList,
+	}
+	secretRmCmd := &cobra.Command{
+		Use:     "rm <name>",
+		Aliases: []string{"remove"},
+		Short:   "Delete a secret",
+		Args:    cobra.ExactArgs(1),
+		Run:     runSecretRm,
+	}
+	secretCmd.AddCommand(secretSetCmd, secretGetCmd, secretListCmd, secretRmCmd)
+	rootCmd.AddCommand(secretCmd)
+
+	// Bench command
+	benchCmd := &cobra.Command{
+		Use:   "bench [command]",
+		Short: "Run a command repeatedly and report timing and memory statistics",
+		Long: `Run a command (default: cmd in config.yaml) in the sandbox several times
+and report the min, median, 95th percentile and max of its wall time, CPU
+time and peak memory (max RSS), e.g. to compare runtime versions or
+dependency changes:
+
+  sbox bench -n 20 -- python train.py --epochs 1
+
+Run hooks are not run and the command's output is hidden unless
+--show-output is given.`,
+		Run: runBench,
+	}
+	benchCmd.Flags().IntP("runs", "n", 10, "Number of measured runs")
+	benchCmd.Flags().IntP("warmup", "w", 0, "Number of unmeasured runs before the measured ones")
+	benchCmd.Flags().BoolP("ignore-failure", "i", false, "Keep going when the command exits with a non-zero code")
+	benchCmd.Flags().Bool("show-output", false, "Show the output of the command")
+	benchCmd.Flags().BoolP("json", "j", false, "Output the samples and statistics as JSON")
+	benchCmd.Flags().StringArray("env-file", nil, "Load variables from a .env file (repeatable; env in config.yaml takes precedence)")
+	rootCmd.AddCommand(benchCmd)
+
+	// Watch command
+	watchCmd := &cobra.Command{
+		Use:   "watch [command]",
+		Short: "Rebuild and restart a command or daemon when its sources change",
+		Long: `Run a command (default: cmd in config.yaml) and, whenever a copy source or
+config.yaml changes, stop it, build again (only changed sources are copied)
+and start it again, like nodemon:
+
+  sbox watch -- python app.py
+  sbox watch --daemon api           # restart a daemon from 'sbox run -d'
+
+Install commands run again when config.yaml changes them or a file they
+name changes, such as requirements.txt in 'pip install -r requirements.txt';
+with --install also when any dependency file, such as package.json, changes.
+Files are polled every --interval. The command runs without stdin in its
+own process group; Ctrl-C stops it and ends watching.`,
+		Run: runWatch,
+	}
+	watchCmd.Flags().String("daemon", "", "Restart this daemon instead of running a command in the foreground")
+	watchCmd.Flags().Bool("install", false, "Run the install commands again when a dependency file changes")
+	watchCmd.Flags().Duration("interval", time.Second, "How often to look for changes")
+	watchCmd.Flags().Duration("stop-timeout", 10*time.Second, "How long to wait for the command to exit before killing it")
+	watchCmd.Flags().StringArray("env-file", nil, "Load variables from a .env file (repeatable; env in config.yaml takes precedence)")
+	rootCmd.AddCommand(watchCmd)
+
+	// Idle watcher (internal, spawned by 'sbox run -d')
+	rootCmd.AddCommand(&cobra.Command{
+		Use:    "idle-watch <name> <timeout>",
+		Short:  "Watch a daemon and stop it when idle",
+		Hidden: true,
+		Args:   cobra.ExactArgs(2),
+		Run:    runIdleWatch,
+	})
+
+	// Usage meter (internal, spawned for every daemon)
+	rootCmd.AddCommand(&cobra.Command{
+		Use:    "meter <name>",
+		Short:  "Record the resource usage of a daemon over time",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		Run:    runMeter,
+	})
+
+	// Daemon supervisor (internal, spawned by 'sbox run -d' and 'sbox restart')
+	superviseCmd := &cobra.Command{
+		Use:    "supervise <name> <policy> <command>",
+		Short:  "Run a daemon and restart it according to a policy",
+		Hidden: true,
+		Args:   cobra.ExactArgs(3),
+		Run:    runSupervise,
+	}
+	superviseCmd.Flags().StringArray("env-file", nil, "Load variables from a .env file")
+	addLogRotationFlags(superviseCmd)
+	rootCmd.AddCommand(superviseCmd)
+
+	// Rotating log writer (internal, daemon output is piped through it)
+	logWriterCmd := &cobra.Command{
+		Use:    process.LogWriterCommand + " <file>",
+		Short:  "Append stdin to a log file, rotating it",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		Run:    runLogWriter,
+	}
+	addLogRotationFlags(logWriterCmd)
+	logWriterCmd.Flags().Bool(process.StderrFD3Flag, false, "Read the daemon's stderr from fd 3")
+	rootCmd.AddCommand(logWriterCmd)
+
+	// Resource limit launcher (internal, prepended to daemon commands)
+	rlimitExecCmd := &cobra.Command{
+		Use:    process.RlimitExecCommand + " -- <command...>",
+		Short:  "Apply resource limits and exec a command",
+		Hidden: true,
+		Args:   cobra.MinimumNArgs(1),
+		Run:    runRlimitExec,
+	}
+	rlimitExecCmd.Flags().Int64("memory", 0, "Address space limit in bytes")
+	rlimitExecCmd.Flags().Int("nofile", 0, "Maximum open files")
+	rlimitExecCmd.Flags().Int("nproc", 0, "Maximum processes")
+	rlimitExecCmd.Flags().Int("nice", 0, "Nice value")
+	rlimitExecCmd.Flags().String("io-class", "", "IO scheduling class: realtime, best-effort or idle")
+	rlimitExecCmd.Flags().String("cpus", "", "CPUs to pin to, such as 0-3")
+	rlimitExecCmd.Flags().StringArray("ulimit", nil, "Ulimit as key=value, e.g. nofile=1024:65536 (repeatable)")
+	rootCmd.AddCommand(rlimitExecCmd)
+
 	// Clean command
 	cleanCmd := &cobra.Command{
 		Use:   "clean",
 		Short: "Clean the sandbox environment",
 		Long: `Clean the sandbox build artifacts.
 
-By default, keeps configuration files.
-Use --all to remove everything including config.
-Use --logs to only clean log files.`,
+By default, removes the runtime environment, rootfs, micromamba and its
+root prefix, and keeps configuration files.
+Use --all to remove everything including config; it is moved to the
+trash, and 'sbox undo' restores it. It lists what it removes and asks
+first; --yes skips the question.
+Use --logs to only clean log files.
+
+Granular targets reset part of the sandbox without a runtime reinstall:
+  --rootfs-only   Remove only the application files (rootfs)
+  --keep-env      Remove everything built except the runtime environment
+  --processes     Stop running processes and forget all process records
+  --cache-local   Remove the project's package cache and the caches in
+                  the rootfs (__pycache__, .cache, .npm, ...)
+
+After --rootfs-only or --keep-env, 'sbox build' copies the files and runs
+the install commands again in the kept environment.`,
 		Run: runClean,
 	}
 	cleanCmd.Flags().BoolP("all", "a", false, "Remove everything including config")
+	cleanCmd.Flags().BoolP("yes", "y", false, "Do not ask before removing with --all")
 	cleanCmd.Flags().Bool("logs", false, "Only clean log files")
 	cleanCmd.Flags().Duration("logs-older-than", 7*24*time.Hour, "Remove logs older than duration (e.g., 24h, 7d)")
+	cleanCmd.Flags().Bool("rootfs-only", false, "Only remove the rootfs (application files)")
+	cleanCmd.Flags().Bool("keep-env", false, "Remove build artifacts but keep the runtime environment")
+	cleanCmd.Flags().Bool("processes", false, "Only stop processes and forget their records")
+	cleanCmd.Flags().Bool("cache-local", false, "Only remove project-local caches")
 	rootCmd.AddCommand(cleanCmd)
 
+	// Audit log command
+	auditCmd := &cobra.Command{
+		Use:   "audit-log",
+		Short: "Show the audit log of privileged operations",
+		Long: `Show who ran privileged operations (stop, clean, unpack, ...) in this
+project, with timestamps and arguments. The log is append-only and is kept
+by 'sbox clean --all'.`,
+		Run: runAuditLog,
+	}
+	auditCmd.Flags().IntP("lines", "n", 50, "Number of most recent entries to show (0 for all)")
+	auditCmd.Flags().StringP("user", "u", "", "Only show entries by this user")
+	auditCmd.Flags().BoolP("json", "j", false, "Output entries as JSON")
+	rootCmd.AddCommand(auditCmd)
+
 	// Info command - detailed environment info
 	infoCmd := &cobra.Command{
 		Use:   "info",
 		Short: "Show detailed environment information",
 		Run:   runInfo,
 	}
+	infoCmd.Flags().Bool("show-secrets", false, "Show the values of env vars that look like secrets")
 	rootCmd.AddCommand(infoCmd)
 
 	// Validate command - check config validity
@@ -201,6 +923,224 @@ Checks for:
 	validateCmd.Flags().Bool("fix", false, "Attempt to fix common issues")
 	rootCmd.AddCommand(validateCmd)
 
+	// Doctor command
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose host prerequisites and project health",
+		Long: `Check that this host can build and run sandboxes and print a fix for
+every problem found.
+
+Checks tar and curl, glibc, free disk space, access to micro.mamba.pm and
+conda-forge, the runtime cache, and (inside a project) the build state,
+stale process entries and broken mounts.
+
+Exits with status 1 when a check fails.`,
+		Run: runDoctor,
+	}
+	doctorCmd.Flags().Bool("offline", false, "Skip network checks")
+	rootCmd.AddCommand(doctorCmd)
+
+	// Check-isolation command
+	checkIsolationCmd := &cobra.Command{
+		Use:   "check-isolation [command]",
+		Short: "Report host files the application depends on",
+		Long: `Start the application (or the given command) in the sandbox, trace the
+files it opens and executes, and report those outside the sandbox: host
+site-packages, /usr/lib python, host shared libraries, files in your home
+directory and host programs. Such leaks make an app work on the build
+host and fail on the target.
+
+strace is used when installed. Without it, or with --lite, the dynamic
+loader's LD_DEBUG output shows loaded libraries and, for Python runtimes,
+PYTHONVERBOSE shows imported modules.
+
+The command is stopped after --timeout, so servers can be checked too.
+Files under the project, declared mounts and host_libs directories are
+part of the sandbox; glibc, /etc, /proc and similar system files are
+expected from every host and not reported.
+
+Exits with status 1 when leaks are found.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runCheckIsolation,
+	}
+	checkIsolationCmd.Flags().Duration("timeout", 10*time.Second, "Stop the command after this long")
+	checkIsolationCmd.Flags().Bool("lite", false, "Use LD_DEBUG and PYTHONVERBOSE instead of strace")
+	checkIsolationCmd.Flags().Bool("all", false, "List every file, not just the first few per category")
+	rootCmd.AddCommand(checkIsolationCmd)
+
+	// Repro command
+	reproCmd := &cobra.Command{
+		Use:   "repro",
+		Short: "Check that the build is reproducible",
+		Long: `Build the project a second time in a scratch directory and compare the
+result with the current build, file by file, or compare the current build
+with a reference saved by --save or with another project's sbox.lock.
+
+Differences are grouped by their likely cause (package versions resolved
+again, Python bytecode, embedded timestamps, line ordering, permissions)
+with a suggestion for each. Paths of the project are normalized, so the
+scratch build's location does not count as a difference; file times are
+not compared.
+
+Exits with status 1 when the builds differ in more than installer
+metadata.`,
+		Args: cobra.NoArgs,
+		Run:  runRepro,
+	}
+	reproCmd.Flags().String("save", "", "Write the manifest of the current build to this file and exit")
+	reproCmd.Flags().String("against", "", "Compare with a saved manifest or an sbox.lock instead of building again")
+	reproCmd.Flags().Bool("frozen", false, "Build the second time with the versions in sbox.lock")
+	reproCmd.Flags().Bool("keep", false, "Keep the scratch build for inspection")
+	reproCmd.Flags().Bool("all", false, "List every difference, not just the first few per cause")
+	rootCmd.AddCommand(reproCmd)
+
+	// Licenses command
+	licensesCmd := &cobra.Command{
+		Use:   "licenses",
+		Short: "List the licenses of installed packages",
+		Long: `List the conda, pip and npm packages of the build with the license their
+metadata declares: conda-meta records, pip dist-info METADATA (license
+expression, License header or classifiers) and the package.json of every
+node_modules in the environment and the rootfs.
+
+Licenses are checked against the licenses section of config.yaml and the
+--allow and --deny flags, which add to it. Entries are SPDX identifiers or
+glob patterns such as "GPL-*", matched case-insensitively. With an allow
+list, every other license, including an unknown one, is rejected.
+
+Exits with status 1 when a package violates the policy.`,
+		Args: cobra.NoArgs,
+		Run:  runLicenses,
+	}
+	licensesCmd.Flags().String("format", "table", "Report format: table, json or csv")
+	licensesCmd.Flags().StringSlice("allow", nil, "Allowed licenses (adds to licenses.allow)")
+	licensesCmd.Flags().StringSlice("deny", nil, "Denied licenses (adds to licenses.deny)")
+	rootCmd.AddCommand(licensesCmd)
+
+	// Dashboard command
+	dashboardCmd := &cobra.Command{
+		Use:   "dashboard",
+		Short: "Serve a web dashboard for sandbox projects",
+		Long: `Serve a small web UI and JSON API showing projects, services,
+health, live log tails and build history.
+
+By default the current project is shown; use --project to add others.
+
+JSON endpoints:
+  GET /api/projects
+  GET /api/projects/<name>
+  GET /api/projects/<name>/builds
+  GET /api/projects/<name>/logs/<process>?lines=N
+  GET /api/projects/<name>/logs/<process>/stream   (server-sent events)
+
+'sbox daemon' serves the same endpoints on a Unix socket, with build, run
+and stop.`,
+		Run: runDashboard,
+	}
+	dashboardCmd.Flags().String("listen", "127.0.0.1:7777", "Address to listen on")
+	dashboardCmd.Flags().StringSlice("project", nil, "Additional project directories to show")
+	rootCmd.AddCommand(dashboardCmd)
+
+	// Daemon command
+	daemonCmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Serve the sbox API on a Unix socket for editors, dashboards and CI",
+		Long: `Serve the dashboard's JSON API on a Unix socket (default
+~/.sbox/daemon.sock, readable by you only), plus endpoints that build,
+run and stop sandboxes, so tools can drive sbox without parsing its
+output.
+
+Projects are those of the current directory and --project, and any a
+client registers. Each operation runs as an sbox process in the project
+and streams its output back as NDJSON lines, {"stream":"stdout","line":...},
+ending with {"exit_code":N}.
+
+  POST /api/projects                   {"root": "/path/to/project"}
+  POST /api/projects/<name>/build      {"force", "verbose", "frozen", "offline"}
+  POST /api/projects/<name>/run        {"command", "detach", "name", "idle_timeout", "restart"}
+  POST /api/projects/<name>/stop       {"name"} or {"all": true}
+
+Every request may also set "profile" and "output". The GET endpoints of
+'sbox dashboard' are served too.
+
+With --daemon-socket or $SBOX_DAEMON_SOCKET set, 'sbox build', 'sbox run'
+and 'sbox stop' go through the daemon instead of running in-process.
+A command run that way gets no stdin.`,
+		Example: `  sbox daemon &
+  curl --unix-socket ~/.sbox/daemon.sock http://sbox/api/projects
+  SBOX_DAEMON_SOCKET=~/.sbox/daemon.sock sbox build`,
+		Args: cobra.NoArgs,
+		Run:  runDaemon,
+	}
+	daemonCmd.Flags().String("socket", "", "Socket to listen on (default ~/.sbox/"+api.SocketFile+")")
+	daemonCmd.Flags().StringSlice("project", nil, "Additional project directories to serve")
+	rootCmd.AddCommand(daemonCmd)
+
+	// Config command group
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Read and modify .sbox/config.yaml",
+		Long: `Read and modify configuration values by dotted key path.
+
+Keys follow the config.yaml structure, e.g. 'runtime', 'cmd', 'env.DEBUG'.
+Run 'sbox config keys' to list every key, or enable shell completion with
+'sbox completion <shell>' to complete keys for 'config get/set'.`,
+	}
+
+	configCmd.AddCommand(&cobra.Command{
+		Use:               "get <key>",
+		Short:             "Print a configuration value",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeConfigKeys,
+		Run:               runConfigGet,
+	})
+
+	configCmd.AddCommand(&cobra.Command{
+		Use:   "set <key> <value> [value...]",
+		Short: "Set a configuration value",
+		Long: `Set a configuration value and save config.yaml.
+
+List keys (copy, mount, install) take one element per value and replace
+the whole list. Map keys such as env.<NAME> create the entry if needed.`,
+		Args:              cobra.MinimumNArgs(2),
+		ValidArgsFunction: completeConfigKeys,
+		Run:               runConfigSet,
+	})
+
+	configCmd.AddCommand(&cobra.Command{
+		Use:               "unset <key>",
+		Short:             "Remove a configuration value",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeConfigKeys,
+		Run:               runConfigUnset,
+	})
+
+	configResolveCmd := &cobra.Command{
+		Use:   "resolve",
+		Short: "Print the configuration with ${VAR} references resolved",
+		Long: `Print config.yaml as sbox uses it, with ${VAR} and ${VAR:-default}
+references in runtime, workdir, cmd, copy, mount, env, env_file,
+host_libs and path resolved. Variables come from the environment first, then from
+env_file, then the default. Unset variables without a default are left as
+written and listed in a comment.
+
+Env values that look like secrets are masked unless --show-secrets is given.`,
+		Args: cobra.NoArgs,
+		Run:  runConfigResolve,
+	}
+	configResolveCmd.Flags().Bool("show-secrets", false, "Show the values of env vars that look like secrets")
+	configCmd.AddCommand(configResolveCmd)
+
+	configKeysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "List configuration keys",
+		Run:   runConfigKeys,
+	}
+	configKeysCmd.Flags().Bool("schema", false, "Show schema paths only ('*' marks user-defined names)")
+	configCmd.AddCommand(configKeysCmd)
+
+	rootCmd.AddCommand(configCmd)
+
 	// Cache command group
 	cacheCmd := &cobra.Command{
 		Use:   "cache",
@@ -229,10 +1169,13 @@ Cache location: ~/.sbox/cache/`,
 		Long: `Remove cached runtimes from the global cache.
 
 If no runtime is specified, removes all cached data.
-Specify a runtime like 'python-3.10' or 'node-22' to remove only that runtime.`,
+Specify a runtime like 'python-3.10' or 'node-22' to remove only that runtime.
+
+What is removed is moved to the trash; 'sbox undo' restores it.`,
 		Run: runCacheClean,
 	}
 	cacheCleanCmd.Flags().BoolP("all", "a", false, "Remove all cache including micromamba")
+	cacheCleanCmd.Flags().BoolP("yes", "y", false, "Do not ask before removing with --all")
 	cacheCmd.AddCommand(cacheCleanCmd)
 
 	// Cache prune subcommand
@@ -265,17 +1208,211 @@ By default, removes runtimes not used in the last 30 days.`,
 
 	rootCmd.AddCommand(cacheCmd)
 
+	// Undo command
+	undoCmd := &cobra.Command{
+		Use:   "undo [id]",
+		Short: "Restore what a destructive command moved to the trash",
+		Long: `Restore the paths the last clean --all, init --force or cache clean
+removed, or those of a trash entry given by id (see 'sbox trash list').
+
+They are kept in ~/.sbox/trash for 7 days, or trash.retention_days of
+~/.sbox/defaults.yaml. Paths that exist again, such as the project init
+--force created, are only replaced with --force; they are moved to the
+trash in turn.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runUndo,
+	}
+	undoCmd.Flags().BoolP("force", "f", false, "Replace paths that exist again")
+	rootCmd.AddCommand(undoCmd)
+
+	// Trash command group
+	trashCmd := &cobra.Command{
+		Use:   "trash",
+		Short: "Manage what destructive commands moved to ~/.sbox/trash",
+	}
+	trashListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List trash entries, newest first",
+		Args:  cobra.NoArgs,
+		Run:   runTrashList,
+	}
+	trashListCmd.Flags().Bool("json", false, "Output as JSON")
+	trashCmd.AddCommand(trashListCmd)
+	trashEmptyCmd := &cobra.Command{
+		Use:   "empty",
+		Short: "Delete trash entries for good",
+		Args:  cobra.NoArgs,
+		Run:   runTrashEmpty,
+	}
+	trashEmptyCmd.Flags().Duration("older-than", 0, "Only delete entries older than this (e.g. 48h)")
+	trashCmd.AddCommand(trashEmptyCmd)
+	rootCmd.AddCommand(trashCmd)
+
+	// Shim command - host wrappers for sandboxed CLIs
+	shimCmd := &cobra.Command{
+		Use:   "shim",
+		Short: "Put commands of the sandbox on the host PATH as wrapper scripts",
+		Long: `Write small wrapper scripts (shims) that run a command of this project's
+sandbox through 'sbox exec', so CLI tools installed in the sandbox can be
+used from anywhere on the host like globally installed binaries. A shim
+passes its arguments and stdin on and runs in the caller's directory.
+
+Shims go to ~/.local/bin unless --dir is given; that directory must be on
+PATH. They record the project they belong to, and 'sbox shim list' shows
+those whose project is gone.`,
+	}
+	shimAddCmd := &cobra.Command{
+		Use:   "add <command>...",
+		Short: "Write shims for commands of this project's sandbox",
+		Example: `  sbox shim add black ruff
+  sbox shim add --name py311 python`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  runShimAdd,
+	}
+	shimAddCmd.Flags().String("name", "", "Name of the shim, when it differs from the command (one command only)")
+	shimAddCmd.Flags().String("dir", "", "Directory to write shims to (default ~/"+shim.DefaultDir+")")
+	shimAddCmd.Flags().BoolP("force", "f", false, "Replace an existing file or another project's shim")
+	shimCmd.AddCommand(shimAddCmd)
+	shimListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the shims in the shim directory",
+		Args:  cobra.NoArgs,
+		Run:   runShimList,
+	}
+	shimListCmd.Flags().String("dir", "", "Shim directory (default ~/"+shim.DefaultDir+")")
+	shimListCmd.Flags().Bool("json", false, "Output as JSON")
+	shimCmd.AddCommand(shimListCmd)
+	shimRemoveCmd := &cobra.Command{
+		Use:   "remove <name>...",
+		Short: "Remove shims",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   runShimRemove,
+	}
+	shimRemoveCmd.Flags().String("dir", "", "Shim directory (default ~/"+shim.DefaultDir+")")
+	shimCmd.AddCommand(shimRemoveCmd)
+	rootCmd.AddCommand(shimCmd)
+
+	// IDE command - point editors at the sandbox interpreter
+	ideCmd := &cobra.Command{
+		Use:   "ide",
+		Short: "Point editors at the sandbox interpreter",
+		Long: `Write .sbox/ide.json, which every build also writes: the runtime's
+interpreter, the tools in the environment, the PATH entries and the env
+vars of the sandbox (values of variables that look like secrets are left
+out), for editor plugins and scripts.
+
+--vscode merges matching settings into .vscode/settings.json (interpreter
+or runtime executable, integrated terminal env); --pycharm points
+.idea/misc.xml at an interpreter named "sbox (<project>)", which has to be
+added to PyCharm once with the printed path.`,
+		Example: `  sbox ide --vscode
+  sbox ide --pycharm
+  sbox ide --json`,
+		Args: cobra.NoArgs,
+		Run:  runIDE,
+	}
+	ideCmd.Flags().Bool("vscode", false, "Update .vscode/settings.json")
+	ideCmd.Flags().Bool("pycharm", false, "Update .idea/misc.xml (python runtimes)")
+	ideCmd.Flags().Bool("json", false, "Print ide.json")
+	rootCmd.AddCommand(ideCmd)
+
+	// Githooks command - validate and test before commits leave the machine
+	githooksCmd := &cobra.Command{
+		Use:   "githooks",
+		Short: "Install git hooks that validate the config and run tests in the sandbox",
+		Long: `Install git pre-commit and pre-push hooks in the repository of this
+project. Both run 'sbox validate', so a broken config.yaml is not committed;
+with --test the pre-push hook also runs a test command in the sandbox with
+'sbox run', so failing tests are caught before review.
+
+A hook that already exists is only replaced with --force; it is then kept
+as <hook>.pre-sbox and runs before the sbox hook. 'sbox githooks uninstall'
+removes the sbox hooks and puts those back. Skip the hooks once with
+'git commit --no-verify' or 'git push --no-verify'.`,
+	}
+	githooksInstallCmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install the git hooks",
+		Example: `  sbox githooks install
+  sbox githooks install --test "pytest -q"
+  sbox githooks install --hook pre-commit --test "ruff check ." --test-on pre-commit`,
+		Args: cobra.NoArgs,
+		Run:  runGithooksInstall,
+	}
+	githooksInstallCmd.Flags().StringSlice("hook", githooks.Names, "Hooks to install")
+	githooksInstallCmd.Flags().String("test", "", "Test command to run in the sandbox")
+	githooksInstallCmd.Flags().String("test-on", githooks.PrePush, "Hook that runs the test command")
+	githooksInstallCmd.Flags().BoolP("force", "f", false, "Replace existing hooks (kept and run first)")
+	githooksCmd.AddCommand(githooksInstallCmd)
+	githooksCmd.AddCommand(&cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove the git hooks and restore the ones they replaced",
+		Args:  cobra.NoArgs,
+		Run:   runGithooksUninstall,
+	})
+	githooksListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the installed git hooks",
+		Args:  cobra.NoArgs,
+		Run:   runGithooksList,
+	}
+	githooksListCmd.Flags().Bool("json", false, "Output as JSON")
+	githooksCmd.AddCommand(githooksListCmd)
+	rootCmd.AddCommand(githooksCmd)
+
+	// System command - all projects on this machine
+	systemCmd := &cobra.Command{
+		Use:   "system",
+		Short: "Disk usage and cleanup across all projects on this machine",
+		Long: `Show and reclaim the disk space of every sbox project on this machine.
+
+Projects are known from their builds, their daemons ('sbox ps -g') and
+the usage log, wherever they are; 'sbox system df' lists them with the
+size of their .sbox directory and when they were last built or used.`,
+	}
+	systemDfCmd := &cobra.Command{
+		Use:   "df",
+		Short: "Show the disk usage of every project's .sbox directory",
+		Args:  cobra.NoArgs,
+		Run:   runSystemDf,
+	}
+	systemDfCmd.Flags().Duration("older-than", 30*24*time.Hour, "Mark projects not built or used for longer than this as idle")
+	systemDfCmd.Flags().Bool("json", false, "Output as JSON")
+	systemCmd.AddCommand(systemDfCmd)
+	systemPruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove build artifacts of deleted and idle projects",
+		Long: `Forget deleted projects, and remove the build artifacts of projects
+not built or used for longer than --older-than, like 'sbox clean': the
+runtime environment, rootfs, micromamba and env.sh. config.yaml, sbox.lock
+and logs are kept, so 'sbox build' restores the sandbox. Projects with
+running daemons are skipped.
+
+It lists what it removes and asks first; --yes skips the question.`,
+		Example: `  sbox system prune --dry-run
+  sbox system prune --older-than 2160h --yes`,
+		Args: cobra.NoArgs,
+		Run:  runSystemPrune,
+	}
+	systemPruneCmd.Flags().Duration("older-than", 30*24*time.Hour, "Prune projects not built or used for longer than this")
+	systemPruneCmd.Flags().Bool("dry-run", false, "Only show what would be removed")
+	systemPruneCmd.Flags().BoolP("yes", "y", false, "Do not ask before removing")
+	systemCmd.AddCommand(systemPruneCmd)
+	rootCmd.AddCommand(systemCmd)
+
 	// Pack command
 	packCmd := &cobra.Command{
 		Use:   "pack [output]",
 		Short: "Package the sandbox into a portable archive",
-		Long: `Package the current sandbox into a portable tar.gz archive.
+		Long: `Package the current sandbox into a portable tar archive.
 
 The archive includes:
   - .sbox/rootfs/     All sandbox files
   - .sbox/env/        Runtime environment  
   - .sbox/config.yaml Configuration
   - metadata.json     Build metadata
+  - SHA256SUMS        SHA-256 of every file (its digest is in metadata.json)
+  - SYMLINKS          Target of every symlink (its digest too)
 
 The archive can be extracted manually with:
   tar -xzf archive.tar.gz
@@ -286,17 +1423,102 @@ Then run with:
 This workflow provides security benefits:
   - Users can inspect contents before running
   - No automatic code execution on extract
-  - Standard tools for verification`,
+  - Standard tools for verification (sha256sum -c SHA256SUMS, or
+    'sbox verify' for the archive)
+
+The archive's own digest is written next to it as <archive>.sha256. With
+--sign, metadata.json is signed with a minisign or cosign secret key (the
+tool is chosen from the key); the signature covers every file through the
+digests, and 'sbox verify --verify-key' checks it:
+
+  sbox pack --sign ~/.minisign/minisign.key
+  sbox verify app-sbox.tar.gz --verify-key minisign.pub
+
+Logs, mounted volumes, caches and custom patterns can be left out with
+flags or the pack section of config.yaml:
+
+  pack:
+    exclude_logs: true
+    exclude_caches: true
+    exclude:
+      - "*.sqlite"
+
+A size estimate is printed before anything is copied.
+
+Archives are gzip-compressed by default. --compress zstd compresses
+faster and smaller on all cores (the zstd binary must be on PATH; extract
+with 'zstd -dc archive.tar.zst | tar -xf -'), and --compress none skips
+compression. With an output name ending in .tar.zst or .tar, the
+compression follows the name.
+
+--split-size (e.g. 2G) splits the archive into volumes <archive>.part-000,
+<archive>.part-001, ... for channels that limit file size; <archive>.sha256
+lists every volume. 'sbox unpack <volume>' checks and joins them, or
+'cat archive.part-* > archive' does the same, and 'sbox verify' checks
+them without joining.
+
+Archives are written without the system tar, with entries sorted and no
+owner recorded. Set SOURCE_DATE_EPOCH to clamp file times and packed_at in
+metadata.json to it, so packing the same tree twice gives the same archive.
+
+With --target for another platform (e.g. packing on macOS for
+linux-amd64) the environment is left out, since its binaries cannot run
+there, and the recipient rebuilds it with 'sbox build --frozen' from the
+package versions in sbox.lock.
+
+With --platform (e.g. linux-amd64,linux-arm64) one archive is written per
+platform, named <project>-sbox-<platform>.tar.gz. The environment of each
+foreign platform is resolved by micromamba --platform at the runtime
+version in sbox.lock (the host's other conda pins are platform specific);
+install commands cannot run for it, so the
+recipient completes it with 'sbox build --frozen'.`,
 		Run: runPack,
 	}
 	packCmd.Flags().StringP("output", "o", "", "Output file path (default: <project>-sbox.tar.gz)")
 	packCmd.Flags().Bool("include-cache", false, "Include local mamba cache (larger archive)")
 	packCmd.Flags().Bool("exclude-env", false, "Exclude runtime environment (recipient must run sbox build)")
+	packCmd.Flags().Bool("exclude-logs", false, "Exclude log files (*.log, var/log)")
+	packCmd.Flags().Bool("exclude-volumes", false, "Exclude mount destinations (they point at host paths)")
+	packCmd.Flags().Bool("exclude-caches", false, "Exclude caches, *.pyc and node_modules test directories")
+	packCmd.Flags().StringSlice("exclude", nil, "Exclude files matching a glob pattern (repeatable)")
+	packCmd.Flags().Bool("dry-run", false, "Only show the size estimate, do not create the archive")
+	packCmd.Flags().String("target", "", "Platform the archive is for (e.g. linux-amd64); other platforms rebuild from sbox.lock")
+	packCmd.Flags().StringSlice("platform", nil, "Write one archive per platform, resolving each platform's environment (e.g. linux-amd64,linux-arm64)")
+	packCmd.Flags().String("sign", "", "Sign metadata.json with a minisign or cosign secret key")
+	packCmd.Flags().String("compress", "", "Compression: gzip, zstd or none (default: from the output name, else gzip)")
+	packCmd.Flags().String("split-size", "", "Split the archive into volumes of at most this size (e.g. 2G)")
 	rootCmd.AddCommand(packCmd)
 
+	// Verify command
+	verifyCmd := &cobra.Command{
+		Use:   "verify <archive|volume|directory>",
+		Short: "Check a packed archive against its checksums and signature",
+		Long: `Check an archive created by 'sbox pack', or the directory it was
+extracted to, against the SHA256SUMS and SYMLINKS manifests it carries.
+Modified, missing and unexpected files and retargeted symlinks are
+listed and the command exits non-zero.
+
+For an archive, <archive>.sha256 is checked as well when it is present.
+A split archive is verified from any of its volumes.
+With --verify-key the signature of metadata.json is checked with a
+minisign or cosign public key; since metadata.json holds the manifest's
+digest, this proves every file came from the key's owner.
+
+  sbox verify app-sbox.tar.gz
+  sbox verify app-sbox.tar.gz --verify-key minisign.pub
+  sbox verify ./app --verify-key cosign.pub
+
+Extracted directories are verified before 'sbox unpack' rewrites paths
+in them (see 'sbox unpack --verify').`,
+		Args: cobra.ExactArgs(1),
+		Run:  runVerify,
+	}
+	verifyCmd.Flags().String("verify-key", "", "Check the signature with a minisign or cosign public key")
+	rootCmd.AddCommand(verifyCmd)
+
 	// Unpack command
 	unpackCmd := &cobra.Command{
-		Use:   "unpack [directory]",
+		Use:   "unpack [directory... | volume]",
 		Short: "Relocate paths in an extracted sbox archive",
 		Long: `Relocate embedded paths in an extracted sbox archive for the new location.
 
@@ -307,13 +1529,15 @@ SECURITY BOUNDARY:
   - Does NOT execute any code
   - Does NOT download anything  
   - Does NOT run install commands
-  - ONLY performs text replacement in configuration files
+  - ONLY replaces paths in files
 
 What it does:
   1. Regenerates .sbox/env.sh with correct paths
   2. Updates conda-meta/*.json prefix paths
   3. Fixes shebang lines in scripts (if any)
-  4. Updates sbox.lock with new location
+  4. Rewrites the prefix in compiled libraries and executables, padded
+     to its original length (the new path must not be longer)
+  5. Updates sbox.lock with new location
 
 Typical workflow:
   1. Build on source:     sbox build && sbox pack
@@ -323,35 +1547,339 @@ Typical workflow:
   5. Run:                 sbox run
 
 The unpack step is required when the extraction path differs from the
-original build path. Without it, hardcoded paths will be incorrect.`,
+original build path. Without it, hardcoded paths will be incorrect.
+
+An archive packed with --split-size arrives as volumes; given any of
+them, unpack checks them against <archive>.sha256 and joins them into the
+archive, which is then extracted as usual:
+
+  sbox unpack project-sbox.tar.zst.part-000
+
+Use --relocate-to when the tree is extracted in a staging location and
+moved into place afterwards: paths are rewritten for the final location
+instead of the current one. Several directories can be unpacked at once;
+in that case --relocate-to is the parent directory they will be moved into.
+
+Progress is journaled in .sbox/relocate.journal: rerunning after an
+interruption resumes the relocation, and partially relocated environments
+are detected and repaired.
+
+Use --verify to check the extracted files against the archive's SHA256SUMS
+before anything is changed, and --verify-key to check its signature too
+(see 'sbox verify').
+
+The archive's platform, architecture, glibc requirement and sbox version
+are checked against this host first; incompatible archives are refused
+unless --force is given.`,
 		Run: runUnpack,
 	}
 	unpackCmd.Flags().Bool("verbose", false, "Show detailed relocation information")
 	unpackCmd.Flags().Bool("dry-run", false, "Show what would be changed without making changes")
+	unpackCmd.Flags().String("relocate-to", "", "Rewrite paths for this final location instead of the current one")
+	unpackCmd.Flags().Bool("force", false, "Unpack even if the archive was built for an incompatible host")
+	unpackCmd.Flags().Bool("verify", false, "Check files against the archive's checksums before relocating")
+	unpackCmd.Flags().String("verify-key", "", "Also check the archive's signature with a minisign or cosign public key (implies --verify)")
 	rootCmd.AddCommand(unpackCmd)
 
+	// Push/pull commands
+	pushCmd := &cobra.Command{
+		Use:   "push <[registry/]name[:tag]> [archive]",
+		Short: "Upload a packed archive to a remote registry",
+		Long: `Upload an archive created by 'sbox pack' to a registry configured in
+~/.sbox/defaults.yaml:
+
+  default_registry: team
+  registries:
+    team:
+      url: oci://ghcr.io/my-org          # OCI registry
+      username: me
+      password: ${GHCR_TOKEN}
+    bucket:
+      url: s3://my-bucket/sbox           # S3 or S3-compatible
+      region: eu-west-1
+    files:
+      url: https://files.example.com/sbox  # HTTP server accepting PUT
+      token: ${FILES_TOKEN}
+
+The archive defaults to <project>-sbox.tar.gz in the project root. Its
+sha256, size, runtime, platform and sbox version are stored with it and
+checked by 'sbox pull'.`,
+		Args: cobra.RangeArgs(1, 2),
+		Run:  runPush,
+	}
+	rootCmd.AddCommand(pushCmd)
+
+	pullCmd := &cobra.Command{
+		Use:   "pull <[registry/]name[:tag]>",
+		Short: "Download an archive from a remote registry",
+		Long: `Download an archive pushed with 'sbox push' and verify its checksum.
+
+The archive is saved as <name>-<tag>.tar.gz in the current directory. It
+is not extracted: inspect it, then 'tar -xzf' and 'sbox unpack' as for
+any other archive.`,
+		Args: cobra.ExactArgs(1),
+		Run:  runPull,
+	}
+	pullCmd.Flags().StringP("output", "o", "", "Output file path (default: <name>-<tag> with the archive's extension)")
+	rootCmd.AddCommand(pullCmd)
+
+	// Module commands
+	moduleCmd := &cobra.Command{
+		Use:   "module",
+		Short: "Integrate with HPC module systems (Lmod, Environment Modules)",
+	}
+	moduleGenerateCmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate a modulefile for this sandbox",
+		Long: `Generate a modulefile that puts the sandbox environment's programs on
+PATH and sets the env vars from config.yaml, so the tools can be used with
+'module load' on clusters:
+
+  sbox module generate
+  module use ~/modulefiles
+  module load myproject
+
+The format is Lua when Lmod is detected and Tcl (understood by both
+Environment Modules and Lmod) otherwise. The modulefile is written to
+~/modulefiles/<name>[/<version>]; use --output for a shared module
+directory, or --stdout to print it.
+
+A loaded module is not a sandbox: HOME and TMPDIR are not redirected and
+the host PATH stays visible. Use 'sbox run' or 'sbox shell' for isolation.`,
+		Run: runModuleGenerate,
+	}
+	moduleGenerateCmd.Flags().String("format", "", "Modulefile format: lua or tcl (default: lua under Lmod, tcl otherwise)")
+	moduleGenerateCmd.Flags().String("name", "", "Module name (default: project directory name)")
+	moduleGenerateCmd.Flags().String("version", "", "Module version (default: none, the module is loaded by name)")
+	moduleGenerateCmd.Flags().StringP("output", "o", "", "Module directory (default: ~/modulefiles)")
+	moduleGenerateCmd.Flags().Bool("stdout", false, "Print the modulefile instead of writing it")
+	moduleCmd.AddCommand(moduleGenerateCmd)
+	rootCmd.AddCommand(moduleCmd)
+
+	// Export commands
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the sandbox to other tools",
+	}
+	exportDockerCmd := &cobra.Command{
+		Use:   "docker",
+		Short: "Generate a Dockerfile that rebuilds this sandbox as an image",
+		Long: `Generate a Dockerfile that rebuilds the sandbox as a container image:
+the runtime is installed from conda-forge into a micromamba base image,
+then the env vars, copies, install commands and build hooks of
+config.yaml are replayed, and cmd becomes the image's CMD:
+
+  sbox export docker
+  docker build -t myapp .
+
+Pip packages are pinned to the versions in sbox.lock when the project was
+built. Install commands and hooks run in /project, where the project is
+mounted for the step only. A .dockerignore keeps .sbox/ out of the build
+context.
+
+Mounts, secrets and env_file are not part of the image; the Dockerfile's
+header shows the 'docker run' flags that provide them. The Dockerfile
+needs BuildKit (Docker 23 or later).`,
+		Args: cobra.NoArgs,
+		Run:  runExportDocker,
+	}
+	exportDockerCmd.Flags().StringP("output", "o", "", "Directory to write the Dockerfile to (default: project root)")
+	exportDockerCmd.Flags().String("base", dockerfile.DefaultBaseImage, "Base image providing micromamba")
+	exportDockerCmd.Flags().BoolP("force", "f", false, "Overwrite an existing Dockerfile")
+	exportDockerCmd.Flags().Bool("stdout", false, "Print the Dockerfile instead of writing it")
+	exportCmd.AddCommand(exportDockerCmd)
+	rootCmd.AddCommand(exportCmd)
+
+	slurmCmd := &cobra.Command{
+		Use:   "slurm [command]",
+		Short: "Run the sandbox as a Slurm batch job",
+		Long: `Generate an sbatch script that runs 'sbox run [command]' on a compute
+node, and optionally submit it:
+
+  sbox slurm --time 2:00:00 --gpus 1 "python train.py"
+  sbox slurm --submit "python train.py"
+
+Resources come from the slurm section of config.yaml; flags override them:
+
+  slurm:
+    partition: gpu
+    time: "4:00:00"
+    gpus: "a100:1"
+    cpus: 8
+    memory: 32G
+    options: ["--constraint=ib"]
+
+The script is written to .sbox/slurm/<name>.sbatch. Submitted jobs are
+tracked like daemons: 'sbox ps' shows their Slurm state, 'sbox logs <name>'
+their output and 'sbox stop <name>' cancels them. The project and the sbox
+binary must be on a filesystem the compute nodes share.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runSlurm,
+	}
+	slurmCmd.Flags().String("name", "", "Job name (default: project directory name)")
+	slurmCmd.Flags().StringP("partition", "p", "", "Partition (overrides slurm.partition)")
+	slurmCmd.Flags().StringP("time", "t", "", "Time limit, e.g. 2:00:00 (overrides slurm.time)")
+	slurmCmd.Flags().String("gpus", "", "GPUs, e.g. 1 or a100:2 (overrides slurm.gpus)")
+	slurmCmd.Flags().Int("cpus", 0, "CPUs per task (overrides slurm.cpus)")
+	slurmCmd.Flags().String("memory", "", "Memory per node, e.g. 16G (overrides slurm.memory)")
+	slurmCmd.Flags().StringP("account", "A", "", "Account to charge (overrides slurm.account)")
+	slurmCmd.Flags().StringP("output", "o", "", "Script path (default: .sbox/slurm/<name>.sbatch)")
+	slurmCmd.Flags().Bool("submit", false, "Submit the script with sbatch")
+	slurmCmd.Flags().Bool("stdout", false, "Print the script instead of writing it")
+	rootCmd.AddCommand(slurmCmd)
+
+	// Compose commands
+	composeCmd := &cobra.Command{
+		Use:   "compose",
+		Short: "Run several sandboxes together from a compose.yaml",
+		Long: `Start, stop and inspect a group of sandboxes described in compose.yaml.
+
+Each service either references an existing sbox project or is defined
+inline with its own runtime, cmd and env:
+
+  services:
+    api:
+      project: ./api
+      env:
+        PORT: "8080"
+    worker:
+      runtime: python:3.12
+      copy:
+        - ./worker:/app
+      install:
+        - pip install -r worker/requirements.txt
+      cmd: python /app/worker.py
+      depends_on: [api]
+      init_tasks:
+        - name: migrate
+          cmd: python /app/manage.py migrate
+
+Services are built if needed and started as daemons, dependencies first.
+Inline services are generated under .sbox-compose/<service>/.
+
+Init tasks (init_tasks of the service, after those of its project's
+config.yaml) run to completion in order before the service starts, once
+its dependencies are running. A failing task aborts 'compose up'. Their
+output goes to .sbox/logs/init-<name>.log of the service's project.`,
+	}
+	composeCmd.PersistentFlags().String("file", compose.DefaultFile, "Compose file")
+
+	composeCmd.AddCommand(&cobra.Command{
+		Use:   "up [service...]",
+		Short: "Build and start services and their dependencies",
+		Run:   runComposeUp,
+	})
+
+	composeCmd.AddCommand(&cobra.Command{
+		Use:   "down [service...]",
+		Short: "Stop services and everything that depends on them",
+		Run:   runComposeDown,
+	})
+
+	composeCmd.AddCommand(&cobra.Command{
+		Use:   "ps",
+		Short: "List compose services and their status",
+		Run:   runComposePs,
+	})
+
+	composeLogsCmd := &cobra.Command{
+		Use:   "logs [service...]",
+		Short: "View service logs, prefixed with the service name",
+		Run:   runComposeLogs,
+	}
+	composeLogsCmd.Flags().BoolP("follow", "f", false, "Follow log output")
+	composeLogsCmd.Flags().IntP("lines", "n", 20, "Number of lines to show per service")
+	composeCmd.AddCommand(composeLogsCmd)
+
+	rootCmd.AddCommand(composeCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
 }
 
 func runInit(cmd *cobra.Command, args []string) {
-	projectName := args[0]
 	runtimeStr, _ := cmd.Flags().GetString("runtime")
 	force, _ := cmd.Flags().GetBool("force")
+	bare, _ := cmd.Flags().GetBool("bare")
+	templateName, _ := cmd.Flags().GetString("template")
+	noVCS, _ := cmd.Flags().GetBool("no-vcs")
+	fromDockerfile, _ := cmd.Flags().GetString("from-dockerfile")
+
+	if listTemplates, _ := cmd.Flags().GetBool("list-templates"); listTemplates {
+		printTemplates()
+		return
+	}
+
+	if fromDockerfile != "" && (bare || templateName != "") {
+		console.Fatal("--from-dockerfile cannot be combined with --bare or --template")
+	}
+	if len(args) == 0 && !bare && fromDockerfile == "" {
+		console.Fatal("Project name is required (or use --bare to initialize the current directory)")
+	}
+	projectName := "."
+	if len(args) > 0 {
+		projectName = args[0]
+	}
+
+	// Per-user defaults from ~/.sbox/defaults.yaml
+	globalCfg, err := config.LoadGlobalConfig()
+	if err != nil {
+		console.Warning("Ignoring user defaults: %s", err)
+	}
+	defaults := globalCfg.Init
+
+	var tmpl *templates.Template
+	if templateName != "" {
+		if bare {
+			console.Fatal("--template cannot be combined with --bare")
+		}
+		if tmpl, err = templates.Load(templateName); err != nil {
+			console.Fatal("%s\n    → Run 'sbox init --list-templates' to see the available templates", err)
+		}
+	}
+
+	// --runtime wins over the template's runtime, which wins over the
+	// user default
+	if !cmd.Flags().Changed("runtime") {
+		if tmpl != nil {
+			runtimeStr = tmpl.Runtime
+		} else if defaults.Runtime != "" {
+			runtimeStr = defaults.Runtime
+		}
+	}
+
+	language := strings.ToLower(strings.SplitN(runtimeStr, ":", 2)[0])
+	spec, ok := config.LookupRuntime(language)
+	if !ok {
+		console.Fatal("Unsupported runtime: %s (supported: %s)", language, strings.Join(config.RuntimeNames(), ", "))
+	}
 
 	projectPath := filepath.Join(".", projectName)
 
+	if bare {
+		initBare(cmd, projectPath, runtimeStr, defaults, force)
+		return
+	}
+	if fromDockerfile != "" {
+		initFromDockerfile(cmd, projectPath, fromDockerfile, runtimeStr, defaults, force, noVCS)
+		return
+	}
+
 	// Check if project exists
 	if info, err := os.Stat(projectPath); err == nil && info.IsDir() {
 		if !force {
 			console.Fatal("Directory '%s' already exists. Use --force to overwrite.", projectName)
 		}
-		os.RemoveAll(projectPath)
+		confirm(cmd, "--force replaces the existing project; it is moved to the trash:", pathItems(".", projectPath), "Overwrite it?")
+		printUndoHint(moveToTrash("init --force", projectPath))
 	}
 
 	console.Step("Initializing sbox project: %s", projectName)
 	console.Info("Runtime: %s", runtimeStr)
+	if tmpl != nil {
+		console.Info("Template: %s", tmpl.Name)
+	}
 
 	// Create project structure
 	sboxDir := filepath.Join(projectPath, config.SboxDir)
@@ -371,95 +1899,87 @@ func runInit(cmd *cobra.Command, args []string) {
 	}
 	console.Success("Created directory structure")
 
-	// Create runtime-specific files
-	runtime := config.RuntimeInfo{}
-	parts := strings.SplitN(runtimeStr, ":", 2)
-	if len(parts) >= 1 {
-		runtime.Language = strings.ToLower(parts[0])
-	}
-	if len(parts) >= 2 {
-		runtime.Version = parts[1]
-	}
-
-	if runtime.Language == "node" || runtime.Language == "nodejs" {
-		// Create package.json for Node.js
-		packageJSON := `{
-  "name": "` + projectName + `",
-  "version": "1.0.0",
-  "description": "A sbox project",
-  "main": "main.js",
-  "scripts": {
-    "start": "node main.js"
-  }
-}
-`
-		if err := os.WriteFile(filepath.Join(projectPath, "app", "package.json"), []byte(packageJSON), 0644); err != nil {
-			console.Fatal("Failed to create package.json: %s", err)
+	// Create the template's starter files, or runtime-specific ones
+	var created []string
+	if tmpl != nil {
+		files, err := tmpl.Files(projectName)
+		if err != nil {
+			console.Fatal("%s", err)
 		}
-
-		// Create main.js
-		mainJS := `// Main entry point for the application
-
-function main() {
-    console.log("Hello from sbox!");
-    console.log("Edit app/main.js to get started.");
-}
-
-main();
-`
-		if err := os.WriteFile(filepath.Join(projectPath, "app", "main.js"), []byte(mainJS), 0644); err != nil {
-			console.Fatal("Failed to create main.js: %s", err)
+		for _, file := range files {
+			path := filepath.Join(projectPath, filepath.FromSlash(file.Path))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				console.Fatal("Failed to create directory: %s", err)
+			}
+			content := withLicenseHeader(file.Path, string(file.Content), defaults.LicenseHeader)
+			if err := os.WriteFile(path, []byte(content), file.Mode); err != nil {
+				console.Fatal("Failed to create %s: %s", file.Path, err)
+			}
+			created = append(created, file.Path)
 		}
-		console.Success("Created Node.js project files")
+		console.Success("Created project files from template '%s'", tmpl.Name)
 	} else {
-		// Create Python files (default)
-		mainPy := `#!/usr/bin/env python3
-"""
-Main entry point for the application.
-"""
-
-def main():
-    print("Hello from sbox!")
-    print("Edit app/main.py to get started.")
-
-if __name__ == "__main__":
-    main()
-`
-		if err := os.WriteFile(filepath.Join(projectPath, "app", "main.py"), []byte(mainPy), 0644); err != nil {
-			console.Fatal("Failed to create main.py: %s", err)
-		}
-
-		// Create requirements.txt
-		reqTxt := "# Add your dependencies here\n"
-		if err := os.WriteFile(filepath.Join(projectPath, "app", "requirements.txt"), []byte(reqTxt), 0644); err != nil {
-			console.Fatal("Failed to create requirements.txt: %s", err)
+		files := scaffoldFiles(spec.Name, projectName, defaults.LicenseHeader)
+		for _, file := range files {
+			path := filepath.Join(projectPath, "app", file.name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				console.Fatal("Failed to create directory: %s", err)
+			}
+			if err := os.WriteFile(path, []byte(file.content), 0644); err != nil {
+				console.Fatal("Failed to create %s: %s", file.name, err)
+			}
+			created = append(created, "app/"+file.name)
 		}
-		console.Success("Created Python project files")
+		console.Success("Created %s project files", spec.DisplayName)
 	}
 
 	// Create config
 	cfg := config.NewDefaultConfig(runtimeStr)
+	if tmpl != nil {
+		cfg = tmpl.Config()
+		cfg.Runtime = runtimeStr
+	}
+	for key, value := range defaults.Env {
+		cfg.Env[key] = value
+	}
+	if noVCS {
+		cfg.VCS = config.VCSNone
+	}
 	if err := cfg.Save(projectPath); err != nil {
 		console.Fatal("Failed to create config: %s", err)
 	}
 	console.Success("Created config.yaml")
 
-	// Create .gitignore
-	gitignore := `.sbox/env/
-.sbox/rootfs/
-.sbox/bin/
-.sbox/mamba/
-.sbox/logs/
-sbox.lock
-__pycache__/
-*.pyc
-node_modules/
-.env
-`
-	if err := os.WriteFile(filepath.Join(projectPath, ".gitignore"), []byte(gitignore), 0644); err != nil {
-		console.Fatal("Failed to create .gitignore: %s", err)
+	// Keep local state out of version control: the project's .gitignore,
+	// or the .hgignore of the Mercurial repository it is created in
+	ignoreFile := ""
+	if !noVCS {
+		repo := vcs.Detect(projectPath)
+		if repo == nil {
+			// Not in a repository yet; most projects become git ones
+			repo = &vcs.Repo{Kind: vcs.Git, Root: projectPath}
+		}
+		patterns := append(append([]string{}, vcs.StatePaths...),
+			"sbox.lock", "__pycache__/", "*.pyc", "node_modules/", "target/", ".env")
+		if tmpl != nil {
+			patterns = append(patterns, tmpl.Gitignore...)
+		}
+		patterns = append(patterns, defaults.Gitignore...)
+		ignoreFile = repo.IgnoreFile(projectPath)
+		_, statErr := os.Stat(ignoreFile)
+		if err := repo.Ignore(projectPath, patterns); err != nil {
+			console.Fatal("Failed to update %s: %s", ignoreFile, err)
+		}
+		name := ignoreFile
+		if filepath.Dir(ignoreFile) == filepath.Clean(projectPath) {
+			name = filepath.Base(ignoreFile)
+		}
+		if statErr == nil {
+			console.Success("Updated %s", name)
+		} else {
+			console.Success("Created %s", name)
+		}
 	}
-	console.Success("Created .gitignore")
 
 	fmt.Println()
 	console.Success("Project initialized successfully!")
@@ -470,14 +1990,27 @@ node_modules/
 	console.Print("  │   ├── config.yaml")
 	console.Print("  │   └── logs/")
 	console.Print("  ├── app/")
-	if runtime.Language == "node" || runtime.Language == "nodejs" {
-		console.Print("  │   ├── main.js")
-		console.Print("  │   └── package.json")
-	} else {
-		console.Print("  │   ├── main.py")
-		console.Print("  │   └── requirements.txt")
+	var appFiles, otherFiles []string
+	for _, path := range created {
+		if name, ok := strings.CutPrefix(path, "app/"); ok {
+			appFiles = append(appFiles, name)
+		} else {
+			otherFiles = append(otherFiles, path)
+		}
+	}
+	for i, name := range appFiles {
+		branch := "├──"
+		if i == len(appFiles)-1 {
+			branch = "└──"
+		}
+		console.Print("  │   %s %s", branch, name)
+	}
+	for _, path := range otherFiles {
+		console.Print("  ├── %s", path)
+	}
+	if filepath.Dir(ignoreFile) == filepath.Clean(projectPath) {
+		console.Print("  └── %s", filepath.Base(ignoreFile))
 	}
-	console.Print("  └── .gitignore")
 	fmt.Println()
 	console.Print("  Next steps:")
 	console.Print("    cd %s", projectName)
@@ -486,85 +2019,513 @@ node_modules/
 	console.Print("    sbox status     # Check project status")
 }
 
-func runBuild(cmd *cobra.Command, args []string) {
-	force, _ := cmd.Flags().GetBool("force")
-	verbose, _ := cmd.Flags().GetBool("verbose")
+// scaffoldFile is a starter file written into app/ by sbox init
+type scaffoldFile struct {
+	name    string
+	content string
+}
 
-	projectRoot, err := config.GetProjectRoot("")
-	if err != nil {
-		console.Fatal("Not in an sbox project. Run 'sbox init <name>' first.")
-	}
+// scaffoldFiles returns the starter application files for a runtime
+func scaffoldFiles(language, projectName, header string) []scaffoldFile {
+	switch language {
+	case "node":
+		return []scaffoldFile{
+			{"main.js", licenseHeader(header, "//") + `// Main entry point for the application
 
-	projectName := filepath.Base(projectRoot)
-	console.Step("Building sandbox: %s", projectName)
+function main() {
+    console.log("Hello from sbox!");
+    console.log("Edit app/main.js to get started.");
+}
 
-	cfg, err := config.Load(projectRoot)
-	if err != nil {
-		console.Fatal("Failed to load config: %s", err)
-	}
+main();
+`},
+			{"package.json", `{
+  "name": "` + projectName + `",
+  "version": "1.0.0",
+  "description": "A sbox project",
+  "main": "main.js",
+  "scripts": {
+    "start": "node main.js"
+  }
+}
+`},
+		}
+	case "go":
+		return []scaffoldFile{
+			{"go.mod", "module " + projectName + "\n\ngo 1.21\n"},
+			{"main.go", licenseHeader(header, "//") + `// Main entry point for the application
+package main
 
-	// Validate configuration before building
-	console.Info("Validating configuration...")
-	validationResult := validate.ValidateConfig(cfg, projectRoot)
+import "fmt"
 
-	if !validationResult.Valid {
-		console.Error("Configuration validation failed:")
-		fmt.Println()
-		for _, verr := range validationResult.Errors {
-			console.Print("  ✗ %s: %s", verr.Field, verr.Message)
-			if verr.Hint != "" {
-				console.Print("    → %s", verr.Hint)
-			}
+func main() {
+	fmt.Println("Hello from sbox!")
+	fmt.Println("Edit app/main.go to get started.")
+}
+`},
 		}
-		fmt.Println()
-		console.Fatal("Fix the configuration errors above and try again. Run 'sbox validate' for more details.")
-	}
-
-	// Show warnings but continue
-	if len(validationResult.Warnings) > 0 {
-		console.Warning("Configuration has %d warning(s):", len(validationResult.Warnings))
-		for _, warn := range validationResult.Warnings {
-			console.Print("  ⚠ %s: %s", warn.Field, warn.Message)
+	case "java":
+		return []scaffoldFile{
+			{"Main.java", licenseHeader(header, "//") + `// Main entry point for the application
+public class Main {
+    public static void main(String[] args) {
+        System.out.println("Hello from sbox!");
+        System.out.println("Edit app/Main.java to get started.");
+    }
+}
+`},
 		}
-		fmt.Println()
-	}
+	case "ruby":
+		return []scaffoldFile{
+			{"main.rb", licenseHeader(header, "#") + `# Main entry point for the application
 
-	console.Success("Configuration validated")
-	console.Info("Runtime: %s", cfg.Runtime)
-	console.Info("Workdir: %s", cfg.Workdir)
+def main
+  puts "Hello from sbox!"
+  puts "Edit app/main.rb to get started."
+end
 
-	if !force && config.IsUpToDate(projectRoot, cfg) {
-		console.Success("Build is up to date (use --force to rebuild)")
-		return
+main
+`},
+		}
+	case "rust":
+		return []scaffoldFile{
+			{"Cargo.toml", `[package]
+name = "` + projectName + `"
+version = "0.1.0"
+edition = "2021"
+
+[dependencies]
+`},
+			{"src/main.rs", licenseHeader(header, "//") + `// Main entry point for the application
+
+fn main() {
+    println!("Hello from sbox!");
+    println!("Edit app/src/main.rs to get started.");
+}
+`},
+		}
 	}
 
-	startTime := time.Now()
+	return []scaffoldFile{
+		{"main.py", "#!/usr/bin/env python3\n" + licenseHeader(header, "#") + `"""
+Main entry point for the application.
+"""
 
-	b, err := builder.New(projectRoot)
-	if err != nil {
-		console.Fatal("Failed to initialize builder: %s", err)
-	}
+def main():
+    print("Hello from sbox!")
+    print("Edit app/main.py to get started.")
 
-	if verbose {
-		console.Info("Starting build process...")
+if __name__ == "__main__":
+    main()
+`},
+		{"requirements.txt", "# Add your dependencies here\n"},
 	}
+}
 
-	if err := b.Build(force); err != nil {
-		console.Fatal("Build failed: %s", err)
+// printTemplates lists the project templates of 'sbox init --template'
+func printTemplates() {
+	list, problems := templates.List()
+	for _, problem := range problems {
+		console.Warning("%s", problem)
 	}
 
-	elapsed := time.Since(startTime)
+	console.Step("Project templates:")
+	for _, t := range list {
+		line := fmt.Sprintf("  %-14s %-12s %s", t.Name, t.Runtime, t.Description)
+		if t.Source != templates.Builtin {
+			line += fmt.Sprintf(" (%s)", t.Source)
+		}
+		console.Print("%s", line)
+	}
 	fmt.Println()
-	console.Success("Build completed in %s", formatDuration(elapsed))
+	if dir, err := templates.GetUserTemplateDir(); err == nil {
+		console.Print("    → Add your own as %s", filepath.Join(dir, "<name>", templates.MetadataFile))
+	}
+}
 
-	// Show build summary
-	if lock, err := config.LoadLock(projectRoot); err == nil {
-		console.Print("  Config hash: %s", lock.ConfigHash[:8])
-		console.Print("  Built at: %s", lock.BuiltAt)
+// commentPrefixes are the line comment markers of the starter files that
+// get the user's license header, by extension
+var commentPrefixes = map[string]string{
+	".py": "#", ".rb": "#", ".sh": "#",
+	".js": "//", ".ts": "//", ".go": "//", ".java": "//", ".rs": "//",
+}
+
+// withLicenseHeader prepends the user's license header to a starter
+// source file, after its shebang line
+func withLicenseHeader(path, content, header string) string {
+	comment, ok := commentPrefixes[filepath.Ext(path)]
+	if !ok || header == "" {
+		return content
+	}
+	shebang := ""
+	if strings.HasPrefix(content, "#!") {
+		end := strings.IndexByte(content, '\n') + 1
+		if end == 0 {
+			end = len(content)
+		}
+		shebang, content = content[:end], content[end:]
 	}
+	return shebang + licenseHeader(header, comment) + content
 }
 
-func runRun(cmd *cobra.Command, args []string) {
+// initBare adds a .sbox/config.yaml to an existing directory without
+// touching anything else in the tree
+func initBare(cmd *cobra.Command, projectPath, runtimeStr string, defaults config.InitDefaults, force bool) {
+	absPath, err := filepath.Abs(projectPath)
+	if err != nil {
+		console.Fatal("Invalid path: %s", err)
+	}
+	if info, err := os.Stat(absPath); err != nil || !info.IsDir() {
+		console.Fatal("Directory '%s' does not exist", projectPath)
+	}
+
+	// An sbox.yaml anchor is the config too, and would be overwritten
+	configPath := config.GetConfigPath(absPath)
+	if _, err := os.Stat(configPath); err == nil {
+		if !force {
+			console.Fatal("%s already exists. Use --force to overwrite.", configPath)
+		}
+		confirm(cmd, "--force replaces the existing config; it is moved to the trash:", pathItems(absPath, configPath), "Overwrite it?")
+		printUndoHint(moveToTrash("init --bare --force", configPath))
+	}
+
+	// Dependency files in the tree pick the install commands, the start
+	// command and, unless one was chosen, the runtime
+	manifests := config.DetectManifests(absPath, ".")
+	spec, _ := config.LookupRuntime(config.NewDefaultConfig(runtimeStr).ParseRuntime().Language)
+	if len(manifests) > 0 && !cmd.Flags().Changed("runtime") && defaults.Runtime == "" && manifests[0].Language != spec.Name {
+		spec, _ = config.LookupRuntime(manifests[0].Language)
+		runtimeStr = spec.Name + ":" + spec.Versions[len(spec.Versions)-1]
+	}
+
+	console.Step("Initializing sbox in: %s", absPath)
+	console.Info("Runtime: %s", runtimeStr)
+
+	// The existing tree is the application
+	cfg := config.NewDefaultConfig(runtimeStr)
+	cfg.Copy = []string{".:/app"}
+	cfg.Install = []string{}
+	detectedCmd := false
+	for _, m := range manifests {
+		if m.Language != spec.Name {
+			if m.Install == "" {
+				continue
+			}
+			console.Warning("Found %s, but the runtime is not %s; install it yourself", m.Path, m.Language)
+			continue
+		}
+		console.Info("Found %s", m.Path)
+		if m.Install != "" {
+			cfg.Install = append(cfg.Install, m.Install)
+		}
+		if m.Cmd != "" && !detectedCmd {
+			cfg.Cmd = m.Cmd
+			detectedCmd = true
+		}
+	}
+	for key, value := range defaults.Env {
+		cfg.Env[key] = value
+	}
+	if err := cfg.Save(absPath); err != nil {
+		console.Fatal("Failed to create config: %s", err)
+	}
+	console.Success("Created %s", configPath)
+
+	fmt.Println()
+	console.Print("  Next steps:")
+	if len(manifests) > 0 {
+		console.Print("    Check the install commands and cmd in .sbox/config.yaml")
+	} else {
+		console.Print("    Edit .sbox/config.yaml (install commands, cmd)")
+	}
+	console.Print("    Add .sbox/ build outputs and sbox.lock to your VCS ignore file")
+	console.Print("    sbox build      # Build the sandbox environment")
+}
+
+// initFromDockerfile creates the config of an existing directory, the
+// build context, from a Dockerfile
+func initFromDockerfile(cmd *cobra.Command, projectPath, dockerfilePath, runtimeStr string, defaults config.InitDefaults, force, noVCS bool) {
+	absPath, err := filepath.Abs(projectPath)
+	if err != nil {
+		console.Fatal("Invalid path: %s", err)
+	}
+	if info, err := os.Stat(absPath); err != nil || !info.IsDir() {
+		console.Fatal("Directory '%s' does not exist", projectPath)
+	}
+
+	// An sbox.yaml anchor is the config too, and would be overwritten
+	configPath := config.GetConfigPath(absPath)
+	if _, err := os.Stat(configPath); err == nil {
+		if !force {
+			console.Fatal("%s already exists. Use --force to overwrite.", configPath)
+		}
+		confirm(cmd, "--force replaces the existing config; it is moved to the trash:", pathItems(absPath, configPath), "Overwrite it?")
+		printUndoHint(moveToTrash("init --from-dockerfile --force", configPath))
+	}
+
+	console.Step("Importing %s into: %s", dockerfilePath, absPath)
+	imported, err := dockerfile.ImportFile(dockerfilePath, absPath)
+	if err != nil {
+		console.Fatal("Failed to import %s: %s", dockerfilePath, err)
+	}
+
+	// --runtime wins over the base image, which wins over the user default
+	cfg := imported.Config
+	switch {
+	case cmd.Flags().Changed("runtime") || imported.Runtime == "":
+		cfg.Runtime = runtimeStr
+	default:
+		cfg.Runtime = imported.Runtime
+	}
+	console.Info("Runtime: %s", cfg.Runtime)
+	for key, value := range defaults.Env {
+		if _, ok := cfg.Env[key]; !ok {
+			cfg.Env[key] = value
+		}
+	}
+	if noVCS {
+		cfg.VCS = config.VCSNone
+	}
+
+	for _, warning := range imported.Warnings {
+		console.Warning("%s", warning)
+	}
+	if err := cfg.Save(absPath); err != nil {
+		console.Fatal("Failed to create config: %s", err)
+	}
+	console.Success("Created %s", configPath)
+
+	fmt.Println()
+	console.Print("  Next steps:")
+	console.Print("    Check the copy specs, install commands and cmd in .sbox/config.yaml")
+	if len(imported.Warnings) > 0 {
+		console.Print("    Replace what was skipped (see the warnings above)")
+	}
+	console.Print("    sbox build      # Build the sandbox environment")
+}
+
+// licenseHeader renders a user-configured license header as a comment
+// block using the given line comment prefix
+func licenseHeader(text, comment string) string {
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return ""
+	}
+
+	var sb strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), comment) {
+			sb.WriteString(line)
+		} else if line == "" {
+			sb.WriteString(comment)
+		} else {
+			sb.WriteString(comment + " " + line)
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+func runBuild(cmd *cobra.Command, args []string) {
+	force, _ := cmd.Flags().GetBool("force")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	frozen, _ := cmd.Flags().GetBool("frozen")
+	offline, _ := cmd.Flags().GetBool("offline")
+	if noNetwork, _ := cmd.Flags().GetBool("no-network"); noNetwork {
+		offline = true
+	}
+	buildArgFlags, _ := cmd.Flags().GetStringArray("build-arg")
+	buildArgs, err := config.ParseBuildArgs(buildArgFlags)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project. Run 'sbox init <name>' first.")
+	}
+	if client := daemonClient(cmd); client != nil {
+		forwardToDaemon(client, projectRoot, api.OpBuild, api.BuildRequest{
+			Options:   daemonOptions(),
+			Force:     force,
+			Verbose:   verbose,
+			Frozen:    frozen,
+			Offline:   offline,
+			BuildArgs: buildArgs,
+		})
+	}
+
+	projectName := filepath.Base(projectRoot)
+	console.Step("Building sandbox: %s", projectName)
+
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	if cfg, err = cfg.WithBuildArgs(projectRoot, buildArgs); err != nil {
+		console.Fatal("%s\n    → Declare build args under args: in .sbox/config.yaml", err)
+	}
+
+	// Validate configuration before building
+	console.Info("Validating configuration...")
+	validationResult := validate.ValidateConfig(cfg, projectRoot)
+
+	if !validationResult.Valid {
+		console.Error("Configuration validation failed:")
+		fmt.Println()
+		for _, verr := range validationResult.Errors {
+			console.Print("  ✗ %s: %s", verr.Field, verr.Message)
+			if verr.Hint != "" {
+				console.Print("    → %s", verr.Hint)
+			}
+		}
+		fmt.Println()
+		console.Fatal("Fix the configuration errors above and try again. Run 'sbox validate' for more details.")
+	}
+
+	// Show warnings but continue
+	if len(validationResult.Warnings) > 0 {
+		console.Warning("Configuration has %d warning(s):", len(validationResult.Warnings))
+		for _, warn := range validationResult.Warnings {
+			console.Print("  ⚠ %s: %s", warn.Field, warn.Message)
+		}
+		fmt.Println()
+	}
+
+	console.Success("Configuration validated")
+	console.Info("Runtime: %s", cfg.Runtime)
+	console.Info("Workdir: %s", cfg.Workdir)
+
+	if !force && builder.UpToDate(projectRoot, cfg) {
+		console.Success("Build is up to date (use --force to rebuild)")
+		offerIgnore(projectRoot, cfg)
+		return
+	}
+
+	startTime := time.Now()
+
+	if verbose {
+		console.Info("Starting build process...")
+	}
+
+	if err := buildProject(projectRoot, cfg, force, frozen, offline, verbose); err != nil {
+		console.Emit(console.LevelError, console.Fields{"project": projectName, "error": err.Error()}, "Build failed: %s", err)
+		os.Exit(1)
+	}
+
+	elapsed := time.Since(startTime)
+	fmt.Println()
+	console.Emit(console.LevelSuccess, console.Fields{"project": projectName, "duration_ms": elapsed.Milliseconds()},
+		"Build completed in %s", formatDuration(elapsed))
+
+	// Show build summary
+	if lock, err := config.LoadLock(projectRoot); err == nil {
+		console.Print("  Config hash: %s", lock.ConfigHash[:8])
+		console.Print("  Built at: %s", lock.BuiltAt)
+		if lock.Profile != "" {
+			console.Print("  Profile: %s", lock.Profile)
+		}
+		if len(lock.BuildArgs) > 0 {
+			console.Print("  Build args: %s", formatBuildArgs(lock.BuildArgs))
+		}
+		if !lock.Packages.Empty() {
+			console.Print("  Packages: %d conda, %d pip, %d npm (locked)",
+				len(lock.Packages.Conda), len(lock.Packages.Pip), len(lock.Packages.Npm)+len(lock.Packages.NpmLocal))
+		}
+	}
+
+	offerIgnore(projectRoot, cfg)
+}
+
+// offerIgnore offers to add the local state of a project that its
+// .gitignore or .hgignore misses, unless vcs is none
+func offerIgnore(projectRoot string, cfg *config.Config) {
+	if cfg.VCS == config.VCSNone {
+		return
+	}
+	repo := vcs.Detect(projectRoot)
+	if repo == nil {
+		return
+	}
+	missing := repo.Unignored(projectRoot)
+	if len(missing) == 0 {
+		return
+	}
+
+	file := repo.IgnoreFile(projectRoot)
+	fmt.Println()
+	console.Warning("%s does not ignore sbox's local state:", file)
+	for _, path := range missing {
+		console.Print("  %s", path)
+	}
+	if console.JSON() || !runner.StdinIsTerminal() {
+		console.Print("  → Add them, or set vcs: none in .sbox/config.yaml to leave %s alone", filepath.Base(file))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Add them to %s? [y/N] ", filepath.Base(file))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		if err := repo.Ignore(projectRoot, missing); err != nil {
+			console.Warning("Failed to update %s: %s", file, err)
+			return
+		}
+		console.Success("Updated %s", file)
+	default:
+		console.Info("Set vcs: none in .sbox/config.yaml to stop asking")
+	}
+}
+
+// buildProject builds a project and records the attempt in its build
+// history
+func buildProject(projectRoot string, cfg *config.Config, force, frozen, offline, verbose bool) error {
+	startTime := time.Now()
+
+	b, err := builder.New(projectRoot)
+	if err != nil {
+		return fmt.Errorf("failed to initialize builder: %w", err)
+	}
+	// cfg may carry --build-arg values the builder's own load does not
+	b.Config = cfg
+	b.Frozen = frozen
+	if offline {
+		b.Offline = true
+	}
+
+	buildErr := b.Build(force)
+
+	record := config.BuildRecord{
+		StartedAt:  startTime,
+		Duration:   formatDuration(time.Since(startTime)),
+		ConfigHash: cfg.Hash(),
+		Runtime:    cfg.Runtime,
+		Success:    buildErr == nil,
+	}
+	if buildErr != nil {
+		record.Error = buildErr.Error()
+	}
+	if err := config.AppendBuildRecord(projectRoot, record); err != nil && verbose {
+		console.Warning("Failed to record build history: %s", err)
+	}
+
+	return buildErr
+}
+
+// formatBuildArgs formats build args as NAME=VALUE, sorted by name
+func formatBuildArgs(args map[string]string) string {
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + args[name]
+	}
+	return strings.Join(names, " ")
+}
+
+func runRun(cmd *cobra.Command, args []string) {
 	projectRoot, err := config.GetProjectRoot("")
 	if err != nil {
 		console.Fatal("Not in an sbox project.")
@@ -573,6 +2534,23 @@ func runRun(cmd *cobra.Command, args []string) {
 	detach, _ := cmd.Flags().GetBool("detach")
 	name, _ := cmd.Flags().GetString("name")
 
+	if client := daemonClient(cmd); client != nil {
+		for _, flag := range []string{"tty", "env-file", "remote", "metrics", "metrics-json"} {
+			if cmd.Flags().Changed(flag) {
+				console.Fatal("--%s cannot be used with the sbox daemon", flag)
+			}
+		}
+		req := api.RunRequest{Options: daemonOptions(), Command: strings.Join(args, " "), Detach: detach, Name: name}
+		if cmd.Flags().Changed("idle-timeout") {
+			idle, _ := cmd.Flags().GetDuration("idle-timeout")
+			req.IdleTimeout = idle.String()
+		}
+		if cmd.Flags().Changed("restart") {
+			req.Restart, _ = cmd.Flags().GetString("restart")
+		}
+		forwardToDaemon(client, projectRoot, api.OpRun, req)
+	}
+
 	if name == "" {
 		name = filepath.Base(projectRoot)
 	}
@@ -586,24 +2564,37 @@ func runRun(cmd *cobra.Command, args []string) {
 	if err := validate.QuickValidate(cfg, projectRoot); err != nil {
 		console.Fatal("Configuration error: %s\n\nRun 'sbox validate' for detailed diagnostics.", err)
 	}
-
-	r, err := runner.New(projectRoot)
-	if err != nil {
-		console.Fatal("Failed to load config: %s", err)
-	}
+	warnProfileMismatch(projectRoot, cfg)
 
 	var command string
 	if len(args) > 0 {
 		command = strings.Join(args, " ")
 	}
 
+	if remoteName, _ := cmd.Flags().GetString("remote"); remoteName != "" {
+		runRemote(cmd, projectRoot, cfg, remoteName, command)
+		return
+	}
+
+	r, err := runner.New(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	envFiles := loadEnvFiles(cmd, r)
+
 	if detach {
+		if tty, _ := cmd.Flags().GetBool("tty"); tty {
+			console.Fatal("--tty cannot be used with --detach")
+		}
 		// Run as daemon
+		if err := r.CheckBuilt(); err != nil {
+			console.Fatal("%s", err)
+		}
 		pm := process.NewProcessManager(projectRoot)
 
 		// Check if already running
 		existing, _ := pm.GetProcess(name)
-		if existing != nil && existing.Status == "running" && process.IsProcessRunning(existing.PID) {
+		if existing != nil && (existing.Status == "running" || existing.Status == "paused") && process.IsProcessRunning(existing.PID) {
 			console.Fatal("Process '%s' is already running (PID: %d). Use 'sbox stop %s' first.", name, existing.PID, name)
 		}
 
@@ -617,19 +2608,57 @@ func runRun(cmd *cobra.Command, args []string) {
 			console.Fatal("No command specified and no default cmd in config")
 		}
 
-		env := r.BuildEnv()
+		r.ServiceName = name
 		workdir := r.ResolveWorkdir()
 
-		info, err := pm.StartDaemon(name, cmdToRun, env, workdir)
+		idleTimeout, _ := cmd.Flags().GetDuration("idle-timeout")
+		if idleTimeout == 0 && cfg.IdleTimeout != "" {
+			idleTimeout, _ = time.ParseDuration(cfg.IdleTimeout)
+		}
+
+		restartFlag, _ := cmd.Flags().GetString("restart")
+		policy, err := process.ParseRestartPolicy(restartFlag)
+		if err != nil {
+			console.Fatal("%s", err)
+		}
+
+		pm.Wrap, err = r.IsolationPrefix(workdir)
+		if err != nil {
+			console.Fatal("%s", err)
+		}
+		pm.EnvFiles = envFiles
+		if err := applyLogRotation(cmd, &pm.Rotation); err != nil {
+			console.Fatal("%s", err)
+		}
+
+		// Even without a restart policy the supervisor outlives this
+		// command, so it sees how the daemon exits and records crashes
+		info, err := startSupervised(pm, name, cmdToRun, policy)
 		if err != nil {
 			console.Fatal("Failed to start daemon: %s", err)
 		}
+		if err := startMeter(pm, info); err != nil {
+			console.Warning("Failed to start usage meter: %s", err)
+		}
+
+		if idleTimeout > 0 {
+			if err := startIdleWatcher(pm, info, idleTimeout); err != nil {
+				console.Warning("Failed to start idle watcher: %s", err)
+			}
+		}
 
-		console.Success("Daemon started successfully")
+		console.Emit(console.LevelSuccess, console.Fields{"name": info.Name, "pid": info.PID, "log": info.LogFile},
+			"Daemon started successfully")
 		console.Print("  PID:     %d", info.PID)
 		console.Print("  Name:    %s", info.Name)
 		console.Print("  Command: %s", info.Command)
 		console.Print("  Log:     %s", info.LogFile)
+		if info.IdleTimeout != "" {
+			console.Print("  Idle:    auto-stop after %s", info.IdleTimeout)
+		}
+		if info.Restart != "" {
+			console.Print("  Restart: %s", info.Restart)
+		}
 		fmt.Println()
 		console.Print("  Use 'sbox logs %s' to view output", name)
 		console.Print("  Use 'sbox stop %s' to stop the daemon", name)
@@ -637,14 +2666,49 @@ func runRun(cmd *cobra.Command, args []string) {
 	}
 
 	// Run in foreground
+	r.TTY, _ = cmd.Flags().GetBool("tty")
 	exitCode, err := r.Run(command)
 	if err != nil {
 		console.Fatal("%s", err)
 	}
 
+	reportExit(exitCode)
+	if r.Metrics != nil {
+		reportMetrics(cmd, r.Metrics)
+	}
 	os.Exit(exitCode)
 }
 
+// reportMetrics prints or writes the metrics of a foreground run, as
+// asked by --metrics and --metrics-json
+func reportMetrics(cmd *cobra.Command, m *runner.Metrics) {
+	if show, _ := cmd.Flags().GetBool("metrics"); show {
+		cpuPercent := 0.0
+		if m.WallSeconds > 0 {
+			cpuPercent = m.CPUSeconds() / m.WallSeconds * 100
+		}
+		fmt.Println()
+		console.Emit(console.LevelInfo, console.Fields{
+			"exit_code": m.ExitCode, "wall_seconds": m.WallSeconds, "user_seconds": m.UserSeconds,
+			"system_seconds": m.SystemSeconds, "max_rss_bytes": m.MaxRSS,
+		}, "Run metrics")
+		console.Print("  Exit code: %d", m.ExitCode)
+		console.Print("  Wall time: %s", formatCPUSeconds(m.WallSeconds))
+		console.Print("  CPU time:  %s (user %s, system %s, %.0f%% of wall)", formatCPUSeconds(m.CPUSeconds()),
+			formatCPUSeconds(m.UserSeconds), formatCPUSeconds(m.SystemSeconds), cpuPercent)
+		console.Print("  Max RSS:   %s", formatBytes(m.MaxRSS))
+	}
+	if path, _ := cmd.Flags().GetString("metrics-json"); path != "" {
+		data, _ := json.MarshalIndent(m, "", "  ")
+		data = append(data, '\n')
+		if path == "-" {
+			os.Stdout.Write(data)
+		} else if err := os.WriteFile(path, data, 0644); err != nil {
+			console.Warning("Failed to write metrics: %s", err)
+		}
+	}
+}
+
 func runShell(cmd *cobra.Command, args []string) {
 	projectRoot, err := config.GetProjectRoot("")
 	if err != nil {
@@ -655,6 +2719,9 @@ func runShell(cmd *cobra.Command, args []string) {
 	if err != nil {
 		console.Fatal("Failed to load config: %s", err)
 	}
+	loadEnvFiles(cmd, r)
+	r.Pure, _ = cmd.Flags().GetBool("pure")
+	r.ShellName, _ = cmd.Flags().GetString("shell")
 
 	exitCode, err := r.Shell()
 	if err != nil {
@@ -664,36 +2731,467 @@ func runShell(cmd *cobra.Command, args []string) {
 	os.Exit(exitCode)
 }
 
-func runExec(cmd *cobra.Command, args []string) {
+func runWhich(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
 	projectRoot, err := config.GetProjectRoot("")
 	if err != nil {
 		console.Fatal("Not in an sbox project.")
 	}
-
 	r, err := runner.New(projectRoot)
 	if err != nil {
 		console.Fatal("Failed to load config: %s", err)
 	}
-
-	exitCode, err := r.Exec(args)
-	if err != nil {
-		console.Fatal("%s", err)
+	r.Pure, _ = cmd.Flags().GetBool("pure")
+	if !config.IsBuilt(projectRoot) {
+		console.Warning("Environment not built; only host directories can match. Run 'sbox build' first.")
+	}
+	if len(args) == 0 {
+		spec, ok := config.LookupRuntime(r.Config.ParseRuntime().Language)
+		if !ok {
+			console.Fatal("Unknown runtime %s; name the commands to resolve", r.Config.Runtime)
+		}
+		args = []string{spec.Binary}
 	}
 
-	os.Exit(exitCode)
+	var results []*runner.Resolution
+	missing := false
+	for _, name := range args {
+		res := r.Which(name)
+		results = append(results, res)
+		if !res.Found() {
+			missing = true
+		}
+	}
+	if asJSON {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for i, res := range results {
+			if i > 0 {
+				fmt.Println()
+			}
+			printResolution(r, res)
+		}
+	}
+	if missing {
+		os.Exit(1)
+	}
 }
 
-func runStatus(cmd *cobra.Command, args []string) {
-	asJSON, _ := cmd.Flags().GetBool("json")
-
-	projectRoot, err := config.GetProjectRoot("")
-	if err != nil {
-		if asJSON {
-			fmt.Println(`{"error": "not in sbox project"}`)
-		} else {
-			console.Warning("Not in an sbox project")
+// printResolution prints where a name resolves, first match first
+func printResolution(r *runner.Runner, res *runner.Resolution) {
+	console.Print("%s", res.Name)
+	if !res.Found() {
+		console.Print("  sandbox: not found")
+	}
+	for i, path := range res.Sandbox {
+		label := "  sandbox:"
+		if i > 0 {
+			label = "          "
 		}
-		return
+		if !r.InEnv(path) {
+			path += " (host)"
+		}
+		if i > 0 {
+			path += " (shadowed)"
+		} else if res.Target != "" {
+			path += " → " + res.Target
+		}
+		console.Print("%s %s", label, path)
+	}
+	if len(res.Host) == 0 {
+		console.Print("  host:    not found")
+	}
+	for i, path := range res.Host {
+		label := "  host:   "
+		if i > 0 {
+			label = "          "
+			path += " (shadowed)"
+		}
+		console.Print("%s %s", label, path)
+	}
+	for _, warning := range res.Warnings {
+		console.Warning("%s", warning)
+	}
+}
+
+func runExec(cmd *cobra.Command, args []string) {
+	all, _ := cmd.Flags().GetBool("all")
+	if all || cmd.Flags().Changed("label") {
+		runExecAll(cmd, args)
+		return
+	}
+	if parallel, _ := cmd.Flags().GetBool("parallel"); parallel {
+		console.Fatal("--parallel needs --all or --label")
+	}
+
+	project, _ := cmd.Flags().GetString("project")
+	projectRoot, err := config.GetProjectRoot(project)
+	if err != nil {
+		if project != "" {
+			console.Fatal("%s is not in an sbox project.", project)
+		}
+		console.Fatal("Not in an sbox project.")
+	}
+
+	r, err := runner.New(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	if inCwd, _ := cmd.Flags().GetBool("cwd"); inCwd {
+		if r.Workdir, err = os.Getwd(); err != nil {
+			console.Fatal("%s", err)
+		}
+	}
+
+	envFiles := loadEnvFiles(cmd, r)
+	r.TTY, _ = cmd.Flags().GetBool("tty")
+	r.Interactive = runner.StdinIsTerminal()
+	if cmd.Flags().Changed("interactive") {
+		r.Interactive, _ = cmd.Flags().GetBool("interactive")
+	}
+
+	if detach, _ := cmd.Flags().GetBool("detach"); detach {
+		if r.TTY {
+			console.Fatal("--tty cannot be used with --detach")
+		}
+		if interactive, _ := cmd.Flags().GetBool("interactive"); interactive {
+			console.Fatal("--interactive cannot be used with --detach")
+		}
+		name, _ := cmd.Flags().GetString("name")
+		if name == "" {
+			name = filepath.Base(args[0])
+		}
+		startExecJob(r, name, args, envFiles)
+		return
+	}
+
+	exitCode, err := r.Exec(args)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	reportExit(exitCode)
+	os.Exit(exitCode)
+}
+
+// runExecAll runs 'sbox exec --all': the command in each selected compose
+// service, with output lines prefixed by the service name
+func runExecAll(cmd *cobra.Command, args []string) {
+	for _, flag := range []string{"detach", "name", "tty", "interactive"} {
+		if cmd.Flags().Changed(flag) {
+			console.Fatal("--%s cannot be used with --all or --label", flag)
+		}
+	}
+	parallel, _ := cmd.Flags().GetBool("parallel")
+	labels, _ := cmd.Flags().GetStringArray("label")
+
+	f := loadComposeFile(cmd)
+	names, err := f.Select(labels)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	if len(names) == 0 {
+		console.Fatal("No services match %s", strings.Join(labels, ", "))
+	}
+
+	width := 0
+	for _, name := range names {
+		width = max(width, len(name))
+	}
+	var mu sync.Mutex
+
+	// Runners are set up first, so a broken service fails before any runs
+	runners := make(map[string]*runner.Runner)
+	failed := make(map[string]error)
+	for _, name := range names {
+		r, err := execServiceRunner(f, name)
+		if err != nil {
+			failed[name] = err
+			continue
+		}
+		loadEnvFiles(cmd, r)
+		r.Stdout = &prefixWriter{mu: &mu, out: os.Stdout, prefix: fmt.Sprintf("%-*s | ", width, name)}
+		r.Stderr = &prefixWriter{mu: &mu, out: os.Stderr, prefix: fmt.Sprintf("%-*s | ", width, name)}
+		runners[name] = r
+	}
+
+	codes := make(map[string]int)
+	run := func(name string) {
+		r := runners[name]
+		code, err := r.Exec(args)
+		r.Stdout.(*prefixWriter).Flush()
+		r.Stderr.(*prefixWriter).Flush()
+		mu.Lock()
+		defer mu.Unlock()
+		codes[name] = code
+		if err != nil {
+			failed[name] = err
+		}
+	}
+
+	if parallel {
+		var wg sync.WaitGroup
+		for _, name := range names {
+			if runners[name] == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				run(name)
+			}(name)
+		}
+		wg.Wait()
+	} else {
+		for _, name := range names {
+			if runners[name] != nil {
+				run(name)
+			}
+		}
+	}
+
+	fmt.Println()
+	exitCode := 0
+	for _, name := range names {
+		code := codes[name]
+		if err, ok := failed[name]; ok {
+			console.Emit(console.LevelError, console.Fields{"service": name, "error": err.Error()},
+				"%-*s  %s", width, name, err)
+			code = max(code, 1)
+		} else if code != 0 {
+			console.Emit(console.LevelError, console.Fields{"service": name, "exit_code": code},
+				"%-*s  exited with status %d", width, name, code)
+		} else {
+			console.Emit(console.LevelSuccess, console.Fields{"service": name, "exit_code": code},
+				"%-*s  ok", width, name)
+		}
+		if exitCode == 0 {
+			exitCode = code
+		}
+	}
+
+	os.Exit(exitCode)
+}
+
+// execServiceRunner returns a runner for a compose service, with the
+// service's env overriding the project's
+func execServiceRunner(f *compose.File, name string) (*runner.Runner, error) {
+	if err := f.Materialize(name); err != nil {
+		return nil, fmt.Errorf("failed to generate project: %w", err)
+	}
+	r, err := runner.New(f.ProjectRoot(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := r.CheckBuilt(); err != nil {
+		return nil, fmt.Errorf("not built; run 'sbox compose up %s' first", name)
+	}
+
+	r.ServiceName = name
+	if r.Config.Env == nil {
+		r.Config.Env = make(map[string]string)
+	}
+	for key, value := range f.Services[name].Env {
+		r.Config.Env[key] = value
+	}
+	return r, nil
+}
+
+// prefixWriter writes each line to out behind a prefix, holding back a
+// partial line until it is complete so lines of concurrent writers do
+// not interleave
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.mu.Lock()
+		fmt.Fprintf(w.out, "%s%s", w.prefix, w.buf[:i+1])
+		w.mu.Unlock()
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Flush writes a trailing partial line
+func (w *prefixWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.Write([]byte("\n"))
+	}
+}
+
+// loadEnvFiles loads the --env-file files of run, exec and shell and
+// returns their absolute paths
+func loadEnvFiles(cmd *cobra.Command, r *runner.Runner) []string {
+	files, _ := cmd.Flags().GetStringArray("env-file")
+	var paths []string
+	for _, file := range files {
+		path, err := filepath.Abs(file)
+		if err != nil {
+			console.Fatal("Invalid env file path: %s", err)
+		}
+		if err := r.LoadEnvFile(path); err != nil {
+			console.Fatal("%s", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// startExecJob runs 'sbox exec --detach' through the process manager, so
+// the job gets its own log and can be listed and stopped like a daemon
+func startExecJob(r *runner.Runner, name string, args []string, envFiles []string) {
+	if err := r.CheckBuilt(); err != nil {
+		console.Fatal("%s", err)
+	}
+	if strings.ContainsAny(name, "/ ") {
+		console.Fatal("Job name cannot contain '/' or spaces")
+	}
+
+	pm := process.NewProcessManager(r.ProjectRoot)
+	if existing, _ := pm.GetProcess(name); existing != nil && existing.IsAlive() {
+		console.Fatal("Process '%s' is already running (%s). Use 'sbox stop %s' first or pick another --name.", name, existing.Ref(), name)
+	}
+
+	r.ServiceName = name
+	workdir := r.ResolveWorkdir()
+	var err error
+	pm.Wrap, err = r.IsolationPrefix(workdir)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	pm.EnvFiles = envFiles
+
+	info, err := pm.StartDaemon(name, runner.ShellJoin(args), r.BuildEnv(), workdir)
+	if err != nil {
+		console.Fatal("Failed to start job: %s", err)
+	}
+	if err := startMeter(pm, info); err != nil {
+		console.Warning("Failed to start usage meter: %s", err)
+	}
+
+	console.Emit(console.LevelSuccess, console.Fields{"name": name, "pid": info.PID, "log": info.LogFile},
+		"Started %s in the background (PID %d)", name, info.PID)
+	console.Print("  Command: %s", info.Command)
+	console.Print("  Log:     %s", info.LogFile)
+	fmt.Println()
+	console.Print("  Use 'sbox logs %s' to view output", name)
+	console.Print("  Use 'sbox stop %s' to stop it", name)
+}
+
+// statusUnknown is the exit code of 'sbox status --check' when the
+// project cannot be read
+const statusUnknown = 3
+
+func runHealthcheck(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		reportHealthcheck("", healthcheck.Result{State: healthcheck.Unknown, Message: "not in an sbox project"})
+	}
+	name := filepath.Base(projectRoot)
+	if len(args) > 0 {
+		name = args[0]
+	}
+	reportHealthcheck(name, probeDaemon(projectRoot, name))
+}
+
+// probeDaemon runs the healthcheck of a daemon, once it is known to run
+func probeDaemon(projectRoot, name string) healthcheck.Result {
+	unknown := func(format string, args ...interface{}) healthcheck.Result {
+		return healthcheck.Result{State: healthcheck.Unknown, Message: fmt.Sprintf(format, args...)}
+	}
+	r, err := runner.New(projectRoot)
+	if err != nil {
+		return unknown("config error: %s", err)
+	}
+	check, ok := r.Config.Healthchecks[name]
+	if !ok {
+		return unknown("no healthcheck for '%s' under healthchecks: in config.yaml", name)
+	}
+	if err := healthcheck.Check(check); err != nil {
+		return unknown("healthchecks.%s: %s", name, err)
+	}
+	timeout, slow, _ := healthcheck.Timeouts(check)
+
+	pm := process.NewProcessManager(projectRoot)
+	if _, err := pm.UpdateProcessStatus(); err != nil {
+		return unknown("failed to read the process list: %s", err)
+	}
+	info, err := pm.GetProcess(name)
+	switch {
+	case err != nil:
+		return healthcheck.Result{State: healthcheck.Critical, Message: fmt.Sprintf("%s is not running", name)}
+	case !info.IsAlive():
+		return healthcheck.Result{State: healthcheck.Critical, Message: fmt.Sprintf("%s is %s", name, info.Status)}
+	case info.Status == "paused" || info.Status == "restarting":
+		return healthcheck.Result{State: healthcheck.Warning, Message: fmt.Sprintf("%s is %s", name, info.Status)}
+	}
+
+	if check.HTTP != "" {
+		env := make(map[string]string)
+		for _, kv := range r.BuildEnv() {
+			if key, value, ok := strings.Cut(kv, "="); ok {
+				env[key] = value
+			}
+		}
+		url := config.Interpolate(check.HTTP, func(key string) (string, bool) {
+			value, ok := env[key]
+			return value, ok
+		})
+		return healthcheck.RunHTTP(url, timeout, slow)
+	}
+	probe, err := r.Command(sysproc.Shell(check.Command)...)
+	if err != nil {
+		return unknown("%s", err)
+	}
+	probe.Dir = r.ResolveWorkdir()
+	probe.Env = r.BuildEnv()
+	return healthcheck.RunCommand(probe, timeout, slow)
+}
+
+// reportHealthcheck prints a healthcheck result as a plugin line, or an
+// event with --output json, and exits with its code
+func reportHealthcheck(name string, result healthcheck.Result) {
+	if console.JSON() {
+		level := console.LevelSuccess
+		switch result.State {
+		case healthcheck.Warning:
+			level = console.LevelWarning
+		case healthcheck.Critical, healthcheck.Unknown:
+			level = console.LevelError
+		}
+		console.Emit(level, console.Fields{"name": name, "state": result.State, "elapsed_ms": result.Elapsed.Milliseconds()},
+			"%s", result.Message)
+	} else {
+		fmt.Println(result.String())
+	}
+	os.Exit(result.ExitCode())
+}
+
+func runStatus(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	check, _ := cmd.Flags().GetBool("check")
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		if asJSON {
+			fmt.Println(`{"error": "not in sbox project"}`)
+		} else {
+			console.Warning("Not in an sbox project")
+		}
+		if check {
+			os.Exit(statusUnknown)
+		}
+		return
 	}
 
 	projectName := filepath.Base(projectRoot)
@@ -701,13 +3199,31 @@ func runStatus(cmd *cobra.Command, args []string) {
 	cfg, err := config.Load(projectRoot)
 	if err != nil {
 		console.Error("Config error: %s", err)
+		if check {
+			os.Exit(statusUnknown)
+		}
 		return
 	}
 
 	pm := process.NewProcessManager(projectRoot)
-	runningProcesses, _ := pm.GetRunningProcesses()
-	allProcesses, _ := pm.LoadProcesses()
-	logs, _ := pm.ListLogs()
+	allProcesses, _ := inspect.Processes(pm, true)
+	var runningProcesses []inspect.Process
+	for _, p := range allProcesses {
+		if p.IsAlive() {
+			runningProcesses = append(runningProcesses, p)
+		}
+	}
+	logs, _ := inspect.Logs(pm)
+	logNames := []string{}
+	for _, log := range logs {
+		logNames = append(logNames, log.Name)
+	}
+	health := inspect.CheckHealth(projectRoot, cfg, allProcesses)
+
+	if check && !asJSON {
+		printHealth(projectName, health)
+		os.Exit(health.ExitCode())
+	}
 
 	// Build status info
 	statusInfo := map[string]interface{}{
@@ -716,6 +3232,7 @@ func runStatus(cmd *cobra.Command, args []string) {
 		"runtime":  cfg.Runtime,
 		"workdir":  cfg.Workdir,
 		"command":  cfg.Cmd,
+		"profile":  cfg.Profile(),
 		"built":    config.IsBuilt(projectRoot),
 		"upToDate": config.IsUpToDate(projectRoot, cfg),
 	}
@@ -725,6 +3242,7 @@ func runStatus(cmd *cobra.Command, args []string) {
 			"configHash": lock.ConfigHash,
 			"builtAt":    lock.BuiltAt,
 			"runtime":    lock.Runtime,
+			"profile":    lock.Profile,
 		}
 	}
 
@@ -732,11 +3250,15 @@ func runStatus(cmd *cobra.Command, args []string) {
 		"running": len(runningProcesses),
 		"total":   len(allProcesses),
 	}
-	statusInfo["logs"] = logs
+	statusInfo["logs"] = logNames
+	statusInfo["health"] = health
 
 	if asJSON {
 		data, _ := json.MarshalIndent(statusInfo, "", "  ")
 		fmt.Println(string(data))
+		if check {
+			os.Exit(health.ExitCode())
+		}
 		return
 	}
 
@@ -750,6 +3272,9 @@ func runStatus(cmd *cobra.Command, args []string) {
 	console.Print("  │  Runtime:  %s", cfg.Runtime)
 	console.Print("  │  Workdir:  %s", cfg.Workdir)
 	console.Print("  │  Command:  %s", cfg.Cmd)
+	if cfg.Profile() != "" {
+		console.Print("  │  Profile:  %s", cfg.Profile())
+	}
 	if len(cfg.Env) > 0 {
 		console.Print("  │  Env vars: %d defined", len(cfg.Env))
 	}
@@ -759,13 +3284,20 @@ func runStatus(cmd *cobra.Command, args []string) {
 	console.Print("  ┌─ Build Status")
 	if config.IsBuilt(projectRoot) {
 		console.Print("  │  Status:  ✓ Built")
-		if config.IsUpToDate(projectRoot, cfg) {
+		if err := config.CheckPlatform(projectRoot); err != nil {
+			console.Print("  │  State:   ⚠ Built for another platform, rebuild required")
+		} else if config.IsUpToDate(projectRoot, cfg) {
 			console.Print("  │  State:   Up to date")
+		} else if lock, err := config.LoadLock(projectRoot); err == nil && lock.Profile != cfg.Profile() {
+			console.Print("  │  State:   ⚠ Built with another profile, rebuild recommended")
 		} else {
 			console.Print("  │  State:   ⚠ Config changed, rebuild recommended")
 		}
 		if lock, err := config.LoadLock(projectRoot); err == nil {
 			console.Print("  │  Hash:    %s", lock.ConfigHash[:8])
+			if lock.Profile != "" {
+				console.Print("  │  Profile: %s", lock.Profile)
+			}
 			if t, err := time.Parse(time.RFC3339, lock.BuiltAt); err == nil {
 				console.Print("  │  Built:   %s (%s ago)", t.Format("2006-01-02 15:04:05"), formatDuration(time.Since(t)))
 			}
@@ -782,7 +3314,15 @@ func runStatus(cmd *cobra.Command, args []string) {
 		console.Print("  │  Running: %d", len(runningProcesses))
 		for _, p := range runningProcesses {
 			uptime := time.Since(p.StartTime)
-			console.Print("  │    • %s (PID %d) - up %s", p.Name, p.PID, formatDuration(uptime))
+			if p.Status == "paused" {
+				console.Print("  │    • %s (%s) - paused, up %s", p.Name, p.Ref(), formatDuration(uptime))
+				continue
+			}
+			if p.Status == "queued" {
+				console.Print("  │    • %s (%s) - queued", p.Name, p.Ref())
+				continue
+			}
+			console.Print("  │    • %s (%s) - up %s", p.Name, p.Ref(), formatDuration(uptime))
 		}
 	} else {
 		console.Print("  │  Running: 0")
@@ -798,14 +3338,28 @@ func runStatus(cmd *cobra.Command, args []string) {
 	if len(logs) > 0 {
 		console.Print("  │  Available: %d log file(s)", len(logs))
 		for _, log := range logs {
-			size, _ := pm.GetLogSize(log)
-			console.Print("  │    • %s (%s)", log, process.FormatBytes(size))
+			console.Print("  │    • %s (%s)", log.Name, process.FormatBytes(log.Size))
 		}
 	} else {
 		console.Print("  │  No logs available")
 	}
 	fmt.Println()
 
+	// Health section
+	console.Print("  ┌─ Health")
+	switch health.Status {
+	case inspect.Healthy:
+		console.Print("  │  Status:  ✓ Healthy")
+	case inspect.Degraded:
+		console.Print("  │  Status:  ⚠ Degraded")
+	default:
+		console.Print("  │  Status:  ✗ Unhealthy")
+	}
+	for _, problem := range health.Problems {
+		console.Print("  │    • %s", problem)
+	}
+	fmt.Println()
+
 	// Quick actions
 	console.Print("  ┌─ Quick Actions")
 	if !config.IsBuilt(projectRoot) {
@@ -820,9 +3374,29 @@ func runStatus(cmd *cobra.Command, args []string) {
 	fmt.Println()
 }
 
+// printHealth prints the health of a project for 'sbox status --check'
+func printHealth(projectName string, health inspect.Health) {
+	fields := console.Fields{"project": projectName, "health": health.Status, "problems": health.Problems}
+	switch health.Status {
+	case inspect.Healthy:
+		console.Emit(console.LevelSuccess, fields, "%s: healthy", projectName)
+	case inspect.Degraded:
+		console.Emit(console.LevelWarning, fields, "%s: degraded", projectName)
+	default:
+		console.Emit(console.LevelError, fields, "%s: unhealthy", projectName)
+	}
+	for _, problem := range health.Problems {
+		console.Print("  • %s", problem)
+	}
+}
+
 func runPs(cmd *cobra.Command, args []string) {
 	showAll, _ := cmd.Flags().GetBool("all")
 	quiet, _ := cmd.Flags().GetBool("quiet")
+	if global, _ := cmd.Flags().GetBool("global"); global {
+		runPsGlobal(showAll, quiet)
+		return
+	}
 
 	projectRoot, err := config.GetProjectRoot("")
 	if err != nil {
@@ -830,14 +3404,7 @@ func runPs(cmd *cobra.Command, args []string) {
 	}
 
 	pm := process.NewProcessManager(projectRoot)
-
-	var processes []process.ProcessInfo
-	if showAll {
-		processes, err = pm.UpdateProcessStatus()
-	} else {
-		processes, err = pm.GetRunningProcesses()
-	}
-
+	processes, err := inspect.Processes(pm, showAll)
 	if err != nil {
 		console.Fatal("Failed to get process list: %s", err)
 	}
@@ -856,31 +3423,26 @@ func runPs(cmd *cobra.Command, args []string) {
 
 	if quiet {
 		for _, p := range processes {
-			fmt.Println(p.PID)
+			// Slurm jobs have no local PID
+			if p.SlurmJob == "" {
+				fmt.Println(p.PID)
+			}
 		}
 		return
 	}
 
 	// Print table header
 	fmt.Println()
-	fmt.Printf("  %-8s %-15s %-10s %-12s %s\n", "PID", "NAME", "STATUS", "UPTIME", "COMMAND")
-	fmt.Printf("  %-8s %-15s %-10s %-12s %s\n", "---", "----", "------", "------", "-------")
+	fmt.Printf("  %-8s %-15s %-10s %-9s %-12s %-12s %s\n", "PID", "NAME", "STATUS", "RESTARTS", "UPTIME", "PORTS", "COMMAND")
+	fmt.Printf("  %-8s %-15s %-10s %-9s %-12s %-12s %s\n", "---", "----", "------", "--------", "------", "-----", "-------")
 
 	for _, p := range processes {
 		status := p.Status
-		statusColor := ""
-		switch status {
-		case "running":
-			statusColor = "\033[32m" // Green
-		case "stopped":
-			statusColor = "\033[33m" // Yellow
-		case "crashed":
-			statusColor = "\033[31m" // Red
-		}
+		color := statusColor(status)
 
 		uptime := "-"
-		if p.Status == "running" {
-			uptime = formatDuration(time.Since(p.StartTime))
+		if p.Uptime != "" {
+			uptime = p.Uptime
 		}
 
 		// Truncate command if too long
@@ -889,221 +3451,425 @@ func runPs(cmd *cobra.Command, args []string) {
 			command = command[:37] + "..."
 		}
 
-		fmt.Printf("  %-8d %-15s %s%-10s\033[0m %-12s %s\n",
-			p.PID, p.Name, statusColor, status, uptime, command)
+		// Only supervised daemons are restarted
+		restarts := "-"
+		if p.Restart != "" {
+			restarts = strconv.Itoa(p.Restarts)
+		}
+
+		// Slurm jobs show their job ID
+		pid := strconv.Itoa(p.PID)
+		if p.SlurmJob != "" {
+			pid = "job " + p.SlurmJob
+		}
+
+		fmt.Printf("  %-8s %-15s %s%-10s\033[0m %-9s %-12s %-12s %s\n",
+			pid, p.Name, color, status, restarts, uptime, formatPorts(p.Ports), command)
 	}
 	fmt.Println()
+
+	for _, p := range processes {
+		if p.Status == "oom-killed" {
+			console.Warning("'%s' was killed for running out of memory (see 'sbox events %s')", p.Name, p.Name)
+			console.Print("    → %s", pm.OOMHint())
+		}
+	}
 }
 
-func runLogs(cmd *cobra.Command, args []string) {
-	follow, _ := cmd.Flags().GetBool("follow")
-	lines, _ := cmd.Flags().GetInt("lines")
-	listLogs, _ := cmd.Flags().GetBool("list")
+// statusColor returns the color of a process status in tables
+func statusColor(status string) string {
+	switch status {
+	case "running":
+		return "\033[32m" // Green
+	case "queued", "paused", "restarting":
+		return "\033[36m" // Cyan
+	case "stopped":
+		return "\033[33m" // Yellow
+	case "crashed", "oom-killed":
+		return "\033[31m" // Red
+	case process.Orphaned:
+		return "\033[35m" // Magenta
+	}
+	return ""
+}
 
-	projectRoot, err := config.GetProjectRoot("")
+// runPsGlobal lists the daemons of every project, from the registry in
+// ~/.sbox/state
+func runPsGlobal(showAll, quiet bool) {
+	all, err := process.ListGlobal()
 	if err != nil {
-		console.Fatal("Not in an sbox project.")
+		console.Fatal("Failed to read the daemon registry: %s", err)
 	}
-
-	pm := process.NewProcessManager(projectRoot)
-
-	if listLogs {
-		logs, err := pm.ListLogs()
-		if err != nil {
-			console.Fatal("Failed to list logs: %s", err)
-		}
-
-		if len(logs) == 0 {
-			console.Info("No log files found")
-			return
+	var processes []process.GlobalProcess
+	for _, p := range all {
+		if showAll || p.Orphan() || p.IsAlive() {
+			processes = append(processes, p)
 		}
+	}
 
-		console.Step("Available logs:")
-		for _, log := range logs {
-			size, _ := pm.GetLogSize(log)
-			console.Print("  • %s (%s)", log, process.FormatBytes(size))
+	if len(processes) == 0 {
+		if !quiet {
+			if showAll {
+				console.Info("No daemons on this machine")
+			} else {
+				console.Info("No running daemons on this machine")
+			}
 		}
 		return
 	}
-
-	// Determine which log to show
-	name := ""
-	if len(args) > 0 {
-		name = args[0]
-	} else {
-		// Default to project name
-		name = filepath.Base(projectRoot)
+	if quiet {
+		for _, p := range processes {
+			fmt.Println(p.PID)
+		}
+		return
 	}
 
-	if follow {
-		console.Info("Following logs for '%s' (Ctrl+C to exit)...", name)
-		fmt.Println()
+	fmt.Println()
+	fmt.Printf("  %-8s %-15s %-15s %-10s %-12s %s\n", "PID", "PROJECT", "NAME", "STATUS", "UPTIME", "COMMAND")
+	fmt.Printf("  %-8s %-15s %-15s %-10s %-12s %s\n", "---", "-------", "----", "------", "------", "-------")
+	orphans := 0
+	for _, p := range processes {
+		uptime := "-"
+		if p.Orphan() || p.Status == "running" || p.Status == "paused" {
+			uptime = process.FormatDuration(time.Since(p.StartTime))
+		}
+		command := p.Command
+		if len(command) > 40 {
+			command = command[:37] + "..."
+		}
+		if p.Orphan() {
+			orphans++
+		}
+		fmt.Printf("  %-8d %-15s %-15s %s%-10s\033[0m %-12s %s\n",
+			p.PID, filepath.Base(p.Root), p.Name, statusColor(p.Status), p.Status, uptime, command)
 	}
+	fmt.Println()
 
-	if err := pm.ReadLogs(name, lines, follow); err != nil {
-		console.Fatal("%s", err)
+	if orphans > 0 {
+		console.Warning("%d daemon(s) outlived their project", orphans)
+		console.Print("    → Stop them with 'sbox stop -g <project>/<name>'")
 	}
 }
 
-func runStop(cmd *cobra.Command, args []string) {
-	stopAll, _ := cmd.Flags().GetBool("all")
+func runInspect(cmd *cobra.Command, args []string) {
+	showSecrets, _ := cmd.Flags().GetBool("show-secrets")
+	opts := inspect.Options{ShowSecrets: showSecrets}
 
 	projectRoot, err := config.GetProjectRoot("")
 	if err != nil {
 		console.Fatal("Not in an sbox project.")
 	}
 
-	pm := process.NewProcessManager(projectRoot)
-
-	if stopAll {
+	var doc interface{}
+	if len(args) == 1 {
+		doc, err = inspect.InspectProcess(projectRoot, args[0], opts)
+	} else {
+		doc, err = inspect.InspectProject(projectRoot, opts)
+	}
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		console.Fatal("Failed to encode: %s", err)
+	}
+	fmt.Println(string(data))
+}
+
+// formatPorts lists ports for tables, or "-" when there are none
+func formatPorts(ports []int) string {
+	if len(ports) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(ports))
+	for i, port := range ports {
+		parts[i] = strconv.Itoa(port)
+	}
+	return strings.Join(parts, ",")
+}
+
+// topEntry is one process in 'sbox top --json'
+type topEntry struct {
+	Name   string         `json:"name"`
+	PID    int            `json:"pid"`
+	Status string         `json:"status"`
+	Usage  *process.Usage `json:"usage,omitempty"`
+}
+
+func runTop(cmd *cobra.Command, args []string) {
+	interval, _ := cmd.Flags().GetDuration("interval")
+	once, _ := cmd.Flags().GetBool("once")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	if interval <= 0 {
+		console.Fatal("--interval must be positive")
+	}
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		console.Fatal("sbox top reads /proc, which this system does not have")
+	}
+	pm := process.NewProcessManager(projectRoot)
+
+	// Rates need a previous sample, so the first frame waits an interval
+	previous := make(map[int]*process.Usage)
+	sample := func() []topEntry {
 		processes, err := pm.GetRunningProcesses()
 		if err != nil {
 			console.Fatal("Failed to get process list: %s", err)
 		}
-
-		if len(processes) == 0 {
-			console.Info("No running processes to stop")
-			return
+		var entries []topEntry
+		current := make(map[int]*process.Usage)
+		for _, p := range processes {
+			// Slurm jobs have no local PID
+			if p.SlurmJob != "" {
+				continue
+			}
+			entry := topEntry{Name: p.Name, PID: p.PID, Status: p.Status}
+			if usage, err := p.Usage(); err == nil {
+				usage.Since(previous[p.PID])
+				current[p.PID] = usage
+				entry.Usage = usage
+			}
+			entries = append(entries, entry)
 		}
+		previous = current
+		return entries
+	}
 
-		console.Step("Stopping all processes...")
-		for _, p := range processes {
-			if err := pm.StopProcess(p.Name); err != nil {
-				console.Error("Failed to stop %s: %s", p.Name, err)
-			} else {
-				console.Success("Stopped %s (PID %d)", p.Name, p.PID)
+	sample()
+	for {
+		time.Sleep(interval)
+		entries := sample()
+
+		if asJSON {
+			data, _ := json.Marshal(entries)
+			if once {
+				data, _ = json.MarshalIndent(entries, "", "  ")
 			}
+			fmt.Println(string(data))
+		} else {
+			if !once {
+				// Clear the screen and move to the top left
+				fmt.Print("\033[H\033[2J")
+				console.Print("sbox top - %s - every %s (Ctrl-C to quit)", filepath.Base(projectRoot), interval)
+			}
+			printTop(entries)
+		}
+		if once {
+			return
 		}
+	}
+}
+
+func printTop(entries []topEntry) {
+	if len(entries) == 0 {
+		console.Info("No running processes")
 		return
 	}
 
-	// Stop specific process
-	name := ""
-	if len(args) > 0 {
-		name = args[0]
-	} else {
-		name = filepath.Base(projectRoot)
+	fmt.Println()
+	fmt.Printf("  %-8s %-15s %-10s %5s %7s %10s %6s %10s %10s\n", "PID", "NAME", "STATUS", "PROCS", "CPU%", "RSS", "FDS", "READ/s", "WRITE/s")
+	fmt.Printf("  %-8s %-15s %-10s %5s %7s %10s %6s %10s %10s\n", "---", "----", "------", "-----", "----", "---", "---", "------", "-------")
+	for _, e := range entries {
+		u := e.Usage
+		if u == nil {
+			fmt.Printf("  %-8d %-15s %-10s %5s %7s %10s %6s %10s %10s\n", e.PID, e.Name, e.Status, "-", "-", "-", "-", "-", "-")
+			continue
+		}
+		fmt.Printf("  %-8d %-15s %-10s %5d %7.1f %10s %6d %10s %10s\n", e.PID, e.Name, e.Status,
+			u.Processes, u.CPUPercent, process.FormatBytes(u.RSS), u.FDs,
+			process.FormatBytes(int64(u.ReadRate)), process.FormatBytes(int64(u.WriteRate)))
 	}
+	fmt.Println()
+}
 
-	console.Step("Stopping process: %s", name)
+func runStats(cmd *cobra.Command, args []string) {
+	historical, _ := cmd.Flags().GetBool("historical")
+	sinceFlag, _ := cmd.Flags().GetString("since")
+	allProjects, _ := cmd.Flags().GetBool("all-projects")
+	asJSON, _ := cmd.Flags().GetBool("json")
 
-	if err := pm.StopProcess(name); err != nil {
-		console.Fatal("%s", err)
+	if !historical {
+		if allProjects || cmd.Flags().Changed("since") {
+			console.Fatal("--since and --all-projects need --historical")
+		}
+		runCurrentStats(asJSON)
+		return
 	}
 
-	console.Success("Process stopped")
-}
-
-func runRestart(cmd *cobra.Command, args []string) {
-	projectRoot, err := config.GetProjectRoot("")
+	since, err := parseLogTime(sinceFlag)
 	if err != nil {
-		console.Fatal("Not in an sbox project.")
+		console.Fatal("--since: %s", err)
 	}
 
-	pm := process.NewProcessManager(projectRoot)
-
-	name := ""
-	if len(args) > 0 {
-		name = args[0]
+	var records []process.UsageRecord
+	var key func(process.UsageRecord) string
+	scope := ""
+	if allProjects {
+		if records, err = process.LoadGlobalUsage(since); err != nil {
+			console.Fatal("Failed to read usage: %s", err)
+		}
+		home, _ := os.UserHomeDir()
+		key = func(r process.UsageRecord) string {
+			if home != "" && strings.HasPrefix(r.Project, home+"/") {
+				return "~" + strings.TrimPrefix(r.Project, home)
+			}
+			return r.Project
+		}
+		scope = "all projects"
 	} else {
-		name = filepath.Base(projectRoot)
+		projectRoot, err := config.GetProjectRoot("")
+		if err != nil {
+			console.Fatal("Not in an sbox project. Use --all-projects to see every project.")
+		}
+		if records, err = process.NewProcessManager(projectRoot).LoadUsage(since); err != nil {
+			console.Fatal("Failed to read usage: %s", err)
+		}
+		key = func(r process.UsageRecord) string { return r.Process }
+		scope = filepath.Base(projectRoot)
 	}
 
-	// Get existing process info
-	existing, err := pm.GetProcess(name)
-	if err != nil {
-		console.Fatal("Process '%s' not found", name)
+	totals := process.SumUsage(records, key)
+	if asJSON {
+		data, _ := json.MarshalIndent(totals, "", "  ")
+		fmt.Println(string(data))
+		return
 	}
 
-	command := existing.Command
+	console.Print("Usage of %s since %s", scope, since.Format("2006-01-02 15:04"))
+	if len(totals) == 0 {
+		console.Info("No usage recorded")
+		console.Print("    → Daemons started with 'sbox run -d' and foreground commands are metered from now on")
+		return
+	}
 
-	// Stop if running
-	if existing.Status == "running" && process.IsProcessRunning(existing.PID) {
-		console.Step("Stopping process: %s", name)
-		if err := pm.StopProcess(name); err != nil {
-			console.Warning("Failed to stop gracefully: %s", err)
+	name := "NAME"
+	if allProjects {
+		name = "PROJECT"
+	}
+	fmt.Println()
+	fmt.Printf("  %-30s %-7s %9s %10s %6s %10s %10s %10s  %s\n", name, "KIND", "TIME", "CPU TIME", "CPU%", "READ", "WRITE", "PEAK RSS", "LAST SEEN")
+	fmt.Printf("  %-30s %-7s %9s %10s %6s %10s %10s %10s  %s\n", strings.Repeat("-", len(name)), "----", "----", "--------", "----", "----", "-----", "--------", "---------")
+	var sum process.UsageTotal
+	for _, t := range totals {
+		kind := t.Kind
+		if allProjects || kind == "" {
+			kind = "-"
+		}
+		printUsageTotal(t.Key, kind, t)
+		sum.Seconds += t.Seconds
+		sum.CPUSeconds += t.CPUSeconds
+		sum.ReadBytes += t.ReadBytes
+		sum.WriteBytes += t.WriteBytes
+		sum.MaxRSS = max(sum.MaxRSS, t.MaxRSS)
+		if t.LastSeen.After(sum.LastSeen) {
+			sum.LastSeen = t.LastSeen
 		}
-		// Wait a bit for process to fully stop
-		time.Sleep(500 * time.Millisecond)
 	}
-
-	// Start again
-	console.Step("Starting process: %s", name)
-
-	r, err := runner.New(projectRoot)
-	if err != nil {
-		console.Fatal("Failed to load config: %s", err)
+	if len(totals) > 1 {
+		printUsageTotal("total", "", sum)
 	}
+	fmt.Println()
+}
 
-	env := r.BuildEnv()
-	workdir := r.ResolveWorkdir()
+// printUsageTotal prints a row of 'sbox stats --historical'. CPU% is the
+// average over the time the process ran.
+func printUsageTotal(name, kind string, t process.UsageTotal) {
+	cpuPercent := 0.0
+	if t.Seconds > 0 {
+		cpuPercent = t.CPUSeconds / t.Seconds * 100
+	}
+	fmt.Printf("  %-30s %-7s %9s %10s %6.1f %10s %10s %10s  %s\n", name, kind,
+		formatDuration(time.Duration(t.Seconds*float64(time.Second))), formatCPUSeconds(t.CPUSeconds), cpuPercent,
+		formatBytes(t.ReadBytes), formatBytes(t.WriteBytes), formatBytes(t.MaxRSS), t.LastSeen.Local().Format("01-02 15:04"))
+}
 
-	info, err := pm.StartDaemon(name, command, env, workdir)
-	if err != nil {
-		console.Fatal("Failed to start: %s", err)
+// formatCPUSeconds formats CPU time, with tenths of a second below a minute
+func formatCPUSeconds(seconds float64) string {
+	if seconds < 60 {
+		return fmt.Sprintf("%.1fs", seconds)
 	}
+	return formatDuration(time.Duration(seconds * float64(time.Second)))
+}
 
-	console.Success("Process restarted (PID %d)", info.PID)
+// statsEntry is a running daemon in 'sbox stats'
+type statsEntry struct {
+	Name       string    `json:"name"`
+	PID        int       `json:"pid"`
+	StartTime  time.Time `json:"start_time"`
+	CPUSeconds float64   `json:"cpu_seconds"`
+	RSS        int64     `json:"rss_bytes"`
+	ReadBytes  int64     `json:"read_bytes"`
+	WriteBytes int64     `json:"write_bytes"`
 }
 
-func runClean(cmd *cobra.Command, args []string) {
+// runCurrentStats lists the running daemons with their usage since they
+// started
+func runCurrentStats(asJSON bool) {
 	projectRoot, err := config.GetProjectRoot("")
 	if err != nil {
 		console.Fatal("Not in an sbox project.")
 	}
-
-	cleanAll, _ := cmd.Flags().GetBool("all")
-	cleanLogs, _ := cmd.Flags().GetBool("logs")
-	logsAge, _ := cmd.Flags().GetDuration("logs-older-than")
-
-	sboxDir := config.GetSboxDir(projectRoot)
-	pm := process.NewProcessManager(projectRoot)
-
-	// Stop running processes first
-	runningProcesses, _ := pm.GetRunningProcesses()
-	if len(runningProcesses) > 0 {
-		console.Step("Stopping %d running process(es)...", len(runningProcesses))
-		for _, p := range runningProcesses {
-			pm.StopProcess(p.Name)
-			console.Print("  Stopped: %s", p.Name)
-		}
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		console.Fatal("sbox stats reads /proc, which this system does not have")
 	}
 
-	if cleanLogs {
-		console.Step("Cleaning logs older than %s...", logsAge)
-		removed, err := pm.CleanOldLogs(logsAge)
+	processes, err := process.NewProcessManager(projectRoot).GetRunningProcesses()
+	if err != nil {
+		console.Fatal("Failed to get process list: %s", err)
+	}
+	entries := []statsEntry{}
+	for _, p := range processes {
+		// Slurm jobs have no local PID
+		if p.SlurmJob != "" {
+			continue
+		}
+		usage, err := p.Usage()
 		if err != nil {
-			console.Error("Failed to clean logs: %s", err)
-		} else {
-			console.Success("Removed %d log file(s)", removed)
+			continue
 		}
+		entries = append(entries, statsEntry{
+			Name:       p.Name,
+			PID:        p.PID,
+			StartTime:  p.StartTime,
+			CPUSeconds: usage.CPUSeconds + usage.ChildCPUSeconds,
+			RSS:        usage.RSS,
+			ReadBytes:  usage.ReadBytes,
+			WriteBytes: usage.WriteBytes,
+		})
+	}
+
+	if asJSON {
+		data, _ := json.MarshalIndent(entries, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if len(entries) == 0 {
+		console.Info("No running processes")
+		console.Print("    → Use 'sbox stats --historical' for the usage recorded over time")
 		return
 	}
 
-	if cleanAll {
-		console.Step("Removing all sbox files...")
-		os.RemoveAll(sboxDir)
-		os.Remove(config.GetLockPath(projectRoot))
-		console.Success("Cleaned all sbox files")
-		console.Info("Run 'sbox init' to reinitialize the project")
-	} else {
-		console.Step("Cleaning build artifacts...")
-		dirsToClean := []string{"env", "rootfs", "mamba", "bin"}
-		for _, d := range dirsToClean {
-			path := filepath.Join(sboxDir, d)
-			if _, err := os.Stat(path); err == nil {
-				os.RemoveAll(path)
-				console.Print("  Removed: %s/", d)
-			}
+	fmt.Println()
+	fmt.Printf("  %-8s %-15s %9s %10s %6s %10s %10s %10s\n", "PID", "NAME", "UPTIME", "CPU TIME", "CPU%", "RSS", "READ", "WRITE")
+	fmt.Printf("  %-8s %-15s %9s %10s %6s %10s %10s %10s\n", "---", "----", "------", "--------", "----", "---", "----", "-----")
+	for _, e := range entries {
+		uptime := time.Since(e.StartTime)
+		cpuPercent := 0.0
+		if uptime > 0 {
+			cpuPercent = e.CPUSeconds / uptime.Seconds() * 100
 		}
-		os.Remove(config.GetLockPath(projectRoot))
-		os.Remove(filepath.Join(sboxDir, config.EnvScript))
-		console.Success("Cleaned build artifacts")
-		console.Info("Run 'sbox build' to rebuild")
+		fmt.Printf("  %-8d %-15s %9s %10s %6.1f %10s %10s %10s\n", e.PID, e.Name, formatDuration(uptime),
+			formatCPUSeconds(e.CPUSeconds), cpuPercent, formatBytes(e.RSS), formatBytes(e.ReadBytes), formatBytes(e.WriteBytes))
 	}
+	fmt.Println()
 }
 
-func runInfo(cmd *cobra.Command, args []string) {
+func runPort(cmd *cobra.Command, args []string) {
 	projectRoot, err := config.GetProjectRoot("")
 	if err != nil {
 		console.Fatal("Not in an sbox project.")
@@ -1114,665 +3880,5214 @@ func runInfo(cmd *cobra.Command, args []string) {
 		console.Fatal("Failed to load config: %s", err)
 	}
 
-	sboxDir := config.GetSboxDir(projectRoot)
-	envDir := config.GetEnvDir(projectRoot)
-	rootfsDir := config.GetRootfsDir(projectRoot)
-
-	fmt.Println()
-	console.Step("Environment Information")
-	fmt.Println()
-
-	console.Print("  ┌─ Paths")
-	console.Print("  │  Project root:  %s", projectRoot)
-	console.Print("  │  Sbox dir:      %s", sboxDir)
-	console.Print("  │  Environment:   %s", envDir)
-	console.Print("  │  Rootfs:        %s", rootfsDir)
-	fmt.Println()
-
-	console.Print("  ┌─ Runtime")
-	runtimeInfo := cfg.ParseRuntime()
-	console.Print("  │  Language:  %s", runtimeInfo.Language)
-	console.Print("  │  Version:   %s", runtimeInfo.Version)
-
-	// Check for runtime binary
-	var binaryPath string
-	if runtimeInfo.Language == "python" {
-		binaryPath = filepath.Join(envDir, "bin", "python")
-	} else if runtimeInfo.Language == "node" {
-		binaryPath = filepath.Join(envDir, "bin", "node")
+	pm := process.NewProcessManager(projectRoot)
+	processes, err := pm.GetRunningProcesses()
+	if err != nil {
+		console.Fatal("Failed to get process list: %s", err)
 	}
-
-	if binaryPath != "" {
-		if info, err := os.Stat(binaryPath); err == nil {
-			console.Print("  │  Binary:    %s (%s)", binaryPath, process.FormatBytes(info.Size()))
-		} else {
-			console.Print("  │  Binary:    Not installed")
+	if len(args) > 0 {
+		var selected []process.ProcessInfo
+		for _, p := range processes {
+			if p.Name == args[0] {
+				selected = append(selected, p)
+			}
 		}
+		if len(selected) == 0 {
+			console.Fatal("Process '%s' is not running", args[0])
+		}
+		processes = selected
 	}
-	fmt.Println()
 
-	// Directory sizes
-	console.Print("  ┌─ Disk Usage")
-	dirs := map[string]string{
-		"Environment": envDir,
-		"Rootfs":      rootfsDir,
-		"Logs":        filepath.Join(sboxDir, "logs"),
-	}
-	for name, path := range dirs {
-		size := getDirSize(path)
-		console.Print("  │  %-12s %s", name+":", process.FormatBytes(size))
+	// Declared names by port number
+	names := make(map[int]string, len(cfg.Ports))
+	var declared []int
+	for name, port := range cfg.Ports {
+		names[port] = name
+		declared = append(declared, port)
 	}
-	fmt.Println()
+	sort.Ints(declared)
 
-	// Environment variables
-	if len(cfg.Env) > 0 {
-		console.Print("  ┌─ Environment Variables")
-		for key, value := range cfg.Env {
-			// Mask sensitive values
-			displayValue := value
-			if strings.Contains(strings.ToLower(key), "secret") ||
-				strings.Contains(strings.ToLower(key), "password") ||
-				strings.Contains(strings.ToLower(key), "key") {
-				displayValue = "********"
-			}
-			console.Print("  │  %s=%s", key, displayValue)
+	fmt.Println()
+	if len(processes) == 0 {
+		if len(declared) == 0 {
+			console.Info("No ports declared and no running processes")
+			return
+		}
+		console.Print("  ┌─ Declared ports (nothing running)")
+		for _, port := range declared {
+			console.Print("  │  %-12s %-6d %s", names[port], port, config.PortEnvName(names[port]))
 		}
 		fmt.Println()
+		return
 	}
 
-	// Copy specs
-	if len(cfg.Copy) > 0 {
-		console.Print("  ┌─ File Mappings (copy)")
-		for _, spec := range cfg.ParseCopy() {
-			console.Print("  │  %s → %s", spec.Src, spec.Dst)
+	for _, p := range processes {
+		console.Print("  ┌─ %s (%s)", p.Name, p.Ref())
+
+		listening := make(map[int]bool, len(p.Ports))
+		for _, port := range p.Ports {
+			listening[port] = true
+		}
+		// Declared ports first, then undeclared ones the process opened
+		for _, port := range declared {
+			if listening[port] {
+				console.Print("  │  %-12s %-6d listening  http://localhost:%d", names[port], port, port)
+			} else {
+				console.Print("  │  %-12s %-6d not listening", names[port], port)
+			}
+		}
+		for _, port := range p.Ports {
+			if _, ok := names[port]; !ok {
+				console.Print("  │  %-12s %-6d listening  http://localhost:%d", "-", port, port)
+			}
+		}
+		if len(declared) == 0 && len(p.Ports) == 0 {
+			console.Print("  │  No listening ports")
 		}
 		fmt.Println()
 	}
+}
 
-	// Mount specs
-	if len(cfg.Mount) > 0 {
-		console.Print("  ┌─ Directory Mounts (symlink)")
-		for _, spec := range cfg.ParseMount() {
-			mode := "rw"
+func runLogs(cmd *cobra.Command, args []string) {
+	follow, _ := cmd.Flags().GetBool("follow")
+	lines, _ := cmd.Flags().GetInt("lines")
+	listLogs, _ := cmd.Flags().GetBool("list")
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	pm := process.NewProcessManager(projectRoot)
+
+	if listLogs {
+		logs, err := pm.ListLogs()
+		if err != nil {
+			console.Fatal("Failed to list logs: %s", err)
+		}
+
+		if len(logs) == 0 {
+			console.Info("No log files found")
+			return
+		}
+
+		console.Step("Available logs:")
+		for _, log := range logs {
+			size, _ := pm.GetLogSize(log)
+			console.Print("  • %s (%s)", log, process.FormatBytes(size))
+		}
+		return
+	}
+
+	all, _ := cmd.Flags().GetBool("all")
+	timestamps, _ := cmd.Flags().GetBool("timestamps")
+	stream := ""
+	if stderrOnly, _ := cmd.Flags().GetBool("stderr-only"); stderrOnly {
+		stream = process.StreamStderr
+	}
+	if stdoutOnly, _ := cmd.Flags().GetBool("stdout-only"); stdoutOnly {
+		if stream != "" {
+			console.Fatal("--stderr-only and --stdout-only cannot be combined")
+		}
+		stream = process.StreamStdout
+	}
+
+	// Determine which log to show
+	name := ""
+	if all {
+		if len(args) > 0 {
+			console.Fatal("--all cannot be combined with a process name")
+		}
+	} else if len(args) > 0 {
+		name = args[0]
+	} else {
+		// Default to project name
+		name = filepath.Base(projectRoot)
+	}
+
+	var since, until time.Time
+	sinceFlag, _ := cmd.Flags().GetString("since")
+	untilFlag, _ := cmd.Flags().GetString("until")
+	if sinceFlag != "" {
+		if since, err = parseLogTime(sinceFlag); err != nil {
+			console.Fatal("--since: %s", err)
+		}
+	}
+	if untilFlag != "" {
+		if follow {
+			console.Fatal("--until cannot be used with --follow")
+		}
+		if until, err = parseLogTime(untilFlag); err != nil {
+			console.Fatal("--until: %s", err)
+		}
+	}
+	ranged := sinceFlag != "" || untilFlag != ""
+
+	if all || timestamps || stream != "" {
+		names := []string{name}
+		if all {
+			running, err := pm.GetRunningProcesses()
+			if err != nil {
+				console.Fatal("Failed to get process list: %s", err)
+			}
+			if len(running) == 0 {
+				console.Info("No running processes")
+				return
+			}
+			names = names[:0]
+			for _, p := range running {
+				names = append(names, p.Name)
+			}
+		}
+		for _, name := range names {
+			if (stream != "" || (timestamps && !follow)) && !pm.StructuredLog(name) {
+				console.Warning("%s: the log was captured without logging.structured, so its lines have no streams or times", name)
+			}
+		}
+		backlog := func(name string) ([]process.LogLine, error) {
+			var selected []process.LogLine
+			var err error
+			if ranged {
+				selected, err = pm.LogEntriesBetween(name, since, until)
+			} else if stream != "" {
+				// Read back further so -n counts lines of the stream
+				selected, err = pm.LastLogEntries(name, lines*10)
+			} else {
+				selected, err = pm.LastLogEntries(name, lines)
+			}
+			selected = filterStream(selected, stream)
+			// -n only limits a time range when given explicitly
+			if (!ranged || cmd.Flags().Changed("lines")) && len(selected) > lines {
+				selected = selected[len(selected)-lines:]
+			}
+			return selected, err
+		}
+		if follow {
+			console.Info("Following logs for %s (Ctrl+C to exit)...", strings.Join(names, ", "))
+			fmt.Println()
+		}
+		multiplexLogs(pm, names, backlog, stream, all, follow, timestamps)
+		return
+	}
+
+	if ranged {
+		selected, err := pm.LogLinesBetween(name, since, until)
+		if err != nil {
+			console.Fatal("%s", err)
+		}
+		// -n only limits a time range when given explicitly
+		if cmd.Flags().Changed("lines") && len(selected) > lines {
+			selected = selected[len(selected)-lines:]
+		}
+		for _, line := range selected {
+			fmt.Println(line)
+		}
+		if !follow {
+			return
+		}
+		lines = 0
+	}
+
+	if follow {
+		console.Info("Following logs for '%s' (Ctrl+C to exit)...", name)
+		fmt.Println()
+	}
+
+	if err := pm.ReadLogs(name, lines, follow); err != nil {
+		console.Fatal("%s", err)
+	}
+}
+
+// logColors are the name colors of 'sbox logs --all', in the order
+// processes are listed
+var logColors = []string{"\033[36m", "\033[33m", "\033[32m", "\033[35m", "\033[34m", "\033[91m"}
+
+// multiplexLogs prints the backlog of each process log and, with follow,
+// the lines of stream (all when empty) appended to all of them as they
+// are written, until interrupted. With prefix each line starts with the
+// colored process name; with timestamps with its capture time, or for
+// logs without one the time a followed line was read.
+func multiplexLogs(pm *process.ProcessManager, names []string, backlog func(name string) ([]process.LogLine, error), stream string, prefix, follow, timestamps bool) {
+	width := 0
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+
+	var mu sync.Mutex
+	printLine := func(i int, line process.LogLine) {
+		mu.Lock()
+		defer mu.Unlock()
+		if prefix {
+			fmt.Printf("%s%-*s |\033[0m ", logColors[i%len(logColors)], width, names[i])
+		}
+		if timestamps && !line.Time.IsZero() {
+			fmt.Print(line.Time.Format("2006-01-02 15:04:05.000"), " ")
+		}
+		fmt.Println(line.Text)
+	}
+
+	for i, name := range names {
+		lines, err := backlog(name)
+		if err != nil {
+			console.Warning("%s: %s", name, err)
+			continue
+		}
+		for _, line := range lines {
+			printLine(i, line)
+		}
+	}
+
+	if !follow {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			err := pm.FollowLogEntries(name, nil, func(line process.LogLine) {
+				if stream != "" && line.Stream != stream {
+					return
+				}
+				if line.Time.IsZero() {
+					line.Time = time.Now()
+				}
+				printLine(i, line)
+			})
+			if err != nil {
+				console.Warning("%s: %s", name, err)
+			}
+		}(i, name)
+	}
+	wg.Wait()
+}
+
+// filterStream returns the lines of stream, or all lines when it is empty
+func filterStream(lines []process.LogLine, stream string) []process.LogLine {
+	if stream == "" {
+		return lines
+	}
+	var kept []process.LogLine
+	for _, line := range lines {
+		if line.Stream == stream {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// parseLogTime parses the value of --since or --until: a duration before
+// now, or a local time
+func parseLogTime(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s' (use a duration such as 30m or 7d, or 2006-01-02 15:04)", value)
+}
+
+func runStop(cmd *cobra.Command, args []string) {
+	stopAll, _ := cmd.Flags().GetBool("all")
+	if global, _ := cmd.Flags().GetBool("global"); global {
+		runStopGlobal(stopAll, args)
+		return
+	}
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	pm := process.NewProcessManager(projectRoot)
+	var running []process.ProcessInfo
+	if stopAll {
+		if running, err = pm.GetRunningProcesses(); err != nil {
+			console.Fatal("Failed to get process list: %s", err)
+		}
+		if len(running) == 0 {
+			console.Info("No running processes to stop")
+			return
+		}
+		confirm(cmd, "stop --all stops these processes:", processItems(running), "Stop them?")
+	}
+
+	if client := daemonClient(cmd); client != nil {
+		req := api.StopRequest{Options: daemonOptions(), All: stopAll, Name: filepath.Base(projectRoot)}
+		if len(args) > 0 {
+			req.Name = args[0]
+		}
+		forwardToDaemon(client, projectRoot, api.OpStop, req)
+	}
+	auditCommand(projectRoot, cmd)
+
+	if stopAll {
+		console.Step("Stopping all processes...")
+		for _, p := range running {
+			if err := pm.StopProcess(p.Name); err != nil {
+				console.Error("Failed to stop %s: %s", p.Name, err)
+			} else {
+				console.Success("Stopped %s (%s)", p.Name, p.Ref())
+			}
+		}
+		return
+	}
+
+	// Stop specific process
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	} else {
+		name = filepath.Base(projectRoot)
+	}
+
+	console.Step("Stopping process: %s", name)
+
+	if err := pm.StopProcess(name); err != nil {
+		console.Fatal("%s", err)
+	}
+
+	console.Success("Process stopped")
+}
+
+// runStopGlobal stops a daemon of any project, named as in 'sbox ps -g'
+func runStopGlobal(stopAll bool, args []string) {
+	if stopAll || len(args) != 1 {
+		console.Fatal("stop --global takes one daemon, as <name> or <project>/<name>")
+	}
+	p, err := process.FindGlobal(args[0])
+	if err != nil {
+		console.Fatal("%s\n    → List them with 'sbox ps -g'", err)
+	}
+
+	console.Step("Stopping %s in %s", p.Name, p.Root)
+	if err := process.StopGlobal(*p); err != nil {
+		console.Fatal("%s", err)
+	}
+	if p.Orphan() {
+		console.Success("Stopped orphaned daemon %s (%s)", p.Name, p.Ref())
+		return
+	}
+	console.Success("Process stopped")
+}
+
+func runRestart(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	pm := process.NewProcessManager(projectRoot)
+
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	} else {
+		name = filepath.Base(projectRoot)
+	}
+
+	// Get existing process info
+	existing, err := pm.GetProcess(name)
+	if err != nil {
+		console.Fatal("Process '%s' not found", name)
+	}
+
+	command := existing.Command
+
+	if existing.SlurmJob != "" {
+		console.Error("'%s' is Slurm job %s and cannot be restarted locally", name, existing.SlurmJob)
+		console.Print("    → Resubmit it with 'sbox slurm --submit --name %s'", name)
+		os.Exit(1)
+	}
+
+	// Stop if running
+	if existing.IsAlive() {
+		console.Step("Stopping process: %s", name)
+		if err := pm.StopProcess(name); err != nil {
+			console.Warning("Failed to stop gracefully: %s", err)
+		}
+		// Wait a bit for process to fully stop
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// Start again
+	console.Step("Starting process: %s", name)
+
+	r, err := runner.New(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+
+	if err := r.CheckBuilt(); err != nil {
+		console.Fatal("%s", err)
+	}
+
+	// Load the env files it was started with again
+	for _, path := range existing.EnvFiles {
+		if err := r.LoadEnvFile(path); err != nil {
+			console.Fatal("%s", err)
+		}
+	}
+	pm.EnvFiles = existing.EnvFiles
+
+	r.ServiceName = name
+	workdir := r.ResolveWorkdir()
+
+	pm.Wrap, err = r.IsolationPrefix(workdir)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	// Keep the restart policy too; the restart count starts over
+	policy, err := process.ParseRestartPolicy(existing.Restart)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	info, err := startSupervised(pm, name, command, policy)
+	if err != nil {
+		console.Fatal("Failed to start: %s", err)
+	}
+	if err := startMeter(pm, info); err != nil {
+		console.Warning("Failed to start usage meter: %s", err)
+	}
+
+	// Keep the idle policy the daemon was started with
+	if existing.IdleTimeout != "" {
+		if idleTimeout, err := time.ParseDuration(existing.IdleTimeout); err == nil {
+			if err := startIdleWatcher(pm, info, idleTimeout); err != nil {
+				console.Warning("Failed to start idle watcher: %s", err)
+			}
+		}
+	}
+
+	console.Success("Process restarted (PID %d)", info.PID)
+}
+
+// startIdleWatcher spawns a detached 'sbox idle-watch' for a daemon and
+// records the policy on its process entry
+func startIdleWatcher(pm *process.ProcessManager, info *process.ProcessInfo, timeout time.Duration) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	watcher := exec.Command(self, "idle-watch", info.Name, timeout.String())
+	watcher.Dir = pm.ProjectRoot
+	watcher.SysProcAttr = sysproc.Detached()
+	if err := watcher.Start(); err != nil {
+		return err
+	}
+	watcher.Process.Release()
+
+	info.IdleTimeout = timeout.String()
+	return pm.AddProcess(*info)
+}
+
+// startMeter spawns a detached 'sbox meter' that records the resource
+// usage of a daemon until it exits
+func startMeter(pm *process.ProcessManager, info *process.ProcessInfo) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	meter := exec.Command(self, "meter", info.Name)
+	meter.Dir = pm.ProjectRoot
+	meter.SysProcAttr = sysproc.Detached()
+	if err := meter.Start(); err != nil {
+		return err
+	}
+	return meter.Process.Release()
+}
+
+// supervisorStartTimeout is how long 'sbox run -d' waits for
+// the supervisor to start the daemon
+const supervisorStartTimeout = 10 * time.Second
+
+// startSupervised spawns a detached 'sbox supervise' that starts the
+// daemon and restarts it according to policy, and returns the daemon's
+// process entry once the supervisor has registered it
+func startSupervised(pm *process.ProcessManager, name, command string, policy process.RestartPolicy) (*process.ProcessInfo, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	superviseArgs := []string{"supervise", name, policy.String(), command}
+	for _, path := range pm.EnvFiles {
+		superviseArgs = append(superviseArgs, "--env-file", path)
+	}
+	if pm.Rotation.Piped() {
+		superviseArgs = append(superviseArgs, pm.Rotation.Args()...)
+	}
+	supervisor := exec.Command(self, superviseArgs...)
+	supervisor.Dir = pm.ProjectRoot
+	supervisor.SysProcAttr = sysproc.Detached()
+	var stderr bytes.Buffer
+	supervisor.Stderr = &stderr
+	if err := supervisor.Start(); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- supervisor.Wait() }()
+
+	deadline := time.After(supervisorStartTimeout)
+	for {
+		if info, err := pm.GetProcess(name); err == nil && info.SupervisorPID == supervisor.Process.Pid {
+			return info, nil
+		}
+		select {
+		case <-exited:
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("supervisor failed: %s", msg)
+			}
+			return nil, fmt.Errorf("supervisor exited before starting '%s'", name)
+		case <-deadline:
+			return nil, fmt.Errorf("supervisor did not start '%s' within %s", name, supervisorStartTimeout)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func runSupervise(cmd *cobra.Command, args []string) {
+	name, command := args[0], args[2]
+
+	policy, err := process.ParseRestartPolicy(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "not in an sbox project")
+		os.Exit(1)
+	}
+
+	r, err := runner.New(projectRoot)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := r.CheckBuilt(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	envFiles, _ := cmd.Flags().GetStringArray("env-file")
+	for _, path := range envFiles {
+		if err := r.LoadEnvFile(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	r.ServiceName = name
+	env := r.BuildEnv()
+	workdir := r.ResolveWorkdir()
+
+	pm := process.NewProcessManager(projectRoot)
+	pm.EnvFiles = envFiles
+	if err := applyLogRotation(cmd, &pm.Rotation); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if pm.Wrap, err = r.IsolationPrefix(workdir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := pm.Supervise(name, command, env, workdir, policy); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// addLogRotationFlags adds the flags that override logging: in config.yaml
+func addLogRotationFlags(cmd *cobra.Command) {
+	cmd.Flags().String("log-max-size", "", "Rotate the daemon log when it reaches this size, e.g. 10M (overrides logging.max_size)")
+	cmd.Flags().Int("log-max-files", 0, fmt.Sprintf("Number of rotated logs to keep (overrides logging.max_files, default %d)", process.DefaultLogFiles))
+	cmd.Flags().Bool("log-compress", false, "Gzip rotated logs (overrides logging.compress)")
+	cmd.Flags().Bool("log-structured", false, "Prefix log lines with their capture time and stream (overrides logging.structured)")
+}
+
+// applyLogRotation applies the log rotation flags that were set to r
+func applyLogRotation(cmd *cobra.Command, r *process.LogRotation) error {
+	if cmd.Flags().Changed("log-max-size") {
+		value, _ := cmd.Flags().GetString("log-max-size")
+		size, err := config.ParseSize(value)
+		if err != nil {
+			return fmt.Errorf("--log-max-size: %w", err)
+		}
+		r.MaxSize = size
+	}
+	if cmd.Flags().Changed("log-max-files") {
+		files, _ := cmd.Flags().GetInt("log-max-files")
+		if files <= 0 {
+			return fmt.Errorf("--log-max-files must be positive, got %d", files)
+		}
+		r.MaxFiles = files
+	}
+	if cmd.Flags().Changed("log-compress") {
+		r.Compress, _ = cmd.Flags().GetBool("log-compress")
+	}
+	if cmd.Flags().Changed("log-structured") {
+		r.Structured, _ = cmd.Flags().GetBool("log-structured")
+	}
+	if r.MaxFiles <= 0 {
+		r.MaxFiles = process.DefaultLogFiles
+	}
+	return nil
+}
+
+func runLogWriter(cmd *cobra.Command, args []string) {
+	var policy process.LogRotation
+	if err := applyLogRotation(cmd, &policy); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var err error
+	if policy.Structured {
+		var stderr *os.File
+		if fd3, _ := cmd.Flags().GetBool(process.StderrFD3Flag); fd3 {
+			stderr = os.NewFile(3, "stderr")
+		}
+		err = process.WriteStructuredLog(args[0], policy, os.Stdin, stderr)
+	} else {
+		err = process.WriteLog(args[0], policy, os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func runIdleWatch(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		os.Exit(1)
+	}
+
+	timeout, err := time.ParseDuration(args[1])
+	if err != nil || timeout <= 0 {
+		os.Exit(1)
+	}
+
+	pm := process.NewProcessManager(projectRoot)
+	if err := pm.WatchIdle(args[0], timeout); err != nil {
+		os.Exit(1)
+	}
+}
+
+func runMeter(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		os.Exit(1)
+	}
+
+	pm := process.NewProcessManager(projectRoot)
+	if err := pm.Meter(args[0]); err != nil {
+		os.Exit(1)
+	}
+}
+
+func runRlimitExec(cmd *cobra.Command, args []string) {
+	memory, _ := cmd.Flags().GetInt64("memory")
+	nofile, _ := cmd.Flags().GetInt("nofile")
+	nproc, _ := cmd.Flags().GetInt("nproc")
+	nice, _ := cmd.Flags().GetInt("nice")
+	ioClass, _ := cmd.Flags().GetString("io-class")
+	cpus, _ := cmd.Flags().GetString("cpus")
+	ulimits, _ := cmd.Flags().GetStringArray("ulimit")
+
+	// Output goes to the daemon log
+	if err := process.SetPriority(config.Priority{Nice: nice, IOClass: ioClass}); err != nil {
+		fmt.Fprintf(os.Stderr, "sbox: %s\n", err)
+		os.Exit(1)
+	}
+	if err := process.SetAffinity(cpus); err != nil {
+		fmt.Fprintf(os.Stderr, "sbox: %s\n", err)
+		os.Exit(1)
+	}
+	if err := process.SetUlimits(ulimits); err != nil {
+		fmt.Fprintf(os.Stderr, "sbox: %s\n", err)
+		os.Exit(1)
+	}
+	if err := process.ExecWithLimits(memory, nofile, nproc, args); err != nil {
+		fmt.Fprintf(os.Stderr, "sbox: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func runEvents(cmd *cobra.Command, args []string) {
+	lines, _ := cmd.Flags().GetInt("lines")
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	pm := process.NewProcessManager(projectRoot)
+	events, err := pm.LoadEvents()
+	if err != nil {
+		console.Fatal("Failed to read events: %s", err)
+	}
+
+	if len(args) > 0 {
+		var filtered []process.Event
+		for _, e := range events {
+			if e.Process == args[0] {
+				filtered = append(filtered, e)
+			}
+		}
+		events = filtered
+	}
+
+	if lines > 0 && len(events) > lines {
+		events = events[len(events)-lines:]
+	}
+
+	if asJSON {
+		if events == nil {
+			events = []process.Event{}
+		}
+		data, _ := json.MarshalIndent(events, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	if len(events) == 0 {
+		console.Info("No events recorded")
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-20s %-15s %-18s %s\n", "TIME", "NAME", "EVENT", "MESSAGE")
+	fmt.Printf("  %-20s %-15s %-18s %s\n", "----", "----", "-----", "-------")
+	for _, e := range events {
+		fmt.Printf("  %-20s %-15s %-18s %s\n", e.Time.Format("2006-01-02 15:04:05"), e.Process, e.Type, e.Message)
+	}
+	fmt.Println()
+}
+
+func runCrashesList(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	pm := process.NewProcessManager(projectRoot)
+	crashes, err := pm.ListCrashes(name)
+	if err != nil {
+		console.Fatal("Failed to read crashes: %s", err)
+	}
+
+	if asJSON {
+		if crashes == nil {
+			crashes = []process.Crash{}
+		}
+		data, _ := json.MarshalIndent(crashes, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	if len(crashes) == 0 {
+		console.Info("No crashes recorded")
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-32s %-20s %-6s %-26s %s\n", "ID", "TIME", "EXIT", "SIGNAL", "RAN")
+	fmt.Printf("  %-32s %-20s %-6s %-26s %s\n", "--", "----", "----", "------", "---")
+	for _, c := range crashes {
+		signal := c.Signal
+		if signal == "" {
+			signal = "-"
+		}
+		fmt.Printf("  %-32s %-20s %-6d %-26s %s\n", c.ID, c.Time.Format("2006-01-02 15:04:05"), c.ExitCode, signal, formatDuration(c.Time.Sub(c.StartTime)))
+	}
+	fmt.Println()
+	console.Print("    → sbox crashes show <id>")
+}
+
+func runCrashesShow(cmd *cobra.Command, args []string) {
+	lines, _ := cmd.Flags().GetInt("lines")
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	pm := process.NewProcessManager(projectRoot)
+	crash, err := pm.GetCrash(args[0])
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	fmt.Println()
+	console.Print("  ┌─ Crash %s", crash.ID)
+	console.Print("  │  Process:  %s (PID %d)", crash.Process, crash.PID)
+	console.Print("  │  Command:  %s", crash.Command)
+	if crash.Workdir != "" {
+		console.Print("  │  Workdir:  %s", crash.Workdir)
+	}
+	console.Print("  │  Started:  %s", crash.StartTime.Format("2006-01-02 15:04:05"))
+	console.Print("  │  Crashed:  %s (after %s)", crash.Time.Format("2006-01-02 15:04:05"), formatDuration(crash.Time.Sub(crash.StartTime)))
+	console.Print("  │  Exit:     %d", crash.ExitCode)
+	if crash.Signal != "" {
+		console.Print("  │  Signal:   %s", crash.Signal)
+	}
+	if crash.CoreDumped || crash.Core != "" {
+		core := crash.Core
+		if core == "" {
+			core = "location unknown"
+		}
+		if crash.CoreDumped {
+			core = "dumped, " + core
+		}
+		console.Print("  │  Core:     %s", core)
+	}
+	if crash.Restart != "" {
+		console.Print("  │  Restart:  %s (%d restarts before)", crash.Restart, crash.Restarts)
+	}
+	console.Print("  │  Saved in: %s", crash.Dir)
+	fmt.Println()
+
+	output, err := crash.Output()
+	if err != nil || len(output) == 0 {
+		console.Info("No log lines were saved with this crash")
+		return
+	}
+	if lines > 0 && len(output) > lines {
+		output = output[len(output)-lines:]
+	}
+	console.Print("  ┌─ Last %d log lines", len(output))
+	for _, line := range output {
+		console.Print("  │  %s", line)
+	}
+	fmt.Println()
+}
+
+// debugTarget returns the project root and the PID of the interpreter
+// (by executable name prefix) of the running daemon named in args
+func debugTarget(args []string, interpreter string) (string, int) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	name := filepath.Base(projectRoot)
+	if len(args) > 0 {
+		name = args[0]
+	}
+
+	pm := process.NewProcessManager(projectRoot)
+	info, err := pm.GetProcess(name)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	if !info.IsAlive() {
+		console.Fatal("Process '%s' is not running (status: %s)", name, info.Status)
+	}
+	pid, err := info.FindInGroup(interpreter)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	return projectRoot, pid
+}
+
+// ensurePySpy returns the py-spy of the sandbox environment, installing
+// it with pip first if needed
+func ensurePySpy(projectRoot string) string {
+	pySpy := config.EnvExe(config.GetEnvDir(projectRoot), "py-spy")
+	if _, err := os.Stat(pySpy); err == nil {
+		return pySpy
+	}
+
+	if _, err := os.Stat(config.EnvExe(config.GetEnvDir(projectRoot), "python")); err != nil {
+		console.Fatal("The sandbox has no Python environment to install py-spy into")
+	}
+	console.Info("py-spy is not installed in the sandbox; installing it")
+	if err := sboxruntime.NewManager(projectRoot).InstallPackages([]string{"python -m pip install py-spy"}); err != nil {
+		console.Fatal("Failed to install py-spy: %s", err)
+	}
+	if _, err := os.Stat(pySpy); err != nil {
+		console.Fatal("py-spy was not installed at %s", pySpy)
+	}
+	console.Print("    → Add 'pip install py-spy' to install: in config.yaml to keep it across builds")
+	return pySpy
+}
+
+// runPySpy runs py-spy against a process and exits with its status
+func runPySpy(pySpy string, args ...string) {
+	pySpyCmd := exec.Command(pySpy, args...)
+	pySpyCmd.Stdin = os.Stdin
+	pySpyCmd.Stdout = os.Stdout
+	pySpyCmd.Stderr = os.Stderr
+	err := pySpyCmd.Run()
+	if err == nil {
+		return
+	}
+
+	if os.Geteuid() != 0 && process.PtraceScope() > 0 {
+		console.Print("    → kernel.yama.ptrace_scope restricts attaching to processes; run with sudo,")
+		console.Print("      or allow it with 'sudo sysctl kernel.yama.ptrace_scope=0'")
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	}
+	console.Fatal("Failed to run py-spy: %s", err)
+}
+
+func runDebugDump(cmd *cobra.Command, args []string) {
+	locals, _ := cmd.Flags().GetBool("locals")
+	native, _ := cmd.Flags().GetBool("native")
+
+	projectRoot, pid := debugTarget(args, "python")
+	pySpy := ensurePySpy(projectRoot)
+
+	pySpyArgs := []string{"dump", "--pid", strconv.Itoa(pid)}
+	if locals {
+		pySpyArgs = append(pySpyArgs, "--locals")
+	}
+	if native {
+		pySpyArgs = append(pySpyArgs, "--native")
+	}
+	runPySpy(pySpy, pySpyArgs...)
+}
+
+func runDebugTop(cmd *cobra.Command, args []string) {
+	projectRoot, pid := debugTarget(args, "python")
+	pySpy := ensurePySpy(projectRoot)
+	runPySpy(pySpy, "top", "--pid", strconv.Itoa(pid))
+}
+
+func runDebugInspect(cmd *cobra.Command, args []string) {
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+
+	_, pid := debugTarget(args, "node")
+
+	console.Step("Opening the inspector of PID %d", pid)
+	port, err := process.EnableInspector(pid, timeout)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	console.Success("Inspector listening on 127.0.0.1:%d", port)
+	console.Print("    → Open chrome://inspect, or attach your editor to 127.0.0.1:%d", port)
+	console.Print("    → From another machine: ssh -L %d:127.0.0.1:%d <host>", port, port)
+}
+
+func runProfileRun(cmd *cobra.Command, args []string) {
+	tool, _ := cmd.Flags().GetString("tool")
+	top, _ := cmd.Flags().GetInt("top")
+	sortKey, _ := cmd.Flags().GetString("sort")
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	r, err := runner.New(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	if err := r.CheckBuilt(); err != nil {
+		console.Fatal("%s", err)
+	}
+	loadEnvFiles(cmd, r)
+
+	command := r.Config.Cmd
+	if len(args) > 0 {
+		command = strings.Join(args, " ")
+	}
+	if command == "" {
+		console.Fatal("No command specified and no default cmd in config")
+	}
+
+	language := r.Config.ParseRuntime().Language
+	tools := profile.Tools(language)
+	if len(tools) == 0 {
+		console.Fatal("No profiler for the %s runtime (supported: python, node)", language)
+	}
+	if tool == "" {
+		tool = tools[0]
+	}
+	known := false
+	for _, t := range tools {
+		known = known || t == tool
+	}
+	if !known {
+		console.Fatal("Profiler '%s' does not apply to %s (use %s)", tool, language, strings.Join(tools, ", "))
+	}
+
+	p, err := profile.New(projectRoot, tool, command)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	if p.Wrapped, err = p.Wrap(r.EnvDir); err != nil {
+		os.RemoveAll(p.Dir)
+		console.Fatal("%s", err)
+	}
+	if err := p.Save(); err != nil {
+		console.Fatal("Failed to save profile: %s", err)
+	}
+
+	console.Info("Profiling with %s into %s", tool, p.Dir)
+	r.Binds = []string{p.Dir}
+	exitCode, err := r.Run(p.Wrapped)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	p.EndTime = time.Now()
+	p.ExitCode = exitCode
+	if err := p.Save(); err != nil {
+		console.Warning("Failed to save profile: %s", err)
+	}
+
+	fmt.Println()
+	if exitCode != 0 {
+		console.Warning("Command exited with code %d", exitCode)
+	}
+	printProfileSummary(r, p, top, sortKey)
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// printProfileSummary prints the functions that took the most time in a
+// profile, or where the profiler's report is for 0x and clinic
+func printProfileSummary(r *runner.Runner, p *profile.Profile, top int, sortKey string) {
+	outputs := p.Outputs()
+	if len(outputs) == 0 {
+		console.Warning("The profiler wrote nothing to %s", p.Dir)
+		console.Print("    → Profiles are written when the program exits normally; stop servers with Ctrl-C")
+		return
+	}
+
+	switch p.Tool {
+	case profile.CProfile:
+		path := filepath.Join(p.Dir, profile.PythonOutput)
+		stats, err := profile.PythonStats(r.EnvDir, r.BuildEnv(), path, sortKey, top)
+		if err != nil {
+			console.Fatal("%s", err)
+		}
+		console.Step("Top %d functions by %s time", top, sortKey)
+		fmt.Print(stats)
+		console.Print("    → Browse it with: sbox exec python -m pstats %s", path)
+
+	case profile.CPUProf:
+		var paths []string
+		for _, output := range outputs {
+			if strings.HasSuffix(output, ".cpuprofile") {
+				paths = append(paths, filepath.Join(p.Dir, output))
+			}
+		}
+		functions, total, err := profile.SummarizeCPUProfiles(paths)
+		if err != nil {
+			console.Fatal("%s", err)
+		}
+		console.Step("Top %d functions by self time (%d profile(s), %s sampled)", top, len(paths), total.Round(time.Millisecond))
+		fmt.Println()
+		fmt.Printf("  %-10s %-7s %-32s %s\n", "SELF", "%", "FUNCTION", "LOCATION")
+		fmt.Printf("  %-10s %-7s %-32s %s\n", "----", "-", "--------", "--------")
+		for i, f := range functions {
+			if i == top {
+				break
+			}
+			percent := 0.0
+			if total > 0 {
+				percent = float64(f.Self) * 100 / float64(total)
+			}
+			fmt.Printf("  %-10s %-7s %-32s %s\n", f.Self.Round(time.Millisecond), fmt.Sprintf("%.1f", percent), f.Name, f.Location)
+		}
+		fmt.Println()
+		console.Print("    → Open the .cpuprofile files in Chrome DevTools (Performance) for call trees")
+
+	default:
+		console.Step("%s report in %s", p.Tool, p.Dir)
+		for _, output := range outputs {
+			if strings.HasSuffix(output, ".html") {
+				console.Print("  • %s", filepath.Join(p.Dir, output))
+			}
+		}
+		console.Print("    → Open the HTML report in a browser")
+	}
+}
+
+func runSecretSet(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	name := args[0]
+	if !secrets.ValidName(name) {
+		console.Fatal("Invalid secret name '%s' (use letters, digits and _, as for an environment variable)", name)
+	}
+
+	var value string
+	if len(args) > 1 {
+		value = args[1]
+	} else {
+		if value, err = readSecretValue(name); err != nil {
+			console.Fatal("Failed to read the value: %s", err)
+		}
+	}
+	auditCommand(projectRoot, cmd, value)
+
+	store, err := secrets.Open(projectRoot, true)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	if err := store.Set(name, value); err != nil {
+		console.Fatal("Failed to set secret: %s", err)
+	}
+	console.Success("Set secret %s", name)
+
+	if cfg, err := config.Load(projectRoot); err == nil && !containsString(cfg.Secrets, name) {
+		console.Print("    → Add %s to secrets: in config.yaml to pass it to commands", name)
+	}
+}
+
+// readSecretValue reads a secret from stdin: one line, without echo, from
+// a terminal, otherwise everything up to EOF less a trailing newline
+func readSecretValue(name string) (string, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"), nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Value for %s: ", name)
+	stty := func(arg string) {
+		c := exec.Command("stty", arg)
+		c.Stdin = os.Stdin
+		c.Run()
+	}
+	stty("-echo")
+	defer func() {
+		stty("echo")
+		fmt.Fprintln(os.Stderr)
+	}()
+
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n == 0 || err != nil || buf[0] == '\n' {
+			break
+		}
+		line = append(line, buf[0])
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+func runSecretGet(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	auditCommand(projectRoot, cmd)
+	store, err := secrets.Open(projectRoot, false)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	value, err := store.Get(args[0])
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	fmt.Println(value)
+}
+
+func runSecretList(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	names, err := secrets.Names(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to read secrets: %s", err)
+	}
+
+	// Listed in secrets: but never set
+	var missing []string
+	for _, name := range cfg.Secrets {
+		if !containsString(names, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(names) == 0 && len(missing) == 0 {
+		console.Info("No secrets set")
+		console.Print("    → sbox secret set <name>")
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-32s %s\n", "NAME", "PASSED TO COMMANDS")
+	fmt.Printf("  %-32s %s\n", "----", "------------------")
+	for _, name := range names {
+		used := "no (not in secrets:)"
+		if containsString(cfg.Secrets, name) {
+			used = "yes"
+		}
+		fmt.Printf("  %-32s %s\n", name, used)
+	}
+	for _, name := range missing {
+		fmt.Printf("  %-32s %s\n", name, "NOT SET")
+	}
+	fmt.Println()
+}
+
+func runSecretRm(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	name := args[0]
+	if !secrets.ValidName(name) {
+		console.Fatal("Invalid secret name '%s'", name)
+	}
+	auditCommand(projectRoot, cmd)
+	if err := secrets.Remove(projectRoot, name); err != nil {
+		console.Fatal("%s", err)
+	}
+	console.Success("Removed secret %s", name)
+
+	if cfg, err := config.Load(projectRoot); err == nil && containsString(cfg.Secrets, name) {
+		console.Warning("%s is still listed under secrets: in config.yaml", name)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func runProfileList(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	profiles, err := profile.List(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to read profiles: %s", err)
+	}
+	if len(profiles) == 0 {
+		console.Info("No profiles recorded")
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-28s %-9s %-9s %-5s %s\n", "ID", "TOOL", "RAN", "EXIT", "COMMAND")
+	fmt.Printf("  %-28s %-9s %-9s %-5s %s\n", "--", "----", "---", "----", "-------")
+	for _, p := range profiles {
+		ran := "-"
+		if !p.EndTime.IsZero() {
+			ran = formatDuration(p.EndTime.Sub(p.StartTime))
+		}
+		fmt.Printf("  %-28s %-9s %-9s %-5d %s\n", p.ID, p.Tool, ran, p.ExitCode, p.Command)
+	}
+	fmt.Println()
+	console.Print("    → sbox profile show <id>")
+}
+
+func runProfileShow(cmd *cobra.Command, args []string) {
+	top, _ := cmd.Flags().GetInt("top")
+	sortKey, _ := cmd.Flags().GetString("sort")
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	p, err := profile.Load(projectRoot, args[0])
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	r, err := runner.New(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+
+	console.Info("Command: %s", p.Command)
+	console.Info("Started: %s", p.StartTime.Format("2006-01-02 15:04:05"))
+	fmt.Println()
+	printProfileSummary(r, p, top, sortKey)
+}
+
+func runWatch(cmd *cobra.Command, args []string) {
+	daemon, _ := cmd.Flags().GetString("daemon")
+	install, _ := cmd.Flags().GetBool("install")
+	interval, _ := cmd.Flags().GetDuration("interval")
+	stopTimeout, _ := cmd.Flags().GetDuration("stop-timeout")
+
+	if interval <= 0 {
+		console.Fatal("--interval must be positive")
+	}
+	if daemon != "" && len(args) > 0 {
+		console.Fatal("--daemon restarts the daemon with its own command; do not give one")
+	}
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	var existing *process.ProcessInfo
+	if daemon != "" {
+		pm := process.NewProcessManager(projectRoot)
+		pm.UpdateProcessStatus()
+		existing, err = pm.GetProcess(daemon)
+		if err != nil {
+			console.Fatal("Process '%s' not found. Start it with 'sbox run -d --name %s' first.", daemon, daemon)
+		}
+		if existing.SlurmJob != "" {
+			console.Fatal("'%s' is Slurm job %s and cannot be restarted locally", daemon, existing.SlurmJob)
+		}
+	}
+
+	var envFiles []string
+	files, _ := cmd.Flags().GetStringArray("env-file")
+	for _, file := range files {
+		path, err := filepath.Abs(file)
+		if err != nil {
+			console.Fatal("Invalid env file path: %s", err)
+		}
+		envFiles = append(envFiles, path)
+	}
+
+	// Ctrl-C reaches sbox only: the command has its own process group
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-signals
+		close(done)
+	}()
+
+	cfg, built, err := watchBuild(projectRoot, false)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	w := watch.New(projectRoot, cfg)
+	configPath := w.Paths()[0]
+	console.Info("Watching config.yaml and %d copy sources, Ctrl-C to stop", len(w.Paths())-1)
+
+	// A running daemon is only restarted once something changed
+	command := strings.Join(args, " ")
+	var job *runner.Job
+	var quiet chan struct{}
+	if daemon == "" || built || !existing.IsAlive() {
+		job, quiet = watchStart(projectRoot, command, envFiles, daemon)
+	}
+	for {
+		changed, ok := w.Wait(interval, done)
+		if !ok {
+			break
+		}
+
+		rel, _ := filepath.Rel(projectRoot, changed[0])
+		if len(changed) > 1 {
+			console.Step("Changed: %s and %d more", rel, len(changed)-1)
+		} else {
+			console.Step("Changed: %s", rel)
+		}
+
+		if job != nil {
+			close(quiet)
+			console.Step("Stopping the command")
+			job.Stop(stopTimeout)
+			job = nil
+		}
+
+		force, configChanged := false, false
+		for _, path := range changed {
+			if install && !force && watch.IsManifest(path) {
+				console.Info("%s changed, running the install commands again", filepath.Base(path))
+				force = true
+			}
+			configChanged = configChanged || path == configPath
+		}
+		cfg, _, err := watchBuild(projectRoot, force)
+		// Copy sources added to config.yaml are watched from now on
+		if cfg != nil && configChanged {
+			w = watch.New(projectRoot, cfg)
+		}
+		if err != nil {
+			console.Error("%s", err)
+			console.Info("Waiting for changes...")
+			continue
+		}
+		job, quiet = watchStart(projectRoot, command, envFiles, daemon)
+	}
+
+	if job != nil {
+		close(quiet)
+		job.Stop(stopTimeout)
+	}
+	fmt.Println()
+	console.Info("Stopped watching")
+}
+
+// watchBuild loads the config and builds the project when it is out of
+// date, or with force, and reports whether it built. The config is
+// returned whenever it loaded.
+func watchBuild(projectRoot string, force bool) (*config.Config, bool, error) {
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := validate.QuickValidate(cfg, projectRoot); err != nil {
+		return cfg, false, fmt.Errorf("configuration error: %w", err)
+	}
+	if !force && builder.UpToDate(projectRoot, cfg) {
+		return cfg, false, nil
+	}
+	if err := buildProject(projectRoot, cfg, force, false, false, false); err != nil {
+		return cfg, false, fmt.Errorf("build failed: %w", err)
+	}
+	return cfg, true, nil
+}
+
+// watchStart restarts the daemon through 'sbox restart', or starts the
+// command in the background. For a command it returns the job and a
+// channel to close before stopping it, which keeps its exit unreported.
+func watchStart(projectRoot, command string, envFiles []string, daemon string) (*runner.Job, chan struct{}) {
+	if daemon != "" {
+		self, err := os.Executable()
+		if err != nil {
+			console.Error("%s", err)
+			return nil, nil
+		}
+		restart := exec.Command(self, "restart", daemon)
+		restart.Dir = projectRoot
+		restart.Stdout, restart.Stderr = os.Stdout, os.Stderr
+		if err := restart.Run(); err != nil {
+			console.Error("Failed to restart %s, waiting for changes", daemon)
+		}
+		return nil, nil
+	}
+
+	r, err := runner.New(projectRoot)
+	if err == nil {
+		for _, path := range envFiles {
+			if err = r.LoadEnvFile(path); err != nil {
+				break
+			}
+		}
+	}
+	var job *runner.Job
+	if err == nil {
+		job, err = r.Start(command)
+	}
+	if err != nil {
+		console.Error("%s", err)
+		console.Info("Waiting for changes...")
+		return nil, nil
+	}
+
+	quiet := make(chan struct{})
+	go func() {
+		<-job.Done()
+		select {
+		case <-quiet:
+			return
+		default:
+		}
+		if code, err := job.ExitCode(); err != nil {
+			console.Error("%s", err)
+		} else if code != 0 {
+			console.Error("Command exited with code %d, waiting for changes", code)
+		} else {
+			console.Info("Command exited, waiting for changes")
+		}
+	}()
+	return job, quiet
+}
+
+func runBench(cmd *cobra.Command, args []string) {
+	runs, _ := cmd.Flags().GetInt("runs")
+	warmup, _ := cmd.Flags().GetInt("warmup")
+	ignoreFailure, _ := cmd.Flags().GetBool("ignore-failure")
+	showOutput, _ := cmd.Flags().GetBool("show-output")
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+
+	if runs < 1 {
+		console.Fatal("--runs must be at least 1")
+	}
+	if warmup < 0 {
+		console.Fatal("--warmup cannot be negative")
+	}
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	r, err := runner.New(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	if err := r.CheckBuilt(); err != nil {
+		console.Fatal("%s", err)
+	}
+	loadEnvFiles(cmd, r)
+
+	command := r.Config.Cmd
+	if len(args) > 0 {
+		command = strings.Join(args, " ")
+	}
+	if command == "" {
+		console.Fatal("No command specified and no default cmd in config")
+	}
+
+	var out io.Writer
+	if showOutput && !jsonOutput {
+		out = os.Stdout
+	}
+
+	if !jsonOutput {
+		console.Step("Benchmarking: %s", command)
+		console.Info("Workdir: %s", r.ResolveWorkdir())
+	}
+	var samples []bench.Sample
+	for i := 0; i < warmup+runs; i++ {
+		sample, err := bench.Run(r, command, out)
+		if err != nil {
+			console.Fatal("%s", err)
+		}
+		if sample.ExitCode != 0 && !ignoreFailure {
+			console.Error("Command exited with code %d", sample.ExitCode)
+			console.Print("    → Use --show-output to see why, or --ignore-failure to keep going")
+			os.Exit(1)
+		}
+		if i < warmup {
+			if !jsonOutput {
+				console.Info("Warmup %d/%d: %s", i+1, warmup, bench.Seconds(sample.Wall.Seconds()))
+			}
+			continue
+		}
+		samples = append(samples, sample)
+		if !jsonOutput {
+			status := ""
+			if sample.ExitCode != 0 {
+				status = fmt.Sprintf(" (exit code %d)", sample.ExitCode)
+			}
+			console.Info("Run %d/%d: %s%s", len(samples), runs, bench.Seconds(sample.Wall.Seconds()), status)
+		}
+	}
+
+	result := bench.Summarize(command, samples)
+	if jsonOutput {
+		data, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-10s %10s %10s %10s %10s %10s\n", "", "MIN", "MEDIAN", "P95", "MAX", "MEAN")
+	fmt.Printf("  %-10s %10s %10s %10s %10s %10s\n", "", "---", "------", "---", "---", "----")
+	for _, row := range []struct {
+		name  string
+		stats bench.Stats
+	}{
+		{"wall", result.Wall},
+		{"cpu", result.CPU},
+		{"user", result.User},
+		{"system", result.System},
+	} {
+		st := row.stats
+		fmt.Printf("  %-10s %10s %10s %10s %10s %10s\n", row.name,
+			bench.Seconds(st.Min), bench.Seconds(st.Median), bench.Seconds(st.P95), bench.Seconds(st.Max), bench.Seconds(st.Mean))
+	}
+	rss := result.MaxRSS
+	fmt.Printf("  %-10s %10s %10s %10s %10s %10s\n", "max rss",
+		formatBytes(int64(rss.Min)), formatBytes(int64(rss.Median)), formatBytes(int64(rss.P95)), formatBytes(int64(rss.Max)), formatBytes(int64(rss.Mean)))
+	fmt.Println()
+	console.Print("  %d runs, wall time %s ± %s", result.Runs, bench.Seconds(result.Wall.Mean), bench.Seconds(result.Wall.StdDev))
+	if result.Failed > 0 {
+		console.Warning("%d of %d runs exited with a non-zero code", result.Failed, result.Runs)
+	}
+}
+
+func runPause(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	pm := process.NewProcessManager(projectRoot)
+
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	} else {
+		name = filepath.Base(projectRoot)
+	}
+
+	console.Step("Pausing process: %s", name)
+
+	if err := pm.PauseProcess(name); err != nil {
+		console.Fatal("%s", err)
+	}
+
+	console.Success("Process paused (use 'sbox resume %s' to continue)", name)
+}
+
+func runResume(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	pm := process.NewProcessManager(projectRoot)
+
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	} else {
+		name = filepath.Base(projectRoot)
+	}
+
+	console.Step("Resuming process: %s", name)
+
+	if err := pm.ResumeProcess(name); err != nil {
+		console.Fatal("%s", err)
+	}
+
+	console.Success("Process resumed")
+}
+
+func runClean(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	cleanAll, _ := cmd.Flags().GetBool("all")
+	cleanLogs, _ := cmd.Flags().GetBool("logs")
+	logsAge, _ := cmd.Flags().GetDuration("logs-older-than")
+	rootfsOnly, _ := cmd.Flags().GetBool("rootfs-only")
+	keepEnv, _ := cmd.Flags().GetBool("keep-env")
+	processesOnly, _ := cmd.Flags().GetBool("processes")
+	cacheLocal, _ := cmd.Flags().GetBool("cache-local")
+
+	var targets []string
+	for _, flag := range []string{"all", "logs", "rootfs-only", "keep-env", "processes", "cache-local"} {
+		if set, _ := cmd.Flags().GetBool(flag); set {
+			targets = append(targets, flag)
+		}
+	}
+	if len(targets) > 1 {
+		console.Fatal("--%s and --%s cannot be combined", targets[0], targets[1])
+	}
+
+	sboxDir := config.GetSboxDir(projectRoot)
+	pm := process.NewProcessManager(projectRoot)
+
+	if cleanAll {
+		running, _ := pm.GetRunningProcesses()
+		items := append(processItems(running), pathItems(projectRoot, cleanAllPaths(projectRoot)...)...)
+		confirm(cmd, "clean --all stops the project's processes and moves its sbox files, config included, to the trash:", items, "Remove them?")
+	}
+	auditCommand(projectRoot, cmd)
+
+	// Removing files a build is writing would leave a sandbox the lock
+	// file calls up to date
+	if !cleanLogs && !processesOnly {
+		lockPath := config.GetBuildLockPath(projectRoot)
+		lock, err := lockfile.TryAcquire(lockPath)
+		if err != nil {
+			if _, busy := err.(*lockfile.ErrLocked); !busy {
+				console.Fatal("%s", err)
+			}
+			console.Info("Waiting for the running build to finish (%s)...", err)
+			if lock, err = lockfile.Acquire(lockPath); err != nil {
+				console.Fatal("%s", err)
+			}
+		}
+		defer lock.Release()
+	}
+
+	// Caches are regenerated on demand, so processes can keep running
+	if cacheLocal {
+		console.Step("Cleaning local caches...")
+		removed, size := cleanLocalCaches(projectRoot)
+		console.Success("Removed %d cache director(ies) (%s)", removed, formatBytes(size))
+		return
+	}
+
+	// Stop running processes first
+	runningProcesses, _ := pm.GetRunningProcesses()
+	if len(runningProcesses) > 0 {
+		console.Step("Stopping %d running process(es)...", len(runningProcesses))
+		for _, p := range runningProcesses {
+			pm.StopProcess(p.Name)
+			console.Print("  Stopped: %s", p.Name)
+		}
+	}
+
+	if cleanLogs {
+		console.Step("Cleaning logs older than %s...", logsAge)
+		removed, err := pm.CleanOldLogs(logsAge)
+		if err != nil {
+			console.Error("Failed to clean logs: %s", err)
+		} else {
+			console.Success("Removed %d log file(s)", removed)
+		}
+		return
+	}
+
+	if processesOnly {
+		var forgotten int
+		err := pm.UpdateProcesses(func(records []process.ProcessInfo) ([]process.ProcessInfo, error) {
+			forgotten = len(records)
+			return []process.ProcessInfo{}, nil
+		})
+		if err != nil {
+			console.Fatal("Failed to clear process records: %s", err)
+		}
+		console.Success("Forgot %d process record(s)", forgotten)
+		return
+	}
+
+	if rootfsOnly || keepEnv {
+		console.Step("Cleaning application files...")
+		paths := []string{config.GetRootfsDir(projectRoot)}
+		if keepEnv {
+			paths = append(paths, filepath.Join(sboxDir, config.EnvScript))
+		}
+		for _, path := range paths {
+			if _, err := os.Lstat(path); err == nil {
+				if err := os.RemoveAll(path); err != nil {
+					console.Fatal("Failed to remove %s: %s", path, err)
+				}
+				rel, _ := filepath.Rel(sboxDir, path)
+				console.Print("  Removed: %s", rel)
+			}
+		}
+		if err := config.ResetBuildSteps(projectRoot); err != nil {
+			console.Warning("Failed to update %s: %s", config.LockFile, err)
+		}
+		console.Success("Cleaned application files; the runtime environment is kept")
+		console.Info("Run 'sbox build' to copy files and run install commands again")
+		return
+	}
+
+	if cleanAll {
+		console.Step("Removing all sbox files...")
+		trashed := moveToTrash("clean --all", cleanAllPaths(projectRoot)...)
+		console.Success("Cleaned all sbox files")
+		printUndoHint(trashed)
+		console.Info("Run 'sbox init' to reinitialize the project")
+	} else {
+		console.Step("Cleaning build artifacts...")
+		dirsToClean := []string{"env", "rootfs", "mamba", "bin"}
+		for _, d := range dirsToClean {
+			path := filepath.Join(sboxDir, d)
+			if _, err := os.Stat(path); err == nil {
+				os.RemoveAll(path)
+				console.Print("  Removed: %s/", d)
+			}
+		}
+		os.Remove(config.GetLockPath(projectRoot))
+		os.Remove(filepath.Join(sboxDir, config.EnvScript))
+		os.Remove(ide.Path(projectRoot))
+		console.Success("Cleaned build artifacts")
+		console.Info("Run 'sbox build' to rebuild")
+	}
+}
+
+// cleanAllPaths returns what 'sbox clean --all' removes: the .sbox
+// directory but for the audit log, which keeps the clean itself on
+// record, and sbox.lock
+func cleanAllPaths(projectRoot string) []string {
+	var paths []string
+	sboxDir := config.GetSboxDir(projectRoot)
+	entries, _ := os.ReadDir(sboxDir)
+	for _, entry := range entries {
+		if entry.Name() != audit.AuditFile {
+			paths = append(paths, filepath.Join(sboxDir, entry.Name()))
+		}
+	}
+	if _, err := os.Stat(config.GetLockPath(projectRoot)); err == nil {
+		paths = append(paths, config.GetLockPath(projectRoot))
+	}
+	return paths
+}
+
+// cleanLocalCaches removes the project's own package cache and the cache
+// directories in its rootfs, and returns how many and their size. Mounts
+// are symlinks and are not followed.
+func cleanLocalCaches(projectRoot string) (int, int64) {
+	var dirs []string
+	if pkgs := filepath.Join(config.GetSboxDir(projectRoot), "mamba", "pkgs"); getDirSize(pkgs) > 0 {
+		dirs = append(dirs, pkgs)
+	}
+	filepath.WalkDir(config.GetRootfsDir(projectRoot), func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && pack.IsCacheDir(d.Name()) {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	var removed int
+	var size int64
+	for _, dir := range dirs {
+		dirSize := getDirSize(dir)
+		if err := os.RemoveAll(dir); err != nil {
+			console.Warning("Failed to remove %s: %s", dir, err)
+			continue
+		}
+		rel, _ := filepath.Rel(projectRoot, dir)
+		console.Print("  Removed: %s (%s)", rel, formatBytes(dirSize))
+		removed++
+		size += dirSize
+	}
+	return removed, size
+}
+
+// moveToTrash moves the paths a command removes into one trash entry,
+// which 'sbox undo' restores
+func moveToTrash(command string, paths ...string) *trash.Entry {
+	entry, err := trash.New(command)
+	if err != nil {
+		console.Fatal("Failed to create trash entry: %s", err)
+	}
+	for _, path := range paths {
+		if err := entry.Move(path); err != nil {
+			entry.Close()
+			if len(entry.Items) > 0 {
+				console.Fatal("%s\n    → 'sbox undo %s' restores what was moved already", err, entry.ID)
+			}
+			console.Fatal("%s", err)
+		}
+	}
+	entry.Close()
+	return entry
+}
+
+// printUndoHint tells how to restore what a command moved to the trash
+func printUndoHint(entry *trash.Entry) {
+	if len(entry.Items) == 0 {
+		return
+	}
+	console.Info("Moved %s to the trash (kept %d days); run 'sbox undo' to restore it",
+		formatBytes(entry.Size()), int(trash.Retention().Hours()/24))
+}
+
+// confirmItem is a path or process a destructive command lists before
+// asking to go on
+type confirmItem struct {
+	label  string
+	detail string
+}
+
+// pathItems lists paths relative to base with their sizes, and the total
+func pathItems(base string, paths ...string) []confirmItem {
+	var items []confirmItem
+	var total int64
+	for _, path := range paths {
+		size := getDirSize(path)
+		total += size
+		label, err := filepath.Rel(base, path)
+		if err != nil || strings.HasPrefix(label, "..") {
+			label = path
+		}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			label += "/"
+		}
+		items = append(items, confirmItem{label, formatBytes(size)})
+	}
+	if len(paths) > 1 {
+		items = append(items, confirmItem{"total", formatBytes(total)})
+	}
+	return items
+}
+
+// processItems lists processes by name with their PID and command
+func processItems(processes []process.ProcessInfo) []confirmItem {
+	var items []confirmItem
+	for _, p := range processes {
+		items = append(items, confirmItem{p.Name, fmt.Sprintf("%s  %s", p.Ref(), p.Command)})
+	}
+	return items
+}
+
+// confirm shows what a destructive command is about to affect and asks
+// to go on, exiting when the answer is not yes. --yes skips the question;
+// without a terminal to ask on, the command fails rather than going on.
+func confirm(cmd *cobra.Command, header string, items []confirmItem, question string) {
+	if yes, _ := cmd.Flags().GetBool("yes"); yes {
+		return
+	}
+	if !runner.StdinIsTerminal() {
+		console.Fatal("%s\n    → Pass --yes to go ahead without a terminal to confirm on", strings.TrimSuffix(header, ":"))
+	}
+
+	console.Warning("%s", header)
+	width := 0
+	for _, item := range items {
+		if len(item.label) > width {
+			width = len(item.label)
+		}
+	}
+	for _, item := range items {
+		console.Print("  %-*s  %s", width, item.label, item.detail)
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return
+	}
+	console.Info("Aborted; nothing was changed")
+	os.Exit(1)
+}
+
+func runUndo(cmd *cobra.Command, args []string) {
+	force, _ := cmd.Flags().GetBool("force")
+	id := ""
+	if len(args) > 0 {
+		id = args[0]
+	}
+	if id == "" {
+		if entries, _ := trash.List(); len(entries) == 0 {
+			console.Info("Nothing to undo: the trash is empty")
+			return
+		}
+	}
+	entry, err := trash.Find(id)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	console.Step("Undoing '%s' of %s", entry.Command, entry.Time.Format("2006-01-02 15:04"))
+	if conflicts := entry.Conflicts(); len(conflicts) > 0 && !force {
+		console.Error("These paths exist again:")
+		for _, path := range conflicts {
+			console.Print("  %s", path)
+		}
+		console.Fatal("Use --force to replace them; they are moved to the trash")
+	}
+	replaced, err := entry.Restore(force)
+	if err != nil {
+		console.Fatal("Failed to restore: %s", err)
+	}
+	for _, item := range entry.Items {
+		console.Print("  Restored: %s", item.Path)
+	}
+	console.Success("Restored %d path(s)", len(entry.Items))
+	if replaced != nil {
+		replaced.Close()
+		console.Info("The paths it replaced are in trash entry %s", replaced.ID)
+	}
+}
+
+func runTrashList(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	entries, err := trash.List()
+	if err != nil {
+		console.Fatal("Failed to read the trash: %s", err)
+	}
+	if asJSON {
+		if entries == nil {
+			entries = []*trash.Entry{}
+		}
+		data, _ := json.MarshalIndent(entries, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if len(entries) == 0 {
+		console.Info("The trash is empty")
+		return
+	}
+	fmt.Printf("  %-20s %-24s %-10s %-10s %s\n", "ID", "COMMAND", "SIZE", "AGE", "EXPIRES IN")
+	for _, entry := range entries {
+		expires := time.Until(entry.Expires())
+		if expires < 0 {
+			expires = 0
+		}
+		fmt.Printf("  %-20s %-24s %-10s %-10s %s\n", entry.ID, entry.Command, formatBytes(entry.Size()),
+			formatDuration(time.Since(entry.Time)), formatDuration(expires))
+		for _, item := range entry.Items {
+			fmt.Printf("      %s\n", item.Path)
+		}
+	}
+}
+
+// shimDir returns the --dir of a shim command, or ~/.local/bin
+func shimDir(cmd *cobra.Command) string {
+	dir, _ := cmd.Flags().GetString("dir")
+	if dir == "" {
+		var err error
+		if dir, err = shim.Dir(); err != nil {
+			console.Fatal("%s", err)
+		}
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	return abs
+}
+
+func runShimAdd(cmd *cobra.Command, args []string) {
+	name, _ := cmd.Flags().GetString("name")
+	force, _ := cmd.Flags().GetBool("force")
+	if name != "" && len(args) > 1 {
+		console.Fatal("--name needs a single command")
+	}
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		console.Fatal("Failed to locate the sbox binary: %s", err)
+	}
+	r, err := runner.New(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	dir := shimDir(cmd)
+
+	sandboxPath := ""
+	for _, kv := range r.BuildEnv() {
+		if value, ok := strings.CutPrefix(kv, "PATH="); ok {
+			sandboxPath = value
+		}
+	}
+	failed := false
+	for _, command := range args {
+		shimName := command
+		if name != "" {
+			shimName = name
+		}
+		if err := shim.CheckName(command); err != nil {
+			console.Fatal("%s", err)
+		}
+		if err := shim.CheckName(shimName); err != nil {
+			console.Fatal("%s", err)
+		}
+		s, err := shim.Write(dir, shimName, self, projectRoot, command, force)
+		if err != nil {
+			console.Error("%s", err)
+			failed = true
+			continue
+		}
+		console.Success("%s → %s in %s", s.Path, command, filepath.Base(projectRoot))
+		if !onSandboxPath(sandboxPath, command) {
+			console.Warning("%s is not on the sandbox PATH yet; the shim fails until it is installed", command)
+		}
+	}
+	if !shim.OnPath(dir) {
+		console.Warning("%s is not on PATH", dir)
+		console.Print("    → Add it in your shell profile: export PATH=\"%s:$PATH\"", dir)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// onSandboxPath reports whether an executable command is in a directory of
+// a PATH value
+func onSandboxPath(path, command string) bool {
+	for _, dir := range filepath.SplitList(path) {
+		if info, err := os.Stat(filepath.Join(dir, command)); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func runShimList(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	dir := shimDir(cmd)
+	shims, err := shim.List(dir)
+	if err != nil {
+		console.Fatal("Failed to read %s: %s", dir, err)
+	}
+	if asJSON {
+		if shims == nil {
+			shims = []shim.Shim{}
+		}
+		data, _ := json.MarshalIndent(shims, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if len(shims) == 0 {
+		console.Info("No shims in %s", dir)
+		return
+	}
+	fmt.Printf("  %-20s %-20s %s\n", "NAME", "COMMAND", "PROJECT")
+	broken := 0
+	for _, s := range shims {
+		project := s.Project
+		if _, err := os.Stat(config.GetSboxDir(s.Project)); err != nil {
+			project += " (missing)"
+			broken++
+		}
+		fmt.Printf("  %-20s %-20s %s\n", s.Name, s.Command, project)
+	}
+	if broken > 0 {
+		console.Warning("%d shim(s) point to projects that no longer exist", broken)
+		console.Print("    → Remove them with 'sbox shim remove <name>'")
+	}
+}
+
+func runShimRemove(cmd *cobra.Command, args []string) {
+	dir := shimDir(cmd)
+	failed := false
+	for _, name := range args {
+		if err := shim.Remove(dir, name); err != nil {
+			console.Error("%s", err)
+			failed = true
+			continue
+		}
+		console.Success("Removed %s", filepath.Join(dir, name))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runIDE(cmd *cobra.Command, args []string) {
+	vscode, _ := cmd.Flags().GetBool("vscode")
+	pycharm, _ := cmd.Flags().GetBool("pycharm")
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	if !config.IsBuilt(projectRoot) {
+		console.Fatal("Environment not built. Run 'sbox build' first.")
+	}
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	if err := ide.Write(projectRoot, cfg); err != nil {
+		console.Fatal("Failed to write %s: %s", ide.File, err)
+	}
+	meta, err := ide.Load(projectRoot)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	if asJSON {
+		data, _ := json.MarshalIndent(meta, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	console.Success("Wrote %s", ide.Path(projectRoot))
+	console.Info("Interpreter: %s", meta.Interpreter)
+	failed := false
+	if vscode {
+		if path, err := meta.WriteVSCode(projectRoot); err != nil {
+			console.Error("%s", err)
+			failed = true
+		} else {
+			console.Success("Updated %s", path)
+		}
+	}
+	if pycharm {
+		if path, err := meta.WritePyCharm(projectRoot); err != nil {
+			console.Error("%s", err)
+			failed = true
+		} else {
+			console.Success("Updated %s", path)
+			console.Print("    → Add the interpreter once in PyCharm: Settings → Python Interpreter → Add Interpreter")
+			console.Print("      → Existing, %s, named \"%s\"", meta.Interpreter, meta.SDKName())
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// projectRepo returns the project and the git repository it is in, and
+// the project's path relative to the repository root
+func projectRepo() (string, *githooks.Repo, string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	repo, err := githooks.FindRepo(projectRoot)
+	if err != nil {
+		console.Fatal("Not in a git repository: %s", err)
+	}
+	root, err := filepath.EvalSymlinks(repo.Root)
+	if err != nil {
+		root = repo.Root
+	}
+	project, err := filepath.EvalSymlinks(projectRoot)
+	if err != nil {
+		project = projectRoot
+	}
+	rel, err := filepath.Rel(root, project)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		console.Fatal("%s is not inside the work tree of %s", projectRoot, repo.Root)
+	}
+	return projectRoot, repo, filepath.ToSlash(rel)
+}
+
+func runGithooksInstall(cmd *cobra.Command, args []string) {
+	hooks, _ := cmd.Flags().GetStringSlice("hook")
+	test, _ := cmd.Flags().GetString("test")
+	testOn, _ := cmd.Flags().GetString("test-on")
+	force, _ := cmd.Flags().GetBool("force")
+	for _, hook := range append(append([]string{}, hooks...), testOn) {
+		if !containsString(githooks.Names, hook) {
+			console.Fatal("Unknown hook '%s' (supported: %s)", hook, strings.Join(githooks.Names, ", "))
+		}
+	}
+	if test != "" && !containsString(hooks, testOn) {
+		console.Fatal("--test-on %s is not one of the hooks to install", testOn)
+	}
+
+	_, repo, project := projectRepo()
+	self, err := os.Executable()
+	if err != nil {
+		console.Fatal("Failed to locate the sbox binary: %s", err)
+	}
+
+	failed := false
+	for _, name := range hooks {
+		hookTest := ""
+		if name == testOn {
+			hookTest = test
+		}
+		hook, err := repo.Install(name, self, project, hookTest, force)
+		if err != nil {
+			console.Error("%s", err)
+			failed = true
+			continue
+		}
+		what := "sbox validate"
+		if hook.Test != "" {
+			what += ", then " + hook.Test
+		}
+		console.Success("%s → %s", hook.Path, what)
+		if hook.Chained {
+			console.Info("Runs %s first", filepath.Base(hook.Path)+githooks.BackupSuffix)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runGithooksUninstall(cmd *cobra.Command, args []string) {
+	_, repo, _ := projectRepo()
+	removed := 0
+	for _, name := range githooks.Names {
+		ok, err := repo.Uninstall(name)
+		if err != nil {
+			console.Fatal("Failed to remove the %s hook: %s", name, err)
+		}
+		if ok {
+			console.Success("Removed %s", filepath.Join(repo.HooksDir, name))
+			removed++
+			if _, err := os.Stat(filepath.Join(repo.HooksDir, name)); err == nil {
+				console.Info("Restored the %s hook it replaced", name)
+			}
+		}
+	}
+	if removed == 0 {
+		console.Info("No sbox git hooks in %s", repo.HooksDir)
+	}
+}
+
+func runGithooksList(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	_, repo, _ := projectRepo()
+	hooks := repo.List()
+	if asJSON {
+		if hooks == nil {
+			hooks = []githooks.Hook{}
+		}
+		data, _ := json.MarshalIndent(hooks, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if len(hooks) == 0 {
+		console.Info("No sbox git hooks in %s", repo.HooksDir)
+		console.Print("    → Install them with 'sbox githooks install'")
+		return
+	}
+	fmt.Printf("  %-12s %-20s %s\n", "HOOK", "PROJECT", "RUNS")
+	for _, hook := range hooks {
+		runs := "sbox validate"
+		if hook.Test != "" {
+			runs += ", " + hook.Test
+		}
+		if hook.Chained {
+			runs = hook.Name + githooks.BackupSuffix + ", " + runs
+		}
+		fmt.Printf("  %-12s %-20s %s\n", hook.Name, hook.Project, runs)
+	}
+}
+
+// systemProject is a project of 'sbox system df'
+type systemProject struct {
+	Root string `json:"root"`
+	Size int64  `json:"size"`
+	// Reclaimable is the size of the build artifacts of idle projects
+	Reclaimable int64     `json:"reclaimable,omitempty"`
+	Built       time.Time `json:"built,omitempty"`
+	Used        time.Time `json:"used,omitempty"`
+	// State is ok, idle (not active for --older-than), running (has
+	// daemons) or missing (deleted)
+	State string `json:"state"`
+}
+
+// buildArtifacts are what 'sbox system prune' removes from idle projects,
+// relative to .sbox
+var buildArtifacts = []string{"env", "rootfs", "mamba", "bin", config.EnvScript, ide.File}
+
+// buildArtifactPaths returns the build artifacts a project has
+func buildArtifactPaths(projectRoot string) []string {
+	var paths []string
+	for _, name := range buildArtifacts {
+		path := filepath.Join(config.GetSboxDir(projectRoot), name)
+		if _, err := os.Lstat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// systemProjects returns every known project with its disk usage and state
+func systemProjects(olderThan time.Duration) []systemProject {
+	entries, err := process.ListProjects()
+	if err != nil {
+		console.Fatal("Failed to read the project index: %s", err)
+	}
+	var projects []systemProject
+	for _, e := range entries {
+		p := systemProject{Root: e.Root, Built: e.Built, Used: e.Used, State: "ok"}
+		switch {
+		case !process.ProjectExists(e.Root):
+			p.State = "missing"
+		default:
+			p.Size = getDirSize(config.GetSboxDir(e.Root))
+			if running, _ := process.NewProcessManager(e.Root).GetRunningProcesses(); len(running) > 0 {
+				p.State = "running"
+			} else if time.Since(e.LastActive()) > olderThan {
+				p.State = "idle"
+				for _, path := range buildArtifactPaths(e.Root) {
+					p.Reclaimable += getDirSize(path)
+				}
+			}
+		}
+		projects = append(projects, p)
+	}
+	return projects
+}
+
+func runSystemDf(cmd *cobra.Command, args []string) {
+	olderThan, _ := cmd.Flags().GetDuration("older-than")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	projects := systemProjects(olderThan)
+
+	if asJSON {
+		if projects == nil {
+			projects = []systemProject{}
+		}
+		data, _ := json.MarshalIndent(projects, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if len(projects) == 0 {
+		console.Info("No sbox projects known on this machine yet")
+		return
+	}
+
+	fmt.Printf("  %-44s %10s  %-12s %s\n", "PROJECT", "SIZE", "LAST ACTIVE", "STATE")
+	var total, reclaimable int64
+	missing := 0
+	for _, p := range projects {
+		active := "-"
+		if last := (process.ProjectEntry{Built: p.Built, Used: p.Used}).LastActive(); !last.IsZero() {
+			active = formatDuration(time.Since(last)) + " ago"
+		}
+		size := "-"
+		if p.State != "missing" {
+			size = formatBytes(p.Size)
+		}
+		fmt.Printf("  %-44s %10s  %-12s %s\n", p.Root, size, active, p.State)
+		total += p.Size
+		reclaimable += p.Reclaimable
+		if p.State == "missing" {
+			missing++
+		}
+	}
+	fmt.Println()
+	console.Print("  Total: %s in %d project(s)", formatBytes(total), len(projects)-missing)
+	if cm, err := cache.NewManager(); err == nil {
+		if info, err := cm.GetCacheInfo(); err == nil {
+			console.Print("  Shared cache: %s (%s)", formatBytes(info.TotalSize), info.Path)
+		}
+	}
+	if reclaimable > 0 || missing > 0 {
+		console.Print("    → 'sbox system prune' reclaims %s from idle projects and forgets %d deleted one(s)", formatBytes(reclaimable), missing)
+	}
+}
+
+func runSystemPrune(cmd *cobra.Command, args []string) {
+	olderThan, _ := cmd.Flags().GetDuration("older-than")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	var forget []string
+	var items []confirmItem
+	var paths []string
+	var total int64
+	for _, p := range systemProjects(olderThan) {
+		switch p.State {
+		case "missing":
+			forget = append(forget, p.Root)
+			items = append(items, confirmItem{p.Root, "deleted; forget it"})
+		case "idle":
+			if p.Reclaimable > 0 {
+				paths = append(paths, buildArtifactPaths(p.Root)...)
+				total += p.Reclaimable
+				items = append(items, confirmItem{p.Root, formatBytes(p.Reclaimable)})
+			}
+		}
+	}
+	if len(items) == 0 {
+		console.Info("Nothing to prune")
+		return
+	}
+	if dryRun {
+		console.Step("Would prune (older than %s):", formatDuration(olderThan))
+		for _, item := range items {
+			console.Print("  %s  %s", item.label, item.detail)
+		}
+		console.Print("  Total: %s", formatBytes(total))
+		return
+	}
+	confirm(cmd, "Removing the build artifacts of idle projects and forgetting deleted ones:", items, "Prune them?")
+
+	for _, root := range forget {
+		if err := process.ForgetProject(root); err != nil {
+			console.Warning("Failed to forget %s: %s", root, err)
+		}
+	}
+	failed := false
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			console.Error("Failed to remove %s: %s", path, err)
+			failed = true
+		}
+	}
+	console.Success("Reclaimed %s, forgot %d deleted project(s)", formatBytes(total), len(forget))
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runTrashEmpty(cmd *cobra.Command, args []string) {
+	olderThan, _ := cmd.Flags().GetDuration("older-than")
+	removed, size, err := trash.Purge(olderThan)
+	if err != nil {
+		console.Fatal("Failed to empty the trash: %s", err)
+	}
+	if removed == 0 {
+		console.Info("Nothing to delete")
+		return
+	}
+	console.Success("Deleted %d trash entr(ies) (%s)", removed, formatBytes(size))
+}
+
+func runInfo(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+
+	sboxDir := config.GetSboxDir(projectRoot)
+	envDir := config.GetEnvDir(projectRoot)
+	rootfsDir := config.GetRootfsDir(projectRoot)
+
+	fmt.Println()
+	console.Step("Environment Information")
+	fmt.Println()
+
+	console.Print("  ┌─ Paths")
+	console.Print("  │  Project root:  %s", projectRoot)
+	console.Print("  │  Sbox dir:      %s", sboxDir)
+	console.Print("  │  Environment:   %s", envDir)
+	console.Print("  │  Rootfs:        %s", rootfsDir)
+	fmt.Println()
+
+	console.Print("  ┌─ Runtime")
+	runtimeInfo := cfg.ParseRuntime()
+	console.Print("  │  Language:  %s", runtimeInfo.Language)
+	console.Print("  │  Version:   %s", runtimeInfo.Version)
+
+	// Check for runtime binary
+	var binaryPath string
+	if spec, ok := config.LookupRuntime(runtimeInfo.Language); ok {
+		binaryPath = spec.BinaryPath(envDir)
+	}
+
+	if binaryPath != "" {
+		if info, err := os.Stat(binaryPath); err == nil {
+			console.Print("  │  Binary:    %s (%s)", binaryPath, process.FormatBytes(info.Size()))
+		} else {
+			console.Print("  │  Binary:    Not installed")
+		}
+	}
+	fmt.Println()
+
+	// Directory sizes
+	console.Print("  ┌─ Disk Usage")
+	dirs := map[string]string{
+		"Environment": envDir,
+		"Rootfs":      rootfsDir,
+		"Logs":        filepath.Join(sboxDir, "logs"),
+	}
+	for name, path := range dirs {
+		size := getDirSize(path)
+		console.Print("  │  %-12s %s", name+":", process.FormatBytes(size))
+	}
+	fmt.Println()
+
+	// Environment variables
+	if len(cfg.Env) > 0 {
+		console.Print("  ┌─ Environment Variables")
+		showSecrets, _ := cmd.Flags().GetBool("show-secrets")
+		for key, value := range cfg.Env {
+			// Mask sensitive values
+			displayValue := value
+			if !showSecrets && config.IsSensitiveEnv(key) {
+				displayValue = "********"
+			}
+			console.Print("  │  %s=%s", key, displayValue)
+		}
+		fmt.Println()
+	}
+
+	// Copy specs
+	if len(cfg.Copy) > 0 {
+		console.Print("  ┌─ File Mappings (copy)")
+		for _, spec := range cfg.ParseCopy() {
+			console.Print("  │  %s → %s", spec.Src, spec.Dst)
+		}
+		fmt.Println()
+	}
+
+	// Mount specs
+	if len(cfg.Mount) > 0 {
+		console.Print("  ┌─ Directory Mounts (symlink)")
+		for _, spec := range cfg.ParseMount() {
+			mode := "rw"
 			if spec.ReadOnly {
 				mode = "ro"
 			}
-			console.Print("  │  %s → %s (%s)", spec.Src, spec.Dst, mode)
+			console.Print("  │  %s → %s (%s)", spec.Src, spec.Dst, mode)
+		}
+		fmt.Println()
+	}
+
+	// Install commands
+	if len(cfg.Install) > 0 {
+		console.Print("  ┌─ Install Commands")
+		for i, cmd := range cfg.Install {
+			console.Print("  │  %d. %s", i+1, cmd)
+		}
+		fmt.Println()
+	}
+
+	// Lifecycle hooks
+	hasHooks := false
+	for _, stage := range config.HookStages {
+		hasHooks = hasHooks || len(cfg.Hooks(stage)) > 0
+	}
+	if hasHooks {
+		console.Print("  ┌─ Hooks")
+		for _, stage := range config.HookStages {
+			for _, hook := range cfg.Hooks(stage) {
+				console.Print("  │  %-11s %s", stage+":", hook)
+			}
+		}
+		fmt.Println()
+	}
+}
+
+// applyOutputFormat switches the console to the format of --output,
+// --log-format or $SBOX_OUTPUT. pack, pull, module generate and slurm
+// have an --output file flag of their own that shadows the global one,
+// so only --log-format and the variable apply to them. Commands printing
+// data for scripts keep stdout for it.
+func applyOutputFormat(cmd *cobra.Command) {
+	format, _ := cmd.Root().PersistentFlags().GetString("output")
+	if format == "" {
+		format, _ = cmd.Root().PersistentFlags().GetString("log-format")
+	}
+	if format == "" {
+		format = os.Getenv(console.OutputEnv)
+	}
+	if err := console.SetFormat(format); err != nil {
+		console.Fatal("%s", err)
+	}
+	asJSON, _ := cmd.Flags().GetBool("json")
+	toStdout, _ := cmd.Flags().GetBool("stdout")
+	if asJSON || toStdout || dataCommands[cmd.CommandPath()] {
+		console.KeepStdout()
+	}
+}
+
+// dataCommands print data for scripts on stdout without a --json or
+// --stdout flag
+var dataCommands = map[string]bool{
+	"sbox inspect": true, "sbox secret get": true, "sbox config get": true,
+}
+
+// applyProfile selects the profile of --profile by exporting it as
+// $SBOX_PROFILE, so config.Load and the sbox processes started for
+// daemons and watch apply it too
+func applyProfile(cmd *cobra.Command) {
+	name, _ := cmd.Root().PersistentFlags().GetString("profile")
+	if name != "" {
+		os.Setenv(config.ProfileEnv, name)
+	}
+}
+
+// nestedCommands enter or build a sandbox, which another project's
+// sandbox must not be layered under
+var nestedCommands = map[string]bool{
+	"sbox build": true, "sbox run": true, "sbox shell": true, "sbox exec": true,
+	"sbox bench": true, "sbox watch": true, "sbox restart": true, "sbox profile run": true,
+	"sbox check-isolation": true, "sbox repro": true, "sbox compose up": true,
+}
+
+// checkNested takes the sandbox sbox runs in, if any, out of its
+// environment, so commands start from the host's. Entering or building
+// another project's sandbox is refused without --allow-nested: its
+// commands would see the outer project's env vars. Hidden commands run
+// in the environment sbox prepared for them and are left alone.
+func checkNested(cmd *cobra.Command) {
+	outer := nesting.Detect()
+	if outer == nil || cmd.Hidden {
+		return
+	}
+	outer.Leave()
+	if !nestedCommands[cmd.CommandPath()] {
+		return
+	}
+	// exec --project, as shims run it, names the sandbox to enter
+	project := ""
+	if flag := cmd.Flags().Lookup("project"); flag != nil {
+		project = flag.Value.String()
+	}
+	projectRoot, err := config.GetProjectRoot(project)
+	if err != nil || outer.Same(projectRoot) {
+		return
+	}
+
+	allow, _ := cmd.Root().PersistentFlags().GetBool("allow-nested")
+	if !allow && os.Getenv(nesting.AllowEnv) != "1" {
+		console.Fatal("Already inside the sandbox of %s\n    → Exit it first, or pass --allow-nested to enter %s from it", outer.ProjectRoot, projectRoot)
+	}
+	console.Warning("Nested sandbox: entering %s from the sandbox of %s; its env vars stay visible", projectRoot, outer.ProjectRoot)
+}
+
+// warnProfileMismatch warns when the sandbox was built with another
+// profile, whose install commands may differ from the selected one's
+func warnProfileMismatch(projectRoot string, cfg *config.Config) {
+	lock, err := config.LoadLock(projectRoot)
+	if err != nil || lock.Profile == cfg.Profile() || config.IsUpToDate(projectRoot, cfg) {
+		return
+	}
+	built := "no profile"
+	if lock.Profile != "" {
+		built = "profile '" + lock.Profile + "'"
+	}
+	rebuild := "sbox build"
+	if cfg.Profile() != "" {
+		rebuild += " --profile " + cfg.Profile()
+	}
+	console.Warning("Sandbox was built with %s; run '%s' to rebuild it for this one", built, rebuild)
+}
+
+// reportExit records the exit status of a foreground command as an
+// event; text output leaves that to the shell
+func reportExit(exitCode int) {
+	if console.JSON() {
+		console.Emit(console.LevelInfo, console.Fields{"exit_code": exitCode}, "Command exited with status %d", exitCode)
+	}
+}
+
+// applySharedUmask keeps files created by this invocation group-writable
+// when the current project is shared between users
+func applySharedUmask() {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		return
+	}
+	if cfg, err := config.Load(projectRoot); err == nil && cfg.Shared {
+		sysproc.Umask(0002)
+	}
+}
+
+// auditCommand records a privileged command in the project audit log,
+// with the arguments in redact, such as a secret's value, left out
+func auditCommand(projectRoot string, cmd *cobra.Command, redact ...string) {
+	args := append([]string{}, os.Args[1:]...)
+	for i, arg := range args {
+		for _, secret := range redact {
+			if secret != "" && arg == secret {
+				args[i] = "[redacted]"
+			}
+		}
+	}
+	if err := audit.Record(projectRoot, cmd.CommandPath(), args); err != nil {
+		console.Warning("Failed to write audit log: %s", err)
+	}
+}
+
+func runAuditLog(cmd *cobra.Command, args []string) {
+	lines, _ := cmd.Flags().GetInt("lines")
+	userFilter, _ := cmd.Flags().GetString("user")
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	entries, err := audit.Load(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to read audit log: %s", err)
+	}
+
+	if userFilter != "" {
+		filtered := []audit.Entry{}
+		for _, e := range entries {
+			if e.User == userFilter {
+				filtered = append(filtered, e)
+			}
+		}
+		entries = filtered
+	}
+
+	if lines > 0 && len(entries) > lines {
+		entries = entries[len(entries)-lines:]
+	}
+
+	if asJSON {
+		data, _ := json.MarshalIndent(entries, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	if len(entries) == 0 {
+		console.Info("No audited operations recorded")
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("  %-20s %-12s %-16s %s\n", "TIME", "USER", "HOST", "COMMAND")
+	fmt.Printf("  %-20s %-12s %-16s %s\n", "----", "----", "----", "-------")
+	for _, e := range entries {
+		fmt.Printf("  %-20s %-12s %-16s sbox %s\n", e.Time.Format("2006-01-02 15:04:05"), e.User, e.Host, strings.Join(e.Args, " "))
+	}
+	fmt.Println()
+}
+
+// Helper functions
+
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+	if d < time.Hour {
+		return fmt.Sprintf("%dm%ds", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	if d < 24*time.Hour {
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	return fmt.Sprintf("%dd%dh", days, hours)
+}
+
+func getDirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// For status command - load lock file
+func loadLockJSON(path string) map[string]interface{} {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var result map[string]interface{}
+	json.Unmarshal(data, &result)
+	return result
+}
+
+func runValidate(cmd *cobra.Command, args []string) {
+	quiet, _ := cmd.Flags().GetBool("quiet")
+	fix, _ := cmd.Flags().GetBool("fix")
+
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project. Run 'sbox init <name>' first.")
+	}
+
+	configPath := config.GetConfigPath(projectRoot)
+
+	fmt.Println()
+	console.Step("Validating configuration: %s", configPath)
+	fmt.Println()
+
+	// Check if config file exists
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		console.Fatal("Config file not found: %s\n  → Run 'sbox init <name>' to create a new project", configPath)
+	}
+
+	// Load config
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		console.Error("Failed to parse config file:")
+		console.Print("  %s", err)
+		fmt.Println()
+		console.Print("Common causes:")
+		console.Print("  • Invalid YAML syntax (check indentation)")
+		console.Print("  • Missing colons after field names")
+		console.Print("  • Unquoted special characters")
+		fmt.Println()
+		console.Print("Example valid config:")
+		fmt.Println()
+		console.Print(validate.GetConfigExample("python"))
+		os.Exit(1)
+	}
+
+	// Validate
+	result := validate.ValidateConfig(cfg, projectRoot)
+
+	// Display results
+	if len(result.Errors) > 0 {
+		console.Error("Configuration errors (%d):", len(result.Errors))
+		fmt.Println()
+		for i, verr := range result.Errors {
+			console.Print("  %d. [%s] %s", i+1, verr.Field, verr.Message)
+			if verr.Hint != "" {
+				console.Print("     → %s", verr.Hint)
+			}
+			fmt.Println()
+		}
+	}
+
+	if !quiet && len(result.Warnings) > 0 {
+		console.Warning("Configuration warnings (%d):", len(result.Warnings))
+		fmt.Println()
+		for i, warn := range result.Warnings {
+			console.Print("  %d. [%s] %s", i+1, warn.Field, warn.Message)
+			if warn.Hint != "" {
+				console.Print("     → %s", warn.Hint)
+			}
+			fmt.Println()
+		}
+	}
+
+	// Summary
+	fmt.Println()
+	if result.Valid {
+		if len(result.Warnings) > 0 {
+			console.Success("Configuration is valid with %d warning(s)", len(result.Warnings))
+		} else {
+			console.Success("Configuration is valid")
+		}
+		fmt.Println()
+		console.Print("  You can now run:")
+		console.Print("    sbox build     Build the sandbox")
+		console.Print("    sbox run       Run the application")
+	} else {
+		console.Error("Configuration is invalid with %d error(s)", len(result.Errors))
+		fmt.Println()
+		console.Print("  Please fix the errors above and run 'sbox validate' again.")
+
+		if fix {
+			fmt.Println()
+			console.Info("Auto-fix is not yet implemented.")
+			console.Print("  Please manually edit: %s", configPath)
+		}
+
+		os.Exit(1)
+	}
+	fmt.Println()
+
+	// Show config summary
+	console.Print("  ┌─ Config Summary")
+	console.Print("  │  Runtime:  %s", cfg.Runtime)
+	console.Print("  │  Workdir:  %s", cfg.Workdir)
+	console.Print("  │  Command:  %s", cfg.Cmd)
+	console.Print("  │  Copy:     %d mapping(s)", len(cfg.Copy))
+	console.Print("  │  Mount:    %d mount(s)", len(cfg.Mount))
+	console.Print("  │  Install:  %d command(s)", len(cfg.Install))
+	console.Print("  │  Env vars: %d defined", len(cfg.Env))
+	fmt.Println()
+}
+
+func runDoctor(cmd *cobra.Command, args []string) {
+	offline, _ := cmd.Flags().GetBool("offline")
+
+	// Project checks are optional
+	projectRoot, _ := config.GetProjectRoot("")
+
+	fmt.Println()
+	console.Step("Running diagnostics...")
+	fmt.Println()
+
+	warnings, failures := 0, 0
+	for _, check := range doctor.Run(projectRoot, offline) {
+		switch check.Status {
+		case doctor.OK:
+			console.Print("  \033[32m[✓]\033[0m %s: %s", check.Name, check.Detail)
+		case doctor.Warn:
+			warnings++
+			console.Print("  \033[33m[!]\033[0m %s: %s", check.Name, check.Detail)
+		case doctor.Fail:
+			failures++
+			console.Print("  \033[31m[✗]\033[0m %s: %s", check.Name, check.Detail)
+		}
+		if check.Status != doctor.OK && check.Fix != "" {
+			console.Print("      → %s", check.Fix)
+		}
+	}
+	fmt.Println()
+
+	switch {
+	case failures > 0:
+		console.Error("%d problem(s) and %d warning(s) found", failures, warnings)
+		os.Exit(1)
+	case warnings > 0:
+		console.Warning("No problems, %d warning(s)", warnings)
+	default:
+		console.Success("No issues found")
+	}
+}
+
+func runCheckIsolation(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	r, err := runner.New(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	if err := r.CheckBuilt(); err != nil {
+		console.Fatal("%s", err)
+	}
+
+	command := r.Config.Cmd
+	if len(args) > 0 {
+		command = args[0]
+	}
+	if command == "" {
+		console.Fatal("No command specified and no default cmd in config")
+	}
+
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	lite, _ := cmd.Flags().GetBool("lite")
+	showAll, _ := cmd.Flags().GetBool("all")
+
+	// The project, declared mounts and host_libs are part of the sandbox
+	allowed := []string{projectRoot}
+	for _, spec := range r.Config.ParseMount() {
+		src := spec.Src
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(projectRoot, src)
+		}
+		allowed = append(allowed, src)
+		if resolved, err := filepath.EvalSymlinks(src); err == nil {
+			allowed = append(allowed, resolved)
+		}
+	}
+	allowed = append(allowed, r.HostLibDirs()...)
+	if r.Config.UsesGPU() {
+		allowed = append(allowed, gpu.DriverLibraries()...)
+	}
+
+	opts := leakcheck.Options{
+		Dir:     r.ResolveWorkdir(),
+		Env:     r.BuildEnv(),
+		Timeout: timeout,
+		Python:  r.Config.ParseRuntime().Language == "python",
+		Lite:    lite,
+	}
+
+	console.Step("Tracing: %s (stopping after %s)", command, timeout)
+	fmt.Println()
+	result, err := leakcheck.Run(command, opts)
+	if err != nil && !opts.Lite {
+		console.Warning("%s; retrying with LD_DEBUG", err)
+		opts.Lite = true
+		result, err = leakcheck.Run(command, opts)
+	}
+	if err != nil {
+		console.Fatal("Trace failed: %s", err)
+	}
+	fmt.Println()
+
+	switch {
+	case result.TimedOut:
+		console.Info("Stopped after %s", timeout)
+	case result.ExitCode != 0:
+		console.Warning("Command exited with status %d; only files opened until then were seen", result.ExitCode)
+	}
+	if result.Method == leakcheck.MethodLite {
+		console.Info("Traced with LD_DEBUG: only shared libraries (and Python imports) are seen; install strace for every file")
+	}
+
+	home, _ := os.UserHomeDir()
+	findings := leakcheck.Classify(result.Accesses, allowed, home)
+	groups := leakcheck.Group(findings)
+
+	leaks, notes := 0, 0
+	for _, category := range leakcheck.Categories {
+		paths := groups[category]
+		if len(paths) == 0 {
+			continue
+		}
+		if leakcheck.Leak(category) {
+			leaks += len(paths)
+		} else {
+			notes += len(paths)
+		}
+
+		fmt.Println()
+		console.Print("  ┌─ %s (%d)", strings.ToUpper(category[:1])+category[1:], len(paths))
+		shown := paths
+		if !showAll && len(shown) > 10 {
+			shown = shown[:10]
+		}
+		for _, path := range shown {
+			console.Print("  │  %s", path)
+		}
+		if len(shown) < len(paths) {
+			console.Print("  │  ... and %d more (--all lists them)", len(paths)-len(shown))
+		}
+		if hint := leakcheck.Hint(category); hint != "" {
+			console.Print("    → %s", hint)
+		}
+	}
+	fmt.Println()
+
+	switch {
+	case leaks > 0:
+		console.Error("%d host file(s) the sandbox depends on; it may fail on other hosts", leaks)
+		os.Exit(1)
+	case notes > 0:
+		console.Warning("No leaks, %d host file(s) worth a look", notes)
+	default:
+		console.Success("No leaks: %d file(s) traced, all in the sandbox or standard system files", len(result.Accesses))
+	}
+}
+
+func runRepro(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	if !config.IsBuilt(projectRoot) {
+		console.Fatal("Sandbox not built. Run 'sbox build' first.")
+	}
+	if !config.IsUpToDate(projectRoot, cfg) {
+		console.Fatal("Build is out of date with config.yaml. Run 'sbox build' first.")
+	}
+
+	savePath, _ := cmd.Flags().GetString("save")
+	against, _ := cmd.Flags().GetString("against")
+	frozen, _ := cmd.Flags().GetBool("frozen")
+	keep, _ := cmd.Flags().GetBool("keep")
+	showAll, _ := cmd.Flags().GetBool("all")
+	if savePath != "" && against != "" {
+		console.Fatal("--save and --against cannot be combined")
+	}
+
+	console.Step("Scanning the current build...")
+	current, err := repro.Scan(projectRoot)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	if savePath != "" {
+		if err := current.Save(savePath); err != nil {
+			console.Fatal("Failed to write manifest: %s", err)
+		}
+		console.Success("Manifest of %d file(s) written to %s", len(current.Files), savePath)
+		return
+	}
+
+	// The scratch build is removed on every exit path unless kept
+	var scratch string
+	cleanup := func() {
+		if scratch != "" && !keep {
+			os.RemoveAll(scratch)
+		}
+	}
+	defer cleanup()
+	fatal := func(format string, args ...interface{}) {
+		cleanup()
+		console.Fatal(format, args...)
+	}
+
+	var ref, other repro.Build
+	if against != "" {
+		manifest, err := repro.Load(against)
+		if err != nil {
+			console.Fatal("%s", err)
+		}
+		if manifest.Platform != "" && manifest.Platform != current.Platform {
+			console.Warning("%s was made on %s; binaries of %s will differ", against, manifest.Platform, current.Platform)
+		}
+		if manifest.Files == nil {
+			console.Info("%s has no file list; comparing package versions only", against)
+		}
+		ref = repro.Build{Manifest: manifest}
+		other = repro.Build{Manifest: current, Root: projectRoot}
+	} else {
+		if scratch, err = os.MkdirTemp("", "sbox-repro-"); err != nil {
+			console.Fatal("%s", err)
+		}
+		scratchRoot := filepath.Join(scratch, filepath.Base(projectRoot))
+
+		console.Step("Copying the project to %s", scratchRoot)
+		if err := repro.Stage(projectRoot, scratchRoot); err != nil {
+			fatal("Failed to copy the project: %s", err)
+		}
+
+		b, err := builder.New(scratchRoot)
+		if err != nil {
+			fatal("Failed to load config: %s", err)
+		}
+		b.Frozen = frozen
+		fmt.Println()
+		if err := b.Build(true); err != nil {
+			fatal("Second build failed: %s", err)
+		}
+		fmt.Println()
+
+		console.Step("Scanning the second build...")
+		second, err := repro.Scan(scratchRoot)
+		if err != nil {
+			fatal("%s", err)
+		}
+		if keep {
+			console.Info("Scratch build kept in %s", scratchRoot)
+		}
+		ref = repro.Build{Manifest: current, Root: projectRoot}
+		other = repro.Build{Manifest: second, Root: scratchRoot}
+	}
+
+	diffs := repro.Compare(ref, other)
+	groups := repro.Group(diffs)
+
+	differing, expected := 0, 0
+	for _, cause := range repro.Causes {
+		paths := groups[cause]
+		if len(paths) == 0 {
+			continue
+		}
+		if repro.Expected(cause) {
+			expected += len(paths)
+		} else {
+			differing += len(paths)
+		}
+
+		fmt.Println()
+		console.Print("  ┌─ %s (%d)", strings.ToUpper(cause[:1])+cause[1:], len(paths))
+		shown := paths
+		if !showAll && len(shown) > 10 {
+			shown = shown[:10]
+		}
+		for _, path := range shown {
+			console.Print("  │  %s", path)
+		}
+		if len(shown) < len(paths) {
+			console.Print("  │  ... and %d more (--all lists them)", len(paths)-len(shown))
+		}
+		if hint := repro.Hint(cause); hint != "" {
+			console.Print("    → %s", hint)
+		}
+	}
+	fmt.Println()
+
+	switch {
+	case differing > 0:
+		console.Error("%d difference(s); the build is not reproducible", differing)
+		cleanup()
+		os.Exit(1)
+	case expected > 0:
+		console.Success("Reproducible: %d file(s) identical apart from %d installer metadata file(s)", len(current.Files)-expected, expected)
+	default:
+		console.Success("Reproducible: %d file(s) identical", len(current.Files))
+	}
+}
+
+func runLicenses(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	if !config.IsBuilt(projectRoot) {
+		console.Fatal("Sandbox not built. Run 'sbox build' first.")
+	}
+
+	format, _ := cmd.Flags().GetString("format")
+	allow, _ := cmd.Flags().GetStringSlice("allow")
+	deny, _ := cmd.Flags().GetStringSlice("deny")
+	policy := cfg.Licenses
+	policy.Allow = append(append([]string{}, policy.Allow...), allow...)
+	policy.Deny = append(append([]string{}, policy.Deny...), deny...)
+	checked := len(policy.Allow)+len(policy.Deny) > 0
+
+	packages, err := licenses.Collect(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to read package metadata: %s", err)
+	}
+	violations := licenses.Check(packages, policy)
+
+	switch format {
+	case "json":
+		data, _ := json.MarshalIndent(packages, "", "  ")
+		fmt.Println(string(data))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"manager", "name", "version", "license", "status"})
+		for _, p := range packages {
+			w.Write([]string{p.Manager, p.Name, p.Version, p.License, p.Status})
+		}
+		w.Flush()
+	case "table":
+		if len(packages) == 0 {
+			console.Info("No packages found in the build")
+			return
+		}
+		unknown := 0
+		row := func(columns ...interface{}) {
+			line := fmt.Sprintf("  %-7s %-32s %-16s %-32s %s", columns...)
+			fmt.Println(strings.TrimRight(line, " "))
+		}
+		row("MANAGER", "NAME", "VERSION", "LICENSE", "STATUS")
+		row("-------", "----", "-------", "-------", "------")
+		for _, p := range packages {
+			license := p.License
+			if license == "" {
+				license = "-"
+				unknown++
+			}
+			status := ""
+			if checked {
+				status = p.Status
+			}
+			row(p.Manager, p.Name, p.Version, license, status)
+		}
+		fmt.Println()
+		console.Info("%d package(s), %d without license information", len(packages), unknown)
+	default:
+		console.Fatal("Unknown format %q (use table, json or csv)", format)
+	}
+
+	switch {
+	case violations > 0:
+		console.Error("%d package(s) violate the license policy", violations)
+		os.Exit(1)
+	case checked && format == "table":
+		console.Success("All packages comply with the license policy")
+	}
+}
+
+func runDashboard(cmd *cobra.Command, args []string) {
+	listen, _ := cmd.Flags().GetString("listen")
+	extra, _ := cmd.Flags().GetStringSlice("project")
+
+	roots := serverProjectRoots(extra)
+	if len(roots) == 0 {
+		console.Fatal("No sbox projects to show. Run inside a project or pass --project <dir>.")
+	}
+
+	console.Step("Serving dashboard for %d project(s)", len(roots))
+	console.Info("Open http://%s in your browser (Ctrl+C to stop)", listen)
+
+	if err := api.NewServer(roots).ListenAndServe(listen); err != nil {
+		console.Fatal("Dashboard server failed: %s", err)
+	}
+}
+
+// serverProjectRoots returns the current project, if any, and those of
+// --project for the dashboard and daemon
+func serverProjectRoots(extra []string) []string {
+	var roots []string
+	if projectRoot, err := config.GetProjectRoot(""); err == nil {
+		roots = append(roots, projectRoot)
+	}
+	for _, p := range extra {
+		root, err := config.GetProjectRoot(p)
+		if err != nil {
+			console.Warning("Skipping %s: %s", p, err)
+			continue
+		}
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+func runDaemon(cmd *cobra.Command, args []string) {
+	socket, _ := cmd.Flags().GetString("socket")
+	extra, _ := cmd.Flags().GetStringSlice("project")
+	if socket == "" {
+		var err error
+		if socket, err = api.DefaultSocket(); err != nil {
+			console.Fatal("%s", err)
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		console.Fatal("Cannot locate the sbox binary: %s", err)
+	}
+
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		console.Fatal("An sbox daemon is already listening on %s", socket)
+	}
+	// A socket left by a daemon that did not shut down cleanly
+	os.Remove(socket)
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		console.Fatal("Failed to create %s: %s", filepath.Dir(socket), err)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		console.Fatal("Failed to listen on %s: %s", socket, err)
+	}
+	// Anyone who can connect can run commands as you
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		console.Fatal("Failed to restrict %s: %s", socket, err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	server := api.NewServer(serverProjectRoots(extra))
+	server.Exec = exe
+	console.Emit(console.LevelStep, console.Fields{"socket": socket, "projects": len(server.ProjectRoots)},
+		"sbox daemon serving %d project(s) on %s", len(server.ProjectRoots), socket)
+	console.Info("Export %s=%s to send build, run and stop to it (Ctrl+C to stop)", api.SocketEnv, socket)
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		console.Fatal("Daemon failed: %s", err)
+	}
+	os.Remove(socket)
+	console.Info("sbox daemon stopped")
+}
+
+// daemonClient returns a client for the daemon of --daemon-socket or
+// $SBOX_DAEMON_SOCKET, or nil when commands run in-process
+func daemonClient(cmd *cobra.Command) *api.Client {
+	socket, _ := cmd.Root().PersistentFlags().GetString("daemon-socket")
+	if socket == "" {
+		socket = os.Getenv(api.SocketEnv)
+	}
+	if socket == "" {
+		return nil
+	}
+	return api.NewClient(socket)
+}
+
+// daemonOptions returns the profile and output format for the daemon to
+// run an operation with
+func daemonOptions() api.Options {
+	opts := api.Options{Profile: os.Getenv(config.ProfileEnv)}
+	if console.JSON() {
+		opts.Output = console.FormatJSON
+	}
+	return opts
+}
+
+// forwardToDaemon registers the project with the daemon, runs an
+// operation there and exits with its exit code
+func forwardToDaemon(client *api.Client, projectRoot, op string, req interface{}) {
+	name, err := client.Register(projectRoot)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	code, err := client.Do(name, op, req, console.Events(), os.Stderr)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	os.Exit(code)
+}
+
+// Config command handlers
+
+// completeConfigKeys completes dotted config keys for the first argument.
+// Wildcard segments are offered as a prefix (e.g. "env.") without a
+// trailing space so the user can type the new name.
+func completeConfigKeys(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	keys := config.SchemaKeys()
+	if projectRoot, err := config.GetProjectRoot(""); err == nil {
+		if cfg, err := config.Load(projectRoot); err == nil {
+			keys = cfg.Keys()
+		}
+	}
+
+	seen := make(map[string]bool)
+	var candidates []string
+	directive := cobra.ShellCompDirectiveNoFileComp
+	for _, key := range keys {
+		wildcard := false
+		if i := strings.Index(key, config.KeyWildcard); i >= 0 {
+			key = key[:i]
+			wildcard = true
+		}
+		if !strings.HasPrefix(key, toComplete) || seen[key] {
+			continue
+		}
+		if wildcard {
+			directive |= cobra.ShellCompDirectiveNoSpace
+		}
+		seen[key] = true
+		candidates = append(candidates, key)
+	}
+	return candidates, directive
+}
+
+func loadConfigForEdit() (string, *config.Config) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+
+	// Edit the config as written, keeping its ${VAR} references
+	cfg, err := config.LoadRaw(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+	return projectRoot, cfg
+}
+
+func runConfigGet(cmd *cobra.Command, args []string) {
+	_, cfg := loadConfigForEdit()
+
+	value, err := cfg.Get(args[0])
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	switch v := value.(type) {
+	case string:
+		fmt.Println(v)
+	case []string:
+		for _, item := range v {
+			fmt.Println(item)
+		}
+	default:
+		data, _ := yaml.Marshal(v)
+		fmt.Print(string(data))
+	}
+}
+
+func runConfigSet(cmd *cobra.Command, args []string) {
+	projectRoot, cfg := loadConfigForEdit()
+
+	if err := cfg.Set(args[0], args[1:]...); err != nil {
+		console.Fatal("%s", err)
+	}
+
+	// Refuse to save a config that would no longer build
+	resolved, err := cfg.Resolve(projectRoot)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	if result := validate.ValidateConfig(resolved, projectRoot); !result.Valid {
+		verr := result.Errors[0]
+		console.Fatal("Invalid value for %s: %s\n  → %s", args[0], verr.Message, verr.Hint)
+	}
+
+	if err := cfg.Save(projectRoot); err != nil {
+		console.Fatal("Failed to save config: %s", err)
+	}
+	console.Success("Set %s", args[0])
+
+	if args[0] == "shared" && cfg.Shared {
+		if err := config.ApplySharedPermissions(projectRoot); err != nil {
+			console.Warning("Failed to apply shared permissions: %s", err)
+		} else {
+			console.Info("Made .sbox group-writable for teammates")
+		}
+	}
+}
+
+func runConfigResolve(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project.")
+	}
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+
+	if showSecrets, _ := cmd.Flags().GetBool("show-secrets"); !showSecrets {
+		for key := range cfg.Env {
+			if config.IsSensitiveEnv(key) {
+				cfg.Env[key] = "********"
+			}
+		}
+	}
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	if unresolved := cfg.Unresolved(); len(unresolved) > 0 {
+		fmt.Printf("# Not set, left as written: %s\n", strings.Join(unresolved, ", "))
+	}
+	fmt.Print(string(data))
+}
+
+func runConfigUnset(cmd *cobra.Command, args []string) {
+	projectRoot, cfg := loadConfigForEdit()
+
+	if err := cfg.Unset(args[0]); err != nil {
+		console.Fatal("%s", err)
+	}
+
+	if err := cfg.Save(projectRoot); err != nil {
+		console.Fatal("Failed to save config: %s", err)
+	}
+	console.Success("Unset %s", args[0])
+}
+
+func runConfigKeys(cmd *cobra.Command, args []string) {
+	schemaOnly, _ := cmd.Flags().GetBool("schema")
+
+	keys := config.SchemaKeys()
+	if !schemaOnly {
+		if projectRoot, err := config.GetProjectRoot(""); err == nil {
+			if cfg, err := config.Load(projectRoot); err == nil {
+				keys = cfg.Keys()
+			}
+		}
+	}
+
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+}
+
+// Cache command handlers
+
+func runCacheList(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	cm, err := cache.NewManager()
+	if err != nil {
+		console.Fatal("Failed to initialize cache: %s", err)
+	}
+
+	runtimes, err := cm.ListCachedRuntimes()
+	if err != nil {
+		console.Fatal("Failed to list cached runtimes: %s", err)
+	}
+
+	if asJSON {
+		data, _ := json.MarshalIndent(runtimes, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	if len(runtimes) == 0 {
+		console.Info("No cached runtimes found")
+		console.Print("  Cache location: %s", cm.CacheRoot)
+		console.Print("  Runtimes will be cached automatically during 'sbox build'")
+		return
+	}
+
+	fmt.Println()
+	console.Step("Cached Runtimes")
+	fmt.Println()
+
+	fmt.Printf("  %-20s %-15s %-12s %-20s %s\n", "RUNTIME", "PLATFORM", "SIZE", "LAST USED", "PATH")
+	fmt.Printf("  %-20s %-15s %-12s %-20s %s\n", "-------", "--------", "----", "---------", "----")
+
+	legacy := 0
+	for _, r := range runtimes {
+		key := cache.GetRuntimeKey(r.Language, r.Version)
+		platform := r.Platform
+		if platform == "" {
+			platform = "legacy"
+			legacy++
+		}
+		lastUsed := r.LastUsed.Format("2006-01-02 15:04")
+		size := cache.FormatBytes(r.Size)
+		fmt.Printf("  %-20s %-15s %-12s %-20s %s\n", key, platform, size, lastUsed, r.Path)
+	}
+
+	fmt.Println()
+
+	if legacy > 0 {
+		console.Print("  Legacy entries predate per-platform caching and are no longer used;")
+		console.Print("  remove them with 'sbox cache clean' or 'sbox cache prune'")
+	}
+
+	// Show micromamba status
+	if cm.IsMicromambaCached() {
+		console.Print("  micromamba: cached (%s)", cm.Platform)
+	}
+
+	// Show total size
+	info, _ := cm.GetCacheInfo()
+	if info != nil {
+		console.Print("  Total cache size: %s", cache.FormatBytes(info.TotalSize))
+	}
+	fmt.Println()
+}
+
+func runCacheClean(cmd *cobra.Command, args []string) {
+	cleanAll, _ := cmd.Flags().GetBool("all")
+
+	cm, err := cache.NewManager()
+	if err != nil {
+		console.Fatal("Failed to initialize cache: %s", err)
+	}
+
+	if len(args) > 0 {
+		// Clean specific runtime
+		runtimeKey := args[0]
+		
+		// Parse runtime key (e.g., "python-3.10" -> language="python", version="3.10")
+		var language, version string
+		for _, name := range config.RuntimeNames() {
+			prefix := name + "-"
+			if len(runtimeKey) > len(prefix) && runtimeKey[:len(prefix)] == prefix {
+				language = prefix[:len(prefix)-1]
+				version = runtimeKey[len(prefix):]
+				break
+			}
+		}
+
+		if language == "" {
+			console.Fatal("Invalid runtime format: %s\n  Expected format: <language>-<version>, e.g. python-3.10 or go-1.22", runtimeKey)
+		}
+
+		console.Step("Removing cached runtime: %s (%s)", runtimeKey, cm.Platform)
+		runtimePath := cm.GetCachedRuntimePath(language, version)
+		if _, err := os.Stat(runtimePath); err != nil {
+			console.Fatal("Runtime %s is not cached", runtimeKey)
+		}
+		trashed := moveToTrash("cache clean "+runtimeKey, runtimePath)
+		console.Success("Runtime removed from cache")
+		printUndoHint(trashed)
+		return
+	}
+
+	if cleanAll {
+		if _, err := os.Stat(cm.CacheRoot); err != nil {
+			console.Info("Cache is already empty")
+			return
+		}
+		var paths []string
+		entries, _ := os.ReadDir(cm.CacheRoot)
+		for _, entry := range entries {
+			paths = append(paths, filepath.Join(cm.CacheRoot, entry.Name()))
+		}
+		confirm(cmd, fmt.Sprintf("cache clean --all moves everything in %s to the trash:", cm.CacheRoot),
+			pathItems(cm.CacheRoot, paths...), "Remove it?")
+		console.Step("Removing all cached data...")
+		trashed := moveToTrash("cache clean --all", cm.CacheRoot)
+		console.Success("Cache cleared completely")
+		printUndoHint(trashed)
+	} else {
+		// Only clean runtimes, keep micromamba
+		runtimes, _ := cm.ListCachedRuntimes()
+		if len(runtimes) == 0 {
+			console.Info("No cached runtimes to remove")
+			return
+		}
+
+		console.Step("Removing %d cached runtime(s)...", len(runtimes))
+		trashed, err := trash.New("cache clean")
+		if err != nil {
+			console.Fatal("Failed to create trash entry: %s", err)
+		}
+		for _, r := range runtimes {
+			if r.Path == "" {
+				continue
+			}
+			if err := trashed.Move(r.Path); err != nil {
+				console.Warning("Failed to remove %s-%s: %s", r.Language, r.Version, err)
+			} else {
+				console.Print("  Removed: %s-%s", r.Language, r.Version)
+			}
+		}
+		trashed.Close()
+		console.Success("Cached runtimes removed")
+		printUndoHint(trashed)
+		console.Info("Use 'sbox cache clean --all' to also remove micromamba")
+	}
+}
+
+func runCachePrune(cmd *cobra.Command, args []string) {
+	olderThan, _ := cmd.Flags().GetDuration("older-than")
+
+	cm, err := cache.NewManager()
+	if err != nil {
+		console.Fatal("Failed to initialize cache: %s", err)
+	}
+
+	console.Step("Pruning runtimes not used in %s...", formatDuration(olderThan))
+
+	pruned, err := cm.PruneCache(olderThan)
+	if err != nil {
+		console.Fatal("Failed to prune cache: %s", err)
+	}
+
+	if pruned == 0 {
+		console.Info("No runtimes to prune")
+	} else {
+		console.Success("Pruned %d runtime(s)", pruned)
+	}
+}
+
+func runCachePath(cmd *cobra.Command, args []string) {
+	cacheDir, err := cache.GetGlobalCacheDir()
+	if err != nil {
+		console.Fatal("Failed to get cache path: %s", err)
+	}
+	fmt.Println(cacheDir)
+}
+
+func runCacheInfo(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	cm, err := cache.NewManager()
+	if err != nil {
+		console.Fatal("Failed to initialize cache: %s", err)
+	}
+
+	info, err := cm.GetCacheInfo()
+	if err != nil {
+		console.Fatal("Failed to get cache info: %s", err)
+	}
+
+	if asJSON {
+		data, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	fmt.Println()
+	console.Step("Cache Information")
+	fmt.Println()
+
+	console.Print("  ┌─ Location")
+	console.Print("  │  Path:       %s", info.Path)
+	console.Print("  │  Platform:   %s", cm.Platform)
+	console.Print("  │  Total size: %s", cache.FormatBytes(info.TotalSize))
+	fmt.Println()
+
+	console.Print("  ┌─ Cached Runtimes (%d)", info.RuntimeCount)
+	if info.RuntimeCount == 0 {
+		console.Print("  │  No runtimes cached yet")
+	} else {
+		for _, r := range info.Runtimes {
+			platform := r.Platform
+			if platform == "" {
+				platform = "legacy"
+			}
+			console.Print("  │  • %s-%s [%s] (%s)", r.Language, r.Version, platform, cache.FormatBytes(r.Size))
+			console.Print("  │    Last used: %s", r.LastUsed.Format("2006-01-02 15:04:05"))
+		}
+	}
+	fmt.Println()
+
+	console.Print("  ┌─ Package Caches")
+	if len(info.Packages) == 0 {
+		console.Print("  │  No packages cached yet")
+	} else {
+		for _, p := range info.Packages {
+			console.Print("  │  • %-6s %10s  %s", p.Name, cache.FormatBytes(p.Size), p.Path)
+		}
+	}
+	fmt.Println()
+
+	console.Print("  ┌─ Micromamba")
+	if cm.IsMicromambaCached() {
+		mambaPath := cm.GetMicromambaPath()
+		if info, err := os.Stat(mambaPath); err == nil {
+			console.Print("  │  Status: Cached")
+			console.Print("  │  Size:   %s", cache.FormatBytes(info.Size()))
+			console.Print("  │  Path:   %s", mambaPath)
+		}
+	} else {
+		console.Print("  │  Status: Not cached")
+	}
+	fmt.Println()
+
+	console.Print("  ┌─ Commands")
+	console.Print("  │  sbox cache list      List cached runtimes")
+	console.Print("  │  sbox cache clean     Remove all cached runtimes")
+	console.Print("  │  sbox cache prune     Remove old unused runtimes")
+	console.Print("  │  sbox cache path      Show cache directory path")
+	fmt.Println()
+}
+
+// Pack command handler
+
+func runPack(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project. Run 'sbox init <name>' first.")
+	}
+
+	// Check if project is built
+	if !config.IsBuilt(projectRoot) {
+		console.Fatal("Project is not built. Run 'sbox build' first.")
+	}
+
+	outputPath, _ := cmd.Flags().GetString("output")
+	includeCache, _ := cmd.Flags().GetBool("include-cache")
+	excludeEnv, _ := cmd.Flags().GetBool("exclude-env")
+	target, _ := cmd.Flags().GetString("target")
+	platforms, _ := cmd.Flags().GetStringSlice("platform")
+	signKey, _ := cmd.Flags().GetString("sign")
+	if signKey != "" {
+		if _, err := pack.KeyFormat(signKey); err != nil {
+			console.Fatal("%s", err)
+		}
+	}
+	if len(args) > 0 {
+		outputPath = args[0]
+	}
+
+	// The compression defaults to the one the output name implies
+	compression, _ := cmd.Flags().GetString("compress")
+	if compression == "" {
+		compression = archive.CompressionOf(outputPath)
+	}
+	if compression == "" {
+		compression = archive.Gzip
+	}
+	if err := archive.CheckCompression(compression); err != nil {
+		console.Fatal("%s", err)
+	}
+	var splitSize int64
+	if value, _ := cmd.Flags().GetString("split-size"); value != "" {
+		if splitSize, err = config.ParseSize(value); err != nil {
+			console.Fatal("Invalid --split-size: %s", err)
+		}
+	}
+
+	// --platform builds the environment of every foreign platform and
+	// writes one archive each; --target writes a single archive without
+	// a foreign environment
+	hostPlatform := config.GetPlatformKey()
+	multi := len(platforms) > 0
+	if multi && target != "" {
+		console.Fatal("--platform and --target cannot be combined")
+	}
+	if !multi {
+		if target == "" {
+			target = hostPlatform
+		}
+		platforms = []string{target}
+	}
+	seen := make(map[string]bool)
+	var targets []string
+	for _, platform := range platforms {
+		if _, ok := config.MicromambaURLs[platform]; !ok {
+			console.Fatal("Unknown target platform: %s (supported: %s)", platform, strings.Join(supportedPlatforms(), ", "))
+		}
+		if !seen[platform] {
+			seen[platform] = true
+			targets = append(targets, platform)
+		}
+	}
+
+	lock, _ := config.LoadLock(projectRoot)
+	frozen := lock != nil && !lock.Packages.Empty()
+
+	// A foreign platform cannot use this environment; ship the lock instead
+	if !multi && target != hostPlatform {
+		excludeEnv = true
+		console.Info("Packing for %s on %s: runtime environment excluded", target, hostPlatform)
+		if frozen {
+			console.Info("The recipient rebuilds it with 'sbox build --frozen' from sbox.lock")
+		} else {
+			console.Warning("sbox.lock has no resolved packages; the recipient's build will resolve versions afresh")
+		}
+	}
+
+	projectName := filepath.Base(projectRoot)
+
+	// Determine output file
+	ext := archive.Extension(compression)
+	outputs := make(map[string]string, len(targets))
+	for _, platform := range targets {
+		output := outputPath
+		switch {
+		case output == "" && multi:
+			output = fmt.Sprintf("%s-sbox-%s%s", projectName, platform, ext)
+		case output == "":
+			output = fmt.Sprintf("%s-sbox%s", projectName, ext)
+		case len(targets) > 1:
+			output = platformArchivePath(output, platform)
+		}
+		// Make output path absolute
+		if !filepath.IsAbs(output) {
+			output = filepath.Join(projectRoot, output)
+		}
+		outputs[platform] = output
+	}
+
+	console.Step("Packing sandbox: %s", projectName)
+	fmt.Println()
+
+	// Load config for metadata
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
+
+	// Content filter from config and flags
+	filter := packFilter(cmd, cfg)
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	if !printPackEstimate(projectRoot, filter, excludeEnv) {
+		console.Warning("Could not estimate archive size")
+	}
+	if dryRun {
+		return
+	}
+
+	for _, platform := range targets {
+		job := packJob{
+			projectRoot:  projectRoot,
+			cfg:          cfg,
+			filter:       filter,
+			output:       outputs[platform],
+			platform:     platform,
+			prefixRoot:   projectRoot,
+			includeCache: includeCache,
+			frozen:       frozen,
+			excludeEnv:   excludeEnv,
+			needsBuild:   excludeEnv,
+			signKey:      signKey,
+			compression:  compression,
+			splitSize:    splitSize,
+		}
+		if !excludeEnv {
+			job.envDir = config.GetEnvDir(projectRoot)
+			job.binDir = filepath.Join(config.GetSboxDir(projectRoot), "bin")
+		}
+
+		if multi {
+			console.Step("Packing for %s", platform)
+		}
+		if multi && platform != hostPlatform && !excludeEnv {
+			stageDir, err := os.MkdirTemp("", "sbox-platform-")
+			if err != nil {
+				console.Fatal("Failed to create temp directory: %s", err)
+			}
+			job.stageDir = stageDir
+			if err := stagePlatformEnv(&job, stageDir, lock); err != nil {
+				os.RemoveAll(stageDir)
+				console.Fatal("%s", err)
+			}
+		}
+
+		writePackArchive(job)
+		// Each target's staged environment can be large; drop it before
+		// staging the next
+		if job.stageDir != "" {
+			os.RemoveAll(job.stageDir)
 		}
-		fmt.Println()
 	}
 
-	// Install commands
-	if len(cfg.Install) > 0 {
-		console.Print("  ┌─ Install Commands")
-		for i, cmd := range cfg.Install {
-			console.Print("  │  %d. %s", i+1, cmd)
+	if len(targets) > 1 {
+		console.Success("Created %d archives:", len(targets))
+		for _, platform := range targets {
+			console.Print("  %-14s %s", platform, outputs[platform])
 		}
 		fmt.Println()
 	}
 }
 
-// Helper functions
+// packJob is one archive written by 'sbox pack'
+type packJob struct {
+	projectRoot string
+	cfg         *config.Config
+	filter      *pack.Filter
+	output      string
+	platform    string
+	// envDir and binDir are the environment and micromamba to ship;
+	// empty leaves them out
+	envDir string
+	binDir string
+	// prefixRoot is the project root envDir was created under, which
+	// unpack relocates from
+	prefixRoot string
+	// lock replaces the project's sbox.lock in the archive when set
+	lock         *config.LockData
+	includeCache bool
+	frozen       bool
+	excludeEnv   bool
+	// needsBuild means the recipient has to run 'sbox build' to complete
+	// the environment
+	needsBuild bool
+	// signKey signs metadata.json when set
+	signKey string
+	// compression is one of archive.Compressions; splitSize, when set,
+	// splits the archive into volumes
+	compression string
+	splitSize   int64
+	// quiet leaves out the summary, for archives sbox uses itself
+	quiet bool
+	// stageDir holds the environment staged for another platform, removed
+	// along with the pack directory when packing fails
+	stageDir string
+}
 
-func formatDuration(d time.Duration) string {
-	if d < time.Minute {
-		return fmt.Sprintf("%ds", int(d.Seconds()))
+// stagePlatformEnv creates the environment of job's foreign platform in
+// stageDir, laid out like a project so unpack can relocate it, downloads
+// the platform's micromamba and points job at them
+func stagePlatformEnv(job *packJob, stageDir string, projectLock *config.LockData) error {
+	if projectLock == nil {
+		return fmt.Errorf("cannot read %s", config.LockFile)
 	}
-	if d < time.Hour {
-		return fmt.Sprintf("%dm%ds", int(d.Minutes()), int(d.Seconds())%60)
+	prefixRoot := filepath.Join(stageDir, filepath.Base(job.projectRoot))
+	envDir := config.GetEnvDir(prefixRoot)
+	binDir := filepath.Join(config.GetSboxDir(prefixRoot), "bin")
+
+	locked := projectLock.Packages
+	rt := sboxruntime.NewManager(job.projectRoot)
+	if err := rt.CreatePlatformEnv(job.cfg.ParseRuntime(), job.platform, envDir, locked); err != nil {
+		return err
 	}
-	if d < 24*time.Hour {
-		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+
+	console.Step("Downloading micromamba for %s...", job.platform)
+	if err := sboxruntime.DownloadMicromamba(job.platform, filepath.Join(binDir, config.ExeNameFor(job.platform, "micromamba"))); err != nil {
+		return fmt.Errorf("failed to download micromamba for %s: %w", job.platform, err)
 	}
-	days := int(d.Hours()) / 24
-	hours := int(d.Hours()) % 24
-	return fmt.Sprintf("%dd%dh", days, hours)
+
+	// The shipped lock describes the target's environment
+	conda, err := rt.PlatformPackages(envDir)
+	if err != nil {
+		return err
+	}
+	lock := *projectLock
+	lock.Platform = job.platform
+	lock.Steps = nil
+	packages := &config.LockedPackages{Conda: conda}
+	if locked != nil {
+		packages.Pip = locked.Pip
+		packages.Npm = locked.Npm
+		packages.NpmLocal = locked.NpmLocal
+	}
+	lock.Packages = packages
+
+	job.envDir = envDir
+	job.binDir = binDir
+	job.prefixRoot = prefixRoot
+	job.lock = &lock
+	job.frozen = true
+
+	// Nothing built for the target can run here
+	if len(job.cfg.Install) > 0 || len(packages.Pip)+len(packages.Npm)+len(packages.NpmLocal) > 0 {
+		job.needsBuild = true
+		console.Warning("Install commands and pip/npm packages cannot run for %s here; the recipient completes the environment with 'sbox build --frozen'", job.platform)
+	}
+	console.Success("%s environment created (%d conda packages)", job.platform, len(conda))
+	return nil
 }
 
-func getDirSize(path string) int64 {
-	var size int64
-	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err == nil && !info.IsDir() {
-			size += info.Size()
+// platformArchivePath inserts the platform into an archive name:
+// app.tar.gz becomes app-linux-arm64.tar.gz
+func platformArchivePath(path, platform string) string {
+	for _, ext := range archive.Extensions {
+		if strings.HasSuffix(path, ext) {
+			return strings.TrimSuffix(path, ext) + "-" + platform + ext
 		}
-		return nil
-	})
-	return size
+	}
+	return path + "-" + platform
 }
 
-// For status command - load lock file
-func loadLockJSON(path string) map[string]interface{} {
-	data, err := os.ReadFile(path)
+// writePackArchive copies the sandbox into a temp directory and archives it
+func writePackArchive(job packJob) {
+	projectRoot := job.projectRoot
+	cfg := job.cfg
+	projectName := filepath.Base(projectRoot)
+	outputPath := job.output
+	hostPlatform := config.GetPlatformKey()
+	excludeEnv := job.excludeEnv
+
+	// Create metadata
+	metadata := createPackMetadata(projectRoot, cfg)
+	if job.platform != hostPlatform {
+		metadata["platform"] = job.platform
+		metadata["packed_on"] = hostPlatform
+		delete(metadata, "arch")
+		delete(metadata, "glibc_floor")
+		delete(metadata, "env_files")
+		if !excludeEnv {
+			_, arch, _ := strings.Cut(job.platform, "-")
+			metadata["arch"] = arch
+			metadata["original_prefix"] = job.prefixRoot
+			if floor := compat.EnvGlibcFloor(job.envDir); floor != "" {
+				metadata["glibc_floor"] = floor
+			}
+			if fileCount, err := countFiles(job.envDir); err == nil {
+				metadata["env_files"] = fileCount
+			}
+		}
+	}
+	if excluded := job.filter.Reasons(); len(excluded) > 0 {
+		metadata["excluded"] = excluded
+	}
+
+	// console.Fatal exits without running deferred calls
+	var tmpDir string
+	fatal := func(format string, args ...interface{}) {
+		if tmpDir != "" {
+			os.RemoveAll(tmpDir)
+		}
+		if job.stageDir != "" {
+			os.RemoveAll(job.stageDir)
+		}
+		console.Fatal(format, args...)
+	}
+
+	// Create temporary directory for packing
+	tmpDir, err := os.MkdirTemp("", "sbox-pack-")
 	if err != nil {
-		return nil
+		fatal("Failed to create temp directory: %s", err)
 	}
-	var result map[string]interface{}
-	json.Unmarshal(data, &result)
-	return result
-}
+	defer os.RemoveAll(tmpDir)
 
-func runValidate(cmd *cobra.Command, args []string) {
-	quiet, _ := cmd.Flags().GetBool("quiet")
-	fix, _ := cmd.Flags().GetBool("fix")
+	packDir := filepath.Join(tmpDir, projectName)
+	sboxPackDir := filepath.Join(packDir, ".sbox")
 
-	projectRoot, err := config.GetProjectRoot("")
+	// Create pack directory structure
+	if err := os.MkdirAll(sboxPackDir, 0755); err != nil {
+		fatal("Failed to create pack directory: %s", err)
+	}
+
+	// Copy the config, from an sbox.yaml anchor too, as .sbox/config.yaml
+	console.Step("Copying configuration...")
+	srcConfig := config.GetConfigPath(projectRoot)
+	dstConfig := filepath.Join(sboxPackDir, config.ConfigFile)
+	if err := copyFileForPack(srcConfig, dstConfig); err != nil {
+		fatal("Failed to copy config: %s", err)
+	}
+
+	// Copy .sbox/rootfs/
+	console.Step("Copying rootfs...")
+	srcRootfs := config.GetRootfsDir(projectRoot)
+	dstRootfs := filepath.Join(sboxPackDir, "rootfs")
+	if _, err := os.Stat(srcRootfs); err == nil {
+		if err := copyDirForPack(srcRootfs, dstRootfs, job.filter); err != nil {
+			fatal("Failed to copy rootfs: %s", err)
+		}
+		console.Info("Copied rootfs (%s)", formatBytes(getDirSize(dstRootfs)))
+	}
+
+	// Copy .sbox/env/ (runtime environment)
+	if !excludeEnv {
+		console.Step("Copying runtime environment...")
+		dstEnv := filepath.Join(sboxPackDir, "env")
+		if _, err := os.Stat(job.envDir); err == nil {
+			if err := copyDirForPack(job.envDir, dstEnv, job.filter); err != nil {
+				fatal("Failed to copy env: %s", err)
+			}
+			console.Info("Copied env (%s)", formatBytes(getDirSize(dstEnv)))
+		}
+	} else {
+		console.Info("Excluding runtime environment (--exclude-env)")
+	}
+
+	// Copy .sbox/bin/ (micromamba)
+	if job.binDir != "" {
+		dstBin := filepath.Join(sboxPackDir, "bin")
+		if _, err := os.Stat(job.binDir); err == nil {
+			if err := copyDirForPack(job.binDir, dstBin, nil); err != nil {
+				console.Warning("Failed to copy bin: %s", err)
+			}
+		}
+	}
+
+	// Optionally include mamba cache
+	if job.includeCache {
+		console.Step("Copying mamba cache...")
+		srcMamba := filepath.Join(config.GetSboxDir(projectRoot), "mamba")
+		dstMamba := filepath.Join(sboxPackDir, "mamba")
+		if _, err := os.Stat(srcMamba); err == nil {
+			if err := copyDirForPack(srcMamba, dstMamba, nil); err != nil {
+				console.Warning("Failed to copy mamba cache: %s", err)
+			} else {
+				console.Info("Copied mamba cache (%s)", formatBytes(getDirSize(dstMamba)))
+			}
+		}
+	}
+
+	// Copy sbox.lock
+	if job.lock != nil {
+		if err := config.WriteLock(packDir, job.lock); err != nil {
+			fatal("Failed to write lock file: %s", err)
+		}
+	} else {
+		srcLock := config.GetLockPath(projectRoot)
+		dstLock := filepath.Join(packDir, "sbox.lock")
+		if _, err := os.Stat(srcLock); err == nil {
+			copyFileForPack(srcLock, dstLock)
+		}
+	}
+
+	// Create runbook README for the archive from the config
+	readmePath := filepath.Join(packDir, "README.txt")
+	readmeContent := runbook.Generate(cfg, runbook.Info{
+		ProjectName: projectName,
+		ArchiveName: filepath.Base(outputPath),
+		PackedAt:    fmt.Sprint(metadata["packed_at"]),
+		Platform:    job.platform,
+		SboxVersion: version,
+		ExcludeEnv:  excludeEnv,
+		Partial:     job.needsBuild && !excludeEnv,
+		Frozen:      job.frozen,
+		Compression: job.compression,
+		Split:       job.splitSize > 0,
+	})
+
+	if err := os.WriteFile(readmePath, []byte(readmeContent), 0644); err != nil {
+		console.Warning("Failed to write README: %s", err)
+	}
+
+	// Checksums cover everything but metadata.json, which holds their
+	// digest, and its signature
+	console.Step("Computing checksums...")
+	checksums, err := pack.WriteManifest(packDir)
 	if err != nil {
-		console.Fatal("Not in an sbox project. Run 'sbox init <name>' first.")
+		fatal("Failed to compute checksums: %s", err)
+	}
+	metadata["checksums"] = checksums
+
+	// Write metadata.json
+	console.Step("Writing metadata...")
+	metadataPath := filepath.Join(packDir, pack.MetadataFile)
+	metadataBytes, _ := json.MarshalIndent(metadata, "", "  ")
+	if err := os.WriteFile(metadataPath, metadataBytes, 0644); err != nil {
+		fatal("Failed to write metadata: %s", err)
+	}
+
+	signed := ""
+	if job.signKey != "" {
+		console.Step("Signing metadata...")
+		signed, err = pack.Sign(packDir, job.signKey)
+		if err != nil {
+			fatal("%s", err)
+		}
+	}
+
+	// Create the archive
+	console.Step("Creating archive...")
+	epoch, err := archive.SourceDateEpoch()
+	if err != nil {
+		fatal("%s", err)
+	}
+	progress := console.NewProgress("Compressing", getDirSize(packDir))
+	stats, err := archive.Write(outputPath, packDir, archive.Options{
+		ModTime:     epoch,
+		Progress:    progress.Set,
+		Compression: job.compression,
+		SplitSize:   job.splitSize,
+	})
+	progress.Done()
+	if err != nil {
+		fatal("Failed to create archive: %s", err)
+	}
+	for _, skipped := range stats.Skipped {
+		console.Warning("Skipped special file %s", skipped)
 	}
 
-	configPath := filepath.Join(config.GetSboxDir(projectRoot), config.ConfigFile)
+	// Get archive info
+	var archiveSize int64
+	for _, part := range stats.Parts {
+		info, err := os.Stat(part)
+		if err != nil {
+			fatal("Failed to stat archive: %s", err)
+		}
+		archiveSize += info.Size()
+	}
+	split := len(stats.Parts) > 1
+	archiveDigest, err := pack.WriteSumFile(outputPath, stats.Parts)
+	if err != nil {
+		console.Warning("Failed to write %s.sha256: %s", filepath.Base(outputPath), err)
+	}
+	if job.quiet {
+		return
+	}
 
 	fmt.Println()
-	console.Step("Validating configuration: %s", configPath)
+	console.Success("Archive created successfully!")
+	fmt.Println()
+	console.Print("  ┌─ Archive Details")
+	if split {
+		console.Print("  │  Volumes: %s ... %s", stats.Parts[0], filepath.Base(stats.Parts[len(stats.Parts)-1]))
+		console.Print("  │  Size:    %s in %d volumes of at most %s", formatBytes(archiveSize), len(stats.Parts), formatBytes(job.splitSize))
+	} else {
+		console.Print("  │  File:    %s", outputPath)
+		console.Print("  │  Size:    %s", formatBytes(archiveSize))
+	}
+	console.Print("  │  Format:  %s", strings.TrimPrefix(archive.Extension(job.compression), "."))
+	console.Print("  │  Runtime: %s", cfg.Runtime)
+	console.Print("  │  Target:  %s", job.platform)
+	if archiveDigest != "" {
+		console.Print("  │  SHA-256: %s", archiveDigest)
+	}
+	console.Print("  │  Files:   %d checksummed in %s, %d symlinks in %s", checksums.Files, pack.ManifestFile, checksums.Symlinks, pack.LinksFile)
+	if signed != "" {
+		console.Print("  │  Signed:  %s (%s)", pack.MetadataFile, signed)
+	}
+	buildCommand := "sbox build"
+	if job.frozen {
+		buildCommand = "sbox build --frozen"
+	}
+	if excludeEnv {
+		console.Print("  │  Note:    Runtime excluded (recipient must run '%s')", buildCommand)
+	} else if job.needsBuild {
+		console.Print("  │  Note:    Install commands not run (recipient must run '%s')", buildCommand)
+	}
+	fmt.Println()
+	console.Print("  ┌─ To use this archive")
+	console.Print("  │  1. Copy to target machine")
+	console.Print("  │  2. Extract: %s", archive.ExtractCommand(filepath.Base(outputPath), job.compression, split))
+	if job.needsBuild {
+		console.Print("  │  3. Build:   cd %s && %s", projectName, buildCommand)
+		console.Print("  │  4. Run:     sbox run")
+	} else {
+		console.Print("  │  3. Run:     cd %s && sbox run", projectName)
+	}
 	fmt.Println()
+}
 
-	// Check if config file exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		console.Fatal("Config file not found: %s\n  → Run 'sbox init <name>' to create a new project", configPath)
+func runVerify(cmd *cobra.Command, args []string) {
+	verifyKey, _ := cmd.Flags().GetString("verify-key")
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		console.Fatal("Invalid path: %s", err)
 	}
 
-	// Load config
-	cfg, err := config.Load(projectRoot)
+	if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+		err = verifyPacked(path, "", verifyKey)
+	} else {
+		// A volume stands for the whole split archive
+		name, _, partsErr := archive.Parts(path)
+		if partsErr != nil {
+			console.Fatal("%s", partsErr)
+		}
+		err = verifyPacked("", name, verifyKey)
+	}
 	if err != nil {
-		console.Error("Failed to parse config file:")
-		console.Print("  %s", err)
-		fmt.Println()
-		console.Print("Common causes:")
-		console.Print("  • Invalid YAML syntax (check indentation)")
-		console.Print("  • Missing colons after field names")
-		console.Print("  • Unquoted special characters")
-		fmt.Println()
-		console.Print("Example valid config:")
-		fmt.Println()
-		console.Print(validate.GetConfigExample("python"))
-		os.Exit(1)
+		console.Fatal("%s", err)
 	}
+}
 
-	// Validate
-	result := validate.ValidateConfig(cfg, projectRoot)
+// verifyMismatchLimit caps the mismatching files listed by verify
+const verifyMismatchLimit = 20
 
-	// Display results
-	if len(result.Errors) > 0 {
-		console.Error("Configuration errors (%d):", len(result.Errors))
-		fmt.Println()
-		for i, verr := range result.Errors {
-			console.Print("  %d. [%s] %s", i+1, verr.Field, verr.Message)
-			if verr.Hint != "" {
-				console.Print("     → %s", verr.Hint)
-			}
-			fmt.Println()
+// verifyPacked checks an extracted archive in dir, or a packed archive,
+// against its checksums, and its signature when a key is given
+func verifyPacked(dir, archive, key string) error {
+	var report *pack.Report
+	var err error
+	signedDir := dir
+	if archive != "" {
+		console.Step("Verifying %s", filepath.Base(archive))
+		checked, err := pack.CheckSumFile(archive)
+		if err != nil {
+			return err
 		}
-	}
-
-	if !quiet && len(result.Warnings) > 0 {
-		console.Warning("Configuration warnings (%d):", len(result.Warnings))
-		fmt.Println()
-		for i, warn := range result.Warnings {
-			console.Print("  %d. [%s] %s", i+1, warn.Field, warn.Message)
-			if warn.Hint != "" {
-				console.Print("     → %s", warn.Hint)
-			}
-			fmt.Println()
+		if checked {
+			console.Success("Archive matches %s.sha256", filepath.Base(archive))
 		}
-	}
 
-	// Summary
-	fmt.Println()
-	if result.Valid {
-		if len(result.Warnings) > 0 {
-			console.Success("Configuration is valid with %d warning(s)", len(result.Warnings))
-		} else {
-			console.Success("Configuration is valid")
+		tmpDir, err := os.MkdirTemp("", "sbox-verify-")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		signedDir = tmpDir
+		report, err = pack.VerifyArchive(archive, tmpDir)
+		if err != nil {
+			return err
 		}
-		fmt.Println()
-		console.Print("  You can now run:")
-		console.Print("    sbox build     Build the sandbox")
-		console.Print("    sbox run       Run the application")
 	} else {
-		console.Error("Configuration is invalid with %d error(s)", len(result.Errors))
-		fmt.Println()
-		console.Print("  Please fix the errors above and run 'sbox validate' again.")
-
-		if fix {
-			fmt.Println()
-			console.Info("Auto-fix is not yet implemented.")
-			console.Print("  Please manually edit: %s", configPath)
+		console.Step("Verifying %s", dir)
+		report, err = pack.VerifyDir(dir)
+		if err != nil {
+			return err
 		}
+	}
 
-		os.Exit(1)
+	for i, m := range report.Mismatches {
+		if i == verifyMismatchLimit {
+			console.Print("    ... and %d more", len(report.Mismatches)-i)
+			break
+		}
+		console.Emit(console.LevelError, console.Fields{"path": m.Path, "problem": m.Problem},
+			"%-10s %s", m.Problem, m.Path)
+	}
+	if !report.OK() {
+		return fmt.Errorf("%d mismatches against %s (%d files listed)", len(report.Mismatches), pack.ManifestFile, report.Files)
+	}
+	console.Success("All %d files match %s", report.Files, pack.ManifestFile)
+	if report.Symlinks > 0 {
+		console.Success("All %d symlinks match %s", report.Symlinks, pack.LinksFile)
 	}
-	fmt.Println()
 
-	// Show config summary
-	console.Print("  ┌─ Config Summary")
-	console.Print("  │  Runtime:  %s", cfg.Runtime)
-	console.Print("  │  Workdir:  %s", cfg.Workdir)
-	console.Print("  │  Command:  %s", cfg.Cmd)
-	console.Print("  │  Copy:     %d mapping(s)", len(cfg.Copy))
-	console.Print("  │  Mount:    %d mount(s)", len(cfg.Mount))
-	console.Print("  │  Install:  %d command(s)", len(cfg.Install))
-	console.Print("  │  Env vars: %d defined", len(cfg.Env))
-	fmt.Println()
+	switch {
+	case key != "":
+		if err := pack.VerifySignature(signedDir, key); err != nil {
+			return err
+		}
+		console.Success("Signature of %s is valid", pack.MetadataFile)
+	case report.Signed != "":
+		console.Info("%s has a %s signature; check it with --verify-key <public key>", pack.MetadataFile, report.Signed)
+	}
+	return nil
 }
 
-// Cache command handlers
-
-func runCacheList(cmd *cobra.Command, args []string) {
-	asJSON, _ := cmd.Flags().GetBool("json")
+func runRemoteAdd(cmd *cobra.Command, args []string) {
+	name, host := args[0], args[1]
+	if err := remote.CheckName(name); err != nil {
+		console.Fatal("%s", err)
+	}
+	if host == "" || strings.HasPrefix(host, "-") || strings.ContainsAny(host, " :/") {
+		console.Fatal("Invalid host '%s': expected user@host or a Host alias of ~/.ssh/config", host)
+	}
+	port, _ := cmd.Flags().GetInt("port")
+	identity, _ := cmd.Flags().GetString("identity")
+	dir, _ := cmd.Flags().GetString("dir")
+	sbox, _ := cmd.Flags().GetString("sbox")
+	if identity != "" {
+		abs, err := filepath.Abs(identity)
+		if err != nil {
+			console.Fatal("Invalid identity: %s", err)
+		}
+		if _, err := os.Stat(abs); err != nil {
+			console.Fatal("%s", err)
+		}
+		identity = abs
+	}
 
-	cm, err := cache.NewManager()
+	remotes, err := remote.Load()
 	if err != nil {
-		console.Fatal("Failed to initialize cache: %s", err)
+		console.Fatal("%s", err)
+	}
+	_, replaced := remotes[name]
+	remotes[name] = remote.Remote{Host: host, Port: port, Identity: identity, Dir: dir, Sbox: sbox}
+	if err := remote.Save(remotes); err != nil {
+		console.Fatal("Failed to save remotes: %s", err)
+	}
+	if replaced {
+		console.Success("Remote '%s' replaced: %s", name, remotes[name].Address())
+	} else {
+		console.Success("Remote '%s' added: %s", name, remotes[name].Address())
 	}
+	console.Print("    → Run on it with 'sbox run --remote %s [command]'", name)
+}
 
-	runtimes, err := cm.ListCachedRuntimes()
+func runRemoteList(cmd *cobra.Command, args []string) {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	remotes, err := remote.Load()
 	if err != nil {
-		console.Fatal("Failed to list cached runtimes: %s", err)
+		console.Fatal("%s", err)
 	}
-
 	if asJSON {
-		data, _ := json.MarshalIndent(runtimes, "", "  ")
+		data, _ := json.MarshalIndent(remotes, "", "  ")
 		fmt.Println(string(data))
 		return
 	}
-
-	if len(runtimes) == 0 {
-		console.Info("No cached runtimes found")
-		console.Print("  Cache location: %s", cm.CacheRoot)
-		console.Print("  Runtimes will be cached automatically during 'sbox build'")
+	if len(remotes) == 0 {
+		console.Info("No remotes")
+		console.Print("    → Add one with 'sbox remote add <name> user@host'")
 		return
 	}
+	fmt.Printf("  %-16s %-36s %s\n", "NAME", "HOST", "DIR")
+	for _, name := range remote.Names(remotes) {
+		r := remotes[name]
+		dir := r.Dir
+		if dir == "" {
+			dir = "~/" + remote.DefaultDir
+		}
+		fmt.Printf("  %-16s %-36s %s\n", name, r.Address(), dir)
+	}
+}
 
-	fmt.Println()
-	console.Step("Cached Runtimes")
-	fmt.Println()
+func runRemoteRemove(cmd *cobra.Command, args []string) {
+	remotes, err := remote.Load()
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	if _, ok := remotes[args[0]]; !ok {
+		console.Fatal("No remote named '%s'", args[0])
+	}
+	delete(remotes, args[0])
+	if err := remote.Save(remotes); err != nil {
+		console.Fatal("Failed to save remotes: %s", err)
+	}
+	console.Success("Remote '%s' removed", args[0])
+}
 
-	fmt.Printf("  %-20s %-12s %-20s %s\n", "RUNTIME", "SIZE", "LAST USED", "PATH")
-	fmt.Printf("  %-20s %-12s %-20s %s\n", "-------", "----", "---------", "----")
+// runRemote packs the sandbox, uploads it to a remote and runs command
+// there with its output streamed back, exiting with the command's code
+func runRemote(cmd *cobra.Command, projectRoot string, cfg *config.Config, name, command string) {
+	if detach, _ := cmd.Flags().GetBool("detach"); detach {
+		console.Fatal("--detach cannot be used with --remote")
+	}
+	if envFiles, _ := cmd.Flags().GetStringArray("env-file"); len(envFiles) > 0 {
+		console.Fatal("--env-file cannot be used with --remote; set env in config.yaml")
+	}
+	tty, _ := cmd.Flags().GetBool("tty")
 
-	for _, r := range runtimes {
-		key := cache.GetRuntimeKey(r.Language, r.Version)
-		lastUsed := r.LastUsed.Format("2006-01-02 15:04")
-		size := cache.FormatBytes(r.Size)
-		fmt.Printf("  %-20s %-12s %-20s %s\n", key, size, lastUsed, r.Path)
+	remotes, err := remote.Load()
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	rem, ok := remotes[name]
+	if !ok {
+		console.Error("No remote named '%s'", name)
+		console.Print("    → Add it with 'sbox remote add %s user@host'", name)
+		os.Exit(1)
+	}
+	if !config.IsBuilt(projectRoot) {
+		console.Fatal("Project is not built. Run 'sbox build' first.")
 	}
+	projectName := filepath.Base(projectRoot)
+	hostPlatform := config.GetPlatformKey()
 
-	fmt.Println()
+	console.Step("Connecting to %s", rem.Address())
+	host, err := rem.Probe()
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	if host.Platform != hostPlatform {
+		console.Error("%s is %s, but the sandbox was built on %s", rem.Host, host.Platform, hostPlatform)
+		console.Print("    → Pack it with 'sbox pack --target %s' and build it there", host.Platform)
+		os.Exit(1)
+	}
+	if !host.HasSbox {
+		console.Error("sbox not found on %s", rem.Host)
+		console.Print("    → Install it there, or give its path with 'sbox remote add %s %s --sbox <path>'", name, rem.Host)
+		os.Exit(1)
+	}
 
-	// Show micromamba status
-	if cm.IsMicromambaCached() {
-		console.Print("  micromamba: cached")
+	tmpDir, err := os.MkdirTemp("", "sbox-remote-")
+	if err != nil {
+		console.Fatal("Failed to create temp directory: %s", err)
 	}
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, projectName+"-sbox"+archive.Extension(archive.Gzip))
+
+	lock, _ := config.LoadLock(projectRoot)
+	writePackArchive(packJob{
+		projectRoot: projectRoot,
+		cfg:         cfg,
+		filter:      packFilter(cmd, cfg),
+		output:      archivePath,
+		platform:    hostPlatform,
+		prefixRoot:  projectRoot,
+		frozen:      lock != nil && !lock.Packages.Empty(),
+		envDir:      config.GetEnvDir(projectRoot),
+		binDir:      filepath.Join(config.GetSboxDir(projectRoot), "bin"),
+		compression: archive.Gzip,
+		quiet:       true,
+	})
 
-	// Show total size
-	info, _ := cm.GetCacheInfo()
-	if info != nil {
-		console.Print("  Total cache size: %s", cache.FormatBytes(info.TotalSize))
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	console.Step("Uploading %s to %s:%s", formatBytes(info.Size()), rem.Host, host.Dir)
+	if _, err := rem.Upload(archivePath, host.Dir, host.HasRsync); err != nil {
+		console.Fatal("%s", err)
+	}
+	os.RemoveAll(tmpDir)
+
+	console.Step("Running on %s", rem.Host)
+	script := rem.Script(host.Dir, projectName, filepath.Base(archivePath), command, tty)
+	code, err := rem.Run(script, tty, os.Stdout, os.Stderr)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	if code != 0 {
+		os.Exit(code)
 	}
-	fmt.Println()
 }
 
-func runCacheClean(cmd *cobra.Command, args []string) {
-	cleanAll, _ := cmd.Flags().GetBool("all")
+// openRegistry resolves a reference and its backend from ~/.sbox/defaults.yaml
+func openRegistry(refStr string) (registry.Ref, registry.Backend) {
+	globalCfg, err := config.LoadGlobalConfig()
+	if err != nil {
+		console.Fatal("Failed to load ~/.sbox/defaults.yaml: %s", err)
+	}
+	if len(globalCfg.Registries) == 0 {
+		console.Error("No registries configured")
+		console.Print("    → Add one under registries: in ~/.sbox/defaults.yaml (see 'sbox push --help')")
+		os.Exit(1)
+	}
 
-	cm, err := cache.NewManager()
+	ref, err := registry.ParseRef(refStr, globalCfg)
 	if err != nil {
-		console.Fatal("Failed to initialize cache: %s", err)
+		console.Fatal("%s", err)
 	}
+	backend, err := registry.Open(ref.Registry, globalCfg)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	return ref, backend
+}
 
-	if len(args) > 0 {
-		// Clean specific runtime
-		runtimeKey := args[0]
-		
-		// Parse runtime key (e.g., "python-3.10" -> language="python", version="3.10")
-		var language, version string
-		for _, prefix := range []string{"python-", "node-", "nodejs-"} {
-			if len(runtimeKey) > len(prefix) && runtimeKey[:len(prefix)] == prefix {
-				language = prefix[:len(prefix)-1]
-				version = runtimeKey[len(prefix):]
+func runPush(cmd *cobra.Command, args []string) {
+	var archivePath string
+	if len(args) > 1 {
+		archivePath = args[1]
+	} else {
+		projectRoot, err := config.GetProjectRoot("")
+		if err != nil {
+			console.Fatal("Not in an sbox project; pass the archive to push")
+		}
+		// The default archive of 'sbox pack', in whichever compression
+		base := filepath.Join(projectRoot, filepath.Base(projectRoot)+"-sbox")
+		archivePath = base + archive.Extension(archive.Gzip)
+		for _, ext := range archive.Extensions {
+			if _, _, err := archive.Parts(base + ext); err == nil {
+				archivePath = base + ext
 				break
 			}
 		}
+	}
+	if _, _, err := archive.Parts(archivePath); err != nil {
+		console.Error("Archive not found: %s", archivePath)
+		console.Print("    → Create it with 'sbox pack'")
+		os.Exit(1)
+	}
 
-		if language == "" {
-			console.Fatal("Invalid runtime format: %s\n  Expected format: python-3.10 or node-22", runtimeKey)
-		}
+	ref, backend := openRegistry(args[0])
 
-		console.Step("Removing cached runtime: %s", runtimeKey)
-		if err := cm.CleanRuntime(language, version); err != nil {
-			console.Fatal("Failed to remove runtime: %s", err)
-		}
-		console.Success("Runtime removed from cache")
-		return
+	console.Step("Pushing %s to %s", filepath.Base(archivePath), ref)
+	meta, err := registry.Upload(backend, ref, archivePath)
+	if err != nil {
+		console.Fatal("Push failed: %s", err)
 	}
 
-	if cleanAll {
-		console.Step("Removing all cached data...")
-		if err := cm.CleanCache(); err != nil {
-			console.Fatal("Failed to clean cache: %s", err)
-		}
-		console.Success("Cache cleared completely")
-	} else {
-		// Only clean runtimes, keep micromamba
-		runtimes, _ := cm.ListCachedRuntimes()
-		if len(runtimes) == 0 {
-			console.Info("No cached runtimes to remove")
-			return
+	fmt.Println()
+	console.Success("Pushed %s", ref)
+	fmt.Println()
+	console.Print("  ┌─ Archive Details")
+	console.Print("  │  Size:     %s", formatBytes(meta.Size))
+	console.Print("  │  SHA256:   %s", meta.SHA256)
+	if meta.Runtime != "" {
+		console.Print("  │  Runtime:  %s", meta.Runtime)
+	}
+	if meta.Platform != "" {
+		console.Print("  │  Platform: %s", meta.Platform)
+	}
+	fmt.Println()
+	console.Print("  Pull it with: sbox pull %s", ref)
+	fmt.Println()
+}
+
+func runPull(cmd *cobra.Command, args []string) {
+	ref, backend := openRegistry(args[0])
+
+	outputPath, _ := cmd.Flags().GetString("output")
+
+	console.Step("Pulling %s", ref)
+	meta, outputPath, err := registry.Download(backend, ref, outputPath)
+	if err != nil {
+		if errors.Is(err, registry.ErrNotFound) {
+			console.Fatal("%s does not exist in registry '%s'", ref, ref.Registry)
 		}
+		console.Fatal("Pull failed: %s", err)
+	}
 
-		console.Step("Removing %d cached runtime(s)...", len(runtimes))
-		for _, r := range runtimes {
-			if err := cm.CleanRuntime(r.Language, r.Version); err != nil {
-				console.Warning("Failed to remove %s-%s: %s", r.Language, r.Version, err)
-			} else {
-				console.Print("  Removed: %s-%s", r.Language, r.Version)
-			}
+	fmt.Println()
+	console.Success("Downloaded %s (checksum verified)", outputPath)
+	fmt.Println()
+	console.Print("  ┌─ Archive Details")
+	console.Print("  │  Size:     %s", formatBytes(meta.Size))
+	console.Print("  │  SHA256:   %s", meta.SHA256)
+	if meta.Project != "" {
+		console.Print("  │  Project:  %s", meta.Project)
+	}
+	if meta.Runtime != "" {
+		console.Print("  │  Runtime:  %s", meta.Runtime)
+	}
+	if meta.Platform != "" {
+		console.Print("  │  Platform: %s", meta.Platform)
+	}
+	if meta.PushedAt != "" {
+		console.Print("  │  Pushed:   %s", meta.PushedAt)
+	}
+	fmt.Println()
+
+	// Unpack refuses incompatible archives; say so before extraction
+	for _, problem := range compat.Check(compat.Archive{Platform: meta.Platform, SboxVersion: meta.SboxVersion}) {
+		console.Warning("%s", problem.Message)
+		if problem.Hint != "" {
+			console.Print("    → %s", problem.Hint)
 		}
-		console.Success("Cached runtimes removed")
-		console.Info("Use 'sbox cache clean --all' to also remove micromamba")
 	}
+
+	project := meta.Project
+	if project == "" {
+		project = "<project>"
+	}
+	console.Print("  ┌─ Next Steps")
+	console.Print("  │  1. Extract:  %s", archive.ExtractCommand(outputPath, meta.Compression, false))
+	console.Print("  │  2. Relocate: cd %s && sbox unpack", project)
+	console.Print("  │  3. Run:      sbox run")
+	fmt.Println()
 }
 
-func runCachePrune(cmd *cobra.Command, args []string) {
-	olderThan, _ := cmd.Flags().GetDuration("older-than")
+func runModuleGenerate(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
+	if err != nil {
+		console.Fatal("Not in an sbox project. Run 'sbox init <name>' first.")
+	}
+	if !config.IsBuilt(projectRoot) {
+		console.Fatal("Project is not built. Run 'sbox build' first.")
+	}
+	if err := config.CheckPlatform(projectRoot); err != nil {
+		console.Fatal("%s", err)
+	}
 
-	cm, err := cache.NewManager()
+	cfg, err := config.Load(projectRoot)
 	if err != nil {
-		console.Fatal("Failed to initialize cache: %s", err)
+		console.Fatal("Failed to load config: %s", err)
+	}
+
+	format, _ := cmd.Flags().GetString("format")
+	name, _ := cmd.Flags().GetString("name")
+	moduleVersion, _ := cmd.Flags().GetString("version")
+	outputDir, _ := cmd.Flags().GetString("output")
+	toStdout, _ := cmd.Flags().GetBool("stdout")
+
+	switch format {
+	case "":
+		format = modulefile.DetectFormat()
+	case modulefile.FormatLua, modulefile.FormatTcl:
+	default:
+		console.Fatal("Unknown format: %s (supported: lua, tcl)", format)
+	}
+	if name == "" {
+		name = filepath.Base(projectRoot)
+	}
+	if strings.ContainsAny(name, "/ ") || strings.ContainsAny(moduleVersion, "/ ") {
+		console.Fatal("Module name and version cannot contain '/' or spaces")
 	}
 
-	console.Step("Pruning runtimes not used in %s...", formatDuration(olderThan))
+	info := modulefile.Info{Name: name, Version: moduleVersion, ProjectRoot: projectRoot}
+	content := modulefile.Generate(cfg, info, format)
+	if toStdout {
+		fmt.Print(content)
+		return
+	}
 
-	pruned, err := cm.PruneCache(olderThan)
+	if outputDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			console.Fatal("Failed to get home directory: %s", err)
+		}
+		outputDir = filepath.Join(home, "modulefiles")
+	}
+	outputDir, err = filepath.Abs(outputDir)
 	if err != nil {
-		console.Fatal("Failed to prune cache: %s", err)
+		console.Fatal("Invalid output directory: %s", err)
 	}
 
-	if pruned == 0 {
-		console.Info("No runtimes to prune")
-	} else {
-		console.Success("Pruned %d runtime(s)", pruned)
+	modulePath := filepath.Join(outputDir, modulefile.FileName(info, format))
+	if err := os.MkdirAll(filepath.Dir(modulePath), 0755); err != nil {
+		console.Fatal("Failed to create module directory: %s", err)
+	}
+	if err := os.WriteFile(modulePath, []byte(content), 0644); err != nil {
+		console.Fatal("Failed to write modulefile: %s", err)
 	}
-}
 
-func runCachePath(cmd *cobra.Command, args []string) {
-	cacheDir, err := cache.GetGlobalCacheDir()
-	if err != nil {
-		console.Fatal("Failed to get cache path: %s", err)
+	loadName := name
+	if moduleVersion != "" {
+		loadName += "/" + moduleVersion
 	}
-	fmt.Println(cacheDir)
-}
 
-func runCacheInfo(cmd *cobra.Command, args []string) {
-	asJSON, _ := cmd.Flags().GetBool("json")
+	console.Success("Generated %s modulefile: %s", format, modulePath)
+	fmt.Println()
+	console.Print("  ┌─ To use it")
+	console.Print("  │  module use %s", outputDir)
+	console.Print("  │  module load %s", loadName)
+	fmt.Println()
+	console.Print("  Regenerate it after changing env in config.yaml or moving the project.")
+}
 
-	cm, err := cache.NewManager()
+func runExportDocker(cmd *cobra.Command, args []string) {
+	projectRoot, err := config.GetProjectRoot("")
 	if err != nil {
-		console.Fatal("Failed to initialize cache: %s", err)
+		console.Fatal("Not in an sbox project. Run 'sbox init <name>' first.")
 	}
-
-	info, err := cm.GetCacheInfo()
+	cfg, err := config.Load(projectRoot)
 	if err != nil {
-		console.Fatal("Failed to get cache info: %s", err)
+		console.Fatal("Failed to load config: %s", err)
 	}
 
-	if asJSON {
-		data, _ := json.MarshalIndent(info, "", "  ")
-		fmt.Println(string(data))
+	base, _ := cmd.Flags().GetString("base")
+	outputDir, _ := cmd.Flags().GetString("output")
+	force, _ := cmd.Flags().GetBool("force")
+	toStdout, _ := cmd.Flags().GetBool("stdout")
+
+	info := dockerfile.Info{ProjectRoot: projectRoot, BaseImage: base}
+	if lock, err := config.LoadLock(projectRoot); err == nil {
+		info.Lock = lock
+	} else {
+		console.Warning("No %s: package versions are resolved again when the image is built", config.LockFile)
+	}
+	content := dockerfile.Generate(cfg, info)
+	if toStdout {
+		fmt.Print(content)
 		return
 	}
 
-	fmt.Println()
-	console.Step("Cache Information")
-	fmt.Println()
-
-	console.Print("  ┌─ Location")
-	console.Print("  │  Path:       %s", info.Path)
-	console.Print("  │  Total size: %s", cache.FormatBytes(info.TotalSize))
-	fmt.Println()
+	if outputDir == "" {
+		outputDir = projectRoot
+	}
+	dockerfilePath := filepath.Join(outputDir, "Dockerfile")
+	if _, err := os.Stat(dockerfilePath); err == nil && !force {
+		console.Fatal("%s already exists (use --force to overwrite)", dockerfilePath)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		console.Fatal("Failed to create output directory: %s", err)
+	}
+	if err := os.WriteFile(dockerfilePath, []byte(content), 0644); err != nil {
+		console.Fatal("Failed to write Dockerfile: %s", err)
+	}
+	console.Success("Generated %s", dockerfilePath)
 
-	console.Print("  ┌─ Cached Runtimes (%d)", info.RuntimeCount)
-	if info.RuntimeCount == 0 {
-		console.Print("  │  No runtimes cached yet")
-	} else {
-		for _, r := range info.Runtimes {
-			console.Print("  │  • %s-%s (%s)", r.Language, r.Version, cache.FormatBytes(r.Size))
-			console.Print("  │    Last used: %s", r.LastUsed.Format("2006-01-02 15:04:05"))
+	// The build context is the project; keep sbox's state out of it
+	ignorePath := filepath.Join(projectRoot, ".dockerignore")
+	if _, err := os.Stat(ignorePath); os.IsNotExist(err) {
+		if err := os.WriteFile(ignorePath, []byte(dockerfile.DockerIgnore()), 0644); err != nil {
+			console.Warning("Failed to write .dockerignore: %s", err)
+		} else {
+			console.Info("Created %s", ignorePath)
 		}
 	}
-	fmt.Println()
 
-	console.Print("  ┌─ Micromamba")
-	if cm.IsMicromambaCached() {
-		mambaPath := cm.GetMicromambaPath()
-		if info, err := os.Stat(mambaPath); err == nil {
-			console.Print("  │  Status: Cached")
-			console.Print("  │  Size:   %s", cache.FormatBytes(info.Size()))
-			console.Print("  │  Path:   %s", mambaPath)
-		}
-	} else {
-		console.Print("  │  Status: Not cached")
+	for _, note := range dockerfile.Unsupported(cfg) {
+		console.Warning("Not reproduced: %s", note)
 	}
-	fmt.Println()
 
-	console.Print("  ┌─ Commands")
-	console.Print("  │  sbox cache list      List cached runtimes")
-	console.Print("  │  sbox cache clean     Remove all cached runtimes")
-	console.Print("  │  sbox cache prune     Remove old unused runtimes")
-	console.Print("  │  sbox cache path      Show cache directory path")
+	buildArgs := "."
+	if filepath.Clean(outputDir) != filepath.Clean(projectRoot) {
+		buildArgs = fmt.Sprintf("-f %s %s", dockerfilePath, projectRoot)
+	}
+	fmt.Println()
+	console.Print("  ┌─ To build it")
+	console.Print("  │  docker build -t %s %s", dockerfile.ImageName(projectRoot), buildArgs)
 	fmt.Println()
 }
 
-// Pack command handler
-
-func runPack(cmd *cobra.Command, args []string) {
+func runSlurm(cmd *cobra.Command, args []string) {
 	projectRoot, err := config.GetProjectRoot("")
 	if err != nil {
 		console.Fatal("Not in an sbox project. Run 'sbox init <name>' first.")
 	}
-
-	// Check if project is built
 	if !config.IsBuilt(projectRoot) {
 		console.Fatal("Project is not built. Run 'sbox build' first.")
 	}
 
-	outputPath, _ := cmd.Flags().GetString("output")
-	includeCache, _ := cmd.Flags().GetBool("include-cache")
-	excludeEnv, _ := cmd.Flags().GetBool("exclude-env")
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		console.Fatal("Failed to load config: %s", err)
+	}
 
-	projectName := filepath.Base(projectRoot)
+	name, _ := cmd.Flags().GetString("name")
+	scriptPath, _ := cmd.Flags().GetString("output")
+	submit, _ := cmd.Flags().GetBool("submit")
+	toStdout, _ := cmd.Flags().GetBool("stdout")
 
-	// Determine output file
-	if outputPath == "" {
-		outputPath = filepath.Join(projectRoot, fmt.Sprintf("%s-sbox.tar.gz", projectName))
+	options := cfg.Slurm
+	if v, _ := cmd.Flags().GetString("partition"); v != "" {
+		options.Partition = v
 	}
-	if len(args) > 0 {
-		outputPath = args[0]
+	if v, _ := cmd.Flags().GetString("time"); v != "" {
+		options.Time = v
 	}
-
-	// Make output path absolute
-	if !filepath.IsAbs(outputPath) {
-		outputPath = filepath.Join(projectRoot, outputPath)
+	if v, _ := cmd.Flags().GetString("gpus"); v != "" {
+		options.GPUs = v
+	}
+	if v, _ := cmd.Flags().GetInt("cpus"); v > 0 {
+		options.CPUs = v
+	}
+	if v, _ := cmd.Flags().GetString("memory"); v != "" {
+		options.Memory = v
+	}
+	if v, _ := cmd.Flags().GetString("account"); v != "" {
+		options.Account = v
+	}
+	if options.Time != "" && !slurm.ValidTime(options.Time) {
+		console.Fatal("Invalid time limit: %s (e.g. 30, 2:00:00, 1-12:00:00)", options.Time)
+	}
+	if options.Memory != "" && !slurm.ValidMemory(options.Memory) {
+		console.Fatal("Invalid memory: %s (e.g. 16G, 512M)", options.Memory)
+	}
+	if options.GPUs != "" && !slurm.ValidGPUs(options.GPUs) {
+		console.Fatal("Invalid gpus: %s (e.g. 1, a100:2)", options.GPUs)
 	}
 
-	console.Step("Packing sandbox: %s", projectName)
-	fmt.Println()
-
-	// Load config for metadata
-	cfg, err := config.Load(projectRoot)
-	if err != nil {
-		console.Fatal("Failed to load config: %s", err)
+	if name == "" {
+		name = filepath.Base(projectRoot)
+	}
+	if strings.ContainsAny(name, "/ ") {
+		console.Fatal("Job name cannot contain '/' or spaces")
 	}
 
-	// Create metadata
-	metadata := createPackMetadata(projectRoot, cfg)
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	if command == "" && cfg.Cmd == "" {
+		console.Fatal("No command specified and no default cmd in config")
+	}
 
-	// Create temporary directory for packing
-	tmpDir, err := os.MkdirTemp("", "sbox-pack-")
+	self, err := os.Executable()
 	if err != nil {
-		console.Fatal("Failed to create temp directory: %s", err)
+		console.Fatal("Failed to locate the sbox binary: %s", err)
 	}
-	defer os.RemoveAll(tmpDir)
-
-	packDir := filepath.Join(tmpDir, projectName)
-	sboxPackDir := filepath.Join(packDir, ".sbox")
 
-	// Create pack directory structure
-	if err := os.MkdirAll(sboxPackDir, 0755); err != nil {
-		console.Fatal("Failed to create pack directory: %s", err)
+	pm := process.NewProcessManager(projectRoot)
+	job := slurm.Job{
+		Name:        name,
+		ProjectRoot: projectRoot,
+		Command:     command,
+		Sbox:        self,
+		LogFile:     pm.GetLogFile(name),
+		Options:     options,
+	}
+	script := slurm.Script(job)
+	if toStdout {
+		fmt.Print(script)
+		return
 	}
 
-	// Copy .sbox/config.yaml
-	console.Step("Copying configuration...")
-	srcConfig := filepath.Join(config.GetSboxDir(projectRoot), "config.yaml")
-	dstConfig := filepath.Join(sboxPackDir, "config.yaml")
-	if err := copyFileForPack(srcConfig, dstConfig); err != nil {
-		console.Fatal("Failed to copy config: %s", err)
+	if scriptPath == "" {
+		scriptPath = filepath.Join(config.GetSboxDir(projectRoot), "slurm", name+".sbatch")
 	}
-
-	// Copy .sbox/rootfs/
-	console.Step("Copying rootfs...")
-	srcRootfs := config.GetRootfsDir(projectRoot)
-	dstRootfs := filepath.Join(sboxPackDir, "rootfs")
-	if _, err := os.Stat(srcRootfs); err == nil {
-		if err := copyDirForPack(srcRootfs, dstRootfs); err != nil {
-			console.Fatal("Failed to copy rootfs: %s", err)
-		}
-		console.Info("Copied rootfs (%s)", formatBytes(getDirSize(dstRootfs)))
+	if err := os.MkdirAll(filepath.Dir(scriptPath), 0755); err != nil {
+		console.Fatal("Failed to create script directory: %s", err)
 	}
-
-	// Copy .sbox/env/ (runtime environment)
-	if !excludeEnv {
-		console.Step("Copying runtime environment...")
-		srcEnv := config.GetEnvDir(projectRoot)
-		dstEnv := filepath.Join(sboxPackDir, "env")
-		if _, err := os.Stat(srcEnv); err == nil {
-			if err := copyDirForPack(srcEnv, dstEnv); err != nil {
-				console.Fatal("Failed to copy env: %s", err)
-			}
-			console.Info("Copied env (%s)", formatBytes(getDirSize(dstEnv)))
-		}
-	} else {
-		console.Info("Excluding runtime environment (--exclude-env)")
+	if err := os.WriteFile(scriptPath, []byte(script), 0755); err != nil {
+		console.Fatal("Failed to write script: %s", err)
 	}
 
-	// Copy .sbox/bin/ (micromamba)
-	if !excludeEnv {
-		srcBin := filepath.Join(config.GetSboxDir(projectRoot), "bin")
-		dstBin := filepath.Join(sboxPackDir, "bin")
-		if _, err := os.Stat(srcBin); err == nil {
-			if err := copyDirForPack(srcBin, dstBin); err != nil {
-				console.Warning("Failed to copy bin: %s", err)
-			}
-		}
+	if !submit {
+		console.Success("Generated sbatch script: %s", scriptPath)
+		console.Print("  Submit it with 'sbatch %s', or run 'sbox slurm --submit' to track it in 'sbox ps'.", scriptPath)
+		return
 	}
 
-	// Optionally include mamba cache
-	if includeCache {
-		console.Step("Copying mamba cache...")
-		srcMamba := filepath.Join(config.GetSboxDir(projectRoot), "mamba")
-		dstMamba := filepath.Join(sboxPackDir, "mamba")
-		if _, err := os.Stat(srcMamba); err == nil {
-			if err := copyDirForPack(srcMamba, dstMamba); err != nil {
-				console.Warning("Failed to copy mamba cache: %s", err)
-			} else {
-				console.Info("Copied mamba cache (%s)", formatBytes(getDirSize(dstMamba)))
-			}
-		}
+	if !slurm.Available() {
+		console.Fatal("sbatch not found; submit from a Slurm login node")
 	}
-
-	// Copy sbox.lock
-	srcLock := config.GetLockPath(projectRoot)
-	dstLock := filepath.Join(packDir, "sbox.lock")
-	if _, err := os.Stat(srcLock); err == nil {
-		copyFileForPack(srcLock, dstLock)
+	if existing, _ := pm.GetProcess(name); existing != nil && existing.IsAlive() {
+		console.Fatal("'%s' is already active (%s). Use 'sbox stop %s' first or pick another --name.", name, existing.Ref(), name)
 	}
-
-	// Write metadata.json
-	console.Step("Writing metadata...")
-	metadataPath := filepath.Join(packDir, "metadata.json")
-	metadataBytes, _ := json.MarshalIndent(metadata, "", "  ")
-	if err := os.WriteFile(metadataPath, metadataBytes, 0644); err != nil {
-		console.Fatal("Failed to write metadata: %s", err)
+	if err := pm.EnsureLogDir(); err != nil {
+		console.Fatal("Failed to create log directory: %s", err)
 	}
+	auditCommand(projectRoot, cmd)
 
-	// Create README for the archive
-	readmePath := filepath.Join(packDir, "README.txt")
-	readmeContent := fmt.Sprintf(`sbox Portable Archive
-=====================
-
-Project: %s
-Runtime: %s
-Packed:  %s
-
-How to use:
------------
-1. Extract this archive:
-   tar -xzf %s
-
-2. Navigate to the extracted directory:
-   cd %s
+	jobID, err := slurm.Submit(scriptPath)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
 
-3. Run the sandbox:
-   sbox run
+	displayCommand := command
+	if displayCommand == "" {
+		displayCommand = cfg.Cmd
+	}
+	err = pm.AddProcess(process.ProcessInfo{
+		Name:      name,
+		Command:   displayCommand,
+		StartTime: time.Now(),
+		Status:    "queued",
+		LogFile:   job.LogFile,
+		Project:   pm.ProjectName,
+		SlurmJob:  jobID,
+	})
+	if err != nil {
+		console.Warning("Submitted job %s but failed to track it: %s", jobID, err)
+		return
+	}
 
-Note: You need sbox installed on the target system.
-      Install from: https://github.com/CVPaul/sbox
+	console.Success("Submitted batch job %s (%s)", jobID, name)
+	console.Print("  Check its state with 'sbox ps', output with 'sbox logs %s', cancel with 'sbox stop %s'.", name, name)
+}
 
-Security:
----------
-Always inspect the contents before running:
-- Check .sbox/config.yaml for the command that will run
-- Review .sbox/rootfs/ for the application files
-- Verify metadata.json for build information
+// supportedPlatforms lists the platform keys sbox can build for
+func supportedPlatforms() []string {
+	var platforms []string
+	for key := range config.MicromambaURLs {
+		platforms = append(platforms, key)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
 
-This archive uses standard tar+gzip format and can be
-inspected with any standard tools before extraction.
-`, projectName, cfg.Runtime, metadata["packed_at"], filepath.Base(outputPath), projectName)
+// packFilter merges the pack section of the config with the pack flags
+func packFilter(cmd *cobra.Command, cfg *config.Config) *pack.Filter {
+	excludeLogs, _ := cmd.Flags().GetBool("exclude-logs")
+	excludeVolumes, _ := cmd.Flags().GetBool("exclude-volumes")
+	excludeCaches, _ := cmd.Flags().GetBool("exclude-caches")
+	patterns, _ := cmd.Flags().GetStringSlice("exclude")
 
-	if err := os.WriteFile(readmePath, []byte(readmeContent), 0644); err != nil {
-		console.Warning("Failed to write README: %s", err)
+	filter := &pack.Filter{
+		ExcludeLogs:    excludeLogs || cfg.Pack.ExcludeLogs,
+		ExcludeVolumes: excludeVolumes || cfg.Pack.ExcludeVolumes,
+		ExcludeCaches:  excludeCaches || cfg.Pack.ExcludeCaches,
+		Exclude:        append(append([]string{}, cfg.Pack.Exclude...), patterns...),
+	}
+	for _, spec := range cfg.ParseMount() {
+		filter.Volumes = append(filter.Volumes, strings.Trim(filepath.ToSlash(spec.Dst), "/"))
 	}
+	return filter
+}
 
-	// Create tar.gz archive
-	console.Step("Creating archive...")
-	
-	// Use system tar for better compatibility and symlink handling
-	tarCmd := fmt.Sprintf("cd %s && tar -czf %s %s", tmpDir, outputPath, projectName)
-	execCmd := exec.Command("sh", "-c", tarCmd)
-	execCmd.Stderr = os.Stderr
-	if err := execCmd.Run(); err != nil {
-		console.Fatal("Failed to create archive: %s", err)
+// printPackEstimate shows what the archive will contain before copying
+func printPackEstimate(projectRoot string, filter *pack.Filter, excludeEnv bool) bool {
+	type tree struct{ name, path string }
+	trees := []tree{{"rootfs", config.GetRootfsDir(projectRoot)}}
+	if !excludeEnv {
+		trees = append(trees, tree{"env", config.GetEnvDir(projectRoot)})
 	}
 
-	// Get archive info
-	archiveInfo, err := os.Stat(outputPath)
-	if err != nil {
-		console.Fatal("Failed to stat archive: %s", err)
+	excluded := make(map[string]int64)
+	var total int64
+	console.Step("Estimating archive contents...")
+	for _, t := range trees {
+		if _, err := os.Stat(t.path); err != nil {
+			continue
+		}
+		est, err := filter.Estimate(t.path)
+		if err != nil {
+			return false
+		}
+		console.Print("  %-8s %10s  (%d files)", t.name, formatBytes(est.Size), est.Files)
+		total += est.Size
+		for reason, size := range est.Excluded {
+			excluded[reason] += size
+		}
 	}
+	console.Print("  %-8s %10s  before compression", "total", formatBytes(total))
 
-	fmt.Println()
-	console.Success("Archive created successfully!")
-	fmt.Println()
-	console.Print("  ┌─ Archive Details")
-	console.Print("  │  File:    %s", outputPath)
-	console.Print("  │  Size:    %s", formatBytes(archiveInfo.Size()))
-	console.Print("  │  Runtime: %s", cfg.Runtime)
-	if excludeEnv {
-		console.Print("  │  Note:    Runtime excluded (recipient must run 'sbox build')")
+	for _, reason := range []string{pack.ReasonLogs, pack.ReasonVolumes, pack.ReasonCaches, pack.ReasonPatterns} {
+		if size, ok := excluded[reason]; ok {
+			console.Print("  excluded %-9s %s", reason+":", formatBytes(size))
+		}
 	}
 	fmt.Println()
-	console.Print("  ┌─ To use this archive")
-	console.Print("  │  1. Copy to target machine")
-	console.Print("  │  2. Extract: tar -xzf %s", filepath.Base(outputPath))
-	console.Print("  │  3. Run:     cd %s && sbox run", projectName)
-	fmt.Println()
+	return true
+}
+
+// packTime is when an archive is packed: $SOURCE_DATE_EPOCH when set,
+// for reproducible archives, or now
+func packTime() time.Time {
+	if epoch, err := archive.SourceDateEpoch(); err == nil && !epoch.IsZero() {
+		return epoch
+	}
+	return time.Now()
 }
 
 func createPackMetadata(projectRoot string, cfg *config.Config) map[string]interface{} {
 	metadata := map[string]interface{}{
 		"sbox_version":    version,
-		"packed_at":       time.Now().Format(time.RFC3339),
+		"packed_at":       packTime().Format(time.RFC3339),
 		"project_name":    filepath.Base(projectRoot),
 		"runtime":         cfg.Runtime,
 		"workdir":         cfg.Workdir,
@@ -1789,8 +9104,12 @@ func createPackMetadata(projectRoot string, cfg *config.Config) map[string]inter
 		}
 	}
 
-	// Add platform info
+	// Add platform info, checked against the target host by unpack
 	metadata["platform"] = config.GetPlatformKey()
+	metadata["arch"] = runtime.GOARCH
+	if floor := compat.EnvGlibcFloor(config.GetEnvDir(projectRoot)); floor != "" {
+		metadata["glibc_floor"] = floor
+	}
 
 	// Add file counts
 	rootfsDir := config.GetRootfsDir(projectRoot)
@@ -1841,7 +9160,7 @@ func copyFileForPack(src, dst string) error {
 	return err
 }
 
-func copyDirForPack(src, dst string) error {
+func copyDirForPack(src, dst string, filter *pack.Filter) error {
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -1852,6 +9171,13 @@ func copyDirForPack(src, dst string) error {
 			return err
 		}
 
+		if relPath != "." && filter.Match(relPath, info.IsDir()) != "" {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		targetPath := filepath.Join(dst, relPath)
 
 		// Handle symlinks
@@ -1902,26 +9228,140 @@ func formatBytes(bytes int64) string {
 func runUnpack(cmd *cobra.Command, args []string) {
 	verbose, _ := cmd.Flags().GetBool("verbose")
 	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	relocateTo, _ := cmd.Flags().GetString("relocate-to")
 
-	// Determine project directory
-	var projectRoot string
-	var err error
-	if len(args) > 0 {
-		projectRoot, err = filepath.Abs(args[0])
+	// Determine project directories
+	var projectRoots []string
+	if len(args) == 0 {
+		cwd, err := os.Getwd()
+		if err != nil {
+			console.Fatal("Failed to get working directory: %s", err)
+		}
+		projectRoots = append(projectRoots, cwd)
+	}
+	for _, arg := range args {
+		projectRoot, err := filepath.Abs(arg)
 		if err != nil {
 			console.Fatal("Invalid path: %s", err)
 		}
+		// Volumes of a split archive are joined rather than relocated
+		if info, err := os.Stat(projectRoot); err != nil || !info.IsDir() {
+			if err := joinArchive(projectRoot); err != nil {
+				console.Fatal("%s", err)
+			}
+			continue
+		}
+		projectRoots = append(projectRoots, projectRoot)
+	}
+	if len(args) > 0 && len(projectRoots) == 0 {
+		return
+	}
+
+	if relocateTo != "" {
+		var err error
+		relocateTo, err = filepath.Abs(relocateTo)
+		if err != nil {
+			console.Fatal("Invalid --relocate-to path: %s", err)
+		}
+	}
+
+	if len(projectRoots) == 1 {
+		targetRoot := projectRoots[0]
+		if relocateTo != "" {
+			targetRoot = relocateTo
+		}
+		if err := unpackProject(cmd, projectRoots[0], targetRoot, dryRun, verbose); err != nil {
+			console.Fatal("%s", err)
+		}
+		return
+	}
+
+	// Batch mode: --relocate-to names the parent directory the projects
+	// will be moved into
+	var failed []string
+	for i, projectRoot := range projectRoots {
+		console.Print("━━━ [%d/%d] %s", i+1, len(projectRoots), projectRoot)
+		targetRoot := projectRoot
+		if relocateTo != "" {
+			targetRoot = filepath.Join(relocateTo, filepath.Base(projectRoot))
+		}
+		if err := unpackProject(cmd, projectRoot, targetRoot, dryRun, verbose); err != nil {
+			console.Error("%s", err)
+			failed = append(failed, filepath.Base(projectRoot))
+		}
+	}
+
+	fmt.Println()
+	if len(failed) > 0 {
+		console.Fatal("Relocated %d of %d projects (failed: %s)", len(projectRoots)-len(failed), len(projectRoots), strings.Join(failed, ", "))
+	}
+	console.Success("Relocated %d projects", len(projectRoots))
+}
+
+// joinArchive joins the volumes of a split archive after checking them
+// against <archive>.sha256. Extracting stays with the user, as for any
+// archive.
+func joinArchive(path string) error {
+	name, parts, err := archive.Parts(path)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 1 && parts[0] == name {
+		compression := archive.CompressionOf(name)
+		if compression == "" {
+			return fmt.Errorf("%s is not a directory or a split archive", path)
+		}
+		return fmt.Errorf("%s is an archive, not a directory; extract it first with: %s", filepath.Base(name), archive.ExtractCommand(filepath.Base(name), compression, false))
+	}
+
+	console.Step("Joining %d volumes of %s", len(parts), filepath.Base(name))
+	checked, err := pack.CheckSumFile(name)
+	if err != nil {
+		return err
+	}
+	if checked {
+		console.Success("Volumes match %s.sha256", filepath.Base(name))
 	} else {
-		projectRoot, err = os.Getwd()
-		if err != nil {
-			console.Fatal("Failed to get working directory: %s", err)
-		}
+		console.Warning("No %s.sha256 next to the volumes; they are not checked", filepath.Base(name))
+	}
+	if _, _, err := archive.Join(path); err != nil {
+		return err
+	}
+	console.Success("Joined into %s", name)
+
+	compression := archive.CompressionOf(name)
+	if compression == "" {
+		compression = archive.Gzip
 	}
+	console.Print("    → Extract: %s", archive.ExtractCommand(filepath.Base(name), compression, false))
+	console.Print("    → Then:    cd <project> && sbox unpack")
+	return nil
+}
 
+// unpackProject rewrites the paths of the extracted project at projectRoot
+// for targetRoot, its final location (usually projectRoot itself)
+func unpackProject(cmd *cobra.Command, projectRoot, targetRoot string, dryRun, verbose bool) error {
 	// Verify this is an sbox project
 	sboxDir := filepath.Join(projectRoot, ".sbox")
 	if _, err := os.Stat(sboxDir); os.IsNotExist(err) {
-		console.Fatal("Not an sbox project. No .sbox directory found at: %s", projectRoot)
+		return fmt.Errorf("not an sbox project, no .sbox directory found at: %s", projectRoot)
+	}
+
+	// Check the extracted files before anything is written to them
+	verify, _ := cmd.Flags().GetBool("verify")
+	verifyKey, _ := cmd.Flags().GetString("verify-key")
+	if verify || verifyKey != "" {
+		if _, err := os.Stat(filepath.Join(sboxDir, relocate.JournalFile)); err == nil {
+			return fmt.Errorf("cannot verify checksums: an interrupted relocation already rewrote files")
+		}
+		if err := verifyPacked(projectRoot, "", verifyKey); err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+
+	if !dryRun {
+		auditCommand(projectRoot, cmd)
 	}
 
 	projectName := filepath.Base(projectRoot)
@@ -1941,6 +9381,15 @@ func runUnpack(cmd *cobra.Command, args []string) {
 				originalPrefix = prefix
 			}
 		}
+
+		// Refuse archives this host cannot run before touching anything
+		var archive compat.Archive
+		if err := json.Unmarshal(metadataBytes, &archive); err == nil {
+			force, _ := cmd.Flags().GetBool("force")
+			if err := checkArchiveCompat(archive, force); err != nil {
+				return err
+			}
+		}
 	}
 
 	// If no metadata, try to detect from env.sh
@@ -1962,52 +9411,110 @@ func runUnpack(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	// Check if relocation is needed
-	if originalPrefix == projectRoot {
-		console.Success("No relocation needed - paths already match current location")
-		return
+	binDir := filepath.Join(sboxDir, "env", "bin")
+
+	// Resume an interrupted relocation, or repair one that left no journal
+	journal, err := relocate.Load(projectRoot)
+	if err != nil {
+		return fmt.Errorf("failed to read relocation journal: %w", err)
+	}
+
+	if journal != nil {
+		if journal.To != targetRoot {
+			return fmt.Errorf("an interrupted relocation to %s has not finished; complete it first with: sbox unpack %s --relocate-to %s", journal.To, projectRoot, journal.To)
+		}
+		console.Warning("Resuming interrupted relocation started at %s (%d steps already done)", journal.StartedAt.Format(time.RFC3339), journal.Completed())
+		originalPrefix = journal.From
+	} else if originalPrefix == targetRoot || originalPrefix == "" {
+		var stale []string
+		for _, prefix := range relocate.ScriptPrefixes(binDir) {
+			if prefix != targetRoot {
+				stale = append(stale, prefix)
+			}
+		}
+		if len(stale) > 0 {
+			console.Warning("Environment is partially relocated: scripts still reference %s", stale[0])
+			originalPrefix = stale[0]
+		} else if originalPrefix == targetRoot {
+			console.Success("No relocation needed - paths already match %s", targetRoot)
+			return nil
+		}
 	}
 
 	if originalPrefix == "" {
 		console.Warning("Could not determine original prefix. Will regenerate env.sh from scratch.")
 	} else {
 		console.Info("Original prefix: %s", originalPrefix)
-		console.Info("New prefix:      %s", projectRoot)
+		console.Info("New prefix:      %s", targetRoot)
 	}
 
 	fmt.Println()
 	stats := &unpackStats{}
 
+	// Every rewritten file is journaled so a rerun skips it
+	if !dryRun && journal == nil {
+		journal, err = relocate.Begin(projectRoot, originalPrefix, targetRoot)
+		if err != nil {
+			return fmt.Errorf("failed to start relocation journal: %w", err)
+		}
+	}
+
 	// 1. Regenerate env.sh
 	console.Step("Regenerating environment script...")
-	if err := regenerateEnvSh(projectRoot, dryRun, verbose); err != nil {
-		console.Fatal("Failed to regenerate env.sh: %s", err)
+	if !journal.Done("env.sh") {
+		if err := regenerateEnvSh(projectRoot, targetRoot, dryRun, verbose); err != nil {
+			return fmt.Errorf("failed to regenerate env.sh: %w", err)
+		}
+		if !dryRun {
+			if err := journal.Mark("env.sh"); err != nil {
+				return fmt.Errorf("failed to update relocation journal: %w", err)
+			}
+		}
 	}
 	stats.envShUpdated = true
+	if !dryRun {
+		if err := ide.Relocate(projectRoot, originalPrefix, targetRoot); err != nil {
+			console.Warning("Failed to update %s: %s", ide.File, err)
+		}
+	}
 
 	// 2. Fix conda-meta JSON files
 	console.Step("Updating conda metadata...")
 	condaMetaDir := filepath.Join(sboxDir, "env", "conda-meta")
 	if _, err := os.Stat(condaMetaDir); err == nil {
-		count, err := fixCondaMeta(condaMetaDir, originalPrefix, projectRoot, dryRun, verbose)
+		count, err := fixCondaMeta(condaMetaDir, originalPrefix, targetRoot, journal, dryRun, verbose)
 		if err != nil {
-			console.Warning("Error updating conda metadata: %s", err)
+			return fmt.Errorf("failed to update conda metadata: %w", err)
 		}
 		stats.condaMetaFiles = count
 	}
 
 	// 3. Fix shebang lines in bin/ scripts
 	console.Step("Checking scripts for path references...")
-	binDir := filepath.Join(sboxDir, "env", "bin")
 	if _, err := os.Stat(binDir); err == nil && originalPrefix != "" {
-		count, err := fixShebangs(binDir, originalPrefix, projectRoot, dryRun, verbose)
+		count, err := fixShebangs(binDir, originalPrefix, targetRoot, journal, dryRun, verbose)
 		if err != nil {
-			console.Warning("Error fixing shebangs: %s", err)
+			return fmt.Errorf("failed to fix shebangs: %w", err)
 		}
 		stats.scriptsFixed = count
 	}
 
-	// 4. Update sbox.lock
+	// 4. Fix the prefix embedded in compiled libraries and executables
+	console.Step("Relocating binary prefixes...")
+	envDir := filepath.Join(sboxDir, "env")
+	if _, err := os.Stat(envDir); err == nil && originalPrefix != "" {
+		fixed, skipped, err := fixBinaryPrefixes(envDir, originalPrefix, targetRoot, journal, dryRun, verbose)
+		if err != nil {
+			return fmt.Errorf("failed to relocate binaries: %w", err)
+		}
+		stats.binariesFixed = fixed
+		if skipped > 0 {
+			console.Warning("%d binary file(s) still reference %s: the new prefix is %d characters longer", skipped, originalPrefix, len(targetRoot)-len(originalPrefix))
+			console.Print("    → Binary prefixes are rewritten in place; relocate to a path of at most %d characters, or rebuild with 'sbox build --frozen'", len(originalPrefix))
+		}
+	}
+
+	// 5. Update sbox.lock
 	console.Step("Updating lock file...")
 	if err := updateLockFile(projectRoot, dryRun, verbose); err != nil {
 		if verbose {
@@ -2017,23 +9524,29 @@ func runUnpack(cmd *cobra.Command, args []string) {
 		stats.lockUpdated = true
 	}
 
-	// 5. Update metadata.json with new prefix
+	// 6. Update metadata.json with new prefix
 	if _, err := os.Stat(metadataPath); err == nil {
 		console.Step("Updating metadata...")
-		if err := updateMetadata(metadataPath, projectRoot, dryRun, verbose); err != nil {
+		if err := updateMetadata(metadataPath, targetRoot, dryRun, verbose); err != nil {
 			console.Warning("Could not update metadata: %s", err)
 		} else {
 			stats.metadataUpdated = true
 		}
 	}
 
+	if !dryRun {
+		if err := journal.Finish(); err != nil {
+			console.Warning("Could not remove relocation journal: %s", err)
+		}
+	}
+
 	// Print summary
 	fmt.Println()
 	console.Success("Path relocation complete!")
 	fmt.Println()
 	console.Print("  ┌─ Relocation Summary")
 	console.Print("  │  Project:           %s", projectName)
-	console.Print("  │  New location:      %s", projectRoot)
+	console.Print("  │  New location:      %s", targetRoot)
 	if stats.envShUpdated {
 		console.Print("  │  env.sh:            regenerated")
 	}
@@ -2043,6 +9556,9 @@ func runUnpack(cmd *cobra.Command, args []string) {
 	if stats.scriptsFixed > 0 {
 		console.Print("  │  scripts fixed:     %d", stats.scriptsFixed)
 	}
+	if stats.binariesFixed > 0 {
+		console.Print("  │  binaries fixed:    %d", stats.binariesFixed)
+	}
 	if stats.lockUpdated {
 		console.Print("  │  sbox.lock:         updated")
 	}
@@ -2056,34 +9572,69 @@ func runUnpack(cmd *cobra.Command, args []string) {
 
 	if dryRun {
 		console.Info("Dry run complete. Run without --dry-run to apply changes.")
+	} else if targetRoot != projectRoot {
+		console.Print("  ┌─ Next Steps")
+		console.Print("  │  1. Move into place: mv %s %s", projectRoot, targetRoot)
+		console.Print("  │  2. Review config:   cat %s", filepath.Join(targetRoot, config.SboxDir, config.ConfigFile))
+		console.Print("  │  3. Run sandbox:     sbox run")
+		fmt.Println()
 	} else {
 		console.Print("  ┌─ Next Steps")
 		console.Print("  │  1. Review config:  cat .sbox/config.yaml")
 		console.Print("  │  2. Run sandbox:    sbox run")
 		fmt.Println()
 	}
+	return nil
 }
 
 type unpackStats struct {
 	envShUpdated    bool
 	condaMetaFiles  int
 	scriptsFixed    int
+	binariesFixed   int
 	lockUpdated     bool
 	metadataUpdated bool
 }
 
-// regenerateEnvSh creates a new env.sh with correct paths
-func regenerateEnvSh(projectRoot string, dryRun, verbose bool) error {
+// checkArchiveCompat reports host incompatibilities of an archive and
+// fails on fatal ones unless forced
+func checkArchiveCompat(archive compat.Archive, force bool) error {
+	fatal := 0
+	for _, problem := range compat.Check(archive) {
+		if problem.Fatal {
+			fatal++
+			if !force {
+				console.Error("Incompatible archive: %s", problem.Message)
+			} else {
+				console.Warning("Incompatible archive: %s", problem.Message)
+			}
+		} else {
+			console.Warning("%s", problem.Message)
+		}
+		if problem.Hint != "" {
+			console.Print("    → %s", problem.Hint)
+		}
+	}
+
+	if fatal > 0 && !force {
+		return fmt.Errorf("archive is not compatible with this host (use --force to unpack anyway)")
+	}
+	return nil
+}
+
+// regenerateEnvSh creates a new env.sh in projectRoot with paths for
+// targetRoot, the project's final location
+func regenerateEnvSh(projectRoot, targetRoot string, dryRun, verbose bool) error {
 	// Load config to get env vars
 	cfg, err := config.Load(projectRoot)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	envDir := config.GetEnvDir(projectRoot)
-	rootfs := config.GetRootfsDir(projectRoot)
-	sboxDir := config.GetSboxDir(projectRoot)
-	scriptPath := filepath.Join(sboxDir, config.EnvScript)
+	envDir := config.GetEnvDir(targetRoot)
+	rootfs := config.GetRootfsDir(targetRoot)
+	sboxDir := config.GetSboxDir(targetRoot)
+	scriptPath := filepath.Join(config.GetSboxDir(projectRoot), config.EnvScript)
 
 	content := fmt.Sprintf(`#!/bin/bash
 # sbox environment activation script
@@ -2110,13 +9661,21 @@ export TMPDIR="%s/tmp"
 export CONDA_PREFIX="%s"
 export MAMBA_ROOT_PREFIX="%s/mamba"
 
-`, time.Now().Format(time.RFC3339), projectRoot, envDir, rootfs, rootfs, envDir, sboxDir)
+# Conda packages' activation scripts (CUDA paths, PROJ_LIB, ...)
+for script in "$CONDA_PREFIX"/etc/conda/activate.d/*.sh; do
+  [ -f "$script" ] && . "$script"
+done
+unset script
+
+`, time.Now().Format(time.RFC3339), targetRoot, envDir, rootfs, rootfs, envDir, sboxDir)
 
 	// Add custom env vars from config
-	for key, value := range cfg.Env {
+	for key, value := range cfg.Raw().Env {
 		content += fmt.Sprintf("export %s=\"%s\"\n", key, value)
 	}
 
+	content += builder.HostLibsScript(envDir, cfg.HostLibs)
+
 	content += `
 echo "sbox environment activated"
 echo "Project: $SBOX_PROJECT"
@@ -2130,11 +9689,11 @@ echo "Project: $SBOX_PROJECT"
 		return nil
 	}
 
-	return os.WriteFile(scriptPath, []byte(content), 0755)
+	return relocate.WriteFile(scriptPath, []byte(content), 0755)
 }
 
 // fixCondaMeta updates prefix paths in conda-meta/*.json files
-func fixCondaMeta(condaMetaDir, oldPrefix, newPrefix string, dryRun, verbose bool) (int, error) {
+func fixCondaMeta(condaMetaDir, oldPrefix, newPrefix string, journal *relocate.Journal, dryRun, verbose bool) (int, error) {
 	if oldPrefix == "" {
 		return 0, nil
 	}
@@ -2150,26 +9709,30 @@ func fixCondaMeta(condaMetaDir, oldPrefix, newPrefix string, dryRun, verbose boo
 			continue
 		}
 
-		filePath := filepath.Join(condaMetaDir, entry.Name())
-		content, err := os.ReadFile(filePath)
-		if err != nil {
+		key := "conda-meta/" + entry.Name()
+		if journal.Done(key) {
 			continue
 		}
 
-		// Check if file contains old prefix
-		if !strings.Contains(string(content), oldPrefix) {
+		filePath := filepath.Join(condaMetaDir, entry.Name())
+		changed, err := relocate.ReplacePrefix(filePath, oldPrefix, newPrefix, dryRun)
+		if errors.Is(err, relocate.ErrTooLarge) || errors.Is(err, relocate.ErrPrefixTooLong) {
+			console.Warning("  Skipping %s: %s", entry.Name(), err)
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		if !changed {
 			continue
 		}
-
-		// Replace old prefix with new prefix
-		newContent := strings.ReplaceAll(string(content), oldPrefix, newPrefix)
 
 		if verbose {
 			console.Info("  Updating: %s", entry.Name())
 		}
 
 		if !dryRun {
-			if err := os.WriteFile(filePath, []byte(newContent), 0644); err != nil {
+			if err := journal.Mark(key); err != nil {
 				return count, err
 			}
 		}
@@ -2180,7 +9743,7 @@ func fixCondaMeta(condaMetaDir, oldPrefix, newPrefix string, dryRun, verbose boo
 }
 
 // fixShebangs updates shebang lines in scripts that reference the old prefix
-func fixShebangs(binDir, oldPrefix, newPrefix string, dryRun, verbose bool) (int, error) {
+func fixShebangs(binDir, oldPrefix, newPrefix string, journal *relocate.Journal, dryRun, verbose bool) (int, error) {
 	count := 0
 	entries, err := os.ReadDir(binDir)
 	if err != nil {
@@ -2192,6 +9755,11 @@ func fixShebangs(binDir, oldPrefix, newPrefix string, dryRun, verbose bool) (int
 			continue
 		}
 
+		key := "bin/" + entry.Name()
+		if journal.Done(key) {
+			continue
+		}
+
 		filePath := filepath.Join(binDir, entry.Name())
 
 		// Check if it's a symlink
@@ -2203,29 +9771,29 @@ func fixShebangs(binDir, oldPrefix, newPrefix string, dryRun, verbose bool) (int
 			continue // Skip symlinks
 		}
 
-		// Read first few bytes to check if it's a text file with shebang
-		content, err := os.ReadFile(filePath)
-		if err != nil {
+		// Only scripts; compiled binaries are relocated by fixBinaryPrefixes
+		if !relocate.IsScript(filePath) {
 			continue
 		}
 
-		// Check if it starts with #! and contains old prefix
-		if !strings.HasPrefix(string(content), "#!") {
+		changed, err := relocate.ReplacePrefix(filePath, oldPrefix, newPrefix, dryRun)
+		if errors.Is(err, relocate.ErrTooLarge) || errors.Is(err, relocate.ErrPrefixTooLong) {
+			console.Warning("  Skipping %s: %s", entry.Name(), err)
 			continue
 		}
-		if !strings.Contains(string(content), oldPrefix) {
+		if err != nil {
+			return count, err
+		}
+		if !changed {
 			continue
 		}
 
-		// Replace old prefix with new prefix
-		newContent := strings.ReplaceAll(string(content), oldPrefix, newPrefix)
-
 		if verbose {
 			console.Info("  Fixing shebang: %s", entry.Name())
 		}
 
 		if !dryRun {
-			if err := os.WriteFile(filePath, []byte(newContent), info.Mode()); err != nil {
+			if err := journal.Mark(key); err != nil {
 				return count, err
 			}
 		}
@@ -2235,10 +9803,63 @@ func fixShebangs(binDir, oldPrefix, newPrefix string, dryRun, verbose bool) (int
 	return count, nil
 }
 
+// fixBinaryPrefixes rewrites the prefix in the compiled files of envDir
+// (RPATHs and embedded strings), padding each string with NULs to its
+// original length like conda-pack. Files where the new prefix does not
+// fit are counted as skipped.
+func fixBinaryPrefixes(envDir, oldPrefix, newPrefix string, journal *relocate.Journal, dryRun, verbose bool) (fixed, skipped int, err error) {
+	files, err := relocate.BinaryFiles(envDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, rel := range files {
+		key := "binary/" + filepath.ToSlash(rel)
+		if journal.Done(key) {
+			continue
+		}
+
+		// Scan first: most binaries do not embed the prefix, and
+		// rewriting every one would copy the whole environment
+		path := filepath.Join(envDir, rel)
+		found, err := relocate.ReplacePrefix(path, oldPrefix, newPrefix, true)
+		if errors.Is(err, relocate.ErrPrefixTooLong) {
+			if verbose {
+				console.Warning("  Skipping %s: %s", rel, err)
+			}
+			skipped++
+			continue
+		}
+		if errors.Is(err, relocate.ErrTooLarge) {
+			console.Warning("  Skipping %s: %s", rel, err)
+			continue
+		}
+		if err != nil {
+			return fixed, skipped, err
+		}
+		if !found {
+			continue
+		}
+
+		if verbose {
+			console.Info("  Relocating: %s", rel)
+		}
+		if !dryRun {
+			if _, err := relocate.ReplacePrefix(path, oldPrefix, newPrefix, false); err != nil {
+				return fixed, skipped, err
+			}
+			if err := journal.Mark(key); err != nil {
+				return fixed, skipped, err
+			}
+		}
+		fixed++
+	}
+
+	return fixed, skipped, nil
+}
+
 // updateLockFile updates the sbox.lock with current timestamp
 func updateLockFile(projectRoot string, dryRun, verbose bool) error {
-	lockPath := config.GetLockPath(projectRoot)
-
 	lock, err := config.LoadLock(projectRoot)
 	if err != nil {
 		// Create a minimal lock file if it doesn't exist
@@ -2260,17 +9881,8 @@ func updateLockFile(projectRoot string, dryRun, verbose bool) error {
 		return nil
 	}
 
-	// Write the lock file
-	content := fmt.Sprintf(`# sbox lock file
-# Auto-generated - do not edit
-
-version: %s
-config_hash: %s
-built_at: %s
-runtime: %s
-`, lock.Version, lock.ConfigHash, lock.BuiltAt, lock.Runtime)
-
-	return os.WriteFile(lockPath, []byte(content), 0644)
+	// Rewrite in the format LoadLock reads, keeping the package set
+	return config.WriteLock(projectRoot, lock)
 }
 
 // updateMetadata updates metadata.json with new prefix
@@ -2304,3 +9916,313 @@ func updateMetadata(metadataPath, newPrefix string, dryRun, verbose bool) error
 
 	return os.WriteFile(metadataPath, newContent, 0644)
 }
+
+// composeStartGrace is how long 'compose up' waits after starting a
+// service before starting its dependents, to catch immediate crashes
+const composeStartGrace = time.Second
+
+func loadComposeFile(cmd *cobra.Command) *compose.File {
+	path, _ := cmd.Flags().GetString("file")
+	f, err := compose.Load(path)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+	return f
+}
+
+func runComposeUp(cmd *cobra.Command, args []string) {
+	f := loadComposeFile(cmd)
+
+	order, err := f.Order(args)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	for _, name := range order {
+		if err := composeStart(f, name); err != nil {
+			console.Fatal("Service '%s': %s", name, err)
+		}
+	}
+
+	fmt.Println()
+	console.Print("  Use 'sbox compose logs -f' to view output")
+	console.Print("  Use 'sbox compose down' to stop all services")
+}
+
+// composeStart builds a service if needed and starts it as a daemon
+func composeStart(f *compose.File, name string) error {
+	svc := f.Services[name]
+	if err := f.Materialize(name); err != nil {
+		return fmt.Errorf("failed to generate project: %w", err)
+	}
+
+	root := f.ProjectRoot(name)
+	cfg, err := config.Load(root)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	pm := process.NewProcessManager(root)
+	if existing, _ := pm.GetProcess(name); existing != nil && (existing.Status == "running" || existing.Status == "paused") && process.IsProcessRunning(existing.PID) {
+		console.Info("%s is already running (PID %d)", name, existing.PID)
+		return nil
+	}
+
+	if err := validate.QuickValidate(cfg, root); err != nil {
+		return fmt.Errorf("configuration error: %w", err)
+	}
+
+	if !builder.UpToDate(root, cfg) {
+		console.Step("Building %s", name)
+		if err := buildProject(root, cfg, false, false, false, false); err != nil {
+			return fmt.Errorf("build failed: %w", err)
+		}
+	}
+
+	r, err := runner.New(root)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := r.CheckBuilt(); err != nil {
+		return err
+	}
+
+	command := svc.Cmd
+	if command == "" {
+		command = r.Config.Cmd
+	}
+	if command == "" {
+		return fmt.Errorf("no cmd in compose file or project config")
+	}
+
+	// Service env goes last so it overrides the project's
+	r.ServiceName = name
+	env := r.BuildEnv()
+	for key, value := range svc.Env {
+		env = append(env, fmt.Sprintf("%s=%s", key, os.ExpandEnv(value)))
+	}
+
+	workdir := r.ResolveWorkdir()
+	pm.Wrap, err = r.IsolationPrefix(workdir)
+	if err != nil {
+		return err
+	}
+	if !svc.Priority.IsZero() {
+		pm.Priority = svc.Priority
+	}
+	if svc.CPUs != "" {
+		pm.CPUs = svc.CPUs
+	}
+	if !svc.Ulimits.IsZero() {
+		pm.Ulimits = svc.Ulimits
+	}
+
+	tasks := append(append([]config.InitTask{}, r.Config.InitTasks...), svc.InitTasks...)
+	if err := runInitTasks(pm, name, tasks, env, workdir); err != nil {
+		return err
+	}
+
+	console.Step("Starting %s", name)
+	info, err := pm.StartDaemon(name, command, env, workdir)
+	if err != nil {
+		return fmt.Errorf("failed to start daemon: %w", err)
+	}
+	if err := startMeter(pm, info); err != nil {
+		console.Warning("Failed to start usage meter: %s", err)
+	}
+
+	if cfg.IdleTimeout != "" {
+		if idleTimeout, err := time.ParseDuration(cfg.IdleTimeout); err == nil {
+			if err := startIdleWatcher(pm, info, idleTimeout); err != nil {
+				console.Warning("Failed to start idle watcher: %s", err)
+			}
+		}
+	}
+
+	if len(f.Dependents(name)) > 0 {
+		time.Sleep(composeStartGrace)
+		if !process.IsProcessRunning(info.PID) {
+			return fmt.Errorf("exited right after starting; see 'sbox compose logs %s'", name)
+		}
+	}
+
+	console.Emit(console.LevelSuccess, console.Fields{"name": name, "pid": info.PID},
+		"Started %s (PID %d)", name, info.PID)
+	return nil
+}
+
+// initTaskLogLines is how much of a failed init task's log is shown
+const initTaskLogLines = 10
+
+// runInitTasks runs the init tasks of a service in order, stopping at the
+// first that fails
+func runInitTasks(pm *process.ProcessManager, service string, tasks []config.InitTask, env []string, workdir string) error {
+	for _, task := range tasks {
+		console.Step("Running init task %s of %s", task.Name, service)
+		started := time.Now()
+		code, err := pm.RunTask(task, env, workdir)
+		if err != nil {
+			return err
+		}
+		logName := config.InitTaskLog(task.Name)
+		if code != 0 {
+			lines, _ := pm.LastLogLines(logName, initTaskLogLines)
+			for _, line := range lines {
+				console.Print("    %s", line)
+			}
+			return fmt.Errorf("init task '%s' exited with status %d; its log is %s", task.Name, code, pm.GetLogFile(logName))
+		}
+		console.Emit(console.LevelSuccess, console.Fields{"service": service, "task": task.Name, "log": pm.GetLogFile(logName)},
+			"Init task %s finished in %s", task.Name, time.Since(started).Round(time.Millisecond))
+	}
+	return nil
+}
+
+func runComposeDown(cmd *cobra.Command, args []string) {
+	f := loadComposeFile(cmd)
+
+	// Stopping a service also stops everything that depends on it
+	selected := make(map[string]bool)
+	queue := append([]string{}, args...)
+	if len(queue) == 0 {
+		queue = f.Names()
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if _, ok := f.Services[name]; !ok {
+			console.Fatal("no such service: %s", name)
+		}
+		if selected[name] {
+			continue
+		}
+		selected[name] = true
+		queue = append(queue, f.Dependents(name)...)
+	}
+
+	order, err := f.Order(nil)
+	if err != nil {
+		console.Fatal("%s", err)
+	}
+
+	// Dependents first
+	stopped := 0
+	for i := len(order) - 1; i >= 0; i-- {
+		name := order[i]
+		if !selected[name] {
+			continue
+		}
+
+		root := f.ProjectRoot(name)
+		pm := process.NewProcessManager(root)
+		existing, _ := pm.GetProcess(name)
+		if existing == nil || !(existing.Status == "running" || existing.Status == "paused") || !process.IsProcessRunning(existing.PID) {
+			continue
+		}
+
+		auditCommand(root, cmd)
+		if err := pm.StopProcess(name); err != nil {
+			console.Error("Failed to stop %s: %s", name, err)
+			continue
+		}
+		console.Success("Stopped %s (PID %d)", name, existing.PID)
+		stopped++
+	}
+
+	if stopped == 0 {
+		console.Info("No running services to stop")
+	}
+}
+
+func runComposePs(cmd *cobra.Command, args []string) {
+	f := loadComposeFile(cmd)
+
+	fmt.Println()
+	fmt.Printf("  %-15s %-8s %-10s %-12s %s\n", "SERVICE", "PID", "STATUS", "UPTIME", "PROJECT")
+	fmt.Printf("  %-15s %-8s %-10s %-12s %s\n", "-------", "---", "------", "------", "-------")
+
+	for _, name := range f.Names() {
+		root := f.ProjectRoot(name)
+		pm := process.NewProcessManager(root)
+
+		pid, status, uptime := "-", "-", "-"
+		processes, _ := pm.UpdateProcessStatus()
+		for _, p := range processes {
+			if p.Name != name {
+				continue
+			}
+			pid = fmt.Sprintf("%d", p.PID)
+			status = p.Status
+			if p.Status == "running" || p.Status == "paused" {
+				uptime = formatDuration(time.Since(p.StartTime))
+			}
+		}
+
+		project := root
+		if rel, err := filepath.Rel(f.Dir(), root); err == nil {
+			project = rel
+		}
+
+		fmt.Printf("  %-15s %-8s %-10s %-12s %s\n", name, pid, status, uptime, project)
+	}
+	fmt.Println()
+}
+
+func runComposeLogs(cmd *cobra.Command, args []string) {
+	follow, _ := cmd.Flags().GetBool("follow")
+	lines, _ := cmd.Flags().GetInt("lines")
+
+	f := loadComposeFile(cmd)
+
+	names := args
+	if len(names) == 0 {
+		names = f.Names()
+	}
+
+	width := 0
+	for _, name := range names {
+		if _, ok := f.Services[name]; !ok {
+			console.Fatal("no such service: %s", name)
+		}
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+
+	var mu sync.Mutex
+	printLine := func(name, line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Printf("%-*s | %s\n", width, name, line)
+	}
+
+	for _, name := range names {
+		pm := process.NewProcessManager(f.ProjectRoot(name))
+		last, err := pm.LastLogLines(name, lines)
+		if err != nil {
+			continue
+		}
+		for _, line := range last {
+			printLine(name, line)
+		}
+	}
+
+	if !follow {
+		return
+	}
+
+	// Runs until interrupted
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for _, name := range names {
+		pm := process.NewProcessManager(f.ProjectRoot(name))
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := pm.FollowLog(name, done, func(line string) { printLine(name, line) }); err != nil {
+				console.Warning("%s: %s", name, err)
+			}
+		}(name)
+	}
+	wg.Wait()
+}
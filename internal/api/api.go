@@ -0,0 +1,275 @@
+// Package api exposes sbox project state over HTTP for the dashboard and
+// other programmatic clients.
+package api
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/process"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// Server serves the JSON API and the embedded dashboard for a set of projects
+type Server struct {
+	// ProjectRoots lists the project directories exposed by the server
+	ProjectRoots []string
+
+	// Exec is the sbox binary operations (build, run, stop) run; they
+	// and project registration are only served when it is set, as by
+	// 'sbox daemon' on its Unix socket
+	Exec string
+
+	mu sync.Mutex
+}
+
+// ProjectSummary is the overview of one project returned by /api/projects
+type ProjectSummary struct {
+	Name     string `json:"name"`
+	Root     string `json:"root"`
+	Runtime  string `json:"runtime"`
+	Built    bool   `json:"built"`
+	UpToDate bool   `json:"up_to_date"`
+	Running  int    `json:"running"`
+	Total    int    `json:"total"`
+	Health   string `json:"health"` // healthy, stale, unbuilt, error
+	Error    string `json:"error,omitempty"`
+}
+
+// ServiceStatus describes one tracked daemon
+type ServiceStatus struct {
+	process.ProcessInfo
+	Uptime  string `json:"uptime,omitempty"`
+	LogSize int64  `json:"log_size"`
+}
+
+// ProjectDetail is returned by /api/projects/<name>
+type ProjectDetail struct {
+	ProjectSummary
+	Workdir  string           `json:"workdir"`
+	Cmd      string           `json:"cmd"`
+	Lock     *config.LockData `json:"lock,omitempty"`
+	Services []ServiceStatus  `json:"services"`
+	Logs     []string         `json:"logs"`
+}
+
+// NewServer creates an API server for the given project roots
+func NewServer(projectRoots []string) *Server {
+	return &Server{ProjectRoots: projectRoots}
+}
+
+// Handler returns the HTTP handler for the API and dashboard
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/projects", s.handleProjects)
+	mux.HandleFunc("/api/projects/", s.handleProject)
+
+	static, _ := fs.Sub(staticFiles, "static")
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	return mux
+}
+
+// ListenAndServe serves the handler on addr
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+// Serve serves the handler on a listener until it is closed
+func (s *Server) Serve(l net.Listener) error {
+	return (&http.Server{Handler: s.Handler()}).Serve(l)
+}
+
+func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && s.Exec != "" {
+		s.handleRegister(w, r)
+		return
+	}
+	summaries := []ProjectSummary{}
+	for _, root := range s.roots() {
+		summaries = append(summaries, Summarize(root))
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// handleProject routes /api/projects/<name>[/builds|/logs/<proc>[/stream]]
+func (s *Server) handleProject(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/projects/"), "/"), "/")
+	root := s.findProject(parts[0])
+	if root == "" {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("project '%s' not found", parts[0]))
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		detail, err := Describe(root)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, detail)
+	case len(parts) == 2 && parts[1] == "builds":
+		history, err := config.LoadBuildHistory(root)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, history)
+	case len(parts) == 2 && s.Exec != "" && (parts[1] == OpBuild || parts[1] == OpRun || parts[1] == OpStop):
+		s.handleOperation(w, r, root, parts[1])
+	case len(parts) == 3 && parts[1] == "logs":
+		s.handleLogs(w, r, root, parts[2])
+	case len(parts) == 4 && parts[1] == "logs" && parts[3] == "stream":
+		s.handleLogStream(w, r, root, parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request, root, name string) {
+	lines := 200
+	if n, err := strconv.Atoi(r.URL.Query().Get("lines")); err == nil && n > 0 {
+		lines = n
+	}
+
+	pm := process.NewProcessManager(root)
+	logLines, err := pm.LastLogLines(name, lines)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "lines": logLines})
+}
+
+// handleLogStream tails a log as server-sent events
+func (s *Server) handleLogStream(w http.ResponseWriter, r *http.Request, root, name string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	pm := process.NewProcessManager(root)
+	pm.FollowLog(name, r.Context().Done(), func(line string) {
+		fmt.Fprintf(w, "data: %s\n\n", line)
+		flusher.Flush()
+	})
+}
+
+// roots returns the project roots, which the daemon adds to as projects
+// register
+func (s *Server) roots() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ProjectRoots...)
+}
+
+func (s *Server) findProject(name string) string {
+	for _, root := range s.roots() {
+		if filepath.Base(root) == name {
+			return root
+		}
+	}
+	return ""
+}
+
+// Summarize computes the overview for a project root
+func Summarize(root string) ProjectSummary {
+	summary := ProjectSummary{Name: filepath.Base(root), Root: root}
+
+	cfg, err := config.Load(root)
+	if err != nil {
+		summary.Health = "error"
+		summary.Error = err.Error()
+		return summary
+	}
+
+	pm := process.NewProcessManager(root)
+	running, _ := pm.GetRunningProcesses()
+	all, _ := pm.LoadProcesses()
+
+	summary.Runtime = cfg.Runtime
+	summary.Built = config.IsBuilt(root)
+	summary.UpToDate = config.IsUpToDate(root, cfg)
+	summary.Running = len(running)
+	summary.Total = len(all)
+
+	switch {
+	case !summary.Built:
+		summary.Health = "unbuilt"
+	case !summary.UpToDate:
+		summary.Health = "stale"
+	default:
+		summary.Health = "healthy"
+	}
+
+	return summary
+}
+
+// Describe returns the full state of a project
+func Describe(root string) (*ProjectDetail, error) {
+	cfg, err := config.Load(root)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &ProjectDetail{
+		ProjectSummary: Summarize(root),
+		Workdir:        cfg.Workdir,
+		Cmd:            cfg.Cmd,
+		Services:       []ServiceStatus{},
+	}
+
+	if lock, err := config.LoadLock(root); err == nil {
+		detail.Lock = lock
+	}
+
+	pm := process.NewProcessManager(root)
+	processes, _ := pm.UpdateProcessStatus()
+	for _, p := range processes {
+		svc := ServiceStatus{ProcessInfo: p}
+		if p.Status == "running" || p.Status == "paused" {
+			svc.Uptime = process.FormatDuration(time.Since(p.StartTime))
+		}
+		svc.LogSize, _ = pm.GetLogSize(p.Name)
+		detail.Services = append(detail.Services, svc)
+	}
+
+	detail.Logs, _ = pm.ListLogs()
+	if detail.Logs == nil {
+		detail.Logs = []string{}
+	}
+
+	return detail, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
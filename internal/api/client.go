@@ -0,0 +1,101 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Client sends operations to an 'sbox daemon' over its Unix socket
+type Client struct {
+	Socket string
+	http   *http.Client
+}
+
+// NewClient creates a client for the daemon listening on socket
+func NewClient(socket string) *Client {
+	return &Client{
+		Socket: socket,
+		http: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}},
+	}
+}
+
+func (c *Client) post(path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	// The host is ignored: every request goes to the socket
+	resp, err := c.http.Post("http://sbox"+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach sbox daemon at %s: %w", c.Socket, err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("sbox daemon: %s", apiErr.Error)
+		}
+		return nil, fmt.Errorf("sbox daemon: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// Register adds a project to the daemon, if it does not serve it already,
+// and returns the name operations on it use
+func (c *Client) Register(root string) (string, error) {
+	resp, err := c.post("/api/projects", RegisterRequest{Root: root})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var summary ProjectSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return "", fmt.Errorf("invalid response from sbox daemon: %w", err)
+	}
+	return summary.Name, nil
+}
+
+// Do runs an operation on a project, copying its output to stdout and
+// stderr as it streams in, and returns the operation's exit code
+func (c *Client) Do(project, op string, req interface{}, stdout, stderr io.Writer) (int, error) {
+	resp, err := c.post("/api/projects/"+url.PathEscape(project)+"/"+op, req)
+	if err != nil {
+		return 1, err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 2*1024*1024)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return 1, fmt.Errorf("invalid response from sbox daemon: %w", err)
+		}
+		if event.ExitCode != nil {
+			return *event.ExitCode, nil
+		}
+		w := stdout
+		if event.Stream == "stderr" {
+			w = stderr
+		}
+		fmt.Fprintln(w, event.Line)
+	}
+	if err := scanner.Err(); err != nil {
+		return 1, fmt.Errorf("lost connection to sbox daemon: %w", err)
+	}
+	return 1, fmt.Errorf("sbox daemon closed the stream before %s finished", op)
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/console"
+)
+
+// SocketEnv names the daemon socket the CLI sends build, run and stop to
+const SocketEnv = "SBOX_DAEMON_SOCKET"
+
+// SocketFile is the default daemon socket, in ~/.sbox
+const SocketFile = "daemon.sock"
+
+// DefaultSocket returns ~/.sbox/daemon.sock
+func DefaultSocket() (string, error) {
+	globalDir, err := config.GetGlobalSboxDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(globalDir, SocketFile), nil
+}
+
+// Operations
+const (
+	OpBuild = "build"
+	OpRun   = "run"
+	OpStop  = "stop"
+)
+
+// Options apply to every operation
+type Options struct {
+	// Profile and Output are the --profile and --output of the client
+	Profile string `json:"profile,omitempty"`
+	Output  string `json:"output,omitempty"`
+}
+
+// BuildRequest is the body of POST /api/projects/<name>/build
+type BuildRequest struct {
+	Options
+	Force   bool `json:"force,omitempty"`
+	Verbose bool `json:"verbose,omitempty"`
+	Frozen  bool `json:"frozen,omitempty"`
+	Offline bool `json:"offline,omitempty"`
+	// BuildArgs override the args declared in config.yaml
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+}
+
+// RunRequest is the body of POST /api/projects/<name>/run. Without
+// Detach the command runs for as long as the request does.
+type RunRequest struct {
+	Options
+	Command string `json:"command,omitempty"`
+	Detach  bool   `json:"detach,omitempty"`
+	Name    string `json:"name,omitempty"`
+	// IdleTimeout (a duration) and Restart apply to detached commands
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+	Restart     string `json:"restart,omitempty"`
+}
+
+// StopRequest is the body of POST /api/projects/<name>/stop
+type StopRequest struct {
+	Options
+	Name string `json:"name,omitempty"`
+	All  bool   `json:"all,omitempty"`
+}
+
+// RegisterRequest is the body of POST /api/projects
+type RegisterRequest struct {
+	Root string `json:"root"`
+}
+
+// Event is one line of the NDJSON stream an operation responds with: a
+// line of output, then the exit code
+type Event struct {
+	// Stream is stdout or stderr
+	Stream   string `json:"stream,omitempty"`
+	Line     string `json:"line,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
+// args returns the sbox arguments of an operation request
+func args(op string, body io.Reader) ([]string, Options, error) {
+	decoder := json.NewDecoder(body)
+	var opts Options
+	var argv []string
+	switch op {
+	case OpBuild:
+		var req BuildRequest
+		if err := decoder.Decode(&req); err != nil && err != io.EOF {
+			return nil, opts, err
+		}
+		argv = []string{"build"}
+		flags := []struct {
+			name string
+			set  bool
+		}{{"--force", req.Force}, {"--verbose", req.Verbose}, {"--frozen", req.Frozen}, {"--offline", req.Offline}}
+		for _, flag := range flags {
+			if flag.set {
+				argv = append(argv, flag.name)
+			}
+		}
+		names := make([]string, 0, len(req.BuildArgs))
+		for name := range req.BuildArgs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			argv = append(argv, "--build-arg", name+"="+req.BuildArgs[name])
+		}
+		opts = req.Options
+	case OpRun:
+		var req RunRequest
+		if err := decoder.Decode(&req); err != nil && err != io.EOF {
+			return nil, opts, err
+		}
+		argv = []string{"run"}
+		if req.Detach {
+			argv = append(argv, "--detach")
+		}
+		if req.Name != "" {
+			argv = append(argv, "--name", req.Name)
+		}
+		if req.IdleTimeout != "" {
+			argv = append(argv, "--idle-timeout", req.IdleTimeout)
+		}
+		if req.Restart != "" {
+			argv = append(argv, "--restart", req.Restart)
+		}
+		if req.Command != "" {
+			argv = append(argv, "--", req.Command)
+		}
+		opts = req.Options
+	case OpStop:
+		var req StopRequest
+		if err := decoder.Decode(&req); err != nil && err != io.EOF {
+			return nil, opts, err
+		}
+		if req.Name == "" && !req.All {
+			return nil, opts, fmt.Errorf("name or all is required")
+		}
+		argv = []string{"stop"}
+		if req.All {
+			// The client confirmed it; there is no terminal to ask on
+			argv = append(argv, "--all", "--yes")
+		} else {
+			// A name such as --all must not be taken for a flag
+			argv = append(argv, "--", req.Name)
+		}
+		opts = req.Options
+	default:
+		return nil, opts, fmt.Errorf("unknown operation '%s'", op)
+	}
+	return argv, opts, nil
+}
+
+// handleOperation runs an operation as an sbox process in the project and
+// streams its output. A separate process keeps a failing build or a
+// fatal error from taking the daemon down with it.
+func (s *Server) handleOperation(w http.ResponseWriter, r *http.Request, root, op string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	argv, opts, err := args(op, r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	cmd := exec.CommandContext(r.Context(), s.Exec, argv...)
+	cmd.Dir = root
+	// The operation runs in the daemon rather than being sent back to it
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, SocketEnv+"=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	if opts.Profile != "" {
+		cmd.Env = append(cmd.Env, config.ProfileEnv+"="+opts.Profile)
+	}
+	if opts.Output != "" {
+		cmd.Env = append(cmd.Env, console.OutputEnv+"="+opts.Output)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to start sbox: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	emit := func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(event)
+		flusher.Flush()
+	}
+	var wg sync.WaitGroup
+	for stream, pipe := range map[string]io.Reader{"stdout": stdout, "stderr": stderr} {
+		wg.Add(1)
+		go func(stream string, pipe io.Reader) {
+			defer wg.Done()
+			scanner := bufio.NewScanner(pipe)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				emit(Event{Stream: stream, Line: scanner.Text()})
+			}
+		}(stream, pipe)
+	}
+	wg.Wait()
+	cmd.Wait()
+
+	code := cmd.ProcessState.ExitCode()
+	emit(Event{ExitCode: &code})
+}
+
+// handleRegister adds a project to the daemon's list
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	root, err := config.GetProjectRoot(req.Root)
+	if err != nil || root != filepath.Clean(req.Root) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%s is not an sbox project", req.Root))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := filepath.Base(root)
+	for _, existing := range s.ProjectRoots {
+		switch {
+		case existing == root:
+			writeJSON(w, http.StatusOK, Summarize(root))
+			return
+		case filepath.Base(existing) == name:
+			writeError(w, http.StatusConflict, fmt.Sprintf("another project named '%s' is registered (%s)", name, existing))
+			return
+		}
+	}
+	s.ProjectRoots = append(s.ProjectRoots, root)
+	writeJSON(w, http.StatusCreated, Summarize(root))
+}
@@ -0,0 +1,281 @@
+// Package archive writes the archives of 'sbox pack' without the system
+// tar. Entries are sorted and carry no owner, so the same tree always
+// gives the same archive.
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SourceDateEpochEnv clamps the modification times of archived files for
+// reproducible archives (see reproducible-builds.org)
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// Options control what is archived and how
+type Options struct {
+	// Exclude holds glob patterns matched against the base name and the
+	// slash-separated path of each entry relative to the archived
+	// directory; excluded directories are skipped whole
+	Exclude []string
+
+	// ModTime, when set, replaces modification times after it
+	ModTime time.Time
+
+	// Progress is called as file contents are written, with the bytes
+	// written so far
+	Progress func(written int64)
+
+	// Compression is Gzip (the default), Zstd or None
+	Compression string
+
+	// SplitSize, when set, splits the archive into volumes of at most
+	// this many bytes (see PartName)
+	SplitSize int64
+}
+
+// Stats describe a written archive
+type Stats struct {
+	Files    int
+	Dirs     int
+	Symlinks int
+	// Bytes is the size of the archived file contents, before compression
+	Bytes int64
+	// Skipped are special files (sockets, devices, FIFOs) left out
+	Skipped []string
+	// Parts are the files written: the archive, or its volumes when split
+	Parts []string
+}
+
+// SourceDateEpoch returns the time $SOURCE_DATE_EPOCH holds, or the zero
+// time when it is unset
+func SourceDateEpoch() (time.Time, error) {
+	value := os.Getenv(SourceDateEpochEnv)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s '%s': expected seconds since 1970", SourceDateEpochEnv, value)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// Write archives dir into a tar at dest, compressed as the options say,
+// with its entries under the base name of dir like 'tar -cf dest -C
+// parent base'. The archive is written next to dest and renamed into
+// place, so an interrupted run leaves no partial archive behind.
+func Write(dest, dir string, opts Options) (*Stats, error) {
+	out := &splitWriter{dest: dest, size: opts.SplitSize}
+	stats, err := compress(out, dir, opts)
+	if err != nil {
+		out.abort()
+		return nil, fmt.Errorf("failed to create archive: %w", err)
+	}
+	if stats.Parts, err = out.commit(); err != nil {
+		out.abort()
+		return nil, fmt.Errorf("failed to create archive: %w", err)
+	}
+	return stats, nil
+}
+
+// compress writes the tar stream through the compressor of the options
+func compress(w io.Writer, dir string, opts Options) (*Stats, error) {
+	switch opts.Compression {
+	case None:
+		return write(w, dir, opts)
+	case Zstd:
+		return writeZstd(w, dir, opts)
+	}
+	// No name or time in the gzip header either
+	gz, err := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := write(gz, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return stats, gz.Close()
+}
+
+// writeZstd compresses the tar stream with the zstd binary, on all cores
+func writeZstd(w io.Writer, dir string, opts Options) (*Stats, error) {
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		return nil, fmt.Errorf("zstd not found on PATH")
+	}
+	cmd := exec.Command(path, "-q", "-T0", "-c")
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start zstd: %w", err)
+	}
+	stats, err := write(in, dir, opts)
+	in.Close()
+	if waitErr := cmd.Wait(); waitErr != nil && err == nil {
+		err = fmt.Errorf("zstd: %s", strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func write(w io.Writer, dir string, opts Options) (*Stats, error) {
+	tw := tar.NewWriter(w)
+	base := filepath.Base(dir)
+	stats := &Stats{}
+
+	// WalkDir visits entries in lexical order
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && excluded(rel, opts.Exclude) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := base
+		if rel != "." {
+			name = path.Join(base, rel)
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+			stats.Symlinks++
+		case info.IsDir():
+			stats.Dirs++
+		case info.Mode().IsRegular():
+			stats.Files++
+		default:
+			stats.Skipped = append(stats.Skipped, rel)
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		if !opts.ModTime.IsZero() && hdr.ModTime.After(opts.ModTime) {
+			hdr.ModTime = opts.ModTime
+		}
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write %s: %w", rel, err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		n, err := copyFile(tw, file, func(n int64) {
+			if opts.Progress != nil {
+				opts.Progress(stats.Bytes + n)
+			}
+		})
+		stats.Bytes += n
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", rel, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// copyFile copies a file into w, reporting the bytes copied so far
+func copyFile(w io.Writer, file string, progress func(int64)) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1<<20)
+	var written int64
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			progress(written)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// excluded reports whether a slash-separated relative path matches one
+// of the patterns, by base name or whole path
+func excluded(rel string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newGzipReader is gzip.NewReader as an io.ReadCloser
+func newGzipReader(r io.Reader) (io.ReadCloser, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return gz, nil
+}
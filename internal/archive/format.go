@@ -0,0 +1,374 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Compressions
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+	None = "none"
+)
+
+// Compressions lists the supported compressions, the default first
+var Compressions = []string{Gzip, Zstd, None}
+
+// Extension returns the file extension of an archive with a compression
+func Extension(compression string) string {
+	switch compression {
+	case Zstd:
+		return ".tar.zst"
+	case None:
+		return ".tar"
+	}
+	return ".tar.gz"
+}
+
+// Extensions are the archive extensions, longest first
+var Extensions = []string{".tar.gz", ".tar.zst", ".tgz", ".tzst", ".tar"}
+
+// CompressionOf tells the compression of an archive from its name, or ""
+func CompressionOf(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return Gzip
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return Zstd
+	case strings.HasSuffix(name, ".tar"):
+		return None
+	}
+	return ""
+}
+
+// CheckCompression checks a compression name and that its tool is
+// available: zstd is compressed by the zstd binary
+func CheckCompression(compression string) error {
+	switch compression {
+	case Gzip, None:
+		return nil
+	case Zstd:
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return fmt.Errorf("zstd not found on PATH; install it or use --compress gzip")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown compression '%s' (supported: %s)", compression, strings.Join(Compressions, ", "))
+}
+
+// ExtractCommand returns the shell command extracting an archive, or the
+// concatenation of its parts when it was split
+func ExtractCommand(name, compression string, split bool) string {
+	if !split {
+		switch compression {
+		case Zstd:
+			return fmt.Sprintf("zstd -dc %s | tar -xf -", name)
+		case None:
+			return fmt.Sprintf("tar -xf %s", name)
+		}
+		return fmt.Sprintf("tar -xzf %s", name)
+	}
+	parts := name + partSuffix + "*"
+	switch compression {
+	case Zstd:
+		return fmt.Sprintf("cat %s | zstd -dc | tar -xf -", parts)
+	case None:
+		return fmt.Sprintf("cat %s | tar -xf -", parts)
+	}
+	return fmt.Sprintf("cat %s | tar -xzf -", parts)
+}
+
+// Split archives are volumes <archive>.part-000, <archive>.part-001, ...
+// whose concatenation is the archive
+const partSuffix = ".part-"
+
+var partPattern = regexp.MustCompile(`\.part-(\d{3,})$`)
+
+// PartName returns the name of the nth volume of a split archive
+func PartName(archive string, n int) string {
+	return fmt.Sprintf("%s%s%03d", archive, partSuffix, n)
+}
+
+// Parts resolves an archive, or any volume of a split one, to the
+// archive's name and its volumes in order. An archive that was not split
+// is its only volume.
+func Parts(path string) (string, []string, error) {
+	archive := partPattern.ReplaceAllString(path, "")
+	if info, err := os.Stat(archive); err == nil && !info.IsDir() {
+		return archive, []string{archive}, nil
+	}
+
+	matches, _ := filepath.Glob(globEscape(archive) + partSuffix + "*")
+	var parts []string
+	for _, match := range matches {
+		if partPattern.MatchString(match) && partPattern.ReplaceAllString(match, "") == archive {
+			parts = append(parts, match)
+		}
+	}
+	if len(parts) == 0 {
+		return "", nil, fmt.Errorf("%s: no such archive or split volumes", path)
+	}
+	sort.Strings(parts)
+	for i, part := range parts {
+		if part != PartName(archive, i) {
+			return "", nil, fmt.Errorf("split archive %s is missing volume %s", filepath.Base(archive), filepath.Base(PartName(archive, i)))
+		}
+	}
+	return archive, parts, nil
+}
+
+// Join concatenates the volumes of a split archive, from any of them,
+// into the archive and returns its name and the volumes joined. The
+// volumes are kept.
+func Join(path string) (string, []string, error) {
+	if _, err := os.Stat(partPattern.ReplaceAllString(path, "")); err == nil {
+		return "", nil, fmt.Errorf("%s already exists", filepath.Base(partPattern.ReplaceAllString(path, "")))
+	}
+	archive, parts, err := Parts(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(archive), "."+filepath.Base(archive)+".*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to join volumes: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	for _, part := range parts {
+		if err := appendFile(tmp, part); err != nil {
+			tmp.Close()
+			return "", nil, fmt.Errorf("failed to join %s: %w", filepath.Base(part), err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return "", nil, fmt.Errorf("failed to join volumes: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", nil, err
+	}
+	if err := os.Rename(tmp.Name(), archive); err != nil {
+		return "", nil, fmt.Errorf("failed to join volumes: %w", err)
+	}
+	return archive, parts, nil
+}
+
+func appendFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// globEscape quotes the glob metacharacters of a path
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Magic numbers of the compressed streams
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Sniff tells the compression of an archive from the first bytes of its
+// stream
+func Sniff(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return Zstd
+	}
+	return None
+}
+
+// Open returns the uncompressed tar stream of an archive, or of a split
+// archive from any of its volumes. The compression is told from the
+// stream itself rather than the name.
+func Open(path string) (io.ReadCloser, error) {
+	_, parts, err := Parts(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	readers := make([]io.Reader, 0, len(parts))
+	for _, part := range parts {
+		f, err := os.Open(part)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+	stream := io.MultiReader(readers...)
+
+	head := make([]byte, len(zstdMagic))
+	n, _ := io.ReadFull(stream, head)
+	stream = io.MultiReader(bytes.NewReader(head[:n]), stream)
+
+	var r io.ReadCloser
+	switch Sniff(head[:n]) {
+	case Gzip:
+		r, err = newGzipReader(stream)
+	case Zstd:
+		r, err = startZstd(stream, "-dc")
+	default:
+		r = io.NopCloser(stream)
+	}
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return &readCloser{r, func() error {
+		err := r.Close()
+		closeAll()
+		return err
+	}}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// startZstd runs zstd over a stream and returns its output
+func startZstd(stream io.Reader, args ...string) (io.ReadCloser, error) {
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		return nil, fmt.Errorf("zstd not found on PATH")
+	}
+	cmd := exec.Command(path, append([]string{"-q"}, args...)...)
+	cmd.Stdin = stream
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start zstd: %w", err)
+	}
+	return &readCloser{out, func() error {
+		// Stop zstd when the stream is not read to the end
+		io.Copy(io.Discard, out)
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("zstd: %s", strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}}, nil
+}
+
+// splitWriter writes volumes of at most size bytes as temp files next to
+// the archive; commit renames them into place
+type splitWriter struct {
+	dest  string
+	size  int64
+	files []*os.File
+	n     int64
+}
+
+func (w *splitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.files) == 0 || (w.size > 0 && w.n == w.size) {
+			f, err := os.CreateTemp(filepath.Dir(w.dest), "."+filepath.Base(w.dest)+".*")
+			if err != nil {
+				return written, err
+			}
+			w.files = append(w.files, f)
+			w.n = 0
+		}
+		chunk := p
+		if w.size > 0 && int64(len(chunk)) > w.size-w.n {
+			chunk = chunk[:w.size-w.n]
+		}
+		n, err := w.files[len(w.files)-1].Write(chunk)
+		written += n
+		w.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// commit closes the volumes and renames them into place: a single volume
+// becomes the archive itself. Volumes of an earlier split are removed.
+func (w *splitWriter) commit() ([]string, error) {
+	if err := w.close(); err != nil {
+		return nil, err
+	}
+	stale, _ := filepath.Glob(globEscape(w.dest) + partSuffix + "*")
+	for _, part := range stale {
+		if partPattern.MatchString(part) {
+			os.Remove(part)
+		}
+	}
+
+	var parts []string
+	for i, f := range w.files {
+		name := w.dest
+		if len(w.files) > 1 {
+			name = PartName(w.dest, i)
+		}
+		if err := os.Chmod(f.Name(), 0644); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(f.Name(), name); err != nil {
+			return nil, err
+		}
+		parts = append(parts, name)
+	}
+	if len(parts) > 1 {
+		// The volumes replace an archive of the same name
+		os.Remove(w.dest)
+	}
+	return parts, nil
+}
+
+func (w *splitWriter) close() error {
+	var err error
+	for _, f := range w.files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// abort removes the volumes written so far
+func (w *splitWriter) abort() {
+	w.close()
+	for _, f := range w.files {
+		os.Remove(f.Name())
+	}
+}
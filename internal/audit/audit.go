@@ -0,0 +1,96 @@
+// Package audit records privileged sbox operations in an append-only,
+// per-project audit log.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// AuditFile is the audit log file name inside .sbox
+const AuditFile = "audit.log"
+
+// Entry is a single audited operation
+type Entry struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	UID     int       `json:"uid"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	Args    []string  `json:"args"`
+	Workdir string    `json:"workdir"`
+}
+
+// GetAuditPath returns the audit log path for a project
+func GetAuditPath(projectRoot string) string {
+	return filepath.Join(config.GetSboxDir(projectRoot), AuditFile)
+}
+
+// Record appends an entry for command (e.g. "stop") invoked with args.
+// The file is only ever opened for appending.
+func Record(projectRoot, command string, args []string) error {
+	entry := Entry{
+		Time:    time.Now(),
+		User:    currentUser(),
+		UID:     os.Getuid(),
+		Command: command,
+		Args:    args,
+	}
+	entry.Host, _ = os.Hostname()
+	entry.Workdir, _ = os.Getwd()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(GetAuditPath(projectRoot), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Load reads all audit entries, oldest first
+func Load(projectRoot string) ([]Entry, error) {
+	f, err := os.Open(GetAuditPath(projectRoot))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Entry{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // Skip malformed lines
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,166 @@
+// Package bench runs a sandbox command repeatedly for 'sbox bench' and
+// reports statistics of its wall time, CPU time and peak memory.
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/mpi"
+	"github.com/sbox-project/sbox/internal/process"
+	"github.com/sbox-project/sbox/internal/runner"
+	"github.com/sbox-project/sbox/internal/sysproc"
+)
+
+// Sample is the measurement of one run
+type Sample struct {
+	Wall     time.Duration `json:"wall_ns"`
+	User     time.Duration `json:"user_ns"`
+	System   time.Duration `json:"system_ns"`
+	MaxRSS   int64         `json:"max_rss_bytes"`
+	ExitCode int           `json:"exit_code"`
+}
+
+// CPU returns the user and system CPU time of the run
+func (s Sample) CPU() time.Duration {
+	return s.User + s.System
+}
+
+// Run runs command once in the sandbox of r and measures it. The
+// command's output goes to out, or nowhere when out is nil. Run hooks
+// are not run, so that they do not count towards the measurement.
+func Run(r *runner.Runner, command string, out io.Writer) (Sample, error) {
+	cmd, err := r.Command(sysproc.Shell(command)...)
+	if err != nil {
+		return Sample{}, err
+	}
+	cmd.Dir = r.ResolveWorkdir()
+	cmd.Env = mpi.LaunchEnv(command, r.BuildEnv())
+	if out != nil {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = out
+		cmd.Stderr = out
+	}
+
+	start := time.Now()
+	err = cmd.Run()
+	sample := Sample{Wall: time.Since(start)}
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return Sample{}, err
+		}
+		sample.ExitCode = exitErr.ExitCode()
+	}
+
+	// The usage of the shell includes the commands it waited for
+	sample.User = cmd.ProcessState.UserTime()
+	sample.System = cmd.ProcessState.SystemTime()
+	if usage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		sample.MaxRSS = process.MaxRSSBytes(usage)
+	}
+	return sample, nil
+}
+
+// Stats summarizes one metric over the runs
+type Stats struct {
+	Min    float64 `json:"min"`
+	Median float64 `json:"median"`
+	P95    float64 `json:"p95"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+}
+
+// Compute returns the statistics of values
+func Compute(values []float64) Stats {
+	if len(values) == 0 {
+		return Stats{}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(len(sorted))
+	variance := 0.0
+	for _, v := range sorted {
+		variance += (v - mean) * (v - mean)
+	}
+	if len(sorted) > 1 {
+		variance /= float64(len(sorted) - 1)
+	}
+
+	return Stats{
+		Min:    sorted[0],
+		Median: percentile(sorted, 50),
+		P95:    percentile(sorted, 95),
+		Max:    sorted[len(sorted)-1],
+		Mean:   mean,
+		StdDev: math.Sqrt(variance),
+	}
+}
+
+// percentile interpolates the p-th percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	pos := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(pos-float64(lower))
+}
+
+// Result is the outcome of a benchmark
+type Result struct {
+	Command string   `json:"command"`
+	Runs    int      `json:"runs"`
+	Failed  int      `json:"failed"`
+	Samples []Sample `json:"samples"`
+	// Wall, User, System and CPU are in seconds, MaxRSS in bytes
+	Wall   Stats `json:"wall"`
+	User   Stats `json:"user"`
+	System Stats `json:"system"`
+	CPU    Stats `json:"cpu"`
+	MaxRSS Stats `json:"max_rss"`
+}
+
+// Summarize computes the statistics of the samples of command
+func Summarize(command string, samples []Sample) Result {
+	result := Result{Command: command, Runs: len(samples), Samples: samples}
+	var wall, user, system, cpu, rss []float64
+	for _, s := range samples {
+		if s.ExitCode != 0 {
+			result.Failed++
+		}
+		wall = append(wall, s.Wall.Seconds())
+		user = append(user, s.User.Seconds())
+		system = append(system, s.System.Seconds())
+		cpu = append(cpu, s.CPU().Seconds())
+		rss = append(rss, float64(s.MaxRSS))
+	}
+	result.Wall = Compute(wall)
+	result.User = Compute(user)
+	result.System = Compute(system)
+	result.CPU = Compute(cpu)
+	result.MaxRSS = Compute(rss)
+	return result
+}
+
+// Seconds formats a duration in seconds for reports
+func Seconds(s float64) string {
+	d := time.Duration(s * float64(time.Second))
+	switch {
+	case d < time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	case d < time.Minute:
+		return d.Round(time.Millisecond).String()
+	}
+	return fmt.Sprint(d.Round(100 * time.Millisecond))
+}
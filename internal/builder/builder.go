@@ -5,11 +5,16 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	goruntime "runtime"
 	"strings"
 
 	"github.com/sbox-project/sbox/internal/config"
 	"github.com/sbox-project/sbox/internal/console"
+	"github.com/sbox-project/sbox/internal/ide"
+	"github.com/sbox-project/sbox/internal/lockfile"
+	"github.com/sbox-project/sbox/internal/process"
 	"github.com/sbox-project/sbox/internal/runtime"
 )
 
@@ -17,6 +22,12 @@ import (
 type Builder struct {
 	ProjectRoot string
 	Config      *config.Config
+	// Frozen reinstalls exactly the package versions recorded in
+	// sbox.lock instead of resolving them again
+	Frozen bool
+	// Offline fails the build up front when a step would need the
+	// network instead of downloading anything
+	Offline bool
 }
 
 // New creates a new builder
@@ -29,6 +40,7 @@ func New(projectRoot string) (*Builder, error) {
 	return &Builder{
 		ProjectRoot: projectRoot,
 		Config:      cfg,
+		Offline:     runtime.OfflineFromEnv(),
 	}, nil
 }
 
@@ -36,18 +48,118 @@ func New(projectRoot string) (*Builder, error) {
 func (b *Builder) Build(force bool) error {
 	console.Step("Building sandbox in %s", b.ProjectRoot)
 
-	// Check if rebuild is needed
-	if !force && config.IsUpToDate(b.ProjectRoot, b.Config) {
+	// Serialize builds of this project, including across users
+	lockPath := config.GetBuildLockPath(b.ProjectRoot)
+	lock, err := lockfile.TryAcquire(lockPath)
+	if err != nil {
+		if _, busy := err.(*lockfile.ErrLocked); !busy {
+			return err
+		}
+		console.Info("Waiting for another build to finish (%s)...", err)
+		if lock, err = lockfile.Acquire(lockPath); err != nil {
+			return err
+		}
+	}
+	defer lock.Release()
+
+	var locked *config.LockedPackages
+	if b.Frozen {
+		existing, err := config.LoadLock(b.ProjectRoot)
+		if err != nil || existing.Packages.Empty() {
+			return fmt.Errorf("--frozen needs resolved packages in %s; run a normal build first", config.LockFile)
+		}
+		locked = existing.Packages
+
+		// Conda builds are platform specific: resolve them natively and
+		// only pin the portable pip and npm versions
+		if existing.Platform != "" && existing.Platform != config.GetPlatformKey() {
+			console.Warning("%s was resolved on %s; resolving conda packages for %s and pinning pip/npm only",
+				config.LockFile, existing.Platform, config.GetPlatformKey())
+			portable := *locked
+			portable.Conda = nil
+			locked = &portable
+		}
+	}
+
+	// Steps of the previous build; a forced or frozen build redoes all
+	previous, _ := config.LoadLock(b.ProjectRoot)
+	var prevSteps *config.BuildSteps
+	if previous != nil && !force && !b.Frozen && (previous.Platform == "" || previous.Platform == config.GetPlatformKey()) {
+		prevSteps = previous.Steps
+	}
+
+	copySpecs := b.Config.ParseCopy()
+	steps := &config.BuildSteps{Runtime: runtimeFingerprint(b.Config)}
+	steps.Copy = copyFingerprints(b.ProjectRoot, b.Config)
+	steps.Install = installFingerprints(b.ProjectRoot, steps.Runtime, b.Config.Install, copySpecs, steps.Copy)
+
+	changedCopies := b.changedCopies(prevSteps, steps.Copy)
+
+	rtInfo := b.Config.ParseRuntime()
+	rtManager := runtime.NewManager(b.ProjectRoot)
+	rtManager.Frozen = locked
+	rtManager.Offline = b.Offline
+
+	// pre_build hooks may generate copy sources or files the install
+	// commands name, so with the environment in place they run before
+	// deciding whether the build is up to date
+	hooksRan := false
+	if !force && len(b.Config.PreBuild) > 0 && config.IsUpToDate(b.ProjectRoot, b.Config) && config.IsBuilt(b.ProjectRoot) {
+		if err := rtManager.RunHooks(config.HookPreBuild, b.Config.PreBuild); err != nil {
+			return err
+		}
+		hooksRan = true
+		steps.Copy = copyFingerprints(b.ProjectRoot, b.Config)
+		changedCopies = b.changedCopies(prevSteps, steps.Copy)
+		steps.Install = installFingerprints(b.ProjectRoot, steps.Runtime, b.Config.Install, copySpecs, steps.Copy)
+	}
+
+	if !force && b.upToDate(previous, steps) {
 		console.Info("Build is up to date, use --force to rebuild")
 		return nil
 	}
 
+	// Install commands rerun from the first changed one; all of them when
+	// the environment is new or was recreated for another runtime
+	envExisted := config.IsBuilt(b.ProjectRoot)
+	installFrom := 0
+	if prevSteps != nil && envExisted && prevSteps.Runtime == steps.Runtime {
+		installFrom = firstChanged(prevSteps.Install, steps.Install)
+	}
+
 	// 1. Setup runtime
-	rtInfo := b.Config.ParseRuntime()
-	rtManager := runtime.NewManager(b.ProjectRoot)
+	if b.Offline {
+		console.Info("Offline build: using cached runtimes and vendored packages only")
+		condaPackages := (locked != nil && len(locked.Conda) > 0) || b.Config.UsesGPU()
+		if err := rtManager.CheckOffline(rtInfo, b.Config.Install[installFrom:], condaPackages); err != nil {
+			return err
+		}
+	}
 	if err := rtManager.Setup(rtInfo); err != nil {
 		return fmt.Errorf("runtime setup failed: %w", err)
 	}
+	if b.Config.UsesGPU() {
+		if err := rtManager.SetupGPU(b.Config.CUDA); err != nil {
+			return fmt.Errorf("CUDA setup failed: %w", err)
+		}
+	}
+	if err := rtManager.PinConda(locked); err != nil {
+		return err
+	}
+
+	// pre_build hooks may generate files the copy step picks up, so the
+	// copy sources are looked at again after them
+	if len(b.Config.PreBuild) > 0 && !hooksRan {
+		if err := rtManager.RunHooks(config.HookPreBuild, b.Config.PreBuild); err != nil {
+			return err
+		}
+		steps.Copy = copyFingerprints(b.ProjectRoot, b.Config)
+		changedCopies = b.changedCopies(prevSteps, steps.Copy)
+		steps.Install = installFingerprints(b.ProjectRoot, steps.Runtime, b.Config.Install, copySpecs, steps.Copy)
+		if prevSteps != nil && envExisted && prevSteps.Runtime == steps.Runtime {
+			installFrom = firstChanged(prevSteps.Install, steps.Install)
+		}
+	}
 
 	// 2. Setup rootfs structure
 	if err := b.setupRootfs(); err != nil {
@@ -55,7 +167,10 @@ func (b *Builder) Build(force bool) error {
 	}
 
 	// 3. Copy files
-	if err := b.copyFiles(); err != nil {
+	if skipped := len(copySpecs) - len(changedCopies); skipped > 0 {
+		console.Info("Skipping %d unchanged copy sources", skipped)
+	}
+	if err := b.copyFiles(changedCopies); err != nil {
 		return fmt.Errorf("file copy failed: %w", err)
 	}
 
@@ -65,25 +180,118 @@ func (b *Builder) Build(force bool) error {
 	}
 
 	// 5. Install packages
-	if err := rtManager.InstallPackages(b.Config.Install); err != nil {
+	if installFrom > 0 {
+		console.Info("Skipping %d unchanged install commands", installFrom)
+	}
+	if prevSteps != nil && installFrom == len(steps.Install) && len(prevSteps.Install) > len(steps.Install) {
+		console.Warning("Removed install commands are not undone; run 'sbox clean' and 'sbox build' for a clean environment")
+	}
+	if err := rtManager.InstallPackages(b.Config.Install[installFrom:]); err != nil {
 		return fmt.Errorf("package installation failed: %w", err)
 	}
+	if err := rtManager.PinPackages(locked); err != nil {
+		return err
+	}
 
 	// 6. Generate env.sh
 	if err := b.generateEnvScript(); err != nil {
 		return fmt.Errorf("env script generation failed: %w", err)
 	}
+	if err := ide.Write(b.ProjectRoot, b.Config); err != nil {
+		console.Warning("Failed to write %s: %s", ide.File, err)
+	}
+	if err := rtManager.RunHooks(config.HookPostBuild, b.Config.PostBuild); err != nil {
+		return err
+	}
 
-	// 7. Update lock file
-	if err := config.SaveLock(b.ProjectRoot, b.Config); err != nil {
+	// 7. Record the resolved packages and update the lock file. Nothing
+	// was installed when only the command, env or copies changed, so the
+	// previous package set still holds.
+	var packages *config.LockedPackages
+	if prevSteps != nil && envExisted && prevSteps.Runtime == steps.Runtime && installFrom == len(steps.Install) {
+		packages = previous.Packages
+	} else {
+		packages, err = rtManager.CapturePackages()
+		if err != nil {
+			console.Warning("Failed to capture resolved packages: %s", err)
+		}
+	}
+	if b.Frozen {
+		if packages != nil {
+			if diffs := runtime.DiffPackages(locked, packages); len(diffs) > 0 {
+				return fmt.Errorf("frozen build does not match %s:\n  %s", config.LockFile, strings.Join(diffs, "\n  "))
+			}
+		}
+		if packages != nil && locked.Conda == nil {
+			// Keep the natively resolved conda set for this platform
+			merged := *locked
+			merged.Conda = packages.Conda
+			packages = &merged
+		} else {
+			packages = locked
+		}
+	}
+	if err := config.SaveLock(b.ProjectRoot, b.Config, packages, steps); err != nil {
 		return fmt.Errorf("lock file update failed: %w", err)
 	}
 	console.Info("Updated %s", config.GetLockPath(b.ProjectRoot))
 
+	// 8. Let teammates use the build in shared projects
+	if b.Config.Shared {
+		if err := config.ApplySharedPermissions(b.ProjectRoot); err != nil {
+			console.Warning("Failed to apply shared permissions: %s", err)
+		} else {
+			console.Info("Applied group permissions for shared project")
+		}
+	}
+
+	// For 'sbox system df' and 'sbox system prune'
+	process.RecordBuild(b.ProjectRoot)
+
 	console.Success("Build complete!")
 	return nil
 }
 
+// UpToDate reports whether building would change nothing: the config is
+// unchanged and so are the copy sources and install inputs recorded by
+// the last build. With pre_build hooks only Build can tell, after
+// running them, so it reports false.
+func UpToDate(projectRoot string, cfg *config.Config) bool {
+	if len(cfg.PreBuild) > 0 {
+		return false
+	}
+	b := &Builder{ProjectRoot: projectRoot, Config: cfg}
+	previous, _ := config.LoadLock(projectRoot)
+	steps := &config.BuildSteps{Runtime: runtimeFingerprint(cfg), Copy: copyFingerprints(projectRoot, cfg)}
+	steps.Install = installFingerprints(projectRoot, steps.Runtime, cfg.Install, cfg.ParseCopy(), steps.Copy)
+	return b.upToDate(previous, steps)
+}
+
+func (b *Builder) upToDate(previous *config.LockData, steps *config.BuildSteps) bool {
+	// The environment itself is needed too, not just a lock file (e.g.
+	// one copied from elsewhere for a frozen build)
+	if !config.IsUpToDate(b.ProjectRoot, b.Config) || !config.IsBuilt(b.ProjectRoot) {
+		return false
+	}
+	// Builds from older versions did not record their steps
+	if previous.Steps == nil {
+		return true
+	}
+	return len(b.changedCopies(previous.Steps, steps.Copy)) == 0 &&
+		firstChanged(previous.Steps.Install, steps.Install) == len(steps.Install)
+}
+
+// changedCopies returns the copy specs that need copying again
+func (b *Builder) changedCopies(previous *config.BuildSteps, copies map[string]string) []config.CopySpec {
+	var changed []config.CopySpec
+	for _, spec := range b.Config.ParseCopy() {
+		if !copyUnchanged(previous, copies, spec) || b.copyMissing(spec) {
+			changed = append(changed, spec)
+		}
+	}
+	return changed
+}
+
 func (b *Builder) setupRootfs() error {
 	console.Step("Setting up rootfs...")
 
@@ -107,26 +315,19 @@ func (b *Builder) setupRootfs() error {
 	return nil
 }
 
-func (b *Builder) copyFiles() error {
-	copySpecs := b.Config.ParseCopy()
+// copyFiles copies the given specs of the copy list into the rootfs
+func (b *Builder) copyFiles(copySpecs []config.CopySpec) error {
 	if len(copySpecs) == 0 {
 		return nil
 	}
 
 	console.Step("Copying files...")
-	rootfs := config.GetRootfsDir(b.ProjectRoot)
 
 	for _, spec := range copySpecs {
 		// Resolve source (relative to project root)
 		src := filepath.Join(b.ProjectRoot, strings.TrimPrefix(spec.Src, "./"))
 
-		// Resolve destination (in rootfs)
-		var dst string
-		if strings.HasPrefix(spec.Dst, "/") {
-			dst = filepath.Join(rootfs, strings.TrimPrefix(spec.Dst, "/"))
-		} else {
-			dst = filepath.Join(rootfs, spec.Dst)
-		}
+		dst := b.copyDestination(spec)
 
 		if _, err := os.Stat(src); err != nil {
 			console.Warning("Source not found: %s", src)
@@ -150,6 +351,21 @@ func (b *Builder) copyFiles() error {
 	return nil
 }
 
+// copyDestination resolves the destination of a copy spec in the rootfs
+func (b *Builder) copyDestination(spec config.CopySpec) string {
+	return filepath.Join(config.GetRootfsDir(b.ProjectRoot), strings.TrimPrefix(spec.Dst, "/"))
+}
+
+// copyMissing reports whether a copy source exists but its copy was
+// removed from the rootfs
+func (b *Builder) copyMissing(spec config.CopySpec) bool {
+	if _, err := os.Stat(filepath.Join(b.ProjectRoot, strings.TrimPrefix(spec.Src, "./"))); err != nil {
+		return false
+	}
+	_, err := os.Lstat(b.copyDestination(spec))
+	return err != nil
+}
+
 func (b *Builder) setupMounts() error {
 	mountSpecs := b.Config.ParseMount()
 	if len(mountSpecs) == 0 {
@@ -194,7 +410,7 @@ func (b *Builder) setupMounts() error {
 		}
 
 		// Create symlink
-		if err := os.Symlink(src, dst); err != nil {
+		if err := linkMount(src, dst, srcInfo.IsDir()); err != nil {
 			return fmt.Errorf("failed to create mount symlink: %w", err)
 		}
 
@@ -274,6 +490,19 @@ func copyDir(src, dst string) error {
 	return nil
 }
 
+// linkMount links dst to src. Symlinks on Windows need developer mode or
+// an administrator; a directory junction, which does not, is made then.
+func linkMount(src, dst string, dir bool) error {
+	err := os.Symlink(src, dst)
+	if err == nil || goruntime.GOOS != "windows" || !dir {
+		return err
+	}
+	if out, jerr := exec.Command("cmd", "/c", "mklink", "/J", dst, src).CombinedOutput(); jerr != nil {
+		return fmt.Errorf("%w (junction: %s)", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
 func copySymlink(src, dst string) error {
 	link, err := os.Readlink(src)
 	if err != nil {
@@ -304,6 +533,16 @@ func copyFile(src, dst string) error {
 	return err
 }
 
+// HostLibsScript returns the env.sh lines that append host_libs to
+// LD_LIBRARY_PATH after the environment's own lib, or "" without any
+func HostLibsScript(envDir string, hostLibs []string) string {
+	if len(hostLibs) == 0 {
+		return ""
+	}
+	ldPath := strings.Join(append([]string{filepath.Join(envDir, "lib")}, hostLibs...), ":")
+	return fmt.Sprintf("\n# Host libraries (host_libs)\nexport LD_LIBRARY_PATH=\"${LD_LIBRARY_PATH:+$LD_LIBRARY_PATH:}%s\"\n", ldPath)
+}
+
 func (b *Builder) generateEnvScript() error {
 	envDir := config.GetEnvDir(b.ProjectRoot)
 	rootfs := config.GetRootfsDir(b.ProjectRoot)
@@ -332,13 +571,21 @@ export TMPDIR="%s/tmp"
 export CONDA_PREFIX="%s"
 export MAMBA_ROOT_PREFIX="%s/mamba"
 
+# Conda packages' activation scripts (CUDA paths, PROJ_LIB, ...)
+for script in "$CONDA_PREFIX"/etc/conda/activate.d/*.sh; do
+  [ -f "$script" ] && . "$script"
+done
+unset script
+
 `, b.ProjectRoot, envDir, rootfs, rootfs, envDir, sboxDir)
 
 	// Add custom env vars
-	for key, value := range b.Config.Env {
+	for key, value := range b.Config.Raw().Env {
 		content += fmt.Sprintf("export %s=\"%s\"\n", key, value)
 	}
 
+	content += HostLibsScript(envDir, b.Config.HostLibs)
+
 	content += `
 echo "sbox environment activated"
 echo "Python: $(which python)"
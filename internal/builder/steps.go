@@ -0,0 +1,168 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// hashStrings returns a short digest of the given values
+func hashStrings(values ...string) string {
+	h := sha256.New()
+	for _, v := range values {
+		io.WriteString(h, v)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// runtimeFingerprint changes when the environment has to be recreated,
+// or its CUDA libraries change under the install commands
+func runtimeFingerprint(cfg *config.Config) string {
+	if cfg.UsesGPU() {
+		return hashStrings(cfg.Runtime, config.GetPlatformKey(), "cuda="+cfg.CUDA)
+	}
+	return hashStrings(cfg.Runtime, config.GetPlatformKey())
+}
+
+// installFingerprints chains each install command and the files it
+// reads onto the runtime and the commands before it, so a changed
+// requirements.txt runs its command and the ones after it again
+func installFingerprints(projectRoot, runtimeKey string, commands []string, specs []config.CopySpec, copies map[string]string) []string {
+	fingerprints := make([]string, len(commands))
+	prev := runtimeKey
+	for i, command := range commands {
+		values := append([]string{prev, command}, installInputs(projectRoot, command, specs, copies)...)
+		prev = hashStrings(values...)
+		fingerprints[i] = prev
+	}
+	return fingerprints
+}
+
+// installInputs fingerprints the files an install command names: copy
+// sources by their source or destination, and other project files such
+// as requirements.txt in 'pip install -r requirements.txt'. Files it
+// reads without naming them, like package.json for 'npm ci', are not
+// seen.
+func installInputs(projectRoot, command string, specs []config.CopySpec, copies map[string]string) []string {
+	var inputs []string
+	seen := make(map[string]bool)
+	add := func(key, fingerprint string) {
+		if !seen[key] {
+			seen[key] = true
+			inputs = append(inputs, key+"="+fingerprint)
+		}
+	}
+
+	tokens := strings.FieldsFunc(command, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '=' || r == ';' || r == '&' || r == '|' || r == '\'' || r == '"'
+	})
+	for _, token := range tokens {
+		name := strings.TrimPrefix(filepath.ToSlash(token), "./")
+		if name == "" || name == "." || strings.HasPrefix(name, "-") {
+			continue
+		}
+		matched := false
+		for _, spec := range specs {
+			if names(name, spec.Src) || names(name, strings.TrimPrefix(spec.Dst, "/")) {
+				add(copyKey(spec), copies[copyKey(spec)])
+				matched = true
+			}
+		}
+		if matched || filepath.IsAbs(name) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(projectRoot, name)); err == nil && info.Mode().IsRegular() {
+			add(name, copyFingerprint(projectRoot, config.CopySpec{Src: name}))
+		}
+	}
+	return inputs
+}
+
+// names reports whether a command argument is path or a file under it
+func names(arg, path string) bool {
+	path = strings.TrimSuffix(strings.TrimPrefix(filepath.ToSlash(path), "./"), "/")
+	if path == "" || path == "." {
+		return false
+	}
+	return arg == path || strings.HasPrefix(arg, path+"/")
+}
+
+// firstChanged returns the index of the first fingerprint in current
+// that previous does not have at the same position
+func firstChanged(previous, current []string) int {
+	for i := range current {
+		if i >= len(previous) || previous[i] != current[i] {
+			return i
+		}
+	}
+	return len(current)
+}
+
+// copyKey identifies a copy spec in BuildSteps.Copy
+func copyKey(spec config.CopySpec) string {
+	return spec.Src + ":" + spec.Dst
+}
+
+// copyFingerprint covers the path, mode, size and modification time of
+// every file under a copy source. Contents are not read: like make, an
+// edit is detected by its mtime.
+func copyFingerprint(projectRoot string, spec config.CopySpec) string {
+	src := filepath.Join(projectRoot, strings.TrimPrefix(spec.Src, "./"))
+	// copyPath follows a symlinked source
+	if resolved, err := filepath.EvalSymlinks(src); err == nil {
+		src = resolved
+	}
+
+	h := sha256.New()
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// copyDir skips .sbox as well
+		if info.IsDir() && info.Name() == config.SboxDir && path != src {
+			return filepath.SkipDir
+		}
+		rel, _ := filepath.Rel(src, path)
+		fmt.Fprintf(h, "%s %o %d %d", rel, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, _ := os.Readlink(path)
+			fmt.Fprintf(h, " -> %s", link)
+		}
+		h.Write([]byte{0})
+		return nil
+	})
+	if err != nil {
+		// Copied once the source shows up
+		return hashStrings("missing", spec.Src)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// copyFingerprints fingerprints all copy specs of cfg
+func copyFingerprints(projectRoot string, cfg *config.Config) map[string]string {
+	specs := cfg.ParseCopy()
+	if len(specs) == 0 {
+		return nil
+	}
+	fingerprints := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		fingerprints[copyKey(spec)] = copyFingerprint(projectRoot, spec)
+	}
+	return fingerprints
+}
+
+// copyUnchanged reports whether the previous build copied spec from the
+// same source state
+func copyUnchanged(previous *config.BuildSteps, current map[string]string, spec config.CopySpec) bool {
+	if previous == nil {
+		return false
+	}
+	return previous.Copy[copyKey(spec)] == current[copyKey(spec)]
+}
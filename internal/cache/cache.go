@@ -3,12 +3,17 @@ package cache
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/lockfile"
+	"github.com/sbox-project/sbox/internal/netfs"
 )
 
 // Constants for cache structure
@@ -20,6 +25,15 @@ const (
 	BinDir      = "bin"
 )
 
+// Package caches of pip, npm and pnpm under pkgs/. Unlike conda packages,
+// which are split by platform, their contents are portable: pip and pnpm
+// only pick files matching the host.
+const (
+	PipCacheDir  = "pip"
+	NpmCacheDir  = "npm"
+	PnpmStoreDir = "pnpm"
+)
+
 // CachedRuntime represents metadata for a cached runtime environment
 type CachedRuntime struct {
 	Language    string    `json:"language"`
@@ -28,6 +42,9 @@ type CachedRuntime struct {
 	LastUsed    time.Time `json:"last_used"`
 	Size        int64     `json:"size"`
 	Path        string    `json:"path"`
+	// Platform is the platform key the runtime was built for (empty for
+	// entries created before the cache was split by platform)
+	Platform string `json:"platform,omitempty"`
 }
 
 // CacheInfo contains information about the cache
@@ -36,29 +53,42 @@ type CacheInfo struct {
 	TotalSize    int64            `json:"total_size"`
 	RuntimeCount int              `json:"runtime_count"`
 	Runtimes     []CachedRuntime  `json:"runtimes"`
+	// Packages are the shared package caches of builds
+	Packages []PackageCache `json:"packages"`
+}
+
+// PackageCache is a package manager's download cache shared by builds
+type PackageCache struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
 }
 
+// ErrPlatformMismatch is returned for a cached runtime whose metadata
+// names another platform, e.g. after syncing ~/.sbox between machines
+var ErrPlatformMismatch = errors.New("cached runtime was built for another platform")
+
 // Manager handles global cache operations
 type Manager struct {
 	CacheRoot string
+	// Platform selects the per-platform runtime, package and binary
+	// directories, so hosts sharing a home directory never mix binaries
+	Platform string
 }
 
-// NewManager creates a new cache manager
+// NewManager creates a new cache manager for this host's platform
 func NewManager() (*Manager, error) {
 	cacheRoot, err := GetGlobalCacheDir()
 	if err != nil {
 		return nil, err
 	}
-	return &Manager{CacheRoot: cacheRoot}, nil
+	return &Manager{CacheRoot: cacheRoot, Platform: config.GetPlatformKey()}, nil
 }
 
-// GetGlobalCacheDir returns the global cache directory path (~/.sbox/cache)
+// GetGlobalCacheDir returns the global cache directory path: $SBOX_CACHE_DIR
+// when set (e.g. node-local scratch on a cluster), otherwise ~/.sbox/cache
 func GetGlobalCacheDir() (string, error) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return "", fmt.Errorf("failed to get home directory: %w", err)
-	}
-	return filepath.Join(homeDir, CacheDir, CacheName), nil
+	return config.GetGlobalCacheDir()
 }
 
 // GetGlobalSboxDir returns the global sbox directory path (~/.sbox)
@@ -70,27 +100,49 @@ func GetGlobalSboxDir() (string, error) {
 	return filepath.Join(homeDir, CacheDir), nil
 }
 
-// GetRuntimesDir returns the path to cached runtimes
+// GetRuntimesDir returns the path to cached runtimes for this platform
 func (m *Manager) GetRuntimesDir() string {
-	return filepath.Join(m.CacheRoot, RuntimesDir)
+	return filepath.Join(m.CacheRoot, RuntimesDir, m.Platform)
 }
 
-// GetPkgsDir returns the path to shared package cache
+// GetPkgsDir returns the path to shared package cache for this platform
 func (m *Manager) GetPkgsDir() string {
-	return filepath.Join(m.CacheRoot, PkgsDir)
+	return filepath.Join(m.CacheRoot, PkgsDir, m.Platform)
 }
 
-// GetBinDir returns the path to shared binaries (micromamba)
+// GetPipCacheDir returns pip's download and wheel cache (PIP_CACHE_DIR)
+func (m *Manager) GetPipCacheDir() string {
+	return filepath.Join(m.CacheRoot, PkgsDir, PipCacheDir)
+}
+
+// GetNpmCacheDir returns npm's download cache (npm_config_cache)
+func (m *Manager) GetNpmCacheDir() string {
+	return filepath.Join(m.CacheRoot, PkgsDir, NpmCacheDir)
+}
+
+// GetPnpmStoreDir returns pnpm's content-addressable store
+func (m *Manager) GetPnpmStoreDir() string {
+	return filepath.Join(m.CacheRoot, PkgsDir, PnpmStoreDir)
+}
+
+// GetPkgsLockPath returns the lock serializing the micromamba runs that
+// extract packages into the conda package cache of this platform. pip,
+// npm and pnpm write their caches atomically and need no lock.
+func (m *Manager) GetPkgsLockPath() string {
+	return filepath.Join(m.CacheRoot, PkgsDir, "."+m.Platform+".lock")
+}
+
+// GetBinDir returns the path to shared binaries (micromamba) for this platform
 func (m *Manager) GetBinDir() string {
-	return filepath.Join(m.CacheRoot, BinDir)
+	return filepath.Join(m.CacheRoot, BinDir, m.Platform)
 }
 
 // GetMicromambaPath returns the path to the cached micromamba binary
 func (m *Manager) GetMicromambaPath() string {
-	return filepath.Join(m.GetBinDir(), "micromamba")
+	return filepath.Join(m.GetBinDir(), config.ExeNameFor(m.Platform, "micromamba"))
 }
 
-// GetRuntimeKey generates a unique key for a runtime
+// GetRuntimeKey generates a key for a runtime, unique within a platform
 func GetRuntimeKey(language, version string) string {
 	return fmt.Sprintf("%s-%s", language, version)
 }
@@ -101,7 +153,9 @@ func (m *Manager) GetCachedRuntimePath(language, version string) string {
 	return filepath.Join(m.GetRuntimesDir(), key)
 }
 
-// GetCachedRuntime checks if a runtime is cached and returns its info
+// GetCachedRuntime checks if a runtime is cached and returns its info.
+// A runtime whose metadata names another platform is returned together
+// with ErrPlatformMismatch and must not be used.
 func (m *Manager) GetCachedRuntime(language, version string) (*CachedRuntime, error) {
 	runtimePath := m.GetCachedRuntimePath(language, version)
 	
@@ -119,14 +173,8 @@ func (m *Manager) GetCachedRuntime(language, version string) (*CachedRuntime, er
 
 	// Check for marker file or actual binaries
 	var hasRuntime bool
-	if language == "python" {
-		pythonPath := filepath.Join(runtimePath, "bin", "python")
-		if _, err := os.Stat(pythonPath); err == nil {
-			hasRuntime = true
-		}
-	} else if language == "node" || language == "nodejs" {
-		nodePath := filepath.Join(runtimePath, "bin", "node")
-		if _, err := os.Stat(nodePath); err == nil {
+	if spec, ok := config.LookupRuntime(language); ok {
+		if _, err := os.Stat(spec.BinaryPath(runtimePath)); err == nil {
 			hasRuntime = true
 		}
 	}
@@ -148,10 +196,16 @@ func (m *Manager) GetCachedRuntime(language, version string) (*CachedRuntime, er
 	if metaData, err := os.ReadFile(metaPath); err == nil {
 		json.Unmarshal(metaData, runtime)
 	}
+	runtime.Path = runtimePath
 
 	// Calculate size
 	runtime.Size = getDirSize(runtimePath)
 
+	if runtime.Platform != "" && runtime.Platform != m.Platform {
+		return runtime, fmt.Errorf("%w: %s (this host is %s)", ErrPlatformMismatch, runtime.Platform, m.Platform)
+	}
+	runtime.Platform = m.Platform
+
 	return runtime, nil
 }
 
@@ -195,6 +249,7 @@ func (m *Manager) SaveRuntimeMetadata(language, version string) error {
 		LastUsed:  time.Now(),
 		Path:      runtimePath,
 		Size:      getDirSize(runtimePath),
+		Platform:  m.Platform,
 	}
 
 	data, err := json.MarshalIndent(meta, "", "  ")
@@ -218,6 +273,7 @@ func (m *Manager) UpdateLastUsed(language, version string) error {
 	meta.Language = language
 	meta.Version = version
 	meta.Path = runtimePath
+	meta.Platform = m.Platform
 	meta.LastUsed = time.Now()
 	if meta.CreatedAt.IsZero() {
 		meta.CreatedAt = time.Now()
@@ -232,8 +288,42 @@ func (m *Manager) UpdateLastUsed(language, version string) error {
 	return os.WriteFile(metaPath, data, 0644)
 }
 
-// CopyFromCache copies a cached runtime to a project directory
+// ProvisionedFrom returns the metadata of the cached runtime envDir was
+// provisioned from, or nil when the runtime was installed in place. The
+// metadata file is copied along with the runtime.
+func ProvisionedFrom(envDir string) *CachedRuntime {
+	data, err := os.ReadFile(filepath.Join(envDir, ".sbox-cache.json"))
+	if err != nil {
+		return nil
+	}
+	meta := &CachedRuntime{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil
+	}
+	return meta
+}
+
+// lockRuntime serializes writers and readers of a cached runtime, also
+// across hosts sharing the cache over NFS
+func (m *Manager) lockRuntime(language, version string) (*lockfile.Lock, error) {
+	return lockfile.Acquire(filepath.Join(m.GetRuntimesDir(), "."+GetRuntimeKey(language, version)+".lock"))
+}
+
+// IsNetwork returns the network filesystem the cache is on, or ""
+func (m *Manager) IsNetwork() string {
+	return netfs.Detect(m.CacheRoot)
+}
+
+// CopyFromCache provisions a cached runtime into a project directory.
+// Files are cloned or hardlinked rather than copied where the filesystem
+// allows (see LinkModeEnv), which is near instant and takes no space.
 func (m *Manager) CopyFromCache(language, version, targetDir string) error {
+	lock, err := m.lockRuntime(language, version)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	sourcePath := m.GetCachedRuntimePath(language, version)
 
 	// Check if source exists
@@ -251,8 +341,7 @@ func (m *Manager) CopyFromCache(language, version, targetDir string) error {
 		return err
 	}
 
-	// Copy directory recursively
-	if err := copyDir(sourcePath, targetDir); err != nil {
+	if err := linkDir(sourcePath, targetDir); err != nil {
 		return fmt.Errorf("failed to copy from cache: %w", err)
 	}
 
@@ -268,27 +357,56 @@ func (m *Manager) CopyToCache(language, version, sourceDir string) error {
 		return err
 	}
 
+	lock, err := m.lockRuntime(language, version)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	targetPath := m.GetCachedRuntimePath(language, version)
 
+	// Copy next to the target and rename it into place, so an
+	// interrupted copy never looks like a cached runtime
+	tmpPath, err := os.MkdirTemp(filepath.Dir(targetPath), "."+filepath.Base(targetPath)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create cache staging directory: %w", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	if info, err := os.Stat(sourceDir); err == nil {
+		os.Chmod(tmpPath, info.Mode().Perm())
+	}
+	if err := copyDir(sourceDir, tmpPath); err != nil {
+		return fmt.Errorf("failed to copy to cache: %w", err)
+	}
+
 	// Remove existing cache if present
 	if err := os.RemoveAll(targetPath); err != nil {
 		return fmt.Errorf("failed to remove existing cache: %w", err)
 	}
-
-	// Copy directory recursively
-	if err := copyDir(sourceDir, targetPath); err != nil {
-		return fmt.Errorf("failed to copy to cache: %w", err)
+	if err := os.Rename(tmpPath, targetPath); err != nil {
+		return fmt.Errorf("failed to move runtime into cache: %w", err)
 	}
 
 	// Save metadata
 	return m.SaveRuntimeMetadata(language, version)
 }
 
-// ListCachedRuntimes returns all cached runtimes
-func (m *Manager) ListCachedRuntimes() ([]CachedRuntime, error) {
-	runtimesDir := m.GetRuntimesDir()
+// runtimePrefixes returns the cache directory prefixes for every
+// supported language name, e.g. "python-" or "nodejs-"
+func runtimePrefixes() []string {
+	var prefixes []string
+	for _, name := range config.RuntimeNames() {
+		prefixes = append(prefixes, name+"-")
+	}
+	return prefixes
+}
 
-	entries, err := os.ReadDir(runtimesDir)
+// ListCachedRuntimes returns the cached runtimes of every platform,
+// including legacy entries from before the cache was split by platform
+// (their Platform is empty)
+func (m *Manager) ListCachedRuntimes() ([]CachedRuntime, error) {
+	entries, err := os.ReadDir(filepath.Join(m.CacheRoot, RuntimesDir))
 	if os.IsNotExist(err) {
 		return nil, nil
 	}
@@ -297,37 +415,25 @@ func (m *Manager) ListCachedRuntimes() ([]CachedRuntime, error) {
 	}
 
 	var runtimes []CachedRuntime
+	legacy := &Manager{CacheRoot: m.CacheRoot}
 	for _, entry := range entries {
 		if !entry.IsDir() {
 			continue
 		}
 
-		// Parse runtime key (language-version)
-		name := entry.Name()
-		language := ""
-		version := ""
-		
-		// Handle cases like "python-3.10" or "node-22"
-		if len(name) > 0 {
-			for _, prefix := range []string{"python-", "node-", "nodejs-"} {
-				if len(name) > len(prefix) && name[:len(prefix)] == prefix {
-					language = name[:len(prefix)-1]
-					version = name[len(prefix):]
-					break
-				}
-			}
-		}
-
-		if language == "" {
+		// Legacy "python-3.10" directly under runtimes/, otherwise a
+		// platform directory such as "linux-amd64"
+		if language, _ := ParseRuntimeKey(entry.Name()); language != "" {
+			runtimes = append(runtimes, legacy.listRuntimes([]os.DirEntry{entry})...)
 			continue
 		}
 
-		runtime, err := m.GetCachedRuntime(language, version)
-		if err != nil || runtime == nil {
+		platform := &Manager{CacheRoot: m.CacheRoot, Platform: entry.Name()}
+		platformEntries, err := os.ReadDir(platform.GetRuntimesDir())
+		if err != nil {
 			continue
 		}
-
-		runtimes = append(runtimes, *runtime)
+		runtimes = append(runtimes, platform.listRuntimes(platformEntries)...)
 	}
 
 	// Sort by last used (most recent first)
@@ -338,6 +444,41 @@ func (m *Manager) ListCachedRuntimes() ([]CachedRuntime, error) {
 	return runtimes, nil
 }
 
+func (m *Manager) listRuntimes(entries []os.DirEntry) []CachedRuntime {
+	var runtimes []CachedRuntime
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		language, version := ParseRuntimeKey(entry.Name())
+		if language == "" {
+			continue
+		}
+
+		// Misplaced runtimes are listed too, so they can be removed
+		runtime, err := m.GetCachedRuntime(language, version)
+		if (err != nil && !errors.Is(err, ErrPlatformMismatch)) || runtime == nil {
+			continue
+		}
+
+		runtimes = append(runtimes, *runtime)
+	}
+	return runtimes
+}
+
+// ParseRuntimeKey splits a runtime key such as "python-3.10" or
+// "node-22" into language and version. The language is empty when the
+// key does not start with a supported runtime name.
+func ParseRuntimeKey(key string) (string, string) {
+	for _, prefix := range runtimePrefixes() {
+		if len(key) > len(prefix) && key[:len(prefix)] == prefix {
+			return key[:len(prefix)-1], key[len(prefix):]
+		}
+	}
+	return "", ""
+}
+
 // GetCacheInfo returns information about the cache
 func (m *Manager) GetCacheInfo() (*CacheInfo, error) {
 	runtimes, err := m.ListCachedRuntimes()
@@ -351,6 +492,19 @@ func (m *Manager) GetCacheInfo() (*CacheInfo, error) {
 		RuntimeCount: len(runtimes),
 	}
 
+	for _, pkgs := range []PackageCache{
+		{Name: "conda", Path: m.GetPkgsDir()},
+		{Name: "pip", Path: m.GetPipCacheDir()},
+		{Name: "wheels", Path: m.GetWheelsDir()},
+		{Name: "npm", Path: m.GetNpmCacheDir()},
+		{Name: "pnpm", Path: m.GetPnpmStoreDir()},
+	} {
+		if _, err := os.Stat(pkgs.Path); err == nil {
+			pkgs.Size = getDirSize(pkgs.Path)
+			info.Packages = append(info.Packages, pkgs)
+		}
+	}
+
 	// Calculate total size
 	info.TotalSize = getDirSize(m.CacheRoot)
 
@@ -362,12 +516,21 @@ func (m *Manager) CleanCache() error {
 	return os.RemoveAll(m.CacheRoot)
 }
 
-// CleanRuntime removes a specific cached runtime
+// CleanRuntime removes a specific cached runtime of this platform
 func (m *Manager) CleanRuntime(language, version string) error {
 	runtimePath := m.GetCachedRuntimePath(language, version)
 	return os.RemoveAll(runtimePath)
 }
 
+// RemoveRuntime removes a runtime returned by ListCachedRuntimes, which
+// may belong to another platform
+func (m *Manager) RemoveRuntime(runtime CachedRuntime) error {
+	if runtime.Path == "" {
+		return fmt.Errorf("cached runtime %s-%s has no path", runtime.Language, runtime.Version)
+	}
+	return os.RemoveAll(runtime.Path)
+}
+
 // PruneCache removes runtimes not used within the specified duration
 func (m *Manager) PruneCache(olderThan time.Duration) (int, error) {
 	runtimes, err := m.ListCachedRuntimes()
@@ -380,7 +543,7 @@ func (m *Manager) PruneCache(olderThan time.Duration) (int, error) {
 
 	for _, runtime := range runtimes {
 		if runtime.LastUsed.Before(cutoff) {
-			if err := m.CleanRuntime(runtime.Language, runtime.Version); err == nil {
+			if err := m.RemoveRuntime(runtime); err == nil {
 				pruned++
 			}
 		}
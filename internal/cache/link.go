@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/sbox-project/sbox/internal/netfs"
+)
+
+// LinkModeEnv selects how cached runtimes are provisioned into projects
+const LinkModeEnv = "SBOX_CACHE_LINK"
+
+// Link modes of SBOX_CACHE_LINK
+const (
+	// LinkAuto clones files where the filesystem supports it (btrfs, XFS
+	// with reflink), hardlinks them otherwise and copies as a last resort
+	LinkAuto = "auto"
+	// LinkReflink clones or copies files, never hardlinking them
+	LinkReflink = "reflink"
+	// LinkCopy always copies files
+	LinkCopy = "copy"
+)
+
+// copiedPaths are files tools write in place, which are never hardlinked
+// so writing them in one project cannot change the cache and the other
+// projects: conda's install history and records, configuration under
+// etc, .pth files and sbox's cache metadata
+var copiedPaths = regexp.MustCompile(`^(conda-meta|etc)/|\.pth$|^\.sbox-cache\.json$`)
+
+// linker places files from the cache into a project, falling back from
+// cloning to hardlinking to copying when the filesystem refuses one
+type linker struct {
+	reflink  bool
+	hardlink bool
+}
+
+// newLinker returns the linker for the link mode of the environment.
+// Hardlinks are not used across network filesystems, where they are
+// unreliable.
+func newLinker(src, dst string) *linker {
+	switch os.Getenv(LinkModeEnv) {
+	case LinkCopy:
+		return &linker{}
+	case LinkReflink:
+		return &linker{reflink: true}
+	}
+	return &linker{
+		reflink:  true,
+		hardlink: !netfs.IsNetwork(src) && !netfs.IsNetwork(filepath.Dir(dst)),
+	}
+}
+
+// place puts the regular file src at dst; rel is its path in the runtime
+func (l *linker) place(src, dst, rel string, mode os.FileMode) error {
+	if l.reflink {
+		if err := reflinkFile(src, dst, mode); err == nil {
+			return nil
+		}
+		// Not supported by this filesystem: stop trying
+		os.Remove(dst)
+		l.reflink = false
+	}
+	if l.hardlink && !copiedPaths.MatchString(filepath.ToSlash(rel)) {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+		// Another filesystem, or no hardlinks on this one
+		l.hardlink = false
+	}
+	return copyFile(src, dst, mode)
+}
+
+// linkDir provisions the runtime at src into dst like copyDir, sharing
+// file contents with the cache where possible
+func linkDir(src, dst string) error {
+	l := newLinker(src, dst)
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		targetPath := filepath.Join(dst, relPath)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(targetPath, info.Mode())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, targetPath)
+		}
+		return l.place(path, targetPath, relPath, info.Mode())
+	})
+}
@@ -0,0 +1,12 @@
+package cache
+
+import (
+	"errors"
+	"os"
+)
+
+// reflinkFile would use clonefile(2), which package syscall does not
+// expose; runtimes are hardlinked instead
+func reflinkFile(src, dst string, mode os.FileMode) error {
+	return errors.New("reflinks are not supported on macOS")
+}
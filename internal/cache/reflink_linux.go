@@ -0,0 +1,32 @@
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, which makes a file share the blocks of
+// another until either is written (btrfs, XFS, bcachefs)
+const ficlone = 0x40049409
+
+// reflinkFile clones src to a new file dst
+func reflinkFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	if err := out.Close(); err != nil && errno == 0 {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package cache
+
+import (
+	"errors"
+	"os"
+)
+
+// reflinkFile would need FSCTL_DUPLICATE_EXTENTS_TO_FILE on ReFS volumes;
+// runtimes are hardlinked instead
+func reflinkFile(src, dst string, mode os.FileMode) error {
+	return errors.New("reflinks are not supported on Windows")
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WheelsDir holds wheels install commands built from source, under pkgs/
+// and split by platform: unlike downloaded wheels, locally built ones are
+// tagged for the host (e.g. linux_x86_64) and may link its libraries
+const WheelsDir = "wheels"
+
+// pipBuiltWheelsDir is where pip caches the wheels it builds from sdists,
+// under PIP_CACHE_DIR
+const pipBuiltWheelsDir = "wheels"
+
+// GetWheelsDir returns the wheels built from source on this platform.
+// Their file names carry the package, version and Python ABI, e.g.
+// grpcio-1.62.1-cp311-cp311-linux_x86_64.whl, so pip only picks those
+// matching the environment.
+func (m *Manager) GetWheelsDir() string {
+	return filepath.Join(m.CacheRoot, PkgsDir, WheelsDir, m.Platform)
+}
+
+// SaveBuiltWheels keeps the wheels pip built into its cache since a time
+// in the wheels directory and returns the file names of those added.
+// pip's own cache finds them only for the exact sdist URL; kept here they
+// are found by package and version whenever an environment is recreated.
+func (m *Manager) SaveBuiltWheels(since time.Time) ([]string, error) {
+	dir := m.GetWheelsDir()
+	var added []string
+	err := filepath.WalkDir(filepath.Join(m.GetPipCacheDir(), pipBuiltWheelsDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".whl") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().Before(since) {
+			return nil
+		}
+		dst := filepath.Join(dir, d.Name())
+		if _, err := os.Stat(dst); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		// Wheels are written once, so a hardlink is as good as a copy
+		tmp := fmt.Sprintf("%s.tmp-%d", dst, os.Getpid())
+		if err := os.Link(path, tmp); err != nil {
+			if err := copyFile(path, tmp, 0644); err != nil {
+				os.Remove(tmp)
+				return err
+			}
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		added = append(added, d.Name())
+		return nil
+	})
+	sort.Strings(added)
+	return added, err
+}
@@ -0,0 +1,155 @@
+// Package compat checks whether a packed sandbox can run on this host:
+// operating system, architecture, glibc version and sbox version.
+package compat
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+var (
+	glibcConstraint = regexp.MustCompile(`^__glibc\s*>=\s*([0-9.]+)`)
+	glibcVersion    = regexp.MustCompile(`(\d+\.\d+)`)
+)
+
+// Archive describes the host an archive was packed on, as recorded in
+// its metadata.json
+type Archive struct {
+	Platform    string `json:"platform"`
+	Arch        string `json:"arch"`
+	GlibcFloor  string `json:"glibc_floor"`
+	SboxVersion string `json:"sbox_version"`
+}
+
+// Problem is one incompatibility. Fatal problems make the sandbox
+// unusable on this host; the others are worth a warning.
+type Problem struct {
+	Message string
+	Hint    string
+	Fatal   bool
+}
+
+// Check compares an archive's requirements with this host. Fields
+// missing from older archives are not checked.
+func Check(a Archive) []Problem {
+	var problems []Problem
+
+	hostPlatform := config.GetPlatformKey()
+	if a.Platform != "" && a.Platform != hostPlatform {
+		problems = append(problems, Problem{
+			Message: fmt.Sprintf("archive was packed for %s, this host is %s", a.Platform, hostPlatform),
+			Hint:    "Rebuild on this host instead: sbox pack --exclude-env on the source, then sbox build here",
+			Fatal:   true,
+		})
+	} else if a.Arch != "" && a.Arch != runtime.GOARCH {
+		problems = append(problems, Problem{
+			Message: fmt.Sprintf("archive was packed for %s, this host is %s", a.Arch, runtime.GOARCH),
+			Hint:    "Binaries in the environment will not execute; rebuild with sbox build",
+			Fatal:   true,
+		})
+	}
+
+	if a.GlibcFloor != "" && runtime.GOOS == "linux" {
+		host := HostGlibc()
+		switch {
+		case host == "":
+			problems = append(problems, Problem{
+				Message: fmt.Sprintf("environment needs glibc %s but the host glibc version could not be determined", a.GlibcFloor),
+				Hint:    "musl-based distributions (e.g. Alpine) cannot run conda-forge environments",
+			})
+		case CompareVersions(host, a.GlibcFloor) < 0:
+			problems = append(problems, Problem{
+				Message: fmt.Sprintf("environment needs glibc >= %s, host has %s", a.GlibcFloor, host),
+				Hint:    "Use a newer host, or build on a host with the oldest glibc you deploy to",
+				Fatal:   true,
+			})
+		}
+	}
+
+	if a.SboxVersion != "" && CompareVersions(a.SboxVersion, config.Version) > 0 {
+		problems = append(problems, Problem{
+			Message: fmt.Sprintf("archive was packed with sbox %s, this is sbox %s", a.SboxVersion, config.Version),
+			Hint:    "Upgrade sbox if relocation or run fails",
+		})
+	}
+
+	return problems
+}
+
+// HostGlibc returns the glibc version of this host, or "" when it is
+// not a glibc system
+func HostGlibc() string {
+	// "glibc 2.36"
+	if out, err := exec.Command("getconf", "GNU_LIBC_VERSION").Output(); err == nil {
+		if m := glibcVersion.FindString(string(out)); m != "" {
+			return m
+		}
+	}
+	// "ldd (GNU libc) 2.36" on the first line
+	if out, err := exec.Command("ldd", "--version").Output(); err == nil {
+		first := strings.SplitN(string(out), "\n", 2)[0]
+		if strings.Contains(first, "GNU") || strings.Contains(first, "GLIBC") {
+			return glibcVersion.FindString(first)
+		}
+	}
+	return ""
+}
+
+// EnvGlibcFloor returns the highest glibc version required by the
+// packages of a conda environment (their __glibc dependencies), or ""
+func EnvGlibcFloor(envDir string) string {
+	files, _ := filepath.Glob(filepath.Join(envDir, "conda-meta", "*.json"))
+
+	floor := ""
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var meta struct {
+			Depends []string `json:"depends"`
+		}
+		if json.Unmarshal(data, &meta) != nil {
+			continue
+		}
+		for _, dep := range meta.Depends {
+			m := glibcConstraint.FindStringSubmatch(dep)
+			if m != nil && (floor == "" || CompareVersions(m[1], floor) > 0) {
+				floor = strings.TrimSuffix(m[1], ".")
+			}
+		}
+	}
+	return floor
+}
+
+// CompareVersions compares dotted numeric versions, returning -1, 0 or 1.
+// Non-numeric parts compare as 0.
+func CompareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,338 @@
+// Package compose loads compose.yaml files that describe several sandboxes
+// started together, either existing sbox projects or services defined
+// inline with their own runtime.
+package compose
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is the compose file looked up in the current directory
+const DefaultFile = "compose.yaml"
+
+// ServicesDir holds the generated projects of inline services, next to
+// the compose file
+const ServicesDir = ".sbox-compose"
+
+// File is a parsed compose.yaml
+type File struct {
+	Services map[string]*Service `yaml:"services"`
+
+	// Path is the absolute path of the compose file
+	Path string `yaml:"-"`
+}
+
+// Service is one sandbox in a compose file. It either references an
+// existing sbox project or defines one inline with runtime and cmd.
+type Service struct {
+	// Project is a path to an existing sbox project, relative to the
+	// compose file
+	Project string `yaml:"project,omitempty"`
+
+	// Inline project definition (same meaning as in .sbox/config.yaml,
+	// with paths relative to the compose file)
+	Runtime string   `yaml:"runtime,omitempty"`
+	Workdir string   `yaml:"workdir,omitempty"`
+	Copy    []string `yaml:"copy,omitempty"`
+	Mount   []string `yaml:"mount,omitempty"`
+	Install []string `yaml:"install,omitempty"`
+
+	// Cmd overrides the project's default command
+	Cmd string `yaml:"cmd,omitempty"`
+
+	// Env is added to (and overrides) the project's environment
+	Env map[string]string `yaml:"env,omitempty"`
+
+	// Priority overrides the project's priority, so batch services can
+	// run below interactive ones
+	Priority config.Priority `yaml:"priority,omitempty"`
+
+	// CPUs overrides the project's cpus, to keep services apart on
+	// many-core hosts
+	CPUs string `yaml:"cpus,omitempty"`
+
+	// Ulimits overrides the project's ulimits
+	Ulimits config.Ulimits `yaml:"ulimits,omitempty"`
+
+	// DependsOn lists services that must be running before this one starts
+	DependsOn []string `yaml:"depends_on,omitempty"`
+
+	// InitTasks run after the project's own init_tasks, before the
+	// service starts
+	InitTasks []config.InitTask `yaml:"init_tasks,omitempty"`
+
+	// Labels tag the service for selecting it, e.g. in 'sbox exec --label'
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// IsInline reports whether the service is defined in the compose file
+// rather than referencing an existing project
+func (s *Service) IsInline() bool {
+	return s.Project == ""
+}
+
+// Load reads and validates a compose file
+func Load(path string) (*File, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose file: %w", err)
+	}
+
+	var f File
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse compose file: %w", err)
+	}
+	f.Path = absPath
+
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (f *File) validate() error {
+	if len(f.Services) == 0 {
+		return fmt.Errorf("%s defines no services", f.Path)
+	}
+
+	for name, svc := range f.Services {
+		if svc == nil {
+			return fmt.Errorf("service '%s' is empty", name)
+		}
+		if strings.ContainsAny(name, "/ \t") {
+			return fmt.Errorf("invalid service name '%s'", name)
+		}
+		if svc.Project != "" && svc.Runtime != "" {
+			return fmt.Errorf("service '%s' sets both project and runtime; use one", name)
+		}
+		if svc.IsInline() {
+			if svc.Runtime == "" {
+				return fmt.Errorf("service '%s' needs either project or runtime", name)
+			}
+			if svc.Cmd == "" {
+				return fmt.Errorf("inline service '%s' needs a cmd", name)
+			}
+		}
+		if err := svc.Priority.Check(); err != nil {
+			return fmt.Errorf("service '%s': %w", name, err)
+		}
+		if svc.CPUs != "" {
+			if _, err := config.ParseCPUList(svc.CPUs); err != nil {
+				return fmt.Errorf("service '%s': %w", name, err)
+			}
+		}
+		var ulimitErr error
+		svc.Ulimits.Each(func(key, value string) {
+			if _, err := config.ParseUlimit(key, value); err != nil && ulimitErr == nil {
+				ulimitErr = fmt.Errorf("service '%s': %w", name, err)
+			}
+		})
+		if ulimitErr != nil {
+			return ulimitErr
+		}
+		if err := config.CheckInitTasks(svc.InitTasks); err != nil {
+			return fmt.Errorf("service '%s': %w", name, err)
+		}
+		for _, dep := range svc.DependsOn {
+			if _, ok := f.Services[dep]; !ok {
+				return fmt.Errorf("service '%s' depends on unknown service '%s'", name, dep)
+			}
+		}
+	}
+
+	// Reject dependency cycles up front
+	_, err := f.Order(nil)
+	return err
+}
+
+// Dir returns the directory containing the compose file
+func (f *File) Dir() string {
+	return filepath.Dir(f.Path)
+}
+
+// Names returns all service names, sorted
+func (f *File) Names() []string {
+	names := make([]string, 0, len(f.Services))
+	for name := range f.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Order returns the given services and everything they depend on, with
+// dependencies before their dependents. No names means all services.
+func (f *File) Order(names []string) ([]string, error) {
+	if len(names) == 0 {
+		names = f.Names()
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var order []string
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		svc, ok := f.Services[name]
+		if !ok {
+			return fmt.Errorf("no such service: %s", name)
+		}
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		}
+
+		state[name] = visiting
+		deps := append([]string{}, svc.DependsOn...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Select returns the services matching every selector, dependencies
+// before their dependents. A selector is "key=value", or "key" for any
+// service that has the label.
+func (f *File) Select(selectors []string) ([]string, error) {
+	for _, selector := range selectors {
+		if key, _, _ := strings.Cut(selector, "="); key == "" {
+			return nil, fmt.Errorf("invalid label selector '%s' (expected key=value or key)", selector)
+		}
+	}
+
+	order, err := f.Order(nil)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range order {
+		if f.Services[name].Matches(selectors) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Matches reports whether the service's labels match every selector
+func (s *Service) Matches(selectors []string) bool {
+	for _, selector := range selectors {
+		key, value, hasValue := strings.Cut(selector, "=")
+		got, ok := s.Labels[key]
+		if !ok || (hasValue && got != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Dependents returns the services that directly depend on name
+func (f *File) Dependents(name string) []string {
+	var out []string
+	for _, other := range f.Names() {
+		for _, dep := range f.Services[other].DependsOn {
+			if dep == name {
+				out = append(out, other)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// ProjectRoot returns the sbox project directory backing a service
+func (f *File) ProjectRoot(name string) string {
+	svc := f.Services[name]
+	if !svc.IsInline() {
+		if filepath.IsAbs(svc.Project) {
+			return svc.Project
+		}
+		return filepath.Join(f.Dir(), svc.Project)
+	}
+	return filepath.Join(f.Dir(), ServicesDir, name)
+}
+
+// Materialize writes the generated project config of an inline service.
+// Copy, mount and install paths are rewritten so they stay relative to
+// the compose file. Referenced projects are left untouched.
+func (f *File) Materialize(name string) error {
+	svc := f.Services[name]
+	if !svc.IsInline() {
+		return nil
+	}
+
+	root := f.ProjectRoot(name)
+	rel, err := filepath.Rel(root, f.Dir())
+	if err != nil {
+		return err
+	}
+
+	cfg := config.NewDefaultConfig(svc.Runtime)
+	cfg.Cmd = svc.Cmd
+	cfg.Copy = nil
+	cfg.Install = nil
+	if svc.Workdir != "" {
+		cfg.Workdir = svc.Workdir
+	}
+	for _, spec := range svc.Copy {
+		cfg.Copy = append(cfg.Copy, rebaseSpec(spec, rel))
+	}
+	for _, spec := range svc.Mount {
+		cfg.Mount = append(cfg.Mount, rebaseSpec(spec, rel))
+	}
+	for _, cmd := range svc.Install {
+		cfg.Install = append(cfg.Install, fmt.Sprintf("cd %s && %s", rel, cmd))
+	}
+	// Service env, priority, cpus, ulimits and init tasks are applied at
+	// start time so changing them does not force a rebuild
+
+	// Only rewrite the config when it changed
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	configPath := config.GetConfigPath(root)
+	if existing, err := os.ReadFile(configPath); err == nil && string(existing) == string(data) {
+		return nil
+	}
+	return cfg.Save(root)
+}
+
+// rebaseSpec rewrites the relative source of a "src:dst" spec
+func rebaseSpec(spec, rel string) string {
+	parts := strings.SplitN(spec, ":", 2)
+	if filepath.IsAbs(parts[0]) {
+		return spec
+	}
+	parts[0] = filepath.Join(rel, parts[0])
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ParseBuildArgs parses --build-arg NAME=VALUE flags
+func ParseBuildArgs(flags []string) (map[string]string, error) {
+	args := make(map[string]string)
+	for _, flag := range flags {
+		name, value, ok := strings.Cut(flag, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid build arg '%s': expected NAME=VALUE", flag)
+		}
+		if !envFileKey.MatchString(name) {
+			return nil, fmt.Errorf("invalid build arg name '%s'", name)
+		}
+		args[name] = value
+	}
+	return args, nil
+}
+
+// ArgNames returns the names of the declared build args, sorted
+func (c *Config) ArgNames() []string {
+	names := make([]string, 0, len(c.Args))
+	for name := range c.Args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BuildArgs returns the --build-arg values the configuration was loaded
+// or built with, nil for none
+func (c *Config) BuildArgs() map[string]string {
+	return c.buildArgs
+}
+
+// WithBuildArgs returns a copy of a configuration with build args
+// overridden, on top of those it was loaded with, and its references
+// resolved again. Overriding an arg args: does not declare is an error.
+func (c *Config) WithBuildArgs(projectRoot string, overrides map[string]string) (*Config, error) {
+	if len(overrides) == 0 {
+		return c, nil
+	}
+	raw, err := c.Raw().withArgs(overrides, true)
+	if err != nil {
+		return nil, err
+	}
+	return raw.Resolve(projectRoot)
+}
+
+// withArgs returns a copy of a configuration as written with build args
+// overridden. Undeclared args are an error when strict is set and
+// skipped otherwise, e.g. those of sbox.lock after args: changed.
+func (c *Config) withArgs(overrides map[string]string, strict bool) (*Config, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var applied Config
+	if err := yaml.Unmarshal(data, &applied); err != nil {
+		return nil, err
+	}
+	if applied.Env == nil {
+		applied.Env = make(map[string]string)
+	}
+	applied.profile = c.profile
+	applied.base = c.Base()
+
+	applied.buildArgs = make(map[string]string)
+	for name, value := range c.buildArgs {
+		applied.buildArgs[name] = value
+	}
+	for name, value := range overrides {
+		if _, ok := applied.Args[name]; !ok {
+			if !strict {
+				continue
+			}
+			if len(applied.Args) == 0 {
+				return nil, fmt.Errorf("unknown build arg '%s': config.yaml declares no args", name)
+			}
+			return nil, fmt.Errorf("unknown build arg '%s' (declared: %s)", name, strings.Join(applied.ArgNames(), ", "))
+		}
+		applied.Args[name] = value
+		applied.buildArgs[name] = value
+	}
+	return &applied, nil
+}
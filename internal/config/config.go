@@ -9,20 +9,26 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Version is the sbox release version
+const Version = "0.4.0"
+
 // Constants
 const (
-	SboxDir       = ".sbox"
-	ConfigFile    = "config.yaml"
-	LockFile      = "sbox.lock"
-	EnvDir        = "env"
-	RootfsDir     = "rootfs"
-	EnvScript     = "env.sh"
+	SboxDir         = ".sbox"
+	ConfigFile      = "config.yaml"
+	AnchorFile      = "sbox.yaml"
+	LockFile        = "sbox.lock"
+	EnvDir          = "env"
+	RootfsDir       = "rootfs"
+	EnvScript       = "env.sh"
 	GlobalCacheName = "cache"
 )
 
@@ -35,8 +41,492 @@ type Config struct {
 	Install []string          `yaml:"install"`
 	Cmd     string            `yaml:"cmd"`
 	Env     map[string]string `yaml:"env"`
+
+	// Args are build arguments and their defaults, referenced as ${NAME}
+	// in install and copy and overridden with 'sbox build --build-arg
+	// NAME=VALUE'. Their resolved values are part of the config hash.
+	Args map[string]string `yaml:"args,omitempty" json:",omitempty"`
+
+	// PreBuild and PostBuild are shell commands 'sbox build' runs in the
+	// sandbox environment from the project root: pre_build once the
+	// runtime is set up, before files are copied, and post_build after
+	// the install commands
+	PreBuild  []string `yaml:"pre_build,omitempty" json:",omitempty"`
+	PostBuild []string `yaml:"post_build,omitempty" json:",omitempty"`
+
+	// PreRun and PostRun are shell commands run in the workdir before and
+	// after the command of 'sbox run' and of daemons. A failing pre_run
+	// hook keeps the command from starting.
+	PreRun  []string `yaml:"pre_run,omitempty" json:"-"`
+	PostRun []string `yaml:"post_run,omitempty" json:"-"`
+
+	// InitTasks are one-shot setup commands, such as database migrations
+	// or asset builds, run to completion in order before the project's
+	// service starts on 'sbox compose up'. A failing task aborts the
+	// startup.
+	InitTasks []InitTask `yaml:"init_tasks,omitempty" json:"-"`
+
+	// Healthchecks probe daemons for 'sbox healthcheck', keyed by daemon
+	// name: web: probes the daemon started with 'sbox run -d --name
+	// web'.
+	Healthchecks map[string]HealthCheck `yaml:"healthchecks,omitempty" json:"-"`
+
+	// EnvFile is a .env file of KEY=VALUE lines, relative to the project
+	// root, loaded by run, exec, shell and daemons. env entries take
+	// precedence.
+	EnvFile string `yaml:"env_file,omitempty" json:"-"`
+
+	// Secrets are names of secrets set with 'sbox secret set', given to
+	// run, exec, shell and daemons as environment variables of the same
+	// name. They are decrypted at run time and never written to env.sh.
+	Secrets []string `yaml:"secrets,omitempty" json:"-"`
+
+	// Ports names the TCP ports the application listens on, e.g.
+	// http: 8000. They are exported as SBOX_PORT_<NAME> and shown by
+	// 'sbox port'.
+	Ports map[string]int `yaml:"ports,omitempty" json:"-"`
+
+	// IdleTimeout stops daemons with no log output and no TCP connections
+	// for this long (e.g. "30m"). Empty disables the idle policy.
+	IdleTimeout string `yaml:"idle_timeout,omitempty" json:"-"`
+
+	// Shared enables multi-user mode: group-writable .sbox files, per-user
+	// process/log namespaces and build locking across users.
+	Shared bool `yaml:"shared,omitempty" json:"-"`
+
+	// HostLibs are host directories appended to LD_LIBRARY_PATH, after the
+	// environment's lib, for host CUDA, MKL or InfiniBand libraries.
+	// $VAR references are expanded.
+	HostLibs []string `yaml:"host_libs,omitempty" json:",omitempty"`
+
+	// GPU installs the CUDA libraries and cuDNN from conda-forge into the
+	// environment and exposes the host's NVIDIA driver libraries and
+	// /dev/nvidia* devices to commands. CUDA pins the CUDA version (e.g.
+	// "12.1") and implies GPU; without it the newest version the host
+	// driver supports is installed.
+	GPU  bool   `yaml:"gpu,omitempty" json:",omitempty"`
+	CUDA string `yaml:"cuda,omitempty" json:",omitempty"`
+
+	// PathMode sets the host directories that follow the environment's
+	// bin on PATH in run, exec, shell and daemons: "isolated" (default,
+	// the system directories), "inherit" (the host's PATH) or "custom"
+	// (the directories in Path, in order).
+	PathMode string `yaml:"path_mode,omitempty" json:"-"`
+	// Path is the host PATH of path_mode: custom. $VAR references are
+	// expanded.
+	Path []string `yaml:"path,omitempty" json:"-"`
+
+	// Isolation confines run, shell, exec and daemons: "none" (default)
+	// or "namespace" (user namespaces via bwrap or unshare, exposing only
+	// the sandbox, the system directories and declared mounts).
+	Isolation string `yaml:"isolation,omitempty" json:"-"`
+
+	// VCS is "none" to keep sbox from adding its state to .gitignore
+	// or .hgignore, or offering to.
+	VCS string `yaml:"vcs,omitempty" json:"-"`
+
+	// Pack sets what 'sbox pack' leaves out of archives.
+	Pack PackConfig `yaml:"pack,omitempty" json:"-"`
+
+	// Limits constrains the resources of daemons started with
+	// 'sbox run -d'.
+	Limits Limits `yaml:"limits,omitempty" json:"-"`
+
+	// Ulimits raise (or lower) the rlimits of run, exec, shell and
+	// daemons, e.g. nofile for servers on hosts that default to 1024.
+	Ulimits Ulimits `yaml:"ulimits,omitempty" json:"-"`
+
+	// Priority lowers (or raises) the CPU and IO scheduling priority of
+	// run, exec, shell and daemons, so batch sandboxes yield to
+	// interactive services on the same host.
+	Priority Priority `yaml:"priority,omitempty" json:"-"`
+
+	// CPUs pins run, exec, shell and daemons to host CPUs, as a list such
+	// as "0-3" or "0,2,8-15" (see taskset(1)). Linux only.
+	CPUs string `yaml:"cpus,omitempty" json:"-"`
+
+	// Slurm holds the batch job options of 'sbox slurm'.
+	Slurm SlurmConfig `yaml:"slurm,omitempty" json:"-"`
+
+	// Logging rotates the daemon logs in .sbox/logs.
+	Logging LoggingConfig `yaml:"logging,omitempty" json:"-"`
+
+	// Licenses is the license policy 'sbox licenses' checks installed
+	// packages against.
+	Licenses LicensePolicy `yaml:"licenses,omitempty" json:"-"`
+
+	// Profiles are named variants of the configuration, such as dev and
+	// prod, selected with --profile or $SBOX_PROFILE. The selected
+	// profile is applied to the fields above, so only it is part of the
+	// config hash.
+	Profiles map[string]Profile `yaml:"profiles,omitempty" json:"-"`
+
+	// raw is the configuration before ${VAR} references were resolved
+	// (nil when it was not loaded with Load), and unresolved the
+	// referenced variables that were not set
+	raw        *Config
+	unresolved []string
+
+	// buildArgs are the --build-arg values applied to Args
+	buildArgs map[string]string
+
+	// profile is the name of the applied profile and base the
+	// configuration before it was applied
+	profile string
+	base    *Config
+}
+
+// ProfileEnv selects a profile when --profile is not given
+const ProfileEnv = "SBOX_PROFILE"
+
+// Profile overrides parts of the configuration. cmd, mount and install
+// replace the top-level values when set; env entries are added to (and
+// take precedence over) the top-level env.
+type Profile struct {
+	Cmd     string            `yaml:"cmd,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Mount   []string          `yaml:"mount,omitempty"`
+	Install []string          `yaml:"install,omitempty"`
+}
+
+// Hook stages, named after their config keys
+const (
+	HookPreBuild  = "pre_build"
+	HookPostBuild = "post_build"
+	HookPreRun    = "pre_run"
+	HookPostRun   = "post_run"
+)
+
+// HookStages lists the hook stages in the order they run
+var HookStages = []string{HookPreBuild, HookPostBuild, HookPreRun, HookPostRun}
+
+// Hooks returns the commands of a hook stage
+func (c *Config) Hooks(stage string) []string {
+	switch stage {
+	case HookPreBuild:
+		return c.PreBuild
+	case HookPostBuild:
+		return c.PostBuild
+	case HookPreRun:
+		return c.PreRun
+	case HookPostRun:
+		return c.PostRun
+	}
+	return nil
+}
+
+// InitTask is a command of init_tasks. Its output is kept apart from
+// the service's, in .sbox/logs/init-<name>.log.
+type InitTask struct {
+	Name string `yaml:"name"`
+	Cmd  string `yaml:"cmd"`
+}
+
+// HealthCheck probes a running daemon, with either a shell command run in
+// the sandbox environment or an HTTP GET. The command's exit status
+// follows the monitoring plugin convention: 0 is ok, 1 a warning and
+// anything else critical. The GET passes with a 2xx response.
+type HealthCheck struct {
+	Command string `yaml:"command,omitempty"`
+	// HTTP is a URL; ${VAR} references are resolved from the sandbox
+	// environment, e.g. http://localhost:${SBOX_PORT_HTTP}/health
+	HTTP string `yaml:"http,omitempty"`
+	// Timeout makes a probe that takes longer critical (default 10s)
+	Timeout string `yaml:"timeout,omitempty"`
+	// Slow turns a passing probe that takes longer into a warning
+	Slow string `yaml:"slow,omitempty"`
+}
+
+// InitTaskLog is the log name of an init task, for 'sbox logs'
+func InitTaskLog(name string) string {
+	return "init-" + name
+}
+
+// CheckInitTasks returns why a list of init tasks is invalid, or nil
+func CheckInitTasks(tasks []InitTask) error {
+	seen := make(map[string]bool)
+	for i, task := range tasks {
+		switch {
+		case task.Name == "":
+			return fmt.Errorf("init task %d needs a name", i+1)
+		case strings.ContainsAny(task.Name, "/ \t"):
+			return fmt.Errorf("invalid init task name '%s'", task.Name)
+		case seen[task.Name]:
+			return fmt.Errorf("init task '%s' is defined twice", task.Name)
+		case strings.TrimSpace(task.Cmd) == "":
+			return fmt.Errorf("init task '%s' needs a cmd", task.Name)
+		}
+		seen[task.Name] = true
+	}
+	return nil
+}
+
+// SlurmConfig are sbatch options for jobs generated by 'sbox slurm'
+type SlurmConfig struct {
+	Partition string `yaml:"partition,omitempty"`
+	Account   string `yaml:"account,omitempty"`
+	QOS       string `yaml:"qos,omitempty"`
+	// Time is the wall clock limit in Slurm's format, e.g. "02:00:00"
+	// or "1-12:00:00"
+	Time  string `yaml:"time,omitempty"`
+	Nodes int    `yaml:"nodes,omitempty"`
+	// CPUs is the number of CPUs per task
+	CPUs int `yaml:"cpus,omitempty"`
+	// Memory is the memory per node, e.g. "16G"
+	Memory string `yaml:"memory,omitempty"`
+	// GPUs is a count or type:count, e.g. "2" or "a100:1"
+	GPUs string `yaml:"gpus,omitempty"`
+	// Options are additional sbatch options, e.g. "--constraint=ib"
+	Options []string `yaml:"options,omitempty"`
+}
+
+// LoggingConfig sets when daemon logs are rotated
+type LoggingConfig struct {
+	// MaxSize rotates a log once it reaches this size, e.g. "10M"; logs
+	// grow without limit when it is empty
+	MaxSize string `yaml:"max_size,omitempty"`
+	// MaxFiles is the number of rotated files kept (default 5)
+	MaxFiles int `yaml:"max_files,omitempty"`
+	// Compress gzips rotated files
+	Compress bool `yaml:"compress,omitempty"`
+	// Structured prefixes every line with its capture time and stream
+	// (out or err) and keeps an index of the log, for 'sbox logs
+	// --stderr-only' and fast --since
+	Structured bool `yaml:"structured,omitempty"`
+}
+
+// LicensePolicy lists accepted and rejected licenses as SPDX identifiers
+// or glob patterns, e.g. "MIT" or "GPL-*", matched case-insensitively.
+// With an allow list, every other license is rejected.
+type LicensePolicy struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+// Limits are resource limits for daemons, enforced with cgroups v2 (via
+// a systemd user scope) when available and with rlimits otherwise
+type Limits struct {
+	// Memory is the memory ceiling, e.g. "512M" or "2G"
+	Memory string `yaml:"memory,omitempty"`
+	// CPUShares is the relative CPU weight (1024 is the default share);
+	// it needs cgroups v2
+	CPUShares int `yaml:"cpu_shares,omitempty"`
+	// NoFile is the maximum number of open files
+	NoFile int `yaml:"nofile,omitempty"`
+	// NProc is the maximum number of processes and threads
+	NProc int `yaml:"nproc,omitempty"`
+}
+
+// IsZero reports whether no limit is set
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Ulimits are the ulimits: section of config.yaml. Each value is a
+// number, "unlimited", or "soft:hard" of those; core takes sizes such as
+// 1G.
+type Ulimits struct {
+	// NoFile is the number of open files
+	NoFile string `yaml:"nofile,omitempty"`
+	// NProc is the number of processes and threads of the user
+	NProc string `yaml:"nproc,omitempty"`
+	// Core is the size of core dumps
+	Core string `yaml:"core,omitempty"`
+}
+
+// IsZero reports whether no ulimit is set
+func (u Ulimits) IsZero() bool {
+	return u == Ulimits{}
+}
+
+// Each calls fn with the key and value of every set ulimit, in a fixed
+// order
+func (u Ulimits) Each(fn func(key, value string)) {
+	for _, entry := range []struct{ key, value string }{
+		{"nofile", u.NoFile},
+		{"nproc", u.NProc},
+		{"core", u.Core},
+	} {
+		if entry.value != "" {
+			fn(entry.key, entry.value)
+		}
+	}
+}
+
+// RlimitInfinity is the value of "unlimited" (RLIM_INFINITY)
+const RlimitInfinity = ^uint64(0)
+
+// Ulimit is a parsed ulimits: value
+type Ulimit struct {
+	Soft, Hard uint64
+}
+
+// ParseUlimit parses the value of a ulimits: key. A single value sets
+// both the soft and the hard limit.
+func ParseUlimit(key, value string) (Ulimit, error) {
+	soft, hard, isPair := strings.Cut(value, ":")
+	var u Ulimit
+	var err error
+	if u.Soft, err = parseRlimit(key, soft); err != nil {
+		return u, err
+	}
+	u.Hard = u.Soft
+	if isPair {
+		if u.Hard, err = parseRlimit(key, hard); err != nil {
+			return u, err
+		}
+		if u.Soft > u.Hard {
+			return u, fmt.Errorf("soft %s limit %s is above the hard limit %s", key, soft, hard)
+		}
+	}
+	return u, nil
+}
+
+func parseRlimit(key, value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if value == "unlimited" || value == "infinity" || value == "-1" {
+		return RlimitInfinity, nil
+	}
+	if key == "core" && value != "0" {
+		if size, err := ParseSize(value); err == nil {
+			return uint64(size), nil
+		}
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s limit '%s' (use a number, unlimited or soft:hard)", key, value)
+	}
+	return n, nil
 }
 
+// IO scheduling classes of priority.io_class, as in ionice(1)
+const (
+	IOClassRealtime   = "realtime"
+	IOClassBestEffort = "best-effort"
+	IOClassIdle       = "idle"
+)
+
+// Priority is the scheduling priority of sandbox commands. Daemons also
+// get matching cgroup CPU and IO weights when cgroups v2 is available.
+type Priority struct {
+	// Nice is the nice value, from -20 (most favorable) to 19 (least);
+	// values below 0 need privileges
+	Nice int `yaml:"nice,omitempty"`
+	// IOClass is the IO scheduling class: realtime, best-effort or idle.
+	// The level within the class follows Nice. Linux only.
+	IOClass string `yaml:"io_class,omitempty"`
+}
+
+// IsZero reports whether the default priority is kept
+func (p Priority) IsZero() bool {
+	return p == Priority{}
+}
+
+// Check returns why a priority is invalid, or nil
+func (p Priority) Check() error {
+	if p.Nice < -20 || p.Nice > 19 {
+		return fmt.Errorf("nice must be between -20 and 19, got %d", p.Nice)
+	}
+	switch p.IOClass {
+	case "", IOClassRealtime, IOClassBestEffort, IOClassIdle:
+		return nil
+	}
+	return fmt.Errorf("unknown io_class '%s' (use %s, %s or %s)", p.IOClass, IOClassRealtime, IOClassBestEffort, IOClassIdle)
+}
+
+// ParseSize parses a byte size with an optional K, M, G or T suffix
+// (powers of 1024, an optional trailing B or i is accepted)
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+
+	multiplier := int64(1)
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			str = str[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// maxCPU is the highest CPU number Linux supports (NR_CPUS is at most 8192)
+const maxCPU = 8191
+
+// ParseCPUList parses a CPU list such as "0-3" or "0,2,8-15" into sorted,
+// distinct CPU numbers
+func ParseCPUList(s string) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil || lo < 0 {
+			return nil, fmt.Errorf("invalid CPU list '%s'", s)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(last); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid CPU range '%s' in '%s'", part, s)
+			}
+		}
+		if hi > maxCPU {
+			return nil, fmt.Errorf("CPU %d in '%s' is beyond the highest possible CPU %d", hi, s, maxCPU)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			seen[cpu] = true
+		}
+	}
+
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// PackConfig is the pack section of config.yaml; pack flags add to it
+type PackConfig struct {
+	ExcludeLogs    bool     `yaml:"exclude_logs,omitempty"`
+	ExcludeVolumes bool     `yaml:"exclude_volumes,omitempty"`
+	ExcludeCaches  bool     `yaml:"exclude_caches,omitempty"`
+	Exclude        []string `yaml:"exclude,omitempty"`
+}
+
+// Isolation modes
+const (
+	IsolationNone      = "none"
+	IsolationNamespace = "namespace"
+)
+
+// VCSNone turns off .gitignore and .hgignore maintenance
+const VCSNone = "none"
+
+// PATH modes
+const (
+	PathIsolated = "isolated"
+	PathInherit  = "inherit"
+	PathCustom   = "custom"
+)
+
+// SystemPath is the host PATH of path_mode: isolated
+var SystemPath = systemPath()
+
 // CopySpec represents a parsed copy specification
 type CopySpec struct {
 	Src string
@@ -62,14 +552,83 @@ type LockData struct {
 	ConfigHash string `json:"config_hash"`
 	BuiltAt    string `json:"built_at"`
 	Runtime    string `json:"runtime"`
+	// Platform is the platform key the packages were resolved for
+	Platform string `json:"platform,omitempty"`
+	// Profile is the profile the sandbox was built with, if any
+	Profile string `json:"profile,omitempty"`
+	// BuildArgs are the --build-arg values of the build. Load applies
+	// them, so later builds and up-to-date checks keep them.
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+
+	// Packages is the resolved dependency set captured after the build,
+	// used by 'sbox build --frozen' to reproduce it
+	Packages *LockedPackages `json:"packages,omitempty"`
+
+	// Steps records the inputs of each build step, so the next build can
+	// skip the steps whose inputs did not change
+	Steps *BuildSteps `json:"steps,omitempty"`
+}
+
+// BuildSteps holds a fingerprint per build step. Install commands are
+// chained like image layers: each fingerprint covers the runtime and all
+// earlier commands, so changing one command reruns it and those after it.
+type BuildSteps struct {
+	Runtime string            `json:"runtime"`
+	Copy    map[string]string `json:"copy,omitempty"`
+	Install []string          `json:"install,omitempty"`
+}
+
+// LockedPackages holds resolved package versions per package manager
+type LockedPackages struct {
+	Conda []LockedPackage `json:"conda,omitempty"`
+	Pip   []LockedPackage `json:"pip,omitempty"`
+	Npm   []LockedPackage `json:"npm,omitempty"`
+	// NpmLocal are the npm packages installed into the project's own
+	// node_modules, as opposed to the environment's global ones
+	NpmLocal []LockedPackage `json:"npm_local,omitempty"`
+}
+
+// LockedPackage is one resolved package
+type LockedPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Empty reports whether no package was captured
+func (p *LockedPackages) Empty() bool {
+	return p == nil || len(p.Conda)+len(p.Pip)+len(p.Npm)+len(p.NpmLocal) == 0
 }
 
+// BuildRecord is one entry of the project's build history
+type BuildRecord struct {
+	StartedAt  time.Time `json:"started_at"`
+	Duration   string    `json:"duration"`
+	ConfigHash string    `json:"config_hash"`
+	Runtime    string    `json:"runtime"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// BuildHistoryFile stores build records (one JSON object per line)
+const BuildHistoryFile = "builds.jsonl"
+
 // MicromambaURLs maps platform to download URL
 var MicromambaURLs = map[string]string{
 	"darwin-arm64":  "https://micro.mamba.pm/api/micromamba/osx-arm64/latest",
 	"darwin-amd64":  "https://micro.mamba.pm/api/micromamba/osx-64/latest",
 	"linux-amd64":   "https://micro.mamba.pm/api/micromamba/linux-64/latest",
 	"linux-arm64":   "https://micro.mamba.pm/api/micromamba/linux-aarch64/latest",
+	"windows-amd64": "https://micro.mamba.pm/api/micromamba/win-64/latest",
+}
+
+// CondaSubdirs maps platform to conda subdir, the value of micromamba's
+// --platform flag
+var CondaSubdirs = map[string]string{
+	"darwin-arm64":  "osx-arm64",
+	"darwin-amd64":  "osx-64",
+	"linux-amd64":   "linux-64",
+	"linux-arm64":   "linux-aarch64",
+	"windows-amd64": "win-64",
 }
 
 // NewDefaultConfig creates a new default configuration
@@ -77,7 +636,7 @@ func NewDefaultConfig(runtimeStr string) *Config {
 	if runtimeStr == "" {
 		runtimeStr = "python:3.10"
 	}
-	return &Config{
+	cfg := &Config{
 		Runtime: runtimeStr,
 		Workdir: "/app",
 		Copy:    []string{"./app:/app"},
@@ -85,11 +644,123 @@ func NewDefaultConfig(runtimeStr string) *Config {
 		Cmd:     "python main.py",
 		Env:     make(map[string]string),
 	}
+	if spec, ok := LookupRuntime(cfg.ParseRuntime().Language); ok {
+		cfg.Install = append([]string{}, spec.Install...)
+		cfg.Cmd = spec.Cmd
+	}
+	return cfg
 }
 
-// Load loads configuration from a project root
+// sensitiveEnvParts mark environment variable names whose values are
+// likely secrets
+var sensitiveEnvParts = []string{"password", "secret", "key", "token", "credential"}
+
+// IsSensitiveEnv reports whether an environment variable is likely to
+// hold a secret, judging by its name
+func IsSensitiveEnv(name string) bool {
+	lower := strings.ToLower(name)
+	for _, part := range sensitiveEnvParts {
+		if strings.Contains(lower, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load loads configuration from a project root, resolving ${VAR} and
+// ${VAR:-default} references (see Interpolate). Variables are taken from
+// the process environment first, then from env_file, then the default.
+// The profile named by $SBOX_PROFILE is applied first, then the build
+// args recorded in sbox.lock by the last build.
 func Load(projectRoot string) (*Config, error) {
-	configPath := filepath.Join(projectRoot, SboxDir, ConfigFile)
+	raw, err := LoadRaw(projectRoot)
+	if err != nil {
+		return nil, err
+	}
+	raw, err = raw.WithProfile(os.Getenv(ProfileEnv))
+	if err != nil {
+		return nil, err
+	}
+	if lock, err := LoadLock(projectRoot); err == nil && len(lock.BuildArgs) > 0 {
+		if raw, err = raw.withArgs(lock.BuildArgs, false); err != nil {
+			return nil, err
+		}
+	}
+	return raw.Resolve(projectRoot)
+}
+
+// WithProfile returns a copy of a configuration as written with a
+// profile applied. An empty name returns the configuration itself.
+func (c *Config) WithProfile(name string) (*Config, error) {
+	if name == "" {
+		return c, nil
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		if len(c.Profiles) == 0 {
+			return nil, fmt.Errorf("unknown profile '%s': config.yaml defines no profiles", name)
+		}
+		return nil, fmt.Errorf("unknown profile '%s' (defined: %s)", name, strings.Join(c.ProfileNames(), ", "))
+	}
+
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var applied Config
+	if err := yaml.Unmarshal(data, &applied); err != nil {
+		return nil, err
+	}
+	if applied.Env == nil {
+		applied.Env = make(map[string]string)
+	}
+
+	if profile.Cmd != "" {
+		applied.Cmd = profile.Cmd
+	}
+	for key, value := range profile.Env {
+		applied.Env[key] = value
+	}
+	if profile.Mount != nil {
+		applied.Mount = append([]string{}, profile.Mount...)
+	}
+	if profile.Install != nil {
+		applied.Install = append([]string{}, profile.Install...)
+	}
+	applied.profile = name
+	applied.base = c
+	return &applied, nil
+}
+
+// Profile returns the name of the applied profile, or "" for none
+func (c *Config) Profile() string {
+	return c.profile
+}
+
+// Base returns the configuration as written, before a profile was
+// applied and references were resolved
+func (c *Config) Base() *Config {
+	raw := c.Raw()
+	if raw.base != nil {
+		return raw.base
+	}
+	return raw
+}
+
+// ProfileNames returns the names of the defined profiles, sorted
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadRaw loads configuration as written, without resolving references.
+// Use it to edit and save config.yaml.
+func LoadRaw(projectRoot string) (*Config, error) {
+	configPath := GetConfigPath(projectRoot)
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config: %w", err)
@@ -114,9 +785,10 @@ func Load(projectRoot string) (*Config, error) {
 	return &cfg, nil
 }
 
-// Save saves configuration to a project root
+// Save saves configuration to a project root, in its sbox.yaml when that
+// is where it was loaded from
 func (c *Config) Save(projectRoot string) error {
-	configPath := filepath.Join(projectRoot, SboxDir, ConfigFile)
+	configPath := GetConfigPath(projectRoot)
 
 	// Ensure directory exists
 	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
@@ -139,9 +811,9 @@ func (c *Config) Save(projectRoot string) error {
 func (c *Config) ParseCopy() []CopySpec {
 	var specs []CopySpec
 	for _, item := range c.Copy {
-		parts := strings.SplitN(item, ":", 2)
-		if len(parts) == 2 {
-			specs = append(specs, CopySpec{Src: parts[0], Dst: parts[1]})
+		parts := SplitSpec(item)
+		if len(parts) >= 2 {
+			specs = append(specs, CopySpec{Src: parts[0], Dst: strings.Join(parts[1:], ":")})
 		} else {
 			specs = append(specs, CopySpec{Src: item, Dst: item})
 		}
@@ -154,7 +826,7 @@ func (c *Config) ParseCopy() []CopySpec {
 func (c *Config) ParseMount() []MountSpec {
 	var specs []MountSpec
 	for _, item := range c.Mount {
-		parts := strings.Split(item, ":")
+		parts := SplitSpec(item)
 		if len(parts) < 2 {
 			// Invalid format, skip
 			continue
@@ -176,6 +848,49 @@ func (c *Config) ParseMount() []MountSpec {
 	return specs
 }
 
+// HostLibDirs returns the host_libs directories with environment
+// variables expanded
+func (c *Config) HostLibDirs() []string {
+	dirs := make([]string, 0, len(c.HostLibs))
+	for _, dir := range c.HostLibs {
+		dirs = append(dirs, filepath.Clean(os.ExpandEnv(dir)))
+	}
+	return dirs
+}
+
+// UsesGPU reports whether gpu: or cuda: is set
+func (c *Config) UsesGPU() bool {
+	return c.GPU || c.CUDA != ""
+}
+
+// HostPathDirs returns the host directories that follow the environment's
+// bin on PATH under path_mode
+func (c *Config) HostPathDirs() []string {
+	switch c.PathMode {
+	case PathInherit:
+		var dirs []string
+		for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+			if dir != "" {
+				dirs = append(dirs, dir)
+			}
+		}
+		return dirs
+	case PathCustom:
+		dirs := make([]string, 0, len(c.Path))
+		for _, dir := range c.Path {
+			dirs = append(dirs, filepath.Clean(os.ExpandEnv(dir)))
+		}
+		return dirs
+	}
+	return SystemPath
+}
+
+// PortEnvName returns the environment variable a named port is exported
+// as: SBOX_PORT_ plus the name upper-cased, with '-' as '_'
+func PortEnvName(name string) string {
+	return "SBOX_PORT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
 // ParseRuntime parses the runtime string
 func (c *Config) ParseRuntime() RuntimeInfo {
 	parts := strings.SplitN(c.Runtime, ":", 2)
@@ -189,14 +904,22 @@ func (c *Config) ParseRuntime() RuntimeInfo {
 	return info
 }
 
-// Hash computes a hash of the configuration
+// Hash computes a hash of the configuration. Fields tagged json:"-" only
+// affect running the sandbox, not building it, and are left out, so
+// changing them does not trigger a rebuild. env values are hashed as
+// written: env.sh keeps their references for the shell to expand, so a
+// packed sandbox does not go out of date on a host with other values.
 func (c *Config) Hash() string {
-	data, _ := json.Marshal(c)
+	hashed := *c
+	hashed.Env = c.Raw().Env
+	data, _ := json.Marshal(&hashed)
 	h := sha256.Sum256(data)
 	return hex.EncodeToString(h[:])[:16]
 }
 
-// GetProjectRoot finds the project root by looking for .sbox directory
+// GetProjectRoot finds the project root by looking for a .sbox directory
+// or, in monorepos, an sbox.yaml anchor shared by the directories below
+// it. The nearest one wins.
 func GetProjectRoot(startPath string) (string, error) {
 	if startPath == "" {
 		var err error
@@ -211,9 +934,16 @@ func GetProjectRoot(startPath string) (string, error) {
 		return "", err
 	}
 
+	// ~/.sbox holds the global cache and settings; it does not make the
+	// home directory a project
+	globalDir, _ := GetGlobalSboxDir()
+
 	for {
 		sboxPath := filepath.Join(path, SboxDir)
-		if info, err := os.Stat(sboxPath); err == nil && info.IsDir() {
+		if info, err := os.Stat(sboxPath); err == nil && info.IsDir() && sboxPath != globalDir {
+			return path, nil
+		}
+		if info, err := os.Stat(filepath.Join(path, AnchorFile)); err == nil && info.Mode().IsRegular() {
 			return path, nil
 		}
 
@@ -224,7 +954,20 @@ func GetProjectRoot(startPath string) (string, error) {
 		path = parent
 	}
 
-	return "", fmt.Errorf("not in an sbox project (no %s directory found)", SboxDir)
+	return "", fmt.Errorf("not in an sbox project (no %s directory or %s found)", SboxDir, AnchorFile)
+}
+
+// GetConfigPath returns the config file of a project: .sbox/config.yaml,
+// or its sbox.yaml anchor when it has none
+func GetConfigPath(projectRoot string) string {
+	configPath := filepath.Join(projectRoot, SboxDir, ConfigFile)
+	if _, err := os.Stat(configPath); err != nil {
+		anchor := filepath.Join(projectRoot, AnchorFile)
+		if _, err := os.Stat(anchor); err == nil {
+			return anchor
+		}
+	}
+	return configPath
 }
 
 // GetSboxDir returns the .sbox directory path
@@ -244,7 +987,7 @@ func GetRootfsDir(projectRoot string) string {
 
 // GetMicromambaPath returns the micromamba binary path
 func GetMicromambaPath(projectRoot string) string {
-	return filepath.Join(projectRoot, SboxDir, "bin", "micromamba")
+	return filepath.Join(projectRoot, SboxDir, "bin", ExeName("micromamba"))
 }
 
 // GetGlobalSboxDir returns the global sbox directory (~/.sbox)
@@ -256,8 +999,16 @@ func GetGlobalSboxDir() (string, error) {
 	return filepath.Join(homeDir, SboxDir), nil
 }
 
-// GetGlobalCacheDir returns the global cache directory (~/.sbox/cache)
+// CacheDirEnv overrides the global cache location, e.g. to keep it on a
+// node-local disk when home directories are on NFS
+const CacheDirEnv = "SBOX_CACHE_DIR"
+
+// GetGlobalCacheDir returns the global cache directory: $SBOX_CACHE_DIR
+// when set, otherwise ~/.sbox/cache
 func GetGlobalCacheDir() (string, error) {
+	if dir := os.Getenv(CacheDirEnv); dir != "" {
+		return filepath.Abs(dir)
+	}
 	globalDir, err := GetGlobalSboxDir()
 	if err != nil {
 		return "", err
@@ -271,7 +1022,7 @@ func GetGlobalMicromambaPath() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(cacheDir, "bin", "micromamba"), nil
+	return filepath.Join(cacheDir, "bin", GetPlatformKey(), ExeName("micromamba")), nil
 }
 
 // GetGlobalPkgsCacheDir returns the path to the shared package cache
@@ -280,7 +1031,7 @@ func GetGlobalPkgsCacheDir() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(cacheDir, "pkgs"), nil
+	return filepath.Join(cacheDir, "pkgs", GetPlatformKey()), nil
 }
 
 // GetLockPath returns the lock file path
@@ -321,50 +1072,177 @@ func LoadLock(projectRoot string) (*LockData, error) {
 	return &lock, nil
 }
 
-// SaveLock saves the lock file
-func SaveLock(projectRoot string, cfg *Config) error {
-	lock := LockData{
+// SaveLock saves the lock file for a fresh build of cfg
+func SaveLock(projectRoot string, cfg *Config, packages *LockedPackages, steps *BuildSteps) error {
+	return WriteLock(projectRoot, &LockData{
 		Version:    "0.1.0",
 		ConfigHash: cfg.Hash(),
 		BuiltAt:    time.Now().Format(time.RFC3339),
 		Runtime:    cfg.Runtime,
-	}
+		Platform:   GetPlatformKey(),
+		Profile:    cfg.Profile(),
+		BuildArgs:  cfg.BuildArgs(),
+		Packages:   packages,
+		Steps:      steps,
+	})
+}
 
+// WriteLock writes lock data as is. The file is replaced through a temp
+// file, so a command reading it during a build never sees it half written.
+func WriteLock(projectRoot string, lock *LockData) error {
 	data, err := json.MarshalIndent(lock, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(GetLockPath(projectRoot), data, 0644)
+	path := GetLockPath(projectRoot)
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+LockFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ResetBuildSteps makes the next build copy files and run the install
+// commands again in the existing environment, e.g. after its rootfs was
+// removed. The runtime fingerprint and resolved packages are kept, so the
+// environment itself is not recreated.
+func ResetBuildSteps(projectRoot string) error {
+	lock, err := LoadLock(projectRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	lock.ConfigHash = ""
+	if lock.Steps != nil {
+		lock.Steps.Copy = nil
+		lock.Steps.Install = nil
+	}
+	return WriteLock(projectRoot, lock)
+}
+
+// GetBuildLockPath returns the lock file serializing builds
+func GetBuildLockPath(projectRoot string) string {
+	return filepath.Join(projectRoot, SboxDir, "build.lock")
+}
+
+// ApplySharedPermissions makes the .sbox tree usable by the owning group:
+// directories become group-writable and setgid (so new files inherit the
+// group) and files become group-readable/writable.
+func ApplySharedPermissions(projectRoot string) error {
+	return filepath.Walk(GetSboxDir(projectRoot), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		mode := info.Mode()
+		if info.IsDir() {
+			return os.Chmod(path, mode.Perm()|0070|os.ModeSetgid)
+		}
+		perm := mode.Perm() | 0060
+		if mode.Perm()&0100 != 0 {
+			perm |= 0010
+		}
+		if perm == mode.Perm() {
+			return nil
+		}
+		return os.Chmod(path, perm)
+	})
+}
+
+// GetBuildHistoryPath returns the build history file path
+func GetBuildHistoryPath(projectRoot string) string {
+	return filepath.Join(projectRoot, SboxDir, BuildHistoryFile)
+}
+
+// AppendBuildRecord adds an entry to the build history
+func AppendBuildRecord(projectRoot string, record BuildRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(GetBuildHistoryPath(projectRoot), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// LoadBuildHistory returns all recorded builds, oldest first
+func LoadBuildHistory(projectRoot string) ([]BuildRecord, error) {
+	data, err := os.ReadFile(GetBuildHistoryPath(projectRoot))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []BuildRecord{}, nil
+		}
+		return nil, err
+	}
+
+	records := []BuildRecord{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var record BuildRecord
+		if err := json.Unmarshal([]byte(line), &record); err == nil {
+			records = append(records, record)
+		}
+	}
+	return records, nil
 }
 
 // IsBuilt checks if the project has been built
 func IsBuilt(projectRoot string) bool {
-	lockPath := GetLockPath(projectRoot)
-	envDir := GetEnvDir(projectRoot)
-	pythonPath := filepath.Join(envDir, "bin", "python")
-	nodePath := filepath.Join(envDir, "bin", "node")
-
-	if _, err := os.Stat(lockPath); err != nil {
+	if _, err := os.Stat(GetLockPath(projectRoot)); err != nil {
 		return false
 	}
-	// Check if either Python or Node environment exists
-	pythonExists := false
-	nodeExists := false
-	if _, err := os.Stat(pythonPath); err == nil {
-		pythonExists = true
-	}
-	if _, err := os.Stat(nodePath); err == nil {
-		nodeExists = true
+	// Check if any supported runtime is installed in the environment
+	envDir := GetEnvDir(projectRoot)
+	for _, spec := range Runtimes {
+		if _, err := os.Stat(spec.BinaryPath(envDir)); err == nil {
+			return true
+		}
 	}
-	return pythonExists || nodeExists
+	return false
 }
 
-// IsUpToDate checks if the build is up to date
+// IsUpToDate checks if the build is up to date. A build for another
+// platform is never up to date.
 func IsUpToDate(projectRoot string, cfg *Config) bool {
 	lock, err := LoadLock(projectRoot)
 	if err != nil {
 		return false
 	}
+	if lock.Platform != "" && lock.Platform != GetPlatformKey() {
+		return false
+	}
 	return lock.ConfigHash == cfg.Hash()
 }
+
+// CheckPlatform returns an error when the project was built for another
+// platform, e.g. in a home directory shared between x86_64 and arm64
+// hosts. Builds from older versions of sbox did not record a platform
+// and pass.
+func CheckPlatform(projectRoot string) error {
+	lock, err := LoadLock(projectRoot)
+	if err != nil || lock.Platform == "" || lock.Platform == GetPlatformKey() {
+		return nil
+	}
+	return fmt.Errorf("sandbox was built for %s but this host is %s. Run 'sbox build' to rebuild it here", lock.Platform, GetPlatformKey())
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// envFileKey matches variable names in env files
+	envFileKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// envRefPattern matches a $VAR or ${VAR} reference at the start of
+	// a string
+	envRefPattern = regexp.MustCompile(`^\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))`)
+)
+
+// EnvFileError is a malformed line of an env file
+type EnvFileError struct {
+	Line    int
+	Message string
+}
+
+func (e EnvFileError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ResolveEnvFile returns the path of an env file, relative to the project
+// root unless absolute
+func ResolveEnvFile(projectRoot, path string) string {
+	path = os.ExpandEnv(path)
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(projectRoot, path)
+}
+
+// ReadEnvFile reads KEY=VALUE pairs from a .env file. Malformed lines are
+// skipped and reported in problems; err is only set when the file cannot
+// be read.
+func ReadEnvFile(path string) (vars map[string]string, problems []EnvFileError, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	vars, problems = ParseEnvFile(string(data))
+	return vars, problems, nil
+}
+
+// ParseEnvFile parses the contents of a .env file:
+//
+//	# comments and blank lines are ignored
+//	export KEY=value            # 'export' is optional, trailing comments too
+//	KEY="line\nbreak ${HOME}"   # escapes and $VAR references are expanded
+//	KEY='literal $HOME'         # single quotes keep the value as is
+//
+// Quoted values may span several lines. $VAR references resolve to keys
+// defined earlier in the file, then to the host environment.
+func ParseEnvFile(content string) (map[string]string, []EnvFileError) {
+	vars := make(map[string]string)
+	var problems []EnvFileError
+
+	lookup := func(key string) string {
+		if value, ok := vars[key]; ok {
+			return value
+		}
+		return os.Getenv(key)
+	}
+
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if rest, ok := strings.CutPrefix(line, "export "); ok {
+			line = strings.TrimSpace(rest)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok {
+			problems = append(problems, EnvFileError{lineNo, fmt.Sprintf("expected KEY=VALUE, got '%s'", line)})
+			continue
+		}
+		if !envFileKey.MatchString(key) {
+			problems = append(problems, EnvFileError{lineNo, fmt.Sprintf("invalid variable name '%s'", key)})
+			continue
+		}
+		value = strings.TrimLeft(value, " \t")
+
+		if value == "" || (value[0] != '"' && value[0] != '\'') {
+			// Unquoted: a '#' after whitespace starts a comment
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = value[:j]
+			}
+			if j := strings.Index(value, "\t#"); j >= 0 {
+				value = value[:j]
+			}
+			vars[key] = expandValue(strings.TrimSpace(value), false, lookup)
+			continue
+		}
+
+		// Quoted values continue until the closing quote
+		quote := value[0]
+		body := value[1:]
+		end := closingQuote(body, quote)
+		for end < 0 && i+1 < len(lines) {
+			i++
+			body += "\n" + lines[i]
+			end = closingQuote(body, quote)
+		}
+		if end < 0 {
+			problems = append(problems, EnvFileError{lineNo, fmt.Sprintf("unterminated %c quote for %s", quote, key)})
+			continue
+		}
+		if trailing := strings.TrimSpace(body[end+1:]); trailing != "" && !strings.HasPrefix(trailing, "#") {
+			problems = append(problems, EnvFileError{lineNo, fmt.Sprintf("unexpected text after closing quote: '%s'", trailing)})
+			continue
+		}
+
+		if quote == '\'' {
+			vars[key] = body[:end]
+		} else {
+			vars[key] = expandValue(body[:end], true, lookup)
+		}
+	}
+	return vars, problems
+}
+
+// closingQuote returns the index of the quote ending s, skipping
+// backslash escapes inside double quotes
+func closingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote == '"':
+			i++
+		case s[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// expandValue resolves $VAR and ${VAR} references, and with escapes the
+// backslash escapes of a double-quoted value (\$ is a literal '$').
+// Anything else, like a lone '$', is kept as is.
+func expandValue(s string, escapes bool, lookup func(string) string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && escapes && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		if c != '$' {
+			b.WriteByte(c)
+			continue
+		}
+		if m := envRefPattern.FindStringSubmatch(s[i:]); m != nil {
+			name := m[1]
+			if name == "" {
+				name = m[2]
+			}
+			b.WriteString(lookup(name))
+			i += len(m[0]) - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
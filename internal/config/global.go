@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// GlobalConfigFile is the per-user settings file (~/.sbox/defaults.yaml)
+const GlobalConfigFile = "defaults.yaml"
+
+// GlobalConfig holds per-user settings shared by all projects
+type GlobalConfig struct {
+	Init InitDefaults `yaml:"init,omitempty"`
+
+	// Registries are remote archive stores for 'sbox push' and 'sbox pull',
+	// by name
+	Registries map[string]RegistryConfig `yaml:"registries,omitempty"`
+	// DefaultRegistry is used for references without a registry name
+	DefaultRegistry string `yaml:"default_registry,omitempty"`
+
+	Trash TrashConfig `yaml:"trash,omitempty"`
+}
+
+// TrashConfig controls ~/.sbox/trash, where destructive commands move
+// what they remove
+type TrashConfig struct {
+	// RetentionDays is how long entries are kept before being purged
+	// (default 7)
+	RetentionDays int `yaml:"retention_days,omitempty"`
+}
+
+// RegistryConfig describes one archive registry. String values may
+// reference environment variables ($VAR or ${VAR}) to keep secrets out
+// of the file.
+type RegistryConfig struct {
+	// URL selects the backend: oci://host/namespace, s3://bucket/prefix
+	// or an http(s):// base URL
+	URL string `yaml:"url"`
+
+	// Token is sent as a bearer token (HTTP), or exchanged for one (OCI)
+	Token string `yaml:"token,omitempty"`
+	// Username and Password are used for basic authentication
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	// Region, Endpoint and keys for S3; the keys default to
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. Endpoint selects an
+	// S3-compatible server (e.g. MinIO) with path-style addressing.
+	Region    string `yaml:"region,omitempty"`
+	Endpoint  string `yaml:"endpoint,omitempty"`
+	AccessKey string `yaml:"access_key,omitempty"`
+	SecretKey string `yaml:"secret_key,omitempty"`
+
+	// Insecure talks plain HTTP to an OCI registry
+	Insecure bool `yaml:"insecure,omitempty"`
+}
+
+// InitDefaults are applied by 'sbox init' to every new project
+type InitDefaults struct {
+	// Runtime used when --runtime is not given
+	Runtime string `yaml:"runtime,omitempty"`
+	// LicenseHeader is prepended (as comments) to generated source files
+	LicenseHeader string `yaml:"license_header,omitempty"`
+	// Env entries added to the new project's config
+	Env map[string]string `yaml:"env,omitempty"`
+	// Gitignore lines appended to the generated .gitignore
+	Gitignore []string `yaml:"gitignore,omitempty"`
+}
+
+// GetGlobalConfigPath returns the path to ~/.sbox/defaults.yaml
+func GetGlobalConfigPath() (string, error) {
+	globalDir, err := GetGlobalSboxDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(globalDir, GlobalConfigFile), nil
+}
+
+// LoadGlobalConfig loads ~/.sbox/defaults.yaml. A missing file yields an
+// empty configuration.
+func LoadGlobalConfig() (*GlobalConfig, error) {
+	cfg := &GlobalConfig{}
+
+	path, err := GetGlobalConfigPath()
+	if err != nil {
+		return cfg, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return &GlobalConfig{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
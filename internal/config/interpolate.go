@@ -0,0 +1,176 @@
+package config
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Interpolate replaces ${VAR} and ${VAR:-default} references in s, with
+// lookup returning the value of a variable and whether it is set. As in
+// the shell, the default applies when VAR is unset or empty and may hold
+// references itself. A ${VAR} that is not set is left as written, so the
+// shell or the sandbox environment can still expand it, and so are $VAR
+// without braces and other shell expansions such as ${VAR%.*}.
+func Interpolate(s string, lookup func(name string) (string, bool)) string {
+	out, _ := interpolate(s, lookup)
+	return out
+}
+
+// interpolate is Interpolate that also returns the names of the variables
+// left as written
+func interpolate(s string, lookup func(name string) (string, bool)) (string, []string) {
+	var b strings.Builder
+	var unresolved []string
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), unresolved
+		}
+		end := closingBrace(s, start+2)
+		if end < 0 {
+			b.WriteString(s)
+			return b.String(), unresolved
+		}
+		b.WriteString(s[:start])
+
+		ref := s[start : end+1]
+		name, def, hasDefault := strings.Cut(s[start+2:end], ":-")
+		switch value, ok := lookup(name); {
+		case !envFileKey.MatchString(name):
+			b.WriteString(ref)
+		case ok && (value != "" || !hasDefault):
+			b.WriteString(value)
+		case hasDefault:
+			value, missing := interpolate(def, lookup)
+			b.WriteString(value)
+			unresolved = append(unresolved, missing...)
+		default:
+			b.WriteString(ref)
+			unresolved = append(unresolved, name)
+		}
+		s = s[end+1:]
+	}
+}
+
+// closingBrace returns the index of the } closing a reference whose name
+// starts at i, skipping nested references in its default
+func closingBrace(s string, i int) int {
+	depth := 1
+	for ; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "${"):
+			depth++
+			i++
+		case s[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// interpolate resolves the references in runtime, workdir, cmd, copy,
+// mount, env values, env_file, host_libs and path. Variables come from the
+// process environment, then from env_file; in copy, build args come
+// first. install and the hooks are shell commands run in the build or
+// sandbox environment, which expands them, so only the build args are
+// resolved in install.
+func (c *Config) interpolate(projectRoot string) {
+	var unresolved []string
+	resolve := func(field *string, lookup func(string) (string, bool)) {
+		var missing []string
+		*field, missing = interpolate(*field, lookup)
+		unresolved = append(unresolved, missing...)
+	}
+
+	// env_file can only refer to the process environment
+	resolve(&c.EnvFile, os.LookupEnv)
+	var fileVars map[string]string
+	if c.EnvFile != "" {
+		// A missing or malformed file is reported when it is loaded to run
+		fileVars, _, _ = ReadEnvFile(ResolveEnvFile(projectRoot, c.EnvFile))
+	}
+	lookup := func(name string) (string, bool) {
+		if value, ok := os.LookupEnv(name); ok {
+			return value, true
+		}
+		value, ok := fileVars[name]
+		return value, ok
+	}
+
+	argLookup := func(name string) (string, bool) {
+		value, ok := c.Args[name]
+		return value, ok
+	}
+	for i := range c.Install {
+		c.Install[i] = Interpolate(c.Install[i], argLookup)
+	}
+	for i := range c.Copy {
+		c.Copy[i] = Interpolate(c.Copy[i], argLookup)
+	}
+
+	resolve(&c.Runtime, lookup)
+	resolve(&c.Workdir, lookup)
+	resolve(&c.Cmd, lookup)
+	for _, list := range [][]string{c.Copy, c.Mount, c.HostLibs, c.Path} {
+		for i := range list {
+			resolve(&list[i], lookup)
+		}
+	}
+	for key, value := range c.Env {
+		resolve(&value, lookup)
+		c.Env[key] = value
+	}
+
+	seen := make(map[string]bool)
+	c.unresolved = nil
+	for _, name := range unresolved {
+		if !seen[name] {
+			seen[name] = true
+			c.unresolved = append(c.unresolved, name)
+		}
+	}
+	sort.Strings(c.unresolved)
+}
+
+// Resolve returns a copy of a configuration as written with its
+// references resolved, as Load does
+func (c *Config) Resolve(projectRoot string) (*Config, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var resolved Config
+	if err := yaml.Unmarshal(data, &resolved); err != nil {
+		return nil, err
+	}
+	if resolved.Env == nil {
+		resolved.Env = make(map[string]string)
+	}
+	resolved.raw = c
+	resolved.profile = c.profile
+	resolved.buildArgs = c.buildArgs
+	resolved.interpolate(projectRoot)
+	return &resolved, nil
+}
+
+// Raw returns the configuration as written in config.yaml, before
+// ${VAR} references were resolved
+func (c *Config) Raw() *Config {
+	if c.raw != nil {
+		return c.raw
+	}
+	return c
+}
+
+// Unresolved lists the variables referenced without a default that were
+// not set when the configuration was loaded
+func (c *Config) Unresolved() []string {
+	return c.unresolved
+}
@@ -0,0 +1,302 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KeyWildcard marks a user-defined map key in a schema path (e.g. env.*)
+const KeyWildcard = "*"
+
+// SchemaKeys returns every settable config path derived from the Config
+// struct's yaml tags. Map entries are represented with a '*' segment,
+// e.g. "env.*".
+func SchemaKeys() []string {
+	var keys []string
+	collectKeys(reflect.TypeOf(Config{}), "", &keys)
+	sort.Strings(keys)
+	return keys
+}
+
+// Keys returns the schema paths with wildcards expanded to the map keys
+// currently present in this config. Wildcard paths are kept so callers can
+// offer them for new entries.
+func (c *Config) Keys() []string {
+	var keys []string
+	for _, schemaKey := range SchemaKeys() {
+		keys = append(keys, schemaKey)
+		if !strings.Contains(schemaKey, KeyWildcard) {
+			continue
+		}
+		keys = append(keys, expandWildcards(reflect.ValueOf(c).Elem(), strings.Split(schemaKey, "."), "")...)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Get returns the value at a dotted config path (e.g. "runtime", "env.DEBUG")
+func (c *Config) Get(path string) (interface{}, error) {
+	v, err := lookupPath(reflect.ValueOf(c).Elem(), splitPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+// Set assigns a value at a dotted config path. List fields take one
+// element per value; all other fields take exactly one value.
+func (c *Config) Set(path string, values ...string) error {
+	segments := splitPath(path)
+	if len(segments) == 0 {
+		return fmt.Errorf("empty config key")
+	}
+	return setPath(reflect.ValueOf(c).Elem(), segments, path, values)
+}
+
+// Unset clears the value at a dotted config path, deleting map entries
+func (c *Config) Unset(path string) error {
+	segments := splitPath(path)
+	if len(segments) == 0 {
+		return fmt.Errorf("empty config key")
+	}
+	return unsetPath(reflect.ValueOf(c).Elem(), segments, path)
+}
+
+func setPath(v reflect.Value, segments []string, path string, values []string) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if len(segments) == 0 {
+		return assign(v, path, values)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		field, ok := fieldByTag(v, segments[0])
+		if !ok {
+			return fmt.Errorf("unknown config key: %s", path)
+		}
+		return setPath(field, segments[1:], path, values)
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		// Map values are not addressable: update a copy and store it back
+		key := reflect.ValueOf(segments[0])
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if existing := v.MapIndex(key); existing.IsValid() {
+			elem.Set(existing)
+		}
+		if err := setPath(elem, segments[1:], path, values); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	default:
+		return fmt.Errorf("unknown config key: %s", path)
+	}
+}
+
+func unsetPath(v reflect.Value, segments []string, path string) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return fmt.Errorf("config key not set: %s", path)
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		field, ok := fieldByTag(v, segments[0])
+		if !ok {
+			return fmt.Errorf("unknown config key: %s", path)
+		}
+		if len(segments) == 1 {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		return unsetPath(field, segments[1:], path)
+	case reflect.Map:
+		key := reflect.ValueOf(segments[0])
+		existing := v.MapIndex(key)
+		if !existing.IsValid() {
+			return fmt.Errorf("config key not set: %s", path)
+		}
+		if len(segments) == 1 {
+			v.SetMapIndex(key, reflect.Value{})
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		elem.Set(existing)
+		if err := unsetPath(elem, segments[1:], path); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	default:
+		return fmt.Errorf("unknown config key: %s", path)
+	}
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// yamlName returns the yaml key for a struct field ("" if not serialized)
+func yamlName(f reflect.StructField) string {
+	tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if tag == "-" || !f.IsExported() {
+		return ""
+	}
+	if tag == "" {
+		return strings.ToLower(f.Name)
+	}
+	return tag
+}
+
+func fieldByTag(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if yamlName(t.Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func collectKeys(t reflect.Type, prefix string, keys *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			name := yamlName(t.Field(i))
+			if name == "" {
+				continue
+			}
+			collectKeys(t.Field(i).Type, joinKey(prefix, name), keys)
+		}
+	case reflect.Map:
+		collectKeys(t.Elem(), joinKey(prefix, KeyWildcard), keys)
+	default:
+		*keys = append(*keys, prefix)
+	}
+}
+
+func expandWildcards(v reflect.Value, segments []string, prefix string) []string {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if len(segments) == 0 {
+		return []string{prefix}
+	}
+
+	seg := segments[0]
+	switch v.Kind() {
+	case reflect.Struct:
+		field, ok := fieldByTag(v, seg)
+		if !ok {
+			return nil
+		}
+		return expandWildcards(field, segments[1:], joinKey(prefix, seg))
+	case reflect.Map:
+		if seg != KeyWildcard {
+			return nil
+		}
+		var out []string
+		for _, k := range v.MapKeys() {
+			out = append(out, expandWildcards(v.MapIndex(k), segments[1:], joinKey(prefix, k.String()))...)
+		}
+		return out
+	}
+	return nil
+}
+
+// lookupPath walks segments from v and returns the value they address
+func lookupPath(v reflect.Value, segments []string) (reflect.Value, error) {
+	walked := ""
+	for _, seg := range segments {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, fmt.Errorf("config key not set: %s", walked)
+			}
+			v = v.Elem()
+		}
+		walked = joinKey(walked, seg)
+
+		switch v.Kind() {
+		case reflect.Struct:
+			field, ok := fieldByTag(v, seg)
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("unknown config key: %s", walked)
+			}
+			v = field
+		case reflect.Map:
+			entry := v.MapIndex(reflect.ValueOf(seg))
+			if !entry.IsValid() {
+				return reflect.Value{}, fmt.Errorf("config key not set: %s", walked)
+			}
+			v = entry
+		default:
+			return reflect.Value{}, fmt.Errorf("unknown config key: %s", walked)
+		}
+	}
+
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v, nil
+}
+
+func assign(field reflect.Value, path string, values []string) error {
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String {
+		field.Set(reflect.ValueOf(append([]string{}, values...)))
+		return nil
+	}
+
+	if len(values) != 1 {
+		return fmt.Errorf("%s takes exactly one value", path)
+	}
+	value := values[0]
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s expects true or false, got '%s'", path, value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s expects an integer, got '%s'", path, value)
+		}
+		field.SetInt(n)
+	default:
+		return fmt.Errorf("%s is not a scalar value; set one of its sub-keys instead", path)
+	}
+	return nil
+}
+
+func joinKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Manifest is a dependency file found in a project's tree
+type Manifest struct {
+	// Path is relative to the project root, slash-separated
+	Path     string
+	Language string
+	// Install installs the dependencies, run from the project root like
+	// every install command; empty when the file declares none
+	Install string
+	// Cmd is the start command the file declares, if any
+	Cmd string
+	// tools are install commands that read the file from its directory
+	tools []string
+}
+
+// manifestFiles are the dependency files DetectManifests knows, in the
+// order their install commands run
+var manifestFiles = []string{
+	"environment.yml", "environment.yaml", "requirements.txt", "pyproject.toml",
+	"package.json",
+}
+
+// DetectManifests finds the dependency files at the top of dir, relative
+// to projectRoot, with the install command and start command each implies
+func DetectManifests(projectRoot, dir string) []Manifest {
+	dir = path.Clean(filepath.ToSlash(strings.TrimPrefix(dir, "./")))
+	abs := filepath.Join(projectRoot, filepath.FromSlash(dir))
+	exists := func(name string) bool {
+		info, err := os.Stat(filepath.Join(abs, name))
+		return err == nil && !info.IsDir()
+	}
+	rel := func(name string) string {
+		return path.Join(dir, name)
+	}
+	// in runs a command in dir, for tools without a path argument
+	in := func(command string) string {
+		if dir == "." {
+			return command
+		}
+		return "cd " + shellQuote(dir) + " && " + command
+	}
+
+	var found []Manifest
+	for _, name := range manifestFiles {
+		if !exists(name) {
+			continue
+		}
+		m := Manifest{Path: rel(name), Language: "python"}
+		switch name {
+		case "environment.yml", "environment.yaml":
+			if exists("environment.yml") && name == "environment.yaml" {
+				continue
+			}
+			m.Install = path.Join(SboxDir, "bin", "micromamba") + ` install -y -p "$CONDA_PREFIX" -f ` + shellQuote(m.Path)
+			m.tools = []string{"micromamba", "conda env update", "mamba env update"}
+		case "requirements.txt":
+			m.Install = "pip install -r " + shellQuote(m.Path)
+			m.Cmd = pythonEntry(exists)
+		case "pyproject.toml":
+			m.Install = "pip install " + shellQuote(dir)
+			m.Cmd = pyprojectScript(filepath.Join(abs, name))
+			if m.Cmd == "" {
+				m.Cmd = pythonEntry(exists)
+			}
+			m.tools = []string{"pip install", "poetry install", "uv sync", "uv pip install", "pdm install"}
+		case "package.json":
+			m.Language = "node"
+			pkg := readPackageJSON(filepath.Join(abs, name))
+			runner := "npm"
+			if exists("pnpm-lock.yaml") {
+				runner = "pnpm"
+				m.Path = rel("pnpm-lock.yaml")
+			}
+			if len(pkg.Dependencies)+len(pkg.DevDependencies) > 0 || runner == "pnpm" {
+				m.Install = in(runner + " install")
+			}
+			if _, ok := pkg.Scripts["start"]; ok {
+				m.Cmd = in(runner + " start")
+			} else if pkg.Main != "" {
+				m.Cmd = "node " + shellQuote(path.Join(dir, pkg.Main))
+			}
+			m.tools = []string{runner + " install", runner + " i ", runner + " ci", "yarn"}
+		}
+		found = append(found, m)
+	}
+	return found
+}
+
+// ReferencedBy reports whether an install command reads the manifest:
+// one names the file, or runs a tool that reads it in its directory
+func (m Manifest) ReferencedBy(install []string) bool {
+	dir := path.Dir(m.Path)
+	for _, command := range install {
+		if strings.Contains(command, m.Path) || strings.Contains(command, path.Base(m.Path)) {
+			return true
+		}
+		for _, tool := range m.tools {
+			if !strings.Contains(command+" ", tool) {
+				continue
+			}
+			if dir == "." || strings.Contains(command, dir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pythonEntry returns the start command of a conventional Python entry
+// script, if the directory has one
+func pythonEntry(exists func(string) bool) string {
+	for _, name := range []string{"main.py", "app.py", "manage.py"} {
+		if exists(name) {
+			if name == "manage.py" {
+				return "python manage.py runserver"
+			}
+			return "python " + name
+		}
+	}
+	return ""
+}
+
+var tomlKey = regexp.MustCompile(`^\s*"?([A-Za-z0-9_.-]+)"?\s*=`)
+
+// pyprojectScript returns the first console script of [project.scripts]
+// in pyproject.toml; a line scan is enough for the table's flat keys
+func pyprojectScript(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	inScripts := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inScripts = line == "[project.scripts]" || line == "[tool.poetry.scripts]"
+			continue
+		}
+		if !inScripts {
+			continue
+		}
+		if match := tomlKey.FindStringSubmatch(line); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+type packageJSON struct {
+	Main            string            `json:"main"`
+	Scripts         map[string]string `json:"scripts"`
+	Dependencies    map[string]string `json:"dependencies"`
+	DevDependencies map[string]string `json:"devDependencies"`
+}
+
+func readPackageJSON(file string) packageJSON {
+	var pkg packageJSON
+	if data, err := os.ReadFile(file); err == nil {
+		json.Unmarshal(data, &pkg)
+	}
+	return pkg
+}
+
+// shellQuote quotes a path for sh when it needs it
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_./-") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
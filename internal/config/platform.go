@@ -0,0 +1,89 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// IsWindows reports whether a platform key such as windows-amd64 is a
+// Windows platform
+func IsWindows(platform string) bool {
+	return strings.HasPrefix(platform, "windows-")
+}
+
+// ExeName returns the file name of an executable on this platform:
+// name.exe on Windows
+func ExeName(name string) string {
+	return ExeNameFor(GetPlatformKey(), name)
+}
+
+// ExeNameFor returns the file name of an executable on a platform
+func ExeNameFor(platform, name string) string {
+	if IsWindows(platform) {
+		return name + ".exe"
+	}
+	return name
+}
+
+// EnvBinDirs returns the directories of an environment that hold
+// executables, in PATH order. conda on Windows installs interpreters in
+// the prefix itself, entry points in Scripts and other programs in
+// Library\bin, and activation puts them on PATH in this order.
+func EnvBinDirs(envDir string) []string {
+	if runtime.GOOS != "windows" {
+		return []string{filepath.Join(envDir, "bin")}
+	}
+	return []string{
+		envDir,
+		filepath.Join(envDir, "Library", "mingw-w64", "bin"),
+		filepath.Join(envDir, "Library", "usr", "bin"),
+		filepath.Join(envDir, "Library", "bin"),
+		filepath.Join(envDir, "Scripts"),
+		filepath.Join(envDir, "bin"),
+	}
+}
+
+// EnvExe returns the path of an executable of an environment: the first
+// one of EnvBinDirs that has it, else where it would be in the first
+func EnvExe(envDir, name string) string {
+	dirs := EnvBinDirs(envDir)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, ExeName(name))
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dirs[0], ExeName(name))
+}
+
+// systemPath returns the host directories of path_mode: isolated; on
+// Windows those of Windows itself, where cmd, PowerShell and tar live
+func systemPath() []string {
+	if runtime.GOOS != "windows" {
+		return []string{"/usr/bin", "/bin", "/usr/sbin", "/sbin"}
+	}
+	root := os.Getenv("SystemRoot")
+	if root == "" {
+		root = `C:\Windows`
+	}
+	return []string{
+		filepath.Join(root, "System32"),
+		root,
+		filepath.Join(root, "System32", "Wbem"),
+		filepath.Join(root, "System32", "WindowsPowerShell", "v1.0"),
+	}
+}
+
+// SplitSpec splits a copy: or mount: entry at its colons. On Windows the
+// drive of a source such as C:\data stays with it.
+func SplitSpec(item string) []string {
+	drive := ""
+	if runtime.GOOS == "windows" && len(item) >= 3 && item[1] == ':' && (item[2] == '\\' || item[2] == '/') {
+		drive, item = item[:2], item[2:]
+	}
+	parts := strings.Split(item, ":")
+	parts[0] = drive + parts[0]
+	return parts
+}
@@ -0,0 +1,113 @@
+package config
+
+import "strings"
+
+// RuntimeSpec describes a language runtime that sbox can install from
+// conda-forge
+type RuntimeSpec struct {
+	Name        string   // canonical language name used in cache keys
+	Aliases     []string // alternative names accepted in runtime strings
+	DisplayName string
+	Binary      string   // executable in env/bin that marks an installed runtime
+	Package     string   // conda-forge package pinned to the requested version
+	Extras      []string // additional unpinned conda-forge packages
+	VersionArgs []string // arguments that make Binary print its version
+	Versions    []string // versions known to be available on conda-forge
+	Install     []string // default install commands for new projects
+	Cmd         string   // default start command for new projects
+}
+
+// Runtimes lists every supported runtime
+var Runtimes = []RuntimeSpec{
+	{
+		Name:        "python",
+		DisplayName: "Python",
+		Binary:      "python",
+		Package:     "python",
+		Extras:      []string{"pip"},
+		VersionArgs: []string{"--version"},
+		Versions:    []string{"3.8", "3.9", "3.10", "3.11", "3.12", "3.13"},
+		Install:     []string{"pip install -r app/requirements.txt"},
+		Cmd:         "python main.py",
+	},
+	{
+		Name:        "node",
+		Aliases:     []string{"nodejs"},
+		DisplayName: "Node.js",
+		Binary:      "node",
+		Package:     "nodejs",
+		Extras:      []string{"pnpm"},
+		VersionArgs: []string{"--version"},
+		Versions:    []string{"18", "20", "22", "23", "24"},
+		Cmd:         "node main.js",
+	},
+	{
+		Name:        "go",
+		Aliases:     []string{"golang"},
+		DisplayName: "Go",
+		Binary:      "go",
+		Package:     "go",
+		VersionArgs: []string{"version"},
+		Versions:    []string{"1.21", "1.22", "1.23"},
+		Cmd:         "go run .",
+	},
+	{
+		Name:        "java",
+		Aliases:     []string{"openjdk"},
+		DisplayName: "Java",
+		Binary:      "java",
+		Package:     "openjdk",
+		VersionArgs: []string{"-version"},
+		Versions:    []string{"11", "17", "21"},
+		Cmd:         "java Main.java",
+	},
+	{
+		Name:        "ruby",
+		DisplayName: "Ruby",
+		Binary:      "ruby",
+		Package:     "ruby",
+		VersionArgs: []string{"--version"},
+		Versions:    []string{"3.1", "3.2", "3.3"},
+		Cmd:         "ruby main.rb",
+	},
+	{
+		Name:        "rust",
+		DisplayName: "Rust",
+		Binary:      "cargo",
+		Package:     "rust",
+		VersionArgs: []string{"--version"},
+		Versions:    []string{"1.75", "1.76", "1.77", "1.78", "1.79", "1.80"},
+		Cmd:         "cargo run --release --quiet",
+	},
+}
+
+// LookupRuntime finds the runtime spec for a language name or alias
+func LookupRuntime(language string) (*RuntimeSpec, bool) {
+	language = strings.ToLower(language)
+	for i := range Runtimes {
+		if Runtimes[i].Name == language {
+			return &Runtimes[i], true
+		}
+		for _, alias := range Runtimes[i].Aliases {
+			if alias == language {
+				return &Runtimes[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// RuntimeNames returns every accepted language name, including aliases
+func RuntimeNames() []string {
+	var names []string
+	for _, spec := range Runtimes {
+		names = append(names, spec.Name)
+		names = append(names, spec.Aliases...)
+	}
+	return names
+}
+
+// BinaryPath returns the path of the runtime's marker executable in envDir
+func (s *RuntimeSpec) BinaryPath(envDir string) string {
+	return EnvExe(envDir, s.Binary)
+}
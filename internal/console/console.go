@@ -2,8 +2,13 @@
 package console
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 // ANSI color codes
@@ -16,34 +21,152 @@ const (
 	colorCyan   = "\033[36m"
 )
 
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// OutputEnv selects the output format when --output is not given
+const OutputEnv = "SBOX_OUTPUT"
+
+// Event levels
+const (
+	LevelInfo    = "info"
+	LevelSuccess = "success"
+	LevelWarning = "warning"
+	LevelError   = "error"
+	LevelStep    = "step"
+	LevelPrint   = "print"
+)
+
+// Fields are structured data attached to an event
+type Fields map[string]interface{}
+
+// event is one line of JSON output
+type event struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Fields  Fields `json:"fields,omitempty"`
+}
+
+var (
+	jsonOutput bool
+	// events receives JSON events: the original stdout
+	events io.Writer = os.Stdout
+	// stdout is the process's stdout before SetFormat redirected it
+	stdout = os.Stdout
+	mu     sync.Mutex
+)
+
+// SetFormat switches the output format. In JSON mode every message is
+// written to stdout as one JSON object per line; os.Stdout is pointed at
+// stderr, so tables, tool output and the application's own output stay
+// off the event stream; see KeepStdout.
+func SetFormat(format string) error {
+	switch format {
+	case "", FormatText:
+		jsonOutput = false
+	case FormatJSON:
+		if !jsonOutput {
+			jsonOutput = true
+			events = os.Stdout
+			os.Stdout = os.Stderr
+		}
+	default:
+		return fmt.Errorf("unknown output format %q (use %s or %s)", format, FormatText, FormatJSON)
+	}
+	return nil
+}
+
+// KeepStdout leaves stdout to a command that prints data on it for
+// scripts, such as 'sbox secret get' or a --json listing: in JSON mode
+// its events go to stderr instead.
+func KeepStdout() {
+	if jsonOutput {
+		os.Stdout = stdout
+		events = os.Stderr
+	}
+}
+
+// Events returns the writer events go to, the original stdout, for output
+// relayed from another sbox process
+func Events() io.Writer {
+	return events
+}
+
+// JSON reports whether JSON output is on
+func JSON() bool {
+	return jsonOutput
+}
+
+// Emit prints a message with structured fields. In text mode the fields
+// are left out, as the message already says what they hold.
+func Emit(level string, fields Fields, format string, args ...interface{}) {
+	if jsonOutput {
+		writeEvent(level, fields, fmt.Sprintf(format, args...))
+		return
+	}
+	switch level {
+	case LevelSuccess:
+		fmt.Printf(colorGreen+"[OK]"+colorReset+" "+format+"\n", args...)
+	case LevelWarning:
+		fmt.Printf(colorYellow+"[WARN]"+colorReset+" "+format+"\n", args...)
+	case LevelError:
+		fmt.Fprintf(os.Stderr, colorRed+"[ERROR]"+colorReset+" "+format+"\n", args...)
+	case LevelStep:
+		fmt.Printf(colorCyan+"[STEP]"+colorReset+" "+format+"\n", args...)
+	case LevelPrint:
+		fmt.Printf(format+"\n", args...)
+	default:
+		fmt.Printf(colorBlue+"[INFO]"+colorReset+" "+format+"\n", args...)
+	}
+}
+
+func writeEvent(level string, fields Fields, message string) {
+	data, err := json.Marshal(event{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   level,
+		Message: message,
+		Fields:  fields,
+	})
+	if err != nil {
+		data, _ = json.Marshal(event{Time: time.Now().UTC().Format(time.RFC3339Nano), Level: level, Message: message})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	events.Write(append(data, '\n'))
+}
+
 // Info prints an info message
 func Info(format string, args ...interface{}) {
-	fmt.Printf(colorBlue+"[INFO]"+colorReset+" "+format+"\n", args...)
+	Emit(LevelInfo, nil, format, args...)
 }
 
 // Success prints a success message
 func Success(format string, args ...interface{}) {
-	fmt.Printf(colorGreen+"[OK]"+colorReset+" "+format+"\n", args...)
+	Emit(LevelSuccess, nil, format, args...)
 }
 
 // Warning prints a warning message
 func Warning(format string, args ...interface{}) {
-	fmt.Printf(colorYellow+"[WARN]"+colorReset+" "+format+"\n", args...)
+	Emit(LevelWarning, nil, format, args...)
 }
 
 // Error prints an error message
 func Error(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, colorRed+"[ERROR]"+colorReset+" "+format+"\n", args...)
+	Emit(LevelError, nil, format, args...)
 }
 
 // Step prints a step message
 func Step(format string, args ...interface{}) {
-	fmt.Printf(colorCyan+"[STEP]"+colorReset+" "+format+"\n", args...)
+	Emit(LevelStep, nil, format, args...)
 }
 
 // Print prints a plain message
 func Print(format string, args ...interface{}) {
-	fmt.Printf(format+"\n", args...)
+	Emit(LevelPrint, nil, format, args...)
 }
 
 // Fatal prints an error message and exits
@@ -51,3 +174,49 @@ func Fatal(format string, args ...interface{}) {
 	Error(format, args...)
 	os.Exit(1)
 }
+
+// progressInterval limits how often a progress bar is redrawn
+const progressInterval = 100 * time.Millisecond
+
+// Progress draws a progress bar on stderr while a long operation runs.
+// It draws nothing when stderr is not a terminal or output is JSON.
+type Progress struct {
+	label   string
+	total   int64
+	enabled bool
+	drawn   time.Time
+}
+
+// NewProgress starts a progress bar towards total
+func NewProgress(label string, total int64) *Progress {
+	info, err := os.Stderr.Stat()
+	return &Progress{
+		label:   label,
+		total:   total,
+		enabled: err == nil && info.Mode()&os.ModeCharDevice != 0 && !jsonOutput && total > 0,
+	}
+}
+
+// Set redraws the bar with done of total completed
+func (p *Progress) Set(done int64) {
+	if !p.enabled || time.Since(p.drawn) < progressInterval {
+		return
+	}
+	p.drawn = time.Now()
+
+	const width = 30
+	share := float64(done) / float64(p.total)
+	if share > 1 {
+		share = 1
+	}
+	filled := int(share * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	fmt.Fprintf(os.Stderr, "\r  %s [%s] %3.0f%%", p.label, bar, share*100)
+}
+
+// Done clears the bar
+func (p *Progress) Done() {
+	if p.enabled && !p.drawn.IsZero() {
+		fmt.Fprintf(os.Stderr, "\r\033[K")
+	}
+}
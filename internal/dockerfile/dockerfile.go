@@ -0,0 +1,295 @@
+// Package dockerfile converts between sandboxes and Dockerfiles. It
+// generates a Dockerfile for 'sbox export docker' that rebuilds a sandbox
+// as a container image: the runtime from conda-forge in a micromamba base
+// image, the config's env, copies, install commands and build hooks, and
+// its cmd. 'sbox init --from-dockerfile' goes the other way for simple
+// Dockerfiles (see Import).
+//
+// The image is built from the project directory, so copy sources resolve
+// as in 'sbox build'. Install commands and build hooks run in /project,
+// where the project is bind-mounted for the step only: what they write
+// there is discarded, as the rootfs of a sandbox does not include it
+// either.
+package dockerfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/gpu"
+	"github.com/sbox-project/sbox/internal/hooks"
+)
+
+// DefaultBaseImage is the micromamba image the runtime is installed into
+const DefaultBaseImage = "mambaorg/micromamba:1.5.10"
+
+const (
+	// envDir is the base environment of the micromamba image
+	envDir = "/opt/conda"
+	// projectDir is where install commands and hooks see the project
+	projectDir = "/project"
+	// constraintsPath holds the pip versions of sbox.lock
+	constraintsPath = "/opt/sbox/constraints.txt"
+)
+
+// Info describes the Dockerfile to generate
+type Info struct {
+	ProjectRoot string
+	// BaseImage replaces DefaultBaseImage; it must provide micromamba
+	// and MAMBA_USER as the mambaorg/micromamba images do
+	BaseImage string
+	// Lock pins pip packages to the versions of the last build, if set
+	Lock *config.LockData
+}
+
+// Generate renders the Dockerfile for a project
+func Generate(cfg *config.Config, info Info) string {
+	var b strings.Builder
+	runtimeInfo := cfg.ParseRuntime()
+
+	base := info.BaseImage
+	if base == "" {
+		base = DefaultBaseImage
+	}
+
+	fmt.Fprintf(&b, "# syntax=docker/dockerfile:1\n")
+	fmt.Fprintf(&b, "# Generated by sbox %s from %s\n", config.Version, config.GetConfigPath(info.ProjectRoot))
+	fmt.Fprintf(&b, "# Regenerate with 'sbox export docker' after changing the config\n")
+	fmt.Fprintf(&b, "#\n")
+	fmt.Fprintf(&b, "# Build: docker build -t %s .\n", ImageName(info.ProjectRoot))
+	fmt.Fprintf(&b, "# Run:   %s\n\n", runCommand(cfg, info))
+	fmt.Fprintf(&b, "FROM %s\n\n", base)
+
+	// Build steps run as root; the application runs as the image's user
+	fmt.Fprintf(&b, "USER root\n\n")
+
+	env := []string{
+		"SBOX_ACTIVE=1",
+		"SBOX_RUNTIME=" + cfg.Runtime,
+		"PYTHONNOUSERSITE=1",
+		"PYTHONDONTWRITEBYTECODE=1",
+		"PIP_DISABLE_PIP_VERSION_CHECK=1",
+	}
+	for _, name := range sortedKeys(cfg.Ports) {
+		env = append(env, fmt.Sprintf("%s=%d", config.PortEnvName(name), cfg.Ports[name]))
+	}
+	writeEnv(&b, env)
+	b.WriteString("\n")
+
+	packages := runtimePackages(runtimeInfo)
+	if cfg.UsesGPU() {
+		packages = append(packages, gpu.Packages(cfg.CUDA)...)
+	}
+	fmt.Fprintf(&b, "# The %s environment, as 'sbox build' creates it\n", cfg.Runtime)
+	if cfg.UsesGPU() {
+		// No GPU is visible while building; tell the solver which CUDA
+		// the image is for
+		cuda := cfg.CUDA
+		if cuda == "" {
+			cuda = "12"
+		}
+		fmt.Fprintf(&b, "ENV CONDA_OVERRIDE_CUDA=%s\n", cuda)
+	}
+	fmt.Fprintf(&b, "RUN micromamba install --yes --name base --channel conda-forge %s && \\\n", strings.Join(packages, " "))
+	fmt.Fprintf(&b, "    micromamba clean --all --yes\n")
+	writeEnv(&b, []string{"PATH=" + envDir + "/bin:$PATH", "CONDA_PREFIX=" + envDir})
+	b.WriteString("\n")
+
+	if info.Lock != nil && info.Lock.Packages != nil && len(info.Lock.Packages.Pip) > 0 {
+		fmt.Fprintf(&b, "# Pip packages at the versions of the last build (%s)\n", config.LockFile)
+		fmt.Fprintf(&b, "COPY <<EOF %s\n", constraintsPath)
+		for _, p := range info.Lock.Packages.Pip {
+			fmt.Fprintf(&b, "%s==%s\n", p.Name, p.Version)
+		}
+		fmt.Fprintf(&b, "EOF\n")
+		writeEnv(&b, []string{"PIP_CONSTRAINT=" + constraintsPath})
+		b.WriteString("\n")
+	}
+
+	// Values as written: Docker expands $VAR references against the
+	// image's environment
+	if userEnv := cfg.Raw().Env; len(userEnv) > 0 {
+		fmt.Fprintf(&b, "# env\n")
+		var lines []string
+		for _, key := range sortedKeys(userEnv) {
+			lines = append(lines, key+"="+envValue(userEnv[key]))
+		}
+		writeEnv(&b, lines)
+		b.WriteString("\n")
+	}
+
+	if len(cfg.PreBuild) > 0 || len(cfg.Install) > 0 || len(cfg.PostBuild) > 0 {
+		fmt.Fprintf(&b, "WORKDIR %s\n\n", projectDir)
+	}
+	writeCommands(&b, config.HookPreBuild, cfg.PreBuild)
+
+	if specs := cfg.ParseCopy(); len(specs) > 0 {
+		fmt.Fprintf(&b, "# copy\n")
+		for _, spec := range specs {
+			fmt.Fprintf(&b, "COPY --chown=$MAMBA_USER:$MAMBA_USER %s\n",
+				jsonArray(strings.TrimPrefix(spec.Src, "./"), path.Join("/", spec.Dst)))
+		}
+		b.WriteString("\n")
+	}
+
+	writeCommands(&b, "install", cfg.Install)
+	writeCommands(&b, config.HookPostBuild, cfg.PostBuild)
+
+	fmt.Fprintf(&b, "USER $MAMBA_USER\n")
+	fmt.Fprintf(&b, "WORKDIR %s\n", path.Join("/", cfg.Workdir))
+	if len(cfg.Ports) > 0 {
+		var ports []string
+		for _, name := range sortedKeys(cfg.Ports) {
+			ports = append(ports, fmt.Sprint(cfg.Ports[name]))
+		}
+		fmt.Fprintf(&b, "EXPOSE %s\n", strings.Join(ports, " "))
+	}
+	if cfg.Cmd != "" {
+		command := cfg.Cmd
+		if len(cfg.PreRun) > 0 || len(cfg.PostRun) > 0 {
+			command = hooks.Script(cfg.Cmd, cfg.PreRun, cfg.PostRun, config.HookPreRun, config.HookPostRun)
+		}
+		// The image's entrypoint activates the environment first
+		fmt.Fprintf(&b, "CMD %s\n", jsonArray("/bin/sh", "-c", command))
+	}
+	return b.String()
+}
+
+// runtimePackages returns the conda-forge packages of a runtime, as
+// internal/runtime installs them
+func runtimePackages(info config.RuntimeInfo) []string {
+	switch info.Language {
+	case "python":
+		return []string{"python=" + info.Version, "pip"}
+	case "node", "nodejs":
+		return []string{"nodejs=" + info.Version, "pnpm"}
+	}
+	spec, ok := config.LookupRuntime(info.Language)
+	if !ok {
+		return []string{info.Language + "=" + info.Version}
+	}
+	return append([]string{spec.Package + "=" + info.Version}, spec.Extras...)
+}
+
+// Unsupported returns what of a config the image does not reproduce,
+// for 'sbox export docker' to warn about
+func Unsupported(cfg *config.Config) []string {
+	var notes []string
+	if len(cfg.Mount) > 0 {
+		notes = append(notes, "mount: host directories are not in the image; pass them with docker run -v")
+	}
+	if len(cfg.Secrets) > 0 {
+		notes = append(notes, "secrets: not in the image; pass them with docker run -e or --env-file")
+	}
+	if cfg.EnvFile != "" {
+		notes = append(notes, "env_file: not in the image; pass it with docker run --env-file "+cfg.EnvFile)
+	}
+	if len(cfg.HostLibs) > 0 {
+		notes = append(notes, "host_libs: host libraries are not in the image")
+	}
+	if cfg.UsesGPU() {
+		notes = append(notes, "gpu: run the image with docker run --gpus all")
+	}
+	if !cfg.Limits.IsZero() {
+		notes = append(notes, "limits: set them with docker run --memory, --cpu-shares and --ulimit")
+	}
+	return notes
+}
+
+// writeCommands writes shell commands of the config as RUN steps, each
+// its own layer, with the project mounted at the working directory.
+// Multi-line commands become heredocs.
+func writeCommands(b *strings.Builder, stage string, commands []string) {
+	if len(commands) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "# %s\n", stage)
+	mount := "--mount=type=bind,target=" + projectDir + ",rw"
+	for _, command := range commands {
+		command = strings.TrimRight(command, "\n")
+		if strings.Contains(command, "\n") {
+			fmt.Fprintf(b, "RUN %s <<'EOF'\n%s\nEOF\n", mount, command)
+		} else {
+			fmt.Fprintf(b, "RUN %s %s\n", mount, command)
+		}
+	}
+	b.WriteString("\n")
+}
+
+// runCommand suggests how to run the image
+func runCommand(cfg *config.Config, info Info) string {
+	args := []string{"docker run --rm"}
+	if cfg.UsesGPU() {
+		args = append(args, "--gpus all")
+	}
+	for _, name := range sortedKeys(cfg.Ports) {
+		args = append(args, fmt.Sprintf("-p %d:%d", cfg.Ports[name], cfg.Ports[name]))
+	}
+	for _, mount := range cfg.ParseMount() {
+		arg := "-v " + mount.Src + ":" + path.Join("/", mount.Dst)
+		if mount.ReadOnly {
+			arg += ":ro"
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(append(args, ImageName(info.ProjectRoot)), " ")
+}
+
+// ImageName is the project directory's name as an image name
+func ImageName(projectRoot string) string {
+	name := strings.ToLower(path.Base(strings.ReplaceAll(projectRoot, "\\", "/")))
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, name)
+	if name = strings.Trim(name, ".-_"); name == "" {
+		return "sbox-app"
+	}
+	return name
+}
+
+// writeEnv writes one ENV instruction, a KEY=value per line
+func writeEnv(b *strings.Builder, vars []string) {
+	fmt.Fprintf(b, "ENV %s\n", strings.Join(vars, " \\\n    "))
+}
+
+// envValue quotes an env value for ENV, leaving $VAR references for
+// Docker to expand
+func envValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+// jsonArray renders the exec form of COPY and CMD
+func jsonArray(items ...string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(items)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DockerIgnore is the .dockerignore written next to the Dockerfile: the
+// state sbox keeps in the project, which the image rebuilds
+func DockerIgnore() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by 'sbox export docker'\n")
+	fmt.Fprintf(&b, ".sbox/\n")
+	fmt.Fprintf(&b, "%s\n", config.LockFile)
+	return b.String()
+}
@@ -0,0 +1,684 @@
+package dockerfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/runner"
+)
+
+// Instruction is one instruction of a Dockerfile
+type Instruction struct {
+	Line    int
+	Keyword string // upper-cased
+	// Flags are the leading --name=value options, e.g. --from=builder
+	Flags []string
+	// Args is the rest of the instruction, continuation lines joined
+	Args string
+	// Heredoc is the body of a <<EOF here-document, if any
+	Heredoc string
+}
+
+// Flag returns the value of a --name=value flag
+func (in Instruction) Flag(name string) (string, bool) {
+	for _, flag := range in.Flags {
+		if value, ok := strings.CutPrefix(flag, "--"+name+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// heredocPattern matches the <<EOF, <<-EOF or <<'EOF' of an instruction
+var heredocPattern = regexp.MustCompile(`<<(-?)(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)`)
+
+// Parse reads the instructions of a Dockerfile
+func Parse(r io.Reader) ([]Instruction, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	next := func() (string, bool) {
+		if !scanner.Scan() {
+			return "", false
+		}
+		lineNo++
+		return scanner.Text(), true
+	}
+
+	var instructions []Instruction
+	for {
+		line, ok := next()
+		if !ok {
+			break
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		start := lineNo
+		text := trimmed
+		for strings.HasSuffix(text, "\\") {
+			text = strings.TrimSuffix(text, "\\")
+			more, ok := next()
+			if !ok {
+				break
+			}
+			// Comment lines inside an instruction are dropped
+			if more = strings.TrimSpace(more); strings.HasPrefix(more, "#") {
+				more = "\\"
+			}
+			text = strings.TrimRight(text, " \t") + " " + more
+		}
+		text = strings.TrimSpace(strings.TrimSuffix(text, " \\"))
+
+		keyword, args, _ := strings.Cut(text, " ")
+		in := Instruction{Line: start, Keyword: strings.ToUpper(keyword)}
+		args = strings.TrimSpace(args)
+		for strings.HasPrefix(args, "--") {
+			flag, rest, _ := strings.Cut(args, " ")
+			in.Flags = append(in.Flags, flag)
+			args = strings.TrimSpace(rest)
+		}
+
+		if m := heredocPattern.FindStringSubmatchIndex(args); m != nil && !strings.HasPrefix(args, "[") {
+			stripTabs := args[m[2]:m[3]] == "-"
+			delimiter := args[m[6]:m[7]]
+			var body []string
+			for {
+				more, ok := next()
+				if !ok {
+					return nil, fmt.Errorf("line %d: here-document %s is not terminated", start, delimiter)
+				}
+				if stripTabs {
+					more = strings.TrimLeft(more, "\t")
+				}
+				if more == delimiter {
+					break
+				}
+				body = append(body, more)
+			}
+			in.Heredoc = strings.Join(body, "\n")
+			args = strings.TrimSpace(args[:m[0]] + args[m[1]:])
+		}
+		in.Args = args
+		instructions = append(instructions, in)
+	}
+	return instructions, scanner.Err()
+}
+
+// Imported is the config synthesized from a Dockerfile
+type Imported struct {
+	Config *config.Config
+	// Runtime is empty when the base image is not a language image sbox
+	// knows
+	Runtime string
+	// Warnings are what could not be carried over, with their lines
+	Warnings []string
+}
+
+// ImportFile parses the Dockerfile at path and imports it for a project
+// whose directory is the build context
+func ImportFile(path, contextDir string) (*Imported, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	instructions, err := Parse(f)
+	if err != nil {
+		return nil, err
+	}
+	return Import(instructions, contextDir)
+}
+
+// Import turns the final stage of a Dockerfile into a config: FROM picks
+// the runtime, COPY and ADD become copy specs, RUN install commands, ENV
+// env, ARG args, EXPOSE ports, WORKDIR the workdir and CMD and ENTRYPOINT
+// the cmd. Copy sources are looked up in contextDir.
+func Import(instructions []Instruction, contextDir string) (*Imported, error) {
+	stages, err := splitStages(instructions)
+	if err != nil {
+		return nil, err
+	}
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("no FROM instruction")
+	}
+
+	im := &Imported{Config: &config.Config{
+		Workdir: "/",
+		Copy:    []string{},
+		Install: []string{},
+		Env:     map[string]string{},
+	}}
+	c := &converter{im: im, contextDir: contextDir, workdir: "/", portNames: map[int]string{}}
+
+	// ARGs before the first FROM are global
+	for _, in := range stages[0].global {
+		c.convert(in)
+	}
+
+	chain := finalChain(stages)
+	if skipped := len(stages) - len(chain); skipped > 0 {
+		c.warn(chain[0].from, "multi-stage build: only the final stage and the stages it is based on are imported; %d stage(s) skipped", skipped)
+	}
+	c.runtimeFromImage(chain[0])
+	for _, stage := range chain {
+		for _, in := range stage.instructions {
+			c.convert(in)
+		}
+	}
+
+	if im.Runtime == "" {
+		c.warn(chain[0].from, "%s is not a language image sbox knows; set runtime: in config.yaml", chain[0].image)
+	}
+	im.Config.Runtime = im.Runtime
+	im.Config.Copy = c.copySpecs()
+	im.Config.Workdir = c.workdir
+	im.Config.Cmd = strings.TrimSpace(c.entrypoint + " " + c.cmd)
+	return im, nil
+}
+
+// stage is a FROM and the instructions up to the next one
+type stage struct {
+	from         Instruction
+	image        string
+	name         string
+	global       []Instruction
+	instructions []Instruction
+}
+
+func splitStages(instructions []Instruction) ([]*stage, error) {
+	var stages []*stage
+	var global []Instruction
+	for _, in := range instructions {
+		switch {
+		case in.Keyword == "FROM":
+			fields := strings.Fields(in.Args)
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("line %d: FROM requires an image", in.Line)
+			}
+			s := &stage{from: in, image: fields[0], global: global}
+			if len(fields) == 3 && strings.EqualFold(fields[1], "AS") {
+				s.name = fields[2]
+			}
+			stages = append(stages, s)
+		case len(stages) == 0:
+			global = append(global, in)
+		default:
+			stages[len(stages)-1].instructions = append(stages[len(stages)-1].instructions, in)
+		}
+	}
+	return stages, nil
+}
+
+// finalChain returns the last stage preceded by the stages it is built
+// FROM, oldest first
+func finalChain(stages []*stage) []*stage {
+	chain := []*stage{stages[len(stages)-1]}
+	for {
+		found := false
+		for i := len(stages) - 2; i >= 0; i-- {
+			if stages[i].name != "" && strings.EqualFold(stages[i].name, chain[0].image) && stages[i] != chain[0] {
+				chain = append([]*stage{stages[i]}, chain...)
+				found = true
+				break
+			}
+		}
+		if !found || len(chain) > len(stages) {
+			return chain
+		}
+	}
+}
+
+// copySpec is a COPY source in the context and its destination
+type copySpec struct {
+	src, dst string
+	dir      bool
+}
+
+type converter struct {
+	im         *Imported
+	contextDir string
+	workdir    string
+	copies     []copySpec
+	entrypoint string
+	cmd        string
+	portNames  map[int]string
+}
+
+func (c *converter) warn(in Instruction, format string, args ...interface{}) {
+	c.im.Warnings = append(c.im.Warnings, fmt.Sprintf("line %d: %s", in.Line, fmt.Sprintf(format, args...)))
+}
+
+func (c *converter) convert(in Instruction) {
+	cfg := c.im.Config
+	switch in.Keyword {
+	case "ARG":
+		name, value, _ := strings.Cut(in.Args, "=")
+		if cfg.Args == nil {
+			cfg.Args = map[string]string{}
+		}
+		if _, ok := cfg.Args[name]; !ok || value != "" {
+			cfg.Args[name] = unquote(value)
+		}
+
+	case "ENV":
+		for key, value := range envPairs(in.Args) {
+			switch {
+			case key == "PATH" || key == "HOME":
+				c.warn(in, "ENV %s: sbox sets it for the sandbox; skipped", key)
+			case strings.HasPrefix(key, "SBOX_PORT_"):
+				// Names the port, in a Dockerfile from 'sbox export docker'
+				if port, err := strconv.Atoi(value); err == nil {
+					c.portNames[port] = strings.ToLower(strings.TrimPrefix(key, "SBOX_PORT_"))
+				}
+			case managedEnv[key] || strings.HasPrefix(key, "SBOX_"):
+				// Set by sbox itself, e.g. in a Dockerfile from 'sbox export docker'
+			default:
+				cfg.Env[key] = value
+			}
+		}
+
+	case "WORKDIR":
+		c.workdir = c.resolve(unquote(in.Args))
+
+	case "COPY", "ADD":
+		c.convertCopy(in)
+
+	case "RUN":
+		c.convertRun(in)
+
+	case "EXPOSE":
+		for _, field := range strings.Fields(in.Args) {
+			port, err := strconv.Atoi(strings.SplitN(field, "/", 2)[0])
+			if err != nil {
+				c.warn(in, "EXPOSE %s: not a port number; skipped", field)
+				continue
+			}
+			if cfg.Ports == nil {
+				cfg.Ports = map[string]int{}
+			}
+			name := c.portNames[port]
+			if name == "" {
+				name = fmt.Sprintf("port%d", port)
+			}
+			cfg.Ports[name] = port
+		}
+
+	case "CMD":
+		c.cmd = commandLine(in.Args)
+	case "ENTRYPOINT":
+		c.entrypoint = commandLine(in.Args)
+		// ENTRYPOINT resets the CMD of the base image
+		c.cmd = ""
+
+	case "LABEL", "MAINTAINER":
+		// Metadata only
+	case "USER":
+		c.warn(in, "USER: sandboxes run as you; skipped")
+	case "VOLUME":
+		c.warn(in, "VOLUME %s: use mount: for host directories; skipped", in.Args)
+	case "HEALTHCHECK":
+		c.warn(in, "HEALTHCHECK: add it under healthchecks: for the daemon that runs cmd; skipped")
+	default:
+		c.warn(in, "%s is not supported; skipped", in.Keyword)
+	}
+}
+
+// managedEnv are variables sbox sets in every sandbox, or the image of
+// 'sbox export docker' sets for micromamba
+var managedEnv = map[string]bool{
+	"CONDA_PREFIX": true, "MAMBA_ROOT_PREFIX": true, "CONDA_OVERRIDE_CUDA": true, "PIP_CONSTRAINT": true,
+	"PYTHONNOUSERSITE": true, "PYTHONDONTWRITEBYTECODE": true, "PIP_DISABLE_PIP_VERSION_CHECK": true,
+}
+
+func (c *converter) convertCopy(in Instruction) {
+	if from, ok := in.Flag("from"); ok {
+		c.warn(in, "%s --from=%s: files from other stages or images cannot be copied; skipped", in.Keyword, from)
+		return
+	}
+	if in.Heredoc != "" {
+		c.warn(in, "%s of an inline file: create it in the project and copy it instead; skipped", in.Keyword)
+		return
+	}
+
+	args := shellWords(in.Args)
+	if len(args) < 2 {
+		c.warn(in, "%s needs a source and a destination; skipped", in.Keyword)
+		return
+	}
+	srcs, dst := args[:len(args)-1], args[len(args)-1]
+	dstDir := strings.HasSuffix(dst, "/") || len(srcs) > 1 || dst == "."
+	dst = c.resolve(dst)
+
+	for _, src := range srcs {
+		switch {
+		case strings.Contains(src, "://") || strings.HasPrefix(src, "git@"):
+			c.warn(in, "ADD %s: remote sources are not supported; download it in an install command", src)
+			continue
+		case strings.ContainsAny(src, "*?["):
+			c.warn(in, "%s %s: wildcards are not supported in copy:; list the files", in.Keyword, src)
+			continue
+		}
+		src = path.Clean(strings.TrimPrefix(src, "/"))
+		if in.Keyword == "ADD" && isArchive(src) {
+			c.warn(in, "ADD %s: archives are copied, not extracted; extract it in an install command", src)
+		}
+
+		spec := copySpec{src: src, dst: dst}
+		info, err := os.Stat(filepath.Join(c.contextDir, filepath.FromSlash(src)))
+		switch {
+		case err != nil:
+			c.warn(in, "%s %s: not found in %s", in.Keyword, src, c.contextDir)
+		case info.IsDir():
+			spec.dir = true
+		}
+		if !spec.dir && dstDir {
+			spec.dst = path.Join(dst, path.Base(src))
+		}
+		c.copies = append(c.copies, spec)
+	}
+}
+
+func isArchive(name string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tar.xz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// copySpecs renders the copies, leaving out those another copy of a
+// directory already covers, as when requirements.txt is copied ahead
+// of the whole tree for Docker's layer cache
+func (c *converter) copySpecs() []string {
+	specs := []string{}
+	seen := map[string]bool{}
+	for i, spec := range c.copies {
+		covered := false
+		for j, other := range c.copies {
+			if i == j || !other.dir || (other.src == spec.src && other.dst == spec.dst) {
+				continue
+			}
+			srcRel, err1 := filepath.Rel(other.src, spec.src)
+			dstRel, err2 := filepath.Rel(other.dst, spec.dst)
+			if err1 == nil && err2 == nil && srcRel == dstRel && !strings.HasPrefix(srcRel, "..") {
+				covered = true
+				break
+			}
+		}
+		src := spec.src
+		if src != "." {
+			src = "./" + src
+		}
+		line := src + ":" + spec.dst
+		if !covered && !seen[line] {
+			seen[line] = true
+			specs = append(specs, line)
+		}
+	}
+	return specs
+}
+
+// systemCommands need root, which sandboxes do not have
+var systemCommands = map[string]bool{
+	"apt-get": true, "apt": true, "apk": true, "yum": true, "dnf": true, "microdnf": true, "zypper": true,
+	"useradd": true, "adduser": true, "groupadd": true, "addgroup": true, "chown": true, "update-ca-certificates": true,
+}
+
+// condaCommands install conda packages; sbox installs the runtime itself
+var condaCommands = map[string]bool{"conda": true, "mamba": true, "micromamba": true}
+
+// convertRun keeps a RUN as an install command, without the parts that
+// need root or install the runtime. It runs from the project directory
+// that was copied to the current WORKDIR, so relative paths still work.
+func (c *converter) convertRun(in Instruction) {
+	if mount, ok := in.Flag("mount"); ok && (strings.Contains(mount, "type=secret") || strings.Contains(mount, "type=ssh")) {
+		c.warn(in, "RUN --mount=%s: use secrets: instead; the mount is skipped", mount)
+	}
+
+	var command string
+	if in.Heredoc != "" {
+		command = in.Heredoc
+		if in.Args != "" {
+			command = in.Args + " <<'EOF'\n" + in.Heredoc + "\nEOF"
+		}
+	} else {
+		command = commandLine(in.Args)
+		var kept []string
+		for _, part := range strings.Split(command, "&&") {
+			part = strings.TrimSpace(part)
+			words := strings.Fields(part)
+			for len(words) > 0 && (words[0] == "sudo" || strings.Contains(words[0], "=")) {
+				words = words[1:]
+			}
+			switch {
+			case len(words) == 0:
+			case systemCommands[words[0]] || strings.Contains(part, "/var/lib/apt") || strings.Contains(part, "/var/cache/"):
+				sub := ""
+				if len(words) > 1 {
+					sub = words[1]
+				}
+				switch {
+				case sub == "install" || sub == "add":
+					c.warn(in, "skipped '%s': system packages need root; look for them on conda-forge or install them on the host", part)
+				case words[0] == "rm" || sub == "update" || sub == "upgrade" || sub == "clean":
+					// Housekeeping of a package install
+				default:
+					c.warn(in, "skipped '%s': it needs root", part)
+				}
+			case condaCommands[words[0]]:
+				c.condaInstall(in, words)
+			default:
+				kept = append(kept, part)
+			}
+		}
+		command = strings.Join(kept, " && ")
+	}
+	if strings.TrimSpace(command) == "" {
+		return
+	}
+
+	if dir := c.contextFor(c.workdir); dir != "" && dir != "." {
+		command = "cd " + runner.ShellJoin([]string{dir}) + " && " + command
+	}
+	c.im.Config.Install = append(c.im.Config.Install, command)
+}
+
+// condaInstall takes the runtime, and CUDA, from a conda install; other
+// packages are not carried over
+func (c *converter) condaInstall(in Instruction, words []string) {
+	if len(words) < 2 || (words[1] != "install" && words[1] != "create") {
+		return
+	}
+	var others []string
+	for i := 2; i < len(words); i++ {
+		word := words[i]
+		if strings.HasPrefix(word, "-") {
+			// Options with a value
+			switch word {
+			case "-c", "--channel", "-n", "--name", "-p", "--prefix", "-f", "--file":
+				i++
+			}
+			continue
+		}
+		name, version, _ := strings.Cut(strings.Trim(word, `"'`), "=")
+		switch name {
+		case "cuda-version", "cudatoolkit":
+			c.im.Config.CUDA = version
+		case "cuda-libraries", "cudnn":
+			c.im.Config.GPU = c.im.Config.CUDA == ""
+		case "pip", "pnpm":
+		default:
+			if spec, ok := config.LookupRuntime(name); ok && c.im.Runtime == "" && version != "" {
+				c.im.Runtime = spec.Name + ":" + version
+			} else if !ok || spec.Package != name {
+				others = append(others, word)
+			}
+		}
+	}
+	if len(others) > 0 {
+		c.warn(in, "conda packages %s are not installed by sbox; install them with pip or npm", strings.Join(others, " "))
+	}
+}
+
+// contextFor returns the directory of the build context that was copied
+// to dir, or "" when none was
+func (c *converter) contextFor(dir string) string {
+	for i := len(c.copies) - 1; i >= 0; i-- {
+		spec := c.copies[i]
+		if spec.dir && spec.dst == dir {
+			return spec.src
+		}
+		if !spec.dir && path.Dir(spec.dst) == dir && path.Base(spec.dst) == path.Base(spec.src) {
+			return path.Dir(spec.src)
+		}
+	}
+	return ""
+}
+
+// resolve makes a path in the image absolute against the WORKDIR
+func (c *converter) resolve(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(c.workdir, p)
+}
+
+// officialImages are Docker Official Images and the runtime they provide,
+// where the name is not the runtime's
+var officialImages = map[string]string{
+	"eclipse-temurin": "java",
+	"amazoncorretto":  "java",
+}
+
+// runtimeFromImage picks the runtime of a stage's language image, with
+// the version of its tag
+func (c *converter) runtimeFromImage(st *stage) {
+	from := st.from
+	image, _, _ := strings.Cut(st.image, "@")
+	name, tag := image, ""
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+	name = path.Base(name)
+	if language, ok := officialImages[name]; ok {
+		name = language
+	}
+	spec, ok := config.LookupRuntime(name)
+	if !ok {
+		return
+	}
+
+	latest := spec.Versions[len(spec.Versions)-1]
+	version := regexp.MustCompile(`^\d+(\.\d+)*`).FindString(tag)
+	if version == "" {
+		c.warn(from, "FROM %s has no version; using %s:%s", image, spec.Name, latest)
+		version = latest
+	}
+	// As precise as sbox's versions: python:3.11.4 is python:3.11
+	parts := strings.Split(version, ".")
+	if n := strings.Count(latest, ".") + 1; len(parts) > n {
+		version = strings.Join(parts[:n], ".")
+	}
+	c.im.Runtime = spec.Name + ":" + version
+}
+
+// commandLine turns the shell or exec form of RUN, CMD and ENTRYPOINT
+// into a shell command
+func commandLine(args string) string {
+	if !strings.HasPrefix(args, "[") {
+		return args
+	}
+	var argv []string
+	if err := json.Unmarshal([]byte(args), &argv); err != nil || len(argv) == 0 {
+		return args
+	}
+	if len(argv) == 3 && (argv[0] == "/bin/sh" || argv[0] == "sh" || argv[0] == "/bin/bash" || argv[0] == "bash") && argv[1] == "-c" {
+		return argv[2]
+	}
+	return runner.ShellJoin(argv)
+}
+
+// envPairs parses ENV key=value pairs, or the legacy ENV key value
+func envPairs(args string) map[string]string {
+	pairs := map[string]string{}
+	words := shellWords(args)
+	if len(words) > 0 && !strings.Contains(words[0], "=") {
+		key, value, _ := strings.Cut(args, " ")
+		pairs[key] = unquote(strings.TrimSpace(value))
+		return pairs
+	}
+	for _, word := range words {
+		if key, value, ok := strings.Cut(word, "="); ok {
+			pairs[key] = value
+		}
+	}
+	return pairs
+}
+
+// shellWords splits arguments on spaces outside quotes, removing the
+// quotes, or parses the JSON form of COPY
+func shellWords(args string) []string {
+	if strings.HasPrefix(args, "[") {
+		var words []string
+		if err := json.Unmarshal([]byte(args), &words); err == nil {
+			return words
+		}
+	}
+	var words []string
+	var current strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range args {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, current.String())
+	}
+	return words
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
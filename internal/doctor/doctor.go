@@ -0,0 +1,456 @@
+// Package doctor diagnoses the host and project for 'sbox doctor':
+// required tools, disk space, glibc, network access to package servers,
+// cache integrity and stale project state.
+package doctor
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/cache"
+	"github.com/sbox-project/sbox/internal/compat"
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/gpu"
+	"github.com/sbox-project/sbox/internal/netfs"
+	"github.com/sbox-project/sbox/internal/process"
+	"github.com/sbox-project/sbox/internal/vcs"
+)
+
+// Status is the outcome of one check
+type Status int
+
+const (
+	OK Status = iota
+	Warn
+	Fail
+)
+
+// Check is one diagnostic result with a remediation step when it is not OK
+type Check struct {
+	Name   string
+	Status Status
+	Detail string
+	Fix    string
+}
+
+const (
+	// minGlibc is the oldest glibc conda-forge builds target
+	minGlibc = "2.17"
+
+	lowDiskSpace      = 5 << 30
+	criticalDiskSpace = 1 << 30
+
+	networkTimeout = 5 * time.Second
+
+	// minOpenFiles is the hard limit on open files below which servers
+	// are likely to run out
+	minOpenFiles = 65536
+)
+
+// Run performs all checks. Project checks are skipped when projectRoot
+// is empty; network checks are skipped when offline is set.
+func Run(projectRoot string, offline bool) []Check {
+	var checks []Check
+
+	checks = append(checks, checkTool("tar", Fail, "needed to extract micromamba"))
+	checks = append(checks, checkTool("curl", Warn, "not used by sbox itself, but common in install commands"))
+	checks = append(checks, checkGlibc())
+	checks = append(checks, checkOpenFiles())
+
+	if cacheDir, err := cache.GetGlobalCacheDir(); err == nil {
+		checks = append(checks, checkDisk("disk space (cache)", cacheDir))
+		checks = append(checks, checkCacheFS(cacheDir))
+	}
+	if projectRoot != "" {
+		checks = append(checks, checkDisk("disk space (project)", projectRoot))
+	}
+	if IsWSL() {
+		checks = append(checks, checkWSL(projectRoot))
+	}
+
+	if !offline {
+		if url, err := config.GetMicromambaURL(); err == nil {
+			checks = append(checks, checkReachable("micro.mamba.pm", url))
+		}
+		checks = append(checks, checkReachable("conda-forge", "https://conda.anaconda.org/conda-forge/noarch/repodata.json"))
+	}
+
+	checks = append(checks, checkCache()...)
+
+	if projectRoot != "" {
+		checks = append(checks, checkProject(projectRoot)...)
+	}
+
+	return checks
+}
+
+func checkTool(name string, missing Status, why string) Check {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return Check{
+			Name:   name,
+			Status: missing,
+			Detail: "not found in PATH (" + why + ")",
+			Fix:    fmt.Sprintf("Install %s with your package manager (e.g. apt install %s)", name, name),
+		}
+	}
+	return Check{Name: name, Status: OK, Detail: path}
+}
+
+func checkGlibc() Check {
+	if runtime.GOOS != "linux" {
+		return Check{Name: "glibc", Status: OK, Detail: "not required on " + runtime.GOOS}
+	}
+
+	version := compat.HostGlibc()
+	switch {
+	case version == "":
+		return Check{
+			Name:   "glibc",
+			Status: Fail,
+			Detail: "not found (musl or unknown libc)",
+			Fix:    "conda-forge environments need glibc; use a glibc-based distribution or container",
+		}
+	case compat.CompareVersions(version, minGlibc) < 0:
+		return Check{
+			Name:   "glibc",
+			Status: Fail,
+			Detail: fmt.Sprintf("%s is older than %s", version, minGlibc),
+			Fix:    "Upgrade the host; conda-forge packages require glibc " + minGlibc + " or newer",
+		}
+	}
+	return Check{Name: "glibc", Status: OK, Detail: version}
+}
+
+func checkDisk(name, path string) Check {
+	// Measure the nearest existing directory
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+
+	free, err := freeSpace(path)
+	if err != nil {
+		return Check{Name: name, Status: Warn, Detail: fmt.Sprintf("cannot stat %s: %s", path, err)}
+	}
+
+	detail := fmt.Sprintf("%s free on %s", cache.FormatBytes(free), path)
+	switch {
+	case free < criticalDiskSpace:
+		return Check{Name: name, Status: Fail, Detail: detail,
+			Fix: "Free space: 'sbox cache prune' removes unused runtimes, 'sbox clean --logs' old logs"}
+	case free < lowDiskSpace:
+		return Check{Name: name, Status: Warn, Detail: detail,
+			Fix: "A runtime environment needs 0.5-2 GB; consider 'sbox cache prune'"}
+	}
+	return Check{Name: name, Status: OK, Detail: detail}
+}
+
+// checkCacheFS warns about a cache on a network filesystem, where builds
+// copy instead of hardlinking and locks fall back to lock directories
+func checkCacheFS(cacheDir string) Check {
+	fs := netfs.Detect(cacheDir)
+	if fs == "" {
+		return Check{Name: "cache filesystem", Status: OK, Detail: "local"}
+	}
+	if os.Getenv(config.CacheDirEnv) != "" {
+		return Check{Name: "cache filesystem", Status: OK, Detail: fs + " (set by " + config.CacheDirEnv + ")"}
+	}
+	return Check{
+		Name:   "cache filesystem",
+		Status: Warn,
+		Detail: fmt.Sprintf("%s is on %s; packages are copied instead of hardlinked", cacheDir, fs),
+		Fix:    fmt.Sprintf("export %s=/path/on/local/disk (e.g. /scratch/$USER/sbox-cache)", config.CacheDirEnv),
+	}
+}
+
+// IsWSL reports whether sbox runs in the Windows Subsystem for Linux
+func IsWSL() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	if os.Getenv("WSL_DISTRO_NAME") != "" {
+		return true
+	}
+	data, _ := os.ReadFile("/proc/sys/kernel/osrelease")
+	return strings.Contains(strings.ToLower(string(data)), "microsoft")
+}
+
+// onWindowsDrive reports whether a WSL path is on a Windows drive mounted
+// under /mnt, e.g. /mnt/c/Users/alice
+func onWindowsDrive(path string) bool {
+	rest, ok := strings.CutPrefix(path, "/mnt/")
+	if !ok || len(rest) == 0 {
+		return false
+	}
+	return len(rest) == 1 || rest[1] == '/'
+}
+
+// checkWSL warns about a project on a Windows drive under WSL, where every
+// file access crosses into Windows: builds are many times slower, files
+// have no Unix permissions and hardlinks and locks fall back to slower
+// ways
+func checkWSL(projectRoot string) Check {
+	if projectRoot != "" && onWindowsDrive(projectRoot) {
+		return Check{Name: "WSL", Status: Warn,
+			Detail: projectRoot + " is on a Windows drive; environments there build and start slowly",
+			Fix:    "Move the project into the Linux filesystem, e.g. ~/" + filepath.Base(projectRoot) + ", and open it from Windows as \\\\wsl$\\..."}
+	}
+	detail := "running in WSL"
+	if distro := os.Getenv("WSL_DISTRO_NAME"); distro != "" {
+		detail += " (" + distro + ")"
+	}
+	return Check{Name: "WSL", Status: OK, Detail: detail}
+}
+
+func checkReachable(name, url string) Check {
+	client := &http.Client{Timeout: networkTimeout}
+	resp, err := client.Head(url)
+	if err != nil {
+		return Check{
+			Name:   "network: " + name,
+			Status: Warn,
+			Detail: err.Error(),
+			Fix:    "Check your connection or proxy (HTTPS_PROXY); builds can still use cached runtimes",
+		}
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return Check{Name: "network: " + name, Status: Warn, Detail: resp.Status,
+			Fix: "The server is having problems; try again later"}
+	}
+	return Check{Name: "network: " + name, Status: OK, Detail: "reachable"}
+}
+
+// checkCache finds cached runtimes whose directory exists but whose
+// runtime binary is missing (an interrupted cache copy)
+func checkCache() []Check {
+	m, err := cache.NewManager()
+	if err != nil {
+		return nil
+	}
+
+	var checks []Check
+	entries, _ := os.ReadDir(m.GetRuntimesDir())
+	var broken []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		idx := strings.Index(name, "-")
+		if idx <= 0 {
+			continue
+		}
+		rt, err := m.GetCachedRuntime(name[:idx], name[idx+1:])
+		if err != nil || rt == nil {
+			broken = append(broken, name)
+		}
+	}
+	if len(broken) > 0 {
+		checks = append(checks, Check{
+			Name:   "runtime cache",
+			Status: Warn,
+			Detail: "incomplete entries: " + strings.Join(broken, ", "),
+			Fix:    fmt.Sprintf("Remove them with 'sbox cache clean %s'", broken[0]),
+		})
+	} else {
+		checks = append(checks, Check{Name: "runtime cache", Status: OK, Detail: fmt.Sprintf("%d runtimes", len(entries))})
+	}
+
+	// Entries from before the cache was split by platform are never used
+	runtimes, _ := m.ListCachedRuntimes()
+	var legacy []string
+	for _, rt := range runtimes {
+		if rt.Platform == "" {
+			legacy = append(legacy, cache.GetRuntimeKey(rt.Language, rt.Version))
+		}
+	}
+	if len(legacy) > 0 {
+		checks = append(checks, Check{
+			Name:   "legacy cache entries",
+			Status: Warn,
+			Detail: fmt.Sprintf("%s (platform unknown, not used)", strings.Join(legacy, ", ")),
+			Fix:    "Reclaim the space with 'sbox cache clean'",
+		})
+	}
+
+	mamba := m.GetMicromambaPath()
+	if info, err := os.Stat(mamba); err == nil && info.Mode()&0111 == 0 {
+		checks = append(checks, Check{
+			Name:   "cached micromamba",
+			Status: Warn,
+			Detail: mamba + " is not executable",
+			Fix:    "Delete it; the next build downloads it again",
+		})
+	}
+
+	return checks
+}
+
+func checkProject(projectRoot string) []Check {
+	var checks []Check
+
+	cfg, err := config.Load(projectRoot)
+	if err != nil {
+		return append(checks, Check{Name: "config", Status: Fail, Detail: err.Error(),
+			Fix: "Run 'sbox validate' for details"})
+	}
+
+	if !config.IsBuilt(projectRoot) {
+		checks = append(checks, Check{Name: "build", Status: Warn, Detail: "not built", Fix: "Run 'sbox build'"})
+	} else if err := config.CheckPlatform(projectRoot); err != nil {
+		checks = append(checks, Check{Name: "build", Status: Fail, Detail: "built for another platform", Fix: "Run 'sbox build' to rebuild it for this host"})
+	} else if !config.IsUpToDate(projectRoot, cfg) {
+		checks = append(checks, Check{Name: "build", Status: Warn, Detail: "config changed since last build", Fix: "Run 'sbox build'"})
+	} else {
+		checks = append(checks, Check{Name: "build", Status: OK, Detail: "up to date"})
+	}
+
+	if cfg.Isolation == config.IsolationNamespace {
+		_, bwrapErr := exec.LookPath("bwrap")
+		_, unshareErr := exec.LookPath("unshare")
+		if bwrapErr != nil && unshareErr != nil {
+			checks = append(checks, Check{Name: "isolation", Status: Fail,
+				Detail: "isolation: namespace but neither bwrap nor unshare is installed",
+				Fix:    "Install bubblewrap (recommended) or util-linux"})
+		}
+	}
+
+	if cfg.UsesGPU() {
+		checks = append(checks, checkGPU(cfg.CUDA))
+	}
+	if !cfg.Ulimits.IsZero() {
+		checks = append(checks, checkUlimits(cfg.Ulimits))
+	}
+	if cfg.VCS != config.VCSNone {
+		if repo := vcs.Detect(projectRoot); repo != nil {
+			checks = append(checks, checkIgnored(repo, projectRoot))
+		}
+	}
+
+	// Entries marked running whose process is gone; Slurm jobs run on
+	// other nodes
+	pm := process.NewProcessManager(projectRoot)
+	processes, _ := pm.LoadProcesses()
+	var stale []string
+	for _, p := range processes {
+		if p.SlurmJob == "" && (p.Status == "running" || p.Status == "paused") && !process.IsProcessRunning(p.PID) {
+			stale = append(stale, fmt.Sprintf("%s (PID %d)", p.Name, p.PID))
+		}
+	}
+	if len(stale) > 0 {
+		checks = append(checks, Check{Name: "process entries", Status: Warn,
+			Detail: "marked running but gone: " + strings.Join(stale, ", "),
+			Fix:    "Run 'sbox ps --all' to refresh them, then 'sbox logs <name>' to see why they exited"})
+	} else {
+		checks = append(checks, Check{Name: "process entries", Status: OK, Detail: fmt.Sprintf("%d tracked", len(processes))})
+	}
+
+	// Mounts are symlinks in the rootfs; their targets must exist
+	rootfs := config.GetRootfsDir(projectRoot)
+	var broken []string
+	for _, spec := range cfg.ParseMount() {
+		dst := filepath.Join(rootfs, strings.TrimPrefix(spec.Dst, "/"))
+		if _, err := os.Lstat(dst); err != nil {
+			continue
+		}
+		if _, err := os.Stat(dst); err != nil {
+			broken = append(broken, fmt.Sprintf("%s -> %s", spec.Dst, spec.Src))
+		}
+	}
+	if len(broken) > 0 {
+		checks = append(checks, Check{Name: "mounts", Status: Fail,
+			Detail: "broken: " + strings.Join(broken, ", "),
+			Fix:    "Create the host paths or remove them from mount: in config.yaml, then run 'sbox build'"})
+	} else if len(cfg.Mount) > 0 {
+		checks = append(checks, Check{Name: "mounts", Status: OK, Detail: fmt.Sprintf("%d mounts", len(cfg.Mount))})
+	}
+
+	return checks
+}
+
+// checkIgnored checks that the repository ignores the project's local
+// state
+func checkIgnored(repo *vcs.Repo, projectRoot string) Check {
+	file := repo.IgnoreFile(projectRoot)
+	if missing := repo.Unignored(projectRoot); len(missing) > 0 {
+		return Check{Name: "vcs ignore", Status: Warn,
+			Detail: fmt.Sprintf("%s does not ignore %s", file, strings.Join(missing, ", ")),
+			Fix:    "Run 'sbox build' in a terminal to add them, or set vcs: none in config.yaml"}
+	}
+	return Check{Name: "vcs ignore", Status: OK, Detail: fmt.Sprintf("%s repository, local state ignored", repo.Kind)}
+}
+
+// checkOpenFiles checks the hard limit on open files, which caps what
+// ulimits: nofile can raise the soft limit to
+func checkOpenFiles() Check {
+	if runtime.GOOS == "windows" {
+		return Check{Name: "open files limit", Status: OK, Detail: "no limit on " + runtime.GOOS}
+	}
+	hard, err := process.HardLimit("nofile")
+	if err != nil {
+		return Check{Name: "open files limit", Status: Warn, Detail: err.Error()}
+	}
+	detail := "hard limit " + process.FormatRlimit(hard)
+	if hard < minOpenFiles {
+		return Check{Name: "open files limit", Status: Warn,
+			Detail: detail + "; servers with many connections (Node.js, async Python) may run out of file descriptors",
+			Fix:    fmt.Sprintf("Raise it to %d or more, e.g. '* hard nofile %d' in /etc/security/limits.conf or LimitNOFILE= for systemd services", minOpenFiles, minOpenFiles)}
+	}
+	return Check{Name: "open files limit", Status: OK, Detail: detail}
+}
+
+// checkUlimits checks that ulimits: fit under the host's hard limits
+func checkUlimits(ulimits config.Ulimits) Check {
+	var over []string
+	ulimits.Each(func(key, value string) {
+		u, err := config.ParseUlimit(key, value)
+		if err != nil {
+			over = append(over, err.Error())
+			return
+		}
+		if hard, err := process.HardLimit(key); err == nil && u.Hard > hard && os.Geteuid() != 0 {
+			over = append(over, fmt.Sprintf("%s %s (hard limit %s)", key, value, process.FormatRlimit(hard)))
+		}
+	})
+	if len(over) > 0 {
+		return Check{Name: "ulimits", Status: Fail,
+			Detail: "above the host's hard limits: " + strings.Join(over, ", "),
+			Fix:    "Raise the hard limits (/etc/security/limits.conf, then log in again) or lower ulimits: in config.yaml"}
+	}
+	var set []string
+	ulimits.Each(func(key, value string) {
+		set = append(set, key+" "+value)
+	})
+	return Check{Name: "ulimits", Status: OK, Detail: strings.Join(set, ", ")}
+}
+
+// checkGPU checks that the host can run the CUDA version of gpu: or cuda:
+func checkGPU(cuda string) Check {
+	if runtime.GOOS != "linux" {
+		return Check{Name: "gpu", Status: Fail,
+			Detail: "CUDA needs Linux with an NVIDIA GPU, this host runs " + runtime.GOOS,
+			Fix:    "Run the sandbox on a Linux GPU host, or remove gpu: and cuda: from config.yaml"}
+	}
+	if problem := gpu.Check(cuda); problem != nil {
+		return Check{Name: "gpu", Status: Fail, Detail: problem.Detail, Fix: problem.Fix}
+	}
+
+	detail := fmt.Sprintf("%d devices, libcuda in %s", len(gpu.Devices()), gpu.DriverLibDir())
+	if version, err := gpu.DriverVersion(); err == nil {
+		detail = "driver " + version + ", " + detail
+	}
+	return Check{Name: "gpu", Status: OK, Detail: detail}
+}
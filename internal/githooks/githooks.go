@@ -0,0 +1,214 @@
+// Package githooks installs the git hooks of 'sbox githooks': pre-commit
+// and pre-push scripts that run 'sbox validate', and optionally a test
+// command in the sandbox, before changes leave the developer's machine.
+package githooks
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/runner"
+)
+
+// The hooks sbox installs: pre-commit validates the config, pre-push also
+// runs the tests
+const (
+	PreCommit = "pre-commit"
+	PrePush   = "pre-push"
+)
+
+// Names lists the hooks sbox installs
+var Names = []string{PreCommit, PrePush}
+
+// marker starts the second line of every hook sbox writes
+const marker = "# sbox githook: "
+
+// ErrForeign is returned for hooks sbox did not write
+var ErrForeign = errors.New("not written by sbox")
+
+// BackupSuffix names the copy of a hook sbox replaced; the sbox hook runs
+// it first, and uninstalling puts it back
+const BackupSuffix = ".pre-sbox"
+
+// Hook is an installed hook
+type Hook struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Project is the project directory, relative to the repository root
+	Project string `json:"project"`
+	// Test is the command run in the sandbox, if any
+	Test string `json:"test,omitempty"`
+	// Chained reports whether a hook sbox replaced runs first
+	Chained bool `json:"chained,omitempty"`
+}
+
+// Repo is the git repository of a project
+type Repo struct {
+	// Root is the top of the work tree
+	Root string
+	// HooksDir honors core.hooksPath
+	HooksDir string
+}
+
+// FindRepo finds the git repository dir belongs to
+func FindRepo(dir string) (*Repo, error) {
+	out, err := git(dir, "rev-parse", "--show-toplevel", "--git-path", "hooks")
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("unexpected output of git rev-parse: %q", out)
+	}
+	hooks := lines[1]
+	if !filepath.IsAbs(hooks) {
+		hooks = filepath.Join(dir, hooks)
+	}
+	return &Repo{Root: lines[0], HooksDir: filepath.Clean(hooks)}, nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return string(out), nil
+}
+
+// Script returns a hook that runs 'sbox validate' in project, relative to
+// the repository root, and then test in the sandbox when it is not empty
+func Script(sbox, hook, project, test string) string {
+	var sb strings.Builder
+	sb.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&sb, "%s%s in %s\n", marker, hook, project)
+	if test != "" {
+		fmt.Fprintf(&sb, "# test: %s\n", test)
+	}
+	fmt.Fprintf(&sb, "# Skip once with 'git %s --no-verify'; remove with 'sbox githooks uninstall'\n", strings.TrimPrefix(hook, "pre-"))
+	fmt.Fprintf(&sb, "if [ -x \"$0%s\" ]; then \"$0%s\" \"$@\" || exit $?; fi\n", BackupSuffix, BackupSuffix)
+	fmt.Fprintf(&sb, "cd \"$(git rev-parse --show-toplevel)\"/%s || exit 1\n", runner.ShellJoin([]string{project}))
+	fmt.Fprintf(&sb, "%s validate --quiet || exit 1\n", runner.ShellJoin([]string{sbox}))
+	if test != "" {
+		fmt.Fprintf(&sb, "exec %s run -- %s </dev/null\n", runner.ShellJoin([]string{sbox}), runner.ShellJoin([]string{test}))
+	}
+	return sb.String()
+}
+
+// Install writes a hook into the hooks directory. Another hook already
+// there is kept as <hook>.pre-sbox and run first, but only with force; a
+// hook of another project is replaced only with force.
+func (r *Repo) Install(hook, sbox, project, test string, force bool) (*Hook, error) {
+	if err := os.MkdirAll(r.HooksDir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(r.HooksDir, hook)
+	if existing, err := Read(path); err == nil {
+		if existing.Project != project && !force {
+			return nil, fmt.Errorf("%s runs sbox in %s; use --force to replace it", path, existing.Project)
+		}
+	} else if _, err := os.Lstat(path); err == nil {
+		if !force {
+			return nil, fmt.Errorf("%s exists and was not written by sbox; use --force to run it before the sbox hook", path)
+		}
+		if _, err := os.Lstat(path + BackupSuffix); err == nil {
+			return nil, fmt.Errorf("%s exists; remove it or %s first", path+BackupSuffix, path)
+		}
+		if err := os.Rename(path, path+BackupSuffix); err != nil {
+			return nil, err
+		}
+	}
+
+	tmp, err := os.CreateTemp(r.HooksDir, "."+hook+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(Script(sbox, hook, project, test)); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return Read(path)
+}
+
+// Read reads a hook sbox wrote; any other file is an error
+func Read(path string) (*Hook, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hook *Hook
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < 3 && scanner.Scan(); i++ {
+		line := scanner.Text()
+		if rest, ok := strings.CutPrefix(line, marker); ok {
+			name, project, ok := strings.Cut(rest, " in ")
+			if !ok {
+				break
+			}
+			hook = &Hook{Name: name, Path: path, Project: project}
+		} else if test, ok := strings.CutPrefix(line, "# test: "); ok && hook != nil {
+			hook.Test = test
+		}
+	}
+	if hook == nil {
+		return nil, fmt.Errorf("%s: %w", path, ErrForeign)
+	}
+	if _, err := os.Stat(path + BackupSuffix); err == nil {
+		hook.Chained = true
+	}
+	return hook, nil
+}
+
+// List returns the hooks sbox installed, in the order of Names
+func (r *Repo) List() []Hook {
+	var hooks []Hook
+	for _, name := range Names {
+		if hook, err := Read(filepath.Join(r.HooksDir, name)); err == nil {
+			hooks = append(hooks, *hook)
+		}
+	}
+	return hooks
+}
+
+// Uninstall removes a hook sbox installed and puts back the hook it
+// replaced, if any. It reports whether there was one to remove; other
+// hooks are left alone.
+func (r *Repo) Uninstall(hook string) (bool, error) {
+	path := filepath.Join(r.HooksDir, hook)
+	if _, err := Read(path); err != nil {
+		if os.IsNotExist(err) || errors.Is(err, ErrForeign) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	if _, err := os.Lstat(path + BackupSuffix); err == nil {
+		if err := os.Rename(path+BackupSuffix, path); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,205 @@
+// Package gpu finds the host's NVIDIA driver, devices and driver
+// libraries for sandboxes with gpu: or cuda: set, and the conda-forge
+// packages that provide CUDA in the environment.
+package gpu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/compat"
+)
+
+const (
+	// driverVersionFile holds the version of the loaded kernel driver
+	driverVersionFile = "/proc/driver/nvidia/version"
+	// wslLibDir holds the driver libraries WSL maps in from Windows
+	wslLibDir = "/usr/lib/wsl/lib"
+)
+
+// libDirs are where distributions, container runtimes, WSL and NixOS put
+// the driver's user-space libraries. The dynamic linker searches the
+// system directories by itself.
+var libDirs = []struct {
+	path   string
+	system bool
+}{
+	{"/usr/lib/x86_64-linux-gnu", true},
+	{"/usr/lib/aarch64-linux-gnu", true},
+	{"/usr/lib64", true},
+	{"/usr/lib", true},
+	{"/usr/local/nvidia/lib64", false},
+	{"/usr/local/nvidia/lib", false},
+	{wslLibDir, false},
+	{"/run/opengl-driver/lib", false},
+}
+
+// Env are host variables that select GPUs, passed on to commands
+var Env = []string{
+	"CUDA_VISIBLE_DEVICES", "CUDA_DEVICE_ORDER",
+	"NVIDIA_VISIBLE_DEVICES", "NVIDIA_DRIVER_CAPABILITIES",
+}
+
+// minDriver is the oldest driver each CUDA major version runs on, with
+// minor version compatibility
+var minDriver = map[string]string{
+	"11": "450.80.02",
+	"12": "525.60.13",
+	"13": "580.65.06",
+}
+
+var (
+	driverPattern = regexp.MustCompile(`Kernel Module\s+(?:for \S+\s+)?([0-9]+(?:\.[0-9]+)+)`)
+	cudaPattern   = regexp.MustCompile(`^\d+(\.\d+)?$`)
+)
+
+// Devices returns the host's NVIDIA device nodes: /dev/nvidia0,
+// /dev/nvidiactl, /dev/nvidia-uvm, ... and /dev/dxg under WSL
+func Devices() []string {
+	devices, _ := filepath.Glob("/dev/nvidia*")
+	if _, err := os.Stat("/dev/dxg"); err == nil {
+		devices = append(devices, "/dev/dxg")
+	}
+	return devices
+}
+
+// DriverVersion returns the version of the loaded NVIDIA kernel driver
+func DriverVersion() (string, error) {
+	data, err := os.ReadFile(driverVersionFile)
+	if err != nil {
+		return "", fmt.Errorf("no NVIDIA driver loaded (%s not found)", driverVersionFile)
+	}
+	m := driverPattern.FindSubmatch(data)
+	if m == nil {
+		return "", fmt.Errorf("unrecognized driver version in %s", driverVersionFile)
+	}
+	return string(m[1]), nil
+}
+
+// DriverLibDir returns the host directory holding the driver's libcuda,
+// or "" when it is not installed
+func DriverLibDir() string {
+	for _, dir := range libDirs {
+		if hasLibcuda(dir.path) {
+			return dir.path
+		}
+	}
+	return ""
+}
+
+// LibDirs returns the directories holding the driver's libcuda that the
+// dynamic linker does not search by itself, for LD_LIBRARY_PATH. Putting
+// the system directories there would shadow the environment's libraries
+// that binaries find through their RUNPATH.
+func LibDirs() []string {
+	var dirs []string
+	for _, dir := range libDirs {
+		if !dir.system && hasLibcuda(dir.path) {
+			dirs = append(dirs, dir.path)
+		}
+	}
+	return dirs
+}
+
+// DriverLibraries returns the driver's user-space libraries, which GPU
+// sandboxes take from the host: libcuda and the libnvidia-* it loads
+func DriverLibraries() []string {
+	dir := DriverLibDir()
+	if dir == "" {
+		return nil
+	}
+	libs, _ := filepath.Glob(filepath.Join(dir, "libcuda.so*"))
+	nvidia, _ := filepath.Glob(filepath.Join(dir, "libnvidia-*.so*"))
+	return append(libs, nvidia...)
+}
+
+func hasLibcuda(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "libcuda.so.1"))
+	return err == nil
+}
+
+// ValidVersion reports whether a cuda: value is a CUDA version sbox can
+// install, such as "12" or "12.1"
+func ValidVersion(cuda string) bool {
+	if !cudaPattern.MatchString(cuda) {
+		return false
+	}
+	_, ok := minDriver[major(cuda)]
+	return ok
+}
+
+// MinDriver returns the oldest driver that runs a CUDA version, or ""
+// when the version is unknown
+func MinDriver(cuda string) string {
+	return minDriver[major(cuda)]
+}
+
+// Packages returns the conda-forge packages providing CUDA and cuDNN.
+// CUDA 11 ships as cudatoolkit; from CUDA 12 the libraries are split and
+// cuda-version pins them. Without a version the solver picks the newest
+// the driver supports (conda's __cuda virtual package).
+func Packages(cuda string) []string {
+	switch {
+	case cuda == "":
+		return []string{"cuda-libraries", "cudnn"}
+	case major(cuda) == "11":
+		return []string{"cudatoolkit=" + cuda, "cudnn"}
+	}
+	return []string{"cuda-version=" + cuda, "cuda-libraries", "cudnn"}
+}
+
+// Problem is why the host cannot run a GPU sandbox, and how to fix it
+type Problem struct {
+	Detail string
+	Fix    string
+}
+
+// Check returns what the host lacks to run CUDA version cuda ("" for
+// any), or nil when the driver, its libraries and the devices are there
+func Check(cuda string) *Problem {
+	driver := "the NVIDIA driver"
+	version, err := DriverVersion()
+	if err != nil {
+		// Under WSL the driver runs on Windows and has no /proc entry
+		if !hasLibcuda(wslLibDir) {
+			return &Problem{
+				Detail: err.Error(),
+				Fix:    "Install the NVIDIA driver and reboot, or run on a GPU node (e.g. with 'sbox slurm')",
+			}
+		}
+	} else {
+		driver = "NVIDIA driver " + version
+	}
+
+	if DriverLibDir() == "" {
+		var searched []string
+		for _, dir := range libDirs {
+			searched = append(searched, dir.path)
+		}
+		return &Problem{
+			Detail: fmt.Sprintf("%s is loaded but libcuda.so.1 was not found in %s", driver, strings.Join(searched, ", ")),
+			Fix:    "Install the driver's user-space libraries (e.g. libnvidia-compute or nvidia-utils of the same version)",
+		}
+	}
+	if len(Devices()) == 0 {
+		return &Problem{
+			Detail: fmt.Sprintf("%s is loaded but no /dev/nvidia* devices exist", driver),
+			Fix:    "Run nvidia-smi once as root (or nvidia-modprobe) to create them; in containers pass the GPUs in (e.g. docker --gpus all)",
+		}
+	}
+	if oldest := MinDriver(cuda); oldest != "" && version != "" && compat.CompareVersions(version, oldest) < 0 {
+		return &Problem{
+			Detail: fmt.Sprintf("CUDA %s needs NVIDIA driver %s or newer, this host has %s", cuda, oldest, version),
+			Fix:    "Upgrade the NVIDIA driver, or set cuda: in config.yaml to a version it supports",
+		}
+	}
+	return nil
+}
+
+func major(version string) string {
+	major, _, _ := strings.Cut(version, ".")
+	return major
+}
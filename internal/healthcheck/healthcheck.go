@@ -0,0 +1,168 @@
+// Package healthcheck runs the healthchecks: probes of config.yaml once,
+// for 'sbox healthcheck', and reports them the way monitoring plugins do
+// (Nagios, Icinga, Sensu, check_mk): one line of output and an exit code.
+package healthcheck
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/sysproc"
+)
+
+// DefaultTimeout applies when a check sets no timeout
+const DefaultTimeout = 10 * time.Second
+
+// States, in the order of their exit codes
+const (
+	OK       = "OK"
+	Warning  = "WARNING"
+	Critical = "CRITICAL"
+	Unknown  = "UNKNOWN"
+)
+
+// Result is the outcome of a probe
+type Result struct {
+	State   string        `json:"state"`
+	Message string        `json:"message"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// ExitCode returns the monitoring plugin exit code of the result
+func (r Result) ExitCode() int {
+	switch r.State {
+	case OK:
+		return 0
+	case Warning:
+		return 1
+	case Critical:
+		return 2
+	}
+	return 3
+}
+
+// String formats the result as a plugin output line, with the probe's
+// duration as performance data
+func (r Result) String() string {
+	return fmt.Sprintf("%s - %s | time=%.3fs;;;0", r.State, r.Message, r.Elapsed.Seconds())
+}
+
+// Timeouts returns the timeout and slow threshold of a check
+func Timeouts(check config.HealthCheck) (time.Duration, time.Duration, error) {
+	timeout, slow := DefaultTimeout, time.Duration(0)
+	var err error
+	if check.Timeout != "" {
+		if timeout, err = time.ParseDuration(check.Timeout); err != nil || timeout <= 0 {
+			return 0, 0, fmt.Errorf("invalid timeout '%s'", check.Timeout)
+		}
+	}
+	if check.Slow != "" {
+		if slow, err = time.ParseDuration(check.Slow); err != nil || slow <= 0 {
+			return 0, 0, fmt.Errorf("invalid slow '%s'", check.Slow)
+		}
+	}
+	return timeout, slow, nil
+}
+
+// Check returns why a check is invalid, or nil
+func Check(check config.HealthCheck) error {
+	switch {
+	case check.Command == "" && check.HTTP == "":
+		return fmt.Errorf("set command or http")
+	case check.Command != "" && check.HTTP != "":
+		return fmt.Errorf("set command or http, not both")
+	case check.HTTP != "" && !strings.HasPrefix(check.HTTP, "http://") && !strings.HasPrefix(check.HTTP, "https://"):
+		return fmt.Errorf("http must be an http:// or https:// URL")
+	}
+	_, _, err := Timeouts(check)
+	return err
+}
+
+// RunCommand runs a command probe, killing its process group at the
+// timeout. The last line of its output becomes the message.
+func RunCommand(cmd *exec.Cmd, timeout, slow time.Duration) Result {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = sysproc.Group()
+
+	started := time.Now()
+	if err := cmd.Start(); err != nil {
+		return Result{State: Unknown, Message: fmt.Sprintf("failed to start the check: %s", err)}
+	}
+	timer := time.AfterFunc(timeout, func() {
+		sysproc.KillGroup(cmd.Process.Pid)
+	})
+	err := cmd.Wait()
+	elapsed := time.Since(started)
+	timedOut := !timer.Stop()
+
+	message := lastLine(out.String())
+	if timedOut {
+		return Result{State: Critical, Message: fmt.Sprintf("timed out after %s", timeout), Elapsed: elapsed}
+	}
+	code := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		return Result{State: Unknown, Message: err.Error(), Elapsed: elapsed}
+	}
+	if message == "" {
+		message = fmt.Sprintf("check exited with status %d", code)
+	}
+
+	result := Result{Message: message, Elapsed: elapsed}
+	switch code {
+	case 0:
+		result.State = OK
+	case 1:
+		result.State = Warning
+	default:
+		result.State = Critical
+	}
+	return slowWarning(result, slow)
+}
+
+// RunHTTP runs an HTTP probe: a 2xx response passes
+func RunHTTP(url string, timeout, slow time.Duration) Result {
+	client := &http.Client{Timeout: timeout}
+	started := time.Now()
+	resp, err := client.Get(url)
+	elapsed := time.Since(started)
+	if err != nil {
+		return Result{State: Critical, Message: err.Error(), Elapsed: elapsed}
+	}
+	resp.Body.Close()
+
+	result := Result{
+		State:   OK,
+		Message: fmt.Sprintf("HTTP %d from %s in %s", resp.StatusCode, url, elapsed.Round(time.Millisecond)),
+		Elapsed: elapsed,
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		result.State = Critical
+	}
+	return slowWarning(result, slow)
+}
+
+// slowWarning turns a passing result that took longer than slow into a
+// warning
+func slowWarning(result Result, slow time.Duration) Result {
+	if result.State == OK && slow > 0 && result.Elapsed > slow {
+		result.State = Warning
+		result.Message += fmt.Sprintf(" (slower than %s)", slow)
+	}
+	return result
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
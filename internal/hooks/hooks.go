@@ -0,0 +1,63 @@
+// Package hooks runs the pre_build, post_build, pre_run and post_run
+// commands of config.yaml: directly for builds and 'sbox run', and as a
+// wrapper script around the command of daemons.
+package hooks
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/console"
+	"github.com/sbox-project/sbox/internal/sysproc"
+)
+
+// Run runs the hooks of a stage one after another with sh -c (PowerShell
+// on Windows), stopping at the first that fails. wrap is prepended to
+// each command line, e.g. an isolation launcher.
+func Run(stage string, commands []string, dir string, env []string, wrap []string) error {
+	for _, command := range commands {
+		console.Info("Running %s hook: %s", stage, command)
+
+		argv := append(append([]string{}, wrap...), sysproc.Shell(command)...)
+		cmd := exec.Command(argv[0], argv[1:]...)
+		cmd.Dir = dir
+		cmd.Env = env
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook failed: %s: %w", stage, command, err)
+		}
+	}
+	return nil
+}
+
+// Script returns a shell script running command between the pre and
+// post hooks, for daemons whose command line is a single 'sh -c'. A
+// failing pre hook exits with its status without starting command; post
+// hooks run after command exits on its own, and the script exits with
+// the status of command.
+func Script(command string, pre, post []string, preStage, postStage string) string {
+	var b strings.Builder
+	for _, hook := range pre {
+		fmt.Fprintf(&b, "echo %s\n", shellQuote(fmt.Sprintf("sbox: running %s hook: %s", preStage, hook)))
+		fmt.Fprintf(&b, "sh -c %s || { status=$?; echo %s >&2; exit $status; }\n",
+			shellQuote(hook), shellQuote(fmt.Sprintf("sbox: %s hook failed: %s", preStage, hook)))
+	}
+	fmt.Fprintf(&b, "sh -c %s\n", shellQuote(command))
+	b.WriteString("status=$?\n")
+	for _, hook := range post {
+		fmt.Fprintf(&b, "echo %s\n", shellQuote(fmt.Sprintf("sbox: running %s hook: %s", postStage, hook)))
+		fmt.Fprintf(&b, "sh -c %s || echo %s >&2\n",
+			shellQuote(hook), shellQuote(fmt.Sprintf("sbox: %s hook failed: %s", postStage, hook)))
+	}
+	b.WriteString("exit $status\n")
+	return b.String()
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
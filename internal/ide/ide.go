@@ -0,0 +1,263 @@
+// Package ide exports where a project's interpreter lives for editors:
+// .sbox/ide.json after every build, and on request the VS Code and
+// PyCharm project settings that point at it, so autocomplete and
+// debuggers use the sandbox instead of whatever is on the host.
+package ide
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// File is written into .sbox by every build
+const File = "ide.json"
+
+// tools are the executables of env/bin listed in ide.json when present
+var tools = []string{
+	"python", "pip", "node", "npm", "pnpm", "npx", "go", "gopls", "java",
+	"ruby", "bundle", "cargo", "rustc",
+}
+
+// Metadata is the content of ide.json
+type Metadata struct {
+	Project string `json:"project"`
+	Runtime string `json:"runtime"`
+	// Interpreter is the runtime's executable, e.g. env/bin/python
+	Interpreter string `json:"interpreter"`
+	// Binaries are the tools found in env/bin, by name
+	Binaries map[string]string `json:"binaries"`
+	EnvDir   string            `json:"env_dir"`
+	// PathPrepend goes before the editor's own PATH
+	PathPrepend []string `json:"path_prepend"`
+	// Env is what a process in the sandbox gets besides PATH; values of
+	// variables that look like secrets are left out
+	Env map[string]string `json:"env"`
+}
+
+// New describes the built environment of a project
+func New(projectRoot string, cfg *config.Config) *Metadata {
+	envDir := config.GetEnvDir(projectRoot)
+	m := &Metadata{
+		Project:     projectRoot,
+		Runtime:     cfg.Runtime,
+		Binaries:    make(map[string]string),
+		EnvDir:      envDir,
+		PathPrepend: config.EnvBinDirs(envDir),
+		Env: map[string]string{
+			"SBOX_ACTIVE":                   "1",
+			"SBOX_PROJECT":                  projectRoot,
+			"CONDA_PREFIX":                  envDir,
+			"PYTHONNOUSERSITE":              "1",
+			"PIP_DISABLE_PIP_VERSION_CHECK": "1",
+		},
+	}
+	if spec, ok := config.LookupRuntime(cfg.ParseRuntime().Language); ok {
+		m.Interpreter = spec.BinaryPath(envDir)
+	}
+	for _, tool := range tools {
+		path := config.EnvExe(envDir, tool)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			m.Binaries[tool] = path
+		}
+	}
+	for name, port := range cfg.Ports {
+		m.Env[config.PortEnvName(name)] = fmt.Sprint(port)
+	}
+	for key, value := range cfg.Env {
+		if !config.IsSensitiveEnv(key) {
+			m.Env[key] = value
+		}
+	}
+	return m
+}
+
+// Path returns the path to .sbox/ide.json
+func Path(projectRoot string) string {
+	return filepath.Join(config.GetSboxDir(projectRoot), File)
+}
+
+// Write writes ide.json for the built environment of a project
+func Write(projectRoot string, cfg *config.Config) error {
+	data, err := json.MarshalIndent(New(projectRoot, cfg), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(Path(projectRoot), append(data, '\n'))
+}
+
+// Load reads ide.json
+func Load(projectRoot string) (*Metadata, error) {
+	data, err := os.ReadFile(Path(projectRoot))
+	if err != nil {
+		return nil, err
+	}
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", File, err)
+	}
+	return &m, nil
+}
+
+// Relocate rewrites the paths of a project's ide.json that start with
+// from to start with to instead, for 'sbox unpack'. A project without
+// ide.json is left as is.
+func Relocate(projectRoot, from, to string) error {
+	if from == "" || from == to {
+		return nil
+	}
+	m, err := Load(projectRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	move := func(path string) string {
+		if rest, ok := strings.CutPrefix(path, from); ok && (rest == "" || strings.HasPrefix(rest, string(filepath.Separator))) {
+			return to + rest
+		}
+		return path
+	}
+	m.Project = move(m.Project)
+	m.Interpreter = move(m.Interpreter)
+	m.EnvDir = move(m.EnvDir)
+	for i, dir := range m.PathPrepend {
+		m.PathPrepend[i] = move(dir)
+	}
+	for name, path := range m.Binaries {
+		m.Binaries[name] = move(path)
+	}
+	for key, value := range m.Env {
+		m.Env[key] = move(value)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(Path(projectRoot), append(data, '\n'))
+}
+
+// language is the runtime's language, as in config.RuntimeSpec.Name
+func (m *Metadata) language() string {
+	language := strings.ToLower(strings.SplitN(m.Runtime, ":", 2)[0])
+	if spec, ok := config.LookupRuntime(language); ok {
+		return spec.Name
+	}
+	return language
+}
+
+// vscodeSettings returns the settings.json entries for the environment
+func (m *Metadata) vscodeSettings() map[string]interface{} {
+	path := strings.Join(m.PathPrepend, string(os.PathListSeparator)) + string(os.PathListSeparator) + "${env:PATH}"
+	env := map[string]string{"PATH": path}
+	for key, value := range m.Env {
+		env[key] = value
+	}
+	settings := map[string]interface{}{
+		"terminal.integrated.env.linux":   env,
+		"terminal.integrated.env.osx":     env,
+		"terminal.integrated.env.windows": env,
+	}
+	switch m.language() {
+	case "python":
+		settings["python.defaultInterpreterPath"] = m.Interpreter
+		settings["python.terminal.activateEnvironment"] = false
+	case "node":
+		settings["debug.javascript.defaultRuntimeExecutable"] = map[string]string{"pwa-node": m.Interpreter}
+	case "go":
+		settings["go.alternateTools"] = map[string]string{"go": m.Interpreter}
+		settings["go.toolsEnvVars"] = env
+	case "ruby":
+		settings["rubyLsp.rubyExecutablePath"] = m.Interpreter
+	case "rust":
+		settings["rust-analyzer.server.extraEnv"] = env
+	}
+	return settings
+}
+
+// WriteVSCode merges the environment's settings into
+// .vscode/settings.json, keeping every other setting
+func (m *Metadata) WriteVSCode(projectRoot string) (string, error) {
+	path := filepath.Join(projectRoot, ".vscode", "settings.json")
+	settings := make(map[string]interface{})
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return path, fmt.Errorf("%s is not plain JSON (comments or trailing commas?): %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return path, err
+	}
+	for key, value := range m.vscodeSettings() {
+		settings[key] = value
+	}
+	data, err := json.MarshalIndent(settings, "", "    ")
+	if err != nil {
+		return path, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return path, err
+	}
+	return path, writeFile(path, append(data, '\n'))
+}
+
+// SDKName is the name of the interpreter PyCharm knows the environment by
+func (m *Metadata) SDKName() string {
+	return "sbox (" + filepath.Base(m.Project) + ")"
+}
+
+var rootManager = regexp.MustCompile(`(?s)\s*<component name="ProjectRootManager"[^>]*?(/>|>.*?</component>)`)
+
+// WritePyCharm points .idea/misc.xml at the interpreter named SDKName.
+// PyCharm keeps interpreters in the IDE's own configuration, so it must
+// be added there once under that name.
+func (m *Metadata) WritePyCharm(projectRoot string) (string, error) {
+	if m.language() != "python" {
+		return "", fmt.Errorf("PyCharm settings need a python runtime, not %s", m.Runtime)
+	}
+	path := filepath.Join(projectRoot, ".idea", "misc.xml")
+	component := fmt.Sprintf("\n  <component name=\"ProjectRootManager\" version=\"2\" project-jdk-name=\"%s\" project-jdk-type=\"Python SDK\" />", m.SDKName())
+
+	content := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<project version=\"4\">\n</project>\n"
+	if data, err := os.ReadFile(path); err == nil {
+		content = string(data)
+	} else if !os.IsNotExist(err) {
+		return path, err
+	}
+	content = rootManager.ReplaceAllString(content, "")
+	end := strings.LastIndex(content, "</project>")
+	if end < 0 {
+		return path, fmt.Errorf("%s has no <project> element", path)
+	}
+	content = strings.TrimRight(content[:end], "\n") + component + "\n" + content[end:]
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return path, err
+	}
+	return path, writeFile(path, []byte(content))
+}
+
+// writeFile replaces a file atomically
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,79 @@
+package inspect
+
+import (
+	"fmt"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// Health levels, from best to worst
+const (
+	Healthy   = "healthy"
+	Degraded  = "degraded"
+	Unhealthy = "unhealthy"
+)
+
+// Health is the overall state of a project for 'sbox status --check'
+type Health struct {
+	Status string `json:"status"`
+	// Problems say what made the project degraded or unhealthy
+	Problems []string `json:"problems,omitempty"`
+}
+
+// ExitCode returns the exit code of a health level: 0 when healthy, 1
+// when degraded and 2 when unhealthy, as monitoring plugins do. 3 is left
+// for when the state cannot be read.
+func (h Health) ExitCode() int {
+	switch h.Status {
+	case Healthy:
+		return 0
+	case Degraded:
+		return 1
+	}
+	return 2
+}
+
+func (h *Health) add(status, format string, args ...interface{}) {
+	if status == Unhealthy || h.Status == Healthy {
+		h.Status = status
+	}
+	h.Problems = append(h.Problems, fmt.Sprintf(format, args...))
+}
+
+// CheckHealth rolls the build, mounts and tracked processes of a project
+// up into one level. A sandbox that is not built, built for another
+// platform, or whose services crashed is unhealthy; one whose config
+// changed since the build, whose mounts are missing or whose services are
+// being restarted is degraded. Processes stopped with 'sbox stop' are not
+// a problem.
+func CheckHealth(root string, cfg *config.Config, processes []Process) Health {
+	health := Health{Status: Healthy}
+
+	build := buildState(root, cfg)
+	switch {
+	case !build.Built:
+		health.add(Unhealthy, "not built")
+	case build.PlatformError != "":
+		health.add(Unhealthy, "%s", build.PlatformError)
+	case !build.UpToDate:
+		health.add(Degraded, "config changed since the last build")
+	}
+
+	for _, m := range mounts(root, cfg) {
+		if !m.SourceExists {
+			health.add(Degraded, "mount source %s does not exist", m.Source)
+		}
+	}
+
+	for _, p := range processes {
+		switch p.Status {
+		case "crashed":
+			health.add(Unhealthy, "%s crashed", p.Name)
+		case "oom-killed":
+			health.add(Unhealthy, "%s was killed for running out of memory", p.Name)
+		case "restarting":
+			health.add(Degraded, "%s is restarting (%d restarts)", p.Name, p.Restarts)
+		}
+	}
+	return health
+}
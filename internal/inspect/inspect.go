@@ -0,0 +1,372 @@
+// Package inspect describes a project or one of its daemons as a single
+// document for 'sbox inspect', and gathers the process state that
+// 'sbox status' and 'sbox ps' print.
+package inspect
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/sbox-project/sbox/internal/cache"
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/process"
+	"github.com/sbox-project/sbox/internal/runner"
+)
+
+// Masked replaces the values of env vars that look like secrets
+const Masked = "********"
+
+// Options select what goes into a document
+type Options struct {
+	// ShowSecrets keeps the values of env vars that look like secrets
+	// and of secrets: entries
+	ShowSecrets bool
+
+	// secrets are the names of the project's secrets: entries
+	secrets map[string]bool
+}
+
+// withSecrets returns opts masking the secrets: entries of cfg too
+func withSecrets(opts Options, cfg *config.Config) Options {
+	opts.secrets = make(map[string]bool, len(cfg.Secrets))
+	for _, name := range cfg.Secrets {
+		opts.secrets[name] = true
+	}
+	return opts
+}
+
+// Project is the full description of a project
+type Project struct {
+	Name    string `json:"name"`
+	Root    string `json:"root"`
+	SboxDir string `json:"sbox_dir"`
+	// Config is config.yaml with ${VAR} references resolved, keyed as
+	// in the file
+	Config    map[string]interface{} `json:"config"`
+	Build     Build                  `json:"build"`
+	Runtime   Runtime                `json:"runtime"`
+	Env       map[string]string      `json:"env"`
+	Mounts    []Mount                `json:"mounts"`
+	Processes []Process              `json:"processes"`
+	Logs      []Log                  `json:"logs"`
+	Health    Health                 `json:"health"`
+}
+
+// Build is the build state of a project
+type Build struct {
+	Built    bool `json:"built"`
+	UpToDate bool `json:"up_to_date"`
+	// PlatformError is set when the sandbox was built for another host
+	PlatformError string           `json:"platform_error,omitempty"`
+	Lock          *config.LockData `json:"lock,omitempty"`
+}
+
+// Runtime describes the project's runtime environment
+type Runtime struct {
+	Language string `json:"language"`
+	Version  string `json:"version"`
+	EnvDir   string `json:"env_dir"`
+	Rootfs   string `json:"rootfs"`
+	// Workdir is the directory commands run in
+	Workdir string `json:"workdir"`
+	// Cache is set when the runtime was provisioned from the global cache
+	Cache *CacheProvenance `json:"cache,omitempty"`
+}
+
+// CacheProvenance is the cached runtime an environment was provisioned from
+type CacheProvenance struct {
+	Key       string    `json:"key"`
+	Path      string    `json:"path"`
+	Platform  string    `json:"platform,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Present reports whether the cache still holds the runtime
+	Present bool `json:"present"`
+}
+
+// Mount is a mount: entry resolved against the project
+type Mount struct {
+	// Source is the host path, Destination the path in the sandbox and
+	// Path the link the build created for it in the rootfs
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Path        string `json:"path"`
+	ReadOnly    bool   `json:"read_only"`
+	// SourceExists and Linked report whether the host path exists and
+	// the link is in place
+	SourceExists bool `json:"source_exists"`
+	Linked       bool `json:"linked"`
+}
+
+// Process is a tracked process with its log and usage
+type Process struct {
+	process.ProcessInfo
+	Uptime string `json:"uptime,omitempty"`
+	// LogFiles are the files of its log, rotated ones first
+	LogFiles []string       `json:"log_files,omitempty"`
+	LogSize  int64          `json:"log_size"`
+	Usage    *process.Usage `json:"usage,omitempty"`
+}
+
+// Daemon is the full description of one tracked process
+type Daemon struct {
+	Process
+	// Env is the environment of the running process, or the one it gets
+	// from the configuration when that cannot be read (EnvSource
+	// "process" or "config")
+	Env       map[string]string `json:"env"`
+	EnvSource string            `json:"env_source"`
+}
+
+// Log is a log file in the project's log directory
+type Log struct {
+	Name  string   `json:"name"`
+	Path  string   `json:"path"`
+	Size  int64    `json:"size"`
+	Files []string `json:"files"`
+}
+
+// InspectProject describes the project at root
+func InspectProject(root string, opts Options) (*Project, error) {
+	cfg, err := config.Load(root)
+	if err != nil {
+		return nil, err
+	}
+	r, err := runner.New(root)
+	if err != nil {
+		return nil, err
+	}
+	pm := process.NewProcessManager(root)
+	opts = withSecrets(opts, cfg)
+
+	doc := &Project{
+		Name:    filepath.Base(root),
+		Root:    root,
+		SboxDir: config.GetSboxDir(root),
+		Config:  configMap(cfg, opts),
+		Build:   buildState(root, cfg),
+		Runtime: runtimeState(r),
+		Env:     envMap(r.BuildEnv(), opts),
+		Mounts:  mounts(root, cfg),
+	}
+
+	if doc.Processes, err = Processes(pm, true); err != nil {
+		return nil, err
+	}
+	if doc.Logs, err = Logs(pm); err != nil {
+		return nil, err
+	}
+	doc.Health = CheckHealth(root, cfg, doc.Processes)
+	return doc, nil
+}
+
+// InspectProcess describes the tracked process name of the project at
+// root
+func InspectProcess(root, name string, opts Options) (*Daemon, error) {
+	pm := process.NewProcessManager(root)
+	if _, err := pm.UpdateProcessStatus(); err != nil {
+		return nil, err
+	}
+	info, err := pm.GetProcess(name)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &Daemon{Process: describe(pm, *info)}
+	if cfg, err := config.Load(root); err == nil {
+		opts = withSecrets(opts, cfg)
+	}
+	if doc.IsAlive() {
+		if env, err := processEnv(info.PID); err == nil {
+			doc.Env, doc.EnvSource = envMap(env, opts), "process"
+			return doc, nil
+		}
+	}
+
+	// Rebuild the environment the way daemons get it
+	r, err := runner.New(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range info.EnvFiles {
+		if err := r.LoadEnvFile(path); err != nil {
+			return nil, err
+		}
+	}
+	r.ServiceName = name
+	doc.Env, doc.EnvSource = envMap(r.BuildEnv(), opts), "config"
+	return doc, nil
+}
+
+// Processes returns the tracked processes of pm with their logs and
+// usage, refreshing their status first. Only live processes are
+// returned unless all is set, as GetRunningProcesses does.
+func Processes(pm *process.ProcessManager, all bool) ([]Process, error) {
+	infos, err := pm.UpdateProcessStatus()
+	if err != nil {
+		return nil, err
+	}
+	processes := []Process{}
+	for _, info := range infos {
+		p := describe(pm, info)
+		if all || p.IsAlive() {
+			processes = append(processes, p)
+		}
+	}
+	return processes, nil
+}
+
+// describe adds the log and usage of a process to its entry
+func describe(pm *process.ProcessManager, info process.ProcessInfo) Process {
+	p := Process{ProcessInfo: info, LogFiles: pm.LogFiles(info.Name)}
+	p.LogSize, _ = pm.GetLogSize(info.Name)
+	if info.Status == "running" || info.Status == "paused" {
+		p.Uptime = process.FormatDuration(time.Since(info.StartTime))
+		if info.SlurmJob == "" {
+			p.Usage, _ = info.Usage()
+		}
+	}
+	return p
+}
+
+// Logs returns the logs in the log directory of pm
+func Logs(pm *process.ProcessManager) ([]Log, error) {
+	names, err := pm.ListLogs()
+	if err != nil {
+		return nil, err
+	}
+	logs := []Log{}
+	for _, name := range names {
+		log := Log{Name: name, Path: pm.GetLogFile(name), Files: pm.LogFiles(name)}
+		log.Size, _ = pm.GetLogSize(name)
+		logs = append(logs, log)
+	}
+	return logs, nil
+}
+
+func buildState(root string, cfg *config.Config) Build {
+	build := Build{
+		Built:    config.IsBuilt(root),
+		UpToDate: config.IsUpToDate(root, cfg),
+	}
+	if build.Built {
+		if err := config.CheckPlatform(root); err != nil {
+			build.PlatformError = err.Error()
+		}
+	}
+	if lock, err := config.LoadLock(root); err == nil {
+		build.Lock = lock
+	}
+	return build
+}
+
+func runtimeState(r *runner.Runner) Runtime {
+	info := r.Config.ParseRuntime()
+	state := Runtime{
+		Language: info.Language,
+		Version:  info.Version,
+		EnvDir:   r.EnvDir,
+		Rootfs:   r.Rootfs,
+		Workdir:  r.ResolveWorkdir(),
+	}
+	if meta := cache.ProvisionedFrom(r.EnvDir); meta != nil {
+		state.Cache = &CacheProvenance{
+			Key:       cache.GetRuntimeKey(meta.Language, meta.Version),
+			Path:      meta.Path,
+			Platform:  meta.Platform,
+			CreatedAt: meta.CreatedAt,
+		}
+		if _, err := os.Stat(meta.Path); err == nil {
+			state.Cache.Present = true
+		}
+	}
+	return state
+}
+
+// mounts resolves mount: entries as the build does
+func mounts(root string, cfg *config.Config) []Mount {
+	rootfs := config.GetRootfsDir(root)
+	list := []Mount{}
+	for _, spec := range cfg.ParseMount() {
+		m := Mount{
+			Source:      spec.Src,
+			Destination: spec.Dst,
+			Path:        filepath.Join(rootfs, strings.TrimPrefix(spec.Dst, "/")),
+			ReadOnly:    spec.ReadOnly,
+		}
+		if !filepath.IsAbs(m.Source) {
+			m.Source = filepath.Join(root, m.Source)
+		}
+		if _, err := os.Stat(m.Source); err == nil {
+			m.SourceExists = true
+		}
+		if target, err := os.Readlink(m.Path); err == nil && target == m.Source {
+			m.Linked = true
+		}
+		list = append(list, m)
+	}
+	return list
+}
+
+// configMap returns the configuration keyed as in config.yaml
+func configMap(cfg *config.Config, opts Options) map[string]interface{} {
+	masked := *cfg
+	masked.Env = make(map[string]string, len(cfg.Env))
+	for key, value := range cfg.Env {
+		masked.Env[key] = maskValue(key, value, opts)
+	}
+
+	data, err := yaml.Marshal(&masked)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	return m
+}
+
+// envMap turns KEY=VALUE entries into a map; later entries win, as they
+// do for exec
+func envMap(env []string, opts Options) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, entry := range env {
+		key, value, ok := strings.Cut(entry, "=")
+		if ok {
+			m[key] = maskValue(key, value, opts)
+		}
+	}
+	return m
+}
+
+func maskValue(key, value string, opts Options) string {
+	if !opts.ShowSecrets && value != "" && (config.IsSensitiveEnv(key) || opts.secrets[key]) {
+		return Masked
+	}
+	return value
+}
+
+// processEnv reads the environment of a running process from /proc
+func processEnv(pid int) ([]string, error) {
+	if pid <= 0 {
+		return nil, fmt.Errorf("no local process")
+	}
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return nil, err
+	}
+	var env []string
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		if len(entry) > 0 {
+			env = append(env, string(entry))
+		}
+	}
+	return env, nil
+}
@@ -0,0 +1,322 @@
+// Package leakcheck traces a command started in the sandbox and reports
+// the host files it opened or executed: host site-packages, system
+// libraries and tools the environment does not provide. Such leaks make
+// a sandbox work on the machine it was built on and fail elsewhere.
+package leakcheck
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/sysproc"
+)
+
+// Tracing methods
+const (
+	// MethodStrace records every file opened or executed
+	MethodStrace = "strace"
+	// MethodLite needs no tracer: the dynamic loader's LD_DEBUG output
+	// lists shared libraries, and PYTHONVERBOSE lists Python imports
+	MethodLite = "LD_DEBUG"
+)
+
+// Categories of host files, in the order they are reported
+const (
+	HostPython  = "host Python packages"
+	HostNode    = "host Node.js modules"
+	HostLibrary = "host shared libraries"
+	UserFiles   = "files in the host home directory"
+	HostProgram = "host programs"
+	OtherHost   = "other host files"
+)
+
+// Categories lists the categories in report order
+var Categories = []string{HostPython, HostNode, HostLibrary, UserFiles, HostProgram, OtherHost}
+
+// Leak reports whether files of a category are a dependency the target
+// host may not satisfy; the others are worth a look but often harmless
+func Leak(category string) bool {
+	return category != HostProgram && category != OtherHost
+}
+
+// Access is a file a traced command opened or executed
+type Access struct {
+	Path string
+	Exec bool
+}
+
+// Result is the outcome of a traced run
+type Result struct {
+	Method   string
+	Accesses []Access
+	// TimedOut means the command was still running at the time limit
+	// and was stopped, as expected for servers
+	TimedOut bool
+	ExitCode int
+}
+
+// Options configure a traced run
+type Options struct {
+	Dir     string
+	Env     []string
+	Timeout time.Duration
+	// Python adds PYTHONVERBOSE to the lite method
+	Python bool
+	// Lite skips strace even when it is installed
+	Lite bool
+}
+
+var (
+	// straceCall matches a successful open or exec in strace output
+	straceCall = regexp.MustCompile(`^(open|openat|openat2|execve|execveat)\((?:AT_FDCWD, |\d+, )?"((?:[^"\\]|\\.)*)".*\)\s+=\s+(-?\d+)`)
+	// ldDebugInit matches the loader's "calling init: /path/lib.so"
+	ldDebugInit = regexp.MustCompile(`calling init: (/\S+)`)
+	// pythonPath matches the paths in PYTHONVERBOSE's "# ..." lines
+	pythonPath = regexp.MustCompile(`(/[^\s']+)`)
+	// pythonVerbose are the prefixes of PYTHONVERBOSE's output, including
+	// site.py's startup messages and the version banner
+	pythonVerbose = []string{"# ", "import ", "Processing ", "Adding directory", "Python ", `Type "help"`}
+)
+
+// Run runs command with sh -c under the tracer and collects the files it
+// touched. Output of the command is passed through. With MethodStrace,
+// ptrace must be permitted; callers can retry with Options.Lite.
+func Run(command string, opts Options) (*Result, error) {
+	traceDir, err := os.MkdirTemp("", "sbox-trace-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(traceDir)
+
+	method := MethodLite
+	var argv []string
+	env := append([]string{}, opts.Env...)
+	if path, err := exec.LookPath("strace"); err == nil && !opts.Lite {
+		method = MethodStrace
+		// -ff writes one file per process, so calls are never split
+		// into "unfinished" and "resumed" halves
+		argv = []string{path, "-f", "-ff", "-qq", "-s", "4096",
+			"-e", "trace=open,openat,openat2,execve,execveat",
+			"-o", filepath.Join(traceDir, "trace"), "sh", "-c", command}
+	} else {
+		argv = sysproc.Shell(command)
+		env = append(env, "LD_DEBUG=libs", "LD_DEBUG_OUTPUT="+filepath.Join(traceDir, "ld"))
+		if opts.Python {
+			env = append(env, "PYTHONVERBOSE=1")
+		}
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = opts.Dir
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	// The whole tree is stopped at the time limit
+	cmd.SysProcAttr = sysproc.Group()
+
+	var pythonLines []string
+	var stderr io.ReadCloser
+	if method == MethodLite && opts.Python {
+		if stderr, err = cmd.StderrPipe(); err != nil {
+			return nil, err
+		}
+	} else {
+		cmd.Stderr = os.Stderr
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", argv[0], err)
+	}
+
+	result := &Result{Method: method}
+	timer := time.AfterFunc(opts.Timeout, func() {
+		sysproc.KillGroup(cmd.Process.Pid)
+	})
+
+	if stderr != nil {
+		// Keep the verbose import lines, pass the rest on
+		scanner := bufio.NewScanner(stderr)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if isPythonVerbose(line) {
+				pythonLines = append(pythonLines, line)
+				continue
+			}
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}
+
+	err = cmd.Wait()
+	// A timer that already fired stopped the command
+	result.TimedOut = !timer.Stop()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[Access]bool)
+	add := func(a Access) {
+		if !seen[a] {
+			seen[a] = true
+			result.Accesses = append(result.Accesses, a)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(traceDir, "*"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if method == MethodStrace {
+				if a, ok := parseStraceLine(line); ok {
+					add(a)
+				}
+			} else if m := ldDebugInit.FindStringSubmatch(line); m != nil {
+				add(Access{Path: filepath.Clean(m[1])})
+			}
+		}
+	}
+	if method == MethodStrace && len(files) == 0 && result.ExitCode != 0 {
+		return nil, fmt.Errorf("strace recorded nothing (exit status %d); ptrace may not be permitted here", result.ExitCode)
+	}
+	for _, line := range pythonLines {
+		if !strings.HasPrefix(line, "# ") && !strings.HasPrefix(line, "Processing .pth file") {
+			continue
+		}
+		for _, m := range pythonPath.FindAllString(line, -1) {
+			add(Access{Path: filepath.Clean(m)})
+		}
+	}
+	return result, nil
+}
+
+func isPythonVerbose(line string) bool {
+	for _, prefix := range pythonVerbose {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStraceLine extracts the file of a successful open or exec
+func parseStraceLine(line string) (Access, bool) {
+	m := straceCall.FindStringSubmatch(line)
+	if m == nil || strings.HasPrefix(m[3], "-") {
+		return Access{}, false
+	}
+	path := strings.ReplaceAll(m[2], `\"`, `"`)
+	// Relative paths resolve against the workdir, inside the sandbox
+	if !filepath.IsAbs(path) {
+		return Access{}, false
+	}
+	return Access{Path: filepath.Clean(path), Exec: strings.HasPrefix(m[1], "exec")}, true
+}
+
+// Finding is a host file a command depended on
+type Finding struct {
+	Path     string
+	Category string
+}
+
+var (
+	// systemPrefixes hold files every environment reads from the host:
+	// kernel interfaces, /etc configuration, time zones and locales
+	systemPrefixes = []string{"/proc", "/sys", "/dev", "/tmp", "/var/tmp", "/run", "/etc",
+		"/usr/share/zoneinfo", "/usr/share/locale", "/usr/lib/locale", "/usr/share/i18n"}
+	// glibcLibrary matches the libraries of glibc and its loader, which
+	// conda packages take from the host
+	glibcLibrary = regexp.MustCompile(`^(ld-linux[^/]*|ld64\.so[^/]*|lib(c|m|dl|pthread|rt|resolv|util|crypt|mvec|anl|nsl|BrokenLocale|thread_db|nss_[a-z0-9]+)([-.][^/]*)?\.so[^/]*)$`)
+	hostPython   = regexp.MustCompile(`/(site-packages|dist-packages)(/|$)|^/usr(/local)?/lib(64)?/python[0-9]`)
+	// sbox runs every command through sh -c
+	sboxShells = map[string]bool{"/bin/sh": true, "/usr/bin/sh": true}
+)
+
+// Classify sorts the host files among accesses into categories. Files
+// under allowed (the project, declared mounts and host_libs) are part of
+// the sandbox, and the system files every environment relies on are
+// skipped. home is the host home directory.
+func Classify(accesses []Access, allowed []string, home string) []Finding {
+	var findings []Finding
+	for _, a := range accesses {
+		path := a.Path
+		if under(path, allowed...) || under(path, systemPrefixes...) || sboxShells[path] {
+			continue
+		}
+		if strings.Contains(path, "/gconv/") || glibcLibrary.MatchString(filepath.Base(path)) {
+			continue
+		}
+
+		var category string
+		switch {
+		case hostPython.MatchString(path):
+			category = HostPython
+		case strings.Contains(path, "/node_modules/"):
+			category = HostNode
+		case a.Exec:
+			category = HostProgram
+		case home != "" && under(path, home):
+			category = UserFiles
+		case strings.Contains(filepath.Base(path), ".so"):
+			category = HostLibrary
+		default:
+			category = OtherHost
+		}
+		findings = append(findings, Finding{Path: path, Category: category})
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Path < findings[j].Path })
+	return findings
+}
+
+// under reports whether path is one of dirs or inside one
+func under(path string, dirs ...string) bool {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		dir = filepath.Clean(dir)
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Group collects findings by category
+func Group(findings []Finding) map[string][]string {
+	groups := make(map[string][]string)
+	for _, f := range findings {
+		groups[f.Category] = append(groups[f.Category], f.Path)
+	}
+	return groups
+}
+
+// Hint suggests how to remove the files of a category from the host
+// dependencies
+func Hint(category string) string {
+	switch category {
+	case HostPython:
+		return "Install these packages in the environment (install: or conda-forge) and check PYTHONPATH in env"
+	case HostNode:
+		return "Install these modules in the environment and check NODE_PATH in env"
+	case HostLibrary:
+		return "Install the libraries from conda-forge, or declare their directory in host_libs if the target host provides them"
+	case UserFiles:
+		return "Packages under ~/.local or configuration in the host home will not exist on the target; move them into the sandbox"
+	case HostProgram:
+		return "Install the tools in the environment if the target host may not have them"
+	}
+	return ""
+}
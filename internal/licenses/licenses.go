@@ -0,0 +1,353 @@
+// Package licenses collects the licenses of the packages installed in a
+// sandbox from their metadata (conda-meta records, pip dist-info METADATA
+// and npm package.json files) and checks them against the license policy
+// of config.yaml.
+package licenses
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// Package managers, in report order
+const (
+	Conda = "conda"
+	Pip   = "pip"
+	Npm   = "npm"
+)
+
+var managerOrder = map[string]int{Conda: 0, Pip: 1, Npm: 2}
+
+// Statuses of a package under a policy
+const (
+	Allowed    = "allowed"
+	Denied     = "denied"
+	NotAllowed = "not allowed"
+	Unknown    = "unknown"
+)
+
+// Package is an installed package and its declared license
+type Package struct {
+	Manager string `json:"manager"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	License string `json:"license"`
+	Status  string `json:"status"`
+}
+
+// Collect lists the packages of a project's build: conda packages and
+// pip distributions of the environment, and npm packages in the
+// environment's global node_modules and every node_modules of the rootfs
+func Collect(projectRoot string) ([]Package, error) {
+	envDir := config.GetEnvDir(projectRoot)
+
+	packages, err := condaPackages(envDir)
+	if err != nil {
+		return nil, err
+	}
+	packages = append(packages, pipPackages(envDir)...)
+
+	seen := make(map[string]bool)
+	for _, root := range []string{filepath.Join(envDir, "lib", "node_modules"), config.GetRootfsDir(projectRoot)} {
+		for _, p := range npmPackages(root) {
+			key := p.Name + "@" + p.Version
+			if !seen[key] {
+				seen[key] = true
+				packages = append(packages, p)
+			}
+		}
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		a, b := packages[i], packages[j]
+		if a.Manager != b.Manager {
+			return managerOrder[a.Manager] < managerOrder[b.Manager]
+		}
+		if !strings.EqualFold(a.Name, b.Name) {
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+		return a.Version < b.Version
+	})
+	return packages, nil
+}
+
+// condaPackages reads the conda-meta records of an environment
+func condaPackages(envDir string) ([]Package, error) {
+	files, err := filepath.Glob(filepath.Join(envDir, "conda-meta", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var packages []Package
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var record struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			License string `json:"license"`
+		}
+		if json.Unmarshal(data, &record) != nil || record.Name == "" {
+			continue
+		}
+		packages = append(packages, Package{Manager: Conda, Name: record.Name, Version: record.Version, License: strings.TrimSpace(record.License)})
+	}
+	return packages, nil
+}
+
+// pipPackages reads the dist-info METADATA of the environment's Python.
+// Distributions conda installed are already listed from conda-meta.
+func pipPackages(envDir string) []Package {
+	dirs, _ := filepath.Glob(filepath.Join(envDir, "lib", "python*", "site-packages", "*.dist-info"))
+	var packages []Package
+	for _, dir := range dirs {
+		if installer, err := os.ReadFile(filepath.Join(dir, "INSTALLER")); err == nil && strings.TrimSpace(string(installer)) == "conda" {
+			continue
+		}
+		headers, err := readMetadata(filepath.Join(dir, "METADATA"))
+		if err != nil || len(headers["name"]) == 0 {
+			continue
+		}
+		version := ""
+		if v := headers["version"]; len(v) > 0 {
+			version = v[0]
+		}
+		packages = append(packages, Package{Manager: Pip, Name: headers["name"][0], Version: version, License: pipLicense(headers)})
+	}
+	return packages
+}
+
+// readMetadata parses the headers of a METADATA file. A header continued
+// on indented lines is recorded with a trailing newline.
+func readMetadata(file string) (map[string][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	headers := make(map[string][]string)
+	var last string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && last != "" {
+			values := headers[last]
+			values[len(values)-1] += "\n"
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		last = strings.ToLower(strings.TrimSpace(name))
+		headers[last] = append(headers[last], strings.TrimSpace(value))
+	}
+	return headers, scanner.Err()
+}
+
+// classifierLicenses maps trove classifiers to SPDX identifiers; others
+// are reported by their classifier name
+var classifierLicenses = map[string]string{
+	"MIT License":                                             "MIT",
+	"MIT No Attribution License (MIT-0)":                      "MIT-0",
+	"BSD License":                                             "BSD",
+	"Apache Software License":                                 "Apache",
+	"ISC License (ISCL)":                                      "ISC",
+	"Python Software Foundation License":                      "PSF-2.0",
+	"Mozilla Public License 2.0 (MPL 2.0)":                    "MPL-2.0",
+	"The Unlicense (Unlicense)":                               "Unlicense",
+	"GNU General Public License v2 (GPLv2)":                   "GPL-2.0",
+	"GNU General Public License v2 or later (GPLv2+)":         "GPL-2.0-or-later",
+	"GNU General Public License v3 (GPLv3)":                   "GPL-3.0",
+	"GNU General Public License v3 or later (GPLv3+)":         "GPL-3.0-or-later",
+	"GNU Lesser General Public License v2 (LGPLv2)":           "LGPL-2.0",
+	"GNU Lesser General Public License v2 or later (LGPLv2+)": "LGPL-2.0-or-later",
+	"GNU Lesser General Public License v3 (LGPLv3)":           "LGPL-3.0",
+	"GNU Lesser General Public License v3 or later (LGPLv3+)": "LGPL-3.0-or-later",
+	"GNU Affero General Public License v3":                    "AGPL-3.0",
+	"GNU Affero General Public License v3 or later (AGPLv3+)": "AGPL-3.0-or-later",
+	"Eclipse Public License 2.0 (EPL-2.0)":                    "EPL-2.0",
+}
+
+// pipLicense picks the license of a distribution: the SPDX expression of
+// newer metadata, a short License header, or the license classifiers.
+// License headers holding the full license text are not usable.
+func pipLicense(headers map[string][]string) string {
+	if v := headers["license-expression"]; len(v) > 0 && v[0] != "" {
+		return v[0]
+	}
+	if v := headers["license"]; len(v) > 0 {
+		license := v[0]
+		if license != "" && !strings.HasSuffix(license, "\n") && len(license) <= 64 && !strings.EqualFold(license, "UNKNOWN") {
+			return license
+		}
+	}
+	var names []string
+	for _, classifier := range headers["classifier"] {
+		name, ok := strings.CutPrefix(classifier, "License :: ")
+		if !ok {
+			continue
+		}
+		name = strings.TrimPrefix(name, "OSI Approved :: ")
+		if name == "OSI Approved" {
+			continue
+		}
+		if id, ok := classifierLicenses[name]; ok {
+			name = id
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, " OR ")
+}
+
+// npmPackages reads the package.json of every package in the node_modules
+// directories under root. Symlinks are not followed, so mounts and
+// pnpm's links are not walked twice.
+func npmPackages(root string) []Package {
+	var packages []Package
+	filepath.WalkDir(root, func(dir string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || d.Name() != "node_modules" {
+			return nil
+		}
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			if strings.HasPrefix(name, "@") {
+				scoped, _ := os.ReadDir(filepath.Join(dir, name))
+				for _, s := range scoped {
+					if p, ok := readPackageJSON(filepath.Join(dir, name, s.Name())); ok {
+						packages = append(packages, p)
+					}
+				}
+				continue
+			}
+			if p, ok := readPackageJSON(filepath.Join(dir, name)); ok {
+				packages = append(packages, p)
+			}
+		}
+		return nil
+	})
+	return packages
+}
+
+// readPackageJSON reads the name, version and license of an npm package.
+// license is an SPDX expression, or an object in old packages, which may
+// also list several under licenses.
+func readPackageJSON(dir string) (Package, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return Package{}, false
+	}
+	var manifest struct {
+		Name     string          `json:"name"`
+		Version  string          `json:"version"`
+		License  json.RawMessage `json:"license"`
+		Licenses []struct {
+			Type string `json:"type"`
+		} `json:"licenses"`
+	}
+	if json.Unmarshal(data, &manifest) != nil || manifest.Name == "" {
+		return Package{}, false
+	}
+
+	license := ""
+	var s string
+	var obj struct {
+		Type string `json:"type"`
+	}
+	switch {
+	case json.Unmarshal(manifest.License, &s) == nil:
+		license = s
+	case json.Unmarshal(manifest.License, &obj) == nil:
+		license = obj.Type
+	}
+	if license == "" {
+		var types []string
+		for _, l := range manifest.Licenses {
+			if l.Type != "" {
+				types = append(types, l.Type)
+			}
+		}
+		license = strings.Join(types, " OR ")
+	}
+	return Package{Manager: Npm, Name: manifest.Name, Version: manifest.Version, License: strings.TrimSpace(license)}, true
+}
+
+var (
+	orOperator  = regexp.MustCompile(`(?i)\s+OR\s+`)
+	andOperator = regexp.MustCompile(`(?i)\s+AND\s+`)
+)
+
+// Check sets the status of each package under policy and returns the
+// number that violate it. A license expression is accepted when one of
+// its OR alternatives has only accepted terms. Unknown licenses violate
+// a policy with an allow list, as they cannot be shown to be allowed.
+func Check(packages []Package, policy config.LicensePolicy) int {
+	violations := 0
+	for i := range packages {
+		p := &packages[i]
+		p.Status = status(p.License, policy)
+		if p.Status == Denied || p.Status == NotAllowed || p.Status == Unknown && len(policy.Allow) > 0 {
+			violations++
+		}
+	}
+	return violations
+}
+
+func status(license string, policy config.LicensePolicy) string {
+	expr := strings.NewReplacer("(", " ", ")", " ").Replace(license)
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return Unknown
+	}
+
+	result := Denied
+	for _, alternative := range orOperator.Split(expr, -1) {
+		verdict := Allowed
+		for _, term := range andOperator.Split(alternative, -1) {
+			term = strings.TrimSpace(term)
+			switch {
+			case matchesAny(term, policy.Deny):
+				verdict = Denied
+			case len(policy.Allow) > 0 && !matchesAny(term, policy.Allow) && verdict == Allowed:
+				verdict = NotAllowed
+			}
+		}
+		switch {
+		case verdict == Allowed:
+			return Allowed
+		case verdict == NotAllowed:
+			result = NotAllowed
+		}
+	}
+	return result
+}
+
+// matchesAny reports whether a license term matches one of patterns
+func matchesAny(term string, patterns []string) bool {
+	term = strings.ToLower(term)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(strings.TrimSpace(pattern)), term); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package lockfile
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	// errWouldBlock means another process holds the lock
+	errWouldBlock = syscall.EWOULDBLOCK
+	// errNoLock means the filesystem cannot lock; directory locks are
+	// used instead
+	errNoLock = syscall.ENOLCK
+)
+
+// lockFile takes an exclusive flock on f
+func lockFile(f *os.File, wait bool) error {
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	err := syscall.Flock(int(f.Fd()), how)
+	if err == syscall.EOPNOTSUPP {
+		return errNoLock
+	}
+	return err
+}
+
+func unlockFile(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,19 @@
+package lockfile
+
+import (
+	"errors"
+	"os"
+)
+
+var (
+	errWouldBlock = errors.New("lock held")
+	errNoLock     = errors.New("no flock on Windows")
+)
+
+// lockFile always fails with errNoLock: package syscall has no LockFileEx,
+// so Windows uses directory locks
+func lockFile(f *os.File, wait bool) error {
+	return errNoLock
+}
+
+func unlockFile(f *os.File) {}
@@ -0,0 +1,246 @@
+// Package lockfile provides advisory file locks (flock) used to serialize
+// sbox operations across processes and users.
+//
+// On network filesystems flock is unreliable: NFSv3 without lockd fails
+// with ENOLCK, and some servers silently grant every lock. There the lock
+// is a directory instead, since mkdir is atomic on NFS, kept fresh by a
+// heartbeat so a lock left behind by a crashed host can be broken. Windows
+// always uses directory locks.
+package lockfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/netfs"
+	"github.com/sbox-project/sbox/internal/sysproc"
+)
+
+const (
+	// pollInterval is how often a waiting directory lock is retried
+	pollInterval = 500 * time.Millisecond
+	// heartbeatInterval is how often a held directory lock is touched
+	heartbeatInterval = 30 * time.Second
+	// staleAfter is how long a directory lock may go without a heartbeat
+	// before another host may break it
+	staleAfter = 5 * time.Minute
+)
+
+// Lock is a held advisory lock
+type Lock struct {
+	path string
+	file *os.File
+	// dir is set for directory locks on network filesystems, owner to
+	// the holder written into it
+	dir   string
+	owner string
+	stop  chan struct{}
+}
+
+// ErrLocked is returned by TryAcquire when another process holds the lock
+type ErrLocked struct {
+	Path  string
+	Owner string
+}
+
+func (e *ErrLocked) Error() string {
+	if e.Owner != "" {
+		return fmt.Sprintf("%s is locked by %s", e.Path, e.Owner)
+	}
+	return fmt.Sprintf("%s is locked by another process", e.Path)
+}
+
+// Acquire blocks until the lock at path is held
+func Acquire(path string) (*Lock, error) {
+	return acquire(path, true)
+}
+
+// TryAcquire takes the lock at path without waiting, returning *ErrLocked
+// if it is held elsewhere
+func TryAcquire(path string) (*Lock, error) {
+	return acquire(path, false)
+}
+
+func acquire(path string, wait bool) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	if netfs.IsNetwork(path) {
+		return acquireDir(path, wait)
+	}
+
+	// 0666 lets teammates open the same lock file (subject to umask)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(f, wait); err != nil {
+		f.Close()
+		if err == errWouldBlock {
+			return nil, &ErrLocked{Path: path, Owner: Owner(path)}
+		}
+		if err == errNoLock {
+			return acquireDir(path, wait)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	// Record the holder for diagnostics
+	f.Truncate(0)
+	f.WriteAt([]byte(holder()), 0)
+
+	return &Lock{path: path, file: f}, nil
+}
+
+// acquireDir takes the lock by creating path.d
+func acquireDir(path string, wait bool) (*Lock, error) {
+	dir := path + ".d"
+	for {
+		err := os.Mkdir(dir, 0777)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if owner, stale := isStale(dir); stale {
+			breakStale(dir, owner)
+			continue
+		}
+		if !wait {
+			return nil, &ErrLocked{Path: path, Owner: Owner(path)}
+		}
+		time.Sleep(pollInterval)
+	}
+
+	h := holder()
+	owner := h
+	if err := os.WriteFile(filepath.Join(dir, "owner"), []byte(h), 0666); err != nil {
+		owner = ""
+	}
+	os.WriteFile(path, []byte(h), 0666)
+
+	lock := &Lock{path: path, dir: dir, owner: owner, stop: make(chan struct{})}
+	go lock.heartbeat()
+	return lock, nil
+}
+
+func (l *Lock) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			os.Chtimes(l.dir, now, now)
+		}
+	}
+}
+
+// isStale reports whether a directory lock was left behind: its holder
+// on this host is gone, or it has not been refreshed for staleAfter. It
+// also returns the owner it judged.
+func isStale(dir string) (string, bool) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", false
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "owner"))
+	owner := string(data)
+	host, pid := parseHolder(owner)
+	if hostname, _ := os.Hostname(); host != "" && host == hostname && pid > 0 {
+		return owner, !sysproc.Exists(pid)
+	}
+
+	return owner, time.Since(info.ModTime()) > staleAfter
+}
+
+// breakStale removes a directory lock isStale judged left behind by
+// owner. Another waiter may have broken it and taken the lock since, so
+// it is first renamed aside, which only one waiter can do, and removed
+// only if it still is stale with the same owner; otherwise it goes back.
+func breakStale(dir, owner string) {
+	aside := fmt.Sprintf("%s.stale-%d-%d", dir, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(dir, aside); err != nil {
+		// Another waiter moved it first
+		return
+	}
+	if current, stale := isStale(aside); stale && current == owner {
+		os.RemoveAll(aside)
+		return
+	}
+	if err := os.Rename(aside, dir); err != nil {
+		// Yet another lock was taken meanwhile; it is the one in place
+		os.RemoveAll(aside)
+	}
+}
+
+// Release drops the lock
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+	if l.dir != "" {
+		close(l.stop)
+		// A lock broken as stale may be another process's by now
+		var err error
+		if data, _ := os.ReadFile(filepath.Join(l.dir, "owner")); string(data) == l.owner {
+			err = os.RemoveAll(l.dir)
+		}
+		l.dir = ""
+		return err
+	}
+	if l.file == nil {
+		return nil
+	}
+	unlockFile(l.file)
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Owner returns the holder description written by the last locker
+func Owner(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// holder describes this process for the lock file
+func holder() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s pid=%d host=%s since=%s\n", username(), os.Getpid(), hostname, time.Now().Format(time.RFC3339))
+}
+
+// parseHolder extracts host and pid from a holder description
+func parseHolder(s string) (string, int) {
+	var host string
+	var pid int
+	for _, field := range strings.Fields(s) {
+		if value, ok := strings.CutPrefix(field, "host="); ok {
+			host = value
+		} else if value, ok := strings.CutPrefix(field, "pid="); ok {
+			pid, _ = strconv.Atoi(value)
+		}
+	}
+	return host, pid
+}
+
+func username() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,245 @@
+// Package modulefile generates environment modulefiles for 'sbox module
+// generate', so users of HPC clusters can 'module load' a sandbox's tools
+// into their shell with Lmod or Environment Modules.
+//
+// A loaded module puts the environment's programs on PATH and sets the
+// config's env vars. It is not isolated: HOME, TMPDIR and the host PATH
+// are left alone, since the module changes the user's login shell.
+package modulefile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// Formats
+const (
+	// FormatLua is Lmod's native format
+	FormatLua = "lua"
+	// FormatTcl is understood by Environment Modules and by Lmod
+	FormatTcl = "tcl"
+)
+
+// Info describes the module to generate
+type Info struct {
+	Name        string
+	Version     string
+	ProjectRoot string
+}
+
+// DetectFormat picks Lua when Lmod is the active module system
+func DetectFormat() string {
+	if os.Getenv("LMOD_CMD") != "" || os.Getenv("LMOD_VERSION") != "" {
+		return FormatLua
+	}
+	return FormatTcl
+}
+
+// FileName is the path of the modulefile relative to a module directory:
+// name/version, or just name when there is no version
+func FileName(info Info, format string) string {
+	file := info.Name
+	if info.Version != "" {
+		file = filepath.Join(info.Name, info.Version)
+	}
+	if format == FormatLua {
+		file += ".lua"
+	}
+	return file
+}
+
+// setting is one environment change of the module
+type setting struct {
+	prepend bool // prepend to a path variable instead of setting it
+	key     string
+	value   string
+	// expand resolves $VAR references when the module is loaded
+	expand bool
+}
+
+func settings(cfg *config.Config, info Info) []setting {
+	envDir := config.GetEnvDir(info.ProjectRoot)
+
+	s := []setting{
+		{prepend: true, key: "PATH", value: filepath.Join(envDir, "bin")},
+		{key: "SBOX_PROJECT", value: info.ProjectRoot},
+		{key: "SBOX_RUNTIME", value: cfg.Runtime},
+		{key: "CONDA_PREFIX", value: envDir},
+		{key: "PYTHONNOUSERSITE", value: "1"},
+	}
+
+	// env values as written, for the module to expand when loaded
+	env := cfg.Raw().Env
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s = append(s, setting{key: key, value: env[key], expand: true})
+	}
+	return s
+}
+
+// Generate renders the modulefile for a built project
+func Generate(cfg *config.Config, info Info, format string) string {
+	if format == FormatLua {
+		return generateLua(cfg, info)
+	}
+	return generateTcl(cfg, info)
+}
+
+func description(cfg *config.Config, info Info) string {
+	return fmt.Sprintf("sbox sandbox %s (%s)", info.Name, cfg.Runtime)
+}
+
+func generateLua(cfg *config.Config, info Info) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "-- -*- lua -*-\n")
+	fmt.Fprintf(&b, "-- Generated by sbox %s from %s\n", config.Version, configPath(info))
+	fmt.Fprintf(&b, "-- Regenerate with 'sbox module generate' after changing env\n\n")
+
+	fmt.Fprintf(&b, "whatis(%s)\n", luaString("Name: "+info.Name))
+	fmt.Fprintf(&b, "whatis(%s)\n", luaString("Description: "+description(cfg, info)))
+	fmt.Fprintf(&b, "help(%s)\n\n", luaString(helpText(cfg, info)))
+
+	// Only one sandbox at a time: their tools would shadow each other.
+	// Lmod swaps out a loaded module of the same family.
+	fmt.Fprintf(&b, "family(\"sbox\")\n\n")
+
+	for _, s := range settings(cfg, info) {
+		switch {
+		case s.prepend:
+			fmt.Fprintf(&b, "prepend_path(%s, %s)\n", luaString(s.key), luaString(s.value))
+		case s.expand:
+			fmt.Fprintf(&b, "setenv(%s, %s)\n", luaString(s.key), luaExpand(s.value))
+		default:
+			fmt.Fprintf(&b, "setenv(%s, %s)\n", luaString(s.key), luaString(s.value))
+		}
+	}
+	return b.String()
+}
+
+func generateTcl(cfg *config.Config, info Info) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "#%%Module1.0\n")
+	fmt.Fprintf(&b, "# Generated by sbox %s from %s\n", config.Version, configPath(info))
+	fmt.Fprintf(&b, "# Regenerate with 'sbox module generate' after changing env\n\n")
+
+	fmt.Fprintf(&b, "module-whatis %s\n\n", tclString(description(cfg, info)))
+	fmt.Fprintf(&b, "proc ModulesHelp { } {\n")
+	for _, line := range strings.Split(helpText(cfg, info), "\n") {
+		fmt.Fprintf(&b, "    puts stderr %s\n", tclString(line))
+	}
+	fmt.Fprintf(&b, "}\n\n")
+
+	for _, s := range settings(cfg, info) {
+		switch {
+		case s.prepend:
+			fmt.Fprintf(&b, "prepend-path %s %s\n", s.key, tclString(s.value))
+		case s.expand:
+			fmt.Fprintf(&b, "setenv %s %s\n", s.key, tclExpand(s.value))
+		default:
+			fmt.Fprintf(&b, "setenv %s %s\n", s.key, tclString(s.value))
+		}
+	}
+	return b.String()
+}
+
+func configPath(info Info) string {
+	return config.GetConfigPath(info.ProjectRoot)
+}
+
+func helpText(cfg *config.Config, info Info) string {
+	lines := []string{
+		description(cfg, info),
+		"Project: " + info.ProjectRoot,
+		"",
+		"Puts the sandbox environment's programs on PATH. Unlike 'sbox run',",
+		"HOME and TMPDIR are not redirected and the host PATH stays visible.",
+	}
+	return strings.Join(lines, "\n")
+}
+
+// varPattern matches $VAR and ${VAR} references in env values
+var varPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// segment is a literal piece of a value, or a variable reference
+type segment struct {
+	text  string
+	isVar bool
+}
+
+func split(value string) []segment {
+	var segments []segment
+	last := 0
+	for _, m := range varPattern.FindAllStringSubmatchIndex(value, -1) {
+		if m[0] > last {
+			segments = append(segments, segment{text: value[last:m[0]]})
+		}
+		var name string
+		if m[2] >= 0 {
+			name = value[m[2]:m[3]]
+		} else {
+			name = value[m[4]:m[5]]
+		}
+		segments = append(segments, segment{text: name, isVar: true})
+		last = m[1]
+	}
+	if last < len(value) {
+		segments = append(segments, segment{text: value[last:]})
+	}
+	return segments
+}
+
+func luaString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// luaExpand resolves variable references with os.getenv at load time
+func luaExpand(value string) string {
+	segments := split(value)
+	if len(segments) == 0 {
+		return `""`
+	}
+	parts := make([]string, len(segments))
+	for i, seg := range segments {
+		if seg.isVar {
+			parts[i] = fmt.Sprintf("(os.getenv(%s) or \"\")", luaString(seg.text))
+		} else {
+			parts[i] = luaString(seg.text)
+		}
+	}
+	return strings.Join(parts, " .. ")
+}
+
+func tclString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, `[`, `\[`, `]`, `\]`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// tclExpand resolves variable references from env() at load time; unset
+// variables expand to an empty string as they do in 'sbox run'
+func tclExpand(value string) string {
+	var b strings.Builder
+	b.WriteString(`"`)
+	for _, seg := range split(value) {
+		if seg.isVar {
+			fmt.Fprintf(&b, `[expr {[info exists ::env(%s)] ? $::env(%s) : ""}]`, seg.text, seg.text)
+		} else {
+			quoted := tclString(seg.text)
+			b.WriteString(quoted[1 : len(quoted)-1])
+		}
+	}
+	b.WriteString(`"`)
+	return b.String()
+}
@@ -0,0 +1,195 @@
+// Package mpi supports commands that start with an MPI or Slurm launcher
+// (mpirun, mpiexec, srun): it exports the sandbox environment to the ranks
+// the launcher starts on other nodes, and detects the MPI library of an
+// environment so validate can compare it with the launcher and the host's
+// interconnect.
+package mpi
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Implementations
+const (
+	OpenMPI  = "Open MPI"
+	MPICH    = "MPICH"
+	IntelMPI = "Intel MPI"
+)
+
+// Launchers that start ranks on other nodes, by program name
+var launchers = map[string]bool{
+	"mpirun":        true,
+	"mpiexec":       true,
+	"mpiexec.hydra": true,
+	"orterun":       true,
+	"prterun":       true,
+	"srun":          true,
+}
+
+// versionTimeout bounds 'mpirun --version'
+const versionTimeout = 5 * time.Second
+
+// Launcher returns the launcher a shell command starts with, e.g.
+// "mpirun" for "mpirun -np 4 python train.py", or "" if it has none
+func Launcher(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ""
+	}
+	name := filepath.Base(fields[0])
+	if !launchers[name] {
+		return ""
+	}
+	return fields[0]
+}
+
+// LaunchEnv adds the settings that make a launcher pass env on to every
+// rank. Without them, ranks on other nodes start with the login
+// environment of the remote shell instead of the sandbox's PATH and
+// variables. Settings already present in env are kept.
+func LaunchEnv(command string, env []string) []string {
+	launcher := Launcher(command)
+	if launcher == "" {
+		return env
+	}
+
+	present := make(map[string]bool, len(env))
+	var names []string
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !present[name] {
+			present[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var settings []string
+	if filepath.Base(launcher) == "srun" {
+		settings = []string{"SLURM_EXPORT_ENV=ALL"}
+	} else {
+		// Each implementation ignores the others' variables
+		settings = []string{
+			"OMPI_MCA_mca_base_env_list=" + strings.Join(names, ";"),
+			"HYDRA_ENV=all",
+			"I_MPI_HYDRA_ENV=all",
+		}
+	}
+	for _, setting := range settings {
+		name, _, _ := strings.Cut(setting, "=")
+		if !present[name] {
+			env = append(env, setting)
+		}
+	}
+	return env
+}
+
+// Library is the MPI library installed in an environment
+type Library struct {
+	Implementation string
+	Version        string
+	// External builds (conda-forge's external_* builds) are placeholders
+	// that use the host's MPI libraries
+	External bool
+}
+
+// condaMPI maps conda package names to implementations
+var condaMPI = map[string]string{
+	"openmpi":  OpenMPI,
+	"mpich":    MPICH,
+	"mvapich":  MPICH,
+	"mvapich2": MPICH,
+	"impi_rt":  IntelMPI,
+}
+
+// condaMetaName splits conda-meta file names: <name>-<version>-<build>.json
+var condaMetaName = regexp.MustCompile(`^(.+)-([^-]+)-([^-]+)\.json$`)
+
+// EnvLibrary returns the MPI library of a conda environment, or nil
+func EnvLibrary(envDir string) *Library {
+	files, _ := filepath.Glob(filepath.Join(envDir, "conda-meta", "*.json"))
+	for _, file := range files {
+		m := condaMetaName.FindStringSubmatch(filepath.Base(file))
+		if m == nil {
+			continue
+		}
+		if impl, ok := condaMPI[m[1]]; ok {
+			return &Library{Implementation: impl, Version: m[2], External: strings.HasPrefix(m[3], "external")}
+		}
+	}
+	return nil
+}
+
+// ResolveLauncher finds a launcher the way the sandbox PATH would: in the
+// environment first, then on the host
+func ResolveLauncher(envDir, launcher string) string {
+	if filepath.IsAbs(launcher) {
+		return launcher
+	}
+	inEnv := filepath.Join(envDir, "bin", launcher)
+	if info, err := os.Stat(inEnv); err == nil && !info.IsDir() {
+		return inEnv
+	}
+	path, _ := exec.LookPath(launcher)
+	return path
+}
+
+// LauncherImplementation identifies the MPI implementation of a launcher
+// from its --version output, or returns "" when it cannot tell
+func LauncherImplementation(path string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+
+	out, _ := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	version := string(out)
+	switch {
+	case strings.Contains(version, "Open MPI"), strings.Contains(version, "OpenRTE"), strings.Contains(version, "PRRTE"):
+		return OpenMPI
+	case strings.Contains(version, "Intel(R) MPI"):
+		return IntelMPI
+	case strings.Contains(version, "HYDRA"), strings.Contains(version, "MPICH"), strings.Contains(version, "MVAPICH"):
+		return MPICH
+	}
+	return ""
+}
+
+// HostFabric lists the host's InfiniBand, Omni-Path and Slingshot
+// devices, e.g. mlx5_0
+func HostFabric() []string {
+	var devices []string
+	for _, dir := range []string{"/sys/class/infiniband", "/sys/class/cxi"} {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			devices = append(devices, entry.Name())
+		}
+	}
+	return devices
+}
+
+// transportLibraries are the libraries of each transport
+var transportLibraries = []struct {
+	name    string
+	pattern string
+}{
+	{"ucx", "libucp.so*"},
+	{"libfabric", "libfabric.so*"},
+	{"verbs", "libibverbs.so*"},
+}
+
+// EnvTransports lists the interconnect libraries of an environment
+func EnvTransports(envDir string) []string {
+	var transports []string
+	for _, t := range transportLibraries {
+		if matches, _ := filepath.Glob(filepath.Join(envDir, "lib", t.pattern)); len(matches) > 0 {
+			transports = append(transports, t.name)
+		}
+	}
+	return transports
+}
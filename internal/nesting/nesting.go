@@ -0,0 +1,124 @@
+// Package nesting detects sbox commands run inside a sandbox, from 'sbox
+// shell', 'sbox run' or a sourced env.sh, and takes the outer sandbox's
+// environment out of the process before the command builds its own.
+//
+// Without that, the outer sandbox's PATH, HOME, TMPDIR and conda
+// variables are what the inner one is layered on: its tools shadow the
+// host's in builds, path_mode: inherit puts its environment behind the
+// inner one's, and sbox's own files in ~/.sbox are looked up in the outer
+// rootfs.
+package nesting
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// AllowEnv allows entering another project's sandbox from inside one
+// when --allow-nested is not given
+const AllowEnv = "SBOX_ALLOW_NESTED"
+
+// sandboxVars are set by 'sbox run' and env.sh for the sandbox alone
+var sandboxVars = []string{
+	"SBOX_ACTIVE", "SBOX_PROJECT", "SBOX_VERSION", "SBOX_RUNTIME", "SBOX_BUILD_HASH",
+	"SBOX_SERVICE_NAME", "SBOX_LOG_DIR", "CONDA_PREFIX", "MAMBA_ROOT_PREFIX",
+}
+
+// pathVars are lists of directories the outer sandbox adds its own to
+var pathVars = []string{"PATH", "LD_LIBRARY_PATH", "DYLD_LIBRARY_PATH"}
+
+// homeVars point into the outer sandbox's rootfs
+var homeVars = []string{"HOME", "USERPROFILE", "TMPDIR", "TEMP", "TMP"}
+
+// Outer is the sandbox the process runs in
+type Outer struct {
+	ProjectRoot string
+}
+
+// Detect returns the sandbox the process runs in, or nil outside of one
+func Detect() *Outer {
+	if os.Getenv("SBOX_ACTIVE") != "1" {
+		return nil
+	}
+	return &Outer{ProjectRoot: os.Getenv("SBOX_PROJECT")}
+}
+
+// Same reports whether projectRoot is the outer sandbox's project
+func (o *Outer) Same(projectRoot string) bool {
+	return o.ProjectRoot != "" && sameDir(o.ProjectRoot, projectRoot)
+}
+
+// Leave removes the outer sandbox from the process environment: its own
+// variables, its directories in PATH and the library paths, and HOME
+// and the temporary directories it redirected into its rootfs. The
+// project's env vars cannot be told from the host's and are kept.
+func (o *Outer) Leave() {
+	for _, key := range sandboxVars {
+		os.Unsetenv(key)
+	}
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, "SBOX_PORT_") {
+			os.Unsetenv(strings.SplitN(env, "=", 2)[0])
+		}
+	}
+	if o.ProjectRoot == "" {
+		return
+	}
+
+	sboxDir := config.GetSboxDir(o.ProjectRoot)
+	for _, key := range pathVars {
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		var kept []string
+		for _, dir := range filepath.SplitList(value) {
+			if dir != "" && !within(sboxDir, dir) {
+				kept = append(kept, dir)
+			}
+		}
+		if len(kept) == 0 && key != "PATH" {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, strings.Join(kept, string(os.PathListSeparator)))
+		}
+	}
+
+	for _, key := range homeVars {
+		if value := os.Getenv(key); value == "" || !within(sboxDir, value) {
+			continue
+		}
+		os.Unsetenv(key)
+		if key == "HOME" || (key == "USERPROFILE" && runtime.GOOS == "windows") {
+			if u, err := user.Current(); err == nil && u.HomeDir != "" {
+				os.Setenv(key, u.HomeDir)
+			}
+		}
+	}
+}
+
+// within reports whether path is dir or inside it
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+func sameDir(a, b string) bool {
+	if a, err := filepath.Abs(a); err == nil {
+		if b, err := filepath.Abs(b); err == nil {
+			if runtime.GOOS == "windows" {
+				return strings.EqualFold(a, b)
+			}
+			return a == b
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+// Package netfs detects network filesystems (NFS, SMB, Lustre, ...),
+// where hardlinks and flock(2) are unreliable or slow.
+package netfs
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Detect returns the name of the network filesystem holding path, or ""
+// for local filesystems. Paths that do not exist yet are resolved to their
+// nearest existing parent.
+func Detect(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	return detect(path)
+}
+
+// IsNetwork reports whether path is on a network filesystem
+func IsNetwork(path string) bool {
+	return Detect(path) != ""
+}
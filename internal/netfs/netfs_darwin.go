@@ -0,0 +1,30 @@
+package netfs
+
+import "syscall"
+
+var networkTypes = map[string]bool{
+	"nfs":     true,
+	"smbfs":   true,
+	"afpfs":   true,
+	"webdav":  true,
+	"osxfuse": true,
+	"macfuse": true,
+}
+
+func detect(path string) string {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return ""
+	}
+	var name []byte
+	for _, c := range stat.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	if networkTypes[string(name)] {
+		return string(name)
+	}
+	return ""
+}
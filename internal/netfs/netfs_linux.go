@@ -0,0 +1,27 @@
+package netfs
+
+import "syscall"
+
+// Filesystem magic numbers from statfs(2)
+var networkMagics = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x5346414f: "afs",
+	0x0bd00bd0: "lustre",
+	0x47504653: "gpfs",
+	0x00c36400: "ceph",
+	0x01021997: "9p",
+	0x65735546: "fuse",
+	0x013111a8: "ibrix",
+	0x6b414653: "kafs",
+}
+
+func detect(path string) string {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return ""
+	}
+	return networkMagics[uint32(stat.Type)]
+}
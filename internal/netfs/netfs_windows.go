@@ -0,0 +1,32 @@
+package netfs
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const driveRemote = 4
+
+var getDriveType = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDriveTypeW")
+
+// detect reports UNC paths and mapped network drives as "smb"
+func detect(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	volume := filepath.VolumeName(abs)
+	if strings.HasPrefix(volume, `\\`) {
+		return "smb"
+	}
+	root, err := syscall.UTF16PtrFromString(volume + `\`)
+	if err != nil {
+		return ""
+	}
+	if kind, _, _ := getDriveType.Call(uintptr(unsafe.Pointer(root))); kind == driveRemote {
+		return "smb"
+	}
+	return ""
+}
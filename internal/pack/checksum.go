@@ -0,0 +1,451 @@
+package pack
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/archive"
+)
+
+const (
+	// ManifestFile lists the SHA-256 of every packed file in the format
+	// of sha256sum, so 'sha256sum -c' can check an extracted archive too
+	ManifestFile = "SHA256SUMS"
+	// LinksFile lists the target of every packed symlink, which the
+	// manifest cannot hash, as "<path> -> <target>" lines
+	LinksFile = "SYMLINKS"
+	// MetadataFile describes the archive; it holds the manifest's digest
+	MetadataFile = "metadata.json"
+)
+
+// Mismatch problems
+const (
+	Modified   = "modified"
+	Missing    = "missing"
+	Unexpected = "unexpected"
+)
+
+// unhashed are written after the manifest, so it cannot list them
+var unhashed = map[string]bool{
+	ManifestFile:                     true,
+	LinksFile:                        true,
+	MetadataFile:                     true,
+	MetadataFile + minisignSignature: true,
+	MetadataFile + cosignSignature:   true,
+}
+
+// Checksums is the checksums entry of metadata.json
+type Checksums struct {
+	Algorithm string `json:"algorithm"`
+	Manifest  string `json:"manifest"`
+	Files     int    `json:"files"`
+	// Digest is the SHA-256 of the manifest, so metadata.json covers the
+	// content of every file
+	Digest string `json:"digest"`
+	// Links, Symlinks and LinksDigest cover symlink targets the same way;
+	// archives packed before them have none and their links are not
+	// checked
+	Links       string `json:"links,omitempty"`
+	Symlinks    int    `json:"symlinks,omitempty"`
+	LinksDigest string `json:"links_digest,omitempty"`
+}
+
+// Mismatch is a file that differs from the manifest
+type Mismatch struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+// Report is the result of checking a packed tree against its manifest
+type Report struct {
+	Files      int        `json:"files"`
+	Symlinks   int        `json:"symlinks,omitempty"`
+	Mismatches []Mismatch `json:"mismatches,omitempty"`
+	// Signed is the signature format of metadata.json, "" when unsigned
+	Signed string `json:"signed,omitempty"`
+}
+
+// OK reports whether every file matched the manifest
+func (r *Report) OK() bool {
+	return len(r.Mismatches) == 0
+}
+
+// WriteManifest hashes the regular files of a packed tree, records the
+// targets of its symlinks and writes both manifests at its root
+func WriteManifest(dir string) (*Checksums, error) {
+	sums, links, err := hashTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	data := formatManifest(sums)
+	if err := os.WriteFile(filepath.Join(dir, ManifestFile), data, 0644); err != nil {
+		return nil, err
+	}
+	linkData := formatLinks(links)
+	if err := os.WriteFile(filepath.Join(dir, LinksFile), linkData, 0644); err != nil {
+		return nil, err
+	}
+	return &Checksums{
+		Algorithm:   "sha256",
+		Manifest:    ManifestFile,
+		Files:       len(sums),
+		Digest:      digest(data),
+		Links:       LinksFile,
+		Symlinks:    len(links),
+		LinksDigest: digest(linkData),
+	}, nil
+}
+
+// VerifyDir checks an extracted archive against its manifest and the
+// manifest against metadata.json
+func VerifyDir(dir string) (*Report, error) {
+	manifest, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("no %s; the archive was packed without checksums", ManifestFile)
+	}
+	metadata, err := os.ReadFile(filepath.Join(dir, MetadataFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", MetadataFile, err)
+	}
+	// Missing in archives packed before symlinks were recorded
+	linkManifest, _ := os.ReadFile(filepath.Join(dir, LinksFile))
+	got, gotLinks, err := hashTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	report, err := compare(manifest, linkManifest, metadata, got, gotLinks)
+	if err != nil {
+		return nil, err
+	}
+	report.Signed = signatureFormat(func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	})
+	return report, nil
+}
+
+// VerifyArchive checks a packed archive, or a split one from any of its
+// volumes, without extracting it. The files the signature check needs are
+// copied to extractDir.
+func VerifyArchive(path, extractDir string) (*Report, error) {
+	stream, err := archive.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	got := make(map[string]string)
+	gotLinks := make(map[string]string)
+	kept := make(map[string][]byte)
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		// Entries are <project>/<path>
+		rel := archivePath(hdr.Name)
+		if rel == "" {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			gotLinks[rel] = hdr.Linkname
+			continue
+		case tar.TypeLink:
+			// Extracted as a copy of an earlier entry: a regular file
+			// with that file's content, or nothing when it is unknown
+			got[rel] = got[archivePath(hdr.Linkname)]
+			continue
+		case tar.TypeReg:
+		default:
+			continue
+		}
+		if unhashed[rel] {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", rel, err)
+			}
+			kept[rel] = data
+			continue
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+		got[rel] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if kept[ManifestFile] == nil {
+		return nil, fmt.Errorf("no %s; the archive was packed without checksums", ManifestFile)
+	}
+	if kept[MetadataFile] == nil {
+		return nil, fmt.Errorf("archive has no %s", MetadataFile)
+	}
+	report, err := compare(kept[ManifestFile], kept[LinksFile], kept[MetadataFile], got, gotLinks)
+	if err != nil {
+		return nil, err
+	}
+	report.Signed = signatureFormat(func(name string) bool { return kept[name] != nil })
+	for name, data := range kept {
+		if err := os.WriteFile(filepath.Join(extractDir, name), data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// archivePath returns the path of a tar entry below the <project>/
+// directory every entry is in, "" for the directory itself
+func archivePath(name string) string {
+	_, rel, _ := strings.Cut(strings.TrimPrefix(name, "./"), "/")
+	return strings.TrimSuffix(rel, "/")
+}
+
+// compare checks hashed files and symlink targets against the manifests,
+// after checking the manifests against the digests in metadata.json
+func compare(manifest, linkManifest, metadata []byte, got, gotLinks map[string]string) (*Report, error) {
+	var meta struct {
+		Checksums *Checksums `json:"checksums"`
+	}
+	if err := json.Unmarshal(metadata, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", MetadataFile, err)
+	}
+	if meta.Checksums == nil {
+		return nil, fmt.Errorf("%s has no checksums", MetadataFile)
+	}
+	if d := digest(manifest); d != meta.Checksums.Digest {
+		return nil, fmt.Errorf("%s does not match the digest in %s (%s, expected %s)", ManifestFile, MetadataFile, d, meta.Checksums.Digest)
+	}
+
+	want, err := parseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Files: len(want)}
+	report.check(want, got)
+
+	if meta.Checksums.Links != "" {
+		if linkManifest == nil {
+			return nil, fmt.Errorf("%s lists symlinks but the archive has no %s", MetadataFile, LinksFile)
+		}
+		if d := digest(linkManifest); d != meta.Checksums.LinksDigest {
+			return nil, fmt.Errorf("%s does not match the digest in %s (%s, expected %s)", LinksFile, MetadataFile, d, meta.Checksums.LinksDigest)
+		}
+		wantLinks, err := parseLinks(linkManifest)
+		if err != nil {
+			return nil, err
+		}
+		report.Symlinks = len(wantLinks)
+		report.check(wantLinks, gotLinks)
+	}
+	return report, nil
+}
+
+// check adds the entries of got that differ from want to the mismatches
+func (r *Report) check(want, got map[string]string) {
+	for _, rel := range sortedKeys(want) {
+		value, ok := got[rel]
+		switch {
+		case !ok:
+			r.Mismatches = append(r.Mismatches, Mismatch{rel, Missing})
+		case value != want[rel]:
+			r.Mismatches = append(r.Mismatches, Mismatch{rel, Modified})
+		}
+	}
+	for _, rel := range sortedKeys(got) {
+		if _, ok := want[rel]; !ok {
+			r.Mismatches = append(r.Mismatches, Mismatch{rel, Unexpected})
+		}
+	}
+}
+
+// hashTree returns the SHA-256 of each regular file under dir and the
+// target of each symlink, by slash-separated relative path, leaving out
+// the unhashed files
+func hashTree(dir string) (sums, links map[string]string, err error) {
+	sums = make(map[string]string)
+	links = make(map[string]string)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			links[rel] = target
+		case d.Type().IsRegular() && !unhashed[rel]:
+			sum, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+			sums[rel] = sum
+		}
+		return nil
+	})
+	return sums, links, err
+}
+
+// hashFile returns the hex SHA-256 of a file
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digest returns the hex SHA-256 of data
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// formatManifest writes "<sha256>  <path>" lines sorted by path
+func formatManifest(sums map[string]string) []byte {
+	var buf bytes.Buffer
+	for _, rel := range sortedKeys(sums) {
+		fmt.Fprintf(&buf, "%s  %s\n", sums[rel], rel)
+	}
+	return buf.Bytes()
+}
+
+// parseManifest reads the lines written by formatManifest
+func parseManifest(data []byte) (map[string]string, error) {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		sum, rel, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok || len(sum) != sha256.Size*2 || rel == "" {
+			return nil, fmt.Errorf("%s line %d is malformed", ManifestFile, n)
+		}
+		sums[rel] = sum
+	}
+	return sums, scanner.Err()
+}
+
+// formatLinks writes "<path> -> <target>" lines sorted by path
+func formatLinks(links map[string]string) []byte {
+	var buf bytes.Buffer
+	for _, rel := range sortedKeys(links) {
+		fmt.Fprintf(&buf, "%s -> %s\n", rel, links[rel])
+	}
+	return buf.Bytes()
+}
+
+// parseLinks reads the lines written by formatLinks
+func parseLinks(data []byte) (map[string]string, error) {
+	links := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		rel, target, ok := strings.Cut(scanner.Text(), " -> ")
+		if !ok || rel == "" || target == "" {
+			return nil, fmt.Errorf("%s line %d is malformed", LinksFile, n)
+		}
+		links[rel] = target
+	}
+	return links, scanner.Err()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteSumFile writes <archive>.sha256 next to an archive, in the format
+// of sha256sum, with a line for each volume of a split archive. It returns
+// the archive's digest, or "" when split.
+func WriteSumFile(path string, parts []string) (string, error) {
+	var buf bytes.Buffer
+	var sum string
+	for _, part := range parts {
+		var err error
+		if sum, err = hashFile(part); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&buf, "%s  %s\n", sum, filepath.Base(part))
+	}
+	if len(parts) > 1 {
+		sum = ""
+	}
+	return sum, os.WriteFile(path+".sha256", buf.Bytes(), 0644)
+}
+
+// CheckSumFile checks an archive, or the volumes of a split one, against
+// <archive>.sha256 and reports whether that file exists
+func CheckSumFile(path string) (bool, error) {
+	data, err := os.ReadFile(path + ".sha256")
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	want, err := parseSumFile(data)
+	if err != nil {
+		return true, fmt.Errorf("%s.sha256: %w", filepath.Base(path), err)
+	}
+	files := make(map[string]string, len(want))
+	for name := range want {
+		files[name] = filepath.Join(filepath.Dir(path), name)
+	}
+	// A renamed archive is checked under its new name
+	if info, err := os.Stat(path); len(want) == 1 && err == nil && !info.IsDir() {
+		for name := range want {
+			files[name] = path
+		}
+	}
+	for _, name := range sortedKeys(want) {
+		got, err := hashFile(files[name])
+		if err != nil {
+			return true, err
+		}
+		if got != want[name] {
+			return true, fmt.Errorf("%s digest %s does not match %s.sha256 (%s)", name, got, filepath.Base(path), want[name])
+		}
+	}
+	return true, nil
+}
+
+// parseSumFile reads sha256sum lines; sha256sum marks binary files with
+// a '*' before the name
+func parseSumFile(data []byte) (map[string]string, error) {
+	sums := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		sum, name, ok := strings.Cut(strings.TrimSpace(line), " ")
+		name = strings.TrimPrefix(strings.TrimSpace(name), "*")
+		if !ok || len(sum) != sha256.Size*2 || name == "" || strings.ContainsRune(name, '/') {
+			return nil, fmt.Errorf("malformed line '%s'", line)
+		}
+		sums[name] = sum
+	}
+	return sums, nil
+}
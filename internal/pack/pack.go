@@ -0,0 +1,184 @@
+// Package pack decides which files of a built sandbox go into a packed
+// archive and estimates the archive contents before copying.
+package pack
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Exclusion reasons, reported in size estimates
+const (
+	ReasonLogs     = "logs"
+	ReasonVolumes  = "volumes"
+	ReasonCaches   = "caches"
+	ReasonPatterns = "patterns"
+)
+
+// cacheDirs are directories that are regenerated on demand
+var cacheDirs = map[string]bool{
+	"__pycache__":   true,
+	".pytest_cache": true,
+	".mypy_cache":   true,
+	".cache":        true,
+	".npm":          true,
+}
+
+// IsCacheDir reports whether a directory name is one of the caches
+// regenerated on demand (__pycache__, .cache, .npm, ...)
+func IsCacheDir(name string) bool {
+	return cacheDirs[name]
+}
+
+// nodeTestDirs are test suites shipped inside node_modules packages
+var nodeTestDirs = map[string]bool{
+	"test":      true,
+	"tests":     true,
+	"__tests__": true,
+}
+
+// Filter selects content left out of an archive
+type Filter struct {
+	ExcludeLogs    bool
+	ExcludeVolumes bool
+	ExcludeCaches  bool
+
+	// Exclude holds extra glob patterns, matched against the base name
+	// and the slash-separated path relative to the packed tree
+	Exclude []string
+
+	// Volumes are the mount destinations relative to the rootfs
+	Volumes []string
+}
+
+// Match returns why a path (relative to the packed tree) is excluded, or
+// "" when it is packed
+func (f *Filter) Match(rel string, isDir bool) string {
+	if f == nil {
+		return ""
+	}
+	rel = filepath.ToSlash(rel)
+	base := path.Base(rel)
+
+	if f.ExcludeVolumes {
+		for _, volume := range f.Volumes {
+			if rel == volume {
+				return ReasonVolumes
+			}
+		}
+	}
+
+	if f.ExcludeLogs {
+		if isDir && rel == "var/log" {
+			return ReasonLogs
+		}
+		if !isDir && isLogFile(base) {
+			return ReasonLogs
+		}
+	}
+
+	if f.ExcludeCaches {
+		if isDir && cacheDirs[base] {
+			return ReasonCaches
+		}
+		if isDir && nodeTestDirs[base] && strings.Contains(rel, "node_modules/") {
+			return ReasonCaches
+		}
+		if !isDir && (strings.HasSuffix(base, ".pyc") || strings.HasSuffix(base, ".pyo")) {
+			return ReasonCaches
+		}
+	}
+
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, base); ok {
+			return ReasonPatterns
+		}
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), rel); ok {
+			return ReasonPatterns
+		}
+	}
+
+	return ""
+}
+
+// isLogFile matches app.log and rotated app.log.1 and app.log.1.gz
+func isLogFile(name string) bool {
+	if strings.HasSuffix(name, ".log") {
+		return true
+	}
+	idx := strings.LastIndex(name, ".log.")
+	if idx < 0 {
+		return false
+	}
+	suffix := strings.TrimSuffix(name[idx+len(".log."):], ".gz")
+	return suffix != "" && strings.Trim(suffix, "0123456789") == ""
+}
+
+// Estimate is the size of a tree split into packed and excluded content
+type Estimate struct {
+	Size     int64
+	Files    int
+	Excluded map[string]int64
+}
+
+// Estimate walks root and sums what the filter would pack and leave out
+func (f *Filter) Estimate(root string) (*Estimate, error) {
+	est := &Estimate{Excluded: make(map[string]int64)}
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return nil
+		}
+
+		if reason := f.Match(rel, info.IsDir()); reason != "" {
+			if info.IsDir() {
+				est.Excluded[reason] += dirSize(p)
+				return filepath.SkipDir
+			}
+			est.Excluded[reason] += info.Size()
+			return nil
+		}
+
+		if info.Mode().IsRegular() {
+			est.Size += info.Size()
+			est.Files++
+		}
+		return nil
+	})
+	return est, err
+}
+
+func dirSize(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Reasons lists the enabled exclusion categories
+func (f *Filter) Reasons() []string {
+	var reasons []string
+	if f.ExcludeLogs {
+		reasons = append(reasons, ReasonLogs)
+	}
+	if f.ExcludeVolumes {
+		reasons = append(reasons, ReasonVolumes)
+	}
+	if f.ExcludeCaches {
+		reasons = append(reasons, ReasonCaches)
+	}
+	if len(f.Exclude) > 0 {
+		reasons = append(reasons, ReasonPatterns)
+	}
+	return reasons
+}
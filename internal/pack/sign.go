@@ -0,0 +1,119 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Signature formats, named after the tool that makes them
+const (
+	Minisign = "minisign"
+	Cosign   = "cosign"
+)
+
+// Signatures of metadata.json, which covers every file through the
+// manifest digest it holds
+const (
+	minisignSignature = ".minisig"
+	cosignSignature   = ".sig"
+)
+
+// KeyFormat tells from a key which tool it belongs to: minisign keys
+// start with an "untrusted comment:" line (a public key may also be
+// given as its base64 line), cosign keys are PEM
+func KeyFormat(key string) (string, error) {
+	data, err := os.ReadFile(key)
+	if err != nil {
+		if strings.HasPrefix(key, "RW") && !strings.ContainsAny(key, "/.") {
+			return Minisign, nil
+		}
+		return "", fmt.Errorf("failed to read key: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("untrusted comment:")):
+		return Minisign, nil
+	case bytes.HasPrefix(data, []byte("-----BEGIN ")):
+		return Cosign, nil
+	}
+	return "", fmt.Errorf("%s is neither a minisign nor a cosign key", key)
+}
+
+// Sign signs the metadata.json of a packed tree with a minisign or cosign
+// secret key. The tool may prompt for the key's password.
+func Sign(dir, key string) (string, error) {
+	format, err := KeyFormat(key)
+	if err != nil {
+		return "", err
+	}
+	metadata := filepath.Join(dir, MetadataFile)
+
+	var args []string
+	switch format {
+	case Minisign:
+		args = []string{"-S", "-s", key, "-m", metadata, "-x", metadata + minisignSignature}
+	case Cosign:
+		args = []string{"sign-blob", "--yes", "--key", key, "--output-signature", metadata + cosignSignature, metadata}
+	}
+	if err := runSigner(format, args); err != nil {
+		return "", fmt.Errorf("signing failed: %w", err)
+	}
+	return format, nil
+}
+
+// VerifySignature checks the signature of a metadata.json in dir with a
+// minisign or cosign public key
+func VerifySignature(dir, key string) error {
+	format, err := KeyFormat(key)
+	if err != nil {
+		return err
+	}
+	metadata := filepath.Join(dir, MetadataFile)
+
+	var args []string
+	signature := metadata + minisignSignature
+	switch format {
+	case Minisign:
+		keyFlag := "-p"
+		if _, err := os.Stat(key); err != nil {
+			keyFlag = "-P"
+		}
+		args = []string{"-V", "-q", keyFlag, key, "-m", metadata, "-x", signature}
+	case Cosign:
+		signature = metadata + cosignSignature
+		args = []string{"verify-blob", "--key", key, "--signature", signature, metadata}
+	}
+	if _, err := os.Stat(signature); err != nil {
+		return fmt.Errorf("archive has no %s signature", format)
+	}
+	if err := runSigner(format, args); err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+	return nil
+}
+
+// signatureFormat returns the format of the signature present, by a
+// check of whether a file exists, or ""
+func signatureFormat(exists func(name string) bool) string {
+	switch {
+	case exists(MetadataFile + minisignSignature):
+		return Minisign
+	case exists(MetadataFile + cosignSignature):
+		return Cosign
+	}
+	return ""
+}
+
+// runSigner runs minisign or cosign on the terminal, for password prompts
+func runSigner(tool string, args []string) error {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return fmt.Errorf("%s not found on PATH", tool)
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
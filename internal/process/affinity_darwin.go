@@ -0,0 +1,6 @@
+package process
+
+// setAffinity does nothing: macOS does not let processes pick their CPUs
+func setAffinity(cpus []int) error {
+	return nil
+}
@@ -0,0 +1,20 @@
+package process
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// setAffinity pins the current process to cpus, as taskset -c does
+func setAffinity(cpus []int) error {
+	mask := make([]uint64, cpus[len(cpus)-1]/64+1)
+	for _, cpu := range cpus {
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0,
+		uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+package process
+
+// setAffinity does nothing: package syscall cannot set the affinity of
+// processes on Windows
+func setAffinity(cpus []int) error {
+	return nil
+}
@@ -0,0 +1,12 @@
+package process
+
+// corePattern returns where macOS writes core dumps (kern.corefile)
+func corePattern() string {
+	return "/cores/core.%P"
+}
+
+// coreUsesPID reports whether the PID is appended to core dumps whose
+// pattern has no %P; the macOS pattern always has one
+func coreUsesPID() bool {
+	return false
+}
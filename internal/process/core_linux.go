@@ -0,0 +1,22 @@
+package process
+
+import (
+	"os"
+	"strings"
+)
+
+// corePattern returns kernel.core_pattern, where core dumps are written
+func corePattern() string {
+	data, err := os.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// coreUsesPID reports whether kernel.core_uses_pid appends the PID to
+// core dumps whose pattern has no %p
+func coreUsesPID() bool {
+	data, err := os.ReadFile("/proc/sys/kernel/core_uses_pid")
+	return err == nil && strings.TrimSpace(string(data)) == "1"
+}
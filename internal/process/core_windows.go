@@ -0,0 +1,10 @@
+package process
+
+// corePattern returns "": Windows writes no core dumps
+func corePattern() string {
+	return ""
+}
+
+func coreUsesPID() bool {
+	return false
+}
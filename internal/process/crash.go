@@ -0,0 +1,232 @@
+package process
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// CrashDir holds a directory per recorded crash
+	CrashDir = "crashes"
+	// CrashFile is the crash metadata in a crash directory
+	CrashFile = "crash.json"
+	// CrashLogFile holds the last log lines of the crashed daemon
+	CrashLogFile = "output.log"
+	// CrashLogLines is the number of log lines kept with a crash
+	CrashLogLines = 200
+)
+
+// Crash describes a daemon that exited with a non-zero code or was killed
+// by a signal, as seen by its supervisor
+type Crash struct {
+	// ID is the name of the crash directory: <name>-<timestamp>
+	ID        string    `json:"id"`
+	Process   string    `json:"process"`
+	Command   string    `json:"command"`
+	PID       int       `json:"pid"`
+	StartTime time.Time `json:"start_time"`
+	Time      time.Time `json:"time"`
+	ExitCode  int       `json:"exit_code"`
+	// Signal is the signal that killed the daemon, or its shell's child
+	// when the shell exited with 128+N
+	Signal     string `json:"signal,omitempty"`
+	CoreDumped bool   `json:"core_dumped,omitempty"`
+	// Core is where a core dump is written for this crash, or why none is
+	Core     string `json:"core,omitempty"`
+	Restart  string `json:"restart,omitempty"`
+	Restarts int    `json:"restarts,omitempty"`
+	Workdir  string `json:"workdir,omitempty"`
+
+	// Dir is the crash directory
+	Dir string `json:"-"`
+}
+
+// GetCrashDir returns the directory crashes are recorded in
+func (pm *ProcessManager) GetCrashDir() string {
+	return filepath.Join(pm.GetStateDir(), CrashDir)
+}
+
+// recordCrash saves the exit of a daemon and the end of its log under
+// crashes/<name>-<timestamp>/
+func (pm *ProcessManager) recordCrash(info ProcessInfo, exitCode int, state *os.ProcessState, workdir string) (*Crash, error) {
+	now := time.Now()
+	crash := &Crash{
+		Process:   info.Name,
+		Command:   info.Command,
+		PID:       info.PID,
+		StartTime: info.StartTime,
+		Time:      now,
+		ExitCode:  exitCode,
+		Restart:   info.Restart,
+		Restarts:  info.Restarts,
+		Workdir:   workdir,
+	}
+
+	sig := exitSignal(state, exitCode)
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		crash.CoreDumped = status.CoreDump()
+	}
+	if sig != 0 {
+		crash.Signal = fmt.Sprintf("%d (%s)", int(sig), sig)
+		if crash.CoreDumped || coreSignals[sig] {
+			crash.Core = coreLocation(info.PID, workdir)
+		}
+	}
+
+	base := info.Name + "-" + now.Format("20060102-150405")
+	crash.ID = base
+	for i := 2; ; i++ {
+		crash.Dir = filepath.Join(pm.GetCrashDir(), crash.ID)
+		err := os.MkdirAll(filepath.Dir(crash.Dir), 0755)
+		if err == nil {
+			err = os.Mkdir(crash.Dir, 0755)
+		}
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create crash directory: %w", err)
+		}
+		crash.ID = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	data, err := json.MarshalIndent(crash, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(crash.Dir, CrashFile), append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	if lines, err := pm.lastLines(info.Name, CrashLogLines); err == nil {
+		output := strings.Join(lines, "\n")
+		if output != "" {
+			output += "\n"
+		}
+		os.WriteFile(filepath.Join(crash.Dir, CrashLogFile), []byte(output), 0644)
+	}
+	return crash, nil
+}
+
+// exitSignal returns the signal that killed a daemon, or its shell's child
+// when the shell exited with 128+N, or 0
+func exitSignal(state *os.ProcessState, exitCode int) syscall.Signal {
+	if state != nil {
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return status.Signal()
+		}
+	}
+	if exitCode > 128 && exitCode < 128+65 {
+		// The shell running the command reports a child killed by a
+		// signal as 128+N
+		return syscall.Signal(exitCode - 128)
+	}
+	return 0
+}
+
+// coreLocation describes where the kernel writes the core dump of the
+// process pid, following core_pattern, or why it writes none
+func coreLocation(pid int, workdir string) string {
+	if soft, _, err := getRlimit(rlimitCore); err == nil && soft == 0 {
+		return "not written: core dumps are disabled (ulimit -c is 0)"
+	}
+
+	pattern := corePattern()
+	if pattern == "" {
+		return ""
+	}
+	if handler, ok := strings.CutPrefix(pattern, "|"); ok {
+		fields := strings.Fields(handler)
+		if len(fields) == 0 {
+			return ""
+		}
+		if filepath.Base(fields[0]) == "systemd-coredump" {
+			return fmt.Sprintf("handed to systemd-coredump (coredumpctl info %d)", pid)
+		}
+		return "handed to " + fields[0]
+	}
+
+	hostname, _ := os.Hostname()
+	location := strings.NewReplacer(
+		"%%", "%",
+		"%p", strconv.Itoa(pid),
+		"%P", strconv.Itoa(pid),
+		"%h", hostname,
+	).Replace(pattern)
+	if !strings.Contains(pattern, "%p") && !strings.Contains(pattern, "%P") && coreUsesPID() {
+		location += "." + strconv.Itoa(pid)
+	}
+	if !filepath.IsAbs(location) {
+		location = filepath.Join(workdir, location)
+	}
+	return location
+}
+
+// ListCrashes returns the recorded crashes, newest first, of the daemon
+// name or of every daemon when name is empty
+func (pm *ProcessManager) ListCrashes(name string) ([]Crash, error) {
+	entries, err := os.ReadDir(pm.GetCrashDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var crashes []Crash
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		crash, err := pm.GetCrash(entry.Name())
+		if err != nil {
+			continue // Skip incomplete records
+		}
+		if name == "" || crash.Process == name {
+			crashes = append(crashes, *crash)
+		}
+	}
+	sort.Slice(crashes, func(i, j int) bool { return crashes[i].Time.After(crashes[j].Time) })
+	return crashes, nil
+}
+
+// GetCrash reads a recorded crash by ID
+func (pm *ProcessManager) GetCrash(id string) (*Crash, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return nil, fmt.Errorf("invalid crash ID '%s'", id)
+	}
+	dir := filepath.Join(pm.GetCrashDir(), id)
+	data, err := os.ReadFile(filepath.Join(dir, CrashFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("crash '%s' not found", id)
+		}
+		return nil, err
+	}
+	var crash Crash
+	if err := json.Unmarshal(data, &crash); err != nil {
+		return nil, fmt.Errorf("invalid %s in crash '%s': %w", CrashFile, id, err)
+	}
+	crash.ID = id
+	crash.Dir = dir
+	return &crash, nil
+}
+
+// Output returns the log lines saved with a crash
+func (c Crash) Output() ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(c.Dir, CrashLogFile))
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
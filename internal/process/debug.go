@@ -0,0 +1,111 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultInspectPort is the port of the Node.js inspector unless the
+// process was started with --inspect-port
+const DefaultInspectPort = 9229
+
+// FindInGroup returns the lowest PID in the process group of the daemon
+// whose executable name starts with prefix, e.g. "python" or "node". The
+// daemon itself is usually a shell or launcher; this finds the
+// interpreter it started. It relies on /proc.
+func (p ProcessInfo) FindInGroup(prefix string) (int, error) {
+	if p.PID <= 0 {
+		return 0, fmt.Errorf("%s has no local process", p.Name)
+	}
+	if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(p.PID))); err != nil {
+		return 0, fmt.Errorf("no /proc entry for PID %d: %w", p.PID, err)
+	}
+
+	pids := groupPIDs(p.PID)
+	sort.Ints(pids)
+	for _, pid := range pids {
+		if strings.HasPrefix(executableName(pid), prefix) {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no %s process found in %s (%s)", prefix, p.Name, p.Ref())
+}
+
+// executableName returns the base name of a process's executable, or
+// its command name when the executable cannot be read
+func executableName(pid int) string {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	if exe, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+		return filepath.Base(strings.TrimSuffix(exe, " (deleted)"))
+	}
+	comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+	return strings.TrimSpace(string(comm))
+}
+
+// inspectPortFlag matches --inspect-port=N and the port of --inspect=[host:]N
+var inspectPortFlag = regexp.MustCompile(`^--inspect(?:-brk|-port)?=(?:.*:)?(\d+)$`)
+
+// inspectPort returns the inspector port a Node.js process was configured
+// with on its command line or in NODE_OPTIONS
+func inspectPort(pid int) int {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	var args []string
+	if data, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		args = strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "environ")); err == nil {
+		for _, kv := range strings.Split(string(data), "\x00") {
+			if options, ok := strings.CutPrefix(kv, "NODE_OPTIONS="); ok {
+				args = append(args, strings.Fields(options)...)
+			}
+		}
+	}
+	for _, arg := range args {
+		if m := inspectPortFlag.FindStringSubmatch(arg); m != nil {
+			if port, err := strconv.Atoi(m[1]); err == nil {
+				return port
+			}
+		}
+	}
+	return DefaultInspectPort
+}
+
+// EnableInspector opens the inspector of a running Node.js process by
+// sending it SIGUSR1 and returns the port it listens on once it does
+func EnableInspector(pid int, timeout time.Duration) (int, error) {
+	port := inspectPort(pid)
+	if err := signalInspector(pid); err != nil {
+		return 0, fmt.Errorf("failed to signal PID %d: %w", pid, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, listening := range ListeningPorts(pid) {
+			if listening == port {
+				return port, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return port, fmt.Errorf("inspector of PID %d is not listening on port %d after %s", pid, port, FormatDuration(timeout))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// PtraceScope returns the Yama ptrace restriction (0 when unrestricted
+// or not available). At 1 and above a debugger such as py-spy can only
+// attach to its own children unless it has CAP_SYS_PTRACE.
+func PtraceScope() int {
+	data, err := os.ReadFile("/proc/sys/kernel/yama/ptrace_scope")
+	if err != nil {
+		return 0
+	}
+	scope, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return scope
+}
@@ -0,0 +1,77 @@
+package process
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// EventsFile stores the lifecycle event log (one JSON object per line)
+const EventsFile = "events.jsonl"
+
+// Event records a notable lifecycle change for a sandbox process
+type Event struct {
+	Time    time.Time `json:"time"`
+	Process string    `json:"process"`
+	Type    string    `json:"type"` // e.g. idle-stop
+	Message string    `json:"message"`
+}
+
+// GetEventsFile returns the path to the event log
+func (pm *ProcessManager) GetEventsFile() string {
+	return filepath.Join(pm.GetStateDir(), EventsFile)
+}
+
+// RecordEvent appends an event to the project's event log
+func (pm *ProcessManager) RecordEvent(process, eventType, message string) error {
+	event := Event{
+		Time:    time.Now(),
+		Process: process,
+		Type:    eventType,
+		Message: message,
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(pm.GetStateDir(), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(pm.GetEventsFile(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// LoadEvents reads all recorded events, oldest first
+func (pm *ProcessManager) LoadEvents() ([]Event, error) {
+	f, err := os.Open(pm.GetEventsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Event{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue // Skip malformed lines
+		}
+		events = append(events, event)
+	}
+
+	return events, scanner.Err()
+}
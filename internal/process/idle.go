@@ -0,0 +1,176 @@
+package process
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IdlePollInterval is how often the idle watcher samples activity
+const IdlePollInterval = 15 * time.Second
+
+// WatchIdle blocks until the named daemon exits or has been idle for the
+// given timeout, in which case it is stopped and an idle-stop event is
+// recorded. A daemon is idle when its log file does not grow and none of
+// its processes hold an established TCP connection.
+func (pm *ProcessManager) WatchIdle(name string, timeout time.Duration) error {
+	info, err := pm.GetProcess(name)
+	if err != nil {
+		return err
+	}
+	pid := info.PID
+
+	lastActivity := time.Now()
+	lastLogSize, _ := pm.GetLogSize(name)
+
+	for {
+		time.Sleep(IdlePollInterval)
+
+		info, err := pm.GetProcess(name)
+		if err == nil && info.supervised() && info.Status != "stopped" {
+			if info.Status == "restarting" {
+				lastActivity = time.Now()
+				continue
+			}
+			if info.PID != pid {
+				// Restarted by its supervisor: watch the new process
+				pid = info.PID
+				lastActivity = time.Now()
+				lastLogSize, _ = pm.GetLogSize(name)
+				continue
+			}
+		}
+		if err != nil || info.PID != pid || !isActiveStatus(info.Status) || !IsProcessRunning(pid) {
+			// Daemon was stopped or replaced; nothing left to watch
+			return nil
+		}
+
+		// A paused daemon uses no resources, so it is never considered idle
+		if info.Status == "paused" {
+			lastActivity = time.Now()
+			continue
+		}
+
+		if size, err := pm.GetLogSize(name); err == nil && size != lastLogSize {
+			lastLogSize = size
+			lastActivity = time.Now()
+		}
+
+		if CountTCPConnections(pid) > 0 {
+			lastActivity = time.Now()
+		}
+
+		if time.Since(lastActivity) < timeout {
+			continue
+		}
+
+		message := fmt.Sprintf("no log output or TCP connections for %s", FormatDuration(time.Since(lastActivity)))
+		if err := pm.StopProcess(name); err != nil {
+			pm.RecordEvent(name, "idle-stop-failed", err.Error())
+			return err
+		}
+		return pm.RecordEvent(name, "idle-stop", message)
+	}
+}
+
+// CountTCPConnections returns the number of established TCP connections held
+// by the process group led by pid. It relies on /proc and returns 0 on
+// systems without it.
+func CountTCPConnections(pid int) int {
+	count := 0
+	scanTCP(socketInodes(pid), func(state string, localPort int) {
+		// State 01 is TCP_ESTABLISHED
+		if state == "01" {
+			count++
+		}
+	})
+	return count
+}
+
+// socketInodes returns the inodes of the sockets open in the process
+// group led by pid
+func socketInodes(pid int) map[string]bool {
+	inodes := make(map[string]bool)
+	for _, p := range groupPIDs(pid) {
+		fdDir := filepath.Join("/proc", strconv.Itoa(p), "fd")
+		entries, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			link, err := os.Readlink(filepath.Join(fdDir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			if strings.HasPrefix(link, "socket:[") {
+				inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+			}
+		}
+	}
+	return inodes
+}
+
+// scanTCP calls fn with the state and local port of every TCP socket in
+// /proc/net/tcp{,6} whose inode is in inodes
+func scanTCP(inodes map[string]bool, fn func(state string, localPort int)) {
+	if len(inodes) == 0 {
+		return
+	}
+
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // Skip header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || !inodes[fields[9]] {
+				continue
+			}
+			// local_address is ADDR:PORT in hex
+			_, portHex, _ := strings.Cut(fields[1], ":")
+			port, _ := strconv.ParseInt(portHex, 16, 32)
+			fn(fields[3], int(port))
+		}
+		f.Close()
+	}
+}
+
+// groupPIDs returns pid plus every process whose process group is pid
+func groupPIDs(pid int) []int {
+	pids := []int{pid}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return pids
+	}
+
+	for _, entry := range entries {
+		p, err := strconv.Atoi(entry.Name())
+		if err != nil || p == pid {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// Fields after the parenthesised command: state ppid pgrp ...
+		stat := string(data)
+		end := strings.LastIndex(stat, ")")
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(stat[end+1:])
+		if len(fields) >= 3 && fields[2] == strconv.Itoa(pid) {
+			pids = append(pids, p)
+		}
+	}
+
+	return pids
+}
@@ -0,0 +1,6 @@
+package process
+
+// setIOClass does nothing: macOS has no IO scheduling classes
+func setIOClass(class string, level int) error {
+	return nil
+}
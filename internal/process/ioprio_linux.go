@@ -0,0 +1,37 @@
+package process
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+const (
+	// ioprioWhoProcess selects a single process for ioprio_set(2)
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var ioClasses = map[string]int{
+	config.IOClassRealtime:   1,
+	config.IOClassBestEffort: 2,
+	config.IOClassIdle:       3,
+}
+
+// setIOClass sets the IO scheduling class and level of the current
+// process, as ionice -c does
+func setIOClass(class string, level int) error {
+	c, ok := ioClasses[class]
+	if !ok {
+		return fmt.Errorf("unknown IO class '%s'", class)
+	}
+	if class == config.IOClassIdle {
+		level = 0
+	}
+	prio := uintptr(c<<ioprioClassShift | level)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, prio); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// RlimitExecCommand is the hidden sbox subcommand that applies rlimits
+// and then execs the daemon command line
+const RlimitExecCommand = "rlimit-exec"
+
+// cgroupsAvailable reports whether resource limits can be delegated to a
+// transient systemd user scope on a cgroups v2 hierarchy
+func cgroupsAvailable() bool {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return false
+	}
+	if _, err := exec.LookPath("systemd-run"); err != nil {
+		return false
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(runtimeDir, "systemd", "private"))
+	return err == nil
+}
+
+// limitsPrefix returns the launcher command line that applies the
+// configured limits, priority, CPUs and ulimits, and one line per limit
+// describing how it is enforced (written to the daemon log). Memory, CPU
+// and process limits use a cgroup when available; open files are always
+// an rlimit. The priority is set with nice and ionice, and as cgroup
+// weights when a cgroup is available. CPUs are pinned with
+// sched_setaffinity. Ulimits are set before limits, which can lower them.
+func (pm *ProcessManager) limitsPrefix() ([]string, []string, error) {
+	l := pm.Limits
+	priority := pm.Priority
+	if l.IsZero() && priority.IsZero() && pm.CPUs == "" && pm.Ulimits.IsZero() {
+		return nil, nil, nil
+	}
+
+	var memory int64
+	if l.Memory != "" {
+		var err error
+		if memory, err = config.ParseSize(l.Memory); err != nil {
+			return nil, nil, fmt.Errorf("limits.memory: %w", err)
+		}
+	}
+
+	var prefix, notes []string
+
+	if cgroupsAvailable() && (memory > 0 || l.CPUShares > 0 || l.NProc > 0 || !priority.IsZero()) {
+		prefix = []string{"systemd-run", "--user", "--scope", "--quiet", "--collect"}
+		if memory > 0 {
+			prefix = append(prefix, "-p", fmt.Sprintf("MemoryMax=%d", memory))
+			notes = append(notes, fmt.Sprintf("memory %s (cgroup MemoryMax)", l.Memory))
+		}
+		if l.CPUShares > 0 {
+			prefix = append(prefix, "-p", fmt.Sprintf("CPUWeight=%d", cpuWeight(l.CPUShares)))
+			notes = append(notes, fmt.Sprintf("cpu_shares %d (cgroup CPUWeight)", l.CPUShares))
+		} else if priority.Nice != 0 {
+			weight := niceWeight(priority.Nice)
+			prefix = append(prefix, "-p", fmt.Sprintf("CPUWeight=%d", weight))
+			notes = append(notes, fmt.Sprintf("cpu weight %d for nice %d (cgroup CPUWeight)", weight, priority.Nice))
+		}
+		if weight := ioWeight(priority); weight > 0 {
+			prefix = append(prefix, "-p", fmt.Sprintf("IOWeight=%d", weight))
+			notes = append(notes, fmt.Sprintf("io weight %d (cgroup IOWeight)", weight))
+		}
+		if l.NProc > 0 {
+			prefix = append(prefix, "-p", fmt.Sprintf("TasksMax=%d", l.NProc))
+			notes = append(notes, fmt.Sprintf("nproc %d (cgroup TasksMax)", l.NProc))
+		}
+		// Already enforced by the scope
+		memory, l.NProc = 0, 0
+	} else if l.CPUShares > 0 {
+		notes = append(notes, fmt.Sprintf("cpu_shares %d NOT enforced (needs cgroups v2 and a systemd user session)", l.CPUShares))
+	}
+
+	if memory > 0 || l.NoFile > 0 || l.NProc > 0 || !priority.IsZero() || pm.CPUs != "" || !pm.Ulimits.IsZero() {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, nil, err
+		}
+		prefix = append(prefix, self, RlimitExecCommand)
+		if memory > 0 {
+			prefix = append(prefix, "--memory", strconv.FormatInt(memory, 10))
+			notes = append(notes, fmt.Sprintf("memory %s (rlimit address space)", l.Memory))
+		}
+		if l.NoFile > 0 {
+			prefix = append(prefix, "--nofile", strconv.Itoa(l.NoFile))
+			notes = append(notes, fmt.Sprintf("nofile %d (rlimit)", l.NoFile))
+		}
+		if l.NProc > 0 {
+			prefix = append(prefix, "--nproc", strconv.Itoa(l.NProc))
+			notes = append(notes, fmt.Sprintf("nproc %d (rlimit, counts all of the user's processes)", l.NProc))
+		}
+		prefix = append(prefix, priorityArgs(priority)...)
+		notes = append(notes, priorityNotes(priority)...)
+		prefix = append(prefix, affinityArgs(pm.CPUs)...)
+		notes = append(notes, affinityNotes(pm.CPUs)...)
+		prefix = append(prefix, ulimitArgs(pm.Ulimits)...)
+		notes = append(notes, ulimitNotes(pm.Ulimits)...)
+		prefix = append(prefix, "--")
+	}
+
+	return prefix, notes, nil
+}
+
+// cpuWeight converts cgroups v1 style shares (default 1024) to a
+// cgroups v2 CPUWeight (default 100, range 1-10000)
+func cpuWeight(shares int) int {
+	weight := shares * 100 / 1024
+	if weight < 1 {
+		return 1
+	}
+	if weight > 10000 {
+		return 10000
+	}
+	return weight
+}
+
+// ExecWithLimits sets the given rlimits (zero means unchanged) on the
+// current process and replaces it with argv. It only returns on error.
+func ExecWithLimits(memory int64, nofile, nproc int, argv []string) error {
+	limits := []struct {
+		resource int
+		value    uint64
+		name     string
+	}{
+		{rlimitAS, uint64(memory), "memory"},
+		{rlimitNofile, uint64(nofile), "nofile"},
+		{rlimitNproc, uint64(nproc), "nproc"},
+	}
+	for _, l := range limits {
+		if l.value == 0 {
+			continue
+		}
+		if err := setRlimit(l.resource, l.value, l.value); err != nil {
+			return fmt.Errorf("failed to set %s limit: %w", l.name, err)
+		}
+	}
+
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+	return execve(path, argv)
+}
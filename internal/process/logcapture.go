@@ -0,0 +1,307 @@
+package process
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Streams of a structured log line
+const (
+	StreamStdout = "out"
+	StreamStderr = "err"
+)
+
+// LogTimeFormat is the capture time at the start of structured log
+// lines: RFC 3339 with milliseconds
+const LogTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// LogIndexSuffix names the index of a structured log, next to it
+const LogIndexSuffix = ".index.json"
+
+const (
+	// indexInterval and indexBytes bound the time and log size between
+	// index entries, which bounds what 'sbox logs --since' reads
+	indexInterval = 10 * time.Second
+	indexBytes    = 1 << 20
+)
+
+// LogLine is a line of a daemon log. Lines of logs captured without
+// logging.structured have no time or stream.
+type LogLine struct {
+	Time   time.Time `json:"time,omitempty"`
+	Stream string    `json:"stream,omitempty"`
+	Text   string    `json:"text"`
+}
+
+// structuredLine matches "<time> <stream> <text>"
+var structuredLine = regexp.MustCompile(`^(\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}(?:Z|[+-]\d\d:\d\d)) (out|err) (.*)$`)
+
+// ParseLogLine splits a structured log line into its parts; other lines
+// are returned as text
+func ParseLogLine(line string) LogLine {
+	m := structuredLine.FindStringSubmatch(line)
+	if m == nil {
+		return LogLine{Text: line}
+	}
+	t, err := time.Parse(LogTimeFormat, m[1])
+	if err != nil {
+		return LogLine{Text: line}
+	}
+	return LogLine{Time: t, Stream: m[2], Text: m[3]}
+}
+
+// String formats a line as it is stored
+func (l LogLine) String() string {
+	if l.Time.IsZero() {
+		return l.Text
+	}
+	return l.Time.Format(LogTimeFormat) + " " + l.Stream + " " + l.Text
+}
+
+// logIndex maps capture times to offsets in the current log file, in
+// order. It is rewritten as the log grows and reset when it is rotated.
+type logIndex struct {
+	Entries []logIndexEntry `json:"entries"`
+}
+
+type logIndexEntry struct {
+	Time   time.Time `json:"time"`
+	Offset int64     `json:"offset"`
+}
+
+func loadLogIndex(path string) (*logIndex, error) {
+	data, err := os.ReadFile(path + LogIndexSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var index logIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+func (x *logIndex) save(path string) error {
+	data, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	tmp := path + LogIndexSuffix + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+LogIndexSuffix)
+}
+
+// offset returns where the lines captured at or after since start, at
+// the latest
+func (x *logIndex) offset(since time.Time) int64 {
+	i := sort.Search(len(x.Entries), func(i int) bool { return x.Entries[i].Time.After(since) })
+	if i == 0 {
+		return 0
+	}
+	return x.Entries[i-1].Offset
+}
+
+// WriteStructuredLog appends the lines read from stdout and stderr to the
+// log at path, each prefixed with the time it was read and its stream,
+// rotating the log by policy and keeping its index. It returns once both
+// are at EOF; stderr may be nil when the streams arrive merged.
+func WriteStructuredLog(path string, policy LogRotation, stdout, stderr io.Reader) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	size := info.Size()
+
+	// Continue the index of an earlier run unless the log was replaced
+	index, err := loadLogIndex(path)
+	if err != nil || (len(index.Entries) > 0 && index.Entries[len(index.Entries)-1].Offset > size) {
+		index = &logIndex{}
+	}
+	var lastEntry time.Time
+	var lastOffset int64
+	if n := len(index.Entries); n > 0 {
+		lastEntry, lastOffset = index.Entries[n-1].Time, index.Entries[n-1].Offset
+	}
+
+	lines := make(chan LogLine)
+	var wg sync.WaitGroup
+	read := func(r io.Reader, stream string) {
+		defer wg.Done()
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				lines <- LogLine{Time: time.Now(), Stream: stream, Text: strings.TrimRight(line, "\r\n")}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	wg.Add(1)
+	go read(stdout, StreamStdout)
+	if stderr != nil {
+		wg.Add(1)
+		go read(stderr, StreamStderr)
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	for line := range lines {
+		data := line.String() + "\n"
+		if policy.Enabled() && size > 0 && size+int64(len(data)) > policy.MaxSize {
+			f.Close()
+			if err := rotateLog(path, policy); err != nil {
+				fmt.Fprintf(os.Stderr, "log rotation failed: %s\n", err)
+			}
+			if f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+				return err
+			}
+			size = 0
+			index = &logIndex{}
+		}
+
+		if len(index.Entries) == 0 || line.Time.Sub(lastEntry) >= indexInterval || size-lastOffset >= indexBytes {
+			index.Entries = append(index.Entries, logIndexEntry{Time: line.Time, Offset: size})
+			lastEntry, lastOffset = line.Time, size
+			if err := index.save(path); err != nil {
+				fmt.Fprintf(os.Stderr, "log index update failed: %s\n", err)
+			}
+		}
+		n, _ := f.WriteString(data)
+		size += int64(n)
+	}
+	return f.Close()
+}
+
+// StructuredLog reports whether a daemon's log was captured with
+// timestamps and streams
+func (pm *ProcessManager) StructuredLog(name string) bool {
+	_, err := os.Stat(pm.GetLogFile(name) + LogIndexSuffix)
+	return err == nil
+}
+
+// LastLogEntries returns the last n lines of a process log
+func (pm *ProcessManager) LastLogEntries(name string, n int) ([]LogLine, error) {
+	if _, err := os.Stat(pm.GetLogFile(name)); os.IsNotExist(err) {
+		return nil, fmt.Errorf("no logs found for '%s'", name)
+	}
+	lines, err := pm.lastLines(name, n)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LogLine, len(lines))
+	for i, line := range lines {
+		entries[i] = ParseLogLine(line)
+	}
+	return entries, nil
+}
+
+// LogEntriesBetween returns the lines of a daemon's log captured between
+// since and until (zero values leave that end open). Structured logs are
+// read from the index entry before since; other logs are placed in time
+// as LogLinesBetween does.
+func (pm *ProcessManager) LogEntriesBetween(name string, since, until time.Time) ([]LogLine, error) {
+	if !pm.StructuredLog(name) {
+		lines, err := pm.LogLinesBetween(name, since, until)
+		entries := make([]LogLine, len(lines))
+		for i, line := range lines {
+			entries[i] = LogLine{Text: line}
+		}
+		return entries, err
+	}
+
+	segments := pm.logSegments(name)
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("no logs found for '%s'", name)
+	}
+	current := segments[len(segments)-1]
+
+	// Lines without a timestamp, such as the Command: line under a start
+	// header or the exit footer, go with the line before them
+	var result []LogLine
+	lastKept := since.IsZero()
+	keep := func(line LogLine) {
+		when := lineTime(line)
+		if !when.IsZero() {
+			lastKept = (since.IsZero() || !when.Before(since)) && (until.IsZero() || !when.After(until))
+		}
+		if lastKept {
+			result = append(result, line)
+		}
+	}
+
+	// Rotated files hold older lines; skip those last written before since
+	for _, segment := range segments[:len(segments)-1] {
+		if !since.IsZero() && segment.modTime.Before(since) {
+			continue
+		}
+		lines, err := readSegment(segment.path)
+		if err != nil {
+			return result, err
+		}
+		for _, line := range lines {
+			keep(ParseLogLine(line))
+		}
+	}
+
+	f, err := os.Open(current.path)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+	if index, err := loadLogIndex(current.path); err == nil && !since.IsZero() {
+		if _, err := f.Seek(index.offset(since), io.SeekStart); err != nil {
+			return result, err
+		}
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := ParseLogLine(scanner.Text())
+		if when := lineTime(line); !until.IsZero() && when.After(until) {
+			break
+		}
+		keep(line)
+	}
+	return result, scanner.Err()
+}
+
+// lineTime returns when a structured log line was captured, the start
+// time of a daemon start header, or zero
+func lineTime(line LogLine) time.Time {
+	if !line.Time.IsZero() {
+		return line.Time
+	}
+	if m := startedHeader.FindStringSubmatch(line.Text); m != nil {
+		when, _ := time.Parse(time.RFC3339, m[1])
+		return when
+	}
+	return time.Time{}
+}
+
+// FollowLogEntries calls fn for every line appended to a process log
+// until done is closed
+func (pm *ProcessManager) FollowLogEntries(name string, done <-chan struct{}, fn func(line LogLine)) error {
+	if _, err := os.Stat(pm.GetLogFile(name)); err != nil {
+		return fmt.Errorf("no logs found for '%s'", name)
+	}
+	return followFile(pm.GetLogFile(name), done, func(line string) { fn(ParseLogLine(line)) })
+}
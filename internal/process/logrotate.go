@@ -0,0 +1,381 @@
+package process
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/sysproc"
+)
+
+// LogWriterCommand is the hidden sbox subcommand daemon output is piped
+// through when logs are rotated
+const LogWriterCommand = "log-writer"
+
+// StderrFD3Flag tells the log writer that fd 3 is the daemon's stderr
+const StderrFD3Flag = "stderr-fd3"
+
+// DefaultLogFiles is the number of rotated logs kept when logging.max_files
+// is not set
+const DefaultLogFiles = 5
+
+// LogRotation rotates a daemon log once it reaches MaxSize bytes. The
+// rotated files are name.log.1 (the newest) to name.log.<MaxFiles>, with
+// a .gz suffix when compressed. Structured logs are written through the
+// log writer as well, even when they are not rotated.
+type LogRotation struct {
+	MaxSize    int64
+	MaxFiles   int
+	Compress   bool
+	Structured bool
+}
+
+// ParseLogRotation reads the logging section of config.yaml
+func ParseLogRotation(cfg config.LoggingConfig) (LogRotation, error) {
+	r := LogRotation{MaxFiles: cfg.MaxFiles, Compress: cfg.Compress, Structured: cfg.Structured}
+	if cfg.MaxSize != "" {
+		size, err := config.ParseSize(cfg.MaxSize)
+		if err != nil {
+			return LogRotation{}, err
+		}
+		r.MaxSize = size
+	}
+	if r.MaxFiles <= 0 {
+		r.MaxFiles = DefaultLogFiles
+	}
+	return r, nil
+}
+
+// Enabled reports whether logs are rotated
+func (r LogRotation) Enabled() bool {
+	return r.MaxSize > 0
+}
+
+// Args are the flags of the log-writer and supervise commands for r
+func (r LogRotation) Args() []string {
+	var args []string
+	if r.Enabled() {
+		args = append(args, "--log-max-size", strconv.FormatInt(r.MaxSize, 10), "--log-max-files", strconv.Itoa(r.MaxFiles))
+		if r.Compress {
+			args = append(args, "--log-compress")
+		}
+	}
+	if r.Structured {
+		args = append(args, "--log-structured")
+	}
+	return args
+}
+
+// Piped reports whether daemon output goes through the log writer
+func (r LogRotation) Piped() bool {
+	return r.Enabled() || r.Structured
+}
+
+// startLogWriter starts 'sbox log-writer' appending to logFile with
+// rotation and returns the pipe to write the daemon's output to, and for
+// structured logs a second one for its stderr (nil where the writer
+// cannot be handed one). The writer runs in its own session, so stopping
+// the daemon's process group does not lose the output still in the pipe;
+// it exits at EOF, once every process holding the pipes has exited.
+func (pm *ProcessManager) startLogWriter(logFile string) (*os.File, *os.File, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	args := append([]string{LogWriterCommand}, pm.Rotation.Args()...)
+	writer := exec.Command(self, append(args, logFile)...)
+	writer.Stdin = r
+	writer.SysProcAttr = sysproc.Detached()
+
+	var errW *os.File
+	if pm.Rotation.Structured && separateStreams {
+		errR, pipeW, err := os.Pipe()
+		if err != nil {
+			w.Close()
+			return nil, nil, err
+		}
+		defer errR.Close()
+		errW = pipeW
+		writer.ExtraFiles = []*os.File{errR}
+		writer.Args = append(writer.Args, "--"+StderrFD3Flag)
+	}
+
+	if err := writer.Start(); err != nil {
+		w.Close()
+		if errW != nil {
+			errW.Close()
+		}
+		return nil, nil, fmt.Errorf("failed to start log writer: %w", err)
+	}
+	writer.Process.Release()
+	return w, errW, nil
+}
+
+// WriteLog appends the lines read from r to the log at path, rotating it
+// by policy. It returns at EOF.
+func WriteLog(path string, policy LogRotation, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	size := info.Size()
+
+	reader := bufio.NewReader(r)
+	for {
+		// Whole lines are written so no line is split across files
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if policy.Enabled() && size > 0 && size+int64(len(line)) > policy.MaxSize {
+				f.Close()
+				if err := rotateLog(path, policy); err != nil {
+					fmt.Fprintf(os.Stderr, "log rotation failed: %s\n", err)
+				}
+				if f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+					return err
+				}
+				size = 0
+			}
+			n, _ := f.Write(line)
+			size += int64(n)
+		}
+		if readErr == io.EOF {
+			return f.Close()
+		}
+		if readErr != nil {
+			f.Close()
+			return readErr
+		}
+	}
+}
+
+// rotateLog shifts path.1 .. path.<MaxFiles-1> up by one, dropping the
+// oldest, and moves path to path.1
+func rotateLog(path string, policy LogRotation) error {
+	for _, ext := range []string{"", ".gz"} {
+		os.Remove(fmt.Sprintf("%s.%d%s", path, policy.MaxFiles, ext))
+	}
+	for i := policy.MaxFiles - 1; i >= 1; i-- {
+		for _, ext := range []string{"", ".gz"} {
+			old := fmt.Sprintf("%s.%d%s", path, i, ext)
+			if _, err := os.Stat(old); err == nil {
+				if err := os.Rename(old, fmt.Sprintf("%s.%d%s", path, i+1, ext)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+	if policy.Compress {
+		return compressLog(rotated)
+	}
+	return nil
+}
+
+// compressLog replaces path with path.gz, keeping its modification time,
+// which 'sbox logs --since' relies on
+func compressLog(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	os.Chtimes(path+".gz", info.ModTime(), info.ModTime())
+	return os.Remove(path)
+}
+
+// logSegment is one file of a daemon's log
+type logSegment struct {
+	path    string
+	modTime time.Time
+}
+
+// rotatedSuffix matches the suffix of rotated logs: .1, .2.gz, ...
+var rotatedSuffix = regexp.MustCompile(`^\.(\d+)(\.gz)?$`)
+
+// LogFiles returns the files of a daemon's log, rotated ones first and
+// the current log last
+func (pm *ProcessManager) LogFiles(name string) []string {
+	var paths []string
+	for _, segment := range pm.logSegments(name) {
+		paths = append(paths, segment.path)
+	}
+	return paths
+}
+
+// logSegments returns the files of a daemon's log, oldest first
+func (pm *ProcessManager) logSegments(name string) []logSegment {
+	current := pm.GetLogFile(name)
+	type numbered struct {
+		logSegment
+		n int
+	}
+	var rotated []numbered
+	matches, _ := filepath.Glob(current + ".*")
+	for _, path := range matches {
+		m := rotatedSuffix.FindStringSubmatch(strings.TrimPrefix(path, current))
+		if m == nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		rotated = append(rotated, numbered{logSegment{path, info.ModTime()}, n})
+	}
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].n > rotated[j].n })
+
+	var segments []logSegment
+	for _, r := range rotated {
+		segments = append(segments, r.logSegment)
+	}
+	if info, err := os.Stat(current); err == nil {
+		segments = append(segments, logSegment{current, info.ModTime()})
+	}
+	return segments
+}
+
+// readSegment returns the lines of a log file, decompressing .gz files
+func readSegment(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// startedHeader matches the header spawn writes when a daemon starts
+var startedHeader = regexp.MustCompile(`^=== sbox daemon started at (\S+) ===$`)
+
+// LogLinesBetween returns the lines of a daemon's log, across rotated
+// files, that may have been written between since and until (zero
+// values leave that end open). Log lines carry no timestamps, so each is
+// placed between the daemon start headers and file modification times
+// around it, and kept when that window overlaps the requested one.
+// Structured logs are selected by their capture times.
+func (pm *ProcessManager) LogLinesBetween(name string, since, until time.Time) ([]string, error) {
+	if pm.StructuredLog(name) {
+		entries, err := pm.LogEntriesBetween(name, since, until)
+		lines := make([]string, len(entries))
+		for i, entry := range entries {
+			lines[i] = entry.Text
+		}
+		return lines, err
+	}
+
+	segments := pm.logSegments(name)
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("no logs found for '%s'", name)
+	}
+
+	var result []string
+	var segmentStart time.Time
+	for _, segment := range segments {
+		lines, err := readSegment(segment.path)
+		if err != nil {
+			return result, err
+		}
+
+		// A line was written after the last header before it and before
+		// the next header after it
+		starts := make([]time.Time, len(lines))
+		ends := make([]time.Time, len(lines))
+		lo := segmentStart
+		for i, line := range lines {
+			if m := startedHeader.FindStringSubmatch(line); m != nil {
+				if t, err := time.Parse(time.RFC3339, m[1]); err == nil && t.After(lo) {
+					lo = t
+				}
+			}
+			starts[i] = lo
+		}
+		hi := segment.modTime
+		for i := len(lines) - 1; i >= 0; i-- {
+			if m := startedHeader.FindStringSubmatch(lines[i]); m != nil {
+				// Header times are truncated to the second
+				if t, err := time.Parse(time.RFC3339, m[1]); err == nil && t.Add(time.Second).Before(hi) {
+					hi = t.Add(time.Second)
+				}
+			}
+			ends[i] = hi
+		}
+
+		for i, line := range lines {
+			if !since.IsZero() && ends[i].Before(since) {
+				continue
+			}
+			if !until.IsZero() && starts[i].After(until) {
+				continue
+			}
+			result = append(result, line)
+		}
+		segmentStart = segment.modTime
+	}
+	return result, nil
+}
@@ -0,0 +1,300 @@
+package process
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// UsageFile stores metered resource usage (one JSON object per line)
+const UsageFile = "usage.jsonl"
+
+const (
+	// MeterSampleInterval is how often 'sbox meter' samples a daemon
+	MeterSampleInterval = 30 * time.Second
+	// MeterRecordInterval is how often it appends the usage since its
+	// last record, and when the daemon exits
+	MeterRecordInterval = 5 * time.Minute
+)
+
+// Kinds of metered usage
+const (
+	UsageDaemon = "daemon"
+	UsageRun    = "run"
+	UsageExec   = "exec"
+	UsageShell  = "shell"
+)
+
+// UsageRecord is the resource usage of a sandbox process over the period
+// ending at Time. Foreground commands are recorded when they exit under
+// their kind (run, exec or shell) as the process name.
+type UsageRecord struct {
+	Time    time.Time `json:"time"`
+	Project string    `json:"project"`
+	User    string    `json:"user,omitempty"`
+	Process string    `json:"process"`
+	Kind    string    `json:"kind"`
+	// Seconds is the wall time the record covers
+	Seconds    float64 `json:"seconds"`
+	CPUSeconds float64 `json:"cpu_seconds"`
+	ReadBytes  int64   `json:"read_bytes"`
+	WriteBytes int64   `json:"write_bytes"`
+	// MaxRSS is the largest resident set seen in the period
+	MaxRSS int64 `json:"max_rss_bytes,omitempty"`
+}
+
+// GetUsageFile returns the path to the usage log of this manager's
+// namespace
+func (pm *ProcessManager) GetUsageFile() string {
+	return filepath.Join(pm.GetStateDir(), UsageFile)
+}
+
+// GetGlobalUsageFile returns the usage log covering every project of the
+// current user
+func GetGlobalUsageFile() (string, error) {
+	dir, err := config.GetGlobalSboxDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, UsageFile), nil
+}
+
+// RecordUsage appends a usage record to the project's usage log and to
+// the user's global one
+func (pm *ProcessManager) RecordUsage(record UsageRecord) error {
+	record.Project = pm.ProjectRoot
+	record.User = currentUsername()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err := appendLine(pm.GetUsageFile(), data); err != nil {
+		return err
+	}
+	if global, err := GetGlobalUsageFile(); err == nil {
+		appendLine(global, data)
+	}
+	return nil
+}
+
+// appendLine appends a line to a file, creating its directory
+func appendLine(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// ForegroundUsage returns the usage of a foreground command of the given
+// kind from its exit status. The usage of a process includes the
+// processes it waited for.
+func ForegroundUsage(kind string, state *os.ProcessState, started time.Time) UsageRecord {
+	record := UsageRecord{
+		Time:    time.Now(),
+		Process: kind,
+		Kind:    kind,
+		Seconds: time.Since(started).Seconds(),
+	}
+	if state == nil {
+		return record
+	}
+	record.CPUSeconds = (state.UserTime() + state.SystemTime()).Seconds()
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		record.MaxRSS = MaxRSSBytes(usage)
+		record.ReadBytes, record.WriteBytes = rusageIO(usage)
+	}
+	return record
+}
+
+// Meter samples the usage of the named daemon and records it until the
+// daemon exits, following restarts by its supervisor. It is meant to run
+// in the detached 'sbox meter' process. Usage of the group's processes
+// that exit between two samples without being waited for is not seen.
+func (pm *ProcessManager) Meter(name string) error {
+	info, err := pm.GetProcess(name)
+	if err != nil {
+		return err
+	}
+	pid := info.PID
+
+	// Counters start at zero with the daemon
+	prev := &Usage{Time: info.StartTime}
+	pending := UsageRecord{Process: name, Kind: UsageDaemon}
+	lastRecord := time.Now()
+
+	flush := func() {
+		if pending.Seconds > 0 {
+			pending.Time = prev.Time
+			pm.RecordUsage(pending)
+		}
+		pending = UsageRecord{Process: name, Kind: UsageDaemon}
+		lastRecord = time.Now()
+	}
+	defer flush()
+
+	for {
+		time.Sleep(MeterSampleInterval)
+
+		info, err := pm.GetProcess(name)
+		if err == nil && info.supervised() && info.Status != "stopped" {
+			if info.Status == "restarting" {
+				continue
+			}
+			if info.PID != pid {
+				// Restarted by its supervisor: meter the new process
+				pid = info.PID
+				prev = &Usage{Time: info.StartTime}
+			}
+		}
+		if err != nil || info.PID != pid || !isActiveStatus(info.Status) || !IsProcessRunning(pid) {
+			// Record how an unsupervised daemon died before 'sbox ps'
+			// gets to it
+			pm.UpdateProcessStatus()
+			return nil
+		}
+
+		usage, err := info.Usage()
+		if err != nil {
+			return nil
+		}
+		pm.recordMemory(name, pid, MemorySample{Time: usage.Time, RSS: usage.RSS, PIDs: groupPIDs(pid)})
+		addUsage(&pending, prev, usage)
+		prev = usage
+
+		if time.Since(lastRecord) >= MeterRecordInterval {
+			flush()
+		}
+	}
+}
+
+// addUsage adds the usage between two samples to a record. Counters of
+// processes that exited in between are gone, so nothing is negative.
+func addUsage(record *UsageRecord, prev, now *Usage) {
+	nonNegative := func(v float64) float64 {
+		if v < 0 {
+			return 0
+		}
+		return v
+	}
+	record.Seconds += nonNegative(now.Time.Sub(prev.Time).Seconds())
+	record.CPUSeconds += nonNegative(now.CPUSeconds + now.ChildCPUSeconds - prev.CPUSeconds - prev.ChildCPUSeconds)
+	record.ReadBytes += int64(nonNegative(float64(now.ReadBytes - prev.ReadBytes)))
+	record.WriteBytes += int64(nonNegative(float64(now.WriteBytes - prev.WriteBytes)))
+	record.MaxRSS = max(record.MaxRSS, now.RSS)
+}
+
+// LoadUsage reads the usage records of the project since a time, oldest
+// first. Shared projects include the records of every user.
+func (pm *ProcessManager) LoadUsage(since time.Time) ([]UsageRecord, error) {
+	paths := []string{filepath.Join(pm.SboxDir, UsageFile)}
+	if users, err := os.ReadDir(filepath.Join(pm.SboxDir, "users")); err == nil {
+		for _, user := range users {
+			paths = append(paths, filepath.Join(pm.SboxDir, "users", user.Name(), UsageFile))
+		}
+	}
+
+	var records []UsageRecord
+	for _, path := range paths {
+		loaded, err := loadUsageFile(path, since)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, loaded...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+// LoadGlobalUsage reads the usage records of every project of the
+// current user since a time, oldest first
+func LoadGlobalUsage(since time.Time) ([]UsageRecord, error) {
+	path, err := GetGlobalUsageFile()
+	if err != nil {
+		return nil, err
+	}
+	return loadUsageFile(path, since)
+}
+
+func loadUsageFile(path string, since time.Time) ([]UsageRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []UsageRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue // Skip malformed lines
+		}
+		if !record.Time.Before(since) {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// UsageTotal is the usage of one process or project summed over records
+type UsageTotal struct {
+	Key        string    `json:"key"`
+	Kind       string    `json:"kind,omitempty"`
+	Records    int       `json:"records"`
+	Seconds    float64   `json:"seconds"`
+	CPUSeconds float64   `json:"cpu_seconds"`
+	ReadBytes  int64     `json:"read_bytes"`
+	WriteBytes int64     `json:"write_bytes"`
+	MaxRSS     int64     `json:"max_rss_bytes"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// SumUsage adds up records by the key key returns, by decreasing CPU time
+func SumUsage(records []UsageRecord, key func(UsageRecord) string) []UsageTotal {
+	byKey := make(map[string]*UsageTotal)
+	var order []string
+	for _, r := range records {
+		k := key(r)
+		t := byKey[k]
+		if t == nil {
+			t = &UsageTotal{Key: k, Kind: r.Kind}
+			byKey[k] = t
+			order = append(order, k)
+		}
+		if t.Kind != r.Kind {
+			t.Kind = ""
+		}
+		t.Records++
+		t.Seconds += r.Seconds
+		t.CPUSeconds += r.CPUSeconds
+		t.ReadBytes += r.ReadBytes
+		t.WriteBytes += r.WriteBytes
+		t.MaxRSS = max(t.MaxRSS, r.MaxRSS)
+		if r.Time.After(t.LastSeen) {
+			t.LastSeen = r.Time
+		}
+	}
+
+	totals := make([]UsageTotal, 0, len(order))
+	for _, k := range order {
+		totals = append(totals, *byKey[k])
+	}
+	sort.SliceStable(totals, func(i, j int) bool { return totals[i].CPUSeconds > totals[j].CPUSeconds })
+	return totals
+}
@@ -0,0 +1,193 @@
+package process
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// oomRSSShare is the share of the memory ceiling (limits.memory, or the
+// host's memory without it) a daemon must have used at its last sample
+// for a SIGKILL to count as running out of memory
+const oomRSSShare = 0.8
+
+var (
+	// oomKillPattern matches the OOM killer's messages in the kernel log,
+	// e.g. "Out of memory: Killed process 1234 (python) ..." and
+	// "oom-kill:constraint=CONSTRAINT_MEMCG,...,task=python,pid=1234,uid=1000"
+	oomKillPattern = regexp.MustCompile(`(?:Killed process |oom-kill:.*[,:]pid=)(\d+)\b`)
+	// dmesgStamp is the time since boot dmesg prefixes messages with
+	dmesgStamp = regexp.MustCompile(`^\[\s*(\d+\.\d+)\]\s*`)
+)
+
+// MemorySample is the memory of a daemon when 'sbox meter' last sampled
+// it, kept to tell whether it ran out of memory when it dies
+type MemorySample struct {
+	Time time.Time `json:"time"`
+	RSS  int64     `json:"rss_bytes"`
+	// PIDs are the processes of the daemon's group; the OOM killer picks
+	// the largest, which is rarely the shell that leads the group
+	PIDs []int `json:"pids,omitempty"`
+}
+
+// recordMemory keeps a memory sample on the entry of a daemon, unless it
+// was replaced by another process of the same name
+func (pm *ProcessManager) recordMemory(name string, pid int, sample MemorySample) error {
+	return pm.UpdateProcesses(func(processes []ProcessInfo) ([]ProcessInfo, error) {
+		for i := range processes {
+			if processes[i].Name == name && processes[i].PID == pid {
+				processes[i].Memory = &sample
+				return processes, nil
+			}
+		}
+		return nil, nil
+	})
+}
+
+// oomKilled reports whether a daemon that died from signal sig (0 when
+// unknown) was killed for running out of memory, and why: the kernel log
+// shows the OOM killer picked one of its processes, or a SIGKILL came
+// shortly after it used most of its memory ceiling
+func (pm *ProcessManager) oomKilled(p ProcessInfo, sig syscall.Signal) (string, bool) {
+	pids := []int{p.PID}
+	if p.Memory != nil {
+		pids = append(pids, p.Memory.PIDs...)
+	}
+	if message, ok := kernelOOMKill(pids, p.StartTime); ok {
+		return "kernel OOM killer: " + message, true
+	}
+
+	if sig != syscall.SIGKILL || p.Memory == nil || time.Since(p.Memory.Time) > 2*MeterSampleInterval {
+		return "", false
+	}
+	ceiling, source := pm.memoryCeiling()
+	if ceiling <= 0 || float64(p.Memory.RSS) < oomRSSShare*float64(ceiling) {
+		return "", false
+	}
+	return fmt.Sprintf("killed by SIGKILL after using %s of %s %s",
+		FormatBytes(p.Memory.RSS), FormatBytes(ceiling), source), true
+}
+
+// markIfOOMKilled records an OOM kill of a daemon that died from signal
+// sig and returns its status: oom-killed, or fallback
+func (pm *ProcessManager) markIfOOMKilled(p ProcessInfo, sig syscall.Signal, fallback string) string {
+	reason, ok := pm.oomKilled(p, sig)
+	if !ok {
+		return fallback
+	}
+	pm.RecordEvent(p.Name, "oom-killed", reason)
+	return "oom-killed"
+}
+
+// OOMHint suggests how to keep daemons from running out of memory again
+func (pm *ProcessManager) OOMHint() string {
+	if pm.Limits.Memory != "" {
+		return fmt.Sprintf("Raise limits.memory (now %s) with 'sbox config set limits.memory <size>', or reduce the daemon's memory use", pm.Limits.Memory)
+	}
+	return "Set limits.memory (e.g. 'sbox config set limits.memory 4G') to contain it before the host runs out, or reduce the daemon's memory use"
+}
+
+// memoryCeiling returns the memory a daemon can use and where the limit
+// comes from
+func (pm *ProcessManager) memoryCeiling() (int64, string) {
+	if pm.Limits.Memory != "" {
+		if n, err := config.ParseSize(pm.Limits.Memory); err == nil && n > 0 {
+			return n, "limits.memory"
+		}
+	}
+	return hostMemory(), "host memory"
+}
+
+// hostMemory returns MemTotal from /proc/meminfo, or 0 without it
+func hostMemory() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       16314388 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// kernelOOMKill searches the kernel log since a time for an OOM kill of
+// one of pids and returns its message
+func kernelOOMKill(pids []int, since time.Time) (string, bool) {
+	wanted := make(map[int]bool, len(pids))
+	for _, pid := range pids {
+		wanted[pid] = true
+	}
+	for _, line := range kernelLog(since) {
+		m := oomKillPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if pid, _ := strconv.Atoi(m[1]); wanted[pid] {
+			return strings.TrimSpace(line), true
+		}
+	}
+	return "", false
+}
+
+// kernelLog returns the kernel messages since a time, from dmesg or, where
+// unprivileged users cannot read it (kernel.dmesg_restrict), from
+// journalctl -k. It returns nil when neither is readable.
+func kernelLog(since time.Time) []string {
+	// Older messages may name a reused PID; btime has whole seconds
+	since = since.Add(-time.Second)
+
+	if out, err := exec.Command("dmesg").Output(); err == nil {
+		boot := bootTime()
+		var lines []string
+		for _, line := range strings.Split(string(out), "\n") {
+			if m := dmesgStamp.FindStringSubmatch(line); m != nil {
+				secs, _ := strconv.ParseFloat(m[1], 64)
+				if !boot.IsZero() && boot.Add(time.Duration(secs*float64(time.Second))).Before(since) {
+					continue
+				}
+				line = line[len(m[0]):]
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	out, err := exec.Command("journalctl", "-k", "-q", "--no-pager", "-o", "cat",
+		"--since", since.Format("2006-01-02 15:04:05")).Output()
+	if err != nil {
+		return nil
+	}
+	return strings.Split(string(out), "\n")
+}
+
+// bootTime returns when the host booted, from btime in /proc/stat, or the
+// zero time without it
+func bootTime() time.Time {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "btime "); ok {
+			if secs, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+				return time.Unix(secs, 0)
+			}
+		}
+	}
+	return time.Time{}
+}
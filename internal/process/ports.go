@@ -0,0 +1,36 @@
+package process
+
+import "sort"
+
+// ListeningPorts returns the TCP ports the process group led by pid
+// listens on, in ascending order. It relies on /proc and returns nothing
+// on systems without it.
+func ListeningPorts(pid int) []int {
+	seen := make(map[int]bool)
+	scanTCP(socketInodes(pid), func(state string, localPort int) {
+		// State 0A is TCP_LISTEN
+		if state == "0A" {
+			seen[localPort] = true
+		}
+	})
+
+	ports := make([]int, 0, len(seen))
+	for port := range seen {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// samePorts reports whether two sorted port lists are equal
+func samePorts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package process
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// SetPriority applies a priority to the current process; the command it
+// execs and that command's children inherit it
+func SetPriority(p config.Priority) error {
+	if p.Nice != 0 {
+		if err := setNice(p.Nice); err != nil {
+			return fmt.Errorf("failed to set nice %d: %w", p.Nice, err)
+		}
+	}
+	if p.IOClass != "" {
+		if err := setIOClass(p.IOClass, ioLevel(p.Nice)); err != nil {
+			return fmt.Errorf("failed to set io_class %s: %w", p.IOClass, err)
+		}
+	}
+	return nil
+}
+
+// SetAffinity pins the current process to the CPUs of a cpus: list; the
+// command it execs and that command's children inherit it
+func SetAffinity(cpus string) error {
+	if cpus == "" {
+		return nil
+	}
+	list, err := config.ParseCPUList(cpus)
+	if err != nil {
+		return err
+	}
+	if err := setAffinity(list); err != nil {
+		return fmt.Errorf("failed to pin to cpus %s: %w", cpus, err)
+	}
+	return nil
+}
+
+// LaunchPrefix returns the launcher command line that applies a
+// priority, CPU list and ulimits to a command, or nil when none is set
+func LaunchPrefix(p config.Priority, cpus string, u config.Ulimits) ([]string, error) {
+	if p.IsZero() && cpus == "" && u.IsZero() {
+		return nil, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	prefix := append([]string{self, RlimitExecCommand}, priorityArgs(p)...)
+	prefix = append(prefix, affinityArgs(cpus)...)
+	prefix = append(prefix, ulimitArgs(u)...)
+	return append(prefix, "--"), nil
+}
+
+// priorityArgs returns the flags of 'sbox rlimit-exec' for a priority
+func priorityArgs(p config.Priority) []string {
+	var args []string
+	if p.Nice != 0 {
+		args = append(args, "--nice", strconv.Itoa(p.Nice))
+	}
+	if p.IOClass != "" {
+		args = append(args, "--io-class", p.IOClass)
+	}
+	return args
+}
+
+// priorityNotes describes how a priority is applied, for the daemon log
+func priorityNotes(p config.Priority) []string {
+	var notes []string
+	if p.Nice != 0 {
+		notes = append(notes, fmt.Sprintf("nice %d (setpriority)", p.Nice))
+	}
+	if p.IOClass != "" {
+		if runtime.GOOS == "linux" {
+			notes = append(notes, fmt.Sprintf("io_class %s (ioprio)", p.IOClass))
+		} else {
+			notes = append(notes, fmt.Sprintf("io_class %s NOT enforced (Linux only)", p.IOClass))
+		}
+	}
+	return notes
+}
+
+// affinityArgs returns the flags of 'sbox rlimit-exec' for a CPU list
+func affinityArgs(cpus string) []string {
+	if cpus == "" {
+		return nil
+	}
+	return []string{"--cpus", cpus}
+}
+
+// affinityNotes describes how a CPU list is applied, for the daemon log
+func affinityNotes(cpus string) []string {
+	switch {
+	case cpus == "":
+		return nil
+	case runtime.GOOS != "linux":
+		return []string{fmt.Sprintf("cpus %s NOT enforced (Linux only)", cpus)}
+	}
+	return []string{fmt.Sprintf("cpus %s (sched_setaffinity)", cpus)}
+}
+
+// ioLevel is the level within an IO class the kernel derives from the
+// nice value of processes without an explicit IO priority
+func ioLevel(nice int) int {
+	return (nice + 20) / 5
+}
+
+// niceWeight converts a nice value to a cgroups v2 weight (default 100,
+// range 1-10000). Each nice step is worth about 25% CPU, as in the
+// kernel's scheduler.
+func niceWeight(nice int) int {
+	weight := int(math.Round(100 * math.Pow(1.25, float64(-nice))))
+	return max(1, min(weight, 10000))
+}
+
+// ioWeight returns the cgroup IOWeight matching a priority, or 0 to keep
+// the default
+func ioWeight(p config.Priority) int {
+	switch p.IOClass {
+	case config.IOClassIdle:
+		return 1
+	case config.IOClassRealtime:
+		return 1000
+	}
+	if p.Nice != 0 {
+		return niceWeight(p.Nice)
+	}
+	return 0
+}
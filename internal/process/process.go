@@ -8,11 +8,19 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/hooks"
+	"github.com/sbox-project/sbox/internal/lockfile"
+	"github.com/sbox-project/sbox/internal/mpi"
+	"github.com/sbox-project/sbox/internal/slurm"
+	"github.com/sbox-project/sbox/internal/sysproc"
 )
 
 const (
@@ -28,9 +36,35 @@ type ProcessInfo struct {
 	Name      string    `json:"name"`
 	Command   string    `json:"command"`
 	StartTime time.Time `json:"start_time"`
-	Status    string    `json:"status"` // running, stopped, crashed
+	Status    string    `json:"status"` // queued, running, paused, restarting, stopped, crashed, oom-killed
 	LogFile   string    `json:"log_file"`
 	Project   string    `json:"project"`
+	// IdleTimeout is the idle auto-stop policy (empty when disabled)
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+	// Restart is the restart policy (empty when the daemon is not
+	// supervised), Restarts how often it was restarted and SupervisorPID
+	// the 'sbox supervise' process that restarts it
+	Restart       string `json:"restart,omitempty"`
+	Restarts      int    `json:"restarts,omitempty"`
+	SupervisorPID int    `json:"supervisor_pid,omitempty"`
+	// SlurmJob is the job ID of a batch job submitted with 'sbox slurm';
+	// such entries have no local PID and take their status from Slurm
+	SlurmJob string `json:"slurm_job,omitempty"`
+	// EnvFiles are the --env-file files the process was started with
+	EnvFiles []string `json:"env_files,omitempty"`
+	// Ports are the TCP ports the process listened on when last checked
+	Ports []int `json:"ports,omitempty"`
+	// Memory is the last memory sample of 'sbox meter'
+	Memory *MemorySample `json:"memory,omitempty"`
+}
+
+// Ref identifies the process in messages: "PID 123", or "job 456" for
+// Slurm jobs
+func (p ProcessInfo) Ref() string {
+	if p.SlurmJob != "" {
+		return "job " + p.SlurmJob
+	}
+	return fmt.Sprintf("PID %d", p.PID)
 }
 
 // ProcessManager handles process lifecycle
@@ -38,25 +72,74 @@ type ProcessManager struct {
 	SboxDir     string
 	ProjectRoot string
 	ProjectName string
+	// Namespace isolates process state and logs per user in shared
+	// projects (empty for single-user projects)
+	Namespace string
+	// Wrap is prepended to daemon command lines, e.g. an isolation
+	// launcher (see runner.IsolationPrefix)
+	Wrap []string
+	// EnvFiles are the --env-file files of a daemon, recorded on its
+	// entry so restarts load them again
+	EnvFiles []string
+	// Limits are applied to every daemon (see limits: in config.yaml)
+	Limits config.Limits
+	// Priority is the scheduling priority of every daemon (see priority:
+	// in config.yaml)
+	Priority config.Priority
+	// CPUs pins every daemon to host CPUs (see cpus: in config.yaml)
+	CPUs string
+	// Ulimits are set on every daemon (see ulimits: in config.yaml)
+	Ulimits config.Ulimits
+	// Rotation rotates daemon logs (see logging: in config.yaml)
+	Rotation LogRotation
+	// PreRun and PostRun are the hooks run around every daemon command
+	// (see pre_run and post_run in config.yaml)
+	PreRun  []string
+	PostRun []string
 }
 
 // NewProcessManager creates a new process manager
 func NewProcessManager(projectRoot string) *ProcessManager {
-	return &ProcessManager{
+	pm := &ProcessManager{
 		SboxDir:     filepath.Join(projectRoot, ".sbox"),
 		ProjectRoot: projectRoot,
 		ProjectName: filepath.Base(projectRoot),
 	}
+
+	// Shared projects keep each user's daemons and logs apart
+	if cfg, err := config.Load(projectRoot); err == nil {
+		if cfg.Shared {
+			pm.Namespace = currentUsername()
+		}
+		pm.Limits = cfg.Limits
+		pm.Priority = cfg.Priority
+		pm.CPUs = cfg.CPUs
+		pm.Ulimits = cfg.Ulimits
+		pm.Rotation, _ = ParseLogRotation(cfg.Logging)
+		pm.PreRun = cfg.PreRun
+		pm.PostRun = cfg.PostRun
+	}
+
+	return pm
+}
+
+// GetStateDir returns the directory holding process state for this
+// manager's namespace
+func (pm *ProcessManager) GetStateDir() string {
+	if pm.Namespace == "" {
+		return pm.SboxDir
+	}
+	return filepath.Join(pm.SboxDir, "users", pm.Namespace)
 }
 
 // GetProcessFile returns the path to the process tracking file
 func (pm *ProcessManager) GetProcessFile() string {
-	return filepath.Join(pm.SboxDir, ProcessFile)
+	return filepath.Join(pm.GetStateDir(), ProcessFile)
 }
 
 // GetLogDir returns the path to the logs directory
 func (pm *ProcessManager) GetLogDir() string {
-	return filepath.Join(pm.SboxDir, LogDir)
+	return filepath.Join(pm.GetStateDir(), LogDir)
 }
 
 // GetLogFile returns the path to a specific log file
@@ -87,49 +170,106 @@ func (pm *ProcessManager) LoadProcesses() ([]ProcessInfo, error) {
 	return processes, nil
 }
 
-// SaveProcesses saves the process list
+// SaveProcesses replaces the process list
 func (pm *ProcessManager) SaveProcesses(processes []ProcessInfo) error {
-	data, err := json.MarshalIndent(processes, "", "  ")
+	if processes == nil {
+		processes = []ProcessInfo{}
+	}
+	return pm.UpdateProcesses(func([]ProcessInfo) ([]ProcessInfo, error) {
+		return processes, nil
+	})
+}
+
+// UpdateProcesses applies a change to the process list while holding its
+// lock, so concurrent sbox commands and daemon watchers do not undo each
+// other's changes. update must not call back into the process list; a
+// nil result leaves the file as it is.
+func (pm *ProcessManager) UpdateProcesses(update func([]ProcessInfo) ([]ProcessInfo, error)) error {
+	if err := os.MkdirAll(pm.GetStateDir(), 0755); err != nil {
+		return err
+	}
+	lock, err := lockfile.Acquire(pm.GetProcessFile() + ".lock")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(pm.GetProcessFile(), data, 0644)
-}
+	defer lock.Release()
 
-// AddProcess adds a new process to tracking
-func (pm *ProcessManager) AddProcess(info ProcessInfo) error {
 	processes, err := pm.LoadProcesses()
 	if err != nil {
+		// A corrupt file is replaced rather than blocking every command
 		processes = []ProcessInfo{}
 	}
-
-	// Remove any existing entry with same name
-	var filtered []ProcessInfo
-	for _, p := range processes {
-		if p.Name != info.Name {
-			filtered = append(filtered, p)
-		}
+	updated, err := update(processes)
+	if err != nil || updated == nil {
+		return err
 	}
-
-	filtered = append(filtered, info)
-	return pm.SaveProcesses(filtered)
+	return pm.writeProcesses(updated)
 }
 
-// RemoveProcess removes a process from tracking
-func (pm *ProcessManager) RemoveProcess(name string) error {
-	processes, err := pm.LoadProcesses()
+// writeProcesses writes the process list through a temp file, so readers
+// never see it half written
+func (pm *ProcessManager) writeProcesses(processes []ProcessInfo) error {
+	data, err := json.MarshalIndent(processes, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := pm.GetProcessFile()
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+ProcessFile+".*")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes the file private; keep the mode WriteFile gave it
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
 
-	var filtered []ProcessInfo
-	for _, p := range processes {
-		if p.Name != name {
-			filtered = append(filtered, p)
+// AddProcess adds a new process to tracking, and to the global registry
+// of 'sbox ps -g'
+func (pm *ProcessManager) AddProcess(info ProcessInfo) error {
+	err := pm.UpdateProcesses(func(processes []ProcessInfo) ([]ProcessInfo, error) {
+		// Remove any existing entry with same name
+		filtered := []ProcessInfo{}
+		for _, p := range processes {
+			if p.Name != info.Name {
+				filtered = append(filtered, p)
+			}
 		}
+		return append(filtered, info), nil
+	})
+	if err != nil {
+		return err
 	}
+	// The daemon runs either way; it is only missing from 'sbox ps -g'
+	pm.register(info)
+	return nil
+}
 
-	return pm.SaveProcesses(filtered)
+// RemoveProcess removes a process from tracking
+func (pm *ProcessManager) RemoveProcess(name string) error {
+	err := pm.UpdateProcesses(func(processes []ProcessInfo) ([]ProcessInfo, error) {
+		filtered := []ProcessInfo{}
+		for _, p := range processes {
+			if p.Name != name {
+				filtered = append(filtered, p)
+			}
+		}
+		return filtered, nil
+	})
+	if err != nil {
+		return err
+	}
+	pm.unregister(name)
+	return nil
 }
 
 // GetProcess gets a specific process by name
@@ -150,14 +290,11 @@ func (pm *ProcessManager) GetProcess(name string) (*ProcessInfo, error) {
 
 // IsProcessRunning checks if a process is still running
 func IsProcessRunning(pid int) bool {
-	process, err := os.FindProcess(pid)
-	if err != nil {
+	// Signal 0 to pid 0 would test our own process group
+	if pid <= 0 {
 		return false
 	}
-
-	// On Unix, FindProcess always succeeds, so we need to send signal 0
-	err = process.Signal(syscall.Signal(0))
-	return err == nil
+	return sysproc.Alive(pid)
 }
 
 // UpdateProcessStatus updates the status of all tracked processes
@@ -166,25 +303,96 @@ func (pm *ProcessManager) UpdateProcessStatus() ([]ProcessInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	before := append([]ProcessInfo(nil), processes...)
+	if !pm.refreshStatus(processes) {
+		return processes, nil
+	}
+
+	// Another command may have changed the list meanwhile: only entries
+	// it left as they were take the new status
+	var current []ProcessInfo
+	pm.UpdateProcesses(func(latest []ProcessInfo) ([]ProcessInfo, error) {
+		for i := range latest {
+			for j := range processes {
+				if latest[i].Name == processes[j].Name && latest[i].PID == processes[j].PID && latest[i].Status == before[j].Status {
+					latest[i].Status = processes[j].Status
+					latest[i].Ports = processes[j].Ports
+				}
+			}
+		}
+		current = latest
+		return latest, nil
+	})
+	if current == nil {
+		return processes, nil
+	}
+	return current, nil
+}
 
+// refreshStatus updates the status and ports of processes in place and
+// reports whether any changed
+func (pm *ProcessManager) refreshStatus(processes []ProcessInfo) bool {
 	updated := false
 	for i := range processes {
-		if processes[i].Status == "running" {
+		if processes[i].SlurmJob != "" {
+			if isActiveStatus(processes[i].Status) {
+				// Keep the last known status while Slurm cannot be asked
+				if state, err := slurm.State(processes[i].SlurmJob); err == nil {
+					if status := slurm.ProcessStatus(state); status != processes[i].Status {
+						processes[i].Status = status
+						updated = true
+					}
+				}
+			}
+			continue
+		}
+		// A live supervisor keeps the status of its daemon current
+		if !processes[i].supervised() && isActiveStatus(processes[i].Status) {
 			if !IsProcessRunning(processes[i].PID) {
-				processes[i].Status = "stopped"
+				// Only the kernel log can tell: the exit status went to
+				// the 'sbox run -d' that started it
+				processes[i].Status = pm.markIfOOMKilled(processes[i], 0, "stopped")
 				updated = true
 			}
 		}
-	}
 
-	if updated {
-		pm.SaveProcesses(processes)
+		var ports []int
+		if isActiveStatus(processes[i].Status) && IsProcessRunning(processes[i].PID) {
+			ports = ListeningPorts(processes[i].PID)
+		}
+		if !samePorts(ports, processes[i].Ports) {
+			processes[i].Ports = ports
+			updated = true
+		}
 	}
 
-	return processes, nil
+	return updated
+}
+
+// isActiveStatus reports whether a status refers to a live process
+func isActiveStatus(status string) bool {
+	return status == "queued" || status == "running" || status == "paused" || status == "restarting"
+}
+
+// supervised reports whether the daemon's supervisor is still running
+func (p ProcessInfo) supervised() bool {
+	return p.SupervisorPID != 0 && IsProcessRunning(p.SupervisorPID)
+}
+
+// IsAlive reports whether a daemon is running, or waiting to be
+// restarted by its supervisor
+func (p ProcessInfo) IsAlive() bool {
+	if p.SlurmJob != "" {
+		// As of the last UpdateProcessStatus
+		return isActiveStatus(p.Status)
+	}
+	if p.Status == "restarting" {
+		return p.supervised()
+	}
+	return isActiveStatus(p.Status) && IsProcessRunning(p.PID)
 }
 
-// GetRunningProcesses returns only running processes
+// GetRunningProcesses returns only live processes (running or paused)
 func (pm *ProcessManager) GetRunningProcesses() ([]ProcessInfo, error) {
 	processes, err := pm.UpdateProcessStatus()
 	if err != nil {
@@ -193,7 +401,7 @@ func (pm *ProcessManager) GetRunningProcesses() ([]ProcessInfo, error) {
 
 	var running []ProcessInfo
 	for _, p := range processes {
-		if p.Status == "running" && IsProcessRunning(p.PID) {
+		if p.IsAlive() {
 			running = append(running, p)
 		}
 	}
@@ -201,6 +409,19 @@ func (pm *ProcessManager) GetRunningProcesses() ([]ProcessInfo, error) {
 	return running, nil
 }
 
+// setStatus updates the recorded status of a named process
+func (pm *ProcessManager) setStatus(name, status string) error {
+	return pm.UpdateProcesses(func(processes []ProcessInfo) ([]ProcessInfo, error) {
+		for i := range processes {
+			if processes[i].Name == name {
+				processes[i].Status = status
+				break
+			}
+		}
+		return processes, nil
+	})
+}
+
 // StopProcess stops a running process
 func (pm *ProcessManager) StopProcess(name string) error {
 	info, err := pm.GetProcess(name)
@@ -208,68 +429,93 @@ func (pm *ProcessManager) StopProcess(name string) error {
 		return err
 	}
 
-	if info.Status != "running" {
+	if !isActiveStatus(info.Status) {
 		return fmt.Errorf("process '%s' is not running (status: %s)", name, info.Status)
 	}
 
-	process, err := os.FindProcess(info.PID)
-	if err != nil {
-		return fmt.Errorf("failed to find process: %w", err)
+	if info.SlurmJob != "" {
+		if err := slurm.Cancel(info.SlurmJob); err != nil {
+			return err
+		}
+		return pm.setStatus(name, "stopped")
+	}
+
+	// Mark it stopped first so a supervisor does not restart it
+	pm.setStatus(name, "stopped")
+	if info.Status == "restarting" {
+		// Between restarts; the old PID may already be reused
+		return nil
 	}
 
 	// Try graceful shutdown first (SIGTERM)
-	if err := process.Signal(syscall.SIGTERM); err != nil {
+	if err := sysproc.SignalGroup(info.PID, syscall.SIGTERM); err != nil {
 		// If SIGTERM fails, try SIGKILL
-		process.Signal(syscall.SIGKILL)
+		sysproc.KillGroup(info.PID)
+	}
+
+	// A stopped process only sees SIGTERM once it is continued
+	if info.Status == "paused" {
+		sysproc.Resume(info.PID)
 	}
 
 	// Wait a bit for process to terminate
 	time.Sleep(100 * time.Millisecond)
 
-	// Update status
 	info.Status = "stopped"
-	processes, _ := pm.LoadProcesses()
-	for i := range processes {
-		if processes[i].Name == name {
-			processes[i].Status = "stopped"
-			break
-		}
-	}
-	pm.SaveProcesses(processes)
-
 	return nil
 }
 
-// StartDaemon starts a command as a background daemon with logging
-func (pm *ProcessManager) StartDaemon(name, command string, env []string, workdir string) (*ProcessInfo, error) {
-	if err := pm.EnsureLogDir(); err != nil {
-		return nil, fmt.Errorf("failed to create log directory: %w", err)
+// PauseProcess suspends a running daemon and its process group (SIGSTOP)
+func (pm *ProcessManager) PauseProcess(name string) error {
+	info, err := pm.GetProcess(name)
+	if err != nil {
+		return err
 	}
 
-	logFile := pm.GetLogFile(name)
+	if info.SlurmJob != "" {
+		return fmt.Errorf("process '%s' is a Slurm job; use 'scontrol hold %s' while it is queued", name, info.SlurmJob)
+	}
+	if info.Status == "paused" {
+		return fmt.Errorf("process '%s' is already paused", name)
+	}
+	if info.Status != "running" || !IsProcessRunning(info.PID) {
+		return fmt.Errorf("process '%s' is not running (status: %s)", name, info.Status)
+	}
 
-	// Open log file for writing
-	logFd, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err := sysproc.Pause(info.PID); err != nil {
+		return fmt.Errorf("failed to pause process: %w", err)
+	}
+
+	return pm.setStatus(name, "paused")
+}
+
+// ResumeProcess continues a paused daemon and its process group (SIGCONT)
+func (pm *ProcessManager) ResumeProcess(name string) error {
+	info, err := pm.GetProcess(name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open log file: %w", err)
+		return err
 	}
 
-	// Write startup header
-	fmt.Fprintf(logFd, "\n=== sbox daemon started at %s ===\n", time.Now().Format(time.RFC3339))
-	fmt.Fprintf(logFd, "Command: %s\n", command)
-	fmt.Fprintf(logFd, "Workdir: %s\n", workdir)
-	fmt.Fprintf(logFd, "=========================================\n\n")
+	if info.Status != "paused" {
+		return fmt.Errorf("process '%s' is not paused (status: %s)", name, info.Status)
+	}
+	if !IsProcessRunning(info.PID) {
+		pm.setStatus(name, "stopped")
+		return fmt.Errorf("process '%s' is no longer running", name)
+	}
 
-	cmd := exec.Command("sh", "-c", command)
-	cmd.Dir = workdir
-	cmd.Env = env
-	cmd.Stdout = logFd
-	cmd.Stderr = logFd
+	if err := sysproc.Resume(info.PID); err != nil {
+		return fmt.Errorf("failed to resume process: %w", err)
+	}
 
-	// Start the process
-	if err := cmd.Start(); err != nil {
-		logFd.Close()
-		return nil, fmt.Errorf("failed to start process: %w", err)
+	return pm.setStatus(name, "running")
+}
+
+// StartDaemon starts a command as a background daemon with logging
+func (pm *ProcessManager) StartDaemon(name, command string, env []string, workdir string) (*ProcessInfo, error) {
+	cmd, logFd, err := pm.spawn(name, command, env, workdir)
+	if err != nil {
+		return nil, err
 	}
 
 	info := ProcessInfo{
@@ -278,8 +524,9 @@ func (pm *ProcessManager) StartDaemon(name, command string, env []string, workdi
 		Command:   command,
 		StartTime: time.Now(),
 		Status:    "running",
-		LogFile:   logFile,
+		LogFile:   pm.GetLogFile(name),
 		Project:   pm.ProjectName,
+		EnvFiles:  pm.EnvFiles,
 	}
 
 	// Track the process
@@ -291,20 +538,114 @@ func (pm *ProcessManager) StartDaemon(name, command string, env []string, workdi
 	go func() {
 		cmd.Wait()
 		logFd.Close()
+		exitCode := cmd.ProcessState.ExitCode()
+		if exitCode < 0 {
+			// Killed by a signal
+			exitCode = 128
+		}
 		// Update process status when it exits
-		processes, _ := pm.LoadProcesses()
-		for i := range processes {
-			if processes[i].PID == info.PID {
-				processes[i].Status = "stopped"
-				break
+		var crashed *ProcessInfo
+		pm.UpdateProcesses(func(processes []ProcessInfo) ([]ProcessInfo, error) {
+			for i := range processes {
+				if processes[i].PID == info.PID {
+					status := "stopped"
+					if isActiveStatus(processes[i].Status) {
+						if exitCode != 0 {
+							status = "crashed"
+							exited := processes[i]
+							crashed = &exited
+						}
+						sig := exitSignal(cmd.ProcessState, exitCode)
+						status = pm.markIfOOMKilled(processes[i], sig, status)
+					}
+					processes[i].Status = status
+					break
+				}
+			}
+			return processes, nil
+		})
+		// Not when it was stopped; the supervisor of a restart policy
+		// records its crashes itself
+		if crashed != nil {
+			crash, err := pm.recordCrash(*crashed, exitCode, cmd.ProcessState, workdir)
+			if err != nil {
+				pm.RecordEvent(name, "crash", fmt.Sprintf("exit code %d (not recorded: %s)", exitCode, err))
+			} else {
+				pm.RecordEvent(name, "crash", fmt.Sprintf("exit code %d, see 'sbox crashes show %s'", exitCode, crash.ID))
 			}
 		}
-		pm.SaveProcesses(processes)
 	}()
 
 	return &info, nil
 }
 
+// spawn starts a daemon command with its output appended to the log file.
+// The caller waits for the command and closes the log file.
+func (pm *ProcessManager) spawn(name, command string, env []string, workdir string) (*exec.Cmd, *os.File, error) {
+	if err := pm.EnsureLogDir(); err != nil {
+		return nil, nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	limitsArgv, limitNotes, err := pm.limitsPrefix()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logFile := pm.GetLogFile(name)
+
+	// Open log file for writing, through the log writer when logs are
+	// rotated or structured
+	var logFd, errFd *os.File
+	if !pm.Rotation.Structured {
+		// The lines appended from now on are not in the index
+		os.Remove(logFile + LogIndexSuffix)
+	}
+	if pm.Rotation.Piped() {
+		logFd, errFd, err = pm.startLogWriter(logFile)
+	} else {
+		logFd, err = os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	// Write startup header
+	fmt.Fprintf(logFd, "\n=== sbox daemon started at %s ===\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(logFd, "Command: %s\n", command)
+	fmt.Fprintf(logFd, "Workdir: %s\n", workdir)
+	for _, note := range limitNotes {
+		fmt.Fprintf(logFd, "Limit: %s\n", note)
+	}
+	fmt.Fprintf(logFd, "=========================================\n\n")
+
+	script := command
+	if len(pm.PreRun) > 0 || len(pm.PostRun) > 0 {
+		script = hooks.Script(command, pm.PreRun, pm.PostRun, config.HookPreRun, config.HookPostRun)
+	}
+	argv := append(append(limitsArgv, pm.Wrap...), sysproc.Shell(script)...)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = workdir
+	// Ranks started by mpirun or srun get the daemon's environment
+	cmd.Env = mpi.LaunchEnv(command, env)
+	cmd.Stdout = logFd
+	cmd.Stderr = logFd
+	if errFd != nil {
+		// Only the daemon holds its stderr pipe
+		cmd.Stderr = errFd
+		defer errFd.Close()
+	}
+	// Run in its own process group so pause/stop reach every child
+	cmd.SysProcAttr = sysproc.Group()
+
+	// Start the process
+	if err := cmd.Start(); err != nil {
+		logFd.Close()
+		return nil, nil, fmt.Errorf("failed to start process: %w", err)
+	}
+
+	return cmd, logFd, nil
+}
+
 // ReadLogs reads the last n lines from a log file
 func (pm *ProcessManager) ReadLogs(name string, lines int, follow bool) error {
 	logFile := pm.GetLogFile(name)
@@ -314,63 +655,115 @@ func (pm *ProcessManager) ReadLogs(name string, lines int, follow bool) error {
 	}
 
 	if follow {
-		return pm.tailFollow(logFile)
+		return followFile(logFile, nil, func(line string) { fmt.Println(ParseLogLine(line).Text) })
 	}
 
-	return pm.tailLines(logFile, lines)
+	return pm.tailLines(name, lines)
 }
 
-// tailLines reads the last n lines from a file
-func (pm *ProcessManager) tailLines(filename string, n int) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
+// tailLines prints the last n lines of a process log
+func (pm *ProcessManager) tailLines(name string, n int) error {
+	lines, err := pm.lastLines(name, n)
+	for _, line := range lines {
+		fmt.Println(ParseLogLine(line).Text)
 	}
-	defer file.Close()
+	return err
+}
 
-	// Read all lines
+// lastLines returns the last n lines of a process log, reaching into
+// rotated files when the current one is shorter
+func (pm *ProcessManager) lastLines(name string, n int) ([]string, error) {
+	segments := pm.logSegments(name)
 	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	for i := len(segments) - 1; i >= 0 && len(lines) < n; i-- {
+		segment, err := readSegment(segments[i].path)
+		if err != nil {
+			return lines, err
+		}
+		lines = append(segment, lines...)
 	}
 
-	// Print last n lines
 	start := len(lines) - n
 	if start < 0 {
 		start = 0
 	}
+	return lines[start:], nil
+}
 
-	for i := start; i < len(lines); i++ {
-		fmt.Println(lines[i])
+// LastLogLines returns the last n lines of a process log, without the
+// times and streams of structured logs
+func (pm *ProcessManager) LastLogLines(name string, n int) ([]string, error) {
+	entries, err := pm.LastLogEntries(name, n)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = entry.Text
 	}
+	return lines, nil
+}
 
-	return scanner.Err()
+// FollowLog calls fn for every line appended to a process log until done
+// is closed
+func (pm *ProcessManager) FollowLog(name string, done <-chan struct{}, fn func(line string)) error {
+	return pm.FollowLogEntries(name, done, func(line LogLine) { fn(line.Text) })
 }
 
-// tailFollow follows a log file like tail -f
-func (pm *ProcessManager) tailFollow(filename string) error {
-	file, err := os.Open(filename)
+// followFile calls fn for every line appended to a file, like tail -F,
+// until done is closed. When the log is rotated the new file is opened
+// once the old one is read to its end.
+func followFile(path string, done <-chan struct{}, fn func(line string)) error {
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer func() { file.Close() }()
 
 	// Seek to end
 	file.Seek(0, io.SeekEnd)
 
 	reader := bufio.NewReader(file)
+	pending := ""
 	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+
 		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				time.Sleep(100 * time.Millisecond)
+		if err == nil {
+			fn(strings.TrimRight(pending+line, "\n"))
+			pending = ""
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		// Keep a partly written line until its end arrives
+		pending += line
+
+		if rotated(file, path) {
+			if next, err := os.Open(path); err == nil {
+				file.Close()
+				file = next
+				reader.Reset(file)
 				continue
 			}
-			return err
 		}
-		fmt.Print(line)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// rotated reports whether path no longer names the open file
+func rotated(file *os.File, path string) bool {
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
 	}
+	open, err := file.Stat()
+	return err == nil && !os.SameFile(open, current)
 }
 
 // ListLogs lists all available log files
@@ -442,6 +835,16 @@ func (pm *ProcessManager) GetLogSize(name string) (int64, error) {
 	return info.Size(), nil
 }
 
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
 // FormatDuration formats a duration in human-readable form
 func FormatDuration(d time.Duration) string {
 	if d < time.Minute {
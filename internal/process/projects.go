@@ -0,0 +1,114 @@
+package process
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// ProjectsFile indexes every project built or used on this machine, for
+// 'sbox system df' and 'sbox system prune'
+const ProjectsFile = "projects.json"
+
+// ProjectEntry is a project in the global index
+type ProjectEntry struct {
+	Root string `json:"root"`
+	// Built is when the last build finished
+	Built time.Time `json:"built,omitempty"`
+	// Used is when something last ran in the sandbox, from the daemon
+	// registry and the usage log
+	Used time.Time `json:"used,omitempty"`
+}
+
+// LastActive returns when the project was last built or used
+func (e ProjectEntry) LastActive() time.Time {
+	if e.Used.After(e.Built) {
+		return e.Used
+	}
+	return e.Built
+}
+
+// RecordBuild records in the global index that a project was built just
+// now
+func RecordBuild(root string) error {
+	now := time.Now()
+	return updateState(ProjectsFile, func(entries []ProjectEntry) []ProjectEntry {
+		for i := range entries {
+			if entries[i].Root == root {
+				entries[i].Built = now
+				return entries
+			}
+		}
+		return append(entries, ProjectEntry{Root: root, Built: now})
+	})
+}
+
+// ListProjects returns the projects built or used on this machine, by
+// root: those in the index, and those only known from the daemon registry
+// or the usage log, which also tell when each was last used
+func ListProjects() ([]ProjectEntry, error) {
+	globalDir, err := config.GetGlobalSboxDir()
+	if err != nil {
+		return nil, err
+	}
+	stateDir := filepath.Join(globalDir, StateDir)
+	projects := loadState[ProjectEntry](filepath.Join(stateDir, ProjectsFile))
+
+	known := make(map[string]int)
+	for i, p := range projects {
+		known[p.Root] = i
+	}
+	used := func(root string, at time.Time) {
+		i, ok := known[root]
+		if !ok {
+			// Deleted projects only stay listed while indexed, until
+			// 'sbox system prune' forgets them
+			if !ProjectExists(root) {
+				return
+			}
+			i = len(projects)
+			known[root] = i
+			projects = append(projects, ProjectEntry{Root: root})
+		}
+		if at.After(projects[i].Used) {
+			projects[i].Used = at
+		}
+	}
+	for _, e := range loadRegistry(filepath.Join(stateDir, RegistryFile)) {
+		used(e.Root, e.StartTime)
+	}
+	records, err := LoadGlobalUsage(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if r.Project != "" {
+			used(r.Project, r.Time)
+		}
+	}
+
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Root < projects[j].Root })
+	return projects, nil
+}
+
+// ForgetProject removes a project from the global index
+func ForgetProject(root string) error {
+	return updateState(ProjectsFile, func(entries []ProjectEntry) []ProjectEntry {
+		kept := []ProjectEntry{}
+		for _, e := range entries {
+			if e.Root != root {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	})
+}
+
+// ProjectExists reports whether a project still has its .sbox directory
+func ProjectExists(root string) bool {
+	info, err := os.Stat(config.GetSboxDir(root))
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,337 @@
+package process
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/lockfile"
+	"github.com/sbox-project/sbox/internal/sysproc"
+)
+
+const (
+	// StateDir holds machine-wide state, in ~/.sbox
+	StateDir = "state"
+	// RegistryFile records every daemon started on this machine, so
+	// 'sbox ps -g' can list them from anywhere
+	RegistryFile = "daemons.json"
+)
+
+// Orphaned is the status of a daemon still running after its project was
+// deleted or moved
+const Orphaned = "orphaned"
+
+// RegistryEntry is a daemon in the global registry
+type RegistryEntry struct {
+	Root      string    `json:"root"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	PID       int       `json:"pid"`
+	Command   string    `json:"command"`
+	StartTime time.Time `json:"start_time"`
+}
+
+// GlobalProcess is a daemon of any project
+type GlobalProcess struct {
+	ProcessInfo
+	// Root is the project the daemon was started in
+	Root      string `json:"root"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Orphan reports whether the daemon's project is gone
+func (p GlobalProcess) Orphan() bool {
+	return p.Status == Orphaned
+}
+
+// GetRegistryFile returns the path to ~/.sbox/state/daemons.json
+func GetRegistryFile() (string, error) {
+	globalDir, err := config.GetGlobalSboxDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(globalDir, StateDir, RegistryFile), nil
+}
+
+// loadState reads a JSON list of ~/.sbox/state; a missing or corrupt file
+// is empty
+func loadState[T any](path string) []T {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var entries []T
+	if json.Unmarshal(data, &entries) != nil {
+		return nil
+	}
+	return entries
+}
+
+// loadRegistry reads the registry; a missing or corrupt file is empty
+func loadRegistry(path string) []RegistryEntry {
+	return loadState[RegistryEntry](path)
+}
+
+// updateState applies a change to a JSON list of ~/.sbox/state while
+// holding its lock
+func updateState[T any](file string, update func([]T) []T) error {
+	globalDir, err := config.GetGlobalSboxDir()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(globalDir, StateDir, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	lock, err := lockfile.Acquire(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	data, err := json.MarshalIndent(update(loadState[T](path)), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+file+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// updateRegistry applies a change to the registry while holding its lock
+func updateRegistry(update func([]RegistryEntry) []RegistryEntry) error {
+	return updateState(RegistryFile, update)
+}
+
+func (e RegistryEntry) same(root, namespace, name string) bool {
+	return e.Root == root && e.Namespace == namespace && e.Name == name
+}
+
+// register records a daemon in the global registry, replacing an earlier
+// one of the same name in the project. Slurm jobs do not run here.
+func (pm *ProcessManager) register(info ProcessInfo) error {
+	if info.SlurmJob != "" || info.PID <= 0 {
+		return nil
+	}
+	return updateRegistry(func(entries []RegistryEntry) []RegistryEntry {
+		kept := []RegistryEntry{}
+		for _, e := range entries {
+			if !e.same(pm.ProjectRoot, pm.Namespace, info.Name) {
+				kept = append(kept, e)
+			}
+		}
+		return append(kept, RegistryEntry{
+			Root:      pm.ProjectRoot,
+			Namespace: pm.Namespace,
+			Name:      info.Name,
+			PID:       info.PID,
+			Command:   info.Command,
+			StartTime: info.StartTime,
+		})
+	})
+}
+
+// unregister removes a daemon of the project from the global registry
+func (pm *ProcessManager) unregister(name string) error {
+	return forget(RegistryEntry{Root: pm.ProjectRoot, Namespace: pm.Namespace, Name: name})
+}
+
+// forget removes an entry from the registry; a PID other than 0 must
+// match, so a daemon started again meanwhile stays
+func forget(entry RegistryEntry) error {
+	return updateRegistry(func(entries []RegistryEntry) []RegistryEntry {
+		kept := []RegistryEntry{}
+		for _, e := range entries {
+			if !e.same(entry.Root, entry.Namespace, entry.Name) || (entry.PID != 0 && e.PID != entry.PID) {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	})
+}
+
+// ListGlobal returns the daemons of every project on this machine, by
+// project and name. Daemons are read from their project, so the status is
+// that of 'sbox ps' there; those whose project is gone but still run are
+// Orphaned. Entries for daemons that are neither are pruned.
+func ListGlobal() ([]GlobalProcess, error) {
+	path, err := GetRegistryFile()
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []GlobalProcess
+	var stale []RegistryEntry
+	projects := make(map[string][]ProcessInfo)
+	for _, e := range loadRegistry(path) {
+		if _, err := os.Stat(filepath.Join(e.Root, ".sbox")); err != nil {
+			if e.running() {
+				processes = append(processes, GlobalProcess{
+					ProcessInfo: ProcessInfo{
+						PID:       e.PID,
+						Name:      e.Name,
+						Command:   e.Command,
+						StartTime: e.StartTime,
+						Status:    Orphaned,
+						Project:   filepath.Base(e.Root),
+					},
+					Root:      e.Root,
+					Namespace: e.Namespace,
+				})
+			} else {
+				stale = append(stale, e)
+			}
+			continue
+		}
+
+		key := e.Root + "\x00" + e.Namespace
+		infos, ok := projects[key]
+		if !ok {
+			pm := NewProcessManager(e.Root)
+			pm.Namespace = e.Namespace
+			infos, _ = pm.UpdateProcessStatus()
+			projects[key] = infos
+		}
+		found := false
+		for _, info := range infos {
+			if info.Name == e.Name && info.SlurmJob == "" {
+				processes = append(processes, GlobalProcess{ProcessInfo: info, Root: e.Root, Namespace: e.Namespace})
+				found = true
+				break
+			}
+		}
+		// Removed with 'sbox clean --processes'
+		if !found {
+			stale = append(stale, e)
+		}
+	}
+
+	if len(stale) > 0 {
+		updateRegistry(func(entries []RegistryEntry) []RegistryEntry {
+			kept := []RegistryEntry{}
+			for _, e := range entries {
+				pruned := false
+				for _, s := range stale {
+					if e.same(s.Root, s.Namespace, s.Name) && e.PID == s.PID {
+						pruned = true
+						break
+					}
+				}
+				if !pruned {
+					kept = append(kept, e)
+				}
+			}
+			return kept
+		})
+	}
+
+	sort.Slice(processes, func(i, j int) bool {
+		if processes[i].Root != processes[j].Root {
+			return processes[i].Root < processes[j].Root
+		}
+		return processes[i].Name < processes[j].Name
+	})
+	return processes, nil
+}
+
+// FindGlobal finds a live daemon of any project by "name" or
+// "project/name", where project is the base name of its directory
+func FindGlobal(ref string) (*GlobalProcess, error) {
+	processes, err := ListGlobal()
+	if err != nil {
+		return nil, err
+	}
+	project, name := "", ref
+	if i := strings.LastIndex(ref, "/"); i >= 0 {
+		project, name = ref[:i], ref[i+1:]
+	}
+
+	var matches []GlobalProcess
+	for _, p := range processes {
+		if p.Name != name || (!p.Orphan() && !p.IsAlive()) {
+			continue
+		}
+		if project != "" && filepath.Base(p.Root) != project && p.Root != project {
+			continue
+		}
+		matches = append(matches, p)
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no running daemon '%s' on this machine", ref)
+	case 1:
+		return &matches[0], nil
+	}
+	var roots []string
+	for _, p := range matches {
+		roots = append(roots, p.Root)
+	}
+	return nil, fmt.Errorf("'%s' runs in several projects (%s); use <project>/%s", ref, strings.Join(roots, ", "), name)
+}
+
+// StopGlobal stops a daemon of any project: through its project like
+// 'sbox stop' there, or by signaling an orphan's process group directly
+func StopGlobal(p GlobalProcess) error {
+	if !p.Orphan() {
+		pm := NewProcessManager(p.Root)
+		pm.Namespace = p.Namespace
+		return pm.StopProcess(p.Name)
+	}
+
+	if err := sysproc.SignalGroup(p.PID, syscall.SIGTERM); err != nil {
+		sysproc.KillGroup(p.PID)
+	}
+	time.Sleep(100 * time.Millisecond)
+	return forget(RegistryEntry{Root: p.Root, Namespace: p.Namespace, Name: p.Name, PID: p.PID})
+}
+
+// running reports whether the entry's daemon still runs. A PID the
+// kernel handed to a process started after the daemon was reused.
+func (e RegistryEntry) running() bool {
+	if !IsProcessRunning(e.PID) {
+		return false
+	}
+	started, ok := processStart(e.PID)
+	return !ok || !started.After(e.StartTime.Add(time.Minute))
+}
+
+// processStart returns when a process started, from /proc
+func processStart(pid int) (time.Time, bool) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	stat := string(data)
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return time.Time{}, false
+	}
+	// starttime is field 22, in clock ticks since boot
+	fields := strings.Fields(stat[end+1:])
+	boot := bootTime()
+	if len(fields) < 20 || boot.IsZero() {
+		return time.Time{}, false
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), true
+}
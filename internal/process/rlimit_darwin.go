@@ -0,0 +1,4 @@
+package process
+
+// RLIMIT_NPROC is not exported by package syscall
+const rlimitNproc = 0x7
@@ -0,0 +1,14 @@
+package process
+
+import "syscall"
+
+// MaxRSSBytes returns the peak resident set size of a rusage; macOS
+// reports it in bytes
+func MaxRSSBytes(usage *syscall.Rusage) int64 {
+	return usage.Maxrss
+}
+
+// rusageIO returns zeros: macOS counts block operations, not bytes
+func rusageIO(usage *syscall.Rusage) (read, write int64) {
+	return 0, 0
+}
@@ -0,0 +1,15 @@
+package process
+
+import "syscall"
+
+// MaxRSSBytes returns the peak resident set size of a rusage; Linux
+// reports it in KiB
+func MaxRSSBytes(usage *syscall.Rusage) int64 {
+	return usage.Maxrss * 1024
+}
+
+// rusageIO returns the storage bytes read and written, counted by Linux
+// in 512-byte blocks
+func rusageIO(usage *syscall.Rusage) (read, write int64) {
+	return usage.Inblock * 512, usage.Oublock * 512
+}
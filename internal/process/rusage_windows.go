@@ -0,0 +1,13 @@
+package process
+
+import "syscall"
+
+// MaxRSSBytes returns 0: the rusage of Windows only has times
+func MaxRSSBytes(usage *syscall.Rusage) int64 {
+	return 0
+}
+
+// rusageIO returns zeros: the rusage of Windows only has times
+func rusageIO(usage *syscall.Rusage) (read, write int64) {
+	return 0, 0
+}
@@ -0,0 +1,193 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Restart policies for 'sbox run -d --restart'
+const (
+	RestartNo        = "no"
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+)
+
+const (
+	// restartBackoffMin and restartBackoffMax bound the delay before a
+	// restart; it doubles after every run shorter than restartResetAfter
+	restartBackoffMin = time.Second
+	restartBackoffMax = time.Minute
+	restartResetAfter = 30 * time.Second
+)
+
+// RestartPolicy decides whether an exited daemon is started again
+type RestartPolicy struct {
+	Mode string
+	// MaxRetries limits on-failure restarts (0 means unlimited)
+	MaxRetries int
+}
+
+// ParseRestartPolicy parses "no", "always", "on-failure" or
+// "on-failure:<max-retries>"
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	mode, retries, hasRetries := strings.Cut(s, ":")
+	switch mode {
+	case "", RestartNo:
+		return RestartPolicy{Mode: RestartNo}, nil
+	case RestartAlways:
+		if hasRetries {
+			return RestartPolicy{}, fmt.Errorf("restart policy 'always' takes no retry count")
+		}
+		return RestartPolicy{Mode: RestartAlways}, nil
+	case RestartOnFailure:
+		policy := RestartPolicy{Mode: RestartOnFailure}
+		if hasRetries {
+			n, err := strconv.Atoi(retries)
+			if err != nil || n < 1 {
+				return RestartPolicy{}, fmt.Errorf("invalid retry count '%s' in restart policy", retries)
+			}
+			policy.MaxRetries = n
+		}
+		return policy, nil
+	}
+	return RestartPolicy{}, fmt.Errorf("unknown restart policy '%s' (use no, always or on-failure[:max-retries])", s)
+}
+
+// Enabled reports whether the policy restarts anything
+func (p RestartPolicy) Enabled() bool {
+	return p.Mode == RestartAlways || p.Mode == RestartOnFailure
+}
+
+func (p RestartPolicy) String() string {
+	if p.Mode == RestartOnFailure && p.MaxRetries > 0 {
+		return fmt.Sprintf("%s:%d", p.Mode, p.MaxRetries)
+	}
+	if p.Mode == "" {
+		return RestartNo
+	}
+	return p.Mode
+}
+
+// shouldRestart reports whether a daemon that exited with exitCode is
+// restarted after it has been restarted restarts times already
+func (p RestartPolicy) shouldRestart(exitCode, restarts int) bool {
+	switch p.Mode {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0 && (p.MaxRetries == 0 || restarts < p.MaxRetries)
+	}
+	return false
+}
+
+// Supervise runs a daemon and restarts it according to policy until it
+// is stopped with 'sbox stop' or the policy gives up. It is meant to run
+// in the detached 'sbox supervise' process, which becomes the parent of
+// the daemon so it can see its exit status.
+func (pm *ProcessManager) Supervise(name, command string, env []string, workdir string, policy RestartPolicy) error {
+	restarts := 0
+	backoff := restartBackoffMin
+
+	for {
+		cmd, logFd, err := pm.spawn(name, command, env, workdir)
+		if err != nil {
+			pm.setStatus(name, "crashed")
+			pm.RecordEvent(name, "restart-failed", err.Error())
+			return err
+		}
+
+		started := time.Now()
+		info := ProcessInfo{
+			PID:           cmd.Process.Pid,
+			Name:          name,
+			Command:       command,
+			StartTime:     started,
+			Status:        "running",
+			LogFile:       pm.GetLogFile(name),
+			Project:       pm.ProjectName,
+			Restarts:      restarts,
+			SupervisorPID: os.Getpid(),
+			EnvFiles:      pm.EnvFiles,
+		}
+		// A daemon without a policy is supervised only to see how it exits
+		if policy.Enabled() {
+			info.Restart = policy.String()
+		}
+		// Keep the idle policy recorded by 'sbox run -d'
+		if existing, err := pm.GetProcess(name); err == nil {
+			info.IdleTimeout = existing.IdleTimeout
+		}
+		if err := pm.AddProcess(info); err != nil {
+			return fmt.Errorf("failed to track process: %w", err)
+		}
+
+		exitCode := 0
+		if err := cmd.Wait(); err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				exitCode = -1
+			} else if exitCode = exitErr.ExitCode(); exitCode < 0 {
+				// Killed by a signal
+				exitCode = 128
+			}
+		}
+		ran := time.Since(started)
+		fmt.Fprintf(logFd, "\n=== sbox daemon exited with code %d after %s ===\n", exitCode, FormatDuration(ran))
+
+		// Stopped, or replaced by another 'sbox run -d' or 'sbox restart'
+		current, err := pm.GetProcess(name)
+		if err != nil || current.PID != info.PID || current.Status == "stopped" {
+			logFd.Close()
+			return nil
+		}
+
+		// The meter may have added a memory sample since
+		if current.Memory != nil {
+			info.Memory = current.Memory
+		}
+		failed := "crashed"
+		if exitCode != 0 {
+			failed = pm.markIfOOMKilled(info, exitSignal(cmd.ProcessState, exitCode), failed)
+			crash, err := pm.recordCrash(info, exitCode, cmd.ProcessState, workdir)
+			if err != nil {
+				pm.RecordEvent(name, "crash", fmt.Sprintf("exit code %d (not recorded: %s)", exitCode, err))
+			} else {
+				pm.RecordEvent(name, "crash", fmt.Sprintf("exit code %d, see 'sbox crashes show %s'", exitCode, crash.ID))
+			}
+		}
+
+		if !policy.shouldRestart(exitCode, restarts) {
+			status := "stopped"
+			if exitCode != 0 {
+				status = failed
+				if policy.MaxRetries > 0 && restarts >= policy.MaxRetries {
+					pm.RecordEvent(name, "restart-limit", fmt.Sprintf("exit code %d, gave up after %d restarts", exitCode, restarts))
+				}
+			}
+			logFd.Close()
+			return pm.setStatus(name, status)
+		}
+
+		// Back off while the daemon keeps failing quickly
+		if ran >= restartResetAfter {
+			backoff = restartBackoffMin
+		}
+		fmt.Fprintf(logFd, "=== sbox restarting in %s (policy %s) ===\n", FormatDuration(backoff), policy)
+		logFd.Close()
+		pm.setStatus(name, "restarting")
+		time.Sleep(backoff)
+		backoff = min(backoff*2, restartBackoffMax)
+
+		if current, err := pm.GetProcess(name); err != nil || current.PID != info.PID || current.Status == "stopped" {
+			return nil
+		}
+
+		restarts++
+		pm.RecordEvent(name, "restart", fmt.Sprintf("exit code %d, restart %d", exitCode, restarts))
+	}
+}
@@ -0,0 +1,52 @@
+//go:build unix
+
+package process
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	rlimitAS     = syscall.RLIMIT_AS
+	rlimitNofile = syscall.RLIMIT_NOFILE
+	rlimitCore   = syscall.RLIMIT_CORE
+)
+
+// separateStreams reports whether the log writer can be handed the
+// daemon's stderr as an extra file
+const separateStreams = true
+
+// coreSignals are the signals whose default action dumps core
+var coreSignals = map[syscall.Signal]bool{
+	syscall.SIGQUIT: true, syscall.SIGILL: true, syscall.SIGTRAP: true,
+	syscall.SIGABRT: true, syscall.SIGBUS: true, syscall.SIGFPE: true,
+	syscall.SIGSEGV: true, syscall.SIGSYS: true, syscall.SIGXCPU: true,
+	syscall.SIGXFSZ: true,
+}
+
+func setRlimit(resource int, soft, hard uint64) error {
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: soft, Max: hard})
+}
+
+func getRlimit(resource int) (soft, hard uint64, err error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(resource, &limit); err != nil {
+		return 0, 0, err
+	}
+	return limit.Cur, limit.Max, nil
+}
+
+func setNice(nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice)
+}
+
+// execve replaces the current process with argv
+func execve(path string, argv []string) error {
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+// signalInspector asks a Node.js process to open its inspector
+func signalInspector(pid int) error {
+	return syscall.Kill(pid, syscall.SIGUSR1)
+}
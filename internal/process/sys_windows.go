@@ -0,0 +1,58 @@
+package process
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Windows has no rlimits; these only keep the resource tables valid
+const (
+	rlimitAS = iota + 1
+	rlimitNofile
+	rlimitCore
+	rlimitNproc
+)
+
+// separateStreams is false: child processes on Windows inherit no extra
+// files, so structured logs tag stderr as stdout
+const separateStreams = false
+
+// coreSignals is empty: Windows writes no core dumps
+var coreSignals = map[syscall.Signal]bool{}
+
+var errNoRlimits = errors.New("resource limits are not supported on Windows")
+
+func setRlimit(resource int, soft, hard uint64) error {
+	return errNoRlimits
+}
+
+func getRlimit(resource int) (soft, hard uint64, err error) {
+	return 0, 0, errNoRlimits
+}
+
+func setNice(nice int) error {
+	return errors.New("nice is not supported on Windows")
+}
+
+// execve runs argv and exits with its exit code, as Windows cannot
+// replace a process
+func execve(path string, argv []string) error {
+	cmd := exec.Command(path, argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
+
+// signalInspector fails: Node.js opens its inspector on SIGUSR1 only,
+// which Windows cannot send
+func signalInspector(pid int) error {
+	return errors.New("opening the inspector of a running process needs SIGUSR1 (start it with --inspect on Windows)")
+}
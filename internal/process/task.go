@@ -0,0 +1,62 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/mpi"
+	"github.com/sbox-project/sbox/internal/sysproc"
+)
+
+// RunTask runs an init task to completion under the limits and isolation
+// of daemons, with its output appended to its own log, and returns its
+// exit code (128+N when killed by signal N). Unlike daemons it stays in
+// the foreground, so interrupting sbox stops it too.
+func (pm *ProcessManager) RunTask(task config.InitTask, env []string, workdir string) (int, error) {
+	if err := pm.EnsureLogDir(); err != nil {
+		return 1, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	limitsArgv, limitNotes, err := pm.limitsPrefix()
+	if err != nil {
+		return 1, err
+	}
+
+	logFd, err := os.OpenFile(pm.GetLogFile(config.InitTaskLog(task.Name)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 1, fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer logFd.Close()
+
+	started := time.Now()
+	fmt.Fprintf(logFd, "\n=== sbox init task started at %s ===\n", started.Format(time.RFC3339))
+	fmt.Fprintf(logFd, "Command: %s\n", task.Cmd)
+	fmt.Fprintf(logFd, "Workdir: %s\n", workdir)
+	for _, note := range limitNotes {
+		fmt.Fprintf(logFd, "Limit: %s\n", note)
+	}
+	fmt.Fprintf(logFd, "=========================================\n\n")
+
+	argv := append(append(limitsArgv, pm.Wrap...), sysproc.Shell(task.Cmd)...)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = workdir
+	cmd.Env = mpi.LaunchEnv(task.Cmd, env)
+	cmd.Stdout = logFd
+	cmd.Stderr = logFd
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(logFd, "\n=== failed to start: %s ===\n", err)
+		return 1, fmt.Errorf("failed to start init task: %w", err)
+	}
+	cmd.Wait()
+
+	code := cmd.ProcessState.ExitCode()
+	if sig := exitSignal(cmd.ProcessState, code); sig != 0 {
+		code = 128 + int(sig)
+	}
+	fmt.Fprintf(logFd, "\n=== exited with status %d after %s ===\n", code, time.Since(started).Round(time.Millisecond))
+	return code, nil
+}
@@ -0,0 +1,80 @@
+package process
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// ulimitResources are the rlimit resources of ulimits: keys
+var ulimitResources = map[string]int{
+	"nofile": rlimitNofile,
+	"nproc":  rlimitNproc,
+	"core":   rlimitCore,
+}
+
+// SetUlimits applies KEY=VALUE ulimits: entries, as given to
+// 'sbox rlimit-exec --ulimit', to the current process; the command it
+// execs and that command's children inherit them
+func SetUlimits(entries []string) error {
+	for _, entry := range entries {
+		key, value, _ := strings.Cut(entry, "=")
+		resource, ok := ulimitResources[key]
+		if !ok {
+			return fmt.Errorf("unknown ulimit '%s'", key)
+		}
+		u, err := config.ParseUlimit(key, value)
+		if err != nil {
+			return err
+		}
+		if err := setRlimit(resource, u.Soft, u.Hard); err != nil {
+			if err == syscall.EPERM || err == syscall.EINVAL {
+				hard, _ := HardLimit(key)
+				return fmt.Errorf("failed to set %s to %s: %w (the hard limit is %s; raising it needs root)",
+					key, value, err, FormatRlimit(hard))
+			}
+			return fmt.Errorf("failed to set %s to %s: %w", key, value, err)
+		}
+	}
+	return nil
+}
+
+// HardLimit returns the hard limit of the current process for a
+// ulimits: key
+func HardLimit(key string) (uint64, error) {
+	resource, ok := ulimitResources[key]
+	if !ok {
+		return 0, fmt.Errorf("unknown ulimit '%s'", key)
+	}
+	_, hard, err := getRlimit(resource)
+	return hard, err
+}
+
+// FormatRlimit formats an rlimit value as ulimit(1) does
+func FormatRlimit(value uint64) string {
+	if value == config.RlimitInfinity {
+		return "unlimited"
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// ulimitArgs returns the flags of 'sbox rlimit-exec' for ulimits:
+func ulimitArgs(u config.Ulimits) []string {
+	var args []string
+	u.Each(func(key, value string) {
+		args = append(args, "--ulimit", key+"="+value)
+	})
+	return args
+}
+
+// ulimitNotes describes how ulimits: are applied, for the daemon log
+func ulimitNotes(u config.Ulimits) []string {
+	var notes []string
+	u.Each(func(key, value string) {
+		notes = append(notes, fmt.Sprintf("ulimit %s %s (rlimit)", key, value))
+	})
+	return notes
+}
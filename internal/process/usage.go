@@ -0,0 +1,137 @@
+package process
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat,
+// which Linux fixes at 100 on every architecture
+const clockTicks = 100
+
+// Usage is a resource snapshot of a process and the processes of its
+// group. Counters are totals of the processes alive at Time; the rates
+// are filled in by Since from an earlier snapshot.
+type Usage struct {
+	Time      time.Time `json:"time"`
+	Processes int       `json:"processes"`
+	// CPUSeconds is the user and system CPU time consumed so far
+	CPUSeconds float64 `json:"cpu_seconds"`
+	// ChildCPUSeconds is the CPU time of exited processes the group
+	// waited for, e.g. the commands of a shell script
+	ChildCPUSeconds float64 `json:"child_cpu_seconds"`
+	RSS             int64   `json:"rss_bytes"`
+	FDs             int     `json:"fds"`
+	// ReadBytes and WriteBytes count storage IO, as in /proc/<pid>/io
+	ReadBytes  int64 `json:"read_bytes"`
+	WriteBytes int64 `json:"write_bytes"`
+
+	// CPUPercent is the CPU use since the earlier snapshot, 100 per core
+	CPUPercent float64 `json:"cpu_percent"`
+	ReadRate   float64 `json:"read_bytes_per_sec"`
+	WriteRate  float64 `json:"write_bytes_per_sec"`
+}
+
+// Usage takes a resource snapshot of the process group the process
+// leads. It relies on /proc.
+func (p ProcessInfo) Usage() (*Usage, error) {
+	if p.PID <= 0 {
+		return nil, fmt.Errorf("%s has no local process", p.Name)
+	}
+	if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(p.PID))); err != nil {
+		return nil, fmt.Errorf("no /proc entry for PID %d: %w", p.PID, err)
+	}
+
+	u := &Usage{Time: time.Now()}
+	pageSize := int64(os.Getpagesize())
+	for _, pid := range groupPIDs(p.PID) {
+		dir := filepath.Join("/proc", strconv.Itoa(pid))
+		data, err := os.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			// Exited since the group was listed
+			continue
+		}
+		stat := string(data)
+		end := strings.LastIndex(stat, ")")
+		if end < 0 {
+			continue
+		}
+		// Fields after the command start at field 3 (state); utime and
+		// stime are fields 14 and 15, cutime and cstime 16 and 17, rss
+		// (in pages) field 24
+		fields := strings.Fields(stat[end+1:])
+		if len(fields) < 22 {
+			continue
+		}
+		utime, _ := strconv.ParseInt(fields[11], 10, 64)
+		stime, _ := strconv.ParseInt(fields[12], 10, 64)
+		cutime, _ := strconv.ParseInt(fields[13], 10, 64)
+		cstime, _ := strconv.ParseInt(fields[14], 10, 64)
+		rss, _ := strconv.ParseInt(fields[21], 10, 64)
+
+		u.Processes++
+		u.CPUSeconds += float64(utime+stime) / clockTicks
+		u.ChildCPUSeconds += float64(cutime+cstime) / clockTicks
+		u.RSS += rss * pageSize
+		if entries, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+			u.FDs += len(entries)
+		}
+		read, write := readIO(filepath.Join(dir, "io"))
+		u.ReadBytes += read
+		u.WriteBytes += write
+	}
+	return u, nil
+}
+
+// Since fills in the rates of u from an earlier snapshot of the same
+// process. Processes that exited in between take their counters with
+// them, so rates are never negative.
+func (u *Usage) Since(prev *Usage) {
+	if prev == nil {
+		return
+	}
+	elapsed := u.Time.Sub(prev.Time).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rate := func(now, before float64) float64 {
+		if now < before {
+			return 0
+		}
+		return (now - before) / elapsed
+	}
+	u.CPUPercent = rate(u.CPUSeconds, prev.CPUSeconds) * 100
+	u.ReadRate = rate(float64(u.ReadBytes), float64(prev.ReadBytes))
+	u.WriteRate = rate(float64(u.WriteBytes), float64(prev.WriteBytes))
+}
+
+// readIO returns the storage bytes read and written from a /proc/<pid>/io
+// file, or zeros when it cannot be read
+func readIO(path string) (read, write int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		switch name {
+		case "read_bytes":
+			read = n
+		case "write_bytes":
+			write = n
+		}
+	}
+	return read, write
+}
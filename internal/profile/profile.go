@@ -0,0 +1,365 @@
+// Package profile runs a sandbox command under the profiler of its
+// runtime for 'sbox profile run': cProfile for Python, and the V8 CPU
+// profiler, 0x or clinic for Node.js. Each run is kept in
+// .sbox/profiles/<id>/ with a profile.json describing it.
+package profile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/runner"
+)
+
+// Dir holds a directory per profile under .sbox
+const Dir = "profiles"
+
+// MetadataFile describes a profile run
+const MetadataFile = "profile.json"
+
+// PythonOutput is the cProfile output of a run
+const PythonOutput = "profile.prof"
+
+// Profilers
+const (
+	CProfile = "cprofile"
+	CPUProf  = "cpu-prof"
+	ZeroX    = "0x"
+	Clinic   = "clinic"
+)
+
+// tools lists the profilers of each runtime, the default first
+var tools = map[string][]string{
+	"python": {CProfile},
+	"node":   {CPUProf, ZeroX, Clinic},
+	"nodejs": {CPUProf, ZeroX, Clinic},
+}
+
+// Tools returns the profilers for a runtime language, the default first
+func Tools(language string) []string {
+	return tools[language]
+}
+
+// Profile is a profiled run of a command
+type Profile struct {
+	ID      string `json:"id"`
+	Tool    string `json:"tool"`
+	Command string `json:"command"`
+	// Wrapped is the command line that ran under the profiler
+	Wrapped   string    `json:"wrapped"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time,omitempty"`
+	ExitCode  int       `json:"exit_code"`
+
+	// Dir is the profile directory
+	Dir string `json:"-"`
+}
+
+// GetProfilesDir returns .sbox/profiles of a project
+func GetProfilesDir(projectRoot string) string {
+	return filepath.Join(config.GetSboxDir(projectRoot), Dir)
+}
+
+// New creates the directory of a profile of command with tool
+func New(projectRoot, tool, command string) (*Profile, error) {
+	now := time.Now()
+	p := &Profile{Tool: tool, Command: command, StartTime: now}
+
+	base := now.Format("20060102-150405") + "-" + tool
+	p.ID = base
+	for i := 2; ; i++ {
+		p.Dir = filepath.Join(GetProfilesDir(projectRoot), p.ID)
+		err := os.MkdirAll(filepath.Dir(p.Dir), 0755)
+		if err == nil {
+			err = os.Mkdir(p.Dir, 0755)
+		}
+		if err == nil {
+			return p, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create profile directory: %w", err)
+		}
+		p.ID = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// Save writes profile.json
+func (p *Profile) Save() error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(p.Dir, MetadataFile), append(data, '\n'), 0644)
+}
+
+// Load reads a profile by ID
+func Load(projectRoot, id string) (*Profile, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return nil, fmt.Errorf("invalid profile ID '%s'", id)
+	}
+	dir := filepath.Join(GetProfilesDir(projectRoot), id)
+	data, err := os.ReadFile(filepath.Join(dir, MetadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("profile '%s' not found", id)
+		}
+		return nil, err
+	}
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid %s in profile '%s': %w", MetadataFile, id, err)
+	}
+	p.ID = id
+	p.Dir = dir
+	return &p, nil
+}
+
+// List returns the profiles of a project, newest first
+func List(projectRoot string) ([]Profile, error) {
+	entries, err := os.ReadDir(GetProfilesDir(projectRoot))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var profiles []Profile
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if p, err := Load(projectRoot, entry.Name()); err == nil {
+			profiles = append(profiles, *p)
+		}
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].StartTime.After(profiles[j].StartTime) })
+	return profiles, nil
+}
+
+// word is a whitespace separated word of a command line and the offset
+// just after it
+type word struct {
+	text string
+	end  int
+}
+
+// leadingWords splits the first n words of a command line. Quotes are not
+// interpreted; only the program and its leading options are looked at.
+func leadingWords(command string, n int) []word {
+	var words []word
+	i := 0
+	for len(words) < n {
+		for i < len(command) && (command[i] == ' ' || command[i] == '\t') {
+			i++
+		}
+		if i == len(command) {
+			break
+		}
+		start := i
+		for i < len(command) && command[i] != ' ' && command[i] != '\t' {
+			i++
+		}
+		words = append(words, word{command[start:i], i})
+	}
+	return words
+}
+
+var pythonName = regexp.MustCompile(`^python[0-9.]*$`)
+
+// Wrap returns the command line that runs command under the profiler,
+// writing into the profile directory. envDir is the sandbox environment,
+// where programs named by the command are looked up.
+func (p *Profile) Wrap(envDir string) (string, error) {
+	words := leadingWords(p.Command, 64)
+	if len(words) == 0 {
+		return "", fmt.Errorf("no command to profile")
+	}
+	program := words[0].text
+
+	switch p.Tool {
+	case CProfile:
+		out := runner.ShellJoin([]string{filepath.Join(p.Dir, PythonOutput)})
+		if pythonName.MatchString(filepath.Base(program)) {
+			// Interpreter options stay before -m cProfile
+			at := words[0].end
+			for i := 1; i < len(words); i++ {
+				arg := words[i].text
+				if strings.HasPrefix(arg, "-c") {
+					return "", fmt.Errorf("cProfile cannot profile 'python -c'; put the code in a script")
+				}
+				if !strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "-m") {
+					break
+				}
+				at = words[i].end
+				if (arg == "-W" || arg == "-X") && i+1 < len(words) {
+					i++
+					at = words[i].end
+				}
+			}
+			return p.Command[:at] + " -m cProfile -o " + out + p.Command[at:], nil
+		}
+
+		// Python console scripts such as uvicorn or gunicorn run as
+		// python -m cProfile <script>
+		script := program
+		if !strings.Contains(program, "/") {
+			script = filepath.Join(envDir, "bin", program)
+		}
+		if !isPythonScript(script) {
+			return "", fmt.Errorf("'%s' is not a Python program; profile a 'python ...' command or a script installed in the sandbox", program)
+		}
+		return "python -m cProfile -o " + out + " " + runner.ShellJoin([]string{script}) + p.Command[words[0].end:], nil
+
+	case CPUProf:
+		if filepath.Base(program) == "node" {
+			flags := " --cpu-prof --cpu-prof-dir=" + runner.ShellJoin([]string{p.Dir})
+			return p.Command[:words[0].end] + flags + p.Command[words[0].end:], nil
+		}
+		// Through NODE_OPTIONS (Node.js 22 and later) every node process
+		// the command starts, e.g. by npm or pnpm, writes a profile
+		if strings.ContainsAny(p.Dir, " \t\"'$`\\") {
+			return "", fmt.Errorf("profile directory %s has characters NODE_OPTIONS cannot carry", p.Dir)
+		}
+		return fmt.Sprintf(`export NODE_OPTIONS="${NODE_OPTIONS:+$NODE_OPTIONS }--cpu-prof --cpu-prof-dir=%s"; %s`, p.Dir, p.Command), nil
+
+	case ZeroX, Clinic:
+		if filepath.Base(program) != "node" {
+			return "", fmt.Errorf("%s profiles a 'node ...' command, not '%s'; use --tool %s for other commands", p.Tool, program, CPUProf)
+		}
+		dir := runner.ShellJoin([]string{p.Dir})
+		if p.Tool == ZeroX {
+			return "npx --yes 0x --output-dir " + dir + " -- " + p.Command, nil
+		}
+		return "npx --yes clinic flame --dest " + dir + " -- " + p.Command, nil
+	}
+	return "", fmt.Errorf("unknown profiler '%s'", p.Tool)
+}
+
+// isPythonScript reports whether path is a script with a python shebang
+func isPythonScript(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	return strings.HasPrefix(line, "#!") && strings.Contains(line, "python")
+}
+
+// Outputs returns the files the profiler wrote, relative to the profile
+// directory
+func (p *Profile) Outputs() []string {
+	var outputs []string
+	filepath.WalkDir(p.Dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(p.Dir, path)
+		if rel != MetadataFile {
+			outputs = append(outputs, rel)
+		}
+		return nil
+	})
+	return outputs
+}
+
+// PythonStats prints the top n functions of a cProfile output sorted by
+// key (e.g. cumulative or tottime) with the sandbox's Python
+func PythonStats(envDir string, env []string, path, key string, n int) (string, error) {
+	script := "import pstats, sys\n" +
+		"pstats.Stats(sys.argv[1]).sort_stats(sys.argv[2]).print_stats(int(sys.argv[3]))\n"
+	cmd := exec.Command(config.EnvExe(envDir, "python"), "-c", script, path, key, fmt.Sprint(n))
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %s", filepath.Base(path), strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// Function is the self time of a function across CPU profiles
+type Function struct {
+	Name     string
+	Location string
+	Self     time.Duration
+}
+
+// cpuProfile is the part of a V8 .cpuprofile file used for summaries
+type cpuProfile struct {
+	Nodes []struct {
+		ID        int `json:"id"`
+		CallFrame struct {
+			FunctionName string `json:"functionName"`
+			URL          string `json:"url"`
+			LineNumber   int    `json:"lineNumber"`
+		} `json:"callFrame"`
+	} `json:"nodes"`
+	Samples    []int   `json:"samples"`
+	TimeDeltas []int64 `json:"timeDeltas"`
+}
+
+// SummarizeCPUProfiles adds up the self time of each function in V8 CPU
+// profiles and returns them by decreasing self time, with the total
+func SummarizeCPUProfiles(paths []string) ([]Function, time.Duration, error) {
+	byKey := make(map[string]*Function)
+	var total time.Duration
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		var profile cpuProfile
+		if err := json.Unmarshal(data, &profile); err != nil {
+			return nil, 0, fmt.Errorf("invalid CPU profile %s: %w", filepath.Base(path), err)
+		}
+
+		keys := make(map[int]*Function, len(profile.Nodes))
+		for _, node := range profile.Nodes {
+			frame := node.CallFrame
+			name := frame.FunctionName
+			if name == "" {
+				name = "(anonymous)"
+			}
+			location := ""
+			if frame.URL != "" {
+				// Line numbers are zero-based
+				location = fmt.Sprintf("%s:%d", strings.TrimPrefix(frame.URL, "file://"), frame.LineNumber+1)
+			}
+			key := name + "\x00" + location
+			if byKey[key] == nil {
+				byKey[key] = &Function{Name: name, Location: location}
+			}
+			keys[node.ID] = byKey[key]
+		}
+
+		// The time until the next sample is spent where a sample was taken
+		for i, id := range profile.Samples {
+			if i+1 >= len(profile.TimeDeltas) {
+				break
+			}
+			d := time.Duration(profile.TimeDeltas[i+1]) * time.Microsecond
+			if f := keys[id]; f != nil && d > 0 {
+				f.Self += d
+				total += d
+			}
+		}
+	}
+
+	var functions []Function
+	for _, f := range byKey {
+		if f.Self > 0 {
+			functions = append(functions, *f)
+		}
+	}
+	sort.Slice(functions, func(i, j int) bool { return functions[i].Self > functions[j].Self })
+	return functions, total, nil
+}
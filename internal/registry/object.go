@@ -0,0 +1,280 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/archive"
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// objectStore is a flat key/value store such as an HTTP server or an S3
+// bucket. sha256 is the hex digest of the body.
+type objectStore interface {
+	put(key string, body io.Reader, size int64, sha256 string) error
+	get(key string) (io.ReadCloser, error)
+}
+
+// objectBackend keeps each archive as <name>/<tag>.tar.gz (or the
+// extension of its compression) with its metadata in <name>/<tag>.json
+type objectBackend struct {
+	store objectStore
+}
+
+func (b *objectBackend) Push(ref Ref, path string, meta *Meta) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := b.store.put(ref.Name+"/"+ref.Tag+archive.Extension(meta.Compression), f, meta.Size, meta.SHA256); err != nil {
+		return fmt.Errorf("failed to upload archive: %w", err)
+	}
+
+	// Metadata last: a reference only exists once its archive is complete
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if err := b.store.put(ref.Name+"/"+ref.Tag+".json", bytes.NewReader(data), int64(len(data)), hex.EncodeToString(sum[:])); err != nil {
+		return fmt.Errorf("failed to upload metadata: %w", err)
+	}
+	return nil
+}
+
+func (b *objectBackend) Pull(ref Ref, w io.Writer) (*Meta, error) {
+	body, err := b.store.get(ref.Name + "/" + ref.Tag + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metadata for %s: %w", ref, err)
+	}
+	var meta Meta
+	err = json.NewDecoder(body).Decode(&meta)
+	body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata for %s: %w", ref, err)
+	}
+
+	body, err = b.store.get(ref.Name + "/" + ref.Tag + archive.Extension(meta.Compression))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch archive for %s: %w", ref, err)
+	}
+	defer body.Close()
+	if _, err := io.Copy(w, body); err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", ref, err)
+	}
+	return &meta, nil
+}
+
+// httpStore is any HTTP server accepting PUT and serving GET under a
+// base URL (WebDAV, nginx with dav_methods, artifact repositories)
+type httpStore struct {
+	base string
+	cfg  config.RegistryConfig
+}
+
+func (s *httpStore) request(method, key string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.base+"/"+key, body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case s.cfg.Token != "":
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	case s.cfg.Username != "":
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	return req, nil
+}
+
+func (s *httpStore) put(key string, body io.Reader, size int64, sha string) error {
+	req, err := s.request(http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("X-Checksum-Sha256", sha)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "PUT "+key)
+}
+
+func (s *httpStore) get(key string) (io.ReadCloser, error) {
+	req, err := s.request(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, "GET "+key); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// s3Store talks to S3 or an S3-compatible server with Signature V4
+type s3Store struct {
+	bucket    string
+	prefix    string
+	region    string
+	endpoint  string
+	accessKey string
+	secretKey string
+	token     string
+}
+
+// emptySHA256 is the digest of an empty request body
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func newS3(location string, rc config.RegistryConfig) (*s3Store, error) {
+	bucket, prefix, _ := strings.Cut(location, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 url needs a bucket: s3://bucket/prefix")
+	}
+
+	s := &s3Store{
+		bucket:    bucket,
+		prefix:    strings.Trim(prefix, "/"),
+		region:    firstNonEmpty(rc.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+		endpoint:  strings.TrimSuffix(rc.Endpoint, "/"),
+		accessKey: firstNonEmpty(rc.AccessKey, os.Getenv("AWS_ACCESS_KEY_ID")),
+		secretKey: firstNonEmpty(rc.SecretKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("s3 credentials missing: set access_key/secret_key or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+func (s *s3Store) url(key string) string {
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	// Custom endpoints (MinIO, Ceph) use path-style addressing
+	if s.endpoint != "" {
+		return fmt.Sprintf("%s/%s/%s", s.endpoint, s.bucket, key)
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, key)
+}
+
+func (s *s3Store) put(key string, body io.Reader, size int64, sha string) error {
+	req, err := http.NewRequest(http.MethodPut, s.url(key), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("x-amz-meta-sha256", sha)
+	s.sign(req, sha)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "PUT "+key)
+}
+
+func (s *s3Store) get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, emptySHA256)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, "GET "+key); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header
+func (s *s3Store) sign(req *http.Request, payloadSHA256 string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadSHA256)
+	if s.token != "" {
+		req.Header.Set("x-amz-security-token", s.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadSHA256,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
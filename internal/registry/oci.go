@@ -0,0 +1,397 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/archive"
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// Media types of an sbox archive stored as an OCI artifact
+const (
+	ArtifactType    = "application/vnd.sbox.archive.v1"
+	manifestType    = "application/vnd.oci.image.manifest.v1+json"
+	emptyConfigType = "application/vnd.oci.empty.v1+json"
+)
+
+// archiveMediaTypes are the layer media types of the archive by
+// compression
+var archiveMediaTypes = map[string]string{
+	archive.Gzip: ArtifactType + ".tar+gzip",
+	archive.Zstd: ArtifactType + ".tar+zstd",
+	archive.None: ArtifactType + ".tar",
+}
+
+// archiveMediaType returns the layer media type of an archive
+func archiveMediaType(compression string) string {
+	if mediaType, ok := archiveMediaTypes[compression]; ok {
+		return mediaType
+	}
+	return archiveMediaTypes[archive.Gzip]
+}
+
+// emptyConfig is the OCI empty descriptor content "{}"
+var emptyConfig = []byte("{}")
+
+// Manifest annotations carrying the archive metadata
+const (
+	annotationCreated  = "org.opencontainers.image.created"
+	annotationTitle    = "org.opencontainers.image.title"
+	annotationProject  = "dev.sbox.project"
+	annotationRuntime  = "dev.sbox.runtime"
+	annotationPlatform = "dev.sbox.platform"
+	annotationVersion  = "dev.sbox.version"
+	annotationPushed   = "dev.sbox.pushed"
+)
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        descriptor        `json:"config"`
+	Layers        []descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociBackend stores archives as single-layer OCI artifacts, so any
+// registry implementing the distribution spec (GHCR, Harbor, ECR,
+// registry:2) can hold them
+type ociBackend struct {
+	base      string // https://host
+	namespace string
+	cfg       config.RegistryConfig
+	scope     string
+	token     string
+}
+
+func newOCI(location string, rc config.RegistryConfig) *ociBackend {
+	host, namespace, _ := strings.Cut(location, "/")
+	scheme := "https"
+	if rc.Insecure {
+		scheme = "http"
+	}
+	return &ociBackend{base: scheme + "://" + host, namespace: strings.Trim(namespace, "/"), cfg: rc}
+}
+
+func (b *ociBackend) repository(ref Ref) string {
+	if b.namespace == "" {
+		return ref.Name
+	}
+	return b.namespace + "/" + ref.Name
+}
+
+func (b *ociBackend) Push(ref Ref, path string, meta *Meta) error {
+	repo := b.repository(ref)
+	b.scope = "repository:" + repo + ":pull,push"
+
+	configDigest := digestOf(emptyConfig)
+	if err := b.uploadBlob(repo, configDigest, bytes.NewReader(emptyConfig), int64(len(emptyConfig))); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	archiveDigest := "sha256:" + meta.SHA256
+	if err := b.uploadBlob(repo, archiveDigest, f, meta.Size); err != nil {
+		return err
+	}
+
+	m := manifest{
+		SchemaVersion: 2,
+		MediaType:     manifestType,
+		ArtifactType:  ArtifactType,
+		Config:        descriptor{MediaType: emptyConfigType, Digest: configDigest, Size: int64(len(emptyConfig))},
+		Layers: []descriptor{{
+			MediaType:   archiveMediaType(meta.Compression),
+			Digest:      archiveDigest,
+			Size:        meta.Size,
+			Annotations: map[string]string{annotationTitle: ref.Name + "-" + ref.Tag + archive.Extension(meta.Compression)},
+		}},
+		Annotations: annotations(meta),
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.do(http.MethodPut, "/v2/"+repo+"/manifests/"+ref.Tag, bytes.NewReader(data), int64(len(data)), map[string]string{"Content-Type": manifestType})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "push manifest "+ref.String())
+}
+
+// uploadBlob uploads a blob unless the registry already has it
+func (b *ociBackend) uploadBlob(repo, digest string, body io.ReadSeeker, size int64) error {
+	resp, err := b.do(http.MethodHead, "/v2/"+repo+"/blobs/"+digest, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = b.do(http.MethodPost, "/v2/"+repo+"/blobs/uploads/", nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if err := checkResponse(resp, "start upload to "+repo); err != nil {
+		return err
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return fmt.Errorf("registry did not return an upload location")
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	target := location.String()
+	if !location.IsAbs() {
+		target = location.RequestURI()
+	}
+	resp, err = b.do(http.MethodPut, target, body, size, map[string]string{"Content-Type": "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "upload blob "+digest)
+}
+
+func (b *ociBackend) Pull(ref Ref, w io.Writer) (*Meta, error) {
+	repo := b.repository(ref)
+	b.scope = "repository:" + repo + ":pull"
+
+	resp, err := b.do(http.MethodGet, "/v2/"+repo+"/manifests/"+ref.Tag, nil, 0, map[string]string{"Accept": manifestType})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, "fetch manifest "+ref.String()); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	var m manifest
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest for %s: %w", ref, err)
+	}
+
+	var layer *descriptor
+	compression := ""
+	for i := range m.Layers {
+		for c, mediaType := range archiveMediaTypes {
+			if m.Layers[i].MediaType == mediaType {
+				layer, compression = &m.Layers[i], c
+			}
+		}
+		if layer != nil {
+			break
+		}
+	}
+	if layer == nil {
+		return nil, fmt.Errorf("%s is not an sbox archive (artifact type %s)", ref, m.ArtifactType)
+	}
+	sum, ok := strings.CutPrefix(layer.Digest, "sha256:")
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest %s", layer.Digest)
+	}
+
+	meta := metaFromAnnotations(m.Annotations)
+	meta.Name, meta.Tag, meta.SHA256, meta.Size = ref.Name, ref.Tag, sum, layer.Size
+	meta.Compression = compression
+
+	resp, err = b.do(http.MethodGet, "/v2/"+repo+"/blobs/"+layer.Digest, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "fetch archive "+ref.String()); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", ref, err)
+	}
+	return meta, nil
+}
+
+// do sends a request to the registry. On a 401 it logs in with the
+// challenge and retries once, rewinding the body.
+func (b *ociBackend) do(method, target string, body io.ReadSeeker, size int64, headers map[string]string) (*http.Response, error) {
+	if strings.HasPrefix(target, "/") {
+		target = b.base + target
+	}
+
+	send := func() (*http.Response, error) {
+		var reader io.Reader
+		if body != nil {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			reader = body
+		}
+		req, err := http.NewRequest(method, target, reader)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.ContentLength = size
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		switch {
+		case b.token != "":
+			req.Header.Set("Authorization", "Bearer "+b.token)
+		case b.cfg.Username != "":
+			req.SetBasicAuth(b.cfg.Username, b.cfg.Password)
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || b.token != "" {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err := b.authenticate(challenge); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+// authenticate fetches a bearer token for a WWW-Authenticate challenge
+func (b *ociBackend) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		if b.cfg.Username == "" {
+			return fmt.Errorf("registry requires authentication: set username/password or token")
+		}
+		return fmt.Errorf("registry rejected the credentials")
+	}
+
+	values := parseChallenge(params)
+	realm := values["realm"]
+	if realm == "" {
+		return fmt.Errorf("registry sent a bearer challenge without realm")
+	}
+	query := url.Values{}
+	if service := values["service"]; service != "" {
+		query.Set("service", service)
+	}
+	// The challenge to the first request may not name the repository
+	query.Set("scope", firstNonEmpty(values["scope"], b.scope))
+
+	req, err := http.NewRequest(http.MethodGet, realm+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case b.cfg.Username != "":
+		req.SetBasicAuth(b.cfg.Username, firstNonEmpty(b.cfg.Password, b.cfg.Token))
+	case b.cfg.Token != "":
+		// e.g. a GitHub token for ghcr.io
+		req.SetBasicAuth("sbox", b.cfg.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "registry login"); err != nil {
+		return err
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("invalid token response: %w", err)
+	}
+	b.token = firstNonEmpty(token.Token, token.AccessToken)
+	if b.token == "" {
+		return fmt.Errorf("registry returned an empty token")
+	}
+	return nil
+}
+
+// parseChallenge parses key="value" pairs of a WWW-Authenticate header
+func parseChallenge(params string) map[string]string {
+	values := make(map[string]string)
+	for params != "" {
+		key, rest, ok := strings.Cut(strings.TrimLeft(params, " ,"), "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, params = rest[1:end+1], rest[end+2:]
+		} else {
+			value, params, _ = strings.Cut(rest, ",")
+		}
+		values[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return values
+}
+
+func annotations(meta *Meta) map[string]string {
+	a := map[string]string{}
+	for key, value := range map[string]string{
+		annotationCreated:  meta.PackedAt,
+		annotationProject:  meta.Project,
+		annotationRuntime:  meta.Runtime,
+		annotationPlatform: meta.Platform,
+		annotationVersion:  meta.SboxVersion,
+		annotationPushed:   meta.PushedAt,
+	} {
+		if value != "" {
+			a[key] = value
+		}
+	}
+	return a
+}
+
+func metaFromAnnotations(a map[string]string) *Meta {
+	return &Meta{
+		PackedAt:    a[annotationCreated],
+		Project:     a[annotationProject],
+		Runtime:     a[annotationRuntime],
+		Platform:    a[annotationPlatform],
+		SboxVersion: a[annotationVersion],
+		PushedAt:    a[annotationPushed],
+	}
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
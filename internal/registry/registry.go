@@ -0,0 +1,364 @@
+// Package registry uploads packed sandbox archives to, and downloads them
+// from, remote stores for 'sbox push' and 'sbox pull': OCI registries, S3
+// buckets and plain HTTP servers accepting PUT.
+package registry
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/archive"
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// DefaultTag is used for references without a tag
+const DefaultTag = "latest"
+
+var (
+	namePattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+	tagPattern  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+)
+
+// Ref is a parsed archive reference: [registry/]name[:tag]
+type Ref struct {
+	Registry string
+	Name     string
+	Tag      string
+}
+
+func (r Ref) String() string {
+	return fmt.Sprintf("%s/%s:%s", r.Registry, r.Name, r.Tag)
+}
+
+// Meta describes a pushed archive. It is stored next to the archive (or
+// as manifest annotations in OCI registries) and verified on pull.
+type Meta struct {
+	Name        string `json:"name"`
+	Tag         string `json:"tag"`
+	SHA256      string `json:"sha256"`
+	Size        int64  `json:"size"`
+	Project     string `json:"project,omitempty"`
+	Runtime     string `json:"runtime,omitempty"`
+	Platform    string `json:"platform,omitempty"`
+	SboxVersion string `json:"sbox_version,omitempty"`
+	PackedAt    string `json:"packed_at,omitempty"`
+	PushedAt    string `json:"pushed_at,omitempty"`
+	// Compression is one of archive.Compressions; archives pushed before
+	// it was recorded are gzip
+	Compression string `json:"compression,omitempty"`
+}
+
+// Backend stores archives
+type Backend interface {
+	// Push uploads the archive at path with its metadata
+	Push(ref Ref, path string, meta *Meta) error
+	// Pull downloads an archive to w and returns its metadata. The
+	// caller verifies the checksum.
+	Pull(ref Ref, w io.Writer) (*Meta, error)
+}
+
+// ParseRef resolves a reference against the configured registries. The
+// first path element names a registry when one of that name exists;
+// otherwise the default registry is used.
+func ParseRef(s string, global *config.GlobalConfig) (Ref, error) {
+	ref := Ref{Tag: DefaultTag}
+
+	rest := s
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		ref.Tag = rest[i+1:]
+		rest = rest[:i]
+	}
+
+	if first, name, ok := strings.Cut(rest, "/"); ok {
+		if _, known := global.Registries[first]; known {
+			ref.Registry = first
+			rest = name
+		}
+	}
+	if ref.Registry == "" {
+		switch {
+		case global.DefaultRegistry != "":
+			ref.Registry = global.DefaultRegistry
+		case len(global.Registries) == 1:
+			for name := range global.Registries {
+				ref.Registry = name
+			}
+		default:
+			return Ref{}, fmt.Errorf("no registry in '%s' and no default_registry configured", s)
+		}
+	}
+	ref.Name = rest
+
+	if !namePattern.MatchString(ref.Name) {
+		return Ref{}, fmt.Errorf("invalid name '%s' (lowercase letters, digits, '.', '_', '-' and '/')", ref.Name)
+	}
+	if !tagPattern.MatchString(ref.Tag) {
+		return Ref{}, fmt.Errorf("invalid tag '%s'", ref.Tag)
+	}
+	return ref, nil
+}
+
+// Open returns the backend for a configured registry
+func Open(name string, global *config.GlobalConfig) (Backend, error) {
+	rc, ok := global.Registries[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown registry '%s' (configured: %s)", name, strings.Join(registryNames(global), ", "))
+	}
+	rc = expand(rc)
+
+	scheme, rest, ok := strings.Cut(rc.URL, "://")
+	if !ok {
+		return nil, fmt.Errorf("registry '%s': url must start with oci://, s3://, http:// or https://", name)
+	}
+	switch scheme {
+	case "oci":
+		return newOCI(rest, rc), nil
+	case "s3":
+		store, err := newS3(rest, rc)
+		if err != nil {
+			return nil, err
+		}
+		return &objectBackend{store: store}, nil
+	case "http", "https":
+		return &objectBackend{store: &httpStore{base: strings.TrimSuffix(rc.URL, "/"), cfg: rc}}, nil
+	}
+	return nil, fmt.Errorf("registry '%s': unsupported scheme '%s'", name, scheme)
+}
+
+func registryNames(global *config.GlobalConfig) []string {
+	var names []string
+	for name := range global.Registries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expand substitutes environment variables in the string settings
+func expand(rc config.RegistryConfig) config.RegistryConfig {
+	for _, field := range []*string{&rc.URL, &rc.Token, &rc.Username, &rc.Password, &rc.Region, &rc.Endpoint, &rc.AccessKey, &rc.SecretKey} {
+		*field = os.ExpandEnv(*field)
+	}
+	return rc
+}
+
+// ArchiveMeta computes the checksum and size of an archive, or of the
+// concatenated volumes of a split one, and reads its metadata.json
+func ArchiveMeta(archivePath string) (*Meta, error) {
+	_, parts, err := archive.Parts(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	head := &headWriter{}
+	var size int64
+	for _, part := range parts {
+		f, err := os.Open(part)
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.Copy(io.MultiWriter(hash, head), f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		size += n
+	}
+	meta := &Meta{SHA256: hex.EncodeToString(hash.Sum(nil)), Size: size, Compression: archive.Sniff(head.data)}
+
+	stream, err := archive.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", archivePath, err)
+	}
+	defer stream.Close()
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s has no metadata.json; create it with 'sbox pack'", archivePath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", archivePath, err)
+		}
+		// <project>/metadata.json
+		if path.Base(hdr.Name) != "metadata.json" || strings.Count(strings.Trim(hdr.Name, "/"), "/") != 1 {
+			continue
+		}
+		var packed struct {
+			ProjectName string `json:"project_name"`
+			Runtime     string `json:"runtime"`
+			Platform    string `json:"platform"`
+			SboxVersion string `json:"sbox_version"`
+			PackedAt    string `json:"packed_at"`
+		}
+		if err := json.NewDecoder(tr).Decode(&packed); err != nil {
+			return nil, fmt.Errorf("failed to parse metadata.json: %w", err)
+		}
+		meta.Project = packed.ProjectName
+		meta.Runtime = packed.Runtime
+		meta.Platform = packed.Platform
+		meta.SboxVersion = packed.SboxVersion
+		meta.PackedAt = packed.PackedAt
+		return meta, nil
+	}
+}
+
+// headWriter keeps the first bytes written to it, enough to tell the
+// compression
+type headWriter struct {
+	data []byte
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if missing := 4 - len(w.data); missing > 0 {
+		w.data = append(w.data, p[:min(missing, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// Upload pushes an archive, tagged with the metadata it was packed with.
+// The volumes of a split archive are pushed as the one archive they make
+// up.
+func Upload(b Backend, ref Ref, archivePath string) (*Meta, error) {
+	meta, err := ArchiveMeta(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	meta.Name = ref.Name
+	meta.Tag = ref.Tag
+	meta.PushedAt = time.Now().UTC().Format(time.RFC3339)
+
+	name, parts, err := archive.Parts(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) > 1 {
+		joined, err := joinParts(parts)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(joined)
+		name = joined
+	}
+
+	if err := b.Push(ref, name, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// joinParts concatenates the volumes of a split archive into a temporary
+// file
+func joinParts(parts []string) (string, error) {
+	tmp, err := os.CreateTemp("", "sbox-push-*")
+	if err != nil {
+		return "", err
+	}
+	for _, part := range parts {
+		f, err := os.Open(part)
+		if err == nil {
+			_, err = io.Copy(tmp, f)
+			f.Close()
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return "", fmt.Errorf("failed to join %s: %w", filepath.Base(part), err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// ArchiveName is the file name a pulled archive is saved as by default:
+// <name>-<tag> with the extension of its compression
+func ArchiveName(ref Ref, meta *Meta) string {
+	return path.Base(ref.Name) + "-" + ref.Tag + archive.Extension(meta.Compression)
+}
+
+// Download pulls an archive to dest, or without one to ArchiveName in the
+// current directory, and verifies its checksum. It returns the metadata
+// and the path written, which is only replaced once the archive is
+// complete and intact.
+func Download(b Backend, ref Ref, dest string) (*Meta, string, error) {
+	dir := "."
+	if dest != "" {
+		dir = filepath.Dir(dest)
+	}
+	tmp, err := os.CreateTemp(dir, ".sbox-pull-*")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, hash)}
+	meta, err := b.Pull(ref, counter)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if meta.SHA256 == "" {
+		return nil, "", fmt.Errorf("%s has no checksum; refusing to use it", ref)
+	}
+	if sum != meta.SHA256 {
+		return nil, "", fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", ref, meta.SHA256, sum)
+	}
+	if meta.Size > 0 && counter.n != meta.Size {
+		return nil, "", fmt.Errorf("size mismatch for %s: expected %d bytes, got %d", ref, meta.Size, counter.n)
+	}
+
+	if dest == "" {
+		dest = ArchiveName(ref, meta)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return nil, "", err
+	}
+	return meta, dest, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ErrNotFound is returned when a reference does not exist in a registry
+var ErrNotFound = errors.New("not found")
+
+// checkResponse turns a non-2xx response into an error
+func checkResponse(resp *http.Response, what string) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", what, ErrNotFound)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s %s", what, resp.Status, strings.TrimSpace(string(body)))
+}
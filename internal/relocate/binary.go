@@ -0,0 +1,125 @@
+package relocate
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// objectMagics start ELF and Mach-O files (thin in both byte orders, and
+// universal binaries)
+var objectMagics = [][]byte{
+	{0x7f, 'E', 'L', 'F'},
+	{0xfe, 0xed, 0xfa, 0xce}, {0xce, 0xfa, 0xed, 0xfe},
+	{0xfe, 0xed, 0xfa, 0xcf}, {0xcf, 0xfa, 0xed, 0xfe},
+	{0xca, 0xfe, 0xba, 0xbe},
+}
+
+// skippedDirs are not relocated as binaries: conda-meta is JSON, and pkgs
+// holds package caches that are not loaded from
+var skippedDirs = map[string]bool{"conda-meta": true, "pkgs": true}
+
+// IsObject reports whether a file is a compiled executable or library
+func IsObject(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	for _, magic := range objectMagics {
+		if bytes.Equal(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// BinaryFiles returns the files of a conda environment that may embed its
+// prefix in binary form, relative to envDir and sorted: compiled objects,
+// whose RPATH and strings hold it, and the files conda-meta records as
+// installed with a binary prefix placeholder. Symlinks are skipped.
+func BinaryFiles(envDir string) ([]string, error) {
+	files := make(map[string]bool)
+	for _, rel := range condaBinaryPaths(filepath.Join(envDir, "conda-meta")) {
+		files[rel] = true
+	}
+
+	err := filepath.WalkDir(envDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Unreadable entries are left as they are
+		}
+		rel, _ := filepath.Rel(envDir, path)
+		if d.IsDir() {
+			if skippedDirs[rel] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && !files[rel] && IsObject(path) {
+			files[rel] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for rel := range files {
+		info, err := os.Lstat(filepath.Join(envDir, rel))
+		if err == nil && info.Mode().IsRegular() {
+			paths = append(paths, rel)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// condaBinaryPaths lists the files the conda-meta records in dir mark
+// with file_mode binary, relative to the environment. Paths leaving the
+// environment are ignored.
+func condaBinaryPaths(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var record struct {
+			PathsData struct {
+				Paths []struct {
+					Path     string `json:"_path"`
+					FileMode string `json:"file_mode"`
+				} `json:"paths"`
+			} `json:"paths_data"`
+		}
+		if err := json.Unmarshal(data, &record); err != nil {
+			continue
+		}
+		for _, p := range record.PathsData.Paths {
+			rel := filepath.Clean(filepath.FromSlash(p.Path))
+			if p.FileMode == "binary" && rel != "." && !filepath.IsAbs(rel) && !strings.HasPrefix(rel, "..") {
+				paths = append(paths, rel)
+			}
+		}
+	}
+	return paths
+}
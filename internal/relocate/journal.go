@@ -0,0 +1,218 @@
+// Package relocate tracks path relocation progress for sbox unpack so an
+// interrupted run can be resumed without rewriting files twice.
+package relocate
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JournalFile records relocation progress (one JSON object per line). It
+// exists only while a relocation is in progress.
+const JournalFile = "relocate.journal"
+
+// Journal is the progress record of one relocation. A nil *Journal is
+// valid and records nothing (used for dry runs).
+type Journal struct {
+	From      string
+	To        string
+	StartedAt time.Time
+
+	path string
+	done map[string]bool
+}
+
+type journalEntry struct {
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	Done      string    `json:"done,omitempty"`
+}
+
+// GetJournalPath returns the path to the relocation journal
+func GetJournalPath(projectRoot string) string {
+	return filepath.Join(projectRoot, ".sbox", JournalFile)
+}
+
+// Load reads an unfinished relocation journal, returning nil if there is none
+func Load(projectRoot string) (*Journal, error) {
+	path := GetJournalPath(projectRoot)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	j := &Journal{path: path, done: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // A torn final line from a crash
+		}
+		if entry.Done != "" {
+			j.done[entry.Done] = true
+		} else if entry.To != "" {
+			j.From, j.To, j.StartedAt = entry.From, entry.To, entry.StartedAt
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if j.To == "" {
+		// Header never made it to disk: nothing was rewritten yet
+		os.Remove(path)
+		return nil, nil
+	}
+	return j, nil
+}
+
+// Begin starts a new journal for a relocation from one prefix to another
+func Begin(projectRoot, from, to string) (*Journal, error) {
+	j := &Journal{
+		From:      from,
+		To:        to,
+		StartedAt: time.Now(),
+		path:      GetJournalPath(projectRoot),
+		done:      make(map[string]bool),
+	}
+	if err := os.WriteFile(j.path, nil, 0644); err != nil {
+		return nil, err
+	}
+	if err := j.append(journalEntry{From: from, To: to, StartedAt: j.StartedAt}); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Done reports whether a step or file was already relocated
+func (j *Journal) Done(key string) bool {
+	return j != nil && j.done[key]
+}
+
+// Completed returns the number of recorded steps and files
+func (j *Journal) Completed() int {
+	if j == nil {
+		return 0
+	}
+	return len(j.done)
+}
+
+// Mark records that a step or file has been relocated
+func (j *Journal) Mark(key string) error {
+	if j == nil {
+		return nil
+	}
+	j.done[key] = true
+	return j.append(journalEntry{Done: key})
+}
+
+// Finish removes the journal once every step has completed
+func (j *Journal) Finish() error {
+	if j == nil {
+		return nil
+	}
+	return os.Remove(j.path)
+}
+
+func (j *Journal) append(entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	// The entry must be durable before the next file is touched
+	return f.Sync()
+}
+
+// WriteFile replaces a file atomically so an interruption leaves either
+// the old or the new content, never a truncated file
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".relocate-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ScriptPrefixes returns the project prefixes referenced by shebang lines
+// of scripts in an environment's bin directory. A prefix other than the
+// project's current one means an earlier relocation did not finish.
+func ScriptPrefixes(binDir string) []string {
+	entries, err := os.ReadDir(binDir)
+	if err != nil {
+		return nil
+	}
+
+	marker := string(filepath.Separator) + filepath.Join(".sbox", "env", "bin") + string(filepath.Separator)
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		line := firstLine(filepath.Join(binDir, entry.Name()))
+		if !strings.HasPrefix(line, "#!") {
+			continue
+		}
+		interpreter := strings.Fields(strings.TrimPrefix(line, "#!"))
+		if len(interpreter) == 0 {
+			continue
+		}
+		idx := strings.Index(interpreter[0], marker)
+		if idx <= 0 {
+			continue
+		}
+		prefix := interpreter[0][:idx]
+		if !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+func firstLine(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// ReadSlice stops at the buffer size, so binaries are never read whole
+	reader := bufio.NewReaderSize(f, 512)
+	line, _ := reader.ReadSlice('\n')
+	return strings.TrimSpace(string(line))
+}
@@ -0,0 +1,168 @@
+package relocate
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MaxFileSize is the largest file ReplacePrefix will rewrite. Anything
+// bigger is almost certainly data, not something that embeds the prefix.
+const MaxFileSize = 256 << 20
+
+// binarySniffSize is how much of a file is inspected to decide whether it
+// is binary (same heuristic as git and conda: a NUL byte in the head)
+const binarySniffSize = 8000
+
+var (
+	// ErrTooLarge is returned for files above MaxFileSize
+	ErrTooLarge = errors.New("file too large to relocate")
+
+	// ErrPrefixTooLong is returned when a binary file embeds the old
+	// prefix but the new one is longer and cannot be written in place
+	ErrPrefixTooLong = errors.New("new prefix is longer than the old one; binary file cannot be relocated")
+)
+
+// IsBinary reports whether a file looks binary
+func IsBinary(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	head := make([]byte, binarySniffSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return bytes.IndexByte(head[:n], 0) >= 0, nil
+}
+
+// ReplacePrefix rewrites every occurrence of oldPrefix in a file and
+// reports whether anything changed. The file is streamed record by record
+// (lines for text, NUL-terminated strings for binaries), so memory use is
+// bounded by the longest record rather than the file size.
+//
+// In binary files each rewritten string is padded with NUL bytes to its
+// original length, keeping every offset in the file valid. The file is
+// replaced atomically; with dryRun it is only scanned.
+func ReplacePrefix(path, oldPrefix, newPrefix string, dryRun bool) (bool, error) {
+	if oldPrefix == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() > MaxFileSize {
+		return false, fmt.Errorf("%w (%d bytes)", ErrTooLarge, info.Size())
+	}
+
+	binary, err := IsBinary(path)
+	if err != nil {
+		return false, err
+	}
+	if binary && len(newPrefix) > len(oldPrefix) {
+		// Only an error if the prefix is actually there
+		found, err := replaceStream(path, io.Discard, []byte(oldPrefix), []byte(oldPrefix), true)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return false, ErrPrefixTooLong
+		}
+		return false, nil
+	}
+
+	if dryRun {
+		return replaceStream(path, io.Discard, []byte(oldPrefix), []byte(newPrefix), binary)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".relocate-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	out := bufio.NewWriter(tmp)
+	changed, err := replaceStream(path, out, []byte(oldPrefix), []byte(newPrefix), binary)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || !changed {
+		return false, err
+	}
+
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
+
+// replaceStream copies path to w with the prefix replaced, reporting
+// whether any replacement was made
+func replaceStream(path string, w io.Writer, oldPrefix, newPrefix []byte, binary bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	delim := byte('\n')
+	if binary {
+		delim = 0
+	}
+
+	reader := bufio.NewReader(f)
+	changed := false
+	for {
+		record, readErr := reader.ReadBytes(delim)
+		if readErr != nil && readErr != io.EOF {
+			return false, readErr
+		}
+
+		if bytes.Contains(record, oldPrefix) {
+			changed = true
+			if binary {
+				record = replacePadded(record, oldPrefix, newPrefix)
+			} else {
+				record = bytes.ReplaceAll(record, oldPrefix, newPrefix)
+			}
+		}
+		if _, err := w.Write(record); err != nil {
+			return false, err
+		}
+
+		if readErr == io.EOF {
+			return changed, nil
+		}
+	}
+}
+
+// replacePadded replaces the prefix in a NUL-terminated string and pads
+// the result with NULs so it keeps its length. newPrefix must not be
+// longer than oldPrefix.
+func replacePadded(record, oldPrefix, newPrefix []byte) []byte {
+	replaced := bytes.ReplaceAll(bytes.TrimSuffix(record, []byte{0}), oldPrefix, newPrefix)
+	padded := make([]byte, len(record))
+	copy(padded, replaced)
+	return padded
+}
+
+// IsScript reports whether a file starts with a shebang line
+func IsScript(path string) bool {
+	return strings.HasPrefix(firstLine(path), "#!")
+}
@@ -0,0 +1,301 @@
+// Package remote runs packed sandboxes on other hosts over SSH for
+// 'sbox run --remote': the archive is uploaded with rsync (or scp),
+// extracted and unpacked there, and the command's output streamed back.
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// RemotesFile holds the remotes added with 'sbox remote add', in ~/.sbox.
+// It is kept apart from config.yaml so that file is never rewritten.
+const RemotesFile = "remotes.yaml"
+
+// DefaultDir is where sandboxes are unpacked on a remote, relative to the
+// login directory
+const DefaultDir = "sbox-remote"
+
+// Remote is a host sandboxes can run on
+type Remote struct {
+	// Host is user@host, or a Host alias of ~/.ssh/config
+	Host string `yaml:"host" json:"host"`
+	// Port and Identity are passed to ssh when set
+	Port     int    `yaml:"port,omitempty" json:"port,omitempty"`
+	Identity string `yaml:"identity,omitempty" json:"identity,omitempty"`
+	// Dir holds one directory per project, DefaultDir when empty
+	Dir string `yaml:"dir,omitempty" json:"dir,omitempty"`
+	// Sbox is the sbox binary on the host, "sbox" from PATH when empty
+	Sbox string `yaml:"sbox,omitempty" json:"sbox,omitempty"`
+}
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// CheckName checks a remote name
+func CheckName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid remote name '%s': use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// GetRemotesPath returns the path to ~/.sbox/remotes.yaml
+func GetRemotesPath() (string, error) {
+	globalDir, err := config.GetGlobalSboxDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(globalDir, RemotesFile), nil
+}
+
+// Load returns the remotes by name; a missing file yields none
+func Load() (map[string]Remote, error) {
+	remotes := make(map[string]Remote)
+	path, err := GetRemotesPath()
+	if err != nil {
+		return remotes, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return remotes, nil
+		}
+		return remotes, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err := yaml.Unmarshal(data, &remotes); err != nil {
+		return remotes, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return remotes, nil
+}
+
+// Save writes the remotes to ~/.sbox/remotes.yaml
+func Save(remotes map[string]Remote) error {
+	path, err := GetRemotesPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(remotes)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Names returns the names of remotes, sorted
+func Names(remotes map[string]Remote) []string {
+	names := make([]string, 0, len(remotes))
+	for name := range remotes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Address returns the remote's host, with its port when not the default
+func (r Remote) Address() string {
+	if r.Port != 0 {
+		return fmt.Sprintf("%s:%d", r.Host, r.Port)
+	}
+	return r.Host
+}
+
+// sshOptions are the ssh options shared by ssh, rsync and scp. The first
+// connection is kept open for the ones after it, so a password or second
+// factor is asked for once per run.
+func (r Remote) sshOptions() []string {
+	opts := []string{"-o", "ControlMaster=auto", "-o", "ControlPersist=60"}
+	if globalDir, err := config.GetGlobalSboxDir(); err == nil {
+		if os.MkdirAll(globalDir, 0755) == nil {
+			opts = append(opts, "-o", "ControlPath="+filepath.Join(globalDir, "ssh-%C"))
+		}
+	}
+	if r.Identity != "" {
+		opts = append(opts, "-i", r.Identity)
+	}
+	return opts
+}
+
+func (r Remote) sshArgs(tty bool) []string {
+	args := r.sshOptions()
+	if r.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(r.Port))
+	}
+	if tty {
+		args = append(args, "-t")
+	}
+	return append(args, r.Host)
+}
+
+// Output runs a shell script on the remote and returns its stdout
+func (r Remote) Output(script string) (string, error) {
+	cmd := exec.Command("ssh", append(r.sshArgs(false), script)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", r.Host, msg)
+		}
+		return "", fmt.Errorf("ssh %s failed: %w", r.Host, err)
+	}
+	return string(out), nil
+}
+
+// Run runs a shell script on the remote with its output streamed back,
+// and returns its exit code; ssh itself exits with 255 on failure
+func (r Remote) Run(script string, tty bool, stdout, stderr io.Writer) (int, error) {
+	cmd := exec.Command("ssh", append(r.sshArgs(tty), script)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), nil
+		}
+		return 1, fmt.Errorf("failed to run ssh: %w", err)
+	}
+	return 0, nil
+}
+
+// Upload copies a local file into a directory on the remote, with rsync
+// when both hosts have it (an interrupted upload resumes) and scp
+// otherwise. It returns the tool used.
+func (r Remote) Upload(file, dir string, rsync bool) (string, error) {
+	dest := r.Host + ":" + dir + "/"
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("rsync"); err == nil && rsync {
+		shell := append([]string{"ssh"}, r.sshOptions()...)
+		if r.Port != 0 {
+			shell = append(shell, "-p", strconv.Itoa(r.Port))
+		}
+		for i, arg := range shell {
+			shell[i] = ShellQuote(arg)
+		}
+		cmd = exec.Command("rsync", "--partial", "--times", "-e", strings.Join(shell, " "), file, dest)
+	} else {
+		args := append([]string{"-q"}, r.sshOptions()...)
+		if r.Port != 0 {
+			args = append(args, "-P", strconv.Itoa(r.Port))
+		}
+		cmd = exec.Command("scp", append(args, file, dest)...)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s to %s failed: %w", filepath.Base(cmd.Path), r.Host, err)
+	}
+	return filepath.Base(cmd.Path), nil
+}
+
+// Host describes a remote as probed before a run
+type Host struct {
+	Platform string
+	HasRsync bool
+	HasSbox  bool
+	// Dir is the remote's directory for sandboxes, made absolute
+	Dir string
+}
+
+// Probe creates the directory for sandboxes on the remote and reports
+// the remote's platform and tools, in one connection
+func (r Remote) Probe() (*Host, error) {
+	dir := r.Dir
+	if dir == "" {
+		dir = DefaultDir
+	}
+	sbox := r.Sbox
+	if sbox == "" {
+		sbox = "sbox"
+	}
+	script := strings.Join([]string{
+		fmt.Sprintf("mkdir -p %[1]s && cd %[1]s && pwd || exit 1", remotePath(dir)),
+		"uname -s",
+		"uname -m",
+		"command -v rsync >/dev/null 2>&1 && echo rsync || echo -",
+		fmt.Sprintf("command -v %s >/dev/null 2>&1 && echo sbox || echo -", remotePath(sbox)),
+	}, "; ")
+	out, err := r.Output(script)
+	if err != nil {
+		return nil, err
+	}
+	// Shell startup files may print before the script does
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) < 5 {
+		return nil, fmt.Errorf("unexpected output from %s: %q", r.Host, strings.TrimSpace(out))
+	}
+	lines = lines[len(lines)-5:]
+	return &Host{
+		Dir:      lines[0],
+		Platform: Platform(lines[1], lines[2]),
+		HasRsync: lines[3] == "rsync",
+		HasSbox:  lines[4] == "sbox",
+	}, nil
+}
+
+// Platform maps uname -s and -m to an sbox platform key (linux-amd64, ...)
+func Platform(kernel, machine string) string {
+	arch := machine
+	switch machine {
+	case "x86_64", "amd64":
+		arch = "amd64"
+	case "aarch64", "arm64":
+		arch = "arm64"
+	}
+	return strings.ToLower(kernel) + "-" + arch
+}
+
+// Script returns the shell script that replaces the project's previous
+// tree in dir with the archive's, relocates it and runs the command.
+// The output of unpack goes to stderr, keeping stdout for the run.
+func (r Remote) Script(dir, project, archiveName, command string, tty bool) string {
+	sbox := r.Sbox
+	if sbox == "" {
+		sbox = "sbox"
+	}
+	sbox = remotePath(sbox)
+	q := ShellQuote
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "set -e; cd %s; ", q(dir))
+	staging := q("." + project + ".extract")
+	fmt.Fprintf(&b, "rm -rf %[1]s && mkdir %[1]s && tar -xzf %[2]s -C %[1]s; ", staging, q(archiveName))
+	fmt.Fprintf(&b, "rm -rf %[1]s && mv %[2]s/%[1]s %[1]s && rmdir %[2]s; ", q(project), staging)
+	fmt.Fprintf(&b, "cd %s; %s unpack >&2; ", q(project), sbox)
+	args := []string{"exec", sbox, "run"}
+	if tty {
+		args = append(args, "--tty")
+	}
+	if command != "" {
+		args = append(args, "--", q(command))
+	}
+	b.WriteString(strings.Join(args, " "))
+	return b.String()
+}
+
+// remotePath quotes a remote path, leaving a leading ~/ to the shell
+func remotePath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		return "~/" + ShellQuote(rest)
+	}
+	return ShellQuote(path)
+}
+
+// ShellQuote quotes s for a POSIX shell
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,387 @@
+// Package repro checks that builds are reproducible: it records the
+// files of a build in a manifest of content hashes and compares two
+// builds, or a build and a saved manifest, classifying each difference
+// by its likely cause (bytecode, timestamps, ordering, package versions).
+package repro
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/runtime"
+)
+
+// Causes of a difference, in the order they are reported
+const (
+	Packages    = "package versions"
+	Missing     = "files missing from one build"
+	Bytecode    = "Python bytecode"
+	Timestamps  = "embedded timestamps"
+	Ordering    = "line ordering"
+	Permissions = "permissions"
+	Metadata    = "installer metadata"
+	Content     = "other content"
+)
+
+// Causes lists the causes in report order
+var Causes = []string{Packages, Missing, Bytecode, Timestamps, Ordering, Permissions, Metadata, Content}
+
+// Expected reports whether differences with a cause are a normal part of
+// every build and do not affect what the sandbox runs
+func Expected(cause string) bool {
+	return cause == Metadata
+}
+
+// rootPlaceholder stands for the project root in hashed content, so two
+// builds of the same project in different directories compare equal
+const rootPlaceholder = "<project>"
+
+// trees are the build outputs under .sbox that are compared
+var trees = []string{config.EnvDir, config.RootfsDir}
+
+// skipped are scratch directories of the rootfs
+var skipped = map[string]bool{
+	config.RootfsDir + "/tmp": true,
+}
+
+var (
+	// installerMetadata are files that record how and when packages were
+	// installed rather than what was installed, including sbox's record
+	// of the cached runtime an environment was restored from
+	installerMetadata = regexp.MustCompile(`(^|/)conda-meta/history$|^env/\.sbox-cache\.json$|\.dist-info/(RECORD|INSTALLER|REQUESTED|direct_url\.json)$`)
+	digits            = regexp.MustCompile(`[0-9]+`)
+	nulRun            = regexp.MustCompile("\x00+")
+)
+
+// Entry is one file, directory or symlink of a build
+type Entry struct {
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256,omitempty"`
+	Link   string      `json:"link,omitempty"`
+}
+
+// Manifest records the files of a build by path relative to .sbox
+type Manifest struct {
+	CreatedAt  string                 `json:"created_at"`
+	Platform   string                 `json:"platform"`
+	ConfigHash string                 `json:"config_hash"`
+	Packages   *config.LockedPackages `json:"packages,omitempty"`
+	Files      map[string]Entry       `json:"files"`
+}
+
+// Scan builds the manifest of a project's current build
+func Scan(projectRoot string) (*Manifest, error) {
+	m := &Manifest{
+		CreatedAt: time.Now().Format(time.RFC3339),
+		Platform:  config.GetPlatformKey(),
+		Files:     make(map[string]Entry),
+	}
+	if lock, err := config.LoadLock(projectRoot); err == nil {
+		m.ConfigHash = lock.ConfigHash
+		m.Packages = lock.Packages
+	}
+
+	sboxDir := config.GetSboxDir(projectRoot)
+	for _, tree := range trees {
+		root := filepath.Join(sboxDir, tree)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == root {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			rel, _ := filepath.Rel(sboxDir, path)
+			rel = filepath.ToSlash(rel)
+			if skipped[rel] {
+				return filepath.SkipDir
+			}
+
+			entry := Entry{Mode: info.Mode() & (os.ModeType | os.ModePerm)}
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				entry.Link = strings.ReplaceAll(link, projectRoot, rootPlaceholder)
+			case info.Mode().IsRegular():
+				if entry.SHA256, err = hashFile(path, projectRoot); err != nil {
+					return err
+				}
+			}
+			m.Files[rel] = entry
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", tree, err)
+		}
+	}
+	return m, nil
+}
+
+// Stage copies the inputs of a build to dst, a fresh project directory:
+// everything but .sbox, plus config.yaml when the project has one rather
+// than an sbox.yaml anchor
+func Stage(projectRoot, dst string) error {
+	return filepath.Walk(projectRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(projectRoot, path)
+		target := filepath.Join(dst, rel)
+		if rel == config.SboxDir {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			if _, err := os.Stat(filepath.Join(path, config.ConfigFile)); err != nil {
+				return filepath.SkipDir
+			}
+			if err := copyFile(filepath.Join(path, config.ConfigFile), filepath.Join(target, config.ConfigFile), 0644); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// hashFile hashes the normalized content of a file
+func hashFile(path, projectRoot string) (string, error) {
+	data, err := readNormalized(path, projectRoot)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readNormalized reads a file with the project root replaced by a
+// placeholder. Conda pads prefixes in binaries with NUL bytes up to a
+// fixed length, so runs of NULs are collapsed too.
+func readNormalized(path, projectRoot string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.ReplaceAll(data, []byte(projectRoot), []byte(rootPlaceholder))
+	return nulRun.ReplaceAll(data, []byte{0}), nil
+}
+
+// Save writes the manifest as JSON
+func (m *Manifest) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Load reads a reference file: a manifest written by Save, or an
+// sbox.lock, whose packages are compared and which has no files
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s is not a manifest or %s: %w", path, config.LockFile, err)
+	}
+	if m.Files == nil && m.Packages == nil {
+		return nil, fmt.Errorf("%s has neither files nor packages", path)
+	}
+	return &m, nil
+}
+
+// Difference is a file or package that differs between two builds
+type Difference struct {
+	Path  string
+	Cause string
+}
+
+// Build is a manifest together with the project it was scanned from.
+// Root is empty for a saved manifest, whose file contents are not
+// available to look into.
+type Build struct {
+	Manifest *Manifest
+	Root     string
+}
+
+// Compare lists the differences between a reference build and another.
+// Files are only compared when the reference has them, so a lock file
+// compares packages alone.
+func Compare(ref, other Build) []Difference {
+	var diffs []Difference
+	if ref.Manifest.Packages != nil && other.Manifest.Packages != nil {
+		for _, d := range runtime.DiffPackages(ref.Manifest.Packages, other.Manifest.Packages) {
+			diffs = append(diffs, Difference{Path: d, Cause: Packages})
+		}
+		for _, d := range runtime.DiffPackages(other.Manifest.Packages, ref.Manifest.Packages) {
+			if strings.Contains(d, ": missing") {
+				name, _, _ := strings.Cut(d, ":")
+				diffs = append(diffs, Difference{Path: name + ": not in the reference", Cause: Packages})
+			}
+		}
+	}
+	if ref.Manifest.Files == nil {
+		return diffs
+	}
+
+	paths := make(map[string]bool)
+	for path := range ref.Manifest.Files {
+		paths[path] = true
+	}
+	for path := range other.Manifest.Files {
+		paths[path] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	for _, path := range sorted {
+		a, inRef := ref.Manifest.Files[path]
+		b, inOther := other.Manifest.Files[path]
+		if inRef && inOther && a == b {
+			continue
+		}
+		shown := path
+		switch {
+		case !inOther:
+			shown += " (only in the reference)"
+		case !inRef:
+			shown += " (only in the new build)"
+		}
+		diffs = append(diffs, Difference{Path: shown, Cause: cause(path, a, b, inRef && inOther, ref.Root, other.Root)})
+	}
+	return diffs
+}
+
+// cause guesses why a file differs between two builds
+func cause(path string, a, b Entry, inBoth bool, refRoot, otherRoot string) string {
+	switch {
+	case installerMetadata.MatchString(path):
+		return Metadata
+	case !inBoth:
+		return Missing
+	case strings.HasSuffix(path, ".pyc"):
+		return Bytecode
+	case a.SHA256 == b.SHA256 && a.Link == b.Link:
+		return Permissions
+	case refRoot == "" || otherRoot == "" || a.SHA256 == "" || b.SHA256 == "":
+		return Content
+	}
+
+	refData, err := readNormalized(filepath.Join(config.GetSboxDir(refRoot), path), refRoot)
+	if err != nil {
+		return Content
+	}
+	otherData, err := readNormalized(filepath.Join(config.GetSboxDir(otherRoot), path), otherRoot)
+	if err != nil {
+		return Content
+	}
+	switch {
+	case bytes.Equal(digits.ReplaceAll(refData, []byte("0")), digits.ReplaceAll(otherData, []byte("0"))):
+		return Timestamps
+	case sameLines(refData, otherData):
+		return Ordering
+	}
+	return Content
+}
+
+// sameLines reports whether two texts have the same lines in another order
+func sameLines(a, b []byte) bool {
+	linesA := strings.Split(string(a), "\n")
+	linesB := strings.Split(string(b), "\n")
+	if len(linesA) != len(linesB) {
+		return false
+	}
+	sort.Strings(linesA)
+	sort.Strings(linesB)
+	for i := range linesA {
+		if linesA[i] != linesB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Group collects differences by cause
+func Group(diffs []Difference) map[string][]string {
+	groups := make(map[string][]string)
+	for _, d := range diffs {
+		groups[d.Cause] = append(groups[d.Cause], d.Path)
+	}
+	return groups
+}
+
+// Hint suggests how to make the files of a cause reproducible
+func Hint(cause string) string {
+	switch cause {
+	case Packages:
+		return "Versions were resolved again; use 'sbox build --frozen' or pin versions in install commands"
+	case Missing:
+		return "Install commands produced different files; check for downloads of 'latest' versions and optional features detected at build time"
+	case Bytecode:
+		return "Bytecode embeds source mtimes; prefix pip installs with SOURCE_DATE_EPOCH=0, or use pip install --no-compile"
+	case Timestamps:
+		return "Build dates are written into these files; set SOURCE_DATE_EPOCH in install commands"
+	case Ordering:
+		return "Files are written in a nondeterministic order (directory listing or hash order); set PYTHONHASHSEED=0 or sort in the generator"
+	case Permissions:
+		return "Check the umask of install commands and chmod steps in pre_build hooks"
+	case Metadata:
+		return "Install logs and pip RECORD files change on every build and do not affect the app"
+	case Content:
+		return "Keep the second build with 'sbox repro --keep' and diff the files"
+	}
+	return ""
+}
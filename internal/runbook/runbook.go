@@ -0,0 +1,267 @@
+// Package runbook generates the operator README shipped inside packed
+// archives, templated from the project configuration.
+package runbook
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/archive"
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// Info describes the archive being packed
+type Info struct {
+	ProjectName string
+	ArchiveName string
+	PackedAt    string
+	Platform    string
+	SboxVersion string
+	ExcludeEnv  bool
+	// Partial means the environment was resolved for another platform
+	// without running the install commands
+	Partial bool
+	// Frozen means sbox.lock carries resolved packages to rebuild from
+	Frozen bool
+	// Compression is the archive's compression (see archive.Compressions)
+	Compression string
+	// Split means the archive may come as volumes to join first
+	Split bool
+}
+
+// hostVarPattern matches $VAR, ${VAR} and ${VAR:-default} references
+var hostVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// HostVar is an environment variable the recipient must provide
+type HostVar struct {
+	Name       string
+	UsedBy     []string
+	HasDefault bool
+}
+
+// RequiredHostVars returns host variables referenced by env values, which
+// the recipient must export before starting the sandbox
+func RequiredHostVars(cfg *config.Config) []HostVar {
+	vars := make(map[string]*HostVar)
+	for key, value := range cfg.Raw().Env {
+		for _, m := range hostVarPattern.FindAllStringSubmatch(value, -1) {
+			name := m[1]
+			if name == "" {
+				name = m[3]
+			}
+			v, ok := vars[name]
+			if !ok {
+				v = &HostVar{Name: name, HasDefault: true}
+				vars[name] = v
+			}
+			v.UsedBy = append(v.UsedBy, key)
+			if m[2] == "" {
+				v.HasDefault = false
+			}
+		}
+	}
+
+	var out []HostVar
+	for _, v := range vars {
+		sort.Strings(v.UsedBy)
+		out = append(out, *v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Ports returns the listening ports of the config, keyed by the
+// variable they are exported as: the ports entries as SBOX_PORT_<NAME>,
+// or without any, env entries that look like ports (e.g. PORT, HTTP_PORT)
+func Ports(cfg *config.Config) map[string]string {
+	ports := make(map[string]string)
+	if len(cfg.Ports) > 0 {
+		for name, port := range cfg.Ports {
+			ports[config.PortEnvName(name)] = strconv.Itoa(port)
+		}
+		return ports
+	}
+	for key, value := range cfg.Raw().Env {
+		if key == "PORT" || strings.HasSuffix(key, "_PORT") {
+			ports[key] = value
+		}
+	}
+	return ports
+}
+
+// Generate renders the runbook text
+func Generate(cfg *config.Config, info Info) string {
+	var b strings.Builder
+	w := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+	section := func(title string) {
+		w("")
+		w("%s", title)
+		w("%s", strings.Repeat("-", len(title)))
+	}
+
+	title := fmt.Sprintf("%s - sbox Runbook", info.ProjectName)
+	w("%s", title)
+	w("%s", strings.Repeat("=", len(title)))
+	w("")
+	w("Runtime:  %s", cfg.Runtime)
+	w("Workdir:  %s", cfg.Workdir)
+	w("Command:  %s", valueOr(cfg.Cmd, "(none - pass a command to 'sbox run')"))
+	w("Packed:   %s with sbox %s on %s", info.PackedAt, info.SboxVersion, info.Platform)
+
+	section("Setup")
+	w("1. Extract the archive:")
+	if info.Split {
+		w("     sbox unpack %s   # if it came as volumes: joins them", archive.PartName(info.ArchiveName, 0))
+	}
+	w("     %s", archive.ExtractCommand(info.ArchiveName, info.Compression, false))
+	w("2. Relocate paths for the new location:")
+	w("     cd %s && sbox unpack", info.ProjectName)
+	if info.ExcludeEnv && info.Frozen {
+		w("3. Build the runtime (not included in this archive) from the")
+		w("   package versions locked in sbox.lock:")
+		w("     sbox build --frozen")
+	} else if info.ExcludeEnv {
+		w("3. Build the runtime (not included in this archive):")
+		w("     sbox build")
+	} else if info.Partial {
+		w("3. Run the install commands, which could not run for this")
+		w("   platform when it was packed:")
+		w("     sbox build --frozen")
+	}
+	w("")
+	w("You need sbox installed on the target system:")
+	w("  https://github.com/CVPaul/sbox")
+
+	hostVars := RequiredHostVars(cfg)
+	section("Environment Variables")
+	if len(hostVars) == 0 {
+		w("No host variables are required.")
+	} else {
+		w("Export these on the host before starting:")
+		for _, v := range hostVars {
+			note := "required"
+			if v.HasDefault {
+				note = "optional, has default"
+			}
+			w("  %-24s %s (used by %s)", v.Name, note, strings.Join(v.UsedBy, ", "))
+		}
+	}
+	if len(cfg.Env) > 0 {
+		var keys []string
+		for key := range cfg.Env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		w("")
+		w("Variables set inside the sandbox: %s", strings.Join(keys, ", "))
+	}
+
+	if mounts := cfg.ParseMount(); len(mounts) > 0 {
+		section("Host Directories")
+		w("These host paths are linked into the sandbox and must exist:")
+		for _, m := range mounts {
+			mode := "read-write"
+			if m.ReadOnly {
+				mode = "read-only"
+			}
+			w("  %-30s -> %s (%s)", m.Src, m.Dst, mode)
+		}
+	}
+
+	if ports := Ports(cfg); len(ports) > 0 {
+		section("Ports")
+		var keys []string
+		for key := range ports {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			w("  %-24s %s", key, ports[key])
+		}
+	}
+
+	if len(cfg.Healthchecks) > 0 {
+		section("Health Checks")
+		w("Probe a daemon with 'sbox healthcheck <name>' (exit code 0 OK,")
+		w("1 WARNING, 2 CRITICAL, 3 UNKNOWN):")
+		ports := Ports(cfg)
+		var names []string
+		for name := range cfg.Healthchecks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			check := cfg.Healthchecks[name]
+			if check.HTTP != "" {
+				w("  %-24s GET %s", name, expandPorts(check.HTTP, ports))
+			} else {
+				w("  %-24s %s", name, check.Command)
+			}
+		}
+	}
+
+	section("Operating the Service")
+	w("Run in the foreground:")
+	w("  sbox run")
+	w("")
+	w("Run as a background daemon:")
+	w("  %-36s # start", "sbox run -d --name "+info.ProjectName)
+	w("  %-36s # status", "sbox ps")
+	w("  %-36s # follow logs", "sbox logs -f "+info.ProjectName)
+	w("  %-36s # restart", "sbox restart "+info.ProjectName)
+	w("  %-36s # stop", "sbox stop "+info.ProjectName)
+
+	section("Security")
+	w("Always inspect the contents before running:")
+	w("- Check .sbox/config.yaml for the command that will run")
+	w("- Review .sbox/rootfs/ for the application files")
+	w("- Verify metadata.json for build information")
+	w("")
+	w("This archive uses standard %s format and can be", formatName(info.Compression))
+	w("inspected with any standard tools before extraction.")
+	if info.Split {
+		w("It is split into volumes (%s, ...) that are", archive.PartName(info.ArchiveName, 0))
+		w("concatenated, in order, back into the archive.")
+	}
+
+	return b.String()
+}
+
+// expandPorts resolves the port variables of a healthcheck URL, keeping
+// other references for the sandbox environment to resolve
+func expandPorts(url string, ports map[string]string) string {
+	return hostVarPattern.ReplaceAllStringFunc(url, func(ref string) string {
+		m := hostVarPattern.FindStringSubmatch(ref)
+		name := m[1]
+		if name == "" {
+			name = m[3]
+		}
+		if port, ok := ports[name]; ok {
+			return port
+		}
+		return ref
+	})
+}
+
+// formatName names the format of an archive with a compression
+func formatName(compression string) string {
+	switch compression {
+	case archive.Zstd:
+		return "tar+zstd"
+	case archive.None:
+		return "uncompressed tar"
+	}
+	return "tar+gzip"
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
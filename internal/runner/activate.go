@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// activateScripts returns the environment's conda activation scripts
+// (etc/conda/activate.d/*.sh) in the order conda sources them
+func activateScripts(envDir string) []string {
+	scripts, _ := filepath.Glob(filepath.Join(envDir, "etc", "conda", "activate.d", "*.sh"))
+	return scripts
+}
+
+// shellVars are set by the shell itself and not part of the activation
+var shellVars = map[string]bool{"PWD": true, "OLDPWD": true, "SHLVL": true, "_": true}
+
+// applyActivateScripts sources the activation scripts in env, as 'conda
+// activate' does, and returns the environment they leave behind. Packages
+// use them to set CUDA paths, PROJ_LIB, GDAL_DATA and the like.
+func applyActivateScripts(scripts []string, env []string) ([]string, error) {
+	var script strings.Builder
+	for _, path := range scripts {
+		// Keep stdout for the environment dump
+		fmt.Fprintf(&script, ". %s >&2\n", ShellJoin([]string{path}))
+	}
+	// env by path: a pure sandbox PATH has no system directories
+	dump := "env"
+	if path, err := exec.LookPath(dump); err == nil {
+		dump = path
+	}
+	fmt.Fprintf(&script, "exec %s -0\n", ShellJoin([]string{dump}))
+
+	// Activation scripts are written for bash
+	shell := "bash"
+	if _, err := exec.LookPath(shell); err != nil {
+		shell = "sh"
+	}
+	cmd := exec.Command(shell, "-c", script.String())
+	cmd.Env = env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+
+	var activated []string
+	for _, kv := range strings.Split(string(out), "\x00") {
+		name, _, ok := strings.Cut(kv, "=")
+		if !ok || shellVars[name] {
+			continue
+		}
+		activated = append(activated, kv)
+	}
+	return activated, nil
+}
@@ -0,0 +1,170 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/gpu"
+	"github.com/sbox-project/sbox/internal/process"
+)
+
+// systemDirs are exposed read-only inside a namespace sandbox so the
+// shell, libc and certificates keep working
+var systemDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc", "/run/systemd/resolve"}
+
+// bind is a host path made visible at the same location in the sandbox
+type bind struct {
+	Path     string
+	ReadOnly bool
+}
+
+// unshareScript builds the sandbox root with plain mount(8) calls when
+// bwrap is not available. Arguments: new root, workdir, then
+// "rw|ro path" pairs up to "--", then the command.
+const unshareScript = `set -e
+root=$1; workdir=$2; shift 2
+mount -t tmpfs sbox "$root"
+for d in /usr /bin /sbin /lib /lib32 /lib64 /etc /run/systemd/resolve; do
+  if [ -L "$d" ]; then mkdir -p "$root$(dirname "$d")"; ln -s "$(readlink "$d")" "$root$d"
+  elif [ -d "$d" ]; then mkdir -p "$root$d"; mount --rbind "$d" "$root$d"; mount -o remount,bind,ro "$root$d" 2>/dev/null || true; fi
+done
+mkdir -p "$root/dev" "$root/proc" "$root/tmp"
+mount --rbind /dev "$root/dev"
+mount -t proc proc "$root/proc"
+while [ "$1" != "--" ]; do
+  mode=$1; path=$2; shift 2
+  if [ -d "$path" ]; then mkdir -p "$root$path"; else mkdir -p "$root$(dirname "$path")"; touch "$root$path"; fi
+  mount --rbind "$path" "$root$path"
+  if [ "$mode" = ro ]; then mount -o remount,bind,ro "$root$path"; fi
+done
+shift
+exec chroot "$root" /bin/sh -c 'cd "$0" && exec "$@"' "$workdir" "$@"
+`
+
+// Command returns an exec.Cmd for argv, started inside the sandbox's
+// isolation backend when one is configured, at the configured priority,
+// on the configured CPUs and with the configured ulimits. The caller sets
+// Env, Dir and stdio as for a plain command.
+func (r *Runner) Command(argv ...string) (*exec.Cmd, error) {
+	launch, err := process.LaunchPrefix(r.Config.Priority, r.Config.CPUs, r.Config.Ulimits)
+	if err != nil {
+		return nil, err
+	}
+	isolation, err := r.IsolationPrefix(r.ResolveWorkdir())
+	if err != nil {
+		return nil, err
+	}
+	full := append(append(launch, isolation...), argv...)
+	return exec.Command(full[0], full[1:]...), nil
+}
+
+// IsolationPrefix returns the launcher command line that confines a
+// command to the sandbox, or nil when isolation is disabled. Namespace
+// isolation prefers bwrap and falls back to unshare.
+func (r *Runner) IsolationPrefix(workdir string) ([]string, error) {
+	switch r.Config.Isolation {
+	case "", config.IsolationNone:
+		return nil, nil
+	case config.IsolationNamespace:
+	default:
+		return nil, fmt.Errorf("unknown isolation mode '%s'", r.Config.Isolation)
+	}
+
+	binds := r.isolationBinds(workdir)
+
+	if bwrap, err := exec.LookPath("bwrap"); err == nil {
+		args := []string{bwrap, "--unshare-user", "--unshare-pid", "--unshare-ipc", "--unshare-uts"}
+		for _, dir := range systemDirs {
+			args = append(args, "--ro-bind-try", dir, dir)
+		}
+		args = append(args, "--dev", "/dev", "--proc", "/proc", "--tmpfs", "/tmp")
+		// bwrap's /dev is minimal; GPU sandboxes need the NVIDIA devices
+		if r.Config.UsesGPU() {
+			for _, dev := range gpu.Devices() {
+				args = append(args, "--dev-bind", dev, dev)
+			}
+		}
+		for _, b := range binds {
+			flag := "--bind"
+			if b.ReadOnly {
+				flag = "--ro-bind"
+			}
+			args = append(args, flag, b.Path, b.Path)
+		}
+		return append(args, "--chdir", workdir, "--"), nil
+	}
+
+	if unshare, err := exec.LookPath("unshare"); err == nil {
+		// The new root is an empty directory hidden under a tmpfs inside
+		// the mount namespace
+		root := filepath.Join(r.SboxDir, "isolate")
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return nil, fmt.Errorf("failed to prepare isolation root: %w", err)
+		}
+		args := []string{unshare, "--user", "--map-root-user", "--mount", "--pid", "--fork",
+			"sh", "-c", unshareScript, "sbox-isolate", root, workdir}
+		for _, b := range binds {
+			mode := "rw"
+			if b.ReadOnly {
+				mode = "ro"
+			}
+			args = append(args, mode, b.Path)
+		}
+		return append(args, "--"), nil
+	}
+
+	return nil, fmt.Errorf("isolation: namespace needs bwrap or unshare in PATH")
+}
+
+// isolationBinds returns the host paths visible inside the sandbox: the
+// rootfs, the environment, declared mounts, host_libs (with the GPU
+// driver's libraries) and the working directory
+func (r *Runner) isolationBinds(workdir string) []bind {
+	binds := []bind{{Path: r.Rootfs}, {Path: r.EnvDir}}
+	if mambaDir := filepath.Join(r.SboxDir, "mamba"); dirExists(mambaDir) {
+		binds = append(binds, bind{Path: mambaDir})
+	}
+
+	// Mounts are symlinks in the rootfs, so their targets must be bound
+	for _, spec := range r.Config.ParseMount() {
+		src := spec.Src
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(r.ProjectRoot, src)
+		}
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		binds = append(binds, bind{Path: src, ReadOnly: spec.ReadOnly})
+	}
+
+	for _, dir := range r.HostLibDirs() {
+		if dirExists(dir) {
+			binds = append(binds, bind{Path: dir, ReadOnly: true})
+		}
+	}
+	for _, dir := range r.Binds {
+		binds = append(binds, bind{Path: dir})
+	}
+
+	covered := false
+	for _, b := range binds {
+		if workdir == b.Path || strings.HasPrefix(workdir, b.Path+string(filepath.Separator)) {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		binds = append(binds, bind{Path: workdir})
+	}
+
+	return binds
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,103 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/console"
+	"github.com/sbox-project/sbox/internal/hooks"
+	"github.com/sbox-project/sbox/internal/mpi"
+	"github.com/sbox-project/sbox/internal/process"
+	"github.com/sbox-project/sbox/internal/sysproc"
+)
+
+// Job is a command started in the background by Start
+type Job struct {
+	cmd      *exec.Cmd
+	done     chan struct{}
+	exitCode int
+	err      error
+}
+
+// Start starts cmd, or the default command when empty, as Run does but
+// without waiting for it. It runs in its own process group so Stop ends
+// the processes it started too, and without stdin: reading the terminal
+// from another process group would stop it.
+func (r *Runner) Start(cmd string) (*Job, error) {
+	if err := r.CheckBuilt(); err != nil {
+		return nil, err
+	}
+
+	command := cmd
+	if command == "" {
+		command = r.Config.Cmd
+	}
+	if command == "" {
+		return nil, fmt.Errorf("no command specified and no default cmd in config")
+	}
+
+	workdir := r.ResolveWorkdir()
+	env := mpi.LaunchEnv(command, r.BuildEnv())
+
+	wrap, err := r.IsolationPrefix(workdir)
+	if err != nil {
+		return nil, err
+	}
+	if err := hooks.Run(config.HookPreRun, r.Config.PreRun, workdir, env, wrap); err != nil {
+		return nil, err
+	}
+
+	console.Step("Running: %s", command)
+
+	execCmd, err := r.Command(sysproc.Shell(command)...)
+	if err != nil {
+		return nil, err
+	}
+	execCmd.Dir = workdir
+	execCmd.Env = env
+	execCmd.Stdout, execCmd.Stderr = os.Stdout, os.Stderr
+	execCmd.SysProcAttr = sysproc.Group()
+
+	started := time.Now()
+	if err := execCmd.Start(); err != nil {
+		return nil, err
+	}
+
+	job := &Job{cmd: execCmd, done: make(chan struct{})}
+	go func() {
+		job.exitCode, job.err = exitStatus(execCmd.Wait())
+		r.recordUsage(process.UsageRun, execCmd, started)
+		if err := hooks.Run(config.HookPostRun, r.Config.PostRun, workdir, env, wrap); err != nil {
+			console.Warning("%s", err)
+		}
+		close(job.done)
+	}()
+	return job, nil
+}
+
+// Done is closed once the job exited and its post_run hooks ran
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// ExitCode returns the exit code of a job that is done
+func (j *Job) ExitCode() (int, error) {
+	return j.exitCode, j.err
+}
+
+// Stop sends SIGTERM to the job's process group and SIGKILL when it is
+// still running after timeout, and waits for it to be done
+func (j *Job) Stop(timeout time.Duration) {
+	pid := j.cmd.Process.Pid
+	sysproc.SignalGroup(pid, syscall.SIGTERM)
+	select {
+	case <-j.done:
+	case <-time.After(timeout):
+		sysproc.KillGroup(pid)
+		<-j.done
+	}
+}
@@ -0,0 +1,46 @@
+package runner
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/process"
+)
+
+// Metrics is what 'sbox run --metrics' reports about a foreground command
+type Metrics struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	// WallSeconds includes the time the command waited, e.g. for IO
+	WallSeconds   float64 `json:"wall_seconds"`
+	UserSeconds   float64 `json:"user_seconds"`
+	SystemSeconds float64 `json:"system_seconds"`
+	// MaxRSS is the peak resident set of the largest process in the
+	// command's tree that was waited for
+	MaxRSS int64 `json:"max_rss_bytes"`
+}
+
+// CPUSeconds returns the user and system time together
+func (m *Metrics) CPUSeconds() float64 {
+	return m.UserSeconds + m.SystemSeconds
+}
+
+// newMetrics reads the metrics of an exited command from its wait4
+// rusage, which covers the processes it waited for
+func newMetrics(command string, exitCode int, state *os.ProcessState, started time.Time) *Metrics {
+	m := &Metrics{
+		Command:     command,
+		ExitCode:    exitCode,
+		WallSeconds: time.Since(started).Seconds(),
+	}
+	if state == nil {
+		return m
+	}
+	m.UserSeconds = state.UserTime().Seconds()
+	m.SystemSeconds = state.SystemTime().Seconds()
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		m.MaxRSS = process.MaxRSSBytes(usage)
+	}
+	return m
+}
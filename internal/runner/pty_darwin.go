@@ -0,0 +1,45 @@
+package runner
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
+
+// openPTY opens a new pseudo-terminal pair
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ioctlFile(master, syscall.TIOCPTYGRANT, nil); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	if err := ioctlFile(master, syscall.TIOCPTYUNLK, nil); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var name [128]byte
+	if err := ioctlFile(master, syscall.TIOCPTYGNAME, unsafe.Pointer(&name[0])); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	if i := bytes.IndexByte(name[:], 0); i >= 0 {
+		slave, err = os.OpenFile(string(name[:i]), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if slave == nil || err != nil {
+		master.Close()
+		if err == nil {
+			err = syscall.EINVAL
+		}
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
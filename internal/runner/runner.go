@@ -3,15 +3,30 @@ package runner
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
 	"github.com/sbox-project/sbox/internal/config"
 	"github.com/sbox-project/sbox/internal/console"
+	"github.com/sbox-project/sbox/internal/gpu"
+	"github.com/sbox-project/sbox/internal/hooks"
+	"github.com/sbox-project/sbox/internal/mpi"
+	"github.com/sbox-project/sbox/internal/process"
+	"github.com/sbox-project/sbox/internal/secrets"
+	"github.com/sbox-project/sbox/internal/sysproc"
 )
 
+// windowsVars are the host variables every sandbox gets on Windows
+var windowsVars = []string{
+	"SystemRoot", "SystemDrive", "WINDIR", "COMSPEC", "PATHEXT",
+	"PROCESSOR_ARCHITECTURE", "NUMBER_OF_PROCESSORS", "USERNAME",
+}
+
 // Runner executes commands in the sandbox environment
 type Runner struct {
 	ProjectRoot string
@@ -19,6 +34,45 @@ type Runner struct {
 	EnvDir      string
 	Rootfs      string
 	SboxDir     string
+	// ServiceName is exported as SBOX_SERVICE_NAME (default: project name)
+	ServiceName string
+
+	// Pure leaves out what BuildEnv would take from the host: the system
+	// directories on PATH and host variables such as DISPLAY and
+	// SSH_AUTH_SOCK. TERM is kept for interactive use.
+	Pure bool
+
+	// Workdir replaces the configured workdir when set, e.g. the current
+	// directory for 'sbox exec --cwd'. Isolation binds it in.
+	Workdir string
+
+	// ShellName is the shell Shell starts, one of Shells; empty means
+	// $SHELL when supported, else bash
+	ShellName string
+
+	// Binds are extra directories the command may write to under
+	// isolation, e.g. where 'sbox profile' writes profiles
+	Binds []string
+
+	// TTY runs the commands of Run and Exec on a new pseudo-terminal,
+	// for interactive programs such as ipython
+	TTY bool
+
+	// Interactive passes the stdin of sbox to the commands of Exec; they
+	// read nothing without it, so scripts keep their input. Run and
+	// Shell always pass it.
+	Interactive bool
+
+	// Stdout and Stderr receive the output of Exec in place of those of
+	// sbox when set, e.g. to prefix it with a service name
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Metrics describes the command of the last Run once it exited
+	Metrics *Metrics
+
+	// fileEnv holds the variables of env_file and --env-file files
+	fileEnv map[string]string
 }
 
 // New creates a new runner
@@ -28,19 +82,55 @@ func New(projectRoot string) (*Runner, error) {
 		return nil, err
 	}
 
-	return &Runner{
+	r := &Runner{
 		ProjectRoot: projectRoot,
 		Config:      cfg,
 		EnvDir:      config.GetEnvDir(projectRoot),
 		Rootfs:      config.GetRootfsDir(projectRoot),
 		SboxDir:     config.GetSboxDir(projectRoot),
-	}, nil
+		ServiceName: filepath.Base(projectRoot),
+	}
+	if cfg.EnvFile != "" {
+		if err := r.LoadEnvFile(config.ResolveEnvFile(projectRoot, cfg.EnvFile)); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// LoadEnvFile adds the variables of a .env file to the sandbox
+// environment, overriding those of files loaded before it. Malformed
+// lines are skipped with a warning.
+func (r *Runner) LoadEnvFile(path string) error {
+	vars, problems, err := config.ReadEnvFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read env file: %w", err)
+	}
+	for _, problem := range problems {
+		console.Warning("%s: %s (skipped)", path, problem)
+	}
+
+	if r.fileEnv == nil {
+		r.fileEnv = make(map[string]string)
+	}
+	for key, value := range vars {
+		r.fileEnv[key] = value
+	}
+	return nil
+}
+
+// CheckBuilt returns an error unless the sandbox is built for this host
+func (r *Runner) CheckBuilt() error {
+	if !config.IsBuilt(r.ProjectRoot) {
+		return fmt.Errorf("sandbox not built. Run 'sbox build' first")
+	}
+	return config.CheckPlatform(r.ProjectRoot)
 }
 
 // Run executes the command in the sandbox
 func (r *Runner) Run(cmd string) (int, error) {
-	if !config.IsBuilt(r.ProjectRoot) {
-		return 1, fmt.Errorf("sandbox not built. Run 'sbox build' first")
+	if err := r.CheckBuilt(); err != nil {
+		return 1, err
 	}
 
 	command := cmd
@@ -52,71 +142,93 @@ func (r *Runner) Run(cmd string) (int, error) {
 	}
 
 	workdir := r.ResolveWorkdir()
-	env := r.BuildEnv()
+	env := mpi.LaunchEnv(command, r.BuildEnv())
+
+	wrap, err := r.IsolationPrefix(workdir)
+	if err != nil {
+		return 1, err
+	}
+	if err := hooks.Run(config.HookPreRun, r.Config.PreRun, workdir, env, wrap); err != nil {
+		return 1, err
+	}
 
 	console.Step("Running: %s", command)
 	console.Info("Workdir: %s", workdir)
+	if launcher := mpi.Launcher(command); launcher != "" {
+		console.Info("Exporting the sandbox environment to %s ranks", launcher)
+	}
 	fmt.Println()
 
-	execCmd := exec.Command("sh", "-c", command)
+	execCmd, err := r.Command(sysproc.Shell(command)...)
+	if err != nil {
+		return 1, err
+	}
 	execCmd.Dir = workdir
 	execCmd.Env = env
-	execCmd.Stdin = os.Stdin
-	execCmd.Stdout = os.Stdout
-	execCmd.Stderr = os.Stderr
 
-	err := execCmd.Run()
+	started := time.Now()
+	exitCode, err := runForeground(execCmd, r.TTY, true)
+	r.recordUsage(process.UsageRun, execCmd, started)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return exitErr.ExitCode(), nil
-		}
 		return 1, err
 	}
+	r.Metrics = newMetrics(command, exitCode, execCmd.ProcessState, started)
 
-	return 0, nil
+	// post_run hooks run whatever the exit status; their failures do
+	// not change it
+	if err := hooks.Run(config.HookPostRun, r.Config.PostRun, workdir, env, wrap); err != nil {
+		console.Warning("%s", err)
+	}
+	return exitCode, nil
 }
 
 // Shell starts an interactive shell in the sandbox
 func (r *Runner) Shell() (int, error) {
-	if !config.IsBuilt(r.ProjectRoot) {
-		return 1, fmt.Errorf("sandbox not built. Run 'sbox build' first")
+	if err := r.CheckBuilt(); err != nil {
+		return 1, err
 	}
 
 	workdir := r.ResolveWorkdir()
 	env := r.BuildEnv()
 
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "/bin/bash"
+	// The shell reads an rc file of sbox, not the user's, which would
+	// put the host's PATH and conda hooks back
+	kind, err := shellKind(r.ShellName)
+	if err != nil {
+		return 1, err
+	}
+	argv, shellEnv, err := r.shellCommand(kind, env)
+	if err != nil {
+		return 1, fmt.Errorf("failed to set up %s: %w", kind, err)
 	}
+	env = append(env, shellEnv...)
 
-	console.Step("Starting shell in sandbox...")
+	console.Step("Starting %s in sandbox...", kind)
 	console.Info("Workdir: %s", workdir)
+	if r.Pure {
+		console.Info("Pure environment: PATH is %s/bin only, host variables are not passed", r.EnvDir)
+	}
 	console.Info("Type 'exit' to leave the sandbox")
 	fmt.Println()
 
-	execCmd := exec.Command(shell)
-	execCmd.Dir = workdir
-	execCmd.Env = env
-	execCmd.Stdin = os.Stdin
-	execCmd.Stdout = os.Stdout
-	execCmd.Stderr = os.Stderr
-
-	err := execCmd.Run()
+	execCmd, err := r.Command(argv...)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return exitErr.ExitCode(), nil
-		}
 		return 1, err
 	}
+	execCmd.Dir = workdir
+	execCmd.Env = env
 
-	return 0, nil
+	// The shell keeps the terminal of sbox
+	started := time.Now()
+	exitCode, err := runForeground(execCmd, false, true)
+	r.recordUsage(process.UsageShell, execCmd, started)
+	return exitCode, err
 }
 
 // Exec executes a command with arguments in the sandbox
 func (r *Runner) Exec(args []string) (int, error) {
-	if !config.IsBuilt(r.ProjectRoot) {
-		return 1, fmt.Errorf("sandbox not built. Run 'sbox build' first")
+	if err := r.CheckBuilt(); err != nil {
+		return 1, err
 	}
 
 	if len(args) == 0 {
@@ -124,28 +236,78 @@ func (r *Runner) Exec(args []string) (int, error) {
 	}
 
 	workdir := r.ResolveWorkdir()
-	env := r.BuildEnv()
+	env := mpi.LaunchEnv(args[0], r.BuildEnv())
 
-	execCmd := exec.Command(args[0], args[1:]...)
+	execCmd, err := r.Command(args...)
+	if err != nil {
+		return 1, err
+	}
 	execCmd.Dir = workdir
 	execCmd.Env = env
-	execCmd.Stdin = os.Stdin
-	execCmd.Stdout = os.Stdout
-	execCmd.Stderr = os.Stderr
+	execCmd.Stdout, execCmd.Stderr = r.Stdout, r.Stderr
 
-	err := execCmd.Run()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return exitErr.ExitCode(), nil
+	started := time.Now()
+	exitCode, err := runForeground(execCmd, r.TTY, r.Interactive)
+	r.recordUsage(process.UsageExec, execCmd, started)
+	return exitCode, err
+}
+
+// recordUsage meters a foreground command once it exited
+func (r *Runner) recordUsage(kind string, cmd *exec.Cmd, started time.Time) {
+	if cmd.ProcessState != nil {
+		pm := process.NewProcessManager(r.ProjectRoot)
+		pm.RecordUsage(process.ForegroundUsage(kind, cmd.ProcessState, started))
+	}
+}
+
+// HostLibDirs returns the host directories added to LD_LIBRARY_PATH:
+// host_libs, then for GPU sandboxes the NVIDIA driver's libraries and
+// the host's own LD_LIBRARY_PATH, e.g. from 'module load cuda'
+func (r *Runner) HostLibDirs() []string {
+	dirs := r.Config.HostLibDirs()
+	if !r.Config.UsesGPU() {
+		return dirs
+	}
+	dirs = append(dirs, gpu.LibDirs()...)
+	if !r.Pure {
+		for _, dir := range filepath.SplitList(os.Getenv("LD_LIBRARY_PATH")) {
+			if dir != "" {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	unique := dirs[:0]
+	for _, dir := range dirs {
+		if !seen[dir] {
+			seen[dir] = true
+			unique = append(unique, dir)
 		}
-		return 1, err
 	}
+	return unique
+}
 
-	return 0, nil
+// ShellJoin quotes argv into a command line for 'sh -c' that runs exactly
+// those arguments. Plain words are left unquoted so the command stays
+// readable in 'sbox ps'.
+func ShellJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-.,/:=@%+") == "" {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
 }
 
 // ResolveWorkdir returns the resolved working directory path
 func (r *Runner) ResolveWorkdir() string {
+	if r.Workdir != "" {
+		return r.Workdir
+	}
 	workdirConfig := r.Config.Workdir
 
 	var resolved string
@@ -173,6 +335,16 @@ func (r *Runner) BuildEnv() []string {
 
 	// Essential system vars
 	essentialVars := []string{"LANG", "TERM", "USER", "LOGNAME", "DISPLAY", "SSH_AUTH_SOCK"}
+	if r.Pure {
+		essentialVars = []string{"TERM"}
+	}
+	if r.Config.UsesGPU() {
+		essentialVars = append(essentialVars, gpu.Env...)
+	}
+	if runtime.GOOS == "windows" {
+		// Windows programs, Python's included, fail without these
+		essentialVars = append(essentialVars, windowsVars...)
+	}
 	for _, key := range essentialVars {
 		if val := os.Getenv(key); val != "" {
 			env = append(env, fmt.Sprintf("%s=%s", key, val))
@@ -180,7 +352,7 @@ func (r *Runner) BuildEnv() []string {
 	}
 
 	// Defaults
-	if os.Getenv("LANG") == "" {
+	if os.Getenv("LANG") == "" || r.Pure {
 		env = append(env, "LANG=en_US.UTF-8")
 	}
 	if os.Getenv("TERM") == "" {
@@ -191,25 +363,101 @@ func (r *Runner) BuildEnv() []string {
 	env = append(env, "SBOX_ACTIVE=1")
 	env = append(env, fmt.Sprintf("SBOX_PROJECT=%s", r.ProjectRoot))
 
+	// Build and runtime provenance for the application
+	env = append(env, fmt.Sprintf("SBOX_VERSION=%s", config.Version))
+	env = append(env, fmt.Sprintf("SBOX_RUNTIME=%s", r.Config.Runtime))
+	if lock, err := config.LoadLock(r.ProjectRoot); err == nil && lock.ConfigHash != "" {
+		env = append(env, fmt.Sprintf("SBOX_BUILD_HASH=%s", lock.ConfigHash))
+	}
+	env = append(env, fmt.Sprintf("SBOX_SERVICE_NAME=%s", r.ServiceName))
+	env = append(env, fmt.Sprintf("SBOX_LOG_DIR=%s", process.NewProcessManager(r.ProjectRoot).GetLogDir()))
+
+	// Declared ports
+	for name, port := range r.Config.Ports {
+		env = append(env, fmt.Sprintf("%s=%d", config.PortEnvName(name), port))
+	}
+
 	// Python isolation
 	env = append(env, "PYTHONNOUSERSITE=1")
 	env = append(env, "PYTHONDONTWRITEBYTECODE=1")
 	env = append(env, "PIP_DISABLE_PIP_VERSION_CHECK=1")
 
-	// Paths - isolated
-	env = append(env, fmt.Sprintf("PATH=%s/bin:/usr/bin:/bin:/usr/sbin:/sbin", r.EnvDir))
+	// Paths - the environment first, then the host directories of
+	// path_mode
+	path := config.EnvBinDirs(r.EnvDir)
+	if !r.Pure {
+		seen := make(map[string]bool)
+		for _, dir := range path {
+			seen[dir] = true
+		}
+		for _, dir := range r.Config.HostPathDirs() {
+			if !seen[dir] {
+				seen[dir] = true
+				path = append(path, dir)
+			}
+		}
+	}
+	env = append(env, "PATH="+strings.Join(path, string(os.PathListSeparator)))
 	env = append(env, fmt.Sprintf("HOME=%s/home", r.Rootfs))
 	env = append(env, fmt.Sprintf("TMPDIR=%s/tmp", r.Rootfs))
+	if runtime.GOOS == "windows" {
+		home, tmp := filepath.Join(r.Rootfs, "home"), filepath.Join(r.Rootfs, "tmp")
+		env = append(env, "USERPROFILE="+home, "TEMP="+tmp, "TMP="+tmp)
+	}
 
 	// Conda/mamba vars
 	env = append(env, fmt.Sprintf("CONDA_PREFIX=%s", r.EnvDir))
 	env = append(env, fmt.Sprintf("MAMBA_ROOT_PREFIX=%s/mamba", r.SboxDir))
 
+	// Conda packages' activation scripts, before the project's own vars
+	if scripts := activateScripts(r.EnvDir); len(scripts) > 0 {
+		if activated, err := applyActivateScripts(scripts, env); err != nil {
+			console.Warning("Conda activation scripts failed: %s", err)
+		} else {
+			env = activated
+		}
+	}
+
+	// Env files, unless env in config.yaml sets the same variable
+	for key, value := range r.fileEnv {
+		if _, ok := r.Config.Env[key]; !ok {
+			env = append(env, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+
+	// Host libraries come after the environment's own, so they cannot
+	// shadow the libraries conda packages were built against
+	hostLibs := r.HostLibDirs()
+	if len(hostLibs) > 0 {
+		ldPath := append([]string{filepath.Join(r.EnvDir, "lib")}, hostLibs...)
+		if value, ok := r.Config.Env["LD_LIBRARY_PATH"]; ok && value != "" {
+			ldPath = append([]string{os.ExpandEnv(value)}, ldPath...)
+		}
+		env = append(env, "LD_LIBRARY_PATH="+strings.Join(ldPath, ":"))
+	}
+
 	// Custom environment variables from config
 	for key, value := range r.Config.Env {
+		if key == "LD_LIBRARY_PATH" && len(hostLibs) > 0 {
+			continue
+		}
 		expanded := os.ExpandEnv(value)
 		env = append(env, fmt.Sprintf("%s=%s", key, expanded))
 	}
 
+	// Secrets last, decrypted for this command only
+	if len(r.Config.Secrets) > 0 {
+		store, err := secrets.Open(r.ProjectRoot, false)
+		if err == nil {
+			var values []string
+			if values, err = store.Env(r.Config.Secrets); err == nil {
+				env = append(env, values...)
+			}
+		}
+		if err != nil {
+			console.Warning("Secrets not set: %s", err)
+		}
+	}
+
 	return env
 }
@@ -0,0 +1,170 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Shells are the shells 'sbox shell' writes an rc file for
+var Shells = []string{"bash", "zsh", "fish"}
+
+// WindowsShells are those of 'sbox shell' on Windows
+var WindowsShells = []string{"powershell", "pwsh", "cmd"}
+
+// ShellRCDir holds the generated rc files, in .sbox
+const ShellRCDir = "shell"
+
+// shellKind returns the shell to start: name when given, else the user's
+// $SHELL when sbox supports it, else bash; on Windows PowerShell
+func shellKind(name string) (string, error) {
+	if name == "" {
+		name = filepath.Base(os.Getenv("SHELL"))
+		if !isShell(name) {
+			name = "bash"
+			if runtime.GOOS == "windows" {
+				name = "powershell"
+			}
+		}
+	}
+	if !isShell(name) {
+		return "", fmt.Errorf("unsupported shell '%s' (supported: %s)", name, strings.Join(supportedShells(), ", "))
+	}
+	return name, nil
+}
+
+// supportedShells returns the shells of this platform
+func supportedShells() []string {
+	if runtime.GOOS == "windows" {
+		return WindowsShells
+	}
+	return Shells
+}
+
+func isShell(name string) bool {
+	for _, shell := range supportedShells() {
+		if shell == name {
+			return true
+		}
+	}
+	return false
+}
+
+// shellPath finds a shell, preferring $SHELL when it is that shell
+func shellPath(kind string) (string, error) {
+	if shell := os.Getenv("SHELL"); shell != "" && filepath.Base(shell) == kind {
+		return shell, nil
+	}
+	path, err := exec.LookPath(kind)
+	if err != nil {
+		return "", fmt.Errorf("%s not found on PATH", kind)
+	}
+	return path, nil
+}
+
+// shellCommand writes the rc file of a shell and returns the command line
+// starting it with that file instead of the user's, and variables the
+// shell needs for it. The rc sets the sandbox PATH again, after anything
+// in /etc the shell reads, shows (sbox:<project>) in the prompt and keeps
+// history in the sandbox home.
+func (r *Runner) shellCommand(kind string, env []string) ([]string, []string, error) {
+	shell, err := shellPath(kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	path, home := "", ""
+	for _, kv := range env {
+		if value, ok := strings.CutPrefix(kv, "PATH="); ok {
+			path = value
+		} else if value, ok := strings.CutPrefix(kv, "HOME="); ok {
+			home = value
+		}
+	}
+	if home != "" {
+		if err := os.MkdirAll(home, 0755); err != nil {
+			return nil, nil, err
+		}
+	}
+	project := filepath.Base(r.ProjectRoot)
+	dir := filepath.Join(r.SboxDir, ShellRCDir)
+
+	var rcPath, rc string
+	var argv, extra []string
+	switch kind {
+	case "bash":
+		rcPath = filepath.Join(dir, "bashrc")
+		rc = fmt.Sprintf(`export PATH=%s
+export HISTFILE="$HOME/.bash_history"
+PS1=%s
+`, ShellJoin([]string{path}), ShellJoin([]string{"(sbox:" + project + ") \\w \\$ "}))
+		argv = []string{shell, "--noprofile", "--rcfile", rcPath, "-i"}
+	case "zsh":
+		// zsh reads .zshrc from ZDOTDIR; -d skips /etc/zshrc and friends
+		rcPath = filepath.Join(dir, "zsh", ".zshrc")
+		rc = fmt.Sprintf(`export PATH=%s
+HISTFILE="$HOME/.zsh_history"
+HISTSIZE=10000
+SAVEHIST=10000
+PROMPT=%s
+`, ShellJoin([]string{path}), ShellJoin([]string{"(sbox:" + project + ") %~ %# "}))
+		argv = []string{shell, "-d", "-i"}
+		extra = []string{"ZDOTDIR=" + filepath.Dir(rcPath)}
+	case "fish":
+		// fish keeps history in $XDG_DATA_HOME, under the sandbox home
+		rcPath = filepath.Join(dir, "config.fish")
+		rc = fmt.Sprintf(`set -gx PATH %s
+function fish_prompt
+    echo -n %s(prompt_pwd)'> '
+end
+`, fishJoin(filepath.SplitList(path)), fishJoin([]string{"(sbox:" + project + ") "}))
+		argv = []string{shell, "--no-config", "--init-command", "source " + fishJoin([]string{rcPath}), "-i"}
+		extra = []string{"XDG_DATA_HOME=" + filepath.Join(home, ".local", "share")}
+	case "powershell", "pwsh":
+		// Dot-sourced so the prompt function outlives the script;
+		// PSReadLine keeps history where it is told
+		rcPath = filepath.Join(dir, "profile.ps1")
+		rc = fmt.Sprintf(`$env:PATH = %s
+function prompt { %s + $executionContext.SessionState.Path.CurrentLocation + '> ' }
+if (Get-Command Set-PSReadLineOption -ErrorAction SilentlyContinue) {
+    Set-PSReadLineOption -HistorySavePath (Join-Path $HOME 'powershell_history.txt')
+}
+`, psQuote(path), psQuote("(sbox:"+project+") PS "))
+		argv = []string{shell, "-NoLogo", "-NoProfile", "-NoExit", "-ExecutionPolicy", "Bypass", "-Command", ". " + psQuote(rcPath)}
+	case "cmd":
+		// cmd keeps no history between sessions
+		rcPath = filepath.Join(dir, "init.cmd")
+		rc = fmt.Sprintf("@set \"PATH=%s\"\r\n@prompt %s$P$G\r\n", path, "(sbox:"+project+") ")
+		argv = []string{shell, "/k", rcPath}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rcPath), 0755); err != nil {
+		return nil, nil, err
+	}
+	header := "# Generated by 'sbox shell' on every start; edits are overwritten\n"
+	if kind == "cmd" {
+		header = "@rem Generated by 'sbox shell' on every start; edits are overwritten\r\n"
+	}
+	if err := os.WriteFile(rcPath, []byte(header+rc), 0644); err != nil {
+		return nil, nil, err
+	}
+	return argv, extra, nil
+}
+
+// psQuote quotes a word for PowerShell, where a single quote inside single
+// quotes is doubled
+func psQuote(word string) string {
+	return "'" + strings.ReplaceAll(word, "'", "''") + "'"
+}
+
+// fishJoin quotes words for fish, whose single quotes escape \ and '
+func fishJoin(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		word = strings.ReplaceAll(word, `\`, `\\`)
+		quoted[i] = "'" + strings.ReplaceAll(word, "'", `\'`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
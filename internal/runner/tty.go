@@ -0,0 +1,236 @@
+//go:build unix
+
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// winsize is struct winsize of TIOCGWINSZ and TIOCSWINSZ
+type winsize struct {
+	Row, Col, X, Y uint16
+}
+
+// ioctl runs an ioctl on fd
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ioctlFile runs an ioctl on f without switching it to blocking mode,
+// as f.Fd() would
+func ioctlFile(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ioctlErr error
+	if err := rc.Control(func(fd uintptr) { ioctlErr = ioctl(fd, req, arg) }); err != nil {
+		return err
+	}
+	return ioctlErr
+}
+
+// isTerminal reports whether fd is a terminal
+func isTerminal(fd uintptr) bool {
+	var t syscall.Termios
+	return ioctl(fd, ioctlGetTermios, unsafe.Pointer(&t)) == nil
+}
+
+// StdinIsTerminal reports whether the stdin of sbox is a terminal
+func StdinIsTerminal() bool {
+	return isTerminal(os.Stdin.Fd())
+}
+
+// isForeground reports whether this process runs in the foreground of
+// the terminal on stdin, where keys such as Ctrl-C signal the whole
+// process group, the command included
+func isForeground() bool {
+	var pgrp int32
+	if err := ioctl(os.Stdin.Fd(), syscall.TIOCGPGRP, unsafe.Pointer(&pgrp)); err != nil {
+		return false
+	}
+	return int(pgrp) == syscall.Getpgrp()
+}
+
+// makeRaw puts the terminal fd in raw mode like cfmakeraw and returns
+// its previous state
+func makeRaw(fd uintptr) (*syscall.Termios, error) {
+	var old syscall.Termios
+	if err := ioctl(fd, ioctlGetTermios, unsafe.Pointer(&old)); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, ioctlSetTermios, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return &old, nil
+}
+
+// restoreTerminal puts a terminal back into the state makeRaw returned
+func restoreTerminal(fd uintptr, state *syscall.Termios) {
+	ioctl(fd, ioctlSetTermios, unsafe.Pointer(state))
+}
+
+// copyWinsize gives the pseudo-terminal the size of the terminal on fd
+func copyWinsize(fd uintptr, pty *os.File) {
+	var ws winsize
+	if ioctl(fd, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)) == nil {
+		ioctlFile(pty, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+	}
+}
+
+// forwardedSignals are passed on to the command. SIGINT and SIGQUIT are
+// only forwarded when the terminal does not deliver them itself.
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP,
+	syscall.SIGUSR1, syscall.SIGUSR2,
+}
+
+// runForeground runs cmd with the standard streams of sbox, or on a new
+// pseudo-terminal with tty, forwards the signals sbox receives to it
+// and returns its exit code (128+N when killed by signal N). Output cmd
+// already has set is kept unless it runs on a pseudo-terminal. Without
+// interactive the command reads nothing: its stdin is /dev/null, or a
+// pseudo-terminal nobody types into.
+//
+// With a pseudo-terminal or without a controlling terminal, the command
+// gets its own process group and signals reach the whole group, so
+// processes started by 'sh -c' get them too. In the foreground of a
+// terminal the command shares the group of sbox, which keeps it able to
+// read the terminal; SIGINT and SIGQUIT then come from the terminal.
+func runForeground(cmd *exec.Cmd, tty, interactive bool) (int, error) {
+	stdin := os.Stdin.Fd()
+	var pty *os.File
+	group := false
+	terminalSignals := false
+
+	// Signals arriving while the command starts are delivered once it runs
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, forwardedSignals...)
+	if tty {
+		signal.Notify(signals, syscall.SIGWINCH)
+	}
+	defer func() {
+		signal.Stop(signals)
+		close(signals)
+	}()
+
+	if tty {
+		if interactive && !isTerminal(stdin) {
+			return 1, fmt.Errorf("--tty needs a terminal on stdin")
+		}
+		master, slave, err := openPTY()
+		if err != nil {
+			return 1, fmt.Errorf("failed to allocate a pseudo-terminal: %w", err)
+		}
+		defer master.Close()
+		copyWinsize(stdin, master)
+
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+		err = cmd.Start()
+		slave.Close()
+		if err != nil {
+			return 1, err
+		}
+		pty = master
+		group = true
+	} else {
+		if cmd.Stdout == nil {
+			cmd.Stdout = os.Stdout
+		}
+		if cmd.Stderr == nil {
+			cmd.Stderr = os.Stderr
+		}
+		if interactive {
+			cmd.Stdin = os.Stdin
+		}
+		terminalSignals = isForeground()
+		if !terminalSignals {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			group = true
+		}
+		if err := cmd.Start(); err != nil {
+			return 1, err
+		}
+	}
+
+	target := cmd.Process.Pid
+	if group {
+		target = -target
+	}
+	go func() {
+		for sig := range signals {
+			switch {
+			case sig == syscall.SIGWINCH:
+				copyWinsize(stdin, pty)
+			case terminalSignals && (sig == syscall.SIGINT || sig == syscall.SIGQUIT):
+				// The terminal signalled the command as well
+			default:
+				syscall.Kill(target, sig.(syscall.Signal))
+			}
+		}
+	}()
+
+	var output chan struct{}
+	if pty != nil {
+		if interactive {
+			state, err := makeRaw(stdin)
+			if err == nil {
+				defer restoreTerminal(stdin, state)
+			}
+			go io.Copy(pty, os.Stdin)
+		}
+		output = make(chan struct{})
+		go func() {
+			// Ends with EIO once every process holding the terminal exited
+			io.Copy(os.Stdout, pty)
+			close(output)
+		}()
+	}
+
+	err := cmd.Wait()
+	if output != nil {
+		// Background processes may keep the terminal open; do not wait
+		// for them
+		select {
+		case <-output:
+		case <-time.After(time.Second):
+		}
+	}
+	return exitStatus(err)
+}
+
+// exitStatus turns the error of cmd.Wait into an exit code (128+N when
+// killed by signal N), keeping errors other than a failed exit
+func exitStatus(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1, err
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+	return exitErr.ExitCode(), nil
+}
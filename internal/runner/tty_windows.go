@@ -0,0 +1,56 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// isTerminal reports whether fd is a console
+func isTerminal(fd uintptr) bool {
+	var mode uint32
+	return syscall.GetConsoleMode(syscall.Handle(fd), &mode) == nil
+}
+
+// StdinIsTerminal reports whether the stdin of sbox is a console
+func StdinIsTerminal() bool {
+	return isTerminal(os.Stdin.Fd())
+}
+
+// runForeground runs cmd with the standard streams of sbox and returns
+// its exit code. Windows has no pseudo-terminals to put it on, and the
+// console delivers Ctrl+C to every process attached to it, the command
+// included, so nothing is forwarded. Without interactive the command
+// reads nothing.
+func runForeground(cmd *exec.Cmd, tty, interactive bool) (int, error) {
+	if tty {
+		return 1, fmt.Errorf("--tty is not supported on Windows")
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	if interactive {
+		cmd.Stdin = os.Stdin
+	}
+	if err := cmd.Start(); err != nil {
+		return 1, err
+	}
+	return exitStatus(cmd.Wait())
+}
+
+// exitStatus turns the error of cmd.Wait into an exit code, keeping
+// errors other than a failed exit
+func exitStatus(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1, err
+	}
+	return exitErr.ExitCode(), nil
+}
@@ -0,0 +1,227 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// Resolution is where a command name resolves in the sandbox and on the
+// host, for 'sbox which'
+type Resolution struct {
+	Name string `json:"name"`
+	// Sandbox lists every match on the sandbox PATH; the first one runs
+	Sandbox []string `json:"sandbox"`
+	// Host lists every match on the PATH of the caller
+	Host []string `json:"host"`
+	// Target is what the sandbox match links to, when it is a symlink
+	Target string `json:"target,omitempty"`
+	// Warnings explain why the command may not run from the environment
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Found reports whether the name resolves in the sandbox
+func (res *Resolution) Found() bool {
+	return len(res.Sandbox) > 0
+}
+
+// Which resolves a command name on the sandbox PATH of BuildEnv and on
+// the host PATH, and explains how the sandbox one can be the wrong one:
+// it lives outside the environment, shadows others, or is a script whose
+// interpreter is not the environment's.
+func (r *Runner) Which(name string) *Resolution {
+	sandboxPath := ""
+	for _, kv := range r.BuildEnv() {
+		if value, ok := strings.CutPrefix(kv, "PATH="); ok {
+			sandboxPath = value
+		}
+	}
+	res := &Resolution{
+		Name:    name,
+		Sandbox: lookAll(name, sandboxPath),
+		Host:    lookAll(name, os.Getenv("PATH")),
+	}
+	if !res.Found() {
+		if len(res.Host) > 0 {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("%s is only on the host PATH; the sandbox cannot run it", name))
+		}
+		return res
+	}
+
+	first := res.Sandbox[0]
+	if target, err := filepath.EvalSymlinks(first); err == nil && target != first {
+		res.Target = target
+	}
+	inEnv := r.InEnv(first)
+	if !inEnv && runtimeTool(name) {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("%s resolves outside the environment, in %s (a host directory on PATH)", name, filepath.Dir(first)))
+	} else if inEnv && res.Target != "" && !within(res.Target, r.EnvDir) {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("%s links to %s, outside the environment", first, res.Target))
+	}
+	if len(res.Sandbox) > 1 {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("%s shadows %d other %s on the sandbox PATH", first, len(res.Sandbox)-1, name))
+	}
+	if interpreter := shebang(first); interpreter != "" && filepath.IsAbs(interpreter) {
+		if _, err := os.Stat(interpreter); err != nil {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("%s runs with %s, which does not exist (project moved? rebuild or 'sbox unpack')", first, interpreter))
+		} else if inEnv && !within(interpreter, r.EnvDir) {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("%s runs with %s, outside the environment", first, interpreter))
+		}
+	}
+	return res
+}
+
+// runtimeTools are the commands the environment is meant to provide;
+// that one of them comes from the host is the classic "it's using the
+// system python" bug. Other host tools such as git are expected.
+var runtimeTools = []string{
+	"python", "pip", "node", "npm", "npx", "pnpm", "go", "java", "javac",
+	"ruby", "gem", "bundle", "cargo", "rustc", "conda", "mamba",
+}
+
+// runtimeTool reports whether name is one of runtimeTools, with or
+// without a version suffix such as python3.11
+func runtimeTool(name string) bool {
+	base := strings.TrimRight(name, "0123456789.")
+	for _, tool := range runtimeTools {
+		if base == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// InEnv reports whether a path is in one of the environment's bin
+// directories
+func (r *Runner) InEnv(path string) bool {
+	for _, dir := range config.EnvBinDirs(r.EnvDir) {
+		if filepath.Dir(path) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// lookAll returns every executable named name in the directories of a
+// PATH value, in order; a file reached through several directories, such
+// as /bin and /usr/bin on merged-/usr systems, counts once
+func lookAll(name, path string) []string {
+	if strings.Contains(name, "/") {
+		if isExecutable(name) {
+			abs, _ := filepath.Abs(name)
+			return []string{abs}
+		}
+		return nil
+	}
+	var found []string
+	var files []os.FileInfo
+	seen := make(map[string]bool)
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		for _, candidate := range exeCandidates(filepath.Join(dir, name)) {
+			info, err := os.Stat(candidate)
+			if err != nil || !isExecutableFile(candidate, info) {
+				continue
+			}
+			duplicate := false
+			for _, f := range files {
+				if os.SameFile(f, info) {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				files = append(files, info)
+				found = append(found, candidate)
+			}
+			break
+		}
+	}
+	return found
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && isExecutableFile(path, info)
+}
+
+// isExecutableFile reports whether a file can be run: by its mode bits,
+// or on Windows, which has none, by its extension
+func isExecutableFile(path string, info os.FileInfo) bool {
+	if info.IsDir() {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		ext := strings.ToLower(filepath.Ext(path))
+		for _, e := range pathExts() {
+			if ext == e {
+				return true
+			}
+		}
+		return false
+	}
+	return info.Mode()&0111 != 0
+}
+
+// exeCandidates returns the files a command path may name: itself, and
+// on Windows without an extension, itself with each of PATHEXT
+func exeCandidates(path string) []string {
+	if runtime.GOOS != "windows" || filepath.Ext(path) != "" {
+		return []string{path}
+	}
+	var candidates []string
+	for _, ext := range pathExts() {
+		candidates = append(candidates, path+ext)
+	}
+	return candidates
+}
+
+// pathExts returns the executable extensions of PATHEXT, lower-cased
+func pathExts() []string {
+	value := os.Getenv("PATHEXT")
+	if value == "" {
+		value = ".COM;.EXE;.BAT;.CMD"
+	}
+	var exts []string
+	for _, ext := range strings.Split(strings.ToLower(value), ";") {
+		if ext != "" {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// within reports whether path is dir or inside it
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// shebang returns the interpreter of a script, or "" for other files.
+// "#!/usr/bin/env python" is resolved by PATH, so it is not reported.
+func shebang(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	// Only the first line matters; binaries need not have one
+	line, _ := bufio.NewReaderSize(f, 256).ReadSlice('\n')
+	rest, ok := strings.CutPrefix(string(line), "#!")
+	if !ok {
+		return ""
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || filepath.Base(fields[0]) == "env" {
+		return ""
+	}
+	return fields[0]
+}
@@ -0,0 +1,69 @@
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/console"
+	"github.com/sbox-project/sbox/internal/gpu"
+)
+
+// SetupGPU installs the CUDA libraries and cuDNN from conda-forge into
+// the environment for gpu: and cuda:, unless they are installed already.
+// It runs after Setup, so cached runtimes stay free of CUDA.
+func (m *Manager) SetupGPU(cuda string) error {
+	packages := gpu.Packages(cuda)
+	what := "CUDA"
+	if cuda != "" {
+		what = "CUDA " + cuda
+	}
+	if m.condaInstalled(packages) {
+		console.Success("%s libraries already installed", what)
+		return nil
+	}
+
+	mambaPath, err := m.ensureMicromamba()
+	if err != nil {
+		return fmt.Errorf("failed to setup micromamba: %w", err)
+	}
+
+	console.Step("Installing %s libraries and cuDNN from conda-forge...", what)
+	args := append([]string{"install", "-p", m.EnvDir, "-c", "conda-forge"}, packages...)
+	args = append(args, "--yes", "--quiet")
+
+	cmd := exec.Command(mambaPath, args...)
+	cmd.Env = m.mambaEnv()
+	// Build hosts without a GPU, such as login nodes, have no __cuda
+	// virtual package for packages that require one
+	if _, err := gpu.DriverVersion(); err != nil && cuda != "" {
+		cmd.Env = append(cmd.Env, "CONDA_OVERRIDE_CUDA="+cuda)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := m.runMamba(cmd); err != nil {
+		return fmt.Errorf("failed to install %s libraries: %w", what, err)
+	}
+
+	console.Success("%s libraries installed", what)
+	return nil
+}
+
+// condaInstalled reports whether every package spec ("name" or
+// "name=version") is installed in the environment
+func (m *Manager) condaInstalled(specs []string) bool {
+	for _, spec := range specs {
+		name, version, _ := strings.Cut(spec, "=")
+		pattern := fmt.Sprintf("%s-%s*-*.json", name, version)
+		if version == "" {
+			pattern = name + "-[0-9]*-*.json"
+		}
+		matches, _ := filepath.Glob(filepath.Join(m.EnvDir, "conda-meta", pattern))
+		if len(matches) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// OfflineEnv makes every 'sbox build' offline when set to 1 or true
+const OfflineEnv = "SBOX_OFFLINE"
+
+// Vendored package caches used by offline builds, relative to the project
+const (
+	// VendorWheelsDir holds wheels and sdists for pip (PIP_FIND_LINKS)
+	VendorWheelsDir = "vendor/wheels"
+	// VendorNpmDir is the npm cache npm installs from offline
+	VendorNpmDir = "vendor/npm"
+	// VendorPnpmDir is the pnpm store pnpm installs from offline
+	VendorPnpmDir = "vendor/pnpm"
+)
+
+// OfflineFromEnv reports whether SBOX_OFFLINE asks for offline builds
+func OfflineFromEnv() bool {
+	v := strings.ToLower(os.Getenv(OfflineEnv))
+	return v == "1" || v == "true" || v == "yes"
+}
+
+// offlineTool matches a program in an install command that fetches
+// packages, and how it is made to work without the network
+type offlineTool struct {
+	pattern *regexp.Regexp
+	vendor  string
+	hint    string
+}
+
+var offlineTools = []offlineTool{
+	{
+		pattern: regexp.MustCompile(`(^|[\s;&|(/])pip[0-9.]*(\s|$)`),
+		vendor:  VendorWheelsDir,
+		hint:    "pip download -d " + VendorWheelsDir + " -r requirements.txt",
+	},
+	{
+		pattern: regexp.MustCompile(`(^|[\s;&|(/])pnpm(\s|$)`),
+		vendor:  VendorPnpmDir,
+		hint:    "pnpm fetch --store-dir " + VendorPnpmDir,
+	},
+	{
+		pattern: regexp.MustCompile(`(^|[\s;&|(/])(npm|npx)(\s|$)`),
+		vendor:  VendorNpmDir,
+		hint:    "npm ci --cache " + VendorNpmDir,
+	},
+}
+
+// networkCommand matches commands that always need the network
+var networkCommand = regexp.MustCompile(`(^|[\s;&|(/])(curl|wget|git\s+clone)(\s|$)|git\+(https?|ssh)://`)
+
+// CheckOffline fails fast when building info with the install commands
+// would need the network: micromamba has to be in the project or the
+// global cache unless the runtime is and no conda packages are installed
+// on top (condaPackages), and pip and npm installs need a vendored
+// package cache
+func (m *Manager) CheckOffline(info config.RuntimeInfo, commands []string, condaPackages bool) error {
+	if (!m.runtimeAvailable(info) || condaPackages) && !m.micromambaAvailable() {
+		return m.noMicromambaError()
+	}
+
+	for _, command := range commands {
+		if networkCommand.MatchString(command) {
+			return fmt.Errorf("install command needs the network: %s", command)
+		}
+		for _, tool := range offlineTools {
+			if !tool.pattern.MatchString(command) {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(m.ProjectRoot, tool.vendor)); err != nil {
+				return fmt.Errorf("install command '%s' needs a vendored package cache in %s (create it with network access: %s)",
+					command, tool.vendor, tool.hint)
+			}
+		}
+	}
+	return nil
+}
+
+// runtimeAvailable reports whether the runtime can be set up without
+// micromamba: it is built already or in the global cache
+func (m *Manager) runtimeAvailable(info config.RuntimeInfo) bool {
+	if config.IsBuilt(m.ProjectRoot) {
+		return true
+	}
+	if !m.UseCache || m.CacheManager == nil {
+		return false
+	}
+	language := info.Language
+	if language == "nodejs" {
+		language = "node"
+	}
+	cached, err := m.CacheManager.GetCachedRuntime(language, info.Version)
+	return err == nil && cached != nil
+}
+
+// micromambaAvailable reports whether micromamba is in the project or
+// the global cache
+func (m *Manager) micromambaAvailable() bool {
+	if fileExists(config.GetMicromambaPath(m.ProjectRoot)) {
+		return true
+	}
+	return m.UseCache && m.CacheManager != nil && fileExists(m.CacheManager.GetMicromambaPath())
+}
+
+func (m *Manager) noMicromambaError() error {
+	where := config.GetMicromambaPath(m.ProjectRoot)
+	if m.UseCache && m.CacheManager != nil {
+		where += " or " + m.CacheManager.GetMicromambaPath()
+	}
+	return fmt.Errorf("offline build needs micromamba in %s; build once with network access or unpack an archive from 'sbox pack'", where)
+}
+
+// offlineEnv points pip and npm at the project's vendored package caches
+// and keeps them off the network
+func (m *Manager) offlineEnv() []string {
+	env := []string{"PIP_NO_INDEX=1", "npm_config_offline=true"}
+	// Wheels built from source by earlier builds also work offline
+	links := m.wheelLinks()
+	if dir := filepath.Join(m.ProjectRoot, VendorWheelsDir); fileExists(dir) {
+		links = append([]string{dir}, links...)
+	}
+	if len(links) > 0 {
+		env = append(env, fmt.Sprintf("PIP_FIND_LINKS=%s", strings.Join(links, " ")))
+	}
+	if dir := filepath.Join(m.ProjectRoot, VendorNpmDir); fileExists(dir) {
+		env = append(env, fmt.Sprintf("npm_config_cache=%s", dir))
+	}
+	if dir := filepath.Join(m.ProjectRoot, VendorPnpmDir); fileExists(dir) {
+		env = append(env, fmt.Sprintf("npm_config_store_dir=%s", dir))
+	}
+	return env
+}
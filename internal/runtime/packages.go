@@ -0,0 +1,326 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/console"
+	"github.com/sbox-project/sbox/internal/lockfile"
+	"github.com/sbox-project/sbox/internal/netfs"
+)
+
+// CapturePackages records the resolved package set of the environment:
+// conda packages, pip distributions, global npm packages and the npm
+// packages of the project's package.json. Package managers that are not
+// installed are skipped.
+func (m *Manager) CapturePackages() (*config.LockedPackages, error) {
+	packages := &config.LockedPackages{}
+
+	if mambaPath := config.GetMicromambaPath(m.ProjectRoot); fileExists(mambaPath) {
+		conda, err := m.condaPackages(mambaPath, m.EnvDir)
+		if err != nil {
+			return nil, err
+		}
+		packages.Conda = conda
+	}
+
+	if pip := m.GetPipPath(); fileExists(pip) {
+		out, err := m.output(pip, "list", "--format=json", "--exclude-editable")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pip packages: %w", err)
+		}
+		if err := json.Unmarshal(out, &packages.Pip); err != nil {
+			return nil, fmt.Errorf("failed to parse pip package list: %w", err)
+		}
+	}
+
+	if npm := m.GetNpmPath(); fileExists(npm) {
+		global, err := m.npmPackages(npm, "", "-g")
+		if err != nil {
+			return nil, err
+		}
+		packages.Npm = global
+		// Install commands run in the project root, where npm install
+		// without -g writes node_modules
+		if fileExists(filepath.Join(m.ProjectRoot, "package.json")) {
+			local, err := m.npmPackages(npm, m.ProjectRoot)
+			if err != nil {
+				return nil, err
+			}
+			packages.NpmLocal = local
+		}
+	}
+
+	for _, list := range [][]config.LockedPackage{packages.Conda, packages.Pip, packages.Npm, packages.NpmLocal} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	}
+	return packages, nil
+}
+
+// npmPackages lists the top-level npm packages installed in dir, or
+// globally with -g
+func (m *Manager) npmPackages(npm, dir string, args ...string) ([]config.LockedPackage, error) {
+	cmd := exec.Command(npm, append([]string{"ls", "--json", "--depth=0"}, args...)...)
+	cmd.Env = m.buildEnv()
+	cmd.Dir = dir
+	// npm ls exits non-zero on peer dependency warnings but still prints
+	// the tree
+	out, _ := cmd.Output()
+	var tree struct {
+		Dependencies map[string]struct {
+			Version string `json:"version"`
+		} `json:"dependencies"`
+	}
+	if err := json.Unmarshal(out, &tree); err != nil {
+		return nil, fmt.Errorf("failed to parse npm package list: %w", err)
+	}
+	var packages []config.LockedPackage
+	for name, dep := range tree.Dependencies {
+		// Declared but not installed
+		if dep.Version == "" {
+			continue
+		}
+		packages = append(packages, config.LockedPackage{Name: name, Version: dep.Version})
+	}
+	return packages, nil
+}
+
+// condaPackages lists the conda packages of the environment at prefix
+func (m *Manager) condaPackages(mambaPath, prefix string) ([]config.LockedPackage, error) {
+	out, err := m.output(mambaPath, "list", "-p", prefix, "--json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conda packages: %w", err)
+	}
+	var list []struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+		Channel string `json:"channel"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse conda package list: %w", err)
+	}
+	var packages []config.LockedPackage
+	for _, p := range list {
+		// pip-installed packages are recorded from pip itself
+		if p.Channel == "pypi" {
+			continue
+		}
+		packages = append(packages, config.LockedPackage{Name: p.Name, Version: p.Version})
+	}
+	return packages, nil
+}
+
+// PinConda installs the locked conda packages at their exact versions.
+// It runs before the install commands so they see the locked runtime.
+func (m *Manager) PinConda(packages *config.LockedPackages) error {
+	if packages == nil || len(packages.Conda) == 0 {
+		return nil
+	}
+
+	mambaPath, err := m.ensureMicromamba()
+	if err != nil {
+		return fmt.Errorf("failed to setup micromamba: %w", err)
+	}
+
+	console.Step("Pinning %d conda packages from %s...", len(packages.Conda), config.LockFile)
+	args := []string{"install", "-p", m.EnvDir, "-c", "conda-forge"}
+	for _, p := range packages.Conda {
+		args = append(args, fmt.Sprintf("%s=%s", p.Name, p.Version))
+	}
+	args = append(args, "--yes", "--quiet")
+
+	cmd := exec.Command(mambaPath, args...)
+	cmd.Env = m.mambaEnv()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := m.runMamba(cmd); err != nil {
+		return fmt.Errorf("failed to pin conda packages: %w", err)
+	}
+	return nil
+}
+
+// PinPackages reinstalls the locked pip and npm packages at their exact
+// versions after the install commands ran
+func (m *Manager) PinPackages(packages *config.LockedPackages) error {
+	if packages == nil {
+		return nil
+	}
+
+	env := m.buildEnv()
+
+	if len(packages.Pip) > 0 {
+		console.Step("Pinning %d pip packages from %s...", len(packages.Pip), config.LockFile)
+		args := []string{"install", "--no-deps"}
+		for _, p := range packages.Pip {
+			args = append(args, fmt.Sprintf("%s==%s", p.Name, p.Version))
+		}
+		cmd := exec.Command(m.GetPipPath(), args...)
+		cmd.Env = env
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to pin pip packages: %w", err)
+		}
+	}
+
+	if len(packages.Npm) > 0 {
+		console.Step("Pinning %d npm packages from %s...", len(packages.Npm), config.LockFile)
+		args := []string{"install", "-g"}
+		for _, p := range packages.Npm {
+			args = append(args, fmt.Sprintf("%s@%s", p.Name, p.Version))
+		}
+		cmd := exec.Command(m.GetNpmPath(), args...)
+		cmd.Env = env
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to pin npm packages: %w", err)
+		}
+	}
+
+	if len(packages.NpmLocal) > 0 {
+		console.Step("Pinning %d project npm packages from %s...", len(packages.NpmLocal), config.LockFile)
+		// --no-save leaves package.json and package-lock.json as written
+		args := []string{"install", "--no-save"}
+		for _, p := range packages.NpmLocal {
+			args = append(args, fmt.Sprintf("%s@%s", p.Name, p.Version))
+		}
+		cmd := exec.Command(m.GetNpmPath(), args...)
+		cmd.Env = env
+		cmd.Dir = m.ProjectRoot
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to pin project npm packages: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DiffPackages lists locked packages that are missing or at another
+// version in the captured set
+func DiffPackages(locked, actual *config.LockedPackages) []string {
+	var diffs []string
+	compare := func(manager string, want, have []config.LockedPackage) {
+		versions := make(map[string]string, len(have))
+		for _, p := range have {
+			versions[strings.ToLower(p.Name)] = p.Version
+		}
+		for _, p := range want {
+			got, ok := versions[strings.ToLower(p.Name)]
+			switch {
+			case !ok:
+				diffs = append(diffs, fmt.Sprintf("%s %s: missing (locked %s)", manager, p.Name, p.Version))
+			case got != p.Version:
+				diffs = append(diffs, fmt.Sprintf("%s %s: %s (locked %s)", manager, p.Name, got, p.Version))
+			}
+		}
+	}
+	compare("conda", locked.Conda, actual.Conda)
+	compare("pip", locked.Pip, actual.Pip)
+	compare("npm", locked.Npm, actual.Npm)
+	compare("npm (project)", locked.NpmLocal, actual.NpmLocal)
+	return diffs
+}
+
+// writeConstraints writes the locked pip versions as a pip constraints
+// file so install commands resolve to them
+func (m *Manager) writeConstraints(packages []config.LockedPackage) (string, error) {
+	path := filepath.Join(m.SboxDir, "constraints.txt")
+	var sb strings.Builder
+	sb.WriteString("# Generated from " + config.LockFile + " by 'sbox build --frozen'\n")
+	for _, p := range packages {
+		fmt.Fprintf(&sb, "%s==%s\n", p.Name, p.Version)
+	}
+	return path, os.WriteFile(path, []byte(sb.String()), 0644)
+}
+
+func (m *Manager) output(name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Env = m.buildEnv()
+	return cmd.Output()
+}
+
+// mambaEnv returns the environment for micromamba: the project's root
+// prefix and, with caching enabled, the shared package cache
+func (m *Manager) mambaEnv() []string {
+	env := append(os.Environ(), fmt.Sprintf("MAMBA_ROOT_PREFIX=%s", m.MambaRoot))
+	pkgsDir := ""
+	if m.UseCache && m.CacheManager != nil {
+		pkgsDir = m.CacheManager.GetPkgsDir()
+		if err := os.MkdirAll(pkgsDir, 0755); err == nil {
+			dirs := pkgsDir
+			// An unpacked 'sbox pack --include-cache' archive brings its
+			// packages in the project's own package cache
+			if local := filepath.Join(m.MambaRoot, "pkgs"); m.Offline && fileExists(local) {
+				dirs += "," + local
+			}
+			env = append(env, fmt.Sprintf("CONDA_PKGS_DIRS=%s", dirs))
+		}
+	}
+
+	// Hardlinks from the package cache into the environment break on
+	// network filesystems (or silently share inodes across hosts)
+	if fs := m.networkFS(pkgsDir); fs != "" {
+		env = append(env, "MAMBA_ALWAYS_COPY=true", "CONDA_ALWAYS_COPY=true")
+	}
+	return env
+}
+
+// runMamba runs a micromamba command that installs packages, holding the
+// lock of the shared package cache when it is used
+func (m *Manager) runMamba(cmd *exec.Cmd) error {
+	if m.Offline {
+		cmd.Args = append(cmd.Args, "--offline")
+	}
+	if m.UseCache && m.CacheManager != nil {
+		lockPath := m.CacheManager.GetPkgsLockPath()
+		lock, err := lockfile.TryAcquire(lockPath)
+		if err != nil {
+			if _, busy := err.(*lockfile.ErrLocked); !busy {
+				return err
+			}
+			console.Info("Waiting for another build using the package cache (%s)...", err)
+			if lock, err = lockfile.Acquire(lockPath); err != nil {
+				return err
+			}
+		}
+		defer lock.Release()
+	}
+	if err := cmd.Run(); err != nil {
+		if m.Offline {
+			return fmt.Errorf("%w (offline: every package must already be in the package cache)", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// networkFS returns the network filesystem holding the environment or
+// the package cache, or "". The first detection is reported once.
+func (m *Manager) networkFS(pkgsDir string) string {
+	fs := netfs.Detect(m.EnvDir)
+	if fs == "" && pkgsDir != "" {
+		fs = netfs.Detect(pkgsDir)
+	}
+	if fs != "" && !m.networkNoted {
+		m.networkNoted = true
+		console.Info("Package cache or environment is on %s; copying packages instead of hardlinking", fs)
+		if os.Getenv(config.CacheDirEnv) == "" {
+			console.Print("  Set %s to a node-local directory for faster builds", config.CacheDirEnv)
+		}
+	}
+	return fs
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
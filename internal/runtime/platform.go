@@ -0,0 +1,112 @@
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	goruntime "runtime"
+	"sort"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/console"
+)
+
+// baselineGlibc is the glibc conda-forge builds against, assumed for
+// linux targets when packing on a host without glibc
+const baselineGlibc = "2.17"
+
+// CreatePlatformEnv creates the runtime environment for another platform
+// at prefix. micromamba resolves and downloads the target's packages with
+// --platform. Only the runtime's locked version is carried over from
+// packages: the other conda pins are the host's, and many of them (e.g.
+// libgcc-ng, ld_impl_linux-64) do not exist for the target.
+// Nothing in the environment can run here, so install commands and pip
+// and npm packages are left to the recipient's 'sbox build --frozen'.
+func (m *Manager) CreatePlatformEnv(info config.RuntimeInfo, platform, prefix string, packages *config.LockedPackages) error {
+	subdir, ok := config.CondaSubdirs[platform]
+	if !ok {
+		return fmt.Errorf("unsupported platform: %s", platform)
+	}
+
+	specs, err := runtimeSpecs(info)
+	if err != nil {
+		return err
+	}
+	if packages != nil {
+		name, _, _ := strings.Cut(specs[0], "=")
+		for _, p := range packages.Conda {
+			if p.Name == name {
+				specs[0] = fmt.Sprintf("%s=%s", p.Name, p.Version)
+				break
+			}
+		}
+	}
+
+	mambaPath, err := m.ensureMicromamba()
+	if err != nil {
+		return fmt.Errorf("failed to setup micromamba: %w", err)
+	}
+	if err := os.MkdirAll(m.MambaRoot, 0755); err != nil {
+		return err
+	}
+
+	console.Step("Creating %s environment for %s with micromamba...", info.Language, platform)
+	args := []string{"create", "-p", prefix, "--platform", subdir, "-c", "conda-forge"}
+	args = append(args, specs...)
+	args = append(args, "--yes", "--quiet")
+
+	// The target's python cannot run here to compile .pyc files
+	env := append(m.mambaEnv(), "MAMBA_COMPILE_PYC=false")
+	if strings.HasPrefix(platform, "linux-") && goruntime.GOOS != "linux" && os.Getenv("CONDA_OVERRIDE_GLIBC") == "" {
+		env = append(env, "CONDA_OVERRIDE_GLIBC="+baselineGlibc)
+	}
+
+	cmd := exec.Command(mambaPath, args...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := m.runMamba(cmd); err != nil {
+		return fmt.Errorf("failed to create %s environment: %w", platform, err)
+	}
+	return nil
+}
+
+// PlatformPackages lists the conda packages of an environment created by
+// CreatePlatformEnv
+func (m *Manager) PlatformPackages(prefix string) ([]config.LockedPackage, error) {
+	mambaPath, err := m.ensureMicromamba()
+	if err != nil {
+		return nil, err
+	}
+	packages, err := m.condaPackages(mambaPath, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Name < packages[j].Name })
+	return packages, nil
+}
+
+// DownloadMicromamba installs the micromamba binary of platform at dst
+func DownloadMicromamba(platform, dst string) error {
+	url, ok := config.MicromambaURLs[platform]
+	if !ok {
+		return fmt.Errorf("unsupported platform: %s", platform)
+	}
+	return downloadMicromamba(url, dst)
+}
+
+// runtimeSpecs returns the conda specs Setup installs for a runtime
+func runtimeSpecs(info config.RuntimeInfo) ([]string, error) {
+	switch info.Language {
+	case "python":
+		return []string{"python=" + info.Version, "pip"}, nil
+	case "node", "nodejs":
+		return []string{"nodejs=" + info.Version, "pnpm"}, nil
+	}
+	spec, ok := config.LookupRuntime(info.Language)
+	if !ok {
+		return nil, fmt.Errorf("unsupported runtime: %s (supported: %s)", info.Language, strings.Join(config.RuntimeNames(), ", "))
+	}
+	return append([]string{fmt.Sprintf("%s=%s", spec.Package, info.Version)}, spec.Extras...), nil
+}
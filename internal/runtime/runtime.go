@@ -2,19 +2,26 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/sbox-project/sbox/internal/cache"
 	"github.com/sbox-project/sbox/internal/config"
 	"github.com/sbox-project/sbox/internal/console"
+	"github.com/sbox-project/sbox/internal/hooks"
+	"github.com/sbox-project/sbox/internal/sysproc"
 )
 
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)*`)
+
 // Manager handles runtime environment setup
 type Manager struct {
 	ProjectRoot  string
@@ -23,6 +30,15 @@ type Manager struct {
 	MambaRoot    string
 	CacheManager *cache.Manager
 	UseCache     bool
+	// Frozen holds the locked package set during 'sbox build --frozen';
+	// install commands then resolve pip packages to the locked versions
+	Frozen *config.LockedPackages
+	// Offline builds without the network: micromamba and runtimes come
+	// from the caches, micromamba runs with --offline and install
+	// commands use the project's vendored package caches
+	Offline bool
+
+	networkNoted bool
 }
 
 // NewManager creates a new runtime manager
@@ -45,14 +61,102 @@ func NewManager(projectRoot string) *Manager {
 
 // Setup sets up the runtime environment
 func (m *Manager) Setup(info config.RuntimeInfo) error {
+	if err := m.discardForeignEnv(); err != nil {
+		return err
+	}
+
 	switch info.Language {
 	case "python":
 		return m.setupPython(info.Version)
 	case "node", "nodejs":
 		return m.setupNode(info.Version)
-	default:
-		return fmt.Errorf("unsupported runtime: %s (supported: python, node)", info.Language)
 	}
+	spec, ok := config.LookupRuntime(info.Language)
+	if !ok {
+		return fmt.Errorf("unsupported runtime: %s (supported: %s)", info.Language, strings.Join(config.RuntimeNames(), ", "))
+	}
+	return m.setupConda(spec, info.Version)
+}
+
+// setupConda installs a runtime described by spec from conda-forge
+func (m *Manager) setupConda(spec *config.RuntimeSpec, version string) error {
+	console.Step("Setting up %s %s environment...", spec.DisplayName, version)
+
+	// Check if environment already exists locally
+	if _, err := os.Stat(spec.BinaryPath(m.EnvDir)); err == nil {
+		currentVersion := m.getRuntimeVersion(spec)
+		if versionMatches(currentVersion, version) {
+			console.Success("%s %s already installed", spec.DisplayName, currentVersion)
+			return nil
+		}
+		console.Warning("Version mismatch (have %s, want %s), recreating environment...", currentVersion, version)
+		if err := m.removeEnv(); err != nil {
+			return err
+		}
+	}
+
+	// Try to use cached runtime first
+	if m.UseCache && m.CacheManager != nil {
+		if cachedRuntime := m.cachedRuntime(spec.Name, version); cachedRuntime != nil {
+			console.Step("Using cached %s %s environment...", spec.DisplayName, version)
+
+			if err := m.CacheManager.CopyFromCache(spec.Name, version, m.EnvDir); err == nil {
+				console.Success("%s %s restored from cache", spec.DisplayName, version)
+				return nil
+			} else {
+				console.Warning("Failed to restore from cache: %s", err)
+				// Fall through to create new environment
+			}
+		}
+	}
+
+	// Ensure micromamba is available
+	mambaPath, err := m.ensureMicromamba()
+	if err != nil {
+		return fmt.Errorf("failed to setup micromamba: %w", err)
+	}
+
+	// Create mamba root directory
+	if err := os.MkdirAll(m.MambaRoot, 0755); err != nil {
+		return err
+	}
+
+	console.Step("Creating %s %s environment with micromamba...", spec.DisplayName, version)
+
+	// Set package cache to global location if cache is enabled
+	env := m.mambaEnv()
+
+	args := []string{
+		"create",
+		"-p", m.EnvDir,
+		"-c", "conda-forge",
+		fmt.Sprintf("%s=%s", spec.Package, version),
+	}
+	args = append(args, spec.Extras...)
+	args = append(args, "--yes", "--quiet")
+
+	cmd := exec.Command(mambaPath, args...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := m.runMamba(cmd); err != nil {
+		return fmt.Errorf("failed to create environment: %w", err)
+	}
+
+	console.Success("%s %s environment created", spec.DisplayName, version)
+
+	// Cache the runtime for future use
+	if m.UseCache && m.CacheManager != nil {
+		console.Step("Caching %s %s environment...", spec.DisplayName, version)
+		if err := m.CacheManager.CopyToCache(spec.Name, version, m.EnvDir); err != nil {
+			console.Warning("Failed to cache runtime: %s", err)
+		} else {
+			console.Success("Runtime cached for future use")
+		}
+	}
+
+	return nil
 }
 
 func (m *Manager) setupPython(version string) error {
@@ -73,8 +177,7 @@ func (m *Manager) setupPython(version string) error {
 
 	// Try to use cached runtime first
 	if m.UseCache && m.CacheManager != nil {
-		cachedRuntime, err := m.CacheManager.GetCachedRuntime("python", version)
-		if err == nil && cachedRuntime != nil {
+		if cachedRuntime := m.cachedRuntime("python", version); cachedRuntime != nil {
 			console.Step("Using cached Python %s environment...", version)
 			
 			if err := m.CacheManager.CopyFromCache("python", version, m.EnvDir); err == nil {
@@ -101,13 +204,7 @@ func (m *Manager) setupPython(version string) error {
 	console.Step("Creating Python %s environment with micromamba...", version)
 
 	// Set package cache to global location if cache is enabled
-	env := append(os.Environ(), fmt.Sprintf("MAMBA_ROOT_PREFIX=%s", m.MambaRoot))
-	if m.UseCache && m.CacheManager != nil {
-		pkgsDir := m.CacheManager.GetPkgsDir()
-		if err := os.MkdirAll(pkgsDir, 0755); err == nil {
-			env = append(env, fmt.Sprintf("CONDA_PKGS_DIRS=%s", pkgsDir))
-		}
-	}
+	env := m.mambaEnv()
 
 	// Create environment with Python
 	cmd := exec.Command(mambaPath,
@@ -124,7 +221,7 @@ func (m *Manager) setupPython(version string) error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Run(); err != nil {
+	if err := m.runMamba(cmd); err != nil {
 		return fmt.Errorf("failed to create environment: %w", err)
 	}
 
@@ -161,8 +258,7 @@ func (m *Manager) setupNode(version string) error {
 
 	// Try to use cached runtime first
 	if m.UseCache && m.CacheManager != nil {
-		cachedRuntime, err := m.CacheManager.GetCachedRuntime("node", version)
-		if err == nil && cachedRuntime != nil {
+		if cachedRuntime := m.cachedRuntime("node", version); cachedRuntime != nil {
 			console.Step("Using cached Node.js %s environment...", version)
 			
 			if err := m.CacheManager.CopyFromCache("node", version, m.EnvDir); err == nil {
@@ -189,13 +285,7 @@ func (m *Manager) setupNode(version string) error {
 	console.Step("Creating Node.js %s environment with micromamba...", version)
 
 	// Set package cache to global location if cache is enabled
-	env := append(os.Environ(), fmt.Sprintf("MAMBA_ROOT_PREFIX=%s", m.MambaRoot))
-	if m.UseCache && m.CacheManager != nil {
-		pkgsDir := m.CacheManager.GetPkgsDir()
-		if err := os.MkdirAll(pkgsDir, 0755); err == nil {
-			env = append(env, fmt.Sprintf("CONDA_PKGS_DIRS=%s", pkgsDir))
-		}
-	}
+	env := m.mambaEnv()
 
 	// Create environment with Node.js and pnpm
 	cmd := exec.Command(mambaPath,
@@ -212,7 +302,7 @@ func (m *Manager) setupNode(version string) error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Run(); err != nil {
+	if err := m.runMamba(cmd); err != nil {
 		return fmt.Errorf("failed to create environment: %w", err)
 	}
 
@@ -260,53 +350,83 @@ func (m *Manager) ensureMicromamba() (string, error) {
 		}
 	}
 
+	if m.Offline {
+		return "", m.noMicromambaError()
+	}
+
 	console.Step("Downloading micromamba...")
 
 	url, err := config.GetMicromambaURL()
 	if err != nil {
 		return "", err
 	}
+	if err := downloadMicromamba(url, localPath); err != nil {
+		return "", err
+	}
+
+	console.Success("micromamba downloaded")
+
+	// Cache the binary for future use
+	if m.UseCache && m.CacheManager != nil {
+		if err := m.CacheManager.EnsureCacheDirs(); err == nil {
+			// Renamed into place: another build may be copying it out
+			globalPath := m.CacheManager.GetMicromambaPath()
+			tmp := fmt.Sprintf("%s.tmp-%d", globalPath, os.Getpid())
+			if err := copyFile(localPath, tmp); err == nil && os.Rename(tmp, globalPath) == nil {
+				console.Success("micromamba cached for future use")
+			} else {
+				os.Remove(tmp)
+			}
+		}
+	}
 
+	return localPath, nil
+}
+
+// downloadMicromamba downloads the micromamba release at url and installs
+// its binary at dst
+func downloadMicromamba(url, dst string) error {
 	// Create bin directory
-	binDir := filepath.Dir(localPath)
+	binDir := filepath.Dir(dst)
 	if err := os.MkdirAll(binDir, 0755); err != nil {
-		return "", err
+		return err
 	}
 
 	// Download archive
 	resp, err := http.Get(url)
 	if err != nil {
-		return "", fmt.Errorf("failed to download micromamba: %w", err)
+		return fmt.Errorf("failed to download micromamba: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Create temp file for archive
 	tmpFile, err := os.CreateTemp("", "micromamba-*.tar.bz2")
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer os.Remove(tmpFile.Name())
 
 	if _, err := io.Copy(tmpFile, resp.Body); err != nil {
 		tmpFile.Close()
-		return "", err
+		return err
 	}
 	tmpFile.Close()
 
 	// Create temp directory for extraction
 	tmpDir, err := os.MkdirTemp("", "micromamba-extract-")
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer os.RemoveAll(tmpDir)
 
 	// Extract archive
 	cmd := exec.Command("tar", "-xjf", tmpFile.Name(), "-C", tmpDir)
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to extract micromamba: %w", err)
+		return fmt.Errorf("failed to extract micromamba: %w", err)
 	}
 
-	// Find the extracted binary
+	// Find the extracted binary; the Windows archive has it in
+	// Library/bin/micromamba.exe
 	extractedPath := filepath.Join(tmpDir, "bin", "micromamba")
 	if _, err := os.Stat(extractedPath); err != nil {
 		// Try to find it
@@ -314,35 +434,22 @@ func (m *Manager) ensureMicromamba() (string, error) {
 			if err != nil {
 				return err
 			}
-			if info.Name() == "micromamba" && !info.IsDir() {
+			if (info.Name() == "micromamba" || info.Name() == "micromamba.exe") && !info.IsDir() {
 				extractedPath = path
 				return filepath.SkipAll
 			}
 			return nil
 		})
 		if err != nil && err != filepath.SkipAll {
-			return "", fmt.Errorf("failed to find micromamba in archive")
+			return fmt.Errorf("failed to find micromamba in archive")
 		}
 	}
 
-	// Copy to local destination
-	if err := copyFile(extractedPath, localPath); err != nil {
-		return "", fmt.Errorf("failed to copy micromamba: %w", err)
+	// Copy to destination
+	if err := copyFile(extractedPath, dst); err != nil {
+		return fmt.Errorf("failed to copy micromamba: %w", err)
 	}
-
-	console.Success("micromamba downloaded")
-
-	// Cache the binary for future use
-	if m.UseCache && m.CacheManager != nil {
-		if err := m.CacheManager.EnsureCacheDirs(); err == nil {
-			globalPath := m.CacheManager.GetMicromambaPath()
-			if err := copyFile(localPath, globalPath); err == nil {
-				console.Success("micromamba cached for future use")
-			}
-		}
-	}
-
-	return localPath, nil
+	return nil
 }
 
 // copyFile copies a file from src to dst with executable permissions
@@ -369,19 +476,19 @@ func copyFile(src, dst string) error {
 }
 
 func (m *Manager) pythonEnvExists() bool {
-	pythonPath := filepath.Join(m.EnvDir, "bin", "python")
+	pythonPath := config.EnvExe(m.EnvDir, "python")
 	_, err := os.Stat(pythonPath)
 	return err == nil
 }
 
 func (m *Manager) nodeEnvExists() bool {
-	nodePath := filepath.Join(m.EnvDir, "bin", "node")
+	nodePath := config.EnvExe(m.EnvDir, "node")
 	_, err := os.Stat(nodePath)
 	return err == nil
 }
 
 func (m *Manager) getPythonVersion() string {
-	pythonPath := filepath.Join(m.EnvDir, "bin", "python")
+	pythonPath := config.EnvExe(m.EnvDir, "python")
 	cmd := exec.Command(pythonPath, "--version")
 	output, err := cmd.Output()
 	if err != nil {
@@ -396,7 +503,7 @@ func (m *Manager) getPythonVersion() string {
 }
 
 func (m *Manager) getNodeVersion() string {
-	nodePath := filepath.Join(m.EnvDir, "bin", "node")
+	nodePath := config.EnvExe(m.EnvDir, "node")
 	cmd := exec.Command(nodePath, "--version")
 	output, err := cmd.Output()
 	if err != nil {
@@ -406,33 +513,83 @@ func (m *Manager) getNodeVersion() string {
 	return strings.TrimSpace(string(output))
 }
 
+// getRuntimeVersion extracts the version number a runtime reports, e.g.
+// "1.22.1" from "go version go1.22.1 linux/amd64". Java prints its
+// version on stderr, so both streams are read.
+func (m *Manager) getRuntimeVersion(spec *config.RuntimeSpec) string {
+	cmd := exec.Command(spec.BinaryPath(m.EnvDir), spec.VersionArgs...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return ""
+	}
+	return versionPattern.FindString(string(output))
+}
+
+// versionMatches reports whether an installed version satisfies the
+// requested one ("17.0.10" satisfies "17", but "1.220" does not satisfy "1.22")
+func versionMatches(installed, requested string) bool {
+	return installed == requested || strings.HasPrefix(installed, requested+".")
+}
+
 func (m *Manager) removeEnv() error {
 	return os.RemoveAll(m.EnvDir)
 }
 
+// discardForeignEnv removes an environment and micromamba binary built
+// for another platform, e.g. in a project directory shared over NFS
+// between an x86_64 and an arm64 host
+func (m *Manager) discardForeignEnv() error {
+	lock, err := config.LoadLock(m.ProjectRoot)
+	if err != nil || lock.Platform == "" || lock.Platform == config.GetPlatformKey() {
+		return nil
+	}
+	if _, err := os.Stat(m.EnvDir); err != nil {
+		return nil
+	}
+
+	console.Warning("Environment was built for %s, this host is %s; recreating it", lock.Platform, config.GetPlatformKey())
+	if err := m.removeEnv(); err != nil {
+		return err
+	}
+	return os.RemoveAll(config.GetMicromambaPath(m.ProjectRoot))
+}
+
+// cachedRuntime looks up a runtime in the global cache, reporting
+// entries that belong to another platform
+func (m *Manager) cachedRuntime(language, version string) *cache.CachedRuntime {
+	cached, err := m.CacheManager.GetCachedRuntime(language, version)
+	if errors.Is(err, cache.ErrPlatformMismatch) {
+		console.Warning("Ignoring cached %s-%s: %s", language, version, err)
+	}
+	if err != nil {
+		return nil
+	}
+	return cached
+}
+
 // GetPythonPath returns the path to Python interpreter
 func (m *Manager) GetPythonPath() string {
-	return filepath.Join(m.EnvDir, "bin", "python")
+	return config.EnvExe(m.EnvDir, "python")
 }
 
 // GetPipPath returns the path to pip
 func (m *Manager) GetPipPath() string {
-	return filepath.Join(m.EnvDir, "bin", "pip")
+	return config.EnvExe(m.EnvDir, "pip")
 }
 
 // GetNodePath returns the path to Node.js
 func (m *Manager) GetNodePath() string {
-	return filepath.Join(m.EnvDir, "bin", "node")
+	return config.EnvExe(m.EnvDir, "node")
 }
 
 // GetNpmPath returns the path to npm
 func (m *Manager) GetNpmPath() string {
-	return filepath.Join(m.EnvDir, "bin", "npm")
+	return config.EnvExe(m.EnvDir, "npm")
 }
 
 // GetPnpmPath returns the path to pnpm
 func (m *Manager) GetPnpmPath() string {
-	return filepath.Join(m.EnvDir, "bin", "pnpm")
+	return config.EnvExe(m.EnvDir, "pnpm")
 }
 
 // InstallPackages runs install commands in the environment
@@ -443,12 +600,21 @@ func (m *Manager) InstallPackages(commands []string) error {
 
 	console.Step("Installing packages...")
 
+	started := time.Now()
 	env := m.buildEnv()
+	if m.Frozen != nil && len(m.Frozen.Pip) > 0 {
+		constraints, err := m.writeConstraints(m.Frozen.Pip)
+		if err != nil {
+			return fmt.Errorf("failed to write pip constraints: %w", err)
+		}
+		env = append(env, fmt.Sprintf("PIP_CONSTRAINT=%s", constraints))
+	}
 
 	for _, cmdStr := range commands {
 		console.Info("Running: %s", cmdStr)
 
-		cmd := exec.Command("sh", "-c", cmdStr)
+		argv := sysproc.Shell(cmdStr)
+		cmd := exec.Command(argv[0], argv[1:]...)
 		cmd.Dir = m.ProjectRoot
 		cmd.Env = env
 		cmd.Stdout = os.Stdout
@@ -459,10 +625,44 @@ func (m *Manager) InstallPackages(commands []string) error {
 		}
 	}
 
+	m.saveBuiltWheels(started)
 	console.Success("Package installation complete")
 	return nil
 }
 
+// wheelLinks returns the wheels built from source by earlier builds, for
+// PIP_FIND_LINKS; pip prefers a matching wheel over building the sdist
+func (m *Manager) wheelLinks() []string {
+	if m.CacheManager == nil {
+		return nil
+	}
+	if dir := m.CacheManager.GetWheelsDir(); fileExists(dir) {
+		return []string{dir}
+	}
+	return nil
+}
+
+// saveBuiltWheels keeps the wheels install commands built from source
+// since a time in the global cache, for the next environment
+func (m *Manager) saveBuiltWheels(since time.Time) {
+	if m.Offline || !m.UseCache || m.CacheManager == nil {
+		return
+	}
+	added, err := m.CacheManager.SaveBuiltWheels(since)
+	if err != nil {
+		console.Warning("Failed to cache built wheels: %s", err)
+	}
+	if len(added) > 0 {
+		console.Info("Cached %d wheels built from source: %s", len(added), strings.Join(added, ", "))
+	}
+}
+
+// RunHooks runs build hooks from the project root in the environment the
+// install commands get
+func (m *Manager) RunHooks(stage string, commands []string) error {
+	return hooks.Run(stage, commands, m.ProjectRoot, m.buildEnv(), nil)
+}
+
 func (m *Manager) buildEnv() []string {
 	path := fmt.Sprintf("PATH=%s/bin:%s", m.EnvDir, os.Getenv("PATH"))
 
@@ -477,6 +677,20 @@ func (m *Manager) buildEnv() []string {
 		fmt.Sprintf("npm_config_prefix=%s", m.EnvDir),
 	}
 
+	// Downloads are shared with other projects' builds
+	if m.Offline {
+		env = append(env, m.offlineEnv()...)
+	} else if m.UseCache && m.CacheManager != nil {
+		env = append(env,
+			fmt.Sprintf("PIP_CACHE_DIR=%s", m.CacheManager.GetPipCacheDir()),
+			fmt.Sprintf("npm_config_cache=%s", m.CacheManager.GetNpmCacheDir()),
+			fmt.Sprintf("npm_config_store_dir=%s", m.CacheManager.GetPnpmStoreDir()),
+		)
+		if links := m.wheelLinks(); len(links) > 0 {
+			env = append(env, "PIP_FIND_LINKS="+strings.Join(links, " "))
+		}
+	}
+
 	// Add essential system vars
 	for _, key := range []string{"LANG", "TERM", "USER", "HOME", "TMPDIR"} {
 		if val := os.Getenv(key); val != "" {
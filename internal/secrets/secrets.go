@@ -0,0 +1,235 @@
+// Package secrets keeps values such as API tokens out of config.yaml.
+// Each secret is a file under .sbox/secrets, encrypted with AES-256-GCM
+// using a key that never leaves the user's ~/.sbox. Commands get the
+// secrets listed under secrets: in config.yaml as environment variables
+// when they start; env.sh and packed archives never contain them.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+const (
+	// Dir is the directory in .sbox holding the encrypted secrets
+	Dir = "secrets"
+	// KeyFile is the key in the global sbox directory (~/.sbox)
+	KeyFile = "secrets.key"
+	// KeyEnv holds a base64 key instead of KeyFile, e.g. in CI
+	KeyEnv = "SBOX_SECRETS_KEY"
+
+	keySize = 32
+	// fileExt marks encrypted files, so other files in Dir are ignored
+	fileExt = ".enc"
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ErrNotFound is returned for a secret that was never set
+var ErrNotFound = errors.New("secret not found")
+
+// Store is the secrets of a project
+type Store struct {
+	dir string
+	key []byte
+}
+
+// ValidName reports whether name can be a secret, which becomes an
+// environment variable of the same name
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// GetDir returns the secrets directory of a project
+func GetDir(projectRoot string) string {
+	return filepath.Join(config.GetSboxDir(projectRoot), Dir)
+}
+
+// Open opens the secrets of a project. With create, a missing key is
+// generated; otherwise it is an error.
+func Open(projectRoot string, create bool) (*Store, error) {
+	key, err := loadKey(create)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: GetDir(projectRoot), key: key}, nil
+}
+
+// Names returns the secrets set in a project, sorted. Listing them needs
+// no key.
+func Names(projectRoot string) ([]string, error) {
+	entries, err := os.ReadDir(GetDir(projectRoot))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), fileExt); ok && !entry.IsDir() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Set encrypts and stores a secret, replacing its previous value
+func (s *Store) Set(name, value string) error {
+	if !ValidName(name) {
+		return fmt.Errorf("invalid secret name '%s' (use letters, digits and _, as for an environment variable)", name)
+	}
+	gcm, err := s.cipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// The name is authenticated too, so a file renamed to another secret
+	// does not decrypt
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(name))
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	data := base64.StdEncoding.EncodeToString(sealed) + "\n"
+	return os.WriteFile(s.path(name), []byte(data), 0600)
+}
+
+// Get decrypts a secret
+func (s *Store) Get(name string) (string, error) {
+	data, err := os.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return "", fmt.Errorf("secret %s is corrupt: %w", name, err)
+	}
+	gcm, err := s.cipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("secret %s is corrupt", name)
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	value, err := gcm.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("secret %s was encrypted with another key", name)
+	}
+	return string(value), nil
+}
+
+// Remove deletes a secret of a project, which needs no key
+func Remove(projectRoot, name string) error {
+	err := os.Remove(filepath.Join(GetDir(projectRoot), name+fileExt))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return err
+}
+
+// Env returns the named secrets as KEY=VALUE entries
+func (s *Store) Env(names []string) ([]string, error) {
+	env := make([]string, 0, len(names))
+	for _, name := range names {
+		value, err := s.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, name+"="+value)
+	}
+	return env, nil
+}
+
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, name+fileExt)
+}
+
+func (s *Store) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// KeyPath returns where the key is kept
+func KeyPath() (string, error) {
+	globalDir, err := config.GetGlobalSboxDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(globalDir, KeyFile), nil
+}
+
+// loadKey reads the key from $SBOX_SECRETS_KEY or ~/.sbox/secrets.key,
+// generating the file when create is set
+func loadKey(create bool) ([]byte, error) {
+	if encoded := os.Getenv(KeyEnv); encoded != "" {
+		return decodeKey(encoded, "$"+KeyEnv)
+	}
+
+	path, err := KeyPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return decodeKey(string(data), path)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !create {
+		return nil, fmt.Errorf("no secrets key at %s", path)
+	}
+
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	data = []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+	// O_EXCL: another sbox may have just created it
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return loadKey(false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+func decodeKey(encoded, source string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("invalid secrets key in %s (want %d base64-encoded bytes)", source, keySize)
+	}
+	return key, nil
+}
@@ -0,0 +1,164 @@
+// Package shim writes the wrapper scripts of 'sbox shim': small shell
+// scripts on the host PATH that run a command of a project's sandbox with
+// 'sbox exec', so CLIs installed in a sandbox work like global binaries.
+package shim
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sbox-project/sbox/internal/runner"
+)
+
+// DefaultDir is where shims are written, relative to the home directory
+const DefaultDir = ".local/bin"
+
+// marker starts the second line of every shim, so shims can be told from
+// other files in the directory
+const marker = "# sbox shim: "
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+-]*$`)
+
+// Shim is a wrapper script
+type Shim struct {
+	// Name is the file name, the command typed on the host
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Project is the project whose sandbox runs Command
+	Project string `json:"project"`
+	Command string `json:"command"`
+}
+
+// Dir returns the default shim directory, ~/.local/bin
+func Dir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, DefaultDir), nil
+}
+
+// CheckName checks a shim or command name
+func CheckName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid name '%s': use letters, digits, '.', '_', '+' and '-'", name)
+	}
+	return nil
+}
+
+// Script returns a shim running command in the sandbox of project with
+// the caller's arguments, stdin and current directory
+func Script(sbox, project, command string) string {
+	argv := runner.ShellJoin([]string{sbox, "exec", "--project", project, "--cwd", "-i", "--", command})
+	return fmt.Sprintf("#!/bin/sh\n%s%s in %s\nexec %s \"$@\"\n", marker, command, project, argv)
+}
+
+// Write writes a shim into dir. An existing file that is not a shim, or a
+// shim of another project or command, is only replaced with force.
+func Write(dir, name, sbox, project, command string, force bool) (*Shim, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, name)
+	if !force {
+		if existing, err := Read(path); err == nil {
+			if existing.Project != project || existing.Command != command {
+				return nil, fmt.Errorf("%s runs %s in %s; use --force to replace it", path, existing.Command, existing.Project)
+			}
+		} else if _, err := os.Lstat(path); err == nil {
+			return nil, fmt.Errorf("%s exists and is not an sbox shim; use --force to replace it", path)
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(Script(sbox, project, command)); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return &Shim{Name: name, Path: path, Project: project, Command: command}, nil
+}
+
+// Read reads a shim; a file that is not one is an error
+func Read(path string) (*Shim, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < 2 && scanner.Scan(); i++ {
+		rest, ok := strings.CutPrefix(scanner.Text(), marker)
+		if !ok {
+			continue
+		}
+		command, project, ok := strings.Cut(rest, " in ")
+		if !ok {
+			break
+		}
+		return &Shim{Name: filepath.Base(path), Path: path, Project: project, Command: command}, nil
+	}
+	return nil, fmt.Errorf("%s is not an sbox shim", path)
+}
+
+// List returns the shims in dir, by name
+func List(dir string) ([]Shim, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var shims []Shim
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if s, err := Read(filepath.Join(dir, entry.Name())); err == nil {
+			shims = append(shims, *s)
+		}
+	}
+	sort.Slice(shims, func(i, j int) bool { return shims[i].Name < shims[j].Name })
+	return shims, nil
+}
+
+// Remove removes a shim, refusing files that are not one
+func Remove(dir, name string) error {
+	path := filepath.Join(dir, name)
+	if _, err := Read(path); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no shim '%s' in %s", name, dir)
+		}
+		return err
+	}
+	return os.Remove(path)
+}
+
+// OnPath reports whether dir is on $PATH
+func OnPath(dir string) bool {
+	for _, entry := range filepath.SplitList(os.Getenv("PATH")) {
+		if filepath.Clean(entry) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+// Package slurm generates sbatch scripts that run a sandbox as a batch
+// job for 'sbox slurm', submits them and maps job states back to sbox
+// process states for 'sbox ps'.
+package slurm
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// Job describes a batch job running 'sbox run' in a project
+type Job struct {
+	Name        string
+	ProjectRoot string
+	// Command is passed to 'sbox run'; empty runs the config's cmd
+	Command string
+	// Sbox is the sbox binary the job runs; it must be reachable from
+	// the compute nodes, like the project
+	Sbox string
+	// LogFile receives the job's stdout and stderr
+	LogFile string
+	Options config.SlurmConfig
+}
+
+var (
+	timePattern   = regexp.MustCompile(`^(\d+-)?\d+(:\d+){0,2}$`)
+	memoryPattern = regexp.MustCompile(`^\d+[KMGT]?$`)
+	gpusPattern   = regexp.MustCompile(`^([A-Za-z0-9_.-]+:)?\d+$`)
+	jobIDPattern  = regexp.MustCompile(`^\d+(_\d+)?$`)
+)
+
+// queryTimeout bounds the squeue and sacct calls of 'sbox ps'
+const queryTimeout = 10 * time.Second
+
+// ValidTime reports whether s is a Slurm time limit: minutes, MM:SS,
+// HH:MM:SS, D-HH, D-HH:MM or D-HH:MM:SS
+func ValidTime(s string) bool {
+	return timePattern.MatchString(s)
+}
+
+// ValidMemory reports whether s is a Slurm memory size such as 16G
+func ValidMemory(s string) bool {
+	return memoryPattern.MatchString(s)
+}
+
+// ValidGPUs reports whether s is a GPU count or type:count
+func ValidGPUs(s string) bool {
+	return gpusPattern.MatchString(s)
+}
+
+// Available reports whether the Slurm client tools are installed
+func Available() bool {
+	_, err := exec.LookPath("sbatch")
+	return err == nil
+}
+
+// Script renders the sbatch script for a job
+func Script(job Job) string {
+	var b strings.Builder
+
+	b.WriteString("#!/bin/bash\n")
+	directive := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, "#SBATCH "+format+"\n", args...)
+	}
+	directive("--job-name=%s", job.Name)
+	directive("--chdir=%s", job.ProjectRoot)
+	directive("--output=%s", job.LogFile)
+	directive("--open-mode=append")
+
+	o := job.Options
+	if o.Partition != "" {
+		directive("--partition=%s", o.Partition)
+	}
+	if o.Account != "" {
+		directive("--account=%s", o.Account)
+	}
+	if o.QOS != "" {
+		directive("--qos=%s", o.QOS)
+	}
+	if o.Time != "" {
+		directive("--time=%s", o.Time)
+	}
+	if o.Nodes > 0 {
+		directive("--nodes=%d", o.Nodes)
+	}
+	if o.CPUs > 0 {
+		directive("--cpus-per-task=%d", o.CPUs)
+	}
+	if o.Memory != "" {
+		directive("--mem=%s", o.Memory)
+	}
+	if o.GPUs != "" {
+		directive("--gpus=%s", o.GPUs)
+	}
+	for _, option := range o.Options {
+		directive("%s", option)
+	}
+
+	fmt.Fprintf(&b, "\n# Generated by sbox %s; regenerate with 'sbox slurm'\n", config.Version)
+	b.WriteString("set -euo pipefail\n\n")
+	b.WriteString(`echo "sbox: job ${SLURM_JOB_ID} on $(hostname) at $(date -Iseconds)"` + "\n")
+
+	args := []string{shellQuote(job.Sbox), "run"}
+	if job.Command != "" {
+		args = append(args, shellQuote(job.Command))
+	}
+	fmt.Fprintf(&b, "exec %s\n", strings.Join(args, " "))
+	return b.String()
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Submit submits a batch script and returns the job ID
+func Submit(scriptPath string) (string, error) {
+	out, err := exec.Command("sbatch", "--parsable", scriptPath).Output()
+	if err != nil {
+		return "", fmt.Errorf("sbatch failed: %w%s", err, stderrOf(err))
+	}
+	// "<id>" or "<id>;<cluster>"
+	id, _, _ := strings.Cut(strings.TrimSpace(string(out)), ";")
+	if !jobIDPattern.MatchString(id) {
+		return "", fmt.Errorf("unexpected sbatch output: %q", strings.TrimSpace(string(out)))
+	}
+	return id, nil
+}
+
+// Cancel cancels a job
+func Cancel(jobID string) error {
+	if _, err := exec.Command("scancel", jobID).Output(); err != nil {
+		return fmt.Errorf("scancel %s failed: %w%s", jobID, err, stderrOf(err))
+	}
+	return nil
+}
+
+// State returns the Slurm state of a job, e.g. PENDING or COMPLETED.
+// squeue only knows queued and running jobs, so finished ones are looked
+// up in the accounting database.
+func State(jobID string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "squeue", "--noheader", "--jobs", jobID, "--format=%T").Output()
+	if err == nil {
+		if state := strings.TrimSpace(string(out)); state != "" {
+			return state, nil
+		}
+	}
+
+	out, err = exec.CommandContext(ctx, "sacct", "--noheader", "--allocations", "--parsable2", "--jobs", jobID, "--format=State").Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot query job %s: %w", jobID, err)
+	}
+	// "CANCELLED by 1000"
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("job %s is unknown to squeue and sacct", jobID)
+	}
+	return fields[0], nil
+}
+
+// ProcessStatus maps a Slurm job state to an sbox process status
+func ProcessStatus(state string) string {
+	switch state {
+	case "PENDING", "CONFIGURING", "REQUEUED", "REQUEUE_HOLD", "REQUEUE_FED", "RESIZING", "SIGNALING":
+		return "queued"
+	case "RUNNING", "COMPLETING", "STAGE_OUT":
+		return "running"
+	case "SUSPENDED", "STOPPED":
+		return "paused"
+	case "COMPLETED", "CANCELLED", "REVOKED":
+		return "stopped"
+	}
+	// FAILED, TIMEOUT, NODE_FAIL, OUT_OF_MEMORY, BOOT_FAIL, DEADLINE, PREEMPTED
+	return "crashed"
+}
+
+func stderrOf(err error) string {
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return ": " + strings.TrimSpace(string(exitErr.Stderr))
+	}
+	return ""
+}
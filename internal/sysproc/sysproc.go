@@ -0,0 +1,11 @@
+// Package sysproc starts, signals and checks processes the same way on
+// Unix and Windows. Windows has no process groups, sessions or signals
+// besides kill; there a group is a process tree, ended by taskkill, and
+// signals it cannot deliver return ErrUnsupported.
+package sysproc
+
+import "errors"
+
+// ErrUnsupported is returned for signals the platform cannot deliver,
+// e.g. SIGSTOP on Windows
+var ErrUnsupported = errors.New("not supported on this platform")
@@ -0,0 +1,74 @@
+//go:build unix
+
+package sysproc
+
+import (
+	"os"
+	"syscall"
+)
+
+// Group returns the attributes starting a command in a process group of
+// its own, so SignalGroup reaches everything it starts
+func Group() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Detached returns the attributes starting a command in a session of its
+// own, so it outlives the terminal of sbox
+func Detached() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// SignalGroup sends a signal to the process group of pid, falling back to
+// the process itself when it is not a group leader
+func SignalGroup(pid int, sig syscall.Signal) error {
+	if err := syscall.Kill(-pid, sig); err == nil {
+		return nil
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// KillGroup kills the process group of pid
+func KillGroup(pid int) error {
+	return SignalGroup(pid, syscall.SIGKILL)
+}
+
+// Pause suspends the process group of pid (SIGSTOP)
+func Pause(pid int) error {
+	return SignalGroup(pid, syscall.SIGSTOP)
+}
+
+// Resume continues the process group of pid (SIGCONT)
+func Resume(pid int) error {
+	return SignalGroup(pid, syscall.SIGCONT)
+}
+
+// Alive reports whether a process exists
+func Alive(pid int) bool {
+	// Signal 0 to pid 0 would test our own process group
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// On Unix, FindProcess always succeeds, so we need to send signal 0
+	err = process.Signal(syscall.Signal(0))
+	return err == nil
+}
+
+// Exists reports whether pid is taken, even by a process of another user
+func Exists(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// Shell returns the argv running a command line with sh
+func Shell(command string) []string {
+	return []string{"sh", "-c", command}
+}
+
+// Umask sets the file mode creation mask of the current process
+func Umask(mask int) {
+	syscall.Umask(mask)
+}
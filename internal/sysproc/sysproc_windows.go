@@ -0,0 +1,87 @@
+package sysproc
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+const (
+	createNewProcessGroup = 0x00000200
+	detachedProcess       = 0x00000008
+	stillActive           = 259
+)
+
+// Group returns the attributes starting a command in a process group of
+// its own, which keeps the Ctrl+C of the console from reaching it
+func Group() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: createNewProcessGroup}
+}
+
+// Detached returns the attributes starting a command without a console,
+// so it outlives the one of sbox
+func Detached() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: createNewProcessGroup | detachedProcess}
+}
+
+// SignalGroup ends the process tree of pid for SIGTERM and SIGKILL; other
+// signals are not supported
+func SignalGroup(pid int, sig syscall.Signal) error {
+	if sig != syscall.SIGTERM && sig != syscall.SIGKILL {
+		return ErrUnsupported
+	}
+	return KillGroup(pid)
+}
+
+// KillGroup ends the process tree of pid
+func KillGroup(pid int) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run()
+}
+
+// Pause would suspend the process tree of pid, which Windows does not
+// offer to programs
+func Pause(pid int) error {
+	return ErrUnsupported
+}
+
+// Resume would continue a paused process tree
+func Resume(pid int) error {
+	return ErrUnsupported
+}
+
+// Alive reports whether a process exists and has not exited
+func Alive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// Processes of other users cannot be opened but exist
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+// Exists reports whether pid is taken by a running process
+func Exists(pid int) bool {
+	return Alive(pid)
+}
+
+// Shell returns the argv running a command line with PowerShell: pwsh
+// when installed, else the Windows PowerShell every Windows has. cmd.exe
+// does not take its command line as an argument Go can quote.
+func Shell(command string) []string {
+	shell := "powershell.exe"
+	if _, err := exec.LookPath("pwsh.exe"); err == nil {
+		shell = "pwsh.exe"
+	}
+	return []string{shell, "-NoLogo", "-NoProfile", "-NonInteractive", "-Command", command}
+}
+
+// Umask does nothing: Windows has ACLs instead of permission bits
+func Umask(mask int) {}
@@ -0,0 +1,17 @@
+// Express server for {{project_name}}
+const express = require("express");
+
+const app = express();
+const port = process.env.SBOX_PORT_HTTP || process.env.PORT || 3000;
+
+app.get("/", (req, res) => {
+    res.json({ message: "Hello from sbox!" });
+});
+
+app.get("/health", (req, res) => {
+    res.json({ status: "ok" });
+});
+
+app.listen(port, () => {
+    console.log(`Listening on port ${port}`);
+});
@@ -0,0 +1,19 @@
+"""
+{{project_name}}: a FastAPI service.
+
+Run it with 'sbox run', then open http://localhost:8000/docs
+"""
+
+from fastapi import FastAPI
+
+app = FastAPI(title="{{project_name}}")
+
+
+@app.get("/")
+def index():
+    return {"message": "Hello from sbox!"}
+
+
+@app.get("/health")
+def health():
+    return {"status": "ok"}
@@ -0,0 +1,222 @@
+// Package templates provides the project templates of 'sbox init
+// --template': a built-in set embedded in the binary and the user's own
+// in ~/.sbox/templates. A template is a directory holding a template.yaml,
+// which describes the project config, and the starter files copied into
+// the new project.
+package templates
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// MetadataFile describes a template; every other file is a starter file
+const MetadataFile = "template.yaml"
+
+// UserDir is the directory of user templates under ~/.sbox
+const UserDir = "templates"
+
+// ProjectNamePlaceholder is replaced with the project name in starter files
+const ProjectNamePlaceholder = "{{project_name}}"
+
+// Builtin is the source of the templates embedded in sbox
+const Builtin = "built-in"
+
+//go:embed builtin
+var builtin embed.FS
+
+// Template is a project template
+type Template struct {
+	// Name is the template's directory name, Source "built-in" or the
+	// directory a user template was read from
+	Name   string `yaml:"-"`
+	Source string `yaml:"-"`
+
+	Description string `yaml:"description"`
+
+	// Runtime, Workdir, Copy, Install, Cmd, Env and Ports become the
+	// project's config; unset fields keep the defaults of the runtime
+	Runtime string            `yaml:"runtime"`
+	Workdir string            `yaml:"workdir,omitempty"`
+	Copy    []string          `yaml:"copy,omitempty"`
+	Install []string          `yaml:"install,omitempty"`
+	Cmd     string            `yaml:"cmd,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Ports   map[string]int    `yaml:"ports,omitempty"`
+
+	// Gitignore lines are added to the project's .gitignore
+	Gitignore []string `yaml:"gitignore,omitempty"`
+
+	files fs.FS
+}
+
+// File is a starter file, by path relative to the project root
+type File struct {
+	Path    string
+	Content []byte
+	Mode    fs.FileMode
+}
+
+// GetUserTemplateDir returns ~/.sbox/templates
+func GetUserTemplateDir() (string, error) {
+	globalDir, err := config.GetGlobalSboxDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(globalDir, UserDir), nil
+}
+
+// Load returns a template by name. A user template takes precedence over
+// the built-in one of the same name.
+func Load(name string) (*Template, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || !fs.ValidPath(name) {
+		return nil, fmt.Errorf("invalid template name '%s'", name)
+	}
+
+	if dir, err := GetUserTemplateDir(); err == nil {
+		if _, err := os.Stat(filepath.Join(dir, name, MetadataFile)); err == nil {
+			return read(os.DirFS(dir), name, filepath.Join(dir, name))
+		}
+	}
+	if _, err := fs.Stat(builtin, "builtin/"+name+"/"+MetadataFile); err == nil {
+		return read(builtinFS(), name, Builtin)
+	}
+	return nil, fmt.Errorf("template '%s' not found", name)
+}
+
+// List returns every template sorted by name, user templates replacing
+// built-in ones of the same name. User templates that cannot be read are
+// left out and reported in problems.
+func List() (list []*Template, problems []error) {
+	byName := make(map[string]*Template)
+
+	builtinFiles := builtinFS()
+	entries, _ := fs.ReadDir(builtinFiles, ".")
+	for _, entry := range entries {
+		if t, err := read(builtinFiles, entry.Name(), Builtin); err == nil {
+			byName[t.Name] = t
+		}
+	}
+
+	if dir, err := GetUserTemplateDir(); err == nil {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			t, err := read(os.DirFS(dir), entry.Name(), filepath.Join(dir, entry.Name()))
+			if err != nil {
+				problems = append(problems, err)
+				continue
+			}
+			byName[t.Name] = t
+		}
+	}
+
+	for _, t := range byName {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, problems
+}
+
+func builtinFS() fs.FS {
+	sub, _ := fs.Sub(builtin, "builtin")
+	return sub
+}
+
+// read loads the template in directory name of fsys
+func read(fsys fs.FS, name, source string) (*Template, error) {
+	data, err := fs.ReadFile(fsys, name+"/"+MetadataFile)
+	if err != nil {
+		return nil, fmt.Errorf("template '%s': %w", name, err)
+	}
+
+	t := &Template{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(t); err != nil {
+		return nil, fmt.Errorf("template '%s': invalid %s: %w", name, MetadataFile, err)
+	}
+	if t.Runtime == "" {
+		return nil, fmt.Errorf("template '%s': %s has no runtime", name, MetadataFile)
+	}
+
+	t.Name = name
+	t.Source = source
+	if t.files, err = fs.Sub(fsys, name); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Config returns the project config of the template
+func (t *Template) Config() *config.Config {
+	cfg := config.NewDefaultConfig(t.Runtime)
+	if t.Workdir != "" {
+		cfg.Workdir = t.Workdir
+	}
+	if t.Copy != nil {
+		cfg.Copy = append([]string{}, t.Copy...)
+	}
+	if t.Install != nil {
+		cfg.Install = append([]string{}, t.Install...)
+	}
+	if t.Cmd != "" {
+		cfg.Cmd = t.Cmd
+	}
+	for key, value := range t.Env {
+		cfg.Env[key] = value
+	}
+	if len(t.Ports) > 0 {
+		cfg.Ports = make(map[string]int)
+		for name, port := range t.Ports {
+			cfg.Ports[name] = port
+		}
+	}
+	return cfg
+}
+
+// Files returns the starter files of the template with the project name
+// filled in
+func (t *Template) Files(projectName string) ([]File, error) {
+	var files []File
+	err := fs.WalkDir(t.files, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path == MetadataFile {
+			return nil
+		}
+		data, err := fs.ReadFile(t.files, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// Embedded files are read-only; keep only the executable bit
+		mode := fs.FileMode(0644)
+		if info.Mode()&0111 != 0 {
+			mode = 0755
+		}
+		content := bytes.ReplaceAll(data, []byte(ProjectNamePlaceholder), []byte(projectName))
+		files = append(files, File{Path: path, Content: content, Mode: mode})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("template '%s': %w", t.Name, err)
+	}
+	return files, nil
+}
@@ -0,0 +1,322 @@
+// Package trash keeps what destructive commands (clean --all, init
+// --force, cache clean) remove in ~/.sbox/trash for a while, so 'sbox
+// undo' can put it back. Each command moves its paths into one entry.
+package trash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// Dir is the trash directory, in ~/.sbox
+const Dir = "trash"
+
+// DefaultRetention is how long entries are kept when trash.retention_days
+// is not set in ~/.sbox/defaults.yaml
+const DefaultRetention = 7 * 24 * time.Hour
+
+// entryFile describes an entry; the paths it holds are items/0, items/1, ...
+const entryFile = "entry.json"
+
+// Item is a path moved into the trash
+type Item struct {
+	// Path is where it was, and is restored to
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Entry holds the paths one command removed
+type Entry struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Items   []Item    `json:"items"`
+
+	dir string
+}
+
+// GetTrashDir returns the path to ~/.sbox/trash
+func GetTrashDir() (string, error) {
+	globalDir, err := config.GetGlobalSboxDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(globalDir, Dir), nil
+}
+
+// Retention returns how long entries are kept, from ~/.sbox/defaults.yaml
+func Retention() time.Duration {
+	cfg, err := config.LoadGlobalConfig()
+	if err != nil || cfg.Trash.RetentionDays <= 0 {
+		return DefaultRetention
+	}
+	return time.Duration(cfg.Trash.RetentionDays) * 24 * time.Hour
+}
+
+// New creates an empty entry for a command, such as "clean --all".
+// Entries past the retention period are purged first.
+func New(command string) (*Entry, error) {
+	trashDir, err := GetTrashDir()
+	if err != nil {
+		return nil, err
+	}
+	Purge(Retention())
+
+	if err := os.MkdirAll(trashDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", trashDir, err)
+	}
+	now := time.Now()
+	id := now.Format("20060102-150405")
+	for n := 2; ; n++ {
+		err := os.Mkdir(filepath.Join(trashDir, id), 0700)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create trash entry: %w", err)
+		}
+		id = now.Format("20060102-150405") + "-" + strconv.Itoa(n)
+	}
+	return &Entry{ID: id, Time: now, Command: command, dir: filepath.Join(trashDir, id)}, nil
+}
+
+// Move moves a path into the entry. A path on another filesystem than
+// the trash is copied, then removed.
+func (e *Entry) Move(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if info.IsDir() {
+		size = dirSize(path)
+	}
+
+	items := filepath.Join(e.dir, "items")
+	if err := os.MkdirAll(items, 0700); err != nil {
+		return err
+	}
+	dest := filepath.Join(items, strconv.Itoa(len(e.Items)))
+	if err := move(path, dest); err != nil {
+		return fmt.Errorf("failed to move %s to the trash: %w", path, err)
+	}
+	e.Items = append(e.Items, Item{Path: path, Size: size})
+	return e.save()
+}
+
+// Close removes the entry when nothing was moved into it
+func (e *Entry) Close() {
+	if len(e.Items) == 0 {
+		os.RemoveAll(e.dir)
+	}
+}
+
+// Size returns the total size of the entry's paths
+func (e *Entry) Size() int64 {
+	var size int64
+	for _, item := range e.Items {
+		size += item.Size
+	}
+	return size
+}
+
+// Expires returns when the entry is purged
+func (e *Entry) Expires() time.Time {
+	return e.Time.Add(Retention())
+}
+
+func (e *Entry) save() error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(e.dir, entryFile), data, 0600)
+}
+
+// Conflicts returns the paths of the entry that exist again, which
+// Restore would have to replace
+func (e *Entry) Conflicts() []string {
+	var conflicts []string
+	for _, item := range e.Items {
+		if _, err := os.Lstat(item.Path); err == nil {
+			conflicts = append(conflicts, item.Path)
+		}
+	}
+	return conflicts
+}
+
+// Restore moves the entry's paths back and removes the entry. Paths that
+// exist again are an error unless replace is set, in which case they are
+// moved into a new entry so the restore itself can be undone.
+func (e *Entry) Restore(replace bool) (*Entry, error) {
+	conflicts := e.Conflicts()
+	if len(conflicts) > 0 && !replace {
+		return nil, fmt.Errorf("%s exists again", conflicts[0])
+	}
+
+	var replaced *Entry
+	if len(conflicts) > 0 {
+		var err error
+		if replaced, err = New("undo " + e.ID); err != nil {
+			return nil, err
+		}
+		for _, path := range conflicts {
+			if err := replaced.Move(path); err != nil {
+				return replaced, err
+			}
+		}
+	}
+
+	for i, item := range e.Items {
+		if err := os.MkdirAll(filepath.Dir(item.Path), 0755); err != nil {
+			return replaced, err
+		}
+		if err := move(filepath.Join(e.dir, "items", strconv.Itoa(i)), item.Path); err != nil {
+			return replaced, fmt.Errorf("failed to restore %s: %w", item.Path, err)
+		}
+	}
+	return replaced, os.RemoveAll(e.dir)
+}
+
+// Remove deletes the entry for good
+func (e *Entry) Remove() error {
+	return os.RemoveAll(e.dir)
+}
+
+// List returns the entries, newest first. Entries that cannot be read,
+// such as one a command was interrupted creating, are skipped.
+func List() ([]*Entry, error) {
+	trashDir, err := GetTrashDir()
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := os.ReadDir(trashDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []*Entry
+	for _, d := range dirs {
+		dir := filepath.Join(trashDir, d.Name())
+		data, err := os.ReadFile(filepath.Join(dir, entryFile))
+		if err != nil {
+			continue
+		}
+		var entry Entry
+		if json.Unmarshal(data, &entry) != nil {
+			continue
+		}
+		entry.dir = dir
+		entries = append(entries, &entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	return entries, nil
+}
+
+// Find returns the entry with an ID, or the newest for ""
+func Find(id string) (*Entry, error) {
+	entries, err := List()
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("the trash is empty")
+		}
+		return entries[0], nil
+	}
+	for _, entry := range entries {
+		if entry.ID == id {
+			return entry, nil
+		}
+	}
+	return nil, fmt.Errorf("no trash entry '%s'", id)
+}
+
+// Purge removes the entries older than age and returns how many and
+// their size; 0 empties the trash
+func Purge(age time.Duration) (int, int64, error) {
+	trashDir, err := GetTrashDir()
+	if err != nil {
+		return 0, 0, err
+	}
+	dirs, err := os.ReadDir(trashDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+
+	entries, _ := List()
+	listed := make(map[string]*Entry)
+	for _, entry := range entries {
+		listed[filepath.Base(entry.dir)] = entry
+	}
+	var removed int
+	var size int64
+	for _, d := range dirs {
+		dir := filepath.Join(trashDir, d.Name())
+		// Unreadable entries age by their modification time
+		modTime := time.Now()
+		if info, err := d.Info(); err == nil {
+			modTime = info.ModTime()
+		}
+		entrySize := int64(0)
+		if entry, ok := listed[d.Name()]; ok {
+			modTime = entry.Time
+			entrySize = entry.Size()
+		}
+		if age > 0 && time.Since(modTime) < age {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return removed, size, err
+		}
+		removed++
+		size += entrySize
+	}
+	return removed, size, nil
+}
+
+// move renames a path, copying it across filesystems
+func move(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if out, err := exec.Command("cp", "-a", src, dst).CombinedOutput(); err != nil {
+		os.RemoveAll(dst)
+		return fmt.Errorf("cp: %s", strings.TrimSpace(string(out)))
+	}
+	return os.RemoveAll(src)
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -2,13 +2,25 @@
 package validate
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/sbox-project/sbox/internal/config"
+	"github.com/sbox-project/sbox/internal/gpu"
+	"github.com/sbox-project/sbox/internal/healthcheck"
+	"github.com/sbox-project/sbox/internal/mpi"
+	"github.com/sbox-project/sbox/internal/process"
+	"github.com/sbox-project/sbox/internal/secrets"
+	"github.com/sbox-project/sbox/internal/slurm"
 )
 
 // ValidationError represents a single validation error
@@ -27,17 +39,17 @@ type ValidationResult struct {
 
 // Supported runtimes and versions
 var (
-	SupportedLanguages = []string{"python", "node", "nodejs"}
-
-	SupportedPythonVersions = []string{"3.8", "3.9", "3.10", "3.11", "3.12", "3.13"}
-	SupportedNodeVersions   = []string{"18", "20", "22", "23", "24"}
+	SupportedLanguages = config.RuntimeNames()
 
 	// Regex patterns
-	runtimePattern = regexp.MustCompile(`^(python|node|nodejs):(\d+\.?\d*)$`)
-	copyPattern    = regexp.MustCompile(`^[^:]+:[^:]+$|^[^:]+$`)
-	mountPattern   = regexp.MustCompile(`^[^:]+:[^:]+(:(ro|readonly))?$`)
-	workdirPattern = regexp.MustCompile(`^/[a-zA-Z0-9_\-./]*$`)
-	envKeyPattern  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	runtimePattern  = regexp.MustCompile(`^[a-z]+:\d+(\.\d+){0,2}$`)
+	copyPattern     = regexp.MustCompile(`^[^:]+:[^:]+$|^[^:]+$`)
+	mountPattern    = regexp.MustCompile(`^[^:]+:[^:]+(:(ro|readonly))?$`)
+	workdirPattern  = regexp.MustCompile(`^/[a-zA-Z0-9_\-./]*$`)
+	envKeyPattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	portNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+	profilePattern  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+	sboxCallPattern = regexp.MustCompile(`(^|[\s;&|(])sbox\s+(build|run)\b`)
 )
 
 // ValidateConfig performs comprehensive validation on a config
@@ -58,12 +70,61 @@ func ValidateConfig(cfg *config.Config, projectRoot string) *ValidationResult {
 
 	// Validate install commands
 	validateInstall(cfg, result)
+	validateManifests(cfg, projectRoot, result)
 
 	// Validate cmd
 	validateCmd(cfg, result)
 
+	// Validate lifecycle hooks
+	validateHooks(cfg, result)
+	validateInitTasks(cfg, result)
+	validateHealthchecks(cfg, result)
+
 	// Validate environment variables
 	validateEnv(cfg, result)
+	validateEnvFile(cfg, projectRoot, result)
+	validateSecrets(cfg, projectRoot, result)
+
+	// Validate idle policy
+	validateIdleTimeout(cfg, result)
+
+	// Validate isolation backend
+	validateIsolation(cfg, result)
+
+	// Validate the host PATH
+	validatePathMode(cfg, result)
+	validateLimits(cfg, result)
+	validateUlimits(cfg, result)
+	validatePriority(cfg, result)
+	validateCPUs(cfg, result)
+
+	// Validate declared ports
+	validatePorts(cfg, result)
+
+	// Validate build args
+	validateArgs(cfg, result)
+
+	// Validate host library passthrough
+	validateHostLibs(cfg, result)
+	validateGPU(cfg, result)
+
+	// Validate Slurm batch options
+	validateSlurm(cfg, result)
+
+	// Validate log rotation
+	validateLogging(cfg, result)
+
+	// Validate the license policy
+	validateLicenses(cfg, result)
+
+	// Validate .gitignore maintenance
+	validateVCS(cfg, result)
+
+	// Validate MPI launches against the env's MPI and the host
+	validateMPI(cfg, projectRoot, result)
+
+	// Validate the other profiles
+	validateProfiles(cfg, projectRoot, result)
 
 	// Set overall validity
 	result.Valid = len(result.Errors) == 0
@@ -118,7 +179,7 @@ func validateRuntime(cfg *config.Config, result *ValidationResult) {
 		result.Errors = append(result.Errors, ValidationError{
 			Field:   "runtime",
 			Message: fmt.Sprintf("Invalid runtime format: '%s'", cfg.Runtime),
-			Hint:    "Use format 'language:version', e.g., 'python:3.11' or 'node:22'",
+			Hint:    "Use format 'language:version', e.g., 'python:3.11', 'node:22' or 'go:1.22'",
 		})
 		return
 	}
@@ -127,13 +188,7 @@ func validateRuntime(cfg *config.Config, result *ValidationResult) {
 	info := cfg.ParseRuntime()
 
 	// Check language
-	validLang := false
-	for _, lang := range SupportedLanguages {
-		if info.Language == lang {
-			validLang = true
-			break
-		}
-	}
+	spec, validLang := config.LookupRuntime(info.Language)
 	if !validLang {
 		result.Errors = append(result.Errors, ValidationError{
 			Field:   "runtime",
@@ -144,12 +199,7 @@ func validateRuntime(cfg *config.Config, result *ValidationResult) {
 	}
 
 	// Check version (warning only for unknown versions)
-	var supportedVersions []string
-	if info.Language == "python" {
-		supportedVersions = SupportedPythonVersions
-	} else {
-		supportedVersions = SupportedNodeVersions
-	}
+	supportedVersions := spec.Versions
 
 	versionValid := false
 	for _, v := range supportedVersions {
@@ -260,7 +310,9 @@ func validateMount(cfg *config.Config, projectRoot string, result *ValidationRes
 
 	for i, spec := range cfg.Mount {
 		// Check format: /host/path:/container/path or /host/path:/container/path:ro
-		if !mountPattern.MatchString(spec) {
+		// A Windows drive such as C: is not a separator
+		drive := filepath.VolumeName(config.SplitSpec(spec)[0])
+		if !mountPattern.MatchString(strings.TrimPrefix(spec, drive)) {
 			result.Errors = append(result.Errors, ValidationError{
 				Field:   fmt.Sprintf("mount[%d]", i),
 				Message: fmt.Sprintf("Invalid mount specification: '%s'", spec),
@@ -269,7 +321,7 @@ func validateMount(cfg *config.Config, projectRoot string, result *ValidationRes
 			continue
 		}
 
-		parts := strings.Split(spec, ":")
+		parts := config.SplitSpec(spec)
 		if len(parts) < 2 {
 			result.Errors = append(result.Errors, ValidationError{
 				Field:   fmt.Sprintf("mount[%d]", i),
@@ -397,6 +449,34 @@ func validateInstall(cfg *config.Config, result *ValidationResult) {
 	}
 }
 
+// validateManifests warns about dependency files in the copied
+// directories that no install command reads
+func validateManifests(cfg *config.Config, projectRoot string, result *ValidationResult) {
+	if projectRoot == "" {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, spec := range cfg.ParseCopy() {
+		if filepath.IsAbs(spec.Src) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(projectRoot, spec.Src)); err != nil || !info.IsDir() {
+			continue
+		}
+		for _, m := range config.DetectManifests(projectRoot, spec.Src) {
+			if seen[m.Path] || m.Install == "" || m.ReferencedBy(cfg.Install) {
+				continue
+			}
+			seen[m.Path] = true
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   "install",
+				Message: fmt.Sprintf("%s is not installed by any install command", m.Path),
+				Hint:    fmt.Sprintf("Add '%s' to install", m.Install),
+			})
+		}
+	}
+}
+
 func validateCmd(cfg *config.Config, result *ValidationResult) {
 	if cfg.Cmd == "" {
 		result.Warnings = append(result.Warnings, ValidationError{
@@ -436,10 +516,12 @@ func validateEnv(cfg *config.Config, result *ValidationResult) {
 
 	reservedVars := []string{
 		"PATH", "HOME", "SBOX_ACTIVE", "SBOX_PROJECT",
+		"SBOX_VERSION", "SBOX_RUNTIME", "SBOX_BUILD_HASH",
+		"SBOX_SERVICE_NAME", "SBOX_LOG_DIR",
 		"CONDA_PREFIX", "MAMBA_ROOT_PREFIX",
 	}
 
-	for key, value := range cfg.Env {
+	for key := range cfg.Env {
 		// Check key format
 		if !envKeyPattern.MatchString(key) {
 			result.Errors = append(result.Errors, ValidationError{
@@ -463,18 +545,196 @@ func validateEnv(cfg *config.Config, result *ValidationResult) {
 		}
 
 		// Check for potentially sensitive values in plain text
-		sensitivePatterns := []string{"password", "secret", "key", "token", "credential"}
-		keyLower := strings.ToLower(key)
-		for _, pattern := range sensitivePatterns {
-			if strings.Contains(keyLower, pattern) && value != "" && !strings.HasPrefix(value, "${") {
-				result.Warnings = append(result.Warnings, ValidationError{
-					Field:   fmt.Sprintf("env.%s", key),
-					Message: "Sensitive value may be stored in plain text",
-					Hint:    "Consider using environment variable expansion like '${MY_SECRET}' or a secrets manager",
-				})
-				break
+		if raw := cfg.Raw().Env[key]; config.IsSensitiveEnv(key) && raw != "" && !strings.HasPrefix(raw, "${") {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   fmt.Sprintf("env.%s", key),
+				Message: "Sensitive value may be stored in plain text",
+				Hint:    fmt.Sprintf("Store it with 'sbox secret set %s' and list it under secrets:", key),
+			})
+		}
+	}
+}
+
+// validateProfiles checks each profile other than the selected one (which
+// the checks above covered) as the configuration it selects, reporting
+// what its overrides bring under profiles.<name>
+func validateProfiles(cfg *config.Config, projectRoot string, result *ValidationResult) {
+	base := cfg.Base()
+	for _, name := range base.ProfileNames() {
+		prefix := "profiles." + name
+		if !profilePattern.MatchString(name) {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   prefix,
+				Message: fmt.Sprintf("Invalid profile name: '%s'", name),
+				Hint:    "Use letters, digits, '-' and '_', starting with a letter, e.g. 'prod'",
+			})
+			continue
+		}
+		if name == cfg.Profile() {
+			continue
+		}
+
+		raw, err := base.WithProfile(name)
+		if err == nil {
+			var applied *config.Config
+			if applied, err = raw.Resolve(projectRoot); err == nil {
+				raw = applied
 			}
 		}
+		if err != nil {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   prefix,
+				Message: fmt.Sprintf("Cannot apply profile: %s", err),
+			})
+			continue
+		}
+
+		profile := base.Profiles[name]
+		sub := &ValidationResult{}
+		if profile.Cmd != "" {
+			validateCmd(raw, sub)
+		}
+		if profile.Mount != nil {
+			validateMount(raw, projectRoot, sub)
+		}
+		if profile.Install != nil {
+			validateInstall(raw, sub)
+		}
+		if len(profile.Env) > 0 {
+			env := &ValidationResult{}
+			validateEnv(raw, env)
+			// Only the entries the profile sets; the rest are top-level env
+			inProfile := func(e ValidationError) bool {
+				_, ok := profile.Env[strings.TrimPrefix(e.Field, "env.")]
+				return ok
+			}
+			for _, e := range env.Errors {
+				if inProfile(e) {
+					sub.Errors = append(sub.Errors, e)
+				}
+			}
+			for _, e := range env.Warnings {
+				if inProfile(e) {
+					sub.Warnings = append(sub.Warnings, e)
+				}
+			}
+		}
+
+		for _, e := range sub.Errors {
+			e.Field = prefix + "." + e.Field
+			result.Errors = append(result.Errors, e)
+		}
+		for _, e := range sub.Warnings {
+			e.Field = prefix + "." + e.Field
+			result.Warnings = append(result.Warnings, e)
+		}
+	}
+}
+
+func validateIdleTimeout(cfg *config.Config, result *ValidationResult) {
+	if cfg.IdleTimeout == "" {
+		return
+	}
+
+	d, err := time.ParseDuration(cfg.IdleTimeout)
+	if err != nil || d <= 0 {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "idle_timeout",
+			Message: fmt.Sprintf("Invalid idle timeout: '%s'", cfg.IdleTimeout),
+			Hint:    "Use a positive duration like '30m' or '2h'",
+		})
+		return
+	}
+
+	if d < time.Minute {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "idle_timeout",
+			Message: fmt.Sprintf("Idle timeout '%s' is very short", cfg.IdleTimeout),
+			Hint:    fmt.Sprintf("Activity is sampled every %s; daemons may be stopped while still starting up", process.IdlePollInterval),
+		})
+	}
+}
+
+func validateIsolation(cfg *config.Config, result *ValidationResult) {
+	switch cfg.Isolation {
+	case "", config.IsolationNone:
+		return
+	case config.IsolationNamespace:
+	default:
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "isolation",
+			Message: fmt.Sprintf("Unknown isolation mode: '%s'", cfg.Isolation),
+			Hint:    "Use 'none' or 'namespace'",
+		})
+		return
+	}
+
+	_, bwrapErr := exec.LookPath("bwrap")
+	_, unshareErr := exec.LookPath("unshare")
+	if bwrapErr != nil && unshareErr != nil {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "isolation",
+			Message: "Namespace isolation needs bwrap or unshare, neither was found in PATH",
+			Hint:    "Install bubblewrap (recommended) or util-linux",
+		})
+	}
+}
+
+// validateVCS checks vcs
+func validateVCS(cfg *config.Config, result *ValidationResult) {
+	if cfg.VCS != "" && cfg.VCS != config.VCSNone {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "vcs",
+			Message: fmt.Sprintf("Unknown VCS mode: '%s'", cfg.VCS),
+			Hint:    "Use 'none' to stop sbox from changing .gitignore or .hgignore, or leave it out",
+		})
+	}
+}
+
+// validatePathMode checks path_mode and the directories of path
+func validatePathMode(cfg *config.Config, result *ValidationResult) {
+	switch cfg.PathMode {
+	case "", config.PathIsolated, config.PathInherit:
+		if len(cfg.Path) > 0 {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   "path",
+				Message: "path is ignored unless path_mode is custom",
+				Hint:    "Set path_mode: custom to use these directories",
+			})
+		}
+		return
+	case config.PathCustom:
+	default:
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "path_mode",
+			Message: fmt.Sprintf("Unknown PATH mode: '%s'", cfg.PathMode),
+			Hint:    "Use 'isolated', 'inherit' or 'custom'",
+		})
+		return
+	}
+
+	if len(cfg.Path) == 0 {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "path",
+			Message: "path_mode is custom but path is empty: only the environment's bin is on PATH",
+			Hint:    fmt.Sprintf("List host directories such as %s", strings.Join(config.SystemPath, ", ")),
+		})
+	}
+	for i, dir := range cfg.HostPathDirs() {
+		field := fmt.Sprintf("path[%d]", i)
+		if !filepath.IsAbs(dir) {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("PATH directory must be absolute: '%s'", dir),
+				Hint:    "Use an absolute host path, e.g. /opt/homebrew/bin",
+			})
+		} else if _, err := os.Stat(dir); err != nil {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("PATH directory does not exist: '%s'", dir),
+				Hint:    "It is kept on PATH but has no effect on this host",
+			})
+		}
 	}
 }
 
@@ -587,3 +847,658 @@ env:
   PYTHONPATH: /app
 `
 }
+
+func validateLimits(cfg *config.Config, result *ValidationResult) {
+	l := cfg.Limits
+
+	if l.Memory != "" {
+		if _, err := config.ParseSize(l.Memory); err != nil {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   "limits.memory",
+				Message: fmt.Sprintf("Invalid memory limit: '%s'", l.Memory),
+				Hint:    "Use a size such as 512M or 2G",
+			})
+		}
+	}
+
+	for _, limit := range []struct {
+		field string
+		value int
+	}{
+		{"limits.cpu_shares", l.CPUShares},
+		{"limits.nofile", l.NoFile},
+		{"limits.nproc", l.NProc},
+	} {
+		if limit.value < 0 {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   limit.field,
+				Message: fmt.Sprintf("Limit must be positive, got %d", limit.value),
+				Hint:    "Remove the key to leave it unlimited",
+			})
+		}
+	}
+
+	if l.CPUShares > 0 {
+		if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   "limits.cpu_shares",
+				Message: "CPU shares need cgroups v2, which this host does not have",
+				Hint:    "The limit is ignored here; memory, nofile and nproc fall back to rlimits",
+			})
+		}
+	}
+}
+
+func validateUlimits(cfg *config.Config, result *ValidationResult) {
+	cfg.Ulimits.Each(func(key, value string) {
+		field := "ulimits." + key
+		u, err := config.ParseUlimit(key, value)
+		if err != nil {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Invalid ulimit: %s", err),
+				Hint:    "Use a number, unlimited, or soft:hard such as 1024:65536",
+			})
+			return
+		}
+
+		if hard, err := process.HardLimit(key); err == nil && u.Hard > hard && os.Geteuid() != 0 {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("%s is above this host's hard limit of %s", value, process.FormatRlimit(hard)),
+				Hint:    "Commands fail to start here; raise the hard limit (e.g. in /etc/security/limits.conf) or lower the value",
+			})
+		}
+	})
+
+	for _, both := range []struct {
+		key    string
+		ulimit string
+		limit  int
+	}{
+		{"nofile", cfg.Ulimits.NoFile, cfg.Limits.NoFile},
+		{"nproc", cfg.Ulimits.NProc, cfg.Limits.NProc},
+	} {
+		if both.ulimit != "" && both.limit > 0 {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   "ulimits." + both.key,
+				Message: fmt.Sprintf("limits.%s is set as well and replaces it for daemons", both.key),
+				Hint:    "Set it in one place",
+			})
+		}
+	}
+}
+
+func validatePriority(cfg *config.Config, result *ValidationResult) {
+	p := cfg.Priority
+
+	if err := p.Check(); err != nil {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "priority",
+			Message: fmt.Sprintf("Invalid priority: %s", err),
+			Hint:    "Use a nice value from -20 to 19 and io_class realtime, best-effort or idle",
+		})
+		return
+	}
+
+	if p.Nice < 0 && os.Geteuid() != 0 {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "priority.nice",
+			Message: fmt.Sprintf("Nice %d needs root or CAP_SYS_NICE", p.Nice),
+			Hint:    "Commands fail to start without it; use 0 or more to only lower the priority",
+		})
+	}
+	if p.IOClass == config.IOClassRealtime && os.Geteuid() != 0 {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "priority.io_class",
+			Message: "The realtime IO class needs root or CAP_SYS_ADMIN",
+			Hint:    "Use best-effort with a negative nice, or idle for batch work",
+		})
+	}
+	if p.IOClass != "" && runtime.GOOS != "linux" {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "priority.io_class",
+			Message: "IO classes are only supported on Linux",
+			Hint:    "The setting is ignored on this host",
+		})
+	}
+}
+
+func validateCPUs(cfg *config.Config, result *ValidationResult) {
+	if cfg.CPUs == "" {
+		return
+	}
+	cpus, err := config.ParseCPUList(cfg.CPUs)
+	if err != nil {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "cpus",
+			Message: fmt.Sprintf("Invalid cpus: %s", err),
+			Hint:    "Use a CPU list such as 0-3 or 0,2,8-15",
+		})
+		return
+	}
+
+	if runtime.GOOS != "linux" {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "cpus",
+			Message: "CPU pinning is only supported on Linux",
+			Hint:    "The setting is ignored on this host",
+		})
+		return
+	}
+	if last := cpus[len(cpus)-1]; last >= runtime.NumCPU() {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "cpus",
+			Message: fmt.Sprintf("CPU %d is not available, the highest usable CPU is %d", last, runtime.NumCPU()-1),
+			Hint:    "Only the listed CPUs that exist are used; commands fail to start when none do",
+		})
+	}
+}
+
+// validateArgs checks build arg names, and warns about args that install
+// and copy do not reference
+func validateArgs(cfg *config.Config, result *ValidationResult) {
+	raw := cfg.Raw()
+	used := strings.Join(append(append([]string{}, raw.Install...), raw.Copy...), "\n")
+	for _, name := range cfg.ArgNames() {
+		field := fmt.Sprintf("args.%s", name)
+		if !envKeyPattern.MatchString(name) {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Invalid build arg name: '%s'", name),
+				Hint:    "Use letters, digits and '_', not starting with a digit",
+			})
+			continue
+		}
+		if !strings.Contains(used, "${"+name+"}") && !strings.Contains(used, "${"+name+":-") {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Build arg '%s' is not used by install or copy", name),
+				Hint:    fmt.Sprintf("Reference it as ${%s}, or remove it", name),
+			})
+		}
+	}
+}
+
+// validatePorts checks port names and numbers
+func validatePorts(cfg *config.Config, result *ValidationResult) {
+	names := make([]string, 0, len(cfg.Ports))
+	for name := range cfg.Ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	byPort := make(map[int]string)
+	for _, name := range names {
+		port := cfg.Ports[name]
+		field := fmt.Sprintf("ports.%s", name)
+
+		if !portNamePattern.MatchString(name) {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Invalid port name: '%s'", name),
+				Hint:    "Use letters, digits, '_' and '-', starting with a letter; it becomes " + config.PortEnvName("<name>"),
+			})
+			continue
+		}
+		if port < 1 || port > 65535 {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Port must be between 1 and 65535, got %d", port),
+				Hint:    "Use the port the application listens on, e.g. 8000",
+			})
+			continue
+		}
+		if other, ok := byPort[port]; ok {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Port %d is also declared as '%s'", port, other),
+				Hint:    "Each port can have only one name",
+			})
+			continue
+		}
+		byPort[port] = name
+
+		if port < 1024 {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Port %d is privileged", port),
+				Hint:    "Binding ports below 1024 needs root; use a port such as 8080",
+			})
+		}
+	}
+}
+
+// systemLibDirs hold the host's C library and toolchain runtime
+var systemLibDirs = []string{
+	"/lib", "/lib64", "/usr/lib", "/usr/lib64",
+	"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu",
+	"/lib/aarch64-linux-gnu", "/usr/lib/aarch64-linux-gnu",
+}
+
+// abiLibs are libraries that conda environments ship their own, newer
+// copies of; loading the host's instead breaks with errors like
+// "GLIBCXX_3.4.30 not found"
+var abiLibs = []string{"libc.so.6", "libstdc++.so.6", "libgcc_s.so.1", "libgomp.so.1"}
+
+// validateHostLibs checks the host_libs directories and warns about ABI
+// risks of mixing host and environment libraries
+func validateHostLibs(cfg *config.Config, result *ValidationResult) {
+	for i, dir := range cfg.HostLibDirs() {
+		field := fmt.Sprintf("host_libs[%d]", i)
+
+		if !filepath.IsAbs(dir) {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Host library directory must be absolute: '%s'", cfg.HostLibs[i]),
+				Hint:    "Use a path such as /usr/local/cuda/lib64",
+			})
+			continue
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Host library directory does not exist: '%s'", dir),
+				Hint:    "Check the path on this host; libraries there will not be found",
+			})
+			continue
+		}
+
+		if isSystemLibDir(dir) {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("'%s' exposes every system library to the sandbox", dir),
+				Hint:    "List the directory of the libraries you need instead, e.g. /usr/lib/x86_64-linux-gnu/nvidia",
+			})
+			continue
+		}
+
+		var found []string
+		for _, lib := range abiLibs {
+			if _, err := os.Stat(filepath.Join(dir, lib)); err == nil {
+				found = append(found, lib)
+			}
+		}
+		if len(found) > 0 {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("'%s' contains %s, which the environment provides its own copy of", dir, strings.Join(found, ", ")),
+				Hint:    "Programs that do not find the environment's copy first may load the host's and fail with missing symbol versions",
+			})
+		}
+	}
+}
+
+// validateGPU checks the cuda: version. A missing driver is only a
+// warning: GPU sandboxes are often built on login nodes without GPUs.
+func validateGPU(cfg *config.Config, result *ValidationResult) {
+	if !cfg.UsesGPU() {
+		return
+	}
+	if cfg.CUDA != "" && !gpu.ValidVersion(cfg.CUDA) {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "cuda",
+			Message: fmt.Sprintf("Unsupported CUDA version: '%s'", cfg.CUDA),
+			Hint:    "Use a CUDA 11, 12 or 13 version such as '12.1', or 'gpu: true' for the newest the driver supports",
+		})
+		return
+	}
+	if problem := gpu.Check(cfg.CUDA); problem != nil {
+		field := "gpu"
+		if cfg.CUDA != "" {
+			field = "cuda"
+		}
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   field,
+			Message: "This host cannot run CUDA: " + problem.Detail,
+			Hint:    problem.Fix,
+		})
+	}
+}
+
+func isSystemLibDir(dir string) bool {
+	for _, system := range systemLibDirs {
+		if dir == system {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEnvFile checks that env_file exists and warns about lines that
+// run, exec and shell would skip
+func validateEnvFile(cfg *config.Config, projectRoot string, result *ValidationResult) {
+	if cfg.EnvFile == "" {
+		return
+	}
+
+	path := config.ResolveEnvFile(projectRoot, cfg.EnvFile)
+	_, problems, err := config.ReadEnvFile(path)
+	if err != nil {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "env_file",
+			Message: fmt.Sprintf("Cannot read env file: %s", err),
+			Hint:    "Create the file or remove env_file from config.yaml",
+		})
+		return
+	}
+	for _, problem := range problems {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "env_file",
+			Message: fmt.Sprintf("%s %s", cfg.EnvFile, problem),
+			Hint:    "Use KEY=VALUE, quoting values with spaces; the line is skipped",
+		})
+	}
+}
+
+// validateSecrets checks that every secret in secrets: is set and can be
+// decrypted with this user's key
+func validateSecrets(cfg *config.Config, projectRoot string, result *ValidationResult) {
+	if len(cfg.Secrets) == 0 {
+		return
+	}
+
+	var store *secrets.Store
+	var keyErr error
+	for _, name := range cfg.Secrets {
+		field := fmt.Sprintf("secrets.%s", name)
+		if !secrets.ValidName(name) {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Invalid secret name '%s'", name),
+				Hint:    "Secrets become environment variables; use letters, digits and _",
+			})
+			continue
+		}
+		if _, ok := cfg.Env[name]; ok {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("'%s' is set in env as well", name),
+				Hint:    "The secret takes precedence; remove it from env",
+			})
+		}
+
+		if store == nil && keyErr == nil {
+			store, keyErr = secrets.Open(projectRoot, false)
+		}
+		if keyErr != nil {
+			break
+		}
+		if _, err := store.Get(name); errors.Is(err, secrets.ErrNotFound) {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Secret '%s' is not set", name),
+				Hint:    fmt.Sprintf("Set it with 'sbox secret set %s'", name),
+			})
+		} else if err != nil {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("Cannot read secret: %s", err),
+				Hint:    fmt.Sprintf("Set it again with 'sbox secret set %s', or use the key it was set with", name),
+			})
+		}
+	}
+
+	if keyErr != nil {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "secrets",
+			Message: fmt.Sprintf("Cannot decrypt secrets: %s", keyErr),
+			Hint:    fmt.Sprintf("Copy ~/.sbox/%s from the host the secrets were set on, or set %s", secrets.KeyFile, secrets.KeyEnv),
+		})
+	}
+}
+
+// validateHooks checks the pre_build, post_build, pre_run and post_run
+// commands
+func validateHooks(cfg *config.Config, result *ValidationResult) {
+	for _, stage := range config.HookStages {
+		// A build hook calling 'sbox build' waits for the build lock its
+		// own build holds; a run hook calling 'sbox run' never ends
+		recursive := "run"
+		if stage == config.HookPreBuild || stage == config.HookPostBuild {
+			recursive = "build"
+		}
+
+		for i, command := range cfg.Hooks(stage) {
+			field := fmt.Sprintf("%s[%d]", stage, i)
+			if strings.TrimSpace(command) == "" {
+				result.Errors = append(result.Errors, ValidationError{
+					Field:   field,
+					Message: "Empty hook command",
+					Hint:    "Remove empty commands or add a valid command",
+				})
+				continue
+			}
+			if m := sboxCallPattern.FindStringSubmatch(command); m != nil && m[2] == recursive {
+				result.Errors = append(result.Errors, ValidationError{
+					Field:   field,
+					Message: fmt.Sprintf("%s hook runs 'sbox %s' recursively", stage, recursive),
+					Hint:    "Hooks already run inside the sandbox environment; call the tool directly",
+				})
+			}
+			if strings.Contains(command, "sudo ") {
+				result.Warnings = append(result.Warnings, ValidationError{
+					Field:   field,
+					Message: "Using sudo in hook command",
+					Hint:    "sbox runs in user space - sudo is not needed and may cause issues. Remove 'sudo' from the command",
+				})
+			}
+		}
+	}
+}
+
+// validateInitTasks checks the names and commands of init_tasks
+func validateInitTasks(cfg *config.Config, result *ValidationResult) {
+	if err := config.CheckInitTasks(cfg.InitTasks); err != nil {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "init_tasks",
+			Message: err.Error(),
+			Hint:    "Give each task a unique name without spaces or '/' and a cmd, e.g. - {name: migrate, cmd: python manage.py migrate}",
+		})
+	}
+}
+
+// validateHealthchecks checks the probes of 'sbox healthcheck'
+func validateHealthchecks(cfg *config.Config, result *ValidationResult) {
+	names := make([]string, 0, len(cfg.Healthchecks))
+	for name := range cfg.Healthchecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := healthcheck.Check(cfg.Healthchecks[name]); err != nil {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   fmt.Sprintf("healthchecks.%s", name),
+				Message: err.Error(),
+				Hint:    "e.g. {http: http://localhost:8000/health, timeout: 5s} or {command: ./check.sh}",
+			})
+		}
+	}
+}
+
+// validateLogging checks the log rotation settings
+func validateLogging(cfg *config.Config, result *ValidationResult) {
+	lc := cfg.Logging
+
+	if lc.MaxSize != "" {
+		if _, err := config.ParseSize(lc.MaxSize); err != nil {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   "logging.max_size",
+				Message: fmt.Sprintf("Invalid log size: '%s'", lc.MaxSize),
+				Hint:    "Use a size such as 10M or 1G",
+			})
+		}
+	}
+
+	if lc.MaxFiles < 0 {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "logging.max_files",
+			Message: fmt.Sprintf("max_files must be positive, got %d", lc.MaxFiles),
+			Hint:    fmt.Sprintf("Remove the key to keep %d rotated logs", process.DefaultLogFiles),
+		})
+	}
+
+	if lc.MaxSize == "" && (lc.MaxFiles > 0 || lc.Compress) {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "logging",
+			Message: "max_files and compress have no effect without max_size",
+			Hint:    "Set logging.max_size, e.g. 10M, to rotate daemon logs",
+		})
+	}
+}
+
+// validateLicenses checks the patterns of the license policy
+func validateLicenses(cfg *config.Config, result *ValidationResult) {
+	denied := make(map[string]bool)
+	for _, pattern := range cfg.Licenses.Deny {
+		denied[strings.ToLower(strings.TrimSpace(pattern))] = true
+	}
+
+	lists := []struct {
+		name     string
+		patterns []string
+	}{{"allow", cfg.Licenses.Allow}, {"deny", cfg.Licenses.Deny}}
+	for _, list := range lists {
+		for i, pattern := range list.patterns {
+			field := fmt.Sprintf("licenses.%s[%d]", list.name, i)
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				result.Errors = append(result.Errors, ValidationError{
+					Field:   field,
+					Message: "Empty license pattern",
+					Hint:    "Use an SPDX identifier such as MIT or a pattern such as GPL-*",
+				})
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				result.Errors = append(result.Errors, ValidationError{
+					Field:   field,
+					Message: fmt.Sprintf("Invalid license pattern: '%s'", pattern),
+					Hint:    "Patterns use * and ? wildcards, e.g. GPL-*",
+				})
+			}
+			if list.name == "allow" && denied[strings.ToLower(pattern)] {
+				result.Warnings = append(result.Warnings, ValidationError{
+					Field:   field,
+					Message: fmt.Sprintf("'%s' is both allowed and denied", pattern),
+					Hint:    "Deny wins; remove it from one of the lists",
+				})
+			}
+		}
+	}
+}
+
+// validateSlurm checks the options 'sbox slurm' writes into sbatch scripts
+func validateSlurm(cfg *config.Config, result *ValidationResult) {
+	sc := cfg.Slurm
+
+	if sc.Time != "" && !slurm.ValidTime(sc.Time) {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "slurm.time",
+			Message: fmt.Sprintf("Invalid time limit: '%s'", sc.Time),
+			Hint:    "Use minutes, HH:MM:SS or D-HH:MM:SS, e.g. 4:00:00",
+		})
+	}
+	if sc.Memory != "" && !slurm.ValidMemory(sc.Memory) {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "slurm.memory",
+			Message: fmt.Sprintf("Invalid memory: '%s'", sc.Memory),
+			Hint:    "Use a size such as 16G or 512M",
+		})
+	}
+	if sc.GPUs != "" && !slurm.ValidGPUs(sc.GPUs) {
+		result.Errors = append(result.Errors, ValidationError{
+			Field:   "slurm.gpus",
+			Message: fmt.Sprintf("Invalid gpus: '%s'", sc.GPUs),
+			Hint:    "Use a count or type:count, e.g. 1 or a100:2",
+		})
+	}
+
+	for _, n := range []struct {
+		field string
+		value int
+	}{
+		{"slurm.nodes", sc.Nodes},
+		{"slurm.cpus", sc.CPUs},
+	} {
+		if n.value < 0 {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   n.field,
+				Message: fmt.Sprintf("Must be positive, got %d", n.value),
+				Hint:    "Remove the key to use the partition default",
+			})
+		}
+	}
+
+	for _, option := range sc.Options {
+		if !strings.HasPrefix(option, "--") || strings.Contains(option, "\n") {
+			result.Errors = append(result.Errors, ValidationError{
+				Field:   "slurm.options",
+				Message: fmt.Sprintf("Invalid sbatch option: '%s'", option),
+				Hint:    "Use the long form, e.g. --constraint=ib",
+			})
+		}
+	}
+
+	configured := sc.Partition != "" || sc.Account != "" || sc.QOS != "" || sc.Time != "" ||
+		sc.Nodes != 0 || sc.CPUs != 0 || sc.Memory != "" || sc.GPUs != "" || len(sc.Options) > 0
+	if configured && !slurm.Available() {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "slurm",
+			Message: "sbatch is not installed on this host",
+			Hint:    "'sbox slurm' can still write the script; submit it from a login node",
+		})
+	}
+}
+
+// validateMPI checks that an MPI launcher in cmd matches the MPI library of
+// the environment, and that the library can use the host's interconnect
+func validateMPI(cfg *config.Config, projectRoot string, result *ValidationResult) {
+	envDir := config.GetEnvDir(projectRoot)
+	lib := mpi.EnvLibrary(envDir)
+	launcher := mpi.Launcher(cfg.Cmd)
+
+	if launcher != "" && filepath.Base(launcher) != "srun" {
+		path := mpi.ResolveLauncher(envDir, launcher)
+		if path == "" {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   "cmd",
+				Message: fmt.Sprintf("MPI launcher '%s' is not installed in the environment or on the host", launcher),
+				Hint:    "Add the MPI package to install, or load the host's MPI module before 'sbox run'",
+			})
+		} else if lib != nil {
+			if impl := mpi.LauncherImplementation(path); impl != "" && impl != lib.Implementation {
+				result.Warnings = append(result.Warnings, ValidationError{
+					Field:   "cmd",
+					Message: fmt.Sprintf("%s is %s, but the environment's MPI library is %s %s", path, impl, lib.Implementation, lib.Version),
+					Hint:    "Ranks fail in MPI_Init with a mismatched launcher; use the environment's launcher or srun",
+				})
+			}
+		}
+	}
+
+	if lib == nil {
+		return
+	}
+
+	if lib.External {
+		_, errRun := exec.LookPath("mpirun")
+		_, errExec := exec.LookPath("mpiexec")
+		if errRun != nil && errExec != nil {
+			result.Warnings = append(result.Warnings, ValidationError{
+				Field:   "install",
+				Message: fmt.Sprintf("The environment uses an external %s build, but no MPI is installed on this host", lib.Implementation),
+				Hint:    "External builds load the host's MPI libraries; load its module (e.g. 'module load openmpi') first",
+			})
+		}
+		return
+	}
+
+	if devices := mpi.HostFabric(); len(devices) > 0 && len(mpi.EnvTransports(envDir)) == 0 {
+		result.Warnings = append(result.Warnings, ValidationError{
+			Field:   "install",
+			Message: fmt.Sprintf("The host has a high-speed interconnect (%s), but the environment's %s %s has no UCX, libfabric or verbs support", strings.Join(devices, ", "), lib.Implementation, lib.Version),
+			Hint:    "Ranks fall back to TCP; install ucx or libfabric into the environment, or an external_* MPI build that uses the host's libraries",
+		})
+	}
+}
@@ -0,0 +1,261 @@
+// Package vcs detects the version control system a project is kept in and
+// keeps the state sbox creates for one machine out of it, through
+// .gitignore or .hgignore.
+package vcs
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Kind is a version control system
+type Kind string
+
+const (
+	Git       Kind = "git"
+	Mercurial Kind = "hg"
+)
+
+// StatePaths are the files and directories sbox creates in a project that
+// belong to one machine, relative to the project root. Directories end
+// in a slash.
+var StatePaths = []string{
+	".sbox/env/",
+	".sbox/rootfs/",
+	".sbox/bin/",
+	".sbox/mamba/",
+	".sbox/logs/",
+	".sbox/secrets/",
+	".sbox/shell/",
+	".sbox/users/",
+	".sbox/crashes/",
+	".sbox/profiles/",
+	".sbox/isolate/",
+	".sbox/slurm/",
+	".sbox/env.sh",
+	".sbox/ide.json",
+	".sbox/builds.jsonl",
+	".sbox/build.lock",
+	".sbox/processes.json",
+	".sbox/daemon.sock",
+	".sbox/relocate.journal",
+	".sbox/constraints.txt",
+}
+
+// Repo is the repository a project belongs to
+type Repo struct {
+	Kind Kind
+	// Root is the top of the work tree
+	Root string
+}
+
+// Detect finds the repository dir belongs to by looking for .git or .hg
+// in it and its parents. It returns nil when dir is not in one.
+func Detect(dir string) *Repo {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	for {
+		// .git is a file in worktrees and submodules
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return &Repo{Kind: Git, Root: dir}
+		}
+		if info, err := os.Stat(filepath.Join(dir, ".hg")); err == nil && info.IsDir() {
+			return &Repo{Kind: Mercurial, Root: dir}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+// IgnoreFile returns the ignore file for a project: its own .gitignore,
+// or the .hgignore at the root of the repository, the only one Mercurial
+// reads
+func (r *Repo) IgnoreFile(projectRoot string) string {
+	if r.Kind == Mercurial {
+		return filepath.Join(r.Root, ".hgignore")
+	}
+	return filepath.Join(projectRoot, ".gitignore")
+}
+
+// Unignored returns the StatePaths that exist in a project but are not
+// ignored
+func (r *Repo) Unignored(projectRoot string) []string {
+	var existing []string
+	for _, path := range StatePaths {
+		if _, err := os.Lstat(filepath.Join(projectRoot, filepath.FromSlash(path))); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+
+	if r.Kind == Git {
+		if ignored, err := checkIgnore(projectRoot, existing); err == nil {
+			var missing []string
+			for _, path := range existing {
+				if !ignored[strings.TrimSuffix(path, "/")] {
+					missing = append(missing, path)
+				}
+			}
+			return missing
+		}
+	}
+
+	// Without git, only patterns in the ignore file naming the path or
+	// one of its directories count
+	patterns := map[string]bool{}
+	for _, line := range readLines(r.IgnoreFile(projectRoot)) {
+		patterns[r.normalize(projectRoot, line)] = true
+	}
+	var missing []string
+	for _, path := range existing {
+		covered := false
+		for p := strings.TrimSuffix(path, "/"); p != "."; p = filepath.ToSlash(filepath.Dir(p)) {
+			if patterns[p] {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			missing = append(missing, path)
+		}
+	}
+	return missing
+}
+
+// Ignore adds patterns, relative to the project root, to the ignore file
+// unless it already has them, creating it if needed. For Mercurial they
+// are made relative to the repository root.
+func (r *Repo) Ignore(projectRoot string, patterns []string) error {
+	path := r.IgnoreFile(projectRoot)
+	have := map[string]bool{}
+	lines := readLines(path)
+	for _, line := range lines {
+		have[strings.TrimSpace(line)] = true
+	}
+
+	var add []string
+	for _, pattern := range patterns {
+		pattern = r.pattern(projectRoot, pattern)
+		if !have[pattern] {
+			have[pattern] = true
+			add = append(add, pattern)
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+
+	var sb strings.Builder
+	if data, err := os.ReadFile(path); err == nil && len(data) > 0 && data[len(data)-1] != '\n' {
+		sb.WriteString("\n")
+	}
+	if r.Kind == Mercurial {
+		sb.WriteString("syntax: glob\n")
+	}
+	for _, pattern := range add {
+		sb.WriteString(pattern + "\n")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(sb.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pattern turns a pattern relative to the project root into one for the
+// ignore file. Mercurial globs do not mark directories with a slash and
+// are relative to the repository root when they contain one.
+func (r *Repo) pattern(projectRoot, pattern string) string {
+	if r.Kind != Mercurial {
+		return pattern
+	}
+	pattern = strings.TrimSuffix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		return pattern
+	}
+	if rel := r.rel(projectRoot); rel != "" {
+		pattern = rel + "/" + pattern
+	}
+	return pattern
+}
+
+// normalize turns a line of the ignore file into a path relative to the
+// project root, the inverse of pattern
+func (r *Repo) normalize(projectRoot, line string) string {
+	line = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(line), "/"), "/")
+	if r.Kind == Mercurial {
+		line = strings.TrimPrefix(line, "glob:")
+		if rel := r.rel(projectRoot); rel != "" {
+			line = strings.TrimPrefix(line, rel+"/")
+		}
+	}
+	return line
+}
+
+// rel returns the project directory relative to the repository root, or
+// "" for the root itself
+func (r *Repo) rel(projectRoot string) string {
+	abs, err := filepath.Abs(projectRoot)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(r.Root, abs)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// checkIgnore asks git which of paths its ignore rules match, tracked or
+// not
+func checkIgnore(dir string, paths []string) (map[string]bool, error) {
+	args := []string{"check-ignore", "--no-index", "--"}
+	for _, path := range paths {
+		args = append(args, strings.TrimSuffix(path, "/"))
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	// check-ignore exits 1 when no path is ignored
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return nil, err
+	}
+	ignored := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			ignored[filepath.ToSlash(line)] = true
+		}
+	}
+	return ignored, nil
+}
+
+func readLines(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
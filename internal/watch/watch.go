@@ -0,0 +1,143 @@
+// Package watch finds changes to a project's copy sources and config for
+// 'sbox watch'. It compares the size, mode and modification time of every
+// file on each scan instead of using inotify, so it needs no extra
+// dependency and also sees changes made on network filesystems.
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbox-project/sbox/internal/config"
+)
+
+// manifests are the dependency files whose changes call for the install
+// commands to run again
+var manifests = []string{
+	"requirements*.txt", "constraints*.txt", "pyproject.toml", "setup.py",
+	"setup.cfg", "Pipfile", "Pipfile.lock", "poetry.lock", "uv.lock",
+	"environment.yml", "environment.yaml",
+	"package.json", "package-lock.json", "yarn.lock", "pnpm-lock.yaml",
+}
+
+type file struct {
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// Watcher finds the files that changed between two scans
+type Watcher struct {
+	paths []string
+	files map[string]file
+}
+
+// New returns a watcher of the project's config.yaml and the copy
+// sources of cfg, with their current state as the baseline
+func New(projectRoot string, cfg *config.Config) *Watcher {
+	w := &Watcher{paths: []string{config.GetConfigPath(projectRoot)}}
+	for _, spec := range cfg.ParseCopy() {
+		w.paths = append(w.paths, filepath.Join(projectRoot, strings.TrimPrefix(spec.Src, "./")))
+	}
+	w.files = w.scan()
+	return w
+}
+
+// Paths returns the watched files and directories
+func (w *Watcher) Paths() []string {
+	return w.paths
+}
+
+// Scan returns the files added, changed or removed since the last scan,
+// sorted
+func (w *Watcher) Scan() []string {
+	current := w.scan()
+	var changed []string
+	for path, f := range current {
+		if previous, ok := w.files[path]; !ok || previous != f {
+			changed = append(changed, path)
+		}
+	}
+	for path := range w.files {
+		if _, ok := current[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	w.files = current
+	sort.Strings(changed)
+	return changed
+}
+
+// Wait scans every interval until files change, then until a scan finds
+// no further changes, so that a save touching several files or a
+// checkout leads to a single restart. It returns the changed files, or
+// false when done is closed first.
+func (w *Watcher) Wait(interval time.Duration, done <-chan struct{}) ([]string, bool) {
+	seen := make(map[string]bool)
+	for {
+		select {
+		case <-done:
+			return nil, false
+		case <-time.After(interval):
+		}
+
+		changed := w.Scan()
+		for _, path := range changed {
+			seen[path] = true
+		}
+		if len(changed) == 0 && len(seen) > 0 {
+			break
+		}
+	}
+
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, true
+}
+
+// scan records every file under the watched paths; a symlinked source
+// is followed, as the copy step does
+func (w *Watcher) scan() map[string]file {
+	files := make(map[string]file)
+	for _, root := range w.paths {
+		resolved, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		filepath.Walk(resolved, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			// The copy step skips .sbox as well
+			if info.IsDir() && info.Name() == config.SboxDir && path != resolved {
+				return filepath.SkipDir
+			}
+			if info.IsDir() {
+				return nil
+			}
+			// Report paths under the configured source, not its target
+			rel, _ := filepath.Rel(resolved, path)
+			files[filepath.Join(root, rel)] = file{info.Size(), info.Mode(), info.ModTime()}
+			return nil
+		})
+	}
+	return files
+}
+
+// IsManifest reports whether path is a dependency file such as
+// requirements.txt or package.json
+func IsManifest(path string) bool {
+	name := filepath.Base(path)
+	for _, pattern := range manifests {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}